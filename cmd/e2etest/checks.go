@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+)
+
+// Ports of a run, above --base-port.
+const (
+	coordinatorAPIPort     = 0
+	coordinatorProxyPort   = 1
+	coordinatorMetricsPort = 2
+	targetPort             = 3
+	agentAPIPort           = 10 // agent i's API is at 10+2i and its metrics at 11+2i
+)
+
+// pollInterval is how often a check that waits for the cluster looks
+// again.
+const pollInterval = 500 * time.Millisecond
+
+// harness runs the checks against a cluster.
+type harness struct {
+	logger  *logrus.Logger
+	opts    options
+	cluster cluster
+	client  *http.Client
+	target  *http.Server
+	nodes   []string // agents' node IDs, in start order
+	exits   []models.PoolExit
+	killed  string
+}
+
+func newHarness(logger *logrus.Logger, opts options, c cluster) *harness {
+	return &harness{logger: logger, opts: opts, cluster: c, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// run runs the checks in order, stopping at the first that fails since
+// the later ones build on it.
+func (h *harness) run() error {
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"cluster starts", h.start},
+		{"pool converges", h.checkConvergence},
+		{"traffic reaches every exit", h.checkTraffic},
+		{"metrics add up", h.checkMetrics},
+		{"exit rotates", h.checkRotation},
+		{"traffic fails over from a dead node", h.checkFailover},
+	}
+	for _, check := range checks {
+		started := time.Now()
+		if err := check.run(); err != nil {
+			return fmt.Errorf("%s: %w", check.name, err)
+		}
+		h.logger.Infof("PASS %s (%s)", check.name, time.Since(started).Round(100*time.Millisecond))
+	}
+	return nil
+}
+
+func (h *harness) close() {
+	h.cluster.stop()
+	if h.target != nil {
+		h.target.Close()
+	}
+	removeAddresses(h.logger)
+}
+
+func (h *harness) port(offset int) int { return h.opts.basePort + offset }
+
+func (h *harness) apiURL(path string) string {
+	return fmt.Sprintf("http://localhost:%d%s", h.port(coordinatorAPIPort), path)
+}
+
+func (h *harness) agentURL(i int, path string) string {
+	return fmt.Sprintf("http://localhost:%d%s", h.port(agentAPIPort+2*i), path)
+}
+
+// eventually calls check until it passes or the check timeout is up, and
+// then returns its last error.
+func (h *harness) eventually(check func() error) error {
+	deadline := time.Now().Add(h.opts.timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not within %s: %w", h.opts.timeout, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (h *harness) start() error {
+	if err := h.startTarget(); err != nil {
+		return err
+	}
+
+	// Exits fail over after a single refused connection, to as many
+	// exits as a dead node has and one more
+	coordinatorArgs := []string{
+		"--port", strconv.Itoa(h.port(coordinatorAPIPort)),
+		"--proxy-port", strconv.Itoa(h.port(coordinatorProxyPort)),
+		"--metrics-port", strconv.Itoa(h.port(coordinatorMetricsPort)),
+		"--store", "memory",
+		"--health-interval", "5s",
+		"--egress-headers",
+		"--passive-health-failures", "1",
+		"--retry-attempts", strconv.Itoa(h.opts.proxies + 1),
+	}
+	if err := h.cluster.start(componentCoordinator, componentCoordinator, coordinatorArgs); err != nil {
+		return err
+	}
+	if err := h.eventually(func() error { return h.get(h.apiURL("/health"), nil) }); err != nil {
+		return fmt.Errorf("coordinator is not up: %w", err)
+	}
+
+	for i := 0; i < h.opts.agents; i++ {
+		nodeID := fmt.Sprintf("e2e-%d", i)
+		proxyStart := h.port(agentPortBase + i*agentPortSpan)
+		args := []string{
+			"--node-id", nodeID,
+			"--coordinator", h.apiURL(""),
+			"--report-interval", "2s",
+			"--health-interval", "5s",
+			"--port", strconv.Itoa(h.port(agentAPIPort + 2*i)),
+			"--metrics-port", strconv.Itoa(h.port(agentAPIPort + 2*i + 1)),
+			"--proxy-start", strconv.Itoa(proxyStart),
+			"--proxy-end", strconv.Itoa(proxyStart + agentPortSpan - 1),
+			"--proxy-backend", "embedded",
+			"--proxy-mode", "open",
+			"--ipv6-prefix", agentPrefix(i),
+			"--ipv6-interface", "lo",
+			"--ipv6-count", strconv.Itoa(h.opts.proxies),
+			"--state-file", fmt.Sprintf("%s/%s-state.json", h.cluster.stateDir(), nodeID),
+			"--archive-file", fmt.Sprintf("%s/%s-archive.json", h.cluster.stateDir(), nodeID),
+			"--adopt-proxies=false",
+			"--drain-timeout", "0",
+			"--log-level", "info",
+		}
+		if err := h.cluster.start(nodeID, componentAgent, args); err != nil {
+			return err
+		}
+		h.nodes = append(h.nodes, nodeID)
+	}
+	return nil
+}
+
+// checkConvergence waits for every instance of every agent to be in the
+// coordinator's pool.
+func (h *harness) checkConvergence() error {
+	want := h.opts.agents * h.opts.proxies
+	return h.eventually(func() error {
+		var snapshot models.PoolSnapshot
+		if err := h.get(h.apiURL("/api/pool/snapshot"), &snapshot); err != nil {
+			return err
+		}
+		perNode := map[string]int{}
+		for _, exit := range snapshot.Exits {
+			perNode[exit.NodeID]++
+		}
+		var short []string
+		for _, nodeID := range h.nodes {
+			if perNode[nodeID] != h.opts.proxies {
+				short = append(short, fmt.Sprintf("%s has %d", nodeID, perNode[nodeID]))
+			}
+		}
+		if len(snapshot.Exits) != want || len(short) > 0 {
+			return fmt.Errorf("%d of %d exits in the pool (%s)", len(snapshot.Exits), want, strings.Join(short, ", "))
+		}
+		h.exits = snapshot.Exits
+		return nil
+	})
+}
+
+// checkTraffic sends traffic through the coordinator and expects every
+// request to succeed and every exit to carry some of it.
+func (h *harness) checkTraffic() error {
+	results := h.sendTraffic(h.opts.requests)
+	if err := failures(results); err != nil {
+		return err
+	}
+	ips, nodes := egressCounts(results)
+	for _, exit := range h.exits {
+		if ips[exit.IP] == 0 {
+			return fmt.Errorf("no request left through %s of %s (served: %v)", exit.IP, exit.NodeID, ips)
+		}
+	}
+	h.logger.Infof("%d requests spread over %d exits of %d nodes: %v", len(results), len(ips), len(nodes), nodes)
+	return nil
+}
+
+// checkMetrics compares the coordinator's and agents' metrics with what
+// the cluster was seen doing.
+func (h *harness) checkMetrics() error {
+	families, err := h.scrape(h.port(coordinatorMetricsPort))
+	if err != nil {
+		return err
+	}
+	expect := []struct {
+		name   string
+		labels map[string]string
+		min    float64
+		max    float64
+	}{
+		{"proxy_v6_nodes", nil, float64(h.opts.agents), float64(h.opts.agents)},
+		{"proxy_v6_lb_exits", map[string]string{"state": "healthy"}, float64(len(h.exits)), float64(len(h.exits))},
+		{"proxy_v6_lb_exit_selections_total", nil, float64(h.opts.requests), -1},
+	}
+	for _, e := range expect {
+		value := metricSum(families, e.name, e.labels)
+		if value < e.min || (e.max >= 0 && value > e.max) {
+			return fmt.Errorf("coordinator %s%v is %g, want %s", e.name, e.labels, value, expected(e.min, e.max))
+		}
+	}
+
+	for i := range h.nodes {
+		families, err := h.scrape(h.port(agentAPIPort + 2*i + 1))
+		if err != nil {
+			return err
+		}
+		created := metricSum(families, "proxy_v6_agent_lifecycle_events_total", map[string]string{"type": models.ProxyEventCreated})
+		if created < float64(h.opts.proxies) {
+			return fmt.Errorf("%s counted %g created events, want at least %d", h.nodes[i], created, h.opts.proxies)
+		}
+	}
+	return nil
+}
+
+func expected(min, max float64) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("at least %g", min)
+	case min == max:
+		return fmt.Sprintf("%g", min)
+	}
+	return fmt.Sprintf("%g to %g", min, max)
+}
+
+// checkRotation rotates an exit of the first agent and expects the pool,
+// the lifecycle events and traffic to follow it to its new address.
+func (h *harness) checkRotation() error {
+	var instances []models.ProxyInstance
+	if err := h.get(h.agentURL(0, "/proxies"), &instances); err != nil {
+		return err
+	}
+	var old *models.ProxyInstance
+	for i := range instances {
+		if instances[i].Status == models.ProxyStatusRunning {
+			old = &instances[i]
+			break
+		}
+	}
+	if old == nil {
+		return fmt.Errorf("%s has no running instance", h.nodes[0])
+	}
+	var rotated models.ProxyInstance
+	if err := h.post(h.agentURL(0, "/proxy/"+url.PathEscape(old.ID)+"/rotate"), &rotated); err != nil {
+		return err
+	}
+	oldIP, newIP := old.IPv6.IP.String(), rotated.IPv6.IP.String()
+	h.logger.Infof("Rotated %s from %s to %s", old.ID, oldIP, newIP)
+
+	if err := h.eventually(func() error {
+		var snapshot models.PoolSnapshot
+		if err := h.get(h.apiURL("/api/pool/snapshot"), &snapshot); err != nil {
+			return err
+		}
+		seenOld, seenNew := false, false
+		for _, exit := range snapshot.Exits {
+			seenOld = seenOld || exit.IP == oldIP
+			seenNew = seenNew || exit.IP == newIP
+		}
+		if seenOld || !seenNew {
+			return fmt.Errorf("pool has %s: %t, %s: %t", oldIP, seenOld, newIP, seenNew)
+		}
+		h.exits = snapshot.Exits
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := h.eventually(func() error {
+		var events []models.ProxyEvent
+		query := url.Values{"node": {h.nodes[0]}, "type": {models.ProxyEventRotated}}
+		if err := h.get(h.apiURL("/api/events?"+query.Encode()), &events); err != nil {
+			return err
+		}
+		for _, e := range events {
+			if e.PreviousIP == oldIP && e.IP == newIP {
+				return nil
+			}
+		}
+		return fmt.Errorf("no rotated event from %s to %s among %d", oldIP, newIP, len(events))
+	}); err != nil {
+		return err
+	}
+
+	results := h.sendTraffic(h.opts.requests)
+	if err := failures(results); err != nil {
+		return err
+	}
+	ips, _ := egressCounts(results)
+	if ips[oldIP] > 0 || ips[newIP] == 0 {
+		return fmt.Errorf("after rotation %s served %d requests and %s %d", oldIP, ips[oldIP], newIP, ips[newIP])
+	}
+	return nil
+}
+
+// checkFailover kills the last agent and expects its exits to be taken
+// out of rotation without a request failing.
+func (h *harness) checkFailover() error {
+	h.killed = h.nodes[len(h.nodes)-1]
+	if err := h.cluster.kill(h.killed); err != nil {
+		return fmt.Errorf("failed to kill %s: %w", h.killed, err)
+	}
+	h.logger.Infof("Killed %s", h.killed)
+
+	results := h.sendTraffic(h.opts.requests)
+	if err := failures(results); err != nil {
+		return err
+	}
+	if _, nodes := egressCounts(results); nodes[h.killed] > 0 {
+		return fmt.Errorf("%d requests left through %s after it was killed", nodes[h.killed], h.killed)
+	}
+
+	return h.eventually(func() error {
+		families, err := h.scrape(h.port(coordinatorMetricsPort))
+		if err != nil {
+			return err
+		}
+		if healthy := metricSum(families, "proxy_v6_lb_exits", map[string]string{"node": h.killed, "state": "healthy"}); healthy > 0 {
+			return fmt.Errorf("%g exits of %s are still healthy", healthy, h.killed)
+		}
+		return nil
+	})
+}
+
+// get fetches url and decodes its JSON into out unless out is nil.
+func (h *harness) get(url string, out interface{}) error {
+	return h.call(http.MethodGet, url, out)
+}
+
+func (h *harness) post(url string, out interface{}) error {
+	return h.call(http.MethodPost, url, out)
+}
+
+func (h *harness) call(method, url string, out interface{}) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: status %d: %s", method, url, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// scrape reads the Prometheus metrics served on port.
+func (h *harness) scrape(port int) (map[string]*dto.MetricFamily, error) {
+	resp, err := h.client.Get(fmt.Sprintf("http://localhost:%d/metrics", port))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// metricSum adds up the series of name carrying labels.
+func metricSum(families map[string]*dto.MetricFamily, name string, labels map[string]string) float64 {
+	family, ok := families[name]
+	if !ok {
+		return 0
+	}
+	sum := 0.0
+	for _, m := range family.GetMetric() {
+		if !hasLabels(m, labels) {
+			continue
+		}
+		switch {
+		case m.Gauge != nil:
+			sum += m.GetGauge().GetValue()
+		case m.Counter != nil:
+			sum += m.GetCounter().GetValue()
+		case m.Untyped != nil:
+			sum += m.GetUntyped().GetValue()
+		}
+	}
+	return sum
+}
+
+func hasLabels(m *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, pair := range m.GetLabel() {
+		if want, ok := labels[pair.GetName()]; ok {
+			if pair.GetValue() != want {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// maxAgents bounds --agents by the ports below --base-port +
+	// agentPortBase that the agents' APIs and metrics take.
+	maxAgents = 40
+	// agentPortBase is how far above --base-port the agents' proxy ports
+	// start, agentPortSpan ports for each agent.
+	agentPortBase = 100
+	agentPortSpan = 100
+
+	// e2ePrefix is where the agents' /64s are taken from, one each.
+	e2ePrefix = "fd00:e2e::/48"
+
+	// stopTimeout is how long a component gets to shut down before it is
+	// killed.
+	stopTimeout = 30 * time.Second
+)
+
+// Components a cluster runs.
+const (
+	componentCoordinator = "coordinator"
+	componentAgent       = "agent"
+)
+
+// cluster runs the components of a run.
+type cluster interface {
+	// start runs component as name with args
+	start(name, component string, args []string) error
+	// kill stops name at once, as a crash would
+	kill(name string) error
+	// stop shuts down every component, the last started first
+	stop()
+	// stateDir is where agents keep their state and archive files
+	stateDir() string
+}
+
+// processCluster runs components as child processes of this binary, each
+// logging to its own file in the work directory.
+type processCluster struct {
+	logger  *logrus.Logger
+	exe     string
+	workDir string
+	procs   map[string]*process
+	order   []string
+}
+
+type process struct {
+	cmd  *exec.Cmd
+	log  *os.File
+	done chan struct{} // closed once the process exited
+}
+
+func newProcessCluster(logger *logrus.Logger, workDir string) (*processCluster, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &processCluster{logger: logger, exe: exe, workDir: workDir, procs: make(map[string]*process)}, nil
+}
+
+func (c *processCluster) start(name, component string, args []string) error {
+	log, err := os.Create(filepath.Join(c.workDir, name+".log"))
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(c.exe, append([]string{component}, args...)...)
+	cmd.Dir = c.workDir
+	cmd.Stdout, cmd.Stderr = log, log
+	if err := cmd.Start(); err != nil {
+		log.Close()
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	p := &process{cmd: cmd, log: log, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		log.Close()
+		close(p.done)
+	}()
+	c.procs[name] = p
+	c.order = append(c.order, name)
+	return nil
+}
+
+func (c *processCluster) kill(name string) error {
+	p, ok := c.procs[name]
+	if !ok {
+		return fmt.Errorf("%s is not running", name)
+	}
+	if err := p.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	<-p.done
+	return nil
+}
+
+func (c *processCluster) stop() {
+	for i := len(c.order) - 1; i >= 0; i-- {
+		name := c.order[i]
+		p := c.procs[name]
+		select {
+		case <-p.done:
+			continue
+		default:
+		}
+		p.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-p.done:
+		case <-time.After(stopTimeout):
+			c.logger.Warnf("%s did not stop within %s, killing it", name, stopTimeout)
+			p.cmd.Process.Kill()
+			<-p.done
+		}
+	}
+}
+
+func (c *processCluster) stateDir() string { return c.workDir }
+
+// agentPrefix is the /64 agent i allocates its addresses from.
+func agentPrefix(i int) string {
+	return fmt.Sprintf("fd00:e2e:0:%x::/64", i+1)
+}
+
+// removeAddresses deletes what is left on lo of the agents' addresses,
+// which agents that were killed had no chance to remove.
+func removeAddresses(logger *logrus.Logger) {
+	_, prefix, err := net.ParseCIDR(e2ePrefix)
+	if err != nil {
+		logger.Warnf("Invalid prefix %s: %v", e2ePrefix, err)
+		return
+	}
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		logger.Warnf("Failed to find lo: %v", err)
+		return
+	}
+	addrs, err := netlink.AddrList(lo, netlink.FAMILY_V6)
+	if err != nil {
+		logger.Warnf("Failed to list the addresses of lo: %v", err)
+		return
+	}
+	removed := 0
+	for _, addr := range addrs {
+		if !prefix.Contains(addr.IP) {
+			continue
+		}
+		if err := netlink.AddrDel(lo, &addr); err != nil {
+			logger.Warnf("Failed to remove %s from lo: %v", addr.IP, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		logger.Infof("Removed %d addresses left on lo", removed)
+	}
+}
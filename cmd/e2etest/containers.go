@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"github.com/sirupsen/logrus"
+)
+
+// containerPrefix names the images and containers of a run.
+const containerPrefix = "proxy-v6-e2e-"
+
+// containerCluster runs components in containers built from the
+// repository's Dockerfiles. They share the host network, so ports and the
+// agents' addresses on lo are the same as with processes.
+type containerCluster struct {
+	logger    *logrus.Logger
+	pool      *dockertest.Pool
+	workDir   string
+	resources map[string]*dockertest.Resource
+	order     []string
+}
+
+func newContainerCluster(logger *logrus.Logger, opts options) (*containerCluster, error) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to docker: %w", err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		return nil, fmt.Errorf("docker is not reachable: %w", err)
+	}
+
+	for _, component := range []string{componentCoordinator, componentAgent} {
+		logger.Infof("Building the %s image from %s", component, opts.context)
+		log, err := os.Create(filepath.Join(opts.workDir, "build-"+component+".log"))
+		if err != nil {
+			return nil, err
+		}
+		err = pool.Client.BuildImage(docker.BuildImageOptions{
+			Name:         containerPrefix + component,
+			Dockerfile:   "Dockerfile." + component,
+			ContextDir:   opts.context,
+			OutputStream: log,
+		})
+		log.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build the %s image: %w", component, err)
+		}
+	}
+	return &containerCluster{logger: logger, pool: pool, workDir: opts.workDir, resources: make(map[string]*dockertest.Resource)}, nil
+}
+
+func (c *containerCluster) start(name, component string, args []string) error {
+	// Left over by a run that was interrupted
+	if err := c.pool.RemoveContainerByName(containerPrefix + name); err != nil {
+		return err
+	}
+	resource, err := c.pool.RunWithOptions(&dockertest.RunOptions{
+		Name:       containerPrefix + name,
+		Repository: containerPrefix + component,
+		Tag:        "latest",
+		Cmd:        args,
+		// Agents add their addresses to the host's lo
+		Privileged: component == componentAgent,
+	}, func(hc *docker.HostConfig) {
+		hc.NetworkMode = "host"
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	c.resources[name] = resource
+	c.order = append(c.order, name)
+	return nil
+}
+
+func (c *containerCluster) kill(name string) error {
+	resource, ok := c.resources[name]
+	if !ok {
+		return fmt.Errorf("%s is not running", name)
+	}
+	return c.pool.Client.KillContainer(docker.KillContainerOptions{ID: resource.Container.ID, Signal: docker.SIGKILL})
+}
+
+// stop also saves each container's output to its log in the work
+// directory before removing it.
+func (c *containerCluster) stop() {
+	for i := len(c.order) - 1; i >= 0; i-- {
+		name := c.order[i]
+		resource := c.resources[name]
+		if err := c.pool.Client.StopContainer(resource.Container.ID, uint(stopTimeout.Seconds())); err != nil {
+			if _, stopped := err.(*docker.ContainerNotRunning); !stopped {
+				c.logger.Warnf("Failed to stop %s: %v", name, err)
+			}
+		}
+		if log, err := os.Create(filepath.Join(c.workDir, name+".log")); err == nil {
+			c.pool.Client.Logs(docker.LogsOptions{
+				Container:    resource.Container.ID,
+				OutputStream: log,
+				ErrorStream:  log,
+				Stdout:       true,
+				Stderr:       true,
+			})
+			log.Close()
+		}
+		if err := c.pool.Purge(resource); err != nil {
+			c.logger.Warnf("Failed to remove %s: %v", name, err)
+		}
+	}
+}
+
+// stateDir is inside each agent's own container.
+func (c *containerCluster) stateDir() string { return "/tmp" }
@@ -0,0 +1,147 @@
+// Command e2etest brings up a coordinator and several agents on this host,
+// sends traffic through them and checks that the pool converges, exits
+// rotate, traffic fails over from a dead node and the metrics add up. It
+// exits non-zero when a check fails, so it can gate CI.
+//
+// Agents use the embedded proxy backend and add their addresses to lo from
+// fd00:e2e::/48, so the harness needs root (or CAP_NET_ADMIN). With
+// --containers the coordinator and agents run from the repository's
+// Dockerfiles instead of as processes of this binary.
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"proxy-v6/internal/app/agent"
+	"proxy-v6/internal/app/coordinator"
+	"proxy-v6/pkg/version"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// options configure a run.
+type options struct {
+	agents      int
+	proxies     int // per agent
+	requests    int // per traffic check
+	concurrency int
+	basePort    int
+	timeout     time.Duration // for each check to pass
+	workDir     string
+	keep        bool
+	containers  bool
+	context     string // docker build context of --containers
+}
+
+func main() {
+	var opts options
+	rootCmd := &cobra.Command{
+		Use:          "e2etest",
+		Short:        "Run a local cluster and check pool convergence, rotation, failover and metrics",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(opts)
+		},
+	}
+	flags := rootCmd.Flags()
+	flags.IntVar(&opts.agents, "agents", 3, "Simulated agent nodes to start (at least 2, at most 40)")
+	flags.IntVar(&opts.proxies, "proxies", 2, "Proxy instances per agent")
+	flags.IntVar(&opts.requests, "requests", 60, "Requests the traffic generator sends per traffic check")
+	flags.IntVar(&opts.concurrency, "concurrency", 4, "Requests the traffic generator has in flight at once")
+	flags.IntVar(&opts.basePort, "base-port", 31000, "First of the ports the cluster listens on")
+	flags.DurationVar(&opts.timeout, "timeout", 90*time.Second, "How long each check may take to pass")
+	flags.StringVar(&opts.workDir, "work-dir", "", "Directory for logs and state files (default: a temporary directory)")
+	flags.BoolVar(&opts.keep, "keep", false, "Keep the work directory after a successful run")
+	flags.BoolVar(&opts.containers, "containers", false, "Run the coordinator and agents in Docker containers on the host network")
+	flags.StringVar(&opts.context, "context", ".", "Repository root the container images are built from, with --containers")
+
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print version information",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(version.GetVersion())
+		},
+	}
+
+	// The cluster's processes are this binary again, so a run needs nothing
+	// built beforehand
+	agentCmd := agent.Command()
+	agentCmd.Hidden = true
+	coordinatorCmd := coordinator.Command()
+	coordinatorCmd.Hidden = true
+
+	rootCmd.AddCommand(versionCmd, agentCmd, coordinatorCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func (o options) validate() error {
+	if o.agents < 2 || o.agents > maxAgents {
+		return fmt.Errorf("--agents must be between 2 and %d, failover needs a node to survive", maxAgents)
+	}
+	if o.proxies < 1 || o.proxies > agentPortSpan {
+		return fmt.Errorf("--proxies must be between 1 and %d", agentPortSpan)
+	}
+	if o.requests < o.agents*o.proxies {
+		return fmt.Errorf("--requests must be at least the %d exits, to reach each of them", o.agents*o.proxies)
+	}
+	if o.concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	if o.basePort < 1024 || o.basePort+agentPortBase+maxAgents*agentPortSpan > 65535 {
+		return fmt.Errorf("--base-port must leave room for %d ports above it", agentPortBase+maxAgents*agentPortSpan)
+	}
+	if !o.containers && os.Geteuid() != 0 {
+		return fmt.Errorf("agents add their addresses to lo, run as root")
+	}
+	return nil
+}
+
+func run(opts options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	removeWorkDir := opts.workDir == ""
+	if removeWorkDir {
+		dir, err := os.MkdirTemp("", "proxy-v6-e2e-")
+		if err != nil {
+			return err
+		}
+		opts.workDir = dir
+	} else if err := os.MkdirAll(opts.workDir, 0755); err != nil {
+		return err
+	}
+
+	logger := logrus.StandardLogger()
+	var c cluster
+	var err error
+	if opts.containers {
+		c, err = newContainerCluster(logger, opts)
+	} else {
+		c, err = newProcessCluster(logger, opts.workDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	h := newHarness(logger, opts, c)
+	err = h.run()
+	h.close()
+	if err != nil {
+		logger.Errorf("FAIL: %v", err)
+		logger.Infof("Logs are in %s", opts.workDir)
+		return err
+	}
+	logger.Infof("All checks passed")
+	if removeWorkDir && !opts.keep {
+		os.RemoveAll(opts.workDir)
+	} else {
+		logger.Infof("Logs are in %s", opts.workDir)
+	}
+	return nil
+}
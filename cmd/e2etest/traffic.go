@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/loadbalancer"
+)
+
+// result is one request of the traffic generator.
+type result struct {
+	status     int
+	egressIP   string
+	egressNode string
+	err        error
+}
+
+// startTarget serves the destination the traffic generator requests
+// through the cluster, on the loopback address the exits can reach.
+func (h *harness) startTarget() error {
+	listener, err := net.Listen("tcp", h.targetAddr())
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", h.targetAddr(), err)
+	}
+	h.target = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "ok from %s\n", r.RemoteAddr)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go h.target.Serve(listener)
+	return nil
+}
+
+func (h *harness) targetAddr() string {
+	return fmt.Sprintf("[::1]:%d", h.port(targetPort))
+}
+
+// sendTraffic sends n requests through the coordinator's proxy port, with
+// the configured number in flight at once.
+func (h *harness) sendTraffic(n int) []result {
+	proxyURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", h.port(coordinatorProxyPort))}
+	client := &http.Client{
+		Timeout:   15 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	defer client.CloseIdleConnections()
+
+	results := make([]result, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < h.opts.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = request(client, "http://"+h.targetAddr()+"/")
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+func request(client *http.Client, target string) result {
+	resp, err := client.Get(target)
+	if err != nil {
+		return result{err: err}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return result{
+		status:     resp.StatusCode,
+		egressIP:   resp.Header.Get(loadbalancer.EgressIPHeader),
+		egressNode: resp.Header.Get(loadbalancer.EgressNodeHeader),
+	}
+}
+
+// failures describes the requests that did not get a 200, nil when all
+// did.
+func failures(results []result) error {
+	failed := map[string]int{}
+	count := 0
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			failed[r.err.Error()]++
+		case r.status != http.StatusOK:
+			failed[fmt.Sprintf("status %d", r.status)]++
+		default:
+			continue
+		}
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	reasons := make([]string, 0, len(failed))
+	for reason, n := range failed {
+		reasons = append(reasons, fmt.Sprintf("%dx %s", n, reason))
+	}
+	sort.Strings(reasons)
+	return fmt.Errorf("%d of %d requests failed: %s", count, len(results), strings.Join(reasons, "; "))
+}
+
+// egressCounts counts the requests each exit address and node served.
+func egressCounts(results []result) (ips, nodes map[string]int) {
+	ips, nodes = map[string]int{}, map[string]int{}
+	for _, r := range results {
+		if r.err == nil && r.status == http.StatusOK {
+			ips[r.egressIP]++
+			nodes[r.egressNode]++
+		}
+	}
+	return ips, nodes
+}
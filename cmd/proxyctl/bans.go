@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"proxy-v6/internal/banlist"
+	"proxy-v6/pkg/models"
+
+	"github.com/spf13/cobra"
+)
+
+func bansCommand() *cobra.Command {
+	bansCmd := &cobra.Command{
+		Use:   "bans",
+		Short: "Share the exit bans the coordinator learned or imported",
+	}
+	bansCmd.AddCommand(exportBansCommand(), importBansCommand())
+	return bansCmd
+}
+
+func exportBansCommand() *cobra.Command {
+	var format, output string
+
+	exportCmd := &cobra.Command{
+		Use:     "export",
+		Short:   "Download the coordinator's exit bans as a ban list",
+		Example: "  proxyctl bans export --format text -o bans.txt",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "json" && format != "text" {
+				return fmt.Errorf("--format must be json or text")
+			}
+			resp, err := send(client, http.MethodGet, "/api/bans/export?format="+format, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if output == "" || output == "-" {
+				_, err = io.Copy(os.Stdout, resp.Body)
+				return err
+			}
+			file, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, resp.Body); err != nil {
+				file.Close()
+				os.Remove(output)
+				return err
+			}
+			return file.Close()
+		},
+	}
+	exportCmd.Flags().StringVar(&format, "format", "json", "Output format: json or text")
+	exportCmd.Flags().StringVarP(&output, "output", "o", "", "File to write (default: stdout)")
+	return exportCmd
+}
+
+func importBansCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "import FILE...",
+		Short: "Add ban lists, JSON or text, to the coordinator's exit bans",
+		Long: "Add ban lists to the coordinator's exit bans. Text lists have one entry per\n" +
+			"line, \"prefix [destination [ttl]] [# reason]\"; JSON lists are what\n" +
+			"'proxyctl bans export' writes.",
+		Example: "  proxyctl bans import bans.txt other-deployment.json",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, path := range args {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				// Parsed here so mistakes are reported with the file's name
+				entries, err := banlist.Parse(data)
+				if err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+				var result struct {
+					Imported int `json:"imported"`
+					Expired  int `json:"expired"`
+				}
+				if err := call(http.MethodPost, "/api/bans/import", models.BanList{Entries: entries}, &result); err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+				fmt.Printf("%s: imported %d bans, %d had expired\n", path, result.Imported, result.Expired)
+			}
+			return nil
+		},
+	}
+}
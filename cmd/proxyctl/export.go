@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func exportCommand() *cobra.Command {
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Download data for billing and analytics",
+	}
+	exportCmd.AddCommand(exportUsageCommand(), exportProxiesCommand())
+	return exportCmd
+}
+
+func exportProxiesCommand() *cobra.Command {
+	var (
+		format, output, protocol string
+		node, region, pool, tag  string
+	)
+
+	proxiesCmd := &cobra.Command{
+		Use:   "proxies",
+		Short: "Export the running exits for clients that connect to them directly",
+		Long: "Export the running exits as host:port:user:pass lines, IPv6 hosts in\n" +
+			"brackets, or as JSON or CSV with their node, region, name, tags and pools.",
+		Example: "  proxyctl export proxies --protocol socks5 -o exits.txt\n" +
+			"  proxyctl export proxies --format csv --region eu-west --pool residential",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "plain" && format != "json" && format != "csv" {
+				return fmt.Errorf("--format must be plain, json or csv")
+			}
+			query := url.Values{"format": {format}, "protocol": {protocol}}
+			for name, value := range map[string]string{"node": node, "region": region, "pool": pool, "tag": tag} {
+				if value != "" {
+					query.Set(name, value)
+				}
+			}
+			return download("/api/proxies/export?"+query.Encode(), output)
+		},
+	}
+	proxiesCmd.Flags().StringVar(&format, "format", "plain", "Output format: plain, json or csv")
+	proxiesCmd.Flags().StringVarP(&output, "output", "o", "", "File to write (default: stdout)")
+	proxiesCmd.Flags().StringVar(&protocol, "protocol", "http", "Exits of this protocol: http or socks5")
+	proxiesCmd.Flags().StringVar(&node, "node", "", "Only exits of this node")
+	proxiesCmd.Flags().StringVar(&region, "region", "", "Only exits of nodes in this region")
+	proxiesCmd.Flags().StringVar(&pool, "pool", "", "Only exits in this pool")
+	proxiesCmd.Flags().StringVar(&tag, "tag", "", "Only exits with this tag")
+	return proxiesCmd
+}
+
+func exportUsageCommand() *cobra.Command {
+	var (
+		from, to       string
+		format, output string
+		user, ip, node string
+		tenant         string
+	)
+
+	usageCmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Export the usage ledger as CSV or Parquet",
+		Long: "Export the usage ledger: hourly records of which exit served which user,\n" +
+			"client and destination, with request counts. The coordinator only keeps\n" +
+			"records for its --ledger-retention.",
+		Example: "  proxyctl export usage --from 2024-05-01 --to 2024-06-01 --format parquet -o may.parquet",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "csv" && format != "parquet" {
+				return fmt.Errorf("--format must be csv or parquet")
+			}
+			query := url.Values{"format": {format}}
+			for name, value := range map[string]string{"from": from, "to": to} {
+				if value == "" {
+					continue
+				}
+				t, err := parseExportTime(value)
+				if err != nil {
+					return fmt.Errorf("--%s: %w", name, err)
+				}
+				query.Set(name, t.Format(time.RFC3339))
+			}
+			for name, value := range map[string]string{"user": user, "tenant": tenant, "ip": ip, "node": node} {
+				if value != "" {
+					query.Set(name, value)
+				}
+			}
+			return download("/api/ledger?"+query.Encode(), output)
+		},
+	}
+	usageCmd.Flags().StringVar(&from, "from", "", "Start of the export, RFC 3339 or YYYY-MM-DD (default: everything retained)")
+	usageCmd.Flags().StringVar(&to, "to", "", "End of the export, RFC 3339 or YYYY-MM-DD (default: now)")
+	usageCmd.Flags().StringVar(&format, "format", "csv", "Output format: csv or parquet")
+	usageCmd.Flags().StringVarP(&output, "output", "o", "", "File to write (default: stdout)")
+	usageCmd.Flags().StringVar(&user, "user", "", "Only this proxy user's usage")
+	usageCmd.Flags().StringVar(&tenant, "tenant", "", "Only the usage of this tenant's users")
+	usageCmd.Flags().StringVar(&ip, "ip", "", "Only exits on this address or CIDR prefix")
+	usageCmd.Flags().StringVar(&node, "node", "", "Only exits of this node")
+	return usageCmd
+}
+
+// download writes the response to GET path to the file output, or to
+// stdout when output is empty or "-".
+func download(path, output string) error {
+	// The default client's timeout would cut long downloads short
+	downloader := *client
+	downloader.Timeout = 0
+	resp, err := send(&downloader, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if output == "" || output == "-" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(output)
+		return err
+	}
+	return file.Close()
+}
+
+// parseExportTime reads an RFC 3339 time or a date, which is midnight UTC.
+func parseExportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want an RFC 3339 time or YYYY-MM-DD, got %q", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"proxy-v6/internal/mtls"
+	"proxy-v6/internal/rollout"
+	"proxy-v6/pkg/models"
+	"proxy-v6/pkg/version"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	coordinatorURL string
+	apiKey         string
+	clientTLS      mtls.Files
+	client         = &http.Client{Timeout: 30 * time.Second}
+)
+
+func main() {
+	rootCmd := &cobra.Command{
+		Use:          "proxyctl",
+		Short:        "Operate an IPv6 proxy cluster through the coordinator API",
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			transport, err := mtls.Transport(logrus.StandardLogger(), clientTLS)
+			if err != nil {
+				return err
+			}
+			client.Transport = transport
+			return nil
+		},
+	}
+	rootCmd.PersistentFlags().StringVarP(&coordinatorURL, "coordinator", "c", "http://localhost:8081", "Coordinator URL")
+	rootCmd.PersistentFlags().StringVar(&apiKey, "api-key", os.Getenv("PROXY_V6_API_KEY"), "Coordinator API key (default $PROXY_V6_API_KEY)")
+	rootCmd.PersistentFlags().StringVar(&clientTLS.Cert, "tls-cert", "", "Client certificate for a coordinator that requires mutual TLS")
+	rootCmd.PersistentFlags().StringVar(&clientTLS.Key, "tls-key", "", "Private key for --tls-cert")
+	rootCmd.PersistentFlags().StringVar(&clientTLS.CA, "tls-ca", "", "CA bundle the coordinator's certificate must be signed by")
+	
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print version information",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(version.GetVersion())
+		},
+	}
+	
+	rootCmd.AddCommand(versionCmd, nodesCommand(), proxiesCommand(), proxyCommand(), exportCommand(), bansCommand(), planCommand())
+	
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func nodesCommand() *cobra.Command {
+	nodesCmd := &cobra.Command{
+		Use:   "nodes",
+		Short: "Inspect and operate agent nodes",
+	}
+	
+	var output string
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List registered nodes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			var nodes []models.NodeInfo
+			if err := call(http.MethodGet, "/api/nodes", nil, &nodes); err != nil {
+				return err
+			}
+			// Drained nodes carry "draining" in the API's own fields
+			if ok, err := printStructured(output, nodes); ok {
+				return err
+			}
+			var drained []string
+			if err := call(http.MethodGet, "/api/drains", nil, &drained); err != nil {
+				return err
+			}
+			isDrained := make(map[string]bool, len(drained))
+			for _, id := range drained {
+				isDrained[id] = true
+			}
+			
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NODE\tPROXIES\tRUNNING\tSTATE\tAPI\tUPDATED")
+			for _, node := range nodes {
+				running := 0
+				for _, p := range node.Proxies {
+					if p.Status == models.ProxyStatusRunning {
+						running++
+					}
+				}
+				state := "active"
+				switch {
+				case node.Maintenance:
+					state = "maintenance"
+				case isDrained[node.NodeID]:
+					state = "drained"
+				}
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", node.NodeID, len(node.Proxies), running, state, node.APIURL, node.UpdatedAt.Format(time.RFC3339))
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			
+			var duplicates []models.DuplicateAddress
+			if err := call(http.MethodGet, "/api/duplicates", nil, &duplicates); err != nil {
+				return err
+			}
+			for _, d := range duplicates {
+				fmt.Fprintf(os.Stderr, "Warning: %s is reported by %s since %s and kept out of the pool\n", d.IP, strings.Join(d.Nodes, ", "), d.Since.Format(time.RFC3339))
+			}
+			return nil
+		},
+	}
+	addOutputFlag(listCmd, &output)
+	
+	var wait time.Duration
+	drainCmd := &cobra.Command{
+		Use:   "drain NODE",
+		Short: "Stop routing new traffic to a node",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := call(http.MethodPost, "/api/nodes/"+args[0]+"/drain", nil, nil); err != nil {
+				return err
+			}
+			fmt.Printf("Node %s drained\n", args[0])
+			if wait > 0 {
+				return waitQuiescent(args[0], wait)
+			}
+			return nil
+		},
+	}
+	drainCmd.Flags().DurationVar(&wait, "wait", 0, "Wait up to this long for the node's requests and tunnels to finish (0 = return at once)")
+	
+	undrainCmd := &cobra.Command{
+		Use:   "undrain NODE",
+		Short: "Return a drained node to rotation",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := call(http.MethodDelete, "/api/nodes/"+args[0]+"/drain", nil, nil); err != nil {
+				return err
+			}
+			fmt.Printf("Node %s returned to rotation\n", args[0])
+			return nil
+		},
+	}
+	
+	nodesCmd.AddCommand(listCmd, drainCmd, undrainCmd, rollingRestartCommand())
+	return nodesCmd
+}
+
+func rollingRestartCommand() *cobra.Command {
+	var (
+		maxUnavailable int
+		drainTimeout   time.Duration
+		verifyTimeout  time.Duration
+		detach         bool
+	)
+	
+	restartCmd := &cobra.Command{
+		Use:   "rolling-restart",
+		Short: "Drain, restart and verify each agent in turn",
+		Long: "Drain, restart and verify each agent in turn. The rollout pauses on the first\n" +
+			"failure; use 'rolling-restart resume' to retry or 'rolling-restart abort' to stop.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := rollout.Options{
+				MaxUnavailable:       maxUnavailable,
+				DrainTimeoutSeconds:  int(drainTimeout.Seconds()),
+				VerifyTimeoutSeconds: int(verifyTimeout.Seconds()),
+			}
+			var status rollout.Status
+			if err := call(http.MethodPost, "/api/nodes/rolling-restart", opts, &status); err != nil {
+				return err
+			}
+			fmt.Printf("Started %s across %d nodes\n", status.ID, len(status.Nodes))
+			if detach {
+				return nil
+			}
+			return follow()
+		},
+	}
+	restartCmd.Flags().IntVar(&maxUnavailable, "max-unavailable", 1, "Nodes restarted at the same time")
+	restartCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 2*time.Minute, "Maximum time to wait for in-flight traffic before restarting a node")
+	restartCmd.Flags().DurationVar(&verifyTimeout, "verify-timeout", 2*time.Minute, "Maximum time for a restarted node to report its proxies running")
+	restartCmd.Flags().BoolVar(&detach, "detach", false, "Start the rollout and return without following it")
+	
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the current rolling restart",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var status rollout.Status
+			if err := call(http.MethodGet, "/api/nodes/rolling-restart", nil, &status); err != nil {
+				return err
+			}
+			printStatus(status)
+			return nil
+		},
+	}
+	
+	resumeCmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Retry failed nodes and continue a paused rolling restart",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := call(http.MethodPost, "/api/nodes/rolling-restart/resume", nil, nil); err != nil {
+				return err
+			}
+			return follow()
+		},
+	}
+	
+	abortCmd := &cobra.Command{
+		Use:   "abort",
+		Short: "Stop the rolling restart after the current batch",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var status rollout.Status
+			if err := call(http.MethodPost, "/api/nodes/rolling-restart/abort", nil, &status); err != nil {
+				return err
+			}
+			fmt.Printf("%s aborted\n", status.ID)
+			return nil
+		},
+	}
+	
+	restartCmd.AddCommand(statusCmd, resumeCmd, abortCmd)
+	return restartCmd
+}
+
+// follow prints node transitions until the rollout completes, pauses or is
+// aborted.
+// waitQuiescent polls the drain status of nodeID until nothing is left in
+// flight on it, printing the progress.
+func waitQuiescent(nodeID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var progress models.DrainProgress
+		if err := call(http.MethodGet, "/api/drain/status?node="+url.QueryEscape(nodeID), nil, &progress); err != nil {
+			return err
+		}
+		if progress.Quiescent {
+			fmt.Printf("Node %s is quiet\n", nodeID)
+			return nil
+		}
+		line := fmt.Sprintf("%s  %d requests, %d tunnels left", time.Now().Format("15:04:05"), progress.Requests, progress.Tunnels)
+		if progress.EstimatedCompletion != nil {
+			line += ", done around " + progress.EstimatedCompletion.Format("15:04:05")
+		}
+		fmt.Println(line)
+		if time.Now().After(deadline) {
+			return fmt.Errorf("node %s still has work in flight after %s", nodeID, timeout)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func follow() error {
+	seen := make(map[string]string)
+	for {
+		var status rollout.Status
+		if err := call(http.MethodGet, "/api/nodes/rolling-restart", nil, &status); err != nil {
+			return err
+		}
+		for _, node := range status.Nodes {
+			if seen[node.NodeID] != node.State {
+				seen[node.NodeID] = node.State
+				line := fmt.Sprintf("%s  %-10s %s", time.Now().Format("15:04:05"), node.State, node.NodeID)
+				if node.Error != "" {
+					line += ": " + node.Error
+				}
+				fmt.Println(line)
+			}
+		}
+		
+		switch status.State {
+		case rollout.StateCompleted:
+			fmt.Printf("%s completed\n", status.ID)
+			return nil
+		case rollout.StatePaused:
+			return fmt.Errorf("%s paused: %s (run 'proxyctl nodes rolling-restart resume' or 'abort')", status.ID, status.Error)
+		case rollout.StateAborted:
+			return fmt.Errorf("%s aborted", status.ID)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func printStatus(status rollout.Status) {
+	fmt.Printf("%s: %s (max unavailable %d, started %s)\n", status.ID, status.State, status.Options.MaxUnavailable, status.StartedAt.Format(time.RFC3339))
+	if status.Error != "" {
+		fmt.Printf("Error: %s\n", status.Error)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tSTATE\tERROR")
+	for _, node := range status.Nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", node.NodeID, node.State, node.Error)
+	}
+	w.Flush()
+}
+
+// call sends a JSON request to the coordinator and decodes the response
+// into out. Structured API errors are returned as their message.
+func call(method, path string, body, out interface{}) error {
+	resp, err := send(client, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send sends a JSON request to the coordinator. Responses other than 2xx
+// are closed and returned as errors.
+func send(c *http.Client, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	
+	req, err := http.NewRequest(method, coordinatorURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Message == "" {
+			return nil, fmt.Errorf("coordinator returned %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("%s (%s)", apiErr.Message, apiErr.Code)
+	}
+	return resp, nil
+}
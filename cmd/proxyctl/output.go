@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of the list commands.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// addOutputFlag adds -o/--output, the format a list is printed in.
+func addOutputFlag(cmd *cobra.Command, output *string) {
+	cmd.Flags().StringVarP(output, "output", "o", outputTable, "Output format: table, json or yaml")
+}
+
+func checkOutput(output string) error {
+	switch output {
+	case outputTable, outputJSON, outputYAML:
+		return nil
+	}
+	return fmt.Errorf("--output must be table, json or yaml")
+}
+
+// printStructured prints v as JSON or YAML, with the API's field names
+// either way, and reports whether output asked for one of them.
+func printStructured(output string, v interface{}) (bool, error) {
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return true, enc.Encode(v)
+	case outputYAML:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return true, err
+		}
+		// YAML is a superset of JSON, so decoding it as YAML keeps the
+		// field names and order; dropping the flow style prints it as
+		// block YAML
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return true, err
+		}
+		blockStyle(&doc)
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return true, err
+		}
+		return true, enc.Close()
+	}
+	return false, nil
+}
+
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"proxy-v6/internal/plan"
+
+	"github.com/spf13/cobra"
+)
+
+func planCommand() *cobra.Command {
+	var output string
+
+	planCmd := &cobra.Command{
+		Use:   "plan FILE",
+		Short: "Show what it takes to bring the pool to a desired state",
+		Long: "Compare a desired-state file, YAML or JSON, with the nodes and rules the\n" +
+			"coordinator reports, and list the exits to create, rotate or destroy on each\n" +
+			"node and the rules to change. Nothing is changed.",
+		Example: "  proxyctl plan pool.yaml\n  proxyctl plan pool.yaml -o json",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "text" && output != "json" {
+				return fmt.Errorf("--output must be text or json")
+			}
+			state, err := plan.Load(args[0])
+			if err != nil {
+				return err
+			}
+
+			var current plan.Current
+			if err := call(http.MethodGet, "/api/nodes", nil, &current.Nodes); err != nil {
+				return err
+			}
+			// Only the rule sets the file manages are fetched
+			if state.BanRules != nil {
+				if err := call(http.MethodGet, "/api/bans/rules", nil, &current.BanRules); err != nil {
+					return err
+				}
+			}
+			if state.RewriteRules != nil {
+				if err := call(http.MethodGet, "/api/rewrite-rules", nil, &current.RewriteRules); err != nil {
+					return err
+				}
+			}
+			if state.ReuseRules != nil {
+				if err := call(http.MethodGet, "/api/reuse-rules", nil, &current.ReuseRules); err != nil {
+					return err
+				}
+			}
+
+			p := plan.Compute(state, current, time.Now())
+			if output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(p)
+			}
+			printPlan(p)
+			return nil
+		},
+	}
+	planCmd.Flags().StringVarP(&output, "output", "o", "text", "Output format: text or json")
+	return planCmd
+}
+
+var planSymbols = map[string]string{
+	plan.Create:  "+",
+	plan.Rotate:  "~",
+	plan.Update:  "~",
+	plan.Destroy: "-",
+	plan.Delete:  "-",
+}
+
+func printPlan(p plan.Plan) {
+	for _, warning := range p.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	group := ""
+	for _, action := range p.Actions {
+		heading := "Node " + action.Node
+		if action.Rules != "" {
+			heading = "Rules " + action.Rules
+		}
+		if heading != group {
+			if group != "" {
+				fmt.Println()
+			}
+			fmt.Println(heading + ":")
+			group = heading
+		}
+
+		line := fmt.Sprintf("  %s %-8s", planSymbols[action.Type], action.Type)
+		switch {
+		case action.Rules != "" && action.Destination == "":
+			line += " all rules"
+		case action.Rules != "":
+			line += " " + action.Destination
+		case action.Type == plan.Create:
+			line += " new exit"
+		default:
+			line += " " + action.Instance + " " + action.Address
+		}
+		if action.Prefix != "" {
+			line += " on " + action.Prefix
+		}
+		if action.Reason != "" {
+			line += " (" + action.Reason + ")"
+		}
+		fmt.Println(line)
+	}
+	if len(p.Actions) > 0 {
+		fmt.Println()
+	}
+	fmt.Println(p.Summary())
+}
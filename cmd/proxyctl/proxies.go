@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/spf13/cobra"
+)
+
+// commandPollInterval is how often a queued command is checked on.
+const commandPollInterval = 500 * time.Millisecond
+
+// nodeProxy is a proxy instance with the node running it.
+type nodeProxy struct {
+	NodeID string `json:"node_id"`
+	models.ProxyInstance
+}
+
+func proxiesCommand() *cobra.Command {
+	proxiesCmd := &cobra.Command{
+		Use:   "proxies",
+		Short: "Inspect the proxy instances of every node",
+	}
+
+	var (
+		node, status, tag string
+		output            string
+	)
+	listCmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List proxy instances as the nodes last reported them",
+		Example: "  proxyctl proxies list --node edge-1 --status error\n  proxyctl proxies list --tag residential -o json",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkOutput(output); err != nil {
+				return err
+			}
+			var nodes []models.NodeInfo
+			if err := call(http.MethodGet, "/api/nodes", nil, &nodes); err != nil {
+				return err
+			}
+			proxies := []nodeProxy{}
+			for _, n := range nodes {
+				if node != "" && n.NodeID != node {
+					continue
+				}
+				for _, p := range n.Proxies {
+					if status != "" && string(p.Status) != status {
+						continue
+					}
+					if tag != "" && !slices.Contains(p.Tags, tag) {
+						continue
+					}
+					proxies = append(proxies, nodeProxy{NodeID: n.NodeID, ProxyInstance: p})
+				}
+			}
+
+			if ok, err := printStructured(output, proxies); ok {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NODE\tID\tADDRESS\tPROTOCOL\tSTATUS\tREQUESTS\tSTARTED")
+			for _, p := range proxies {
+				address := net.JoinHostPort(p.IPv6.IP.String(), strconv.Itoa(p.Port))
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", p.NodeID, p.ID, address, p.Protocol, p.Status, p.Metrics.RequestsTotal, p.StartedAt.Format(time.RFC3339))
+			}
+			return w.Flush()
+		},
+	}
+	listCmd.Flags().StringVar(&node, "node", "", "Only the proxies of this node")
+	listCmd.Flags().StringVar(&status, "status", "", "Only proxies in this status: starting, running, stopped, error, quota_exceeded or paused")
+	listCmd.Flags().StringVar(&tag, "tag", "", "Only proxies with this tag")
+	addOutputFlag(listCmd, &output)
+
+	proxiesCmd.AddCommand(listCmd)
+	return proxiesCmd
+}
+
+func proxyCommand() *cobra.Command {
+	proxyCmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Operate a proxy instance through its agent's command channel",
+		Long: "Operate a proxy instance. The command is queued for the instance's node and\n" +
+			"carried out by its agent, also behind NAT; proxyctl waits for the result.",
+	}
+	proxyCmd.AddCommand(
+		proxyActionCommand("stop", "Stop a proxy instance", models.CommandStopProxy, "stopped"),
+		proxyActionCommand("restart", "Relaunch a proxy instance's backend with the same config", models.CommandRestartProxy, "restarted"),
+		proxyActionCommand("rotate", "Move a proxy instance to a new IPv6 address, keeping its ID and port", models.CommandRotateIP, "rotated"),
+	)
+	return proxyCmd
+}
+
+// proxyActionCommand queues commandType for the instance named and reports
+// it done once the agent carried it out.
+func proxyActionCommand(use, short, commandType, done string) *cobra.Command {
+	var (
+		node, ipv6 string
+		wait       time.Duration
+	)
+	actionCmd := &cobra.Command{
+		Use:   use + " ID",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if node == "" {
+				var err error
+				if node, err = findProxyNode(args[0]); err != nil {
+					return err
+				}
+			}
+			command := models.NodeCommand{Type: commandType, InstanceID: args[0], IPv6: ipv6}
+			path := "/api/nodes/" + url.PathEscape(node) + "/commands"
+			if err := call(http.MethodPost, path, command, &command); err != nil {
+				return err
+			}
+			if wait == 0 {
+				fmt.Printf("Queued %s %s for %s on %s\n", command.Type, command.ID, args[0], node)
+				return nil
+			}
+
+			deadline := time.Now().Add(wait)
+			for command.Status == models.CommandQueued || command.Status == models.CommandDelivered {
+				if time.Now().After(deadline) {
+					return fmt.Errorf("%s %s is still %s after %s", command.Type, command.ID, command.Status, wait)
+				}
+				time.Sleep(commandPollInterval)
+				if err := call(http.MethodGet, path+"/"+url.PathEscape(command.ID), nil, &command); err != nil {
+					return err
+				}
+			}
+			if command.Status != models.CommandSucceeded {
+				return fmt.Errorf("%s %s: %s", command.Type, command.Status, commandError(command))
+			}
+
+			var instance models.ProxyInstance
+			if commandType == models.CommandRotateIP && json.Unmarshal(command.Result.Body, &instance) == nil && instance.IPv6.IP != nil {
+				fmt.Printf("Proxy %s on %s moved to %s\n", args[0], node, instance.IPv6.IP)
+				return nil
+			}
+			fmt.Printf("Proxy %s on %s %s\n", args[0], node, done)
+			return nil
+		},
+	}
+	actionCmd.Flags().StringVar(&node, "node", "", "Node running the proxy (default: looked up from the coordinator's nodes)")
+	actionCmd.Flags().DurationVar(&wait, "wait", 2*time.Minute, "How long to wait for the agent to report the result (0 = return once queued)")
+	if commandType == models.CommandRotateIP {
+		actionCmd.Flags().StringVar(&ipv6, "ipv6", "", "Address to move to (default: a fresh one from the agent's --ipv6-prefix, or an unused scanned one)")
+	}
+	return actionCmd
+}
+
+// findProxyNode returns the node reporting instance id.
+func findProxyNode(id string) (string, error) {
+	var nodes []models.NodeInfo
+	if err := call(http.MethodGet, "/api/nodes", nil, &nodes); err != nil {
+		return "", err
+	}
+	var found []string
+	for _, n := range nodes {
+		for _, p := range n.Proxies {
+			if p.ID == id {
+				found = append(found, n.NodeID)
+				break
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no node reports proxy %s", id)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("proxy %s is reported by %v, pick one with --node", id, found)
+}
+
+// commandError describes why a command did not succeed.
+func commandError(command models.NodeCommand) string {
+	if command.Result == nil {
+		return "the agent did not fetch it"
+	}
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(command.Result.Body, &apiErr); err == nil && apiErr.Message != "" {
+		return apiErr.Message
+	}
+	return fmt.Sprintf("agent returned %d", command.Result.StatusCode)
+}
@@ -202,7 +202,7 @@ fi
 # Backup existing binaries if upgrading
 if check_existing_installation > /dev/null 2>&1; then
     echo "Backing up existing binaries..."
-    for binary in agent coordinator monitor; do
+    for binary in agent coordinator monitor proxyctl; do
         if [ -f "$INSTALL_DIR/proxy-v6-${binary}" ]; then
             $SUDO cp "$INSTALL_DIR/proxy-v6-${binary}" "$INSTALL_DIR/proxy-v6-${binary}.backup" 2>/dev/null || true
         fi
@@ -210,7 +210,7 @@ if check_existing_installation > /dev/null 2>&1; then
 fi
 
 # Install each binary
-for binary in agent coordinator monitor; do
+for binary in agent coordinator monitor proxyctl; do
     if [ -f "${binary}-${SUFFIX}" ]; then
         $SUDO mv "${binary}-${SUFFIX}" "$INSTALL_DIR/proxy-v6-${binary}"
         $SUDO chmod +x "$INSTALL_DIR/proxy-v6-${binary}"
@@ -241,6 +241,7 @@ echo "Creating convenience commands..."
 $SUDO ln -sf "$INSTALL_DIR/proxy-v6-agent" "$INSTALL_DIR/pv6-agent" 2>/dev/null || true
 $SUDO ln -sf "$INSTALL_DIR/proxy-v6-coordinator" "$INSTALL_DIR/pv6-coordinator" 2>/dev/null || true
 $SUDO ln -sf "$INSTALL_DIR/proxy-v6-monitor" "$INSTALL_DIR/pv6-monitor" 2>/dev/null || true
+$SUDO ln -sf "$INSTALL_DIR/proxy-v6-proxyctl" "$INSTALL_DIR/proxyctl" 2>/dev/null || true
 
 # Check if tinyproxy is installed
 if ! command -v tinyproxy &> /dev/null; then
@@ -0,0 +1,135 @@
+package abuse
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/ledger"
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWindow = 15 * time.Minute
+	maxReports    = 500
+)
+
+// Quarantiner is implemented by the load balancer.
+type Quarantiner interface {
+	Quarantine(ip, reason string) error
+}
+
+// Desk resolves abuse reports against the usage ledger and keeps the most
+// recent reports for review.
+type Desk struct {
+	logger      *logrus.Logger
+	ledger      *ledger.Ledger
+	quarantiner Quarantiner
+	reports     []models.AbuseReport
+	nextID      int
+	mu          sync.Mutex
+}
+
+func NewDesk(logger *logrus.Logger, l *ledger.Ledger, q Quarantiner) *Desk {
+	return &Desk{
+		logger:      logger,
+		ledger:      l,
+		quarantiner: q,
+	}
+}
+
+// Submit resolves report to the users, clients and destinations that used
+// the address around the reported time and optionally quarantines it.
+func (d *Desk) Submit(report models.AbuseReport) (models.AbuseReport, error) {
+	ip := net.ParseIP(report.IP)
+	if ip == nil {
+		return report, fmt.Errorf("invalid IP address: %s", report.IP)
+	}
+	if report.Timestamp.IsZero() {
+		return report, fmt.Errorf("timestamp is required")
+	}
+
+	window := defaultWindow
+	if report.WindowMinutes > 0 {
+		window = time.Duration(report.WindowMinutes) * time.Minute
+	}
+
+	matches, err := d.ledger.Query(ledger.Query{
+		IP:   ip.String(),
+		From: report.Timestamp.Add(-window),
+		To:   report.Timestamp.Add(window),
+	})
+	if err != nil {
+		return report, err
+	}
+
+	report.IP = ip.String()
+	report.ReceivedAt = time.Now()
+	report.Matches = matches
+
+	users := make(map[string]bool)
+	clients := make(map[string]bool)
+	destinations := make(map[string]bool)
+	nodes := make(map[string]bool)
+	for _, m := range matches {
+		if m.User != "" {
+			users[m.User] = true
+		}
+		clients[m.ClientIP] = true
+		destinations[m.Destination] = true
+		nodes[m.NodeID] = true
+	}
+	report.Users = sortedKeys(users)
+	report.ClientIPs = sortedKeys(clients)
+	report.Destinations = sortedKeys(destinations)
+	report.Nodes = sortedKeys(nodes)
+
+	if report.Quarantine {
+		reason := fmt.Sprintf("abuse report at %s", report.Timestamp.Format(time.RFC3339))
+		if report.Note != "" {
+			reason += ": " + report.Note
+		}
+		if err := d.quarantiner.Quarantine(report.IP, reason); err != nil {
+			return report, err
+		}
+		report.Quarantined = []string{report.IP}
+	}
+
+	d.mu.Lock()
+	d.nextID++
+	report.ID = fmt.Sprintf("abuse-%d", d.nextID)
+	d.reports = append(d.reports, report)
+	if len(d.reports) > maxReports {
+		d.reports = d.reports[len(d.reports)-maxReports:]
+	}
+	d.mu.Unlock()
+
+	d.logger.Warnf("Abuse report %s for %s resolved to %d ledger entries (users: %v)",
+		report.ID, report.IP, len(matches), report.Users)
+	return report, nil
+}
+
+// Reports returns submitted reports, newest first.
+func (d *Desk) Reports() []models.AbuseReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result := make([]models.AbuseReport, len(d.reports))
+	for i, r := range d.reports {
+		result[len(d.reports)-1-i] = r
+	}
+	return result
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,362 @@
+package alert
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxSendAttempts is how many evaluations in a row a notification is
+	// tried before it is given up.
+	maxSendAttempts = 10
+	// keptResolved is how many resolved alerts are kept for the API.
+	keptResolved = 100
+	// forgetAfter is how long a node that stopped reporting is still
+	// alerted about, unless it deregistered.
+	forgetAfter = 24 * time.Hour
+)
+
+var (
+	firingAlerts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_alerts_firing",
+		Help: "Alerts firing, by rule.",
+	}, []string{"rule"})
+	notifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_alert_notifications_total",
+		Help: "Alert notifications sent, by notifier and status (sent, error or dropped).",
+	}, []string{"notifier", "status"})
+)
+
+// tracked is an alert whose condition holds, pending or firing.
+type tracked struct {
+	rule  models.AlertRule
+	alert models.Alert
+}
+
+// message is a notification still to send.
+type message struct {
+	notifier string
+	alert    models.Alert
+	attempts int
+}
+
+// Engine evaluates alert rules. An alert is notified once when it fires
+// and once when it resolves; pending alerts that clear are not notified.
+// Notifications that fail are tried again at the next evaluations. Alerts
+// live in memory, so a restart forgets what already fired.
+type Engine struct {
+	logger    *logrus.Logger
+	client    *http.Client
+	rules     []models.AlertRule
+	notifiers []models.Notifier
+
+	mu       sync.Mutex
+	active   map[string]*tracked
+	resolved []models.Alert // oldest first
+	outbox   []*message
+	lastSeen map[string]time.Time // last report of each node
+}
+
+// NewEngine checks the rules and notifiers and returns an engine for them.
+func NewEngine(logger *logrus.Logger, rules []models.AlertRule, notifiers []models.Notifier) (*Engine, error) {
+	seen := make(map[string]bool)
+	for _, n := range notifiers {
+		if err := ValidateNotifier(n); err != nil {
+			return nil, err
+		}
+		if seen[n.Name] {
+			return nil, fmt.Errorf("duplicate notifier %s", n.Name)
+		}
+		seen[n.Name] = true
+	}
+	seen = make(map[string]bool)
+	for _, rule := range rules {
+		if err := ValidateRule(rule, notifiers); err != nil {
+			return nil, err
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate alert rule %s", rule.Name)
+		}
+		seen[rule.Name] = true
+	}
+	return &Engine{
+		logger:    logger,
+		client:    &http.Client{},
+		rules:     rules,
+		notifiers: notifiers,
+		active:    make(map[string]*tracked),
+		lastSeen:  make(map[string]time.Time),
+	}, nil
+}
+
+// Run evaluates the rules against source every interval until stop closes.
+func (e *Engine) Run(source func() Snapshot, interval time.Duration, stop <-chan struct{}) {
+	if len(e.rules) == 0 {
+		return
+	}
+	e.logger.Infof("Evaluating %d alert rules every %s", len(e.rules), interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Evaluate(source(), time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Evaluate moves the alerts along for snap taken at now, and sends the
+// notifications that are due.
+func (e *Engine) Evaluate(snap Snapshot, now time.Time) {
+	e.mu.Lock()
+	e.evaluateLocked(snap, now)
+	outbox := e.outbox
+	e.outbox = nil
+	e.mu.Unlock()
+
+	var retry []*message
+	for _, msg := range outbox {
+		n, ok := e.notifier(msg.notifier)
+		if !ok {
+			continue
+		}
+		msg.attempts++
+		if err := send(e.client, n, msg.alert, Text(msg.alert)); err != nil {
+			notifications.WithLabelValues(n.Name, "error").Inc()
+			if msg.attempts >= maxSendAttempts {
+				notifications.WithLabelValues(n.Name, "dropped").Inc()
+				e.logger.Errorf("Giving up on notifying %s of alert %s after %d attempts: %v", n.Name, msg.alert.Rule, msg.attempts, err)
+				continue
+			}
+			e.logger.Warnf("Failed to notify %s of alert %s: %v", n.Name, msg.alert.Rule, err)
+			retry = append(retry, msg)
+			continue
+		}
+		notifications.WithLabelValues(n.Name, "sent").Inc()
+	}
+
+	if len(retry) > 0 {
+		e.mu.Lock()
+		e.outbox = append(retry, e.outbox...)
+		e.mu.Unlock()
+	}
+}
+
+func (e *Engine) evaluateLocked(snap Snapshot, now time.Time) {
+	clusterHealthy, clusterUnhealthy := 0, 0
+	samples := make(map[string]NodeSample, len(snap.Nodes))
+	for _, node := range snap.Nodes {
+		clusterHealthy += node.Healthy
+		clusterUnhealthy += node.Unhealthy
+		samples[node.NodeID] = node
+		e.lastSeen[node.NodeID] = node.LastReport
+	}
+	// Nodes that went away are still watched, with nothing healthy
+	for node, last := range e.lastSeen {
+		if _, ok := samples[node]; ok {
+			continue
+		}
+		if now.Sub(last) > forgetAfter {
+			delete(e.lastSeen, node)
+			continue
+		}
+		samples[node] = NodeSample{NodeID: node, LastReport: last}
+	}
+
+	values := make(map[string]float64)
+	observe := func(rule models.AlertRule, node string, value float64) {
+		key := rule.Name + "/" + node
+		values[key] = value
+		if !holds(rule.Op, value, rule.Threshold) {
+			return
+		}
+		t := e.active[key]
+		if t == nil {
+			severity := rule.Severity
+			if severity == "" {
+				severity = defaultSeverity
+			}
+			t = &tracked{rule: rule, alert: models.Alert{
+				Rule:      rule.Name,
+				Node:      node,
+				Severity:  severity,
+				State:     models.AlertPending,
+				Metric:    rule.Metric,
+				Op:        rule.Op,
+				Threshold: rule.Threshold,
+				Since:     now,
+			}}
+			e.active[key] = t
+		}
+		t.alert.Value = value
+		if t.alert.State == models.AlertPending && now.Sub(t.alert.Since) >= time.Duration(rule.ForSeconds)*time.Second {
+			fired := now
+			t.alert.State = models.AlertFiring
+			t.alert.FiredAt = &fired
+			e.logger.Warnf("Alert %s", Text(t.alert))
+			e.notifyLocked(rule, t.alert)
+		}
+	}
+
+	for _, rule := range e.rules {
+		if !perNode(rule.Metric) {
+			switch rule.Metric {
+			case MetricHealthyProxies:
+				observe(rule, "", float64(clusterHealthy))
+			case MetricUnhealthyProxies:
+				observe(rule, "", float64(clusterUnhealthy))
+			case MetricNodes:
+				observe(rule, "", float64(len(snap.Nodes)))
+			}
+			continue
+		}
+		for node, sample := range samples {
+			if sample.Maintenance || (len(rule.Nodes) > 0 && !slices.Contains(rule.Nodes, node)) {
+				continue
+			}
+			switch rule.Metric {
+			case MetricNodeHealthyProxies:
+				observe(rule, node, float64(sample.Healthy))
+			case MetricNodeUnhealthyProxies:
+				observe(rule, node, float64(sample.Unhealthy))
+			case MetricNodeHeartbeatAge:
+				observe(rule, node, now.Sub(sample.LastReport).Round(time.Second).Seconds())
+			}
+		}
+	}
+
+	for key, t := range e.active {
+		value, watched := values[key]
+		if watched && holds(t.rule.Op, value, t.rule.Threshold) {
+			continue
+		}
+		delete(e.active, key)
+		if t.alert.State != models.AlertFiring {
+			continue
+		}
+		if watched {
+			t.alert.Value = value
+		} else {
+			t.alert.Reason = "no longer watched"
+		}
+		resolved := now
+		t.alert.State = models.AlertResolved
+		t.alert.ResolvedAt = &resolved
+		e.logger.Infof("Alert %s", Text(t.alert))
+		e.resolved = append(e.resolved, t.alert)
+		if len(e.resolved) > keptResolved {
+			e.resolved = e.resolved[len(e.resolved)-keptResolved:]
+		}
+		e.notifyLocked(t.rule, t.alert)
+	}
+
+	firingAlerts.Reset()
+	for _, t := range e.active {
+		if t.alert.State == models.AlertFiring {
+			firingAlerts.WithLabelValues(t.alert.Rule).Inc()
+		}
+	}
+}
+
+// notifyLocked queues alert for the notifiers of rule.
+func (e *Engine) notifyLocked(rule models.AlertRule, alert models.Alert) {
+	for _, n := range e.notifiers {
+		if len(rule.Notifiers) == 0 || slices.Contains(rule.Notifiers, n.Name) {
+			e.outbox = append(e.outbox, &message{notifier: n.Name, alert: alert})
+		}
+	}
+}
+
+func (e *Engine) notifier(name string) (models.Notifier, bool) {
+	for _, n := range e.notifiers {
+		if n.Name == name {
+			return n, true
+		}
+	}
+	return models.Notifier{}, false
+}
+
+// ForgetNode stops alerting about a node that left on purpose. Its
+// alerts resolve at the next evaluation.
+func (e *Engine) ForgetNode(nodeID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.lastSeen, nodeID)
+}
+
+// Alerts returns the pending and firing alerts, firing first, then by rule
+// and node.
+func (e *Engine) Alerts() []models.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := make([]models.Alert, 0, len(e.active))
+	for _, t := range e.active {
+		alerts = append(alerts, t.alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		a, b := alerts[i], alerts[j]
+		if a.State != b.State {
+			return a.State == models.AlertFiring
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Node < b.Node
+	})
+	return alerts
+}
+
+// Resolved returns the latest resolved alerts, newest first.
+func (e *Engine) Resolved() []models.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := make([]models.Alert, 0, len(e.resolved))
+	for i := len(e.resolved) - 1; i >= 0; i-- {
+		alerts = append(alerts, e.resolved[i])
+	}
+	return alerts
+}
+
+// Rules returns the alert rules.
+func (e *Engine) Rules() []models.AlertRule {
+	return e.rules
+}
+
+// Notifiers returns the notifiers by name and type only, since their
+// URLs and tokens are secrets.
+func (e *Engine) Notifiers() []models.Notifier {
+	list := make([]models.Notifier, 0, len(e.notifiers))
+	for _, n := range e.notifiers {
+		list = append(list, models.Notifier{Name: n.Name, Type: n.Type})
+	}
+	return list
+}
+
+// Test sends a test alert through the named notifier right away.
+func (e *Engine) Test(name string) error {
+	n, ok := e.notifier(name)
+	if !ok {
+		return fmt.Errorf("notifier %s not found", name)
+	}
+	now := time.Now()
+	test := models.Alert{Rule: "test", Severity: "info", State: models.AlertFiring, Since: now, FiredAt: &now}
+	err := send(e.client, n, test, "Test notification from the proxy-v6 coordinator")
+	if err != nil {
+		notifications.WithLabelValues(n.Name, "error").Inc()
+		return err
+	}
+	notifications.WithLabelValues(n.Name, "sent").Inc()
+	return nil
+}
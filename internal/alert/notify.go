@@ -0,0 +1,107 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Notifier types.
+const (
+	NotifierSlack    = "slack"
+	NotifierTelegram = "telegram"
+	NotifierHTTP     = "http"
+)
+
+const (
+	defaultTelegramAPI = "https://api.telegram.org"
+	defaultTimeout     = 10 * time.Second
+)
+
+// ValidateNotifier checks a notifier before alerts are sent through it.
+func ValidateNotifier(n models.Notifier) error {
+	if n.Name == "" {
+		return fmt.Errorf("notifier needs a name")
+	}
+	switch n.Type {
+	case NotifierSlack, NotifierHTTP:
+		if !httpURL(n.URL) {
+			return fmt.Errorf("notifier %s: url must be an http or https URL", n.Name)
+		}
+	case NotifierTelegram:
+		if n.Token == "" || n.ChatID == "" {
+			return fmt.Errorf("notifier %s: telegram needs a token and a chat_id", n.Name)
+		}
+		if n.URL != "" && !httpURL(n.URL) {
+			return fmt.Errorf("notifier %s: url must be an http or https URL", n.Name)
+		}
+	default:
+		return fmt.Errorf("notifier %s: type must be %q, %q or %q", n.Name, NotifierSlack, NotifierTelegram, NotifierHTTP)
+	}
+	if n.TimeoutSeconds < 0 || n.TimeoutSeconds > 300 {
+		return fmt.Errorf("notifier %s: timeout_seconds must be between 0 and 300", n.Name)
+	}
+	return nil
+}
+
+func httpURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// send tells n about alert once, in text for chats.
+func send(client *http.Client, n models.Notifier, alert models.Alert, text string) error {
+	target := n.URL
+	var payload interface{}
+	switch n.Type {
+	case NotifierSlack:
+		payload = map[string]string{"text": text}
+	case NotifierTelegram:
+		api := n.URL
+		if api == "" {
+			api = defaultTelegramAPI
+		}
+		target = strings.TrimSuffix(api, "/") + "/bot" + n.Token + "/sendMessage"
+		payload = map[string]string{"chat_id": n.ChatID, "text": text}
+	default:
+		payload = struct {
+			models.Alert
+			Text string `json:"text"`
+		}{alert, text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	timeout := defaultTimeout
+	if n.TimeoutSeconds > 0 {
+		timeout = time.Duration(n.TimeoutSeconds) * time.Second
+	}
+	c := *client
+	c.Timeout = timeout
+	resp, err := c.Do(req)
+	if err != nil {
+		// The Telegram URL carries the bot token
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", n.Type, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package alert evaluates the coordinator's alert rules against the state
+// of the cluster, and tells Slack, Telegram or HTTP endpoints when an alert
+// fires and when it resolves.
+package alert
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Metrics alert rules can watch. The node_ ones are per node.
+const (
+	MetricHealthyProxies       = "healthy_proxies"   // healthy exits of the cluster, standby ones left out
+	MetricUnhealthyProxies     = "unhealthy_proxies" // exits failing their health checks
+	MetricNodes                = "nodes"             // nodes the coordinator lists
+	MetricNodeHealthyProxies   = "node_healthy_proxies"
+	MetricNodeUnhealthyProxies = "node_unhealthy_proxies"
+	MetricNodeHeartbeatAge     = "node_heartbeat_age_seconds" // since the node last reported
+)
+
+var metrics = []string{
+	MetricHealthyProxies,
+	MetricUnhealthyProxies,
+	MetricNodes,
+	MetricNodeHealthyProxies,
+	MetricNodeUnhealthyProxies,
+	MetricNodeHeartbeatAge,
+}
+
+var ops = []string{"<", "<=", ">", ">=", "==", "!="}
+
+const defaultSeverity = "warning"
+
+// Snapshot is the state of the cluster one evaluation looks at.
+type Snapshot struct {
+	Nodes []NodeSample
+}
+
+// NodeSample is a node as the coordinator lists it.
+type NodeSample struct {
+	NodeID      string
+	LastReport  time.Time
+	Healthy     int
+	Unhealthy   int
+	Maintenance bool // in a maintenance window, left out of per-node rules
+}
+
+func perNode(metric string) bool {
+	return strings.HasPrefix(metric, "node_")
+}
+
+// ValidateRule checks a rule against the notifiers it may name.
+func ValidateRule(rule models.AlertRule, notifiers []models.Notifier) error {
+	if rule.Name == "" {
+		return fmt.Errorf("alert rule needs a name")
+	}
+	if !slices.Contains(metrics, rule.Metric) {
+		return fmt.Errorf("alert rule %s: metric must be one of %s", rule.Name, strings.Join(metrics, ", "))
+	}
+	if !slices.Contains(ops, rule.Op) {
+		return fmt.Errorf("alert rule %s: op must be one of %s", rule.Name, strings.Join(ops, " "))
+	}
+	if rule.ForSeconds < 0 {
+		return fmt.Errorf("alert rule %s: for_seconds must not be negative", rule.Name)
+	}
+	if len(rule.Nodes) > 0 && !perNode(rule.Metric) {
+		return fmt.Errorf("alert rule %s: nodes only apply to node_ metrics", rule.Name)
+	}
+	for _, name := range rule.Notifiers {
+		if !slices.ContainsFunc(notifiers, func(n models.Notifier) bool { return n.Name == name }) {
+			return fmt.Errorf("alert rule %s: unknown notifier %s", rule.Name, name)
+		}
+	}
+	return nil
+}
+
+// holds reports whether value compared by op with threshold is true.
+func holds(op string, value, threshold float64) bool {
+	switch op {
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+	return false
+}
+
+// Text is the message notifiers send about an alert.
+func Text(alert models.Alert) string {
+	subject := alert.Rule
+	if alert.Node != "" {
+		subject += " on node " + alert.Node
+	}
+	value := fmt.Sprintf("%s is %g", alert.Metric, alert.Value)
+	if alert.State == models.AlertResolved {
+		var lasted time.Duration
+		if alert.FiredAt != nil && alert.ResolvedAt != nil {
+			lasted = alert.ResolvedAt.Sub(*alert.FiredAt).Round(time.Second)
+		}
+		if alert.Reason != "" {
+			value = alert.Reason
+		}
+		return fmt.Sprintf("[RESOLVED] %s: %s, after firing for %s", subject, value, lasted)
+	}
+	return fmt.Sprintf("[%s] %s (%s): %s, %s %g since %s", strings.ToUpper(alert.State), subject, alert.Severity,
+		value, alert.Op, alert.Threshold, alert.Since.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,111 @@
+package apierror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the request ID on both requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// IdempotencyKeyHeader identifies a command so the agent can tell a resent
+// command from a new one. Replayed responses carry IdempotencyReplayedHeader.
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotency-Replayed"
+)
+
+// Machine-readable error codes shared by the proxy path and the APIs.
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeRequestTooLarge   = "request_too_large"
+	CodeConflict          = "conflict"
+	CodeNotFound          = "not_found"
+	CodeNotSupported      = "not_supported"
+	CodeHistoryExpired    = "history_expired"
+	CodeResyncRequired    = "resync_required"
+	CodeInternal          = "internal_error"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeProxyAuthRequired = "proxy_auth_required"
+	CodeOutsideSchedule   = "outside_schedule"
+	CodeDestinationDenied = "destination_denied"
+	CodeNoExitAvailable   = "no_exit_available"
+	CodeQueueFull         = "queue_full"
+	CodeQueueTimeout      = "queue_timeout"
+	CodeOverloaded        = "overloaded"
+	CodeDraining          = "draining"
+	CodeReadOnly          = "read_only"
+	CodeReuseLimited      = "reuse_limited"
+	CodeConstraintsUnmet  = "constraints_unmet"
+	CodeRateLimited       = "rate_limited"
+	CodeContentBlocked    = "content_blocked"
+	CodeResponseTooLarge  = "response_too_large"
+	CodeUpstreamFailed    = "upstream_failed"
+	CodeUpstreamRejected  = "upstream_rejected"
+	CodeFaultInjected     = "fault_injected"
+)
+
+// Error is the JSON body of every error response.
+type Error struct {
+	Code           string   `json:"code"`
+	Message        string   `json:"message"`
+	RequestID      string   `json:"request_id,omitempty"`
+	AttemptedExits []string `json:"attempted_exits,omitempty"`
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewRequestID returns a random identifier for correlating logs and errors.
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Write sends e as JSON with the given status. The request ID is taken
+// from the response headers when e does not carry one.
+func Write(w http.ResponseWriter, status int, e Error) {
+	if e.RequestID == "" {
+		e.RequestID = w.Header().Get(RequestIDHeader)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// Respond aborts a gin request with a structured error.
+func Respond(c *gin.Context, status int, code string, err error) {
+	RespondMessage(c, status, code, err.Error())
+}
+
+func RespondMessage(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, Error{
+		Code:      code,
+		Message:   message,
+		RequestID: c.Writer.Header().Get(RequestIDHeader),
+	})
+}
+
+// RequestID is gin middleware that propagates or assigns a request ID.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" {
+			id = NewRequestID()
+		}
+		c.Writer.Header().Set(RequestIDHeader, id)
+		c.Next()
+	}
+}
@@ -0,0 +1,252 @@
+// Package apikey authenticates callers of the coordinator API with bearer
+// tokens. Keys live in a JSON file that stores only token hashes; the file
+// is re-read when it changes so keys can be managed while the coordinator
+// runs.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles limit what a key may do. Admin keys can call everything, read-only
+// keys only GET endpoints, agent keys only report the status of their node
+// and replica keys only copy the state read replicas serve from. Tenant keys only see
+// their tenant's exits, users and usage.
+const (
+	RoleAdmin    = "admin"
+	RoleReadOnly = "readonly"
+	RoleAgent    = "agent"
+	RoleReplica  = "replica"
+	RoleTenant   = "tenant"
+)
+
+const (
+	tokenPrefix    = "pv6_"
+	reloadInterval = time.Second
+)
+
+var ErrInvalidKey = errors.New("invalid API key")
+
+// Key is a stored API key. The token itself is only shown once, at
+// creation.
+type Key struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Tenant    string    `json:"tenant,omitempty"`  // set for tenant keys
+	NodeID    string    `json:"node_id,omitempty"` // set for agent keys
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ValidRole reports whether role is one of the defined roles.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleReadOnly, RoleAgent, RoleReplica, RoleTenant:
+		return true
+	}
+	return false
+}
+
+// Store holds the keys from one file.
+type Store struct {
+	path      string
+	keys      map[string]Key
+	modTime   time.Time
+	lastCheck time.Time
+	mu        sync.Mutex
+}
+
+// Open loads the keys at path. A missing file is an empty store; it is
+// created by the first Create.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string]Key)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload re-reads the file if it changed. Called with s.mu held.
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys = make(map[string]Key)
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read API keys: %w", err)
+	}
+	var list []Key
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse API keys: %w", err)
+	}
+	keys := make(map[string]Key, len(list))
+	for _, k := range list {
+		keys[k.ID] = k
+	}
+	s.keys = keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func (s *Store) save() error {
+	list := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write API keys: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write API keys: %w", err)
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Create adds a key and returns it with its token. Tenant keys name their
+// tenant and agent keys their node; no other key has either.
+func (s *Store) Create(name, role, tenant, nodeID string) (Key, string, error) {
+	if !ValidRole(role) {
+		return Key{}, "", fmt.Errorf("unknown role %q (valid: %s, %s, %s, %s, %s)", role, RoleAdmin, RoleReadOnly, RoleAgent, RoleReplica, RoleTenant)
+	}
+	if (role == RoleTenant) != (tenant != "") {
+		return Key{}, "", fmt.Errorf("a tenant is required for %s keys and only for them", RoleTenant)
+	}
+	if (role == RoleAgent) != (nodeID != "") {
+		return Key{}, "", fmt.Errorf("a node is required for %s keys and only for them", RoleAgent)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return Key{}, "", err
+	}
+
+	id, err := randomHex(4)
+	if err != nil {
+		return Key{}, "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return Key{}, "", err
+	}
+	token := tokenPrefix + id + "_" + secret
+
+	key := Key{ID: id, Name: name, Role: role, Tenant: tenant, NodeID: nodeID, Hash: hash(token), CreatedAt: time.Now().UTC()}
+	s.keys[id] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, id)
+		return Key{}, "", err
+	}
+	return key, token, nil
+}
+
+// Revoke deletes the key with id.
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	key, ok := s.keys[id]
+	if !ok {
+		return fmt.Errorf("API key not found: %s", id)
+	}
+	delete(s.keys, id)
+	if err := s.save(); err != nil {
+		s.keys[id] = key
+		return err
+	}
+	return nil
+}
+
+// List returns all keys, oldest first.
+func (s *Store) List() ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	list := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// Authenticate returns the key a token belongs to.
+func (s *Store) Authenticate(token string) (Key, error) {
+	id, ok := tokenID(token)
+	if !ok {
+		return Key{}, ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	if time.Since(s.lastCheck) >= reloadInterval {
+		s.lastCheck = time.Now()
+		// On a read error keep serving with the keys already loaded
+		s.reload()
+	}
+	key, exists := s.keys[id]
+	s.mu.Unlock()
+
+	if !exists || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash(token))) != 1 {
+		return Key{}, ErrInvalidKey
+	}
+	return key, nil
+}
+
+func tokenID(token string) (string, bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", false
+	}
+	id, _, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), "_")
+	return id, ok && id != ""
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,146 @@
+package apikey
+
+import (
+	"net/http"
+	"strings"
+
+	"proxy-v6/internal/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContextKey is where Middleware stores the authenticated Key.
+const ContextKey = "api_key"
+
+// Tenant returns the tenant of the key that authenticated c, or "" for
+// other keys and an API without keys.
+func Tenant(c *gin.Context) string {
+	if value, ok := c.Get(ContextKey); ok {
+		if key, ok := value.(Key); ok {
+			return key.Tenant
+		}
+	}
+	return ""
+}
+
+// Role returns the role of the key that authenticated c, or "" for an API
+// without keys.
+func Role(c *gin.Context) string {
+	if value, ok := c.Get(ContextKey); ok {
+		if key, ok := value.(Key); ok {
+			return key.Role
+		}
+	}
+	return ""
+}
+
+// ReplicationRoute serves the state read replicas copy.
+const ReplicationRoute = "/api/replication/state"
+
+// AgentProxyRoute passes calls through to a node's agent API, which can
+// read exit credentials and run any agent command.
+const AgentProxyRoute = "/api/nodes/:nodeId/agent/*path"
+
+// Header is an alternative to "Authorization: Bearer <token>".
+const Header = "X-API-Key"
+
+// Token extracts the API token from a request.
+func Token(r *http.Request) string {
+	if token := r.Header.Get(Header); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Permits reports whether role may call method on the route pattern.
+func Permits(role, method, route string) bool {
+	switch role {
+	case RoleAdmin:
+		return true
+	case RoleReadOnly:
+		// The replication state carries user passwords
+		return (method == http.MethodGet || method == http.MethodHead) && route != ReplicationRoute && route != AgentProxyRoute
+	case RoleReplica:
+		return method == http.MethodGet && route == ReplicationRoute
+	case RoleTenant:
+		switch route {
+		case "/api/tenant", "/api/proxies/export", "/api/pool/snapshot", "/api/pool/diff", "/api/ledger", "/api/usage":
+			return method == http.MethodGet
+		case "/api/users":
+			return method == http.MethodGet || method == http.MethodPost
+		case "/api/users/:username":
+			return method == http.MethodDelete
+		}
+		return false
+	case RoleAgent:
+		switch route {
+		case "/api/nodes/:nodeId":
+			return method == http.MethodPost || method == http.MethodDelete
+		case "/api/nodes/:nodeId/delta", "/api/nodes/:nodeId/events", "/api/nodes/:nodeId/commands/:commandId/result":
+			return method == http.MethodPost
+		case "/api/nodes/:nodeId/commands/next":
+			return method == http.MethodGet
+		}
+		return false
+	}
+	return false
+}
+
+// Middleware rejects requests without a valid key for the route. Paths in
+// public are served without a key. onFailure, if set, is told about every
+// rejected request.
+func Middleware(store *Store, public []string, onFailure func(c *gin.Context, reason string)) gin.HandlerFunc {
+	open := make(map[string]bool, len(public))
+	for _, path := range public {
+		open[path] = true
+	}
+
+	return func(c *gin.Context) {
+		if open[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		token := Token(c.Request)
+		if token == "" {
+			if onFailure != nil {
+				onFailure(c, "missing API key")
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="proxy-v6"`)
+			apierror.RespondMessage(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "API key required")
+			return
+		}
+
+		key, err := store.Authenticate(token)
+		if err != nil {
+			if onFailure != nil {
+				onFailure(c, err.Error())
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="proxy-v6", error="invalid_token"`)
+			apierror.RespondMessage(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+			return
+		}
+
+		if !Permits(key.Role, c.Request.Method, c.FullPath()) {
+			if onFailure != nil {
+				onFailure(c, "key "+key.ID+" ("+key.Role+") not permitted")
+			}
+			apierror.RespondMessage(c, http.StatusForbidden, apierror.CodeForbidden, "API key not permitted for this endpoint")
+			return
+		}
+		// Every agent route names a node; agents only speak for their own
+		if key.Role == RoleAgent && c.Param("nodeId") != key.NodeID {
+			if onFailure != nil {
+				onFailure(c, "key "+key.ID+" ("+key.Role+") not permitted for node "+c.Param("nodeId"))
+			}
+			apierror.RespondMessage(c, http.StatusForbidden, apierror.CodeForbidden, "API key not permitted for this node")
+			return
+		}
+
+		c.Set(ContextKey, key)
+		c.Next()
+	}
+}
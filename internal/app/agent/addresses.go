@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"net"
+
+	"proxy-v6/internal/ipscanner"
+	"proxy-v6/internal/proxy"
+	"proxy-v6/pkg/models"
+)
+
+// watchAddresses starts proxies on the public IPv6 addresses configured on
+// the host while the agent runs, as on startup, and stops the instances
+// whose address is removed, so addresses come and go without a restart.
+// known are the addresses proxies were started on at startup.
+func watchAddresses(ctx context.Context, manager *proxy.Manager, scanner *ipscanner.Scanner, allocator *ipscanner.Allocator, known []models.IPv6Address) {
+	for change := range scanner.Watch(ctx, known) {
+		if change.Added {
+			addressAdded(ctx, manager, allocator, change.Address)
+		} else {
+			addressRemoved(manager, change.Address.IP)
+		}
+	}
+}
+
+func addressAdded(ctx context.Context, manager *proxy.Manager, allocator *ipscanner.Allocator, ipv6 models.IPv6Address) {
+	// Addresses from --ipv6-prefix get their instances from whatever
+	// allocated them, and are put back by watchInterfaces
+	if allocator != nil && allocator.Contains(ipv6.IP) {
+		return
+	}
+	// Instead of being resumed by watchInterfaces
+	if addressInUse(manager.GetInstances(), ipv6.IP) {
+		return
+	}
+
+	logger.Infof("Starting proxies on new IPv6 %s", ipv6.IP)
+	if _, err := manager.StartProxy(ctx, ipv6); err != nil {
+		logger.Errorf("Failed to start proxy for %s: %v", ipv6.IP, err)
+		return
+	}
+	if cfg.SOCKS5 {
+		if _, err := manager.StartSOCKS5(ctx, ipv6); err != nil {
+			logger.Errorf("Failed to start SOCKS5 proxy for %s: %v", ipv6.IP, err)
+		}
+	}
+}
+
+func addressRemoved(manager *proxy.Manager, ip net.IP) {
+	for _, instance := range manager.GetInstances() {
+		if instance.Status == models.ProxyStatusStopped || !instance.IPv6.IP.Equal(ip) {
+			continue
+		}
+		// Linux drops the addresses of an interface taken down;
+		// watchInterfaces pauses those instances until they are back
+		if cfg.LinkCheckInterval > 0 && (instance.Status == models.ProxyStatusPaused || !linkUp(instance.IPv6.Interface)) {
+			continue
+		}
+		logger.Warnf("IPv6 %s was removed, stopping proxy %s", ip, instance.ID)
+		if err := manager.StopProxy(instance.ID); err != nil {
+			logger.Errorf("Failed to stop proxy %s: %v", instance.ID, err)
+		}
+	}
+}
@@ -0,0 +1,825 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/ipscanner"
+	"proxy-v6/internal/metrics"
+	"proxy-v6/internal/mtls"
+	"proxy-v6/internal/proxy"
+	"proxy-v6/pkg/models"
+	"proxy-v6/pkg/version"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	logger *logrus.Logger
+	cfg    models.AgentConfig
+)
+
+// Command returns the agent command. cmd/agent runs it directly and the
+// root proxy-v6 binary mounts it as "proxy-v6 agent".
+func Command() *cobra.Command {
+	logger = logrus.New()
+	
+	// Use text formatter for better readability during debugging
+	logger.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+		TimestampFormat: "2006-01-02 15:04:05",
+	})
+	
+	// Set debug level by default for better visibility
+	logger.SetLevel(logrus.DebugLevel)
+	
+	rootCmd := &cobra.Command{
+		Use:   "agent",
+		Short: "IPv6 proxy agent for managing tinyproxy instances",
+		Run:   runAgent,
+	}
+	
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print version information",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(version.GetVersion())
+		},
+	}
+	
+	rootCmd.AddCommand(versionCmd)
+	
+	rootCmd.PersistentFlags().StringP("config", "c", "", "config file path")
+	rootCmd.PersistentFlags().IntP("port", "p", 8080, "API listen port")
+	rootCmd.PersistentFlags().IntP("proxy-start", "", 10000, "Starting port for proxy instances")
+	rootCmd.PersistentFlags().IntP("proxy-end", "", 20000, "Ending port for proxy instances")
+	rootCmd.PersistentFlags().StringP("coordinator", "", "", "Coordinator URL")
+	rootCmd.PersistentFlags().String("node-id", "", "Node ID reported to the coordinator (default: the hostname)")
+	rootCmd.PersistentFlags().Duration("report-interval", defaultReportInterval, "How often this node reports to the coordinator")
+	rootCmd.PersistentFlags().IntP("metrics-port", "m", 9090, "Metrics port")
+	rootCmd.PersistentFlags().StringSlice("allowed-ips", []string{}, "IPs allowed to connect to proxies (comma-separated)")
+	rootCmd.PersistentFlags().StringP("proxy-mode", "", "restricted", "Proxy access mode: 'open' (allow all) or 'restricted' (allow only specified IPs)")
+	rootCmd.PersistentFlags().StringP("log-level", "l", "debug", "Log level: debug, info, warn, error")
+	rootCmd.PersistentFlags().StringSlice("warmup-urls", []string{}, "URLs to request through each new proxy before it is reported as running")
+	rootCmd.PersistentFlags().Duration("warmup-timeout", 10*time.Second, "Timeout for each warm-up request")
+	rootCmd.PersistentFlags().String("egress-check-url", "", "IP echo URL requested through each proxy on every health check; proxies whose egress IP differs from their bound IPv6 are marked error")
+	rootCmd.PersistentFlags().Duration("egress-check-timeout", 10*time.Second, "Timeout for each egress verification request")
+	rootCmd.PersistentFlags().IntP("standby-proxies", "", 0, "Number of started proxies to hold in reserve as warm standby")
+	rootCmd.PersistentFlags().String("api-key", "", "API key presented to the coordinator (agent or admin role)")
+	rootCmd.PersistentFlags().String("tls-cert", "", "Client certificate presented to an https coordinator (reloaded when it changes)")
+	rootCmd.PersistentFlags().String("tls-key", "", "Private key for --tls-cert")
+	rootCmd.PersistentFlags().String("tls-ca", "", "CA bundle the coordinator's certificate must be signed by")
+	rootCmd.PersistentFlags().Duration("max-clock-skew", defaultMaxClockSkew, "Warn when the coordinator's clock differs from this host's by more than this (0 = off)")
+	rootCmd.PersistentFlags().Duration("full-report-interval", defaultFullReportInterval, "How often a full report is sent to the coordinator, with only changes sent in between (0 = always full)")
+	rootCmd.PersistentFlags().Bool("proxy-auth", false, "Require basic auth on every proxy instance")
+	rootCmd.PersistentFlags().String("proxy-username", "", "Username for all instances with --proxy-auth (random per instance if empty)")
+	rootCmd.PersistentFlags().String("proxy-password", "", "Password for all instances with --proxy-auth (random per instance if empty)")
+	rootCmd.PersistentFlags().Duration("health-interval", 30*time.Second, "How often running proxy instances are health checked")
+	rootCmd.PersistentFlags().Duration("drain-timeout", defaultDrainTimeout, "How long shutdown waits for connections open on the proxies to finish before stopping them (0 = stop at once)")
+	rootCmd.PersistentFlags().Bool("maintenance", false, "Report this node as in maintenance, so the coordinator drains it while its proxies keep running")
+	rootCmd.PersistentFlags().Float64("weight", 0, "Capacity weight reported to the coordinator, which sends each node traffic in proportion to its weight (0 = measured with --weight-from, or one share per proxy)")
+	rootCmd.PersistentFlags().String("weight-from", "", "Measure the capacity weight when --weight is not set: 'cpu' (CPU count) or 'bandwidth' (link speed of the proxies' interfaces in Mbit/s)")
+	rootCmd.PersistentFlags().String("provider", "", "Provider the node's bandwidth is bought from, reported to the coordinator")
+	rootCmd.PersistentFlags().Float64("cost-per-gb", 0, "Egress price per GB reported to the coordinator, which bills usage with it and prefers cheaper nodes with --lb-strategy least-cost (unset = unpriced)")
+	rootCmd.PersistentFlags().Duration("link-check-interval", defaultLinkCheckInterval, "How often the interfaces of proxy instances are checked for a link, pausing their instances while it is gone (0 = off)")
+	rootCmd.PersistentFlags().Bool("watch-addresses", true, "Start proxies on public IPv6 addresses added while the agent runs, and stop those whose address is removed")
+	rootCmd.PersistentFlags().StringP("proxy-backend", "", "tinyproxy", "Proxy engine: 'tinyproxy' or '3proxy' (one process per address), or 'embedded' (in-process)")
+	rootCmd.PersistentFlags().Bool("socks5", false, "Also start an in-process SOCKS5 proxy on every IPv6 address")
+	rootCmd.PersistentFlags().String("ipv6-prefix", "", "Routed IPv6 prefix to allocate proxy addresses from, e.g. 2001:db8:1:2::/64")
+	rootCmd.PersistentFlags().String("ipv6-interface", "", "Interface to add allocated addresses to (default: the one the prefix routes through)")
+	rootCmd.PersistentFlags().Int("ipv6-count", 0, "Number of addresses to allocate from --ipv6-prefix")
+	rootCmd.PersistentFlags().Int("aggregate-port", 0, "Also serve one HTTP proxy port that rotates across this node's exits (0 = off)")
+	rootCmd.PersistentFlags().String("region", "", "Region reported to the coordinator and used for region metrics")
+	rootCmd.PersistentFlags().String("metrics-granularity", "exit", "Instance metric labels: 'exit' (per instance), 'node' or 'region' (summed)")
+	rootCmd.PersistentFlags().Int("metrics-max-exits", proxy.DefaultMaxExitSeries, "Instances above which exit metrics are summed per node (0 = no limit)")
+	rootCmd.PersistentFlags().Int64("quota-mb", 0, "Bandwidth each egress IP may carry per quota period, in MB; exits over it are marked quota_exceeded (0 = no quota)")
+	rootCmd.PersistentFlags().String("quota-reset", proxy.QuotaResetDaily, "When quota usage resets (UTC): 'hourly', 'daily', 'weekly' or 'monthly'")
+	rootCmd.PersistentFlags().String("state-file", proxy.DefaultStateFile, "File the running proxy processes are recorded in, to find them again after a crash (empty = off)")
+	rootCmd.PersistentFlags().Int64("max-log-size-mb", defaultMaxLogSizeMB, "Size at which a proxy instance's log is rotated, in MB (0 = never)")
+	rootCmd.PersistentFlags().Int("log-keep", 1, "Rotated copies kept of each proxy instance log (0 = truncate only)")
+	rootCmd.PersistentFlags().Float64("disk-warn-percent", defaultDiskWarnPercent, "Disk usage of the proxy runtime and state directories at which a warning is logged and every instance log is truncated (0 = off)")
+	rootCmd.PersistentFlags().Duration("housekeeping-interval", defaultHousekeepingInterval, "How often proxy logs are rotated, files of stopped instances removed and disk usage checked (0 = off)")
+	rootCmd.PersistentFlags().StringSlice("event-sinks", []string{sinkLog, sinkCoordinator}, "Where proxy lifecycle events are sent: 'log', 'coordinator' (when --coordinator is set) and 'webhook' (to --event-webhook)")
+	rootCmd.PersistentFlags().String("event-webhook", "", "URL the webhook event sink posts batches of lifecycle events to, as JSON arrays")
+	rootCmd.PersistentFlags().Duration("archive-after", proxy.DefaultArchiveAfter, "How long a stopped or failed proxy instance stays in /proxies and node reports before it is archived (0 = never)")
+	rootCmd.PersistentFlags().String("archive-file", proxy.DefaultArchiveFile, "File archived instances are kept in, listed by /proxies?state=archived (empty = drop them)")
+	rootCmd.PersistentFlags().Int("archive-keep", proxy.DefaultArchiveKeep, "Archived instances kept, dropping the oldest (0 = all)")
+	rootCmd.PersistentFlags().Bool("adopt-proxies", true, "On startup, take over proxy processes an earlier agent left running instead of stopping them and starting fresh")
+	rootCmd.PersistentFlags().StringP("advertise-url", "", "", "Agent API URL the coordinator should use (default: report source IP and API port)")
+	rootCmd.PersistentFlags().String("api-token", "", "Token every agent API call except /health must present; reported to the coordinator, which presents it when calling the agent")
+	
+	// Flags are bound when the command runs rather than here, so that
+	// building every command in one binary does not clobber the shared
+	// viper keys (port, metrics-port, ...)
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
+			return fmt.Errorf("failed to bind flags: %w", err)
+		}
+		return nil
+	}
+	
+	return rootCmd
+}
+
+func runAgent(cmd *cobra.Command, args []string) {
+	// Set log level
+	logLevel := viper.GetString("log-level")
+	switch logLevel {
+	case "debug":
+		logger.SetLevel(logrus.DebugLevel)
+	case "info":
+		logger.SetLevel(logrus.InfoLevel)
+	case "warn":
+		logger.SetLevel(logrus.WarnLevel)
+	case "error":
+		logger.SetLevel(logrus.ErrorLevel)
+	default:
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	
+	configFile := viper.GetString("config")
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			logger.Warnf("Failed to read config file: %v", err)
+		}
+	}
+	
+	var err error
+	cfg, err = readConfig(viper.GetViper())
+	if err != nil {
+		logger.Fatalf("Failed to load the configuration: %v", err)
+	}
+	
+	if cfg.ReportInterval <= 0 {
+		logger.Fatalf("Invalid --report-interval: must be positive")
+	}
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	scanner := ipscanner.NewScanner(logger, cfg.ExcludeInterfaces)
+	manager := proxy.NewManager(logger, cfg.ProxyStartPort, cfg.ProxyEndPort)
+	if err := manager.SetBackend(cfg.ProxyBackend); err != nil {
+		logger.Fatalf("Invalid proxy backend: %v", err)
+	}
+	manager.SetWarmup(cfg.WarmupURLs, cfg.WarmupTimeout)
+	manager.SetEgressCheck(cfg.EgressCheckURL, cfg.EgressCheckTimeout)
+	manager.SetProxyAuth(cfg.ProxyAuth, cfg.ProxyUsername, cfg.ProxyPassword)
+	if err := manager.SetHooks(cfg.Hooks); err != nil {
+		logger.Fatalf("Invalid hook configuration: %v", err)
+	}
+	if err := manager.SetLabelRules(cfg.InstanceLabels); err != nil {
+		logger.Fatalf("Invalid instance_labels: %v", err)
+	}
+	if err := manager.SetMetricsGranularity(cfg.MetricsGranularity, nodeID(), cfg.Region, cfg.MetricsMaxExits); err != nil {
+		logger.Fatalf("Invalid --metrics-granularity: %v", err)
+	}
+	if err := manager.SetQuota(cfg.QuotaMB<<20, cfg.QuotaReset); err != nil {
+		logger.Fatalf("Invalid quota: %v", err)
+	}
+	if err := manager.SetLogRotation(cfg.MaxLogSizeMB<<20, cfg.LogKeep); err != nil {
+		logger.Fatalf("Invalid log rotation: %v", err)
+	}
+	if err := manager.SetArchive(cfg.ArchiveFile, cfg.ArchiveAfter, cfg.ArchiveKeep); err != nil {
+		logger.Fatalf("Invalid archive settings: %v", err)
+	}
+	if cfg.DiskWarnPercent < 0 || cfg.DiskWarnPercent > 100 {
+		logger.Fatal("--disk-warn-percent must be between 0 and 100")
+	}
+	if err := validateWeight(cfg.Weight, cfg.WeightFrom); err != nil {
+		logger.Fatalf("Invalid weight: %v", err)
+	}
+	if cfg.CostPerGB != nil && *cfg.CostPerGB < 0 {
+		logger.Fatal("--cost-per-gb must not be negative")
+	}
+	
+	var transport http.RoundTripper
+	if cfg.CoordinatorURL != "" {
+		var err error
+		transport, err = mtls.Transport(logger, mtls.Files{Cert: cfg.TLSCert, Key: cfg.TLSKey, CA: cfg.TLSCA})
+		if err != nil {
+			logger.Fatalf("Failed to set up coordinator TLS: %v", err)
+		}
+	}
+	// Before any instance starts, so the sinks see every one of them
+	sinks, err := eventSinks(cfg, transport)
+	if err != nil {
+		logger.Fatalf("Invalid --event-sinks: %v", err)
+	}
+	manager.SetEventSinks(nodeID(), sinks)
+	
+	// Configure access control
+	if cfg.ProxyMode == "restricted" {
+		// Auto-detect coordinator IP if not explicitly set
+		allowedIPs := cfg.AllowedIPs
+		if cfg.CoordinatorURL != "" && len(allowedIPs) == 0 {
+			// Extract coordinator IP from URL
+			if u, err := url.Parse(cfg.CoordinatorURL); err == nil {
+				if host, _, err := net.SplitHostPort(u.Host); err == nil {
+					allowedIPs = append(allowedIPs, host)
+				} else {
+					// No port in URL
+					allowedIPs = append(allowedIPs, u.Hostname())
+				}
+			}
+		}
+		manager.SetAccessControl(allowedIPs, cfg.ProxyMode)
+		logger.Infof("Proxy access mode: %s, Allowed IPs: %v", cfg.ProxyMode, allowedIPs)
+	} else {
+		manager.SetAccessControl(cfg.AllowedIPs, cfg.ProxyMode)
+		logger.Warn("Proxy access mode: open - proxies will accept connections from anywhere!")
+	}
+	
+	logger.Info("Scanning for IPv6 addresses...")
+	ipv6Addresses, err := scanner.ScanIPv6Addresses()
+	if err != nil {
+		logger.Fatalf("Failed to scan IPv6 addresses: %v", err)
+	}
+	
+	logger.Infof("Found %d public IPv6 addresses", len(ipv6Addresses))
+	
+	var allocator *ipscanner.Allocator
+	if cfg.IPv6Prefix != "" {
+		if cfg.IPv6Count <= 0 {
+			logger.Fatal("--ipv6-count must be positive when --ipv6-prefix is set")
+		}
+		allocator, err = ipscanner.NewAllocator(logger, cfg.IPv6Prefix, cfg.IPv6Interface)
+		if err != nil {
+			logger.Fatalf("Failed to set up IPv6 allocation: %v", err)
+		}
+		allocated, err := allocator.Allocate(cfg.IPv6Count)
+		if err != nil {
+			// Keep whatever was added; proxies still start on those
+			logger.Errorf("Failed to allocate IPv6 addresses from %s: %v", cfg.IPv6Prefix, err)
+		}
+		ipv6Addresses = mergeAddresses(ipv6Addresses, allocated)
+		logger.Infof("Using %d addresses from %s", len(allocated), cfg.IPv6Prefix)
+	}
+	
+	// Processes left by an agent that did not shut down cleanly are taken
+	// over or stopped before anything else binds their ports
+	manager.SetStateFile(cfg.StateFile)
+	adopted, err := manager.RestoreState(ipv6Addresses, cfg.AdoptProxies)
+	if err != nil {
+		logger.Errorf("Failed to restore proxy state: %v", err)
+	}
+	
+	for _, ipv6 := range ipv6Addresses {
+		if !addressInUse(adopted, ipv6.IP) {
+			if _, err := manager.StartProxy(ctx, ipv6); err != nil {
+				logger.Errorf("Failed to start proxy for %s: %v", ipv6.IP.String(), err)
+				continue
+			}
+		}
+		
+		if cfg.SOCKS5 {
+			if _, err := manager.StartSOCKS5(ctx, ipv6); err != nil {
+				logger.Errorf("Failed to start SOCKS5 proxy for %s: %v", ipv6.IP.String(), err)
+				continue
+			}
+		}
+	}
+	
+	if cfg.StandbyProxies > 0 {
+		manager.SetStandbyCount(cfg.StandbyProxies)
+	}
+	
+	// Instances live as long as ctx; the loops looking after them stop as
+	// soon as shutdown starts, so none of them restarts an instance that
+	// is draining
+	background, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	
+	go manager.RunHealthChecks(background, cfg.HealthInterval)
+	if cfg.HousekeepingInterval > 0 {
+		go housekeeping(background, manager, cfg.HousekeepingInterval, cfg.DiskWarnPercent)
+	}
+	if cfg.LinkCheckInterval > 0 {
+		go watchInterfaces(background, manager, allocator, cfg.LinkCheckInterval)
+	}
+	if cfg.WatchAddresses {
+		go watchAddresses(background, manager, scanner, allocator, ipv6Addresses)
+	}
+	
+	router := setupAPIRouter(ctx, manager, scanner, allocator)
+	configRoutes(router, cmd.PersistentFlags())
+	
+	if cfg.AggregatePort > 0 {
+		aggregate, err := newAggregate(manager)
+		if err != nil {
+			logger.Fatalf("Failed to set up aggregate port: %v", err)
+		}
+		go aggregate.run(background, cfg.AggregatePort)
+	}
+	
+	go func() {
+		metricsRouter := gin.New()
+		metricsRouter.GET("/metrics", gin.WrapH(metrics.Handler()))
+		logger.Infof("Starting metrics server on port %d", cfg.MetricsPort)
+		if err := metricsRouter.Run(fmt.Sprintf(":%d", cfg.MetricsPort)); err != nil {
+			logger.Errorf("Metrics server error: %v", err)
+		}
+	}()
+	
+	// Reporting stops first on shutdown, so it cannot register the node
+	// again once it is deregistered
+	reportsDone := make(chan struct{})
+	if cfg.CoordinatorURL != "" {
+		go func() {
+			reportToCoordinator(background, manager, transport)
+			close(reportsDone)
+		}()
+		go pollCommands(background, router, transport)
+	} else {
+		close(reportsDone)
+	}
+	
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.ListenPort),
+		Handler: router,
+	}
+	
+	go func() {
+		logger.Infof("Starting API server on port %d", cfg.ListenPort)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("API server error: %v", err)
+		}
+	}()
+	
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	
+	logger.Info("Shutting down...")
+	stopBackground()
+	<-reportsDone
+	if cfg.CoordinatorURL != "" {
+		deregister(transport)
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Server shutdown error: %v", err)
+	}
+	
+	manager.StopAccepting()
+	drainConnections(manager, cfg.DrainTimeout, sigChan)
+	
+	for _, instance := range manager.GetInstances() {
+		if err := manager.StopProxy(instance.ID); err != nil {
+			logger.Errorf("Failed to stop proxy %s: %v", instance.ID, err)
+		}
+	}
+	manager.CloseEvents(eventFlushTimeout)
+	
+	if allocator != nil {
+		allocator.Release()
+	}
+}
+
+// mergeAddresses appends the allocated addresses the scan did not already
+// find.
+func mergeAddresses(scanned, allocated []models.IPv6Address) []models.IPv6Address {
+	seen := make(map[string]bool, len(scanned))
+	for _, addr := range scanned {
+		seen[addr.IP.String()] = true
+	}
+	for _, addr := range allocated {
+		if !seen[addr.IP.String()] {
+			scanned = append(scanned, addr)
+		}
+	}
+	return scanned
+}
+
+// jsonTags makes viper decode nested config using the models' json tags.
+func jsonTags(dc *mapstructure.DecoderConfig) {
+	dc.TagName = "json"
+}
+
+// startProxyRequest is the body of POST /proxy. IPv6 is an address on this
+// host, or "auto" to allocate one from --ipv6-prefix.
+type startProxyRequest struct {
+	IPv6     string               `json:"ipv6" binding:"required"`
+	Port     int                  `json:"port"`
+	Protocol models.ProxyProtocol `json:"protocol"`
+}
+
+func setupAPIRouter(ctx context.Context, manager *proxy.Manager, scanner *ipscanner.Scanner, allocator *ipscanner.Allocator) *gin.Engine {
+	router := gin.Default()
+	router.Use(apierror.RequestID())
+	router.Use(requireAPIToken())
+	commands := newCommandJournal().idempotent()
+	
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "healthy"})
+	})
+	
+	// ?state=archived lists the instances moved out of the live ones
+	router.GET("/proxies", func(c *gin.Context) {
+		tag := c.Query("tag")
+		switch state := c.DefaultQuery("state", "live"); state {
+		case "live":
+		case "archived":
+			archived, err := manager.Archived()
+			if err != nil {
+				apierror.Respond(c, 500, apierror.CodeInternal, err)
+				return
+			}
+			if tag != "" {
+				tagged := []models.ArchivedInstance{}
+				for _, instance := range archived {
+					if slices.Contains(instance.Tags, tag) {
+						tagged = append(tagged, instance)
+					}
+				}
+				archived = tagged
+			}
+			c.JSON(200, archived)
+			return
+		default:
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("unknown state %q (valid: live, archived)", state))
+			return
+		}
+		
+		instances := manager.GetInstances()
+		if tag != "" {
+			tagged := []models.ProxyInstance{}
+			for _, instance := range instances {
+				if slices.Contains(instance.Tags, tag) {
+					tagged = append(tagged, instance)
+				}
+			}
+			instances = tagged
+		}
+		c.JSON(200, instances)
+	})
+	
+	// Start one more instance. Like /restart it outlives the request.
+	router.POST("/proxy", commands, func(c *gin.Context) {
+		var req startProxyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		switch req.Protocol {
+		case "", models.ProxyProtocolHTTP, models.ProxyProtocolSOCKS5:
+		default:
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("unknown protocol %q", req.Protocol))
+			return
+		}
+		if req.Port < 0 || req.Port > 65535 {
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("invalid port %d", req.Port))
+			return
+		}
+		
+		var ipv6 models.IPv6Address
+		allocated := false
+		if req.IPv6 == "auto" {
+			if allocator == nil {
+				apierror.RespondMessage(c, 501, apierror.CodeNotSupported, "agent has no --ipv6-prefix to allocate from")
+				return
+			}
+			addr, err := allocator.Add()
+			if err != nil {
+				apierror.Respond(c, 500, apierror.CodeInternal, err)
+				return
+			}
+			ipv6, allocated = addr, true
+		} else {
+			addr, ok := lookupAddress(c, scanner, req.IPv6)
+			if !ok {
+				return
+			}
+			ipv6 = addr
+		}
+		
+		instance, err := manager.StartProxyOn(ctx, ipv6, req.Port, req.Protocol)
+		if err != nil {
+			if allocated {
+				if err := allocator.Remove(ipv6.IP); err != nil {
+					logger.Errorf("Failed to remove allocated IPv6 %s: %v", ipv6.IP, err)
+				}
+			}
+			if proxy.IsPortInUse(err) {
+				apierror.Respond(c, 409, apierror.CodeConflict, err)
+				return
+			}
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		logger.Infof("Started proxy on request: %s", instance.ID)
+		c.JSON(200, instance)
+	})
+	
+	router.POST("/proxy/:id/stop", commands, func(c *gin.Context) {
+		instanceID := c.Param("id")
+		if err := manager.StopProxy(instanceID); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		c.JSON(200, gin.H{"status": "stopped"})
+	})
+	
+	router.POST("/proxy/:id/restart", commands, func(c *gin.Context) {
+		instance, err := manager.RestartProxy(ctx, c.Param("id"))
+		if proxy.IsNotFound(err) {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		c.JSON(200, instance)
+	})
+	
+	// Move a proxy to another address, by default a fresh one from
+	// --ipv6-prefix or else a scanned address no instance uses yet. The
+	// instance keeps its ID and port so clients' configuration stays valid.
+	router.POST("/proxy/:id/rotate", commands, func(c *gin.Context) {
+		var req rotateProxyRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+				return
+			}
+		}
+		
+		instanceID := c.Param("id")
+		current, ok := findInstance(manager.GetInstances(), instanceID)
+		if !ok {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, "proxy instance not found: "+instanceID)
+			return
+		}
+		
+		var ipv6 models.IPv6Address
+		allocated := false
+		switch {
+		case req.IPv6 != "" && req.IPv6 != "auto":
+			addr, ok := lookupAddress(c, scanner, req.IPv6)
+			if !ok {
+				return
+			}
+			if addr.IP.Equal(current.IPv6.IP) {
+				apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("%s is already on %s", instanceID, addr.IP))
+				return
+			}
+			ipv6 = addr
+		case allocator != nil:
+			addr, err := allocator.Add()
+			if err != nil {
+				apierror.Respond(c, 500, apierror.CodeInternal, err)
+				return
+			}
+			ipv6, allocated = addr, true
+		default:
+			addr, err := unusedAddress(scanner, manager.GetInstances())
+			if err != nil {
+				apierror.Respond(c, 409, apierror.CodeConflict, err)
+				return
+			}
+			ipv6 = addr
+		}
+		
+		instance, err := manager.RotateProxy(ctx, instanceID, ipv6)
+		if instance == nil && allocated {
+			if err := allocator.Remove(ipv6.IP); err != nil {
+				logger.Errorf("Failed to remove allocated IPv6 %s: %v", ipv6.IP, err)
+			}
+		}
+		if allocator != nil && allocator.Owns(current.IPv6.IP) && !addressInUse(manager.GetInstances(), current.IPv6.IP) {
+			if err := allocator.Remove(current.IPv6.IP); err != nil {
+				logger.Errorf("Failed to remove allocated IPv6 %s: %v", current.IPv6.IP, err)
+			}
+		}
+		switch {
+		case proxy.IsNotFound(err):
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+		case proxy.IsPortInUse(err):
+			apierror.Respond(c, 409, apierror.CodeConflict, err)
+		case err != nil:
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+		default:
+			c.JSON(200, instance)
+		}
+	})
+	
+	// Name, tag and assign pools to an instance, overriding
+	// instance_labels. An empty body hands it back to the configured rules.
+	router.PUT("/proxy/:id/labels", func(c *gin.Context) {
+		var req labelsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		instance, err := manager.SetLabels(c.Param("id"), req.Name, req.Tags, req.Pools)
+		if proxy.IsNotFound(err) {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		c.JSON(200, instance)
+	})
+	
+	router.GET("/proxy/:id/status", func(c *gin.Context) {
+		status, err := manager.InstanceStatus(c.Param("id"))
+		if proxy.IsNoStatusEndpoint(err) {
+			apierror.Respond(c, 501, apierror.CodeNotSupported, err)
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		c.JSON(200, status)
+	})
+	
+	router.GET("/status", func(c *gin.Context) {
+		c.JSON(200, currentNodeInfo(manager))
+	})
+	
+	router.GET("/access-control", func(c *gin.Context) {
+		mode, allowedIPs := manager.AccessControl()
+		c.JSON(200, accessControlRequest{Mode: mode, AllowedIPs: allowedIPs})
+	})
+	
+	// Replace the access control of every proxy, running ones included
+	router.PUT("/access-control", commands, func(c *gin.Context) {
+		var req accessControlRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if req.Mode != "open" && req.Mode != "restricted" {
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "mode must be open or restricted")
+			return
+		}
+		for _, ip := range req.AllowedIPs {
+			if net.ParseIP(ip) == nil {
+				if _, _, err := net.ParseCIDR(ip); err != nil {
+					apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("invalid allowed IP %q", ip))
+					return
+				}
+			}
+		}
+		if req.AllowedIPs == nil {
+			req.AllowedIPs = []string{}
+		}
+		manager.SetAccessControl(req.AllowedIPs, req.Mode)
+		c.JSON(200, req)
+	})
+	
+	router.GET("/quota", func(c *gin.Context) {
+		c.JSON(200, manager.Quota())
+	})
+	
+	// Restart every proxy in place. Used by the coordinator's rolling
+	// restart after it has drained this node. Instances are tied to the
+	// agent's lifetime, not the request's.
+	router.POST("/restart", commands, func(c *gin.Context) {
+		restarted, err := manager.RestartAll(ctx)
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		c.JSON(200, gin.H{"status": "restarted", "proxies": restarted})
+	})
+	
+	return router
+}
+
+// rotateProxyRequest is the optional body of POST /proxy/:id/rotate.
+type rotateProxyRequest struct {
+	IPv6 string `json:"ipv6"`
+}
+
+// accessControlRequest is the body of PUT /access-control.
+type accessControlRequest struct {
+	Mode       string   `json:"mode"`
+	AllowedIPs []string `json:"allowed_ips"`
+}
+
+// labelsRequest is the body of PUT /proxy/:id/labels.
+type labelsRequest struct {
+	Name  string   `json:"name"`
+	Tags  []string `json:"tags"`
+	Pools []string `json:"pools"`
+}
+
+// lookupAddress resolves a requested IPv6 address to one configured on this
+// host, responding with 400 when it is not.
+func lookupAddress(c *gin.Context, scanner *ipscanner.Scanner, address string) (models.IPv6Address, bool) {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil {
+		apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("invalid IPv6 address %q", address))
+		return models.IPv6Address{}, false
+	}
+	addr, err := scanner.Lookup(ip)
+	if err != nil {
+		apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+		return models.IPv6Address{}, false
+	}
+	return addr, true
+}
+
+// unusedAddress returns a scanned public address no live instance is on.
+func unusedAddress(scanner *ipscanner.Scanner, instances []models.ProxyInstance) (models.IPv6Address, error) {
+	addresses, err := scanner.ScanIPv6Addresses()
+	if err != nil {
+		return models.IPv6Address{}, err
+	}
+	for _, addr := range addresses {
+		if !addressInUse(instances, addr.IP) {
+			return addr, nil
+		}
+	}
+	return models.IPv6Address{}, errors.New("no unused IPv6 address to rotate to, set --ipv6-prefix to allocate one")
+}
+
+func addressInUse(instances []models.ProxyInstance, ip net.IP) bool {
+	for _, instance := range instances {
+		if instance.Status != models.ProxyStatusStopped && instance.IPv6.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func findInstance(instances []models.ProxyInstance, instanceID string) (models.ProxyInstance, bool) {
+	for _, instance := range instances {
+		if instance.ID == instanceID {
+			return instance, true
+		}
+	}
+	return models.ProxyInstance{}, false
+}
+
+// nodeID is the ID this node reports as, its hostname unless --node-id is
+// set, so several agents can share a host.
+func nodeID() string {
+	if cfg.NodeID != "" {
+		return cfg.NodeID
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func currentNodeInfo(manager *proxy.Manager) models.NodeInfo {
+	hostname, _ := os.Hostname()
+	capabilities := manager.Capabilities()
+	return models.NodeInfo{
+		NodeID:       nodeID(),
+		Hostname:     hostname,
+		Region:       cfg.Region,
+		Proxies:      manager.GetInstances(),
+		Capabilities: &capabilities,
+		APIURL:       cfg.AdvertiseURL,
+		APIPort:      cfg.ListenPort,
+		UpdatedAt:    time.Now(),
+		Maintenance:  cfg.Maintenance,
+		Weight:       nodeWeight(manager),
+		Provider:     cfg.Provider,
+		CostPerGB:    cfg.CostPerGB,
+	}
+}
+
+func reportToCoordinator(ctx context.Context, manager *proxy.Manager, transport http.RoundTripper) {
+	ticker := time.NewTicker(cfg.ReportInterval)
+	defer ticker.Stop()
+	
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	reports := newReporter(client, fmt.Sprintf("%s/api/nodes/%s", cfg.CoordinatorURL, nodeID()))
+	
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// The token only goes to the coordinator, never into /status
+		node := currentNodeInfo(manager)
+		node.APIToken = cfg.APIToken
+		if err := reports.report(ctx, node); err != nil && ctx.Err() == nil {
+			logger.Errorf("Failed to report to coordinator: %v", err)
+		}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/proxy"
+	"proxy-v6/pkg/models"
+)
+
+// aggregateRefresh is how often the aggregate port picks up instances that
+// were started, stopped or rotated.
+const aggregateRefresh = 5 * time.Second
+
+// aggregate serves one proxy port that spreads requests across this node's
+// running HTTP exits, the same way the coordinator does across all nodes,
+// for single-node setups without a coordinator.
+type aggregate struct {
+	manager *proxy.Manager
+	lb      *loadbalancer.LoadBalancer
+	pool    string // instances the load balancer was last given
+}
+
+func newAggregate(manager *proxy.Manager) (*aggregate, error) {
+	lb := loadbalancer.NewLoadBalancer(logger, cfg.HealthInterval)
+	if cfg.ProxyAuth {
+		// Exits only see the aggregate's own credentials, so clients
+		// must present the shared ones here instead
+		if cfg.ProxyUsername == "" || cfg.ProxyPassword == "" {
+			return nil, errors.New("--aggregate-port with --proxy-auth needs --proxy-username and --proxy-password")
+		}
+		authenticator, err := auth.NewAuthenticator(logger, []models.User{{
+			Username: cfg.ProxyUsername,
+			Password: cfg.ProxyPassword,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		lb.SetAuthenticator(authenticator)
+	}
+	return &aggregate{manager: manager, lb: lb}, nil
+}
+
+// run serves the aggregate port until ctx is done, then stops taking new
+// requests and lets the open ones finish.
+func (a *aggregate) run(ctx context.Context, port int) {
+	a.refresh()
+	go a.lb.RunHealthChecks(ctx)
+	go func() {
+		ticker := time.NewTicker(aggregateRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.refresh()
+			}
+		}
+	}()
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: a}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	logger.Infof("Starting aggregate proxy on port %d", port)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Errorf("Aggregate proxy error: %v", err)
+	}
+}
+
+// refresh hands the load balancer this node's instances when they changed,
+// leaving its health marks alone otherwise.
+func (a *aggregate) refresh() {
+	node := currentNodeInfo(a.manager)
+	entries := make([]string, 0, len(node.Proxies))
+	for _, instance := range node.Proxies {
+		entries = append(entries, fmt.Sprintf("%s [%s]:%d %s %t", instance.ID, instance.IPv6.IP, instance.Port, instance.Status, instance.Standby))
+	}
+	sort.Strings(entries)
+	pool := strings.Join(entries, "\n")
+	if pool == a.pool {
+		return
+	}
+	a.pool = pool
+	a.lb.UpdateProxies([]models.NodeInfo{node})
+}
+
+// ServeHTTP applies the exits' access control before forwarding, so the
+// aggregate port is no more open than the ports behind it.
+func (a *aggregate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.manager.Permitted(r.RemoteAddr) {
+		apierror.Write(w, http.StatusForbidden, apierror.Error{
+			Code:    apierror.CodeForbidden,
+			Message: "Client address not allowed",
+		})
+		return
+	}
+	a.lb.ServeHTTP(w, r)
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/apikey"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireAPIToken rejects API calls without --api-token. /health stays open
+// for load balancers and supervisors; without a token every call is let
+// through, as before tokens existed.
+func requireAPIToken() gin.HandlerFunc {
+	if cfg.APIToken == "" {
+		logger.Warn("Agent API is unauthenticated; set --api-token to require a token")
+	}
+	return func(c *gin.Context) {
+		if cfg.APIToken == "" || c.FullPath() == "/health" {
+			c.Next()
+			return
+		}
+		token := apikey.Token(c.Request)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.APIToken)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="proxy-v6-agent"`)
+			apierror.RespondMessage(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "API token required")
+			return
+		}
+		c.Next()
+	}
+}
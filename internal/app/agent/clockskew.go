@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultMaxClockSkew is the clock difference to the coordinator that is
+// warned about. The Date header only has whole seconds, so half a second of
+// error is expected.
+const defaultMaxClockSkew = 5 * time.Second
+
+var coordinatorClockSkew = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "proxy_v6_agent_clock_skew_seconds",
+	Help: "How far this host's clock is ahead of the coordinator's, from the Date of its last response (negative when behind)",
+})
+
+var (
+	clockSkewed   bool
+	clockSkewedMu sync.Mutex
+)
+
+// checkClockSkew compares the coordinator's Date header with the time resp
+// arrived. Quota periods and proxy timestamps follow this host's clock, so
+// drifting past --max-clock-skew is logged once, and again on recovery.
+func checkClockSkew(resp *http.Response, receivedAt time.Time) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// The coordinator's clock was somewhere in the second it reported
+	skew := receivedAt.Sub(date.Add(500 * time.Millisecond))
+	coordinatorClockSkew.Set(skew.Seconds())
+	if cfg.MaxClockSkew <= 0 {
+		return
+	}
+
+	off := skew > cfg.MaxClockSkew || skew < -cfg.MaxClockSkew
+	clockSkewedMu.Lock()
+	was := clockSkewed
+	clockSkewed = off
+	clockSkewedMu.Unlock()
+
+	switch {
+	case off && !was:
+		logger.Warnf("Clock is %s off from the coordinator's (more than %s); check NTP on both", skew.Round(time.Second), cfg.MaxClockSkew)
+	case !off && was:
+		logger.Infof("Clock is back within %s of the coordinator's", cfg.MaxClockSkew)
+	}
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/pkg/models"
+)
+
+const (
+	// commandWait is how long each poll asks the coordinator to hold the
+	// request open while there is nothing to do.
+	commandWait = 30 * time.Second
+	// maxCommandBackoff bounds the wait between polls while the
+	// coordinator is unreachable or does not know this node yet.
+	maxCommandBackoff = time.Minute
+	// resultAttempts is how often a command's result is sent before giving
+	// up. The coordinator hands the command out again later, and the
+	// journal answers it without running it twice.
+	resultAttempts = 3
+)
+
+// pollCommands long-polls the coordinator for commands addressed to this
+// node and runs them through the agent's own API, so they get the same
+// validation and idempotency as calls made directly.
+func pollCommands(ctx context.Context, api http.Handler, transport http.RoundTripper) {
+	client := &http.Client{Timeout: commandWait + 15*time.Second, Transport: transport}
+	base := fmt.Sprintf("%s/api/nodes/%s/commands", cfg.CoordinatorURL, url.PathEscape(nodeID()))
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		commands, err := fetchCommands(ctx, client, base)
+		if err != nil {
+			logger.Debugf("Failed to fetch commands from coordinator: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxCommandBackoff)
+			continue
+		}
+		backoff = time.Second
+
+		for _, cmd := range commands {
+			logger.Infof("Running %s command %s from coordinator", cmd.Type, cmd.ID)
+			result := runCommand(api, cmd)
+			if result.StatusCode < 200 || result.StatusCode > 299 {
+				logger.Warnf("Command %s failed with status %d: %s", cmd.ID, result.StatusCode, result.Body)
+			}
+			for attempt := 1; ; attempt++ {
+				err := reportCommand(ctx, client, base, cmd.ID, result)
+				if err == nil || attempt == resultAttempts || ctx.Err() != nil {
+					if err != nil {
+						logger.Errorf("Failed to report command %s: %v", cmd.ID, err)
+					}
+					break
+				}
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+	}
+}
+
+func fetchCommands(ctx context.Context, client *http.Client, base string) ([]models.NodeCommand, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/next?wait="+commandWait.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := coordinatorCall(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var commands []models.NodeCommand
+	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		return nil, fmt.Errorf("failed to decode commands: %w", err)
+	}
+	return commands, nil
+}
+
+func reportCommand(ctx context.Context, client *http.Client, base, id string, result models.CommandResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/"+url.PathEscape(id)+"/result", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := coordinatorCall(client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// coordinatorCall sends req with the agent's API key and fails on any
+// status but 200.
+func coordinatorCall(client *http.Client, req *http.Request) (*http.Response, error) {
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	checkClockSkew(resp, time.Now())
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("coordinator returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+// runCommand serves cmd as the API call it stands for. The command ID is
+// the idempotency key, so a command handed out again after its result was
+// lost is answered from the journal.
+func runCommand(api http.Handler, cmd models.NodeCommand) models.CommandResult {
+	var method, path string
+	var body interface{}
+	switch cmd.Type {
+	case models.CommandStopProxy:
+		method, path = http.MethodPost, "/proxy/"+url.PathEscape(cmd.InstanceID)+"/stop"
+	case models.CommandRestartProxy:
+		method, path = http.MethodPost, "/proxy/"+url.PathEscape(cmd.InstanceID)+"/restart"
+	case models.CommandRotateIP:
+		method, path = http.MethodPost, "/proxy/"+url.PathEscape(cmd.InstanceID)+"/rotate"
+		if cmd.IPv6 != "" {
+			body = rotateProxyRequest{IPv6: cmd.IPv6}
+		}
+	case models.CommandUpdateAccessControl:
+		method, path = http.MethodPut, "/access-control"
+		body = accessControlRequest{Mode: cmd.Mode, AllowedIPs: cmd.AllowedIPs}
+	default:
+		data, _ := json.Marshal(apierror.Error{Code: apierror.CodeNotSupported, Message: fmt.Sprintf("agent does not run %q commands", cmd.Type)})
+		return models.CommandResult{StatusCode: http.StatusNotImplemented, Body: data}
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return models.CommandResult{StatusCode: http.StatusInternalServerError}
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(apierror.IdempotencyKeyHeader, cmd.ID)
+	if cfg.APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIToken)
+	}
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, req)
+	result := models.CommandResult{StatusCode: recorder.Code}
+	if json.Valid(recorder.Body.Bytes()) {
+		result.Body = recorder.Body.Bytes()
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+
+	"proxy-v6/internal/configcheck"
+	"proxy-v6/internal/ipscanner"
+	"proxy-v6/internal/mtls"
+	"proxy-v6/internal/proxy"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configSections are the keys only the config file sets.
+var configSections = []string{"hooks", "instance_labels"}
+
+// configRoutes serve POST /api/config/validate, which checks a candidate
+// config file against flags without applying it.
+func configRoutes(router *gin.Engine, flags *pflag.FlagSet) {
+	router.POST(configcheck.Route, configcheck.Handler(flags, configSections, func(v *viper.Viper) []error {
+		c, err := readConfig(v)
+		if err != nil {
+			return []error{err}
+		}
+		return checkConfig(c)
+	}))
+}
+
+// readConfig reads the agent configuration from v.
+func readConfig(v *viper.Viper) (models.AgentConfig, error) {
+	c := models.AgentConfig{
+		ListenPort:           v.GetInt("port"),
+		ProxyStartPort:       v.GetInt("proxy-start"),
+		ProxyEndPort:         v.GetInt("proxy-end"),
+		CoordinatorURL:       v.GetString("coordinator"),
+		NodeID:               v.GetString("node-id"),
+		ReportInterval:       v.GetDuration("report-interval"),
+		MetricsPort:          v.GetInt("metrics-port"),
+		ExcludeInterfaces:    []string{"docker", "veth", "br-"},
+		AllowedIPs:           v.GetStringSlice("allowed-ips"),
+		ProxyMode:            v.GetString("proxy-mode"),
+		StandbyProxies:       v.GetInt("standby-proxies"),
+		WarmupURLs:           v.GetStringSlice("warmup-urls"),
+		WarmupTimeout:        v.GetDuration("warmup-timeout"),
+		EgressCheckURL:       v.GetString("egress-check-url"),
+		EgressCheckTimeout:   v.GetDuration("egress-check-timeout"),
+		ProxyBackend:         v.GetString("proxy-backend"),
+		HealthInterval:       v.GetDuration("health-interval"),
+		ProxyAuth:            v.GetBool("proxy-auth"),
+		APIKey:               v.GetString("api-key"),
+		ProxyUsername:        v.GetString("proxy-username"),
+		ProxyPassword:        v.GetString("proxy-password"),
+		AdvertiseURL:         v.GetString("advertise-url"),
+		APIToken:             v.GetString("api-token"),
+		SOCKS5:               v.GetBool("socks5"),
+		TLSCert:              v.GetString("tls-cert"),
+		TLSKey:               v.GetString("tls-key"),
+		TLSCA:                v.GetString("tls-ca"),
+		IPv6Prefix:           v.GetString("ipv6-prefix"),
+		IPv6Interface:        v.GetString("ipv6-interface"),
+		IPv6Count:            v.GetInt("ipv6-count"),
+		AggregatePort:        v.GetInt("aggregate-port"),
+		Region:               v.GetString("region"),
+		MetricsGranularity:   v.GetString("metrics-granularity"),
+		MetricsMaxExits:      v.GetInt("metrics-max-exits"),
+		QuotaMB:              v.GetInt64("quota-mb"),
+		QuotaReset:           v.GetString("quota-reset"),
+		StateFile:            v.GetString("state-file"),
+		AdoptProxies:         v.GetBool("adopt-proxies"),
+		ArchiveFile:          v.GetString("archive-file"),
+		ArchiveAfter:         v.GetDuration("archive-after"),
+		ArchiveKeep:          v.GetInt("archive-keep"),
+		EventSinks:           v.GetStringSlice("event-sinks"),
+		EventWebhook:         v.GetString("event-webhook"),
+		MaxLogSizeMB:         v.GetInt64("max-log-size-mb"),
+		LogKeep:              v.GetInt("log-keep"),
+		DiskWarnPercent:      v.GetFloat64("disk-warn-percent"),
+		HousekeepingInterval: v.GetDuration("housekeeping-interval"),
+		MaxClockSkew:         v.GetDuration("max-clock-skew"),
+		FullReportInterval:   v.GetDuration("full-report-interval"),
+		LinkCheckInterval:    v.GetDuration("link-check-interval"),
+		WatchAddresses:       v.GetBool("watch-addresses"),
+		Maintenance:          v.GetBool("maintenance"),
+		DrainTimeout:         v.GetDuration("drain-timeout"),
+		Weight:               v.GetFloat64("weight"),
+		WeightFrom:           v.GetString("weight-from"),
+		Provider:             v.GetString("provider"),
+	}
+	if v.IsSet("cost-per-gb") {
+		cost := v.GetFloat64("cost-per-gb")
+		c.CostPerGB = &cost
+	}
+
+	// Hooks and instance labels are only configurable through the config file
+	if err := v.UnmarshalKey("hooks", &c.Hooks, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse hooks: %w", err)
+	}
+	if err := v.UnmarshalKey("instance_labels", &c.InstanceLabels, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse instance_labels: %w", err)
+	}
+	return c, nil
+}
+
+// checkConfig returns every problem that would stop the agent starting
+// with c. Instance settings are applied to a scratch manager, so they are
+// checked exactly as on startup; no instance or address is touched.
+func checkConfig(c models.AgentConfig) []error {
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	var problems []error
+	check := func(what string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("invalid %s: %w", what, err))
+		}
+	}
+
+	if c.ReportInterval <= 0 {
+		check("--report-interval", fmt.Errorf("must be positive"))
+	}
+	manager := proxy.NewManager(quiet, c.ProxyStartPort, c.ProxyEndPort)
+	check("proxy backend", manager.SetBackend(c.ProxyBackend))
+	check("hook configuration", manager.SetHooks(c.Hooks))
+	check("instance_labels", manager.SetLabelRules(c.InstanceLabels))
+	check("--metrics-granularity", manager.SetMetricsGranularity(c.MetricsGranularity, c.NodeID, c.Region, c.MetricsMaxExits))
+	check("quota", manager.SetQuota(c.QuotaMB<<20, c.QuotaReset))
+	check("log rotation", manager.SetLogRotation(c.MaxLogSizeMB<<20, c.LogKeep))
+	check("archive settings", manager.SetArchive(c.ArchiveFile, c.ArchiveAfter, c.ArchiveKeep))
+	if c.DiskWarnPercent < 0 || c.DiskWarnPercent > 100 {
+		check("--disk-warn-percent", fmt.Errorf("must be between 0 and 100"))
+	}
+	check("weight", validateWeight(c.Weight, c.WeightFrom))
+	if c.CostPerGB != nil && *c.CostPerGB < 0 {
+		check("--cost-per-gb", fmt.Errorf("must not be negative"))
+	}
+
+	if c.CoordinatorURL != "" {
+		_, err := mtls.Transport(quiet, mtls.Files{Cert: c.TLSCert, Key: c.TLSKey, CA: c.TLSCA})
+		check("coordinator TLS", err)
+	}
+	_, err := eventSinks(c, nil)
+	check("--event-sinks", err)
+
+	if c.IPv6Prefix != "" {
+		if c.IPv6Count <= 0 {
+			check("--ipv6-count", fmt.Errorf("must be positive when --ipv6-prefix is set"))
+		}
+		_, err = ipscanner.NewAllocator(quiet, c.IPv6Prefix, c.IPv6Interface)
+		check("IPv6 allocation", err)
+	}
+	return problems
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"proxy-v6/internal/proxy"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultHousekeepingInterval = time.Minute
+	defaultMaxLogSizeMB         = 64
+	defaultDiskWarnPercent      = 90
+)
+
+var (
+	diskUsedRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_agent_disk_used_ratio",
+		Help: "Used share of the filesystems holding proxy logs, configs and agent state.",
+	}, []string{"path"})
+	diskLow = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_v6_agent_disk_low",
+		Help: "1 while one of those filesystems is fuller than --disk-warn-percent.",
+	})
+)
+
+// housekeeping rotates instance logs, removes leftover proxy files and
+// watches how full the disks they are on get. Past warnPercent every
+// instance log is truncated until usage drops again, since tinyproxy and
+// 3proxy instances fail once they cannot write.
+func housekeeping(ctx context.Context, manager *proxy.Manager, interval time.Duration, warnPercent float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	paths := []string{proxy.RuntimeDir}
+	if cfg.StateFile != "" {
+		if dir := filepath.Dir(cfg.StateFile); dir != proxy.RuntimeDir {
+			paths = append(paths, dir)
+		}
+	}
+
+	low := false
+	for {
+		full := ""
+		for _, path := range paths {
+			used, err := diskUsed(path)
+			if err != nil {
+				logger.Debugf("Failed to check disk usage of %s: %v", path, err)
+				continue
+			}
+			diskUsedRatio.WithLabelValues(path).Set(used)
+			if warnPercent > 0 && used*100 >= warnPercent && full == "" {
+				full = fmt.Sprintf("%s is %.0f%% full", path, used*100)
+			}
+		}
+
+		switch {
+		case full != "" && !low:
+			logger.Warnf("Disk space is running out: %s, truncating proxy logs until usage drops below %.0f%%", full, warnPercent)
+		case full == "" && low:
+			logger.Infof("Disk usage is below %.0f%% again", warnPercent)
+		}
+		low = full != ""
+		if low {
+			diskLow.Set(1)
+		} else {
+			diskLow.Set(0)
+		}
+		manager.Housekeep(low)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// diskUsed returns the used share of the filesystem holding path, counting
+// the blocks reserved for root as unavailable, as df does.
+func diskUsed(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	used := st.Blocks - st.Bfree
+	total := used + st.Bavail
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(used) / float64(total), nil
+}
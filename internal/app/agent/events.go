@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"proxy-v6/internal/proxy"
+	"proxy-v6/pkg/models"
+)
+
+// Event sinks named in --event-sinks.
+const (
+	sinkLog         = "log"
+	sinkCoordinator = "coordinator"
+	sinkWebhook     = "webhook"
+)
+
+// eventFlushTimeout is how long shutdown waits for the lifecycle events of
+// the stopped proxies to be delivered.
+const eventFlushTimeout = 10 * time.Second
+
+// eventSinks builds the sinks c names. The coordinator sink is left out
+// when there is no coordinator to send to, since it is on by default.
+func eventSinks(c models.AgentConfig, transport http.RoundTripper) ([]proxy.EventSink, error) {
+	var sinks []proxy.EventSink
+	seen := make(map[string]bool)
+	for _, name := range c.EventSinks {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		switch name {
+		case sinkLog:
+			sinks = append(sinks, proxy.NewLogSink(logger))
+		case sinkCoordinator:
+			if c.CoordinatorURL == "" {
+				continue
+			}
+			sinks = append(sinks, coordinatorSink{
+				client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+				url:    fmt.Sprintf("%s/api/nodes/%s/events", c.CoordinatorURL, nodeID()),
+			})
+		case sinkWebhook:
+			sink, err := proxy.NewWebhookSink(c.EventWebhook, 0)
+			if err != nil {
+				return nil, fmt.Errorf("%w, set --event-webhook", err)
+			}
+			sinks = append(sinks, sink)
+		default:
+			return nil, fmt.Errorf("unknown event sink %q (valid: %s, %s, %s)", name, sinkLog, sinkCoordinator, sinkWebhook)
+		}
+	}
+	if c.EventWebhook != "" && !seen[sinkWebhook] {
+		return nil, fmt.Errorf("--event-webhook is set but %s is not among the sinks", sinkWebhook)
+	}
+	return sinks, nil
+}
+
+// coordinatorSink posts lifecycle events to the coordinator, which keeps
+// the recent events of every node.
+type coordinatorSink struct {
+	client *http.Client
+	url    string
+}
+
+func (s coordinatorSink) Name() string { return sinkCoordinator }
+
+func (s coordinatorSink) Send(events []models.ProxyEvent) error {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := coordinatorCall(s.client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
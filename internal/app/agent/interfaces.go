@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"proxy-v6/internal/ipscanner"
+	"proxy-v6/internal/proxy"
+	"proxy-v6/pkg/models"
+)
+
+const (
+	defaultLinkCheckInterval = 2 * time.Second
+	// addressWait is how long the instances on an interface that came back
+	// wait for their address to return, e.g. from SLAAC, before they are
+	// failed.
+	addressWait = 2 * time.Minute
+)
+
+// recovery is an interface that has its link again while some of its
+// instances are still paused.
+type recovery struct {
+	since   time.Time
+	waiting bool // missing addresses were logged
+}
+
+// watchInterfaces checks the link of every interface instances run on each
+// interval. Instances on an interface that loses it are paused instead of
+// failing their health checks, and are resumed or rebuilt once it is back.
+func watchInterfaces(ctx context.Context, manager *proxy.Manager, allocator *ipscanner.Allocator, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	down := make(map[string]time.Time) // interface -> when it lost its link
+	recovering := make(map[string]*recovery)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		for _, iface := range instanceInterfaces(manager) {
+			up := linkUp(iface)
+			since, wasDown := down[iface]
+			switch {
+			case !up && !wasDown:
+				down[iface] = now
+				delete(recovering, iface)
+				paused := manager.PauseInterface(iface)
+				logger.Warnf("Interface %s lost its link, pausing %d proxies until it is back", iface, len(paused))
+			case up && wasDown:
+				delete(down, iface)
+				recovering[iface] = &recovery{since: now}
+				logger.Infof("Interface %s has its link again after %s, resuming its proxies", iface, now.Sub(since).Round(time.Second))
+			}
+		}
+
+		for iface, r := range recovering {
+			if resumeInterface(ctx, manager, allocator, iface, r) {
+				delete(recovering, iface)
+			}
+		}
+	}
+}
+
+// instanceInterfaces returns the interfaces of the instances not stopped.
+func instanceInterfaces(manager *proxy.Manager) []string {
+	seen := make(map[string]bool)
+	for _, instance := range manager.GetInstances() {
+		if instance.IPv6.Interface != "" && instance.Status != models.ProxyStatusStopped {
+			seen[instance.IPv6.Interface] = true
+		}
+	}
+	ifaces := make([]string, 0, len(seen))
+	for iface := range seen {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+	return ifaces
+}
+
+// linkUp reports whether iface is up and has a carrier. An interface that
+// disappeared counts as down.
+func linkUp(iface string) bool {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false
+	}
+	return link.Flags&net.FlagUp != 0 && link.Flags&net.FlagRunning != 0
+}
+
+// resumeInterface resumes the paused instances on iface whose address is
+// back. Addresses the allocator added are put back, since the kernel drops
+// IPv6 addresses from an interface taken down. It reports whether no
+// instance is left waiting.
+func resumeInterface(ctx context.Context, manager *proxy.Manager, allocator *ipscanner.Allocator, iface string, r *recovery) bool {
+	present := make(map[string]bool)
+	if link, err := net.InterfaceByName(iface); err == nil {
+		addrs, _ := link.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				present[ipNet.IP.String()] = true
+			}
+		}
+	}
+
+	var missing []string
+	for _, instance := range manager.PausedOn(iface) {
+		ip := instance.IPv6.IP
+		if !present[ip.String()] && allocator != nil && allocator.Owns(ip) {
+			if err := allocator.Restore(ip); err != nil {
+				logger.Warnf("Failed to restore %s: %v", ip, err)
+			} else {
+				present[ip.String()] = true
+			}
+		}
+
+		if present[ip.String()] {
+			if _, err := manager.ResumeProxy(ctx, instance.ID); err != nil {
+				logger.Errorf("Failed to resume proxy %s: %v", instance.ID, err)
+			}
+			continue
+		}
+		if time.Since(r.since) < addressWait {
+			missing = append(missing, ip.String())
+			continue
+		}
+		err := fmt.Errorf("address %s did not come back on %s within %s", ip, iface, addressWait)
+		logger.Errorf("Giving up on proxy %s: %v", instance.ID, err)
+		manager.FailPaused(instance.ID, err)
+	}
+
+	if len(missing) > 0 && !r.waiting {
+		r.waiting = true
+		logger.Infof("Waiting up to %s for %d addresses to return on %s", addressWait, len(missing), iface)
+	}
+	return len(missing) == 0
+}
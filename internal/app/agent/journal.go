@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// commandRetention is how long an applied command is remembered. It
+	// only has to outlast the sender's retries.
+	commandRetention = time.Hour
+	// maxJournalEntries bounds the journal when senders use a new key for
+	// every command.
+	maxJournalEntries = 1000
+)
+
+// appliedCommand is a journaled command and the response it produced.
+type appliedCommand struct {
+	command   string // method and path
+	status    int
+	body      []byte
+	appliedAt time.Time
+	done      chan struct{} // closed once the command finished
+}
+
+// commandJournal remembers state-changing commands by idempotency key so a
+// command the coordinator resends, because the first response was lost or
+// it retried, is answered from the journal instead of run again.
+type commandJournal struct {
+	entries map[string]*appliedCommand
+	mu      sync.Mutex
+}
+
+func newCommandJournal() *commandJournal {
+	return &commandJournal{entries: make(map[string]*appliedCommand)}
+}
+
+// begin claims key for command. It returns the entry already recorded under
+// key, waiting for it to finish if it is still running, or nil if the
+// caller should run the command.
+func (j *commandJournal) begin(key, command string) *appliedCommand {
+	j.mu.Lock()
+	j.sweepLocked()
+	if entry, ok := j.entries[key]; ok {
+		j.mu.Unlock()
+		<-entry.done
+		return entry
+	}
+	j.entries[key] = &appliedCommand{command: command, done: make(chan struct{})}
+	j.mu.Unlock()
+	return nil
+}
+
+// finish records the outcome of the command under key. Failed commands are
+// forgotten so a retry runs them again.
+func (j *commandJournal) finish(key string, status int, body []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry := j.entries[key]
+	entry.status, entry.body, entry.appliedAt = status, body, time.Now()
+	if !entry.applied() {
+		delete(j.entries, key)
+	}
+	close(entry.done)
+}
+
+func (e *appliedCommand) applied() bool {
+	return e.status >= 200 && e.status <= 299
+}
+
+func (j *commandJournal) sweepLocked() {
+	cutoff := time.Now().Add(-commandRetention)
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range j.entries {
+		if entry.appliedAt.IsZero() {
+			continue
+		}
+		if entry.appliedAt.Before(cutoff) {
+			delete(j.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.appliedAt.Before(oldest) {
+			oldestKey, oldest = key, entry.appliedAt
+		}
+	}
+	if len(j.entries) >= maxJournalEntries && oldestKey != "" {
+		delete(j.entries, oldestKey)
+	}
+}
+
+// idempotent is gin middleware for command endpoints. Requests without an
+// Idempotency-Key run as before. A repeated key gets the first response
+// again, marked with Idempotency-Replayed, or a 409 when it was used for a
+// different command.
+func (j *commandJournal) idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(apierror.IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		command := c.Request.Method + " " + c.Request.URL.Path
+		for {
+			entry := j.begin(key, command)
+			if entry == nil {
+				break
+			}
+			if entry.command != command {
+				apierror.RespondMessage(c, 409, apierror.CodeConflict, "idempotency key was already used for "+entry.command)
+				return
+			}
+			if entry.applied() {
+				logger.Infof("Replaying %s for idempotency key %s", command, key)
+				c.Header(apierror.IdempotencyReplayedHeader, "true")
+				c.Data(entry.status, "application/json; charset=utf-8", entry.body)
+				c.Abort()
+				return
+			}
+			// The earlier attempt failed and was forgotten, so run it again
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		completed := false
+		defer func() {
+			if !completed {
+				// The handler panicked and gin's Recovery answers with a
+				// 500: forget the command so retries run it again
+				// instead of waiting for it forever
+				j.finish(key, http.StatusInternalServerError, nil)
+				return
+			}
+			j.finish(key, recorder.Status(), recorder.body.Bytes())
+		}()
+		c.Next()
+		completed = true
+	}
+}
+
+// responseRecorder keeps a copy of the response body for the journal.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
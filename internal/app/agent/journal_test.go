@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"proxy-v6/internal/apierror"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func TestIdempotentReplayAfterPanic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger = logrus.New()
+	logger.SetOutput(io.Discard)
+
+	runs := 0
+	router := gin.New()
+	router.Use(gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err interface{}) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	router.POST("/proxy", newCommandJournal().idempotent(), func(c *gin.Context) {
+		runs++
+		if runs == 1 {
+			panic("backend exploded")
+		}
+		c.JSON(http.StatusOK, gin.H{"run": runs})
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		t.Helper()
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/proxy", nil)
+			req.Header.Set(apierror.IdempotencyKeyHeader, "key-1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			done <- w
+		}()
+		select {
+		case w := <-done:
+			return w
+		case <-time.After(5 * time.Second):
+			t.Fatal("request with the key of a panicked command hangs")
+			return nil
+		}
+	}
+
+	if w := send(); w.Code != http.StatusInternalServerError {
+		t.Fatalf("panicking command: got status %d, want 500", w.Code)
+	}
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("retry after panic: got status %d, want 200", w.Code)
+	}
+	if runs != 2 {
+		t.Fatalf("retry after panic ran the command %d times in total, want 2", runs)
+	}
+
+	w := send()
+	if w.Code != http.StatusOK || w.Header().Get(apierror.IdempotencyReplayedHeader) != "true" {
+		t.Fatalf("repeat of applied command: got status %d, replayed %q, want a replayed 200", w.Code, w.Header().Get(apierror.IdempotencyReplayedHeader))
+	}
+	if runs != 2 {
+		t.Fatalf("repeat of applied command ran it again (%d runs)", runs)
+	}
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/pkg/models"
+)
+
+// defaultFullReportInterval is how often a full report is sent even though
+// the coordinator has followed every delta.
+const defaultFullReportInterval = 10 * time.Minute
+
+// defaultReportInterval is how often the node reports to the coordinator.
+const defaultReportInterval = 30 * time.Second
+
+var (
+	// errResyncRequired is the coordinator asking for a full report
+	// because a delta did not follow the last report it has.
+	errResyncRequired = errors.New("coordinator asked for a full report")
+	// errDeltaRefused is a delta answered as an unknown or forbidden
+	// route, which is how coordinators without delta support answer.
+	errDeltaRefused = errors.New("coordinator does not accept delta reports")
+)
+
+// reporter sends this node's reports to the coordinator. Between full
+// reports it sends deltas with only the instances that changed, numbered so
+// the coordinator notices one going missing and asks for everything again.
+type reporter struct {
+	client   *http.Client
+	base     string // the node's URL on the coordinator
+	sequence uint64 // of the last report the coordinator accepted
+	sent     map[string]models.ProxyInstance
+	lastFull time.Time
+	deltas   bool // false once the coordinator turned out not to take deltas
+}
+
+func newReporter(client *http.Client, base string) *reporter {
+	return &reporter{client: client, base: base, deltas: true}
+}
+
+// report sends node as a delta when one is due, and as a full report
+// otherwise or when the coordinator refuses the delta.
+func (r *reporter) report(ctx context.Context, node models.NodeInfo) error {
+	refused := false
+	if r.deltaDue(node.UpdatedAt) {
+		err := r.send(ctx, r.base+"/delta", r.delta(node))
+		switch {
+		case err == nil:
+			r.accepted(node, r.sequence+1)
+			return nil
+		case errors.Is(err, errResyncRequired):
+			logger.Debugf("Sending a full report: %v", err)
+		case errors.Is(err, errDeltaRefused):
+			refused = true
+		default:
+			// Whether the coordinator applied it is unknown
+			r.sent = nil
+			return err
+		}
+	}
+
+	node.Sequence = r.sequence + 1
+	if err := r.send(ctx, r.base, node); err != nil {
+		r.sent = nil
+		return err
+	}
+	r.accepted(node, node.Sequence)
+	r.lastFull = node.UpdatedAt
+	// Only now is it clear that the delta was refused for being one
+	if refused {
+		logger.Infof("Coordinator does not accept delta reports, sending full reports only")
+		r.deltas = false
+	}
+	return nil
+}
+
+func (r *reporter) deltaDue(now time.Time) bool {
+	return r.deltas && r.sent != nil && cfg.FullReportInterval > 0 && now.Sub(r.lastFull) < cfg.FullReportInterval
+}
+
+// delta lists how node differs from the last report the coordinator
+// accepted.
+func (r *reporter) delta(node models.NodeInfo) models.NodeDelta {
+	delta := models.NodeDelta{
+		Sequence:     r.sequence + 1,
+		Hostname:     node.Hostname,
+		Region:       node.Region,
+		Capabilities: node.Capabilities,
+		APIURL:       node.APIURL,
+		APIPort:      node.APIPort,
+		APIToken:     node.APIToken,
+		UpdatedAt:    node.UpdatedAt,
+		Maintenance:  node.Maintenance,
+		Weight:       node.Weight,
+		Provider:     node.Provider,
+		CostPerGB:    node.CostPerGB,
+	}
+	current := make(map[string]bool, len(node.Proxies))
+	for _, p := range node.Proxies {
+		current[p.ID] = true
+		if prev, ok := r.sent[p.ID]; !ok || !sameInstance(prev, p) {
+			delta.Changed = append(delta.Changed, p)
+		}
+	}
+	for id := range r.sent {
+		if !current[id] {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	sort.Strings(delta.Removed)
+	return delta
+}
+
+func (r *reporter) accepted(node models.NodeInfo, sequence uint64) {
+	r.sequence = sequence
+	r.sent = make(map[string]models.ProxyInstance, len(node.Proxies))
+	for _, p := range node.Proxies {
+		r.sent[p.ID] = p
+	}
+}
+
+func (r *reporter) send(ctx context.Context, url string, report interface{}) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal node report: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	checkClockSkew(resp, time.Now())
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		var apiErr apierror.Error
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Code == apierror.CodeResyncRequired {
+			return fmt.Errorf("%w: %s", errResyncRequired, apiErr.Message)
+		}
+	case http.StatusNotFound, http.StatusForbidden:
+		if _, ok := report.(models.NodeDelta); ok {
+			return errDeltaRefused
+		}
+	}
+	return fmt.Errorf("coordinator returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+}
+
+// sameInstance compares instances ignoring LastChecked, which every health
+// check moves. Full reports bring it up to date.
+func sameInstance(a, b models.ProxyInstance) bool {
+	a.LastChecked, b.LastChecked = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
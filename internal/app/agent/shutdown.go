@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"proxy-v6/internal/proxy"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	// drainLogInterval spaces out the progress logged while draining.
+	drainLogInterval = 5 * time.Second
+	// apiShutdownTimeout is how long API calls in flight at shutdown get
+	// to finish.
+	apiShutdownTimeout = 10 * time.Second
+)
+
+// deregister removes this node from the coordinator, so its exits leave the
+// pool before they stop instead of once the node goes stale.
+func deregister(transport http.RoundTripper) {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/nodes/%s", cfg.CoordinatorURL, nodeID()), nil)
+	if err != nil {
+		logger.Errorf("Failed to build deregistration: %v", err)
+		return
+	}
+	resp, err := coordinatorCall(client, req)
+	if err != nil {
+		logger.Warnf("Failed to deregister from the coordinator: %v", err)
+		return
+	}
+	resp.Body.Close()
+	logger.Info("Deregistered from the coordinator")
+}
+
+// drainConnections waits up to timeout for the connections open on the
+// proxies to finish. Another signal on interrupt stops the wait.
+func drainConnections(manager *proxy.Manager, timeout time.Duration, interrupt <-chan os.Signal) {
+	if timeout <= 0 {
+		return
+	}
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var logged time.Time
+	for {
+		active := manager.ActiveConnections()
+		if active == 0 {
+			logger.Info("All proxy connections finished")
+			return
+		}
+		if time.Since(logged) >= drainLogInterval {
+			logger.Infof("Waiting up to %s for %d proxy connections to finish", timeout, active)
+			logged = time.Now()
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			logger.Warnf("Closing %d proxy connections still open after %s", active, timeout)
+			return
+		case <-interrupt:
+			logger.Warnf("Interrupted, closing %d proxy connections", active)
+			return
+		}
+	}
+}
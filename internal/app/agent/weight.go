@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"proxy-v6/internal/proxy"
+)
+
+const (
+	weightFromCPU       = "cpu"
+	weightFromBandwidth = "bandwidth"
+)
+
+func validateWeight(weight float64, from string) error {
+	if weight < 0 {
+		return fmt.Errorf("--weight must not be negative")
+	}
+	switch from {
+	case "", weightFromCPU, weightFromBandwidth:
+		return nil
+	}
+	return fmt.Errorf("unknown --weight-from %q (want %s or %s)", from, weightFromCPU, weightFromBandwidth)
+}
+
+// nodeWeight is the capacity weight reported to the coordinator: --weight
+// when set, otherwise measured as --weight-from says. 0 leaves the
+// coordinator giving this node one share per proxy.
+func nodeWeight(manager *proxy.Manager) float64 {
+	if cfg.Weight > 0 {
+		return cfg.Weight
+	}
+	switch cfg.WeightFrom {
+	case weightFromCPU:
+		return float64(runtime.NumCPU())
+	case weightFromBandwidth:
+		var total float64
+		for _, iface := range instanceInterfaces(manager) {
+			speed, err := linkSpeed(iface)
+			if err != nil {
+				logger.Debugf("No link speed for %s: %v", iface, err)
+				continue
+			}
+			total += speed
+		}
+		return total
+	}
+	return 0
+}
+
+// linkSpeed reads the speed of iface in Mbit/s. Virtual interfaces and
+// links that are down have none.
+func linkSpeed(iface string) (float64, error) {
+	data, err := os.ReadFile("/sys/class/net/" + iface + "/speed")
+	if err != nil {
+		return 0, err
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if speed <= 0 {
+		return 0, fmt.Errorf("speed is unknown")
+	}
+	return speed, nil
+}
@@ -0,0 +1,101 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/apikey"
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// agentTransport carries API calls passed through to agents. The request
+// context bounds each call, so slow commands like restarts can finish.
+var agentTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 5 * time.Minute
+	return t
+}()
+
+// agentProxyStrippedHeaders are the caller's credentials for the
+// coordinator, which the agent has no business seeing. The agent's own
+// token takes their place.
+var agentProxyStrippedHeaders = []string{"Authorization", apikey.Header, "Cookie", "Proxy-Authorization"}
+
+// agentProxy passes /api/nodes/:nodeId/agent/*path through to that node's
+// agent API at the address the node last reported, with the API token it
+// reported. Calls that change state are recorded in the audit trail.
+func agentProxy(auditTrail store.EventStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		node, err := nodes.GetNode(nodeID)
+		if errors.Is(err, store.ErrNotFound) {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		if node.APIURL == "" {
+			apierror.RespondMessage(c, 502, apierror.CodeUpstreamFailed, fmt.Sprintf("node %s has not reported an API address", nodeID))
+			return
+		}
+		target, err := url.Parse(node.APIURL)
+		if err != nil {
+			apierror.Respond(c, 502, apierror.CodeUpstreamFailed, fmt.Errorf("node %s API address: %w", nodeID, err))
+			return
+		}
+
+		// Cleaning keeps "../" from climbing out of the agent's base path
+		agentPath := path.Clean("/" + c.Param("path"))
+		token := agentToken(nodeID)
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			auditTrail.Record(audit.Entry{
+				Event:    "agent_api_called",
+				ClientIP: c.ClientIP(),
+				Detail:   fmt.Sprintf("%s %s %s", nodeID, c.Request.Method, agentPath),
+			})
+		}
+
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.Out.URL.Path = strings.TrimSuffix(target.Path, "/") + agentPath
+				pr.Out.URL.RawPath = ""
+				pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+				pr.SetXForwarded()
+				for _, header := range agentProxyStrippedHeaders {
+					pr.Out.Header.Del(header)
+				}
+				if token != "" {
+					pr.Out.Header.Set("Authorization", "Bearer "+token)
+				}
+				// The agent logs and answers under the coordinator's ID
+				pr.Out.Header.Set(apierror.RequestIDHeader, c.Writer.Header().Get(apierror.RequestIDHeader))
+			},
+			ModifyResponse: func(resp *http.Response) error {
+				resp.Header.Del(apierror.RequestIDHeader)
+				return nil
+			},
+			Transport: agentTransport,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logger.Warnf("Agent API call to node %s failed: %v", nodeID, err)
+				apierror.Write(w, http.StatusBadGateway, apierror.Error{
+					Code:    apierror.CodeUpstreamFailed,
+					Message: fmt.Sprintf("agent of node %s did not answer: %v", nodeID, err),
+				})
+			},
+		}
+		proxy.ServeHTTP(c.Writer, c.Request)
+	}
+}
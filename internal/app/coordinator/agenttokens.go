@@ -0,0 +1,35 @@
+package coordinator
+
+import (
+	"sync"
+
+	"proxy-v6/pkg/models"
+)
+
+// agentTokens are the API tokens agents report, by node. They are kept out
+// of the node store, so node listings, events and read replicas never carry
+// them; a restarted coordinator learns them again from the next reports.
+var agentTokens = struct {
+	byNode map[string]string
+	mu     sync.RWMutex
+}{byNode: make(map[string]string)}
+
+// takeAgentToken moves the token a report from nodeID carries into
+// agentTokens. A report without one means the agent API is open.
+func takeAgentToken(node *models.NodeInfo, nodeID string) {
+	agentTokens.mu.Lock()
+	defer agentTokens.mu.Unlock()
+	if node.APIToken == "" {
+		delete(agentTokens.byNode, nodeID)
+	} else {
+		agentTokens.byNode[nodeID] = node.APIToken
+	}
+	node.APIToken = ""
+}
+
+// agentToken returns the token to present to nodeID's agent API, or "".
+func agentToken(nodeID string) string {
+	agentTokens.mu.RLock()
+	defer agentTokens.mu.RUnlock()
+	return agentTokens.byNode[nodeID]
+}
@@ -0,0 +1,79 @@
+package coordinator
+
+import (
+	"fmt"
+
+	"proxy-v6/internal/alert"
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/maintenance"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// alertSnapshot returns the source alert rules are evaluated against: the
+// nodes as listed, with the health of their exits in the load balancer.
+func alertSnapshot(lb *loadbalancer.LoadBalancer, windows *maintenance.Scheduler) func() alert.Snapshot {
+	return func() alert.Snapshot {
+		counts := lb.ExitCounts()
+		var snap alert.Snapshot
+		for _, node := range nodeList() {
+			snap.Nodes = append(snap.Nodes, alert.NodeSample{
+				NodeID:      node.NodeID,
+				LastReport:  node.UpdatedAt,
+				Healthy:     counts[node.NodeID].Healthy,
+				Unhealthy:   counts[node.NodeID].Unhealthy,
+				Maintenance: windows.InMaintenance(node.NodeID),
+			})
+		}
+		return snap
+	}
+}
+
+// alertRoutes show the alerts of the config file's alert_rules. Only the
+// primary evaluates them; a replica lists none.
+func alertRoutes(router *gin.Engine, engine *alert.Engine, auditTrail store.EventStore) {
+	router.GET("/api/alerts", func(c *gin.Context) {
+		state := c.Query("state")
+		alerts := []models.Alert{}
+		for _, a := range engine.Alerts() {
+			if state == "" || a.State == state {
+				alerts = append(alerts, a)
+			}
+		}
+		c.JSON(200, alerts)
+	})
+
+	router.GET("/api/alerts/resolved", func(c *gin.Context) {
+		c.JSON(200, engine.Resolved())
+	})
+
+	router.GET("/api/alerts/rules", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"rules":     engine.Rules(),
+			"notifiers": engine.Notifiers(),
+		})
+	})
+
+	// Check a notifier's settings without waiting for an alert
+	router.POST("/api/alerts/notifiers/:name/test", func(c *gin.Context) {
+		name := c.Param("name")
+		found := false
+		for _, n := range engine.Notifiers() {
+			found = found || n.Name == name
+		}
+		if !found {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, fmt.Sprintf("notifier %s not found", name))
+			return
+		}
+		if err := engine.Test(name); err != nil {
+			apierror.Respond(c, 502, apierror.CodeUpstreamFailed, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "alert_notifier_tested", ClientIP: c.ClientIP(), Detail: name})
+		c.JSON(200, gin.H{"status": "sent"})
+	})
+}
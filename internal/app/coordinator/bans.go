@@ -0,0 +1,78 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"proxy-v6/internal/banlist"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+)
+
+const (
+	banSaveInterval = time.Minute
+	// maxBanListBytes bounds a ban list posted to /api/bans/import.
+	maxBanListBytes = 32 << 20
+)
+
+// restoreBans brings back the bans saved before a restart, then imports
+// the --ban-lists files on top.
+func restoreBans(lb *loadbalancer.LoadBalancer) error {
+	var saved models.BanList
+	if _, err := ruleStore.GetRules(store.ExitBans, &saved); err != nil {
+		return fmt.Errorf("failed to load saved bans: %w", err)
+	}
+	if len(saved.Entries) > 0 {
+		restored, err := lb.ImportBans(saved.Entries)
+		if err != nil {
+			return fmt.Errorf("invalid saved bans: %w", err)
+		}
+		logger.Infof("Restored %d exit bans", restored)
+	}
+
+	for _, path := range cfg.BanLists {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		entries, err := banlist.Parse(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		imported, err := lb.ImportBans(entries)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		logger.Infof("Imported %d exit bans from %s", imported, path)
+	}
+	return nil
+}
+
+// saveBans stores the bans once they changed, so they survive restarts.
+func saveBans(lb *loadbalancer.LoadBalancer) {
+	state, changed := lb.BanState()
+	if !changed {
+		return
+	}
+	if err := ruleStore.PutRules(store.ExitBans, state); err != nil {
+		logger.Errorf("Failed to save exit bans: %v", err)
+	}
+}
+
+// persistBans saves the exit bans every banSaveInterval until ctx is done.
+func persistBans(ctx context.Context, lb *loadbalancer.LoadBalancer) {
+	ticker := time.NewTicker(banSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveBans(lb)
+		}
+	}
+}
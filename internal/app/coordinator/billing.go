@@ -0,0 +1,68 @@
+package coordinator
+
+import (
+	"fmt"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/apikey"
+	"proxy-v6/internal/billing"
+	"proxy-v6/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// billingRoutes serve the hourly traffic of each tenant and user that
+// operators bill customers for.
+func billingRoutes(router *gin.Engine, meter *billing.Meter) {
+	router.GET("/api/usage", func(c *gin.Context) {
+		query, err := parseBillingQuery(c)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		rollups, err := meter.Usage(query)
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+
+		switch format := c.DefaultQuery("format", "json"); format {
+		case "json":
+			c.JSON(200, rollups)
+		case "csv":
+			c.Header("Content-Type", "text/csv")
+			c.Header("Content-Disposition", `attachment; filename="usage.csv"`)
+			if err := billing.WriteCSV(c.Writer, rollups); err != nil {
+				logger.Errorf("Failed to export usage: %v", err)
+			}
+		default:
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("unknown format %q (want json or csv)", format))
+		}
+	})
+}
+
+// parseBillingQuery reads tenant, user, from and to (RFC 3339) query
+// parameters. Tenant keys only get their own tenant's usage.
+func parseBillingQuery(c *gin.Context) (store.BillingQuery, error) {
+	query := store.BillingQuery{Tenant: c.Query("tenant"), User: c.Query("user")}
+	if tenant := apikey.Tenant(c); tenant != "" {
+		query.Tenant = tenant
+	}
+
+	var err error
+	if from := c.Query("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.To.After(query.From) {
+		return query, fmt.Errorf("to must be after from")
+	}
+	return query, nil
+}
@@ -0,0 +1,71 @@
+package coordinator
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultMaxClockSkew is the clock difference nodes are warned about. It
+// leaves room for the time a report spends in transit, which counts as
+// skew.
+const defaultMaxClockSkew = 5 * time.Second
+
+var nodeClockSkew = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "proxy_v6_node_clock_skew_seconds",
+	Help: "How far each node's clock was ahead of the coordinator's at its last report (negative when behind)",
+}, []string{"node"})
+
+var (
+	skewedNodes   = make(map[string]bool) // nodes past --max-clock-skew
+	skewedNodesMu sync.Mutex
+)
+
+// checkClockSkew compares the time node stamped its report with receivedAt
+// and records the difference in the report. Nodes whose clock drifts past
+// --max-clock-skew are logged and audited once, and again when they
+// recover.
+func checkClockSkew(node *models.NodeInfo, receivedAt time.Time, auditTrail store.EventStore) {
+	if node.UpdatedAt.IsZero() {
+		return
+	}
+	skew := node.UpdatedAt.Sub(receivedAt)
+	node.ClockSkewMs = skew.Milliseconds()
+	nodeClockSkew.WithLabelValues(node.NodeID).Set(skew.Seconds())
+	if cfg.MaxClockSkew <= 0 {
+		return
+	}
+
+	off := skew > cfg.MaxClockSkew || skew < -cfg.MaxClockSkew
+	skewedNodesMu.Lock()
+	was := skewedNodes[node.NodeID]
+	if off {
+		skewedNodes[node.NodeID] = true
+	} else {
+		delete(skewedNodes, node.NodeID)
+	}
+	skewedNodesMu.Unlock()
+
+	switch {
+	case off && !was:
+		logger.Warnf("Clock of node %s is %s off from the coordinator's (more than %s); check NTP on both", node.NodeID, skew.Round(time.Millisecond), cfg.MaxClockSkew)
+		auditTrail.Record(audit.Entry{Event: "clock_skew", Detail: fmt.Sprintf("node=%s skew=%s", node.NodeID, skew.Round(time.Millisecond))})
+	case !off && was:
+		logger.Infof("Clock of node %s is back within %s of the coordinator's", node.NodeID, cfg.MaxClockSkew)
+	}
+}
+
+// forgetClockSkew drops what is known about a removed node's clock.
+func forgetClockSkew(nodeID string) {
+	skewedNodesMu.Lock()
+	delete(skewedNodes, nodeID)
+	skewedNodesMu.Unlock()
+	nodeClockSkew.DeleteLabelValues(nodeID)
+}
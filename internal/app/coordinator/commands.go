@@ -0,0 +1,107 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/commands"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultCommandWait is how long GET .../commands/next holds the request
+// open when the agent does not say.
+const defaultCommandWait = 30 * time.Second
+
+// commandRoutes serves the command channel: operators queue commands for a
+// node, and its agent long-polls for them and reports the results.
+func commandRoutes(router *gin.Engine, queue *commands.Queue, auditTrail store.EventStore) {
+	router.POST("/api/nodes/:nodeId/commands", func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		var cmd models.NodeCommand
+		if err := c.ShouldBindJSON(&cmd); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if _, err := nodes.GetNode(nodeID); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				apierror.Respond(c, 404, apierror.CodeNotFound, err)
+				return
+			}
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		queued, err := queue.Submit(nodeID, cmd)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{
+			Event:    "node_command_queued",
+			ClientIP: c.ClientIP(),
+			Detail:   fmt.Sprintf("%s %s %s", nodeID, queued.Type, queued.ID),
+		})
+		c.JSON(202, queued)
+	})
+
+	router.GET("/api/nodes/:nodeId/commands", func(c *gin.Context) {
+		c.JSON(200, queue.List(c.Param("nodeId")))
+	})
+
+	// Long-polled by the node's agent. Answers with the queued commands as
+	// soon as there are any, or an empty list once wait passes. Only
+	// registered nodes get a queue.
+	router.GET("/api/nodes/:nodeId/commands/next", func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		if _, err := nodes.GetNode(nodeID); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				apierror.Respond(c, 404, apierror.CodeNotFound, err)
+				return
+			}
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		wait := defaultCommandWait
+		if raw := c.Query("wait"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed < 0 {
+				apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "wait must be a non-negative duration")
+				return
+			}
+			wait = parsed
+		}
+		c.JSON(200, queue.Fetch(c.Request.Context(), nodeID, wait))
+	})
+
+	router.GET("/api/nodes/:nodeId/commands/:commandId", func(c *gin.Context) {
+		cmd, err := queue.Get(c.Param("nodeId"), c.Param("commandId"))
+		if err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		c.JSON(200, cmd)
+	})
+
+	router.POST("/api/nodes/:nodeId/commands/:commandId/result", func(c *gin.Context) {
+		var result models.CommandResult
+		if err := c.ShouldBindJSON(&result); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		cmd, err := queue.Report(c.Param("nodeId"), c.Param("commandId"), result)
+		if errors.Is(err, commands.ErrNotFound) {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		c.JSON(200, cmd)
+	})
+}
@@ -0,0 +1,241 @@
+package coordinator
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"proxy-v6/internal/alert"
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/clientip"
+	"proxy-v6/internal/configcheck"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/mitm"
+	"proxy-v6/internal/mtls"
+	"proxy-v6/internal/store"
+	"proxy-v6/internal/webhook"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configSections are the keys only the config file sets.
+var configSections = []string{
+	"users", "ban_rules", "rewrite_rules", "reuse_rules", "prefix_origins", "pools", "tenants",
+	"webhooks", "alert_rules", "notifiers", "content_policy", "outlier_detection", "prefix_warmup",
+}
+
+// configRoutes serve POST /api/config/validate, which checks a candidate
+// config file against flags without applying it.
+func configRoutes(router *gin.Engine, flags *pflag.FlagSet) {
+	router.POST(configcheck.Route, configcheck.Handler(flags, configSections, func(v *viper.Viper) []error {
+		c, err := readConfig(v)
+		if err != nil {
+			return []error{err}
+		}
+		return checkConfig(c)
+	}))
+}
+
+// readConfig reads the coordinator configuration from v.
+func readConfig(v *viper.Viper) (models.CoordinatorConfig, error) {
+	c := models.CoordinatorConfig{
+		ListenPort:            v.GetInt("port"),
+		ProxyPort:             v.GetInt("proxy-port"),
+		HTTP3Port:             v.GetInt("http3-port"),
+		HTTP3Cert:             v.GetString("http3-cert"),
+		HTTP3Key:              v.GetString("http3-key"),
+		MetricsPort:           v.GetInt("metrics-port"),
+		HealthCheckInterval:   v.GetDuration("health-interval"),
+		AuditLogPath:          v.GetString("audit-log"),
+		LedgerPath:            v.GetString("ledger-file"),
+		LedgerRetention:       v.GetDuration("ledger-retention"),
+		PoolHistoryRetention:  v.GetDuration("pool-history-retention"),
+		MaintenancePath:       v.GetString("maintenance-file"),
+		BanLists:              v.GetStringSlice("ban-lists"),
+		NodeReportMaxBytes:    v.GetInt64("node-report-max-bytes"),
+		NodeReportMaxProxies:  v.GetInt("node-report-max-proxies"),
+		Store:                 v.GetString("store"),
+		StorePath:             v.GetString("store-path"),
+		HeartbeatRetention:    v.GetDuration("heartbeat-retention"),
+		MaxClockSkew:          v.GetDuration("max-clock-skew"),
+		PreResolve:            v.GetBool("pre-resolve"),
+		LBStrategy:            v.GetString("lb-strategy"),
+		StickyTTL:             v.GetDuration("sticky-ttl"),
+		EgressHeaders:         v.GetBool("egress-headers"),
+		RetryAttempts:         v.GetInt("retry-attempts"),
+		RetryConnectOnly:      v.GetBool("retry-connect-only"),
+		StreamThresholdMB:     v.GetInt64("stream-threshold-mb"),
+		PassiveHealthFailures: v.GetInt("passive-health-failures"),
+		PassiveHealthRecovery: v.GetDuration("passive-health-recovery"),
+		ShedMaxLag:            v.GetDuration("shed-max-lag"),
+		ShedMaxMemoryMB:       v.GetInt("shed-max-memory-mb"),
+		MaxConnsPerExit:       v.GetInt("max-conns-per-exit"),
+		BatchSharePercent:     v.GetInt("batch-share"),
+		QueueSize:             v.GetInt("queue-size"),
+		QueueTimeout:          v.GetDuration("queue-timeout"),
+		RateLimit:             v.GetFloat64("rate-limit"),
+		RateLimitBurst:        v.GetInt("rate-limit-burst"),
+		RateLimitBy:           v.GetString("rate-limit-by"),
+		TrustedProxies:        v.GetStringSlice("trusted-proxies"),
+		ProxyProtocol:         v.GetBool("proxy-protocol"),
+		MITMCACert:            v.GetString("mitm-ca-cert"),
+		MITMCAKey:             v.GetString("mitm-ca-key"),
+		TLSProfile:            v.GetString("tls-profile"),
+		MITMDestinations:      v.GetStringSlice("mitm-destinations"),
+		APIKeysFile:           v.GetString("api-keys-file"),
+		TLSCert:               v.GetString("tls-cert"),
+		TLSKey:                v.GetString("tls-key"),
+		TLSClientCA:           v.GetString("tls-client-ca"),
+		ReplicaOf:             v.GetString("replica-of"),
+		ReplicaInterval:       v.GetDuration("replica-interval"),
+		ReplicaAPIKey:         v.GetString("replica-api-key"),
+		ReplicaTLSCert:        v.GetString("replica-tls-cert"),
+		ReplicaTLSKey:         v.GetString("replica-tls-key"),
+		ReplicaTLSCA:          v.GetString("replica-tls-ca"),
+		AlertInterval:         v.GetDuration("alert-interval"),
+	}
+
+	// Users are only configurable through the config file
+	if err := v.UnmarshalKey("users", &c.Users, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse users: %w", err)
+	}
+
+	if err := v.UnmarshalKey("ban_rules", &c.BanRules, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse ban rules: %w", err)
+	}
+	if len(c.BanRules) == 0 && v.GetBool("ban-detection") {
+		c.BanRules = loadbalancer.DefaultBanRules
+	}
+
+	if err := v.UnmarshalKey("rewrite_rules", &c.RewriteRules, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse rewrite rules: %w", err)
+	}
+
+	if err := v.UnmarshalKey("reuse_rules", &c.ReuseRules, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse reuse rules: %w", err)
+	}
+
+	if err := v.UnmarshalKey("prefix_origins", &c.PrefixOrigins, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse prefix origins: %w", err)
+	}
+
+	if err := v.UnmarshalKey("pools", &c.Pools, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse pools: %w", err)
+	}
+
+	if err := v.UnmarshalKey("tenants", &c.Tenants, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse tenants: %w", err)
+	}
+
+	if err := v.UnmarshalKey("webhooks", &c.Webhooks, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse webhooks: %w", err)
+	}
+
+	// Alert rules and notifiers are only configurable through the config file
+	if err := v.UnmarshalKey("alert_rules", &c.AlertRules, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse alert rules: %w", err)
+	}
+	if err := v.UnmarshalKey("notifiers", &c.Notifiers, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse notifiers: %w", err)
+	}
+
+	if err := v.UnmarshalKey("content_policy", &c.ContentPolicy, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse content policy: %w", err)
+	}
+
+	if err := v.UnmarshalKey("outlier_detection", &c.OutlierPolicy, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse outlier detection: %w", err)
+	}
+	if !v.IsSet("outlier_detection") && v.GetBool("outlier-detection") {
+		c.OutlierPolicy = loadbalancer.DefaultOutlierPolicy
+	}
+
+	if err := v.UnmarshalKey("prefix_warmup", &c.PrefixWarmup, jsonTags); err != nil {
+		return c, fmt.Errorf("failed to parse prefix warm-up: %w", err)
+	}
+	if !v.IsSet("prefix_warmup") {
+		c.PrefixWarmup.Hours = v.GetDuration("prefix-warmup").Hours()
+	}
+	return c, nil
+}
+
+// checkConfig returns every problem that would stop the coordinator
+// starting with c. Rules and policies are applied to a scratch load
+// balancer, so they are checked exactly as on startup.
+func checkConfig(c models.CoordinatorConfig) []error {
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	var problems []error
+	check := func(what string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("invalid %s: %w", what, err))
+		}
+	}
+
+	if c.Store != "" && !slices.Contains(store.Backends(), c.Store) {
+		check("--store", fmt.Errorf("unknown store backend %s (valid: %v)", c.Store, store.Backends()))
+	}
+	_, err := auth.NewAuthenticator(quiet, c.Users)
+	check("users", err)
+	_, err = clientip.NewResolver(c.TrustedProxies)
+	check("trusted proxies", err)
+
+	lb := loadbalancer.NewLoadBalancer(quiet, c.HealthCheckInterval)
+	check("reuse rules", lb.SetReuseRules(c.ReuseRules))
+	check("prefix origins", lb.SetPrefixOrigins(c.PrefixOrigins))
+	check("pools", lb.SetPools(c.Pools))
+	check("tenants", lb.SetTenants(c.Tenants))
+	check("content policy", lb.SetContentPolicy(c.ContentPolicy))
+	check("outlier detection", lb.SetOutlierPolicy(c.OutlierPolicy))
+	check("prefix warm-up", lb.SetPrefixWarmup(c.PrefixWarmup, nil))
+	check("--batch-share", lb.SetBatchShare(c.BatchSharePercent))
+	check("rate limit", lb.SetRateLimit(c.RateLimit, c.RateLimitBurst, c.RateLimitBy))
+	_, err = loadbalancer.ParseStrategy(c.LBStrategy)
+	check("--lb-strategy", err)
+	check("--sticky-ttl", lb.SetStickyTTL(c.StickyTTL))
+	if c.ShedMaxMemoryMB < 0 {
+		check("--shed-max-memory-mb", fmt.Errorf("must not be negative"))
+	}
+	if c.PassiveHealthFailures < 0 {
+		check("--passive-health-failures", fmt.Errorf("must not be negative"))
+	}
+
+	dispatcher := webhook.NewDispatcher(quiet)
+	check("webhooks", dispatcher.SetWebhooks(c.Webhooks))
+	dispatcher.Close()
+	_, err = alert.NewEngine(quiet, c.AlertRules, c.Notifiers)
+	check("alerting", err)
+	if c.AlertInterval <= 0 {
+		check("--alert-interval", fmt.Errorf("must be positive"))
+	}
+
+	if c.TLSProfile != "" && !mitm.ValidProfile(c.TLSProfile) {
+		check("--tls-profile", fmt.Errorf("unknown TLS profile %q (valid: %s)", c.TLSProfile, strings.Join(mitm.Profiles(), ", ")))
+	}
+	if apiTLS := (mtls.Files{Cert: c.TLSCert, Key: c.TLSKey, CA: c.TLSClientCA}); apiTLS.Enabled() {
+		_, err = mtls.ServerConfig(quiet, apiTLS)
+		check("API TLS", err)
+	}
+	if c.HTTP3Port > 0 {
+		if c.HTTP3Cert == "" || c.HTTP3Key == "" {
+			check("--http3-port", fmt.Errorf("requires --http3-cert and --http3-key"))
+		} else {
+			_, err = tls.LoadX509KeyPair(c.HTTP3Cert, c.HTTP3Key)
+			check("HTTP/3 certificate", err)
+		}
+	}
+	if c.ReplicaOf != "" {
+		if c.ReplicaInterval <= 0 {
+			check("--replica-interval", fmt.Errorf("must be positive"))
+		}
+		_, err = mtls.Transport(quiet, mtls.Files{Cert: c.ReplicaTLSCert, Key: c.ReplicaTLSKey, CA: c.ReplicaTLSCA})
+		check("TLS to the primary", err)
+	}
+	return problems
+}
@@ -0,0 +1,1787 @@
+package coordinator
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"proxy-v6/internal/abuse"
+	"proxy-v6/internal/alert"
+	"proxy-v6/internal/apikey"
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/banlist"
+	"proxy-v6/internal/billing"
+	"proxy-v6/internal/clientip"
+	"proxy-v6/internal/eventstream"
+	"proxy-v6/internal/commands"
+	"proxy-v6/internal/ledger"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/loadshed"
+	"proxy-v6/internal/maintenance"
+	"proxy-v6/internal/metrics"
+	"proxy-v6/internal/mitm"
+	"proxy-v6/internal/mtls"
+	"proxy-v6/internal/pool"
+	"proxy-v6/internal/rollout"
+	"proxy-v6/internal/store"
+	"proxy-v6/internal/traffic"
+	"proxy-v6/internal/webhook"
+	"proxy-v6/pkg/models"
+	"proxy-v6/pkg/version"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	logger     *logrus.Logger
+	cfg        models.CoordinatorConfig
+	nodes      store.NodeStore
+	heartbeats store.HeartbeatStore
+	ruleStore  store.RuleStore
+	mu         sync.Mutex // serializes node read-modify-writes
+	
+	poolHistory *pool.History
+	shedder     *loadshed.Shedder
+	meter       *billing.Meter
+	
+	clusterEvents = eventstream.NewHub()
+	recentTraffic = traffic.NewRecorder()
+	webhooks      *webhook.Dispatcher
+	alerts        *alert.Engine
+)
+
+// Command returns the coordinator command. cmd/coordinator runs it directly
+// and the root proxy-v6 binary mounts it as "proxy-v6 coordinator".
+func Command() *cobra.Command {
+	logger = logrus.New()
+	// Use text formatter for better readability
+	logger.SetFormatter(&logrus.TextFormatter{
+		FullTimestamp: true,
+		TimestampFormat: "2006-01-02 15:04:05",
+	})
+	logger.SetLevel(logrus.InfoLevel) // Set to Info level, can be changed to Debug if needed
+	
+	rootCmd := &cobra.Command{
+		Use:   "coordinator",
+		Short: "Coordinator service for managing distributed IPv6 proxies",
+		Run:   runCoordinator,
+	}
+	
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print version information",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(version.GetVersion())
+		},
+	}
+	
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(keysCommand())
+	
+	rootCmd.PersistentFlags().StringP("config", "c", "", "config file path")
+	rootCmd.PersistentFlags().IntP("port", "p", 8081, "API listen port")
+	rootCmd.PersistentFlags().IntP("proxy-port", "", 8888, "Proxy listen port")
+	rootCmd.PersistentFlags().Int("http3-port", 0, "Experimental: also serve CONNECT tunnels over HTTP/3 (QUIC) on this UDP port (0 = off)")
+	rootCmd.PersistentFlags().String("http3-cert", "", "Certificate the HTTP/3 listener presents, required with --http3-port")
+	rootCmd.PersistentFlags().String("http3-key", "", "Private key for --http3-cert")
+	rootCmd.PersistentFlags().IntP("metrics-port", "m", 9091, "Metrics port")
+	rootCmd.PersistentFlags().DurationP("health-interval", "", 30*time.Second, "Health check interval")
+	rootCmd.PersistentFlags().StringP("audit-log", "", "", "File to append audit trail entries to (JSON lines)")
+	rootCmd.PersistentFlags().StringP("ledger-file", "", "", "File to persist the IPv6 usage ledger to")
+	rootCmd.PersistentFlags().DurationP("ledger-retention", "", 90*24*time.Hour, "How long usage ledger entries are kept")
+	rootCmd.PersistentFlags().String("store", store.BackendSQLite, "Where nodes, users, rules and heartbeats are kept: "+strings.Join(store.Backends(), ", "))
+	rootCmd.PersistentFlags().String("store-path", store.DefaultSQLitePath, "SQLite database file of --store sqlite")
+	rootCmd.PersistentFlags().Duration("heartbeat-retention", 7*24*time.Hour, "How long the history of node reports is kept (0 = forever)")
+	rootCmd.PersistentFlags().String("maintenance-file", "", "File to persist scheduled maintenance windows to")
+	rootCmd.PersistentFlags().Int64("node-report-max-bytes", defaultNodeReportMaxBytes, "Largest node report body accepted from an agent")
+	rootCmd.PersistentFlags().Int("node-report-max-proxies", defaultNodeReportMaxProxies, "Most proxy instances accepted in one node report")
+	rootCmd.PersistentFlags().Duration("max-clock-skew", defaultMaxClockSkew, "Warn about nodes whose clock differs from the coordinator's by more than this (0 = off)")
+	rootCmd.PersistentFlags().Duration("pool-history-retention", 24*time.Hour, "How far back /api/pool/diff can report exit changes")
+	rootCmd.PersistentFlags().Bool("pre-resolve", false, "Resolve destinations at the coordinator and CONNECT exits to the literal IPv6")
+	rootCmd.PersistentFlags().Duration("shed-max-lag", 0, "Scheduler lag at which proxy requests are refused; background work is shed from half of it (0 = off)")
+	rootCmd.PersistentFlags().Int("shed-max-memory-mb", 0, "Heap size in MB at which proxy requests are refused; background work is shed from half of it (0 = off)")
+	rootCmd.PersistentFlags().Bool("enable-fault-injection", false, "Expose /api/faults to inject failures (staging only)")
+	rootCmd.PersistentFlags().Bool("ban-detection", false, "Enable default ban detection (403/429) when no ban_rules are configured")
+	rootCmd.PersistentFlags().StringSlice("ban-lists", []string{}, "Ban list files (JSON or text) of exit prefixes known to be banned by destinations, imported at startup")
+	rootCmd.PersistentFlags().Int("passive-health-failures", loadbalancer.DefaultPassiveFailures, "Consecutive failed requests that mark an exit unhealthy (0 = only TCP health checks)")
+	rootCmd.PersistentFlags().Duration("passive-health-recovery", loadbalancer.DefaultPassiveRecovery, "How often a trial request is sent through an exit marked unhealthy by failed requests")
+	rootCmd.PersistentFlags().Bool("outlier-detection", false, "Eject exits failing 50% of requests over 30s when no outlier_detection is configured")
+	rootCmd.PersistentFlags().Duration("prefix-warmup", 0, "Ramp the exits of new prefixes linearly into rotation over this long when no prefix_warmup is configured (0 = off)")
+	rootCmd.PersistentFlags().String("lb-strategy", "round-robin", "How exits are picked: 'round-robin', 'least-connections' (fewest requests in flight), 'sticky-client' (same exit per client IP) or 'least-cost' (nodes with the cheapest egress first)")
+	rootCmd.PersistentFlags().Duration("sticky-ttl", loadbalancer.DefaultStickyTTL, "How long a client idle with --lb-strategy sticky-client keeps its exit, across restarts")
+	rootCmd.PersistentFlags().Bool("egress-headers", false, "Add X-Egress-IP and X-Egress-Node headers naming the exit to proxied responses")
+	rootCmd.PersistentFlags().Int("retry-attempts", 1, "Exits a replayable HTTP request may try when forwarding fails (1 = no retries)")
+	rootCmd.PersistentFlags().Bool("retry-connect-only", true, "Only retry requests whose exit could not be connected to")
+	rootCmd.PersistentFlags().Int64("stream-threshold-mb", loadbalancer.DefaultStreamThreshold>>20, "Plain HTTP downloads with a Content-Length of at least this many MB are copied straight between the exit's connection and the client's (0 = off)")
+	rootCmd.PersistentFlags().Int("max-conns-per-exit", 0, "Maximum concurrent requests and tunnels per exit (0 = unlimited)")
+	rootCmd.PersistentFlags().Int("batch-share", loadbalancer.DefaultBatchShare, "Percent of --max-conns-per-exit that batch priority requests may hold on an exit (100 = no reserve for interactive ones)")
+	rootCmd.PersistentFlags().Int("queue-size", 0, "Requests to hold while every exit is busy (0 = fail immediately)")
+	rootCmd.PersistentFlags().Duration("queue-timeout", 5*time.Second, "Maximum time a request waits in the queue")
+	rootCmd.PersistentFlags().Float64("rate-limit", 0, "Proxy requests and tunnels per second allowed per client (0 = unlimited)")
+	rootCmd.PersistentFlags().Int("rate-limit-burst", 0, "Requests a client may send at once before --rate-limit applies (default: one second's worth)")
+	rootCmd.PersistentFlags().String("rate-limit-by", loadbalancer.RateLimitByIP, "What a client is for --rate-limit: 'ip' or 'user' (authenticated users, else their IP)")
+	rootCmd.PersistentFlags().StringSlice("trusted-proxies", []string{}, "Load balancer IPs/CIDRs whose X-Forwarded-For and PROXY headers are believed")
+	rootCmd.PersistentFlags().Bool("proxy-protocol", false, "Accept PROXY protocol v1/v2 headers from trusted proxies on the proxy and API ports")
+	rootCmd.PersistentFlags().String("api-keys-file", "", "JSON file of API keys; when set every API call except /health needs a key")
+	rootCmd.PersistentFlags().String("tls-cert", "", "Serve the API over HTTPS with this certificate (reloaded when it changes)")
+	rootCmd.PersistentFlags().String("tls-key", "", "Private key for --tls-cert")
+	rootCmd.PersistentFlags().String("tls-client-ca", "", "CA bundle that signs agent and client certificates; connections without one are rejected")
+	rootCmd.PersistentFlags().String("tls-profile", "", "MITM mode: terminate CONNECT tunnels and re-originate TLS with this ClientHello profile ("+strings.Join(mitm.Profiles(), ", ")+")")
+	rootCmd.PersistentFlags().String("mitm-ca-cert", "mitm-ca.pem", "CA certificate used to sign intercepted sites (created if missing)")
+	rootCmd.PersistentFlags().String("mitm-ca-key", "mitm-ca-key.pem", "Private key of the interception CA (created if missing)")
+	rootCmd.PersistentFlags().StringSlice("mitm-destinations", []string{}, "Only intercept tunnels to these destination patterns (default: all)")
+	rootCmd.PersistentFlags().String("replica-of", "", "Run as a read replica of the coordinator API at this URL, serving proxies and read APIs from its state")
+	rootCmd.PersistentFlags().Duration("replica-interval", defaultReplicaInterval, "How often a read replica copies the primary's state")
+	rootCmd.PersistentFlags().String("replica-api-key", "", "API key (role replica) a read replica sends to the primary")
+	rootCmd.PersistentFlags().String("replica-tls-cert", "", "Client certificate a read replica presents to the primary")
+	rootCmd.PersistentFlags().String("replica-tls-key", "", "Private key for --replica-tls-cert")
+	rootCmd.PersistentFlags().String("replica-tls-ca", "", "CA bundle that signs the primary's certificate")
+	rootCmd.PersistentFlags().Duration("alert-interval", 15*time.Second, "How often the alert_rules of the config file are evaluated")
+	
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
+			return fmt.Errorf("failed to bind flags: %w", err)
+		}
+		return nil
+	}
+	
+	return rootCmd
+}
+
+func runCoordinator(cmd *cobra.Command, args []string) {
+	configFile := viper.GetString("config")
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			logger.Warnf("Failed to read config file: %v", err)
+		}
+	}
+	
+	var err error
+	cfg, err = readConfig(viper.GetViper())
+	if err != nil {
+		logger.Fatalf("Failed to load the configuration: %v", err)
+	}
+	
+	auditTrail, err := audit.NewTrail(logger, cfg.AuditLogPath)
+	if err != nil {
+		logger.Fatalf("Failed to initialize audit trail: %v", err)
+	}
+	defer auditTrail.Close()
+	
+	poolHistory = pool.NewHistory(cfg.PoolHistoryRetention)
+	
+	if cfg.ShedMaxMemoryMB < 0 {
+		logger.Fatalf("Invalid --shed-max-memory-mb: must not be negative")
+	}
+	shedder = loadshed.New(logger, cfg.ShedMaxLag, uint64(cfg.ShedMaxMemoryMB)<<20)
+	stopShedder := make(chan struct{})
+	go shedder.Run(stopShedder)
+	defer close(stopShedder)
+	
+	usageLedger, err := ledger.NewLedger(logger, cfg.LedgerPath, cfg.LedgerRetention)
+	if err != nil {
+		logger.Fatalf("Failed to initialize usage ledger: %v", err)
+	}
+	usageLedger.SetShedder(shedder)
+	stopLedger := make(chan struct{})
+	go usageLedger.Run(stopLedger)
+	defer func() {
+		close(stopLedger)
+		if err := usageLedger.Save(); err != nil {
+			logger.Errorf("Failed to save usage ledger: %v", err)
+		}
+	}()
+	
+	// A replica's state is the primary's, so keeping it across restarts
+	// would only bring back an outdated copy
+	if cfg.ReplicaOf != "" && cfg.Store != store.BackendMemory {
+		logger.Infof("Read replica of %s, keeping state in memory instead of the %s store", cfg.ReplicaOf, cfg.Store)
+		cfg.Store = store.BackendMemory
+	}
+	st, err := store.Open(cfg.Store, store.Options{Path: cfg.StorePath, HeartbeatRetention: cfg.HeartbeatRetention}, usageLedger, auditTrail)
+	if err != nil {
+		logger.Fatalf("Failed to open the %s store: %v", cfg.Store, err)
+	}
+	defer func() {
+		if err := st.Close(); err != nil {
+			logger.Errorf("Failed to close the store: %v", err)
+		}
+	}()
+	nodes, heartbeats, ruleStore = st.Nodes(), st.Heartbeats(), st.Rules()
+	meter = billing.NewMeter(logger, st.Billing())
+	stopMeter := make(chan struct{})
+	go meter.Run(stopMeter)
+	defer func() {
+		close(stopMeter)
+		if err := meter.Flush(); err != nil {
+			logger.Errorf("Failed to store metered usage: %v", err)
+		}
+	}()
+	if err := seedStore(st); err != nil {
+		logger.Fatalf("Failed to load stored state: %v", err)
+	}
+	
+	authenticator, err := auth.NewAuthenticator(logger, cfg.Users)
+	if err != nil {
+		logger.Fatalf("Invalid user configuration: %v", err)
+	}
+	authenticator.SetStore(st.Users())
+	if authenticator.Enabled() {
+		logger.Infof("Proxy authentication enabled for %d users", len(cfg.Users))
+	}
+	
+	clientIPs, err := clientip.NewResolver(cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatalf("Invalid trusted proxy configuration: %v", err)
+	}
+	
+	// Background loops run until shutdown starts
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	
+	lb := loadbalancer.NewLoadBalancer(logger, cfg.HealthCheckInterval)
+	go lb.RunHealthChecks(background)
+	go lb.RunScheduleChecks(background)
+	prometheus.MustRegister(lb.Collector())
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_v6_nodes",
+		Help: "Nodes registered with the coordinator",
+	}, func() float64 { return float64(len(nodeList())) })
+	lb.SetClientIPResolver(clientIPs)
+	lb.SetAuthenticator(authenticator)
+	lb.SetAuditTrail(auditTrail)
+	lb.SetBanRules(cfg.BanRules)
+	lb.SetRewriteRules(cfg.RewriteRules)
+	if err := lb.SetReuseRules(cfg.ReuseRules); err != nil {
+		logger.Fatalf("Invalid reuse rules: %v", err)
+	}
+	if err := lb.SetPrefixOrigins(cfg.PrefixOrigins); err != nil {
+		logger.Fatalf("Invalid prefix origins: %v", err)
+	}
+	if err := lb.SetPools(cfg.Pools); err != nil {
+		logger.Fatalf("Invalid pools: %v", err)
+	}
+	if err := lb.SetTenants(cfg.Tenants); err != nil {
+		logger.Fatalf("Invalid tenants: %v", err)
+	}
+	if err := lb.SetContentPolicy(cfg.ContentPolicy); err != nil {
+		logger.Fatalf("Invalid content policy: %v", err)
+	}
+	if err := lb.SetOutlierPolicy(cfg.OutlierPolicy); err != nil {
+		logger.Fatalf("Invalid outlier detection: %v", err)
+	}
+	var prefixesSeen map[string]time.Time
+	if _, err := ruleStore.GetRules(store.WarmupPrefixes, &prefixesSeen); err != nil {
+		logger.Fatalf("Failed to load warm-up prefixes: %v", err)
+	}
+	if err := lb.SetPrefixWarmup(cfg.PrefixWarmup, prefixesSeen); err != nil {
+		logger.Fatalf("Invalid prefix warm-up: %v", err)
+	}
+	if err := restoreBans(lb); err != nil {
+		logger.Fatalf("Failed to import exit bans: %v", err)
+	}
+	if err := restoreLeases(lb); err != nil {
+		logger.Fatalf("Failed to restore exit leases: %v", err)
+	}
+	lb.SetLedger(usageLedger)
+	lb.SetUsageMeter(meter)
+	lb.SetTrafficRecorder(recentTraffic)
+	lb.SetHealthWatcher(healthEvents{hub: clusterEvents})
+	lb.SetShedder(shedder)
+	lb.SetPreResolve(cfg.PreResolve)
+	strategy, err := loadbalancer.ParseStrategy(cfg.LBStrategy)
+	if err != nil {
+		logger.Fatalf("Invalid --lb-strategy: %v", err)
+	}
+	lb.SetStrategy(strategy)
+	if err := lb.SetStickyTTL(cfg.StickyTTL); err != nil {
+		logger.Fatalf("Invalid --sticky-ttl: %v", err)
+	}
+	if err := restoreStickySessions(lb); err != nil {
+		logger.Fatalf("Failed to restore sticky sessions: %v", err)
+	}
+	lb.SetEgressHeaders(cfg.EgressHeaders)
+	lb.SetCapacity(cfg.MaxConnsPerExit, cfg.QueueSize, cfg.QueueTimeout)
+	if err := lb.SetBatchShare(cfg.BatchSharePercent); err != nil {
+		logger.Fatalf("Invalid --batch-share: %v", err)
+	}
+	if err := lb.SetRateLimit(cfg.RateLimit, cfg.RateLimitBurst, cfg.RateLimitBy); err != nil {
+		logger.Fatalf("Invalid rate limit: %v", err)
+	}
+	lb.SetRetryPolicy(cfg.RetryAttempts, cfg.RetryConnectOnly)
+	lb.SetStreamThreshold(cfg.StreamThresholdMB << 20)
+	if cfg.PassiveHealthFailures < 0 {
+		logger.Fatalf("Invalid --passive-health-failures: must not be negative")
+	}
+	lb.SetPassiveHealth(cfg.PassiveHealthFailures, cfg.PassiveHealthRecovery)
+	if viper.GetBool("enable-fault-injection") {
+		lb.EnableFaultInjection()
+	}
+	
+	interceptor := setupInterception(lb, cfg.Users)
+	
+	webhooks = webhook.NewDispatcher(logger)
+	if err := webhooks.SetWebhooks(cfg.Webhooks); err != nil {
+		logger.Fatalf("Invalid webhooks: %v", err)
+	}
+	defer webhooks.Close()
+	
+	alerts, err = alert.NewEngine(logger, cfg.AlertRules, cfg.Notifiers)
+	if err != nil {
+		logger.Fatalf("Invalid alerting: %v", err)
+	}
+	if cfg.AlertInterval <= 0 {
+		logger.Fatalf("Invalid --alert-interval: must be positive")
+	}
+	
+	stopReplication := make(chan struct{})
+	defer close(stopReplication)
+	if cfg.ReplicaOf != "" {
+		if cfg.ReplicaInterval <= 0 {
+			logger.Fatalf("Invalid --replica-interval: must be positive")
+		}
+		transport, err := mtls.Transport(logger, mtls.Files{Cert: cfg.ReplicaTLSCert, Key: cfg.ReplicaTLSKey, CA: cfg.ReplicaTLSCA})
+		if err != nil {
+			logger.Fatalf("Failed to set up TLS to the primary: %v", err)
+		}
+		replication = newReplica(cfg.ReplicaOf, transport, lb, authenticator)
+		logger.Infof("Running as a read replica of %s, copying its state every %s", cfg.ReplicaOf, cfg.ReplicaInterval)
+		go replication.run(cfg.ReplicaInterval, stopReplication)
+	}
+	
+	abuseDesk := abuse.NewDesk(logger, usageLedger, lb)
+	
+	restarts := rollout.NewOrchestrator(logger, lb, nodeList, func(node models.NodeInfo) {
+		if err := recordNode(node); err != nil {
+			logger.Errorf("Failed to store node %s: %v", node.NodeID, err)
+		}
+		updateLoadBalancer(lb)
+	})
+	
+	windows, err := maintenance.NewScheduler(logger, lb, nodeList, cfg.MaintenancePath)
+	if err != nil {
+		logger.Fatalf("Failed to load maintenance windows: %v", err)
+	}
+	restarts.SetSkip(windows.InMaintenance)
+	restarts.SetAgentToken(agentToken)
+	// A replica gets the drains of maintenance windows from the primary
+	stopMaintenance := make(chan struct{})
+	if replication == nil {
+		go windows.Run(stopMaintenance)
+	}
+	defer close(stopMaintenance)
+	
+	apiKeys := openAPIKeys()
+	
+	router := setupAPIRouter(lb, authenticator, st, abuseDesk, restarts, windows, interceptor, apiKeys)
+	configRoutes(router, cmd.PersistentFlags())
+	
+	go func() {
+		metricsRouter := gin.New()
+		metricsRouter.GET("/metrics", gin.WrapH(metrics.Handler()))
+		logger.Infof("Starting metrics server on port %d", cfg.MetricsPort)
+		if err := metricsRouter.Run(fmt.Sprintf(":%d", cfg.MetricsPort)); err != nil {
+			logger.Errorf("Metrics server error: %v", err)
+		}
+	}()
+	
+	// A persistent store brings back the pool from before a restart, so
+	// traffic is routed before the first node reports arrive. Health checks
+	// and the stale node cleanup weed out what went away meanwhile.
+	if restored := nodeList(); len(restored) > 0 {
+		logger.Infof("Restored %d nodes from the %s store", len(restored), cfg.Store)
+		updateLoadBalancer(lb)
+	}
+	
+	go startProxyServer(lb, clientIPs)
+	if cfg.HTTP3Port > 0 {
+		go startHTTP3Server(lb)
+	}
+	go persistBans(background, lb)
+	go expireLeases(background, lb, auditTrail)
+	go persistStickySessions(background, lb)
+	
+	if replication == nil {
+		go cleanupStaleNodes(background, windows)
+		// The primary already notifies of what a replica sees
+		stopWebhooks := make(chan struct{})
+		defer close(stopWebhooks)
+		go webhooks.Run(clusterEvents, stopWebhooks)
+		go alerts.Run(alertSnapshot(lb, windows), cfg.AlertInterval, stopWebhooks)
+	}
+	
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.ListenPort),
+		Handler: router,
+	}
+	// Event streams never finish on their own
+	srv.RegisterOnShutdown(clusterEvents.Close)
+	
+	apiListener, err := listen(cfg.ListenPort, clientIPs)
+	if err != nil {
+		logger.Fatalf("API server error: %v", err)
+	}
+	
+	apiTLS := mtls.Files{Cert: cfg.TLSCert, Key: cfg.TLSKey, CA: cfg.TLSClientCA}
+	if apiTLS.Enabled() {
+		tlsConfig, err := mtls.ServerConfig(logger, apiTLS)
+		if err != nil {
+			logger.Fatalf("Failed to set up API TLS: %v", err)
+		}
+		apiListener = tls.NewListener(apiListener, tlsConfig)
+		logger.Info("API requires client certificates (mutual TLS)")
+	}
+	
+	go func() {
+		logger.Infof("Starting API server on port %d", cfg.ListenPort)
+		if err := srv.Serve(apiListener); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("API server error: %v", err)
+		}
+	}()
+	
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	
+	logger.Info("Shutting down...")
+	stopBackground()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Errorf("Server shutdown error: %v", err)
+	}
+	saveBans(lb)
+	saveStickySessions(lb)
+}
+
+// setupInterception enables MITM mode when a TLS profile is configured
+// globally or for any user. It returns nil when interception is off.
+func setupInterception(lb *loadbalancer.LoadBalancer, users []models.User) *mitm.Interceptor {
+	enabled := cfg.TLSProfile != ""
+	for _, u := range users {
+		if u.TLSProfile != "" {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	if cfg.TLSProfile != "" && !mitm.ValidProfile(cfg.TLSProfile) {
+		logger.Fatalf("Unknown TLS profile %q (valid: %s)", cfg.TLSProfile, strings.Join(mitm.Profiles(), ", "))
+	}
+	
+	interceptor, err := mitm.NewInterceptor(logger, cfg.MITMCACert, cfg.MITMCAKey)
+	if err != nil {
+		logger.Fatalf("Failed to initialize TLS interception: %v", err)
+	}
+	lb.SetInterception(interceptor, cfg.TLSProfile, cfg.MITMDestinations)
+	
+	logger.Warnf("TLS INTERCEPTION (MITM) ENABLED: CONNECT tunnels are decrypted at the coordinator and clients must trust %s", cfg.MITMCACert)
+	return interceptor
+}
+
+// jsonTags makes viper decode nested config using the models' json tags.
+func jsonTags(dc *mapstructure.DecoderConfig) {
+	dc.TagName = "json"
+}
+
+func setupAPIRouter(lb *loadbalancer.LoadBalancer, authenticator *auth.Authenticator, st store.Store, abuseDesk *abuse.Desk, restarts *rollout.Orchestrator, windows *maintenance.Scheduler, interceptor *mitm.Interceptor, apiKeys *apikey.Store) *gin.Engine {
+	router := gin.Default()
+	router.Use(apierror.RequestID())
+	auditTrail, usageLedger := st.Events(), st.Usage()
+	
+	// Only believe forwarding headers from configured proxies; gin trusts
+	// everyone by default
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logger.Fatalf("Invalid trusted proxy configuration: %v", err)
+	}
+	
+	if apiKeys != nil {
+		router.Use(apikey.Middleware(apiKeys, []string{"/health"}, func(c *gin.Context, reason string) {
+			auditTrail.Record(audit.Entry{
+				Event:    "api_auth_failed",
+				ClientIP: c.ClientIP(),
+				Detail:   fmt.Sprintf("%s %s: %s", c.Request.Method, c.Request.URL.Path, reason),
+			})
+		}))
+	}
+	if replication != nil {
+		router.Use(readOnly(cfg.ReplicaOf))
+	}
+	
+	router.GET("/health", func(c *gin.Context) {
+		// Tells a load balancer in front to stop sending clients here
+		if lb.SelfDraining() {
+			c.JSON(503, gin.H{"status": "draining"})
+			return
+		}
+		// A replica has nothing to serve until its first copy
+		if replication != nil && !replication.synced() {
+			c.JSON(503, gin.H{"status": "syncing"})
+			return
+		}
+		c.JSON(200, gin.H{"status": "healthy"})
+	})
+	
+	router.POST("/api/nodes/:nodeId", func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		
+		nodeInfo, err := decodeNodeReport(c.Writer, c.Request, cfg.NodeReportMaxBytes)
+		if err == nil {
+			err = validateNodeReport(nodeID, &nodeInfo, cfg.NodeReportMaxProxies)
+		}
+		if err == nil {
+			err = checkAdvertisedURL(nodeInfo.APIURL, c.ClientIP())
+		}
+		if err != nil {
+			rejectNodeReport(c, nodeID, err)
+			return
+		}
+		
+		prepareNodeReport(&nodeInfo, nodeID, c.ClientIP(), time.Now(), auditTrail)
+		if err := recordNode(nodeInfo); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		nodeReports.WithLabelValues("full").Inc()
+		
+		updateLoadBalancer(lb)
+		
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	// Deltas only carry the instances that changed since the node's
+	// previous report. One that does not follow the stored report is
+	// answered with resync_required, and the agent sends a full report.
+	router.POST("/api/nodes/:nodeId/delta", func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		
+		delta, err := decodeNodeDelta(c.Writer, c.Request, cfg.NodeReportMaxBytes)
+		// Resolved before taking the lock
+		if err == nil {
+			err = checkAdvertisedURL(delta.APIURL, c.ClientIP())
+		}
+		if err != nil {
+			rejectNodeReport(c, nodeID, err)
+			return
+		}
+		receivedAt := time.Now()
+		
+		// Held from reading the stored report to writing the merged one,
+		// so concurrent reports cannot interleave
+		mu.Lock()
+		existing, err := nodes.GetNode(nodeID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			mu.Unlock()
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		nodeInfo, err := applyNodeDelta(existing, delta)
+		if err == nil {
+			err = validateNodeReport(nodeID, &nodeInfo, cfg.NodeReportMaxProxies)
+		}
+		if err != nil {
+			mu.Unlock()
+			rejectNodeReport(c, nodeID, err)
+			return
+		}
+		prepareNodeReport(&nodeInfo, nodeID, c.ClientIP(), receivedAt, auditTrail)
+		err = recordNodeLocked(nodeInfo)
+		mu.Unlock()
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		nodeReports.WithLabelValues("delta").Inc()
+		
+		updateLoadBalancer(lb)
+		
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	// Agents deregister when they shut down, so their exits leave the pool
+	// at once rather than once the node goes stale
+	router.DELETE("/api/nodes/:nodeId", func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		
+		mu.Lock()
+		err := nodes.DeleteNode(nodeID)
+		mu.Unlock()
+		if errors.Is(err, store.ErrNotFound) {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, fmt.Sprintf("node %s is not registered", nodeID))
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		forgetClockSkew(nodeID)
+		clusterEvents.Publish(eventstream.NodeLeft(nodeID, "deregistered"))
+		alerts.ForgetNode(nodeID)
+		logger.Infof("Node %s deregistered", nodeID)
+		auditTrail.Record(audit.Entry{Event: "node_deregistered", ClientIP: c.ClientIP(), Detail: nodeID})
+		
+		updateLoadBalancer(lb)
+		
+		c.JSON(200, gin.H{"status": "removed"})
+	})
+	
+	router.GET(apikey.ReplicationRoute, func(c *gin.Context) {
+		c.JSON(200, replicationState(lb, authenticator))
+	})
+	
+	router.GET("/api/replication/status", func(c *gin.Context) {
+		if replication == nil {
+			c.JSON(200, models.ReplicationStatus{Role: "primary", Nodes: len(nodeList())})
+			return
+		}
+		c.JSON(200, replication.status())
+	})
+	
+	router.GET("/api/nodes", func(c *gin.Context) {
+		nodeList, err := nodes.ListNodes()
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		
+		drained := make(map[string]bool)
+		for _, nodeID := range lb.DrainedNodes() {
+			drained[nodeID] = true
+		}
+		for i := range nodeList {
+			nodeList[i].Draining = drained[nodeList[i].NodeID]
+		}
+		if hideCredentials(c) {
+			nodeList = nodesWithoutCredentials(nodeList)
+		}
+		c.JSON(200, nodeList)
+	})
+	
+	// Running exits for clients that connect to exits directly, as
+	// host:port:user:pass lines, a JSON array or CSV
+	router.GET("/api/proxies/export", func(c *gin.Context) {
+		protocol := models.ProxyProtocol(c.DefaultQuery("protocol", string(models.ProxyProtocolHTTP)))
+		if protocol != models.ProxyProtocolHTTP && protocol != models.ProxyProtocolSOCKS5 {
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "protocol must be http or socks5")
+			return
+		}
+		format := c.DefaultQuery("format", exportPlain)
+		if format != exportPlain && format != exportJSON && format != exportCSV {
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "format must be plain, json or csv")
+			return
+		}
+		
+		exits := filterExits(pool.Exits(nodeList()), string(protocol), c.Query("tag"))
+		exits = exportedExits(exits, c.Query("node"), c.Query("region"))
+		if name := c.Query("pool"); name != "" {
+			var err error
+			if exits, err = lb.PoolExits(exits, name); err != nil {
+				apierror.Respond(c, 404, apierror.CodeNotFound, err)
+				return
+			}
+		}
+		if tenant, ok := scopeTenant(c); ok {
+			exits = lb.TenantExits(exits, tenant)
+		}
+		sort.Slice(exits, func(i, j int) bool { return exits[i].Address < exits[j].Address })
+		if hideCredentials(c) {
+			exits = exitsWithoutCredentials(exits)
+		}
+		writeExport(c, format, exits)
+	})
+	
+	router.GET("/api/pool/snapshot", func(c *gin.Context) {
+		snapshot := poolHistory.Snapshot()
+		snapshot.Exits = filterExits(snapshot.Exits, c.Query("protocol"), c.Query("tag"))
+		if tenant, ok := scopeTenant(c); ok {
+			snapshot.Exits = lb.TenantExits(snapshot.Exits, tenant)
+		}
+		if hideCredentials(c) {
+			snapshot.Exits = exitsWithoutCredentials(snapshot.Exits)
+		}
+		c.JSON(200, snapshot)
+	})
+	
+	// Exits added and removed since a snapshot (or an earlier diff)
+	// timestamp. Answers 410 once history that old has been discarded, at
+	// which point the client needs a fresh snapshot.
+	router.GET("/api/pool/diff", func(c *gin.Context) {
+		since, err := time.Parse(time.RFC3339, c.Query("since"))
+		if err != nil {
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+		diff, err := poolHistory.Diff(since)
+		if errors.Is(err, pool.ErrHistoryExpired) {
+			apierror.RespondMessage(c, 410, apierror.CodeHistoryExpired, "pool history does not go back to since; fetch /api/pool/snapshot")
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		diff.Added = filterExits(diff.Added, c.Query("protocol"), c.Query("tag"))
+		diff.Removed = filterExits(diff.Removed, c.Query("protocol"), c.Query("tag"))
+		if tenant, ok := scopeTenant(c); ok {
+			diff.Added = lb.TenantExits(diff.Added, tenant)
+			diff.Removed = lb.TenantExits(diff.Removed, tenant)
+		}
+		if hideCredentials(c) {
+			diff.Added = exitsWithoutCredentials(diff.Added)
+			diff.Removed = exitsWithoutCredentials(diff.Removed)
+		}
+		c.JSON(200, diff)
+	})
+	
+	router.GET("/api/stats", func(c *gin.Context) {
+		current, err := nodes.ListNodes()
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		
+		totalProxies := 0
+		healthyProxies := 0
+		
+		for _, node := range current {
+			for _, proxy := range node.Proxies {
+				totalProxies++
+				if proxy.Status == models.ProxyStatusRunning {
+					healthyProxies++
+				}
+			}
+		}
+		
+		stats := gin.H{
+			"total_nodes":         len(current),
+			"total_proxies":       totalProxies,
+			"healthy_proxies":     healthyProxies,
+			"queue":               lb.QueueStats(),
+			"strategy":            lb.Strategy(),
+			"in_flight":           lb.InFlight(),
+			"content_blocked":     lb.ContentBlocked(),
+			"duplicate_addresses": len(lb.DuplicateAddresses()),
+			"load_shedding":       shedder.Stats(),
+			"timestamp":           time.Now(),
+		}
+		
+		c.JSON(200, stats)
+	})
+	
+	router.GET("/api/users", func(c *gin.Context) {
+		if tenant := apikey.Tenant(c); tenant != "" {
+			c.JSON(200, tenantUsers(authenticator.Users(), tenant))
+			return
+		}
+		c.JSON(200, authenticator.Users())
+	})
+	
+	// Tenant keys add and replace users of their own tenant only
+	router.POST("/api/users", func(c *gin.Context) {
+		var user models.User
+		if err := c.ShouldBindJSON(&user); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if tenant := apikey.Tenant(c); tenant != "" {
+			if owner, found := userTenant(authenticator.Users(), user.Username); found && owner != tenant {
+				apierror.RespondMessage(c, 409, apierror.CodeConflict, "username "+user.Username+" is taken")
+				return
+			}
+			// Interception decrypts the user's tunnels at the coordinator,
+			// so only admins turn it on
+			if user.TLSProfile != "" {
+				apierror.RespondMessage(c, 403, apierror.CodeForbidden, "tenant keys cannot set tls_profile")
+				return
+			}
+			if user.Pool != "" {
+				owned, err := lb.Tenant(tenant)
+				if err != nil || !slices.Contains(owned.Pools, user.Pool) {
+					apierror.RespondMessage(c, 403, apierror.CodeForbidden, "pool "+user.Pool+" does not belong to tenant "+tenant)
+					return
+				}
+			}
+			user.Tenant = tenant
+		} else if user.Tenant != "" {
+			if _, err := lb.Tenant(user.Tenant); err != nil {
+				apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+				return
+			}
+		}
+		if err := authenticator.SetUser(user); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "user_updated", User: user.Username, ClientIP: c.ClientIP()})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.DELETE("/api/users/:username", func(c *gin.Context) {
+		username := c.Param("username")
+		if tenant := apikey.Tenant(c); tenant != "" {
+			if owner, found := userTenant(authenticator.Users(), username); !found || owner != tenant {
+				apierror.RespondMessage(c, 404, apierror.CodeNotFound, "user not found: "+username)
+				return
+			}
+		}
+		if err := authenticator.DeleteUser(username); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "user_deleted", User: username, ClientIP: c.ClientIP()})
+		c.JSON(200, gin.H{"status": "deleted"})
+	})
+	
+	router.GET("/api/mitm/ca.pem", func(c *gin.Context) {
+		if interceptor == nil {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, "TLS interception is not enabled")
+			return
+		}
+		c.Data(200, "application/x-pem-file", interceptor.CACertPEM())
+	})
+	
+	router.GET("/api/standby", func(c *gin.Context) {
+		c.JSON(200, lb.StandbyEndpoints())
+	})
+	
+	router.POST("/api/standby/activate", func(c *gin.Context) {
+		count, err := strconv.Atoi(c.DefaultQuery("count", "1"))
+		if err != nil || count < 1 {
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "count must be a positive integer")
+			return
+		}
+		promoted := lb.PromoteStandby(count)
+		auditTrail.Record(audit.Entry{Event: "standby_promoted", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%v", promoted)})
+		c.JSON(200, gin.H{"promoted": promoted})
+	})
+	
+	router.GET("/api/bans", func(c *gin.Context) {
+		c.JSON(200, lb.Bans())
+	})
+	
+	router.DELETE("/api/bans", func(c *gin.Context) {
+		lb.ClearBans()
+		saveBans(lb)
+		auditTrail.Record(audit.Entry{Event: "bans_cleared", ClientIP: c.ClientIP()})
+		c.JSON(200, gin.H{"status": "cleared"})
+	})
+	
+	router.GET("/api/bans/export", func(c *gin.Context) {
+		list := lb.ExportBans()
+		if c.Query("format") != "text" {
+			c.JSON(200, list)
+			return
+		}
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		banlist.WriteText(c.Writer, list, list.GeneratedAt)
+	})
+	
+	router.POST("/api/bans/import", func(c *gin.Context) {
+		data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBanListBytes+1))
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if len(data) > maxBanListBytes {
+			apierror.RespondMessage(c, 413, apierror.CodeRequestTooLarge, fmt.Sprintf("ban list is larger than %d bytes", maxBanListBytes))
+			return
+		}
+		entries, err := banlist.Parse(data)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		imported, err := lb.ImportBans(entries)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		saveBans(lb)
+		auditTrail.Record(audit.Entry{Event: "bans_imported", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%d of %d entries", imported, len(entries))})
+		c.JSON(200, gin.H{"status": "imported", "imported": imported, "expired": len(entries) - imported})
+	})
+	
+	router.GET("/api/bans/rules", func(c *gin.Context) {
+		c.JSON(200, lb.BanRules())
+	})
+	
+	router.PUT("/api/bans/rules", func(c *gin.Context) {
+		var rules []models.BanRule
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		lb.SetBanRules(rules)
+		if err := ruleStore.PutRules(store.BanRules, rules); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "ban_rules_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%d rules", len(rules))})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.GET("/api/outliers", func(c *gin.Context) {
+		c.JSON(200, lb.Outliers())
+	})
+	
+	router.DELETE("/api/outliers", func(c *gin.Context) {
+		exit := c.Query("exit")
+		if err := lb.ReturnOutlier(exit); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "outlier_returned", ClientIP: c.ClientIP(), Detail: exit})
+		c.JSON(200, gin.H{"status": "returned"})
+	})
+	
+	router.GET("/api/warmup", func(c *gin.Context) {
+		c.JSON(200, lb.WarmingPrefixes())
+	})
+	
+	router.DELETE("/api/warmup", func(c *gin.Context) {
+		prefix := c.Query("prefix")
+		if err := lb.FinishWarmup(prefix); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		savePrefixWarmup(lb)
+		auditTrail.Record(audit.Entry{Event: "warmup_finished", ClientIP: c.ClientIP(), Detail: prefix})
+		c.JSON(200, gin.H{"status": "finished"})
+	})
+	
+	router.GET("/api/outliers/policy", func(c *gin.Context) {
+		c.JSON(200, lb.OutlierPolicy())
+	})
+	
+	router.PUT("/api/outliers/policy", func(c *gin.Context) {
+		var policy models.OutlierPolicy
+		if err := c.ShouldBindJSON(&policy); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := lb.SetOutlierPolicy(policy); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "outlier_policy_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%d%% over %ds", policy.ErrorRatePercent, policy.WindowSeconds)})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.GET("/api/rewrite-rules", func(c *gin.Context) {
+		c.JSON(200, lb.RewriteRules())
+	})
+	
+	router.PUT("/api/rewrite-rules", func(c *gin.Context) {
+		var rules []models.RewriteRule
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		lb.SetRewriteRules(rules)
+		if err := ruleStore.PutRules(store.RewriteRules, rules); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "rewrite_rules_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%d rules", len(rules))})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.GET("/api/reuse-rules", func(c *gin.Context) {
+		c.JSON(200, lb.ReuseRules())
+	})
+	
+	router.PUT("/api/reuse-rules", func(c *gin.Context) {
+		var rules []models.ReuseRule
+		if err := c.ShouldBindJSON(&rules); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := lb.SetReuseRules(rules); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.ReuseRules, rules); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "reuse_rules_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%d rules", len(rules))})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.GET("/api/prefix-origins", func(c *gin.Context) {
+		c.JSON(200, lb.PrefixOrigins())
+	})
+	
+	router.PUT("/api/prefix-origins", func(c *gin.Context) {
+		var origins []models.PrefixOrigin
+		if err := c.ShouldBindJSON(&origins); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := lb.SetPrefixOrigins(origins); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.PrefixOrigins, origins); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "prefix_origins_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%d prefixes", len(origins))})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.GET("/api/pools", func(c *gin.Context) {
+		c.JSON(200, lb.PoolStatuses())
+	})
+	
+	router.GET("/api/pools/:name", func(c *gin.Context) {
+		status, err := lb.PoolStatus(c.Param("name"))
+		if err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		c.JSON(200, status)
+	})
+	
+	// Add a named pool or replace the one with its name
+	router.POST("/api/pools", func(c *gin.Context) {
+		var pool models.ProxyPool
+		if err := c.ShouldBindJSON(&pool); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := lb.SetPool(pool); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.Pools, lb.Pools()); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "pool_updated", ClientIP: c.ClientIP(), Detail: pool.Name})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.DELETE("/api/pools/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		if err := lb.DeletePool(name); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.Pools, lb.Pools()); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "pool_deleted", ClientIP: c.ClientIP(), Detail: name})
+		c.JSON(200, gin.H{"status": "deleted"})
+	})
+	
+	router.GET("/api/tenants", func(c *gin.Context) {
+		statuses := []models.TenantStatus{}
+		for _, tenant := range lb.Tenants() {
+			statuses = append(statuses, tenantStatus(lb, authenticator, usageLedger, tenant))
+		}
+		c.JSON(200, statuses)
+	})
+	
+	router.GET("/api/tenants/:name", func(c *gin.Context) {
+		tenant, err := lb.Tenant(c.Param("name"))
+		if err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		c.JSON(200, tenantStatus(lb, authenticator, usageLedger, tenant))
+	})
+	
+	// The tenant of the calling key
+	router.GET("/api/tenant", func(c *gin.Context) {
+		name := apikey.Tenant(c)
+		if name == "" {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, "this API key belongs to no tenant")
+			return
+		}
+		tenant, err := lb.Tenant(name)
+		if err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		c.JSON(200, tenantStatus(lb, authenticator, usageLedger, tenant))
+	})
+	
+	// Add a tenant or replace the one with its name
+	router.POST("/api/tenants", func(c *gin.Context) {
+		var tenant models.Tenant
+		if err := c.ShouldBindJSON(&tenant); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if _, err := lb.SetTenant(tenant, time.Now()); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.Tenants, lb.Tenants()); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "tenant_updated", ClientIP: c.ClientIP(), Detail: tenant.Name})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	// Users have to be moved or deleted before their tenant
+	router.DELETE("/api/tenants/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		if users := tenantUsers(authenticator.Users(), name); len(users) > 0 {
+			apierror.RespondMessage(c, 409, apierror.CodeConflict, fmt.Sprintf("tenant %s still has %d users", name, len(users)))
+			return
+		}
+		if err := lb.DeleteTenant(name); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.Tenants, lb.Tenants()); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "tenant_deleted", ClientIP: c.ClientIP(), Detail: name})
+		c.JSON(200, gin.H{"status": "deleted"})
+	})
+	
+	router.GET("/api/content-policy", func(c *gin.Context) {
+		c.JSON(200, lb.ContentPolicy())
+	})
+	
+	router.PUT("/api/content-policy", func(c *gin.Context) {
+		var policy models.ContentPolicy
+		if err := c.ShouldBindJSON(&policy); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := lb.SetContentPolicy(policy); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "content_policy_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("max %d bytes, %d blocked types", policy.MaxResponseBytes, len(policy.BlockedTypes))})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+	
+	router.GET("/api/transport/stats", func(c *gin.Context) {
+		c.JSON(200, lb.TransportStats())
+	})
+	
+	router.GET("/api/transport/settings", func(c *gin.Context) {
+		c.JSON(200, lb.TransportSettings())
+	})
+	
+	router.PUT("/api/transport/settings", func(c *gin.Context) {
+		settings := lb.TransportSettings()
+		if err := c.ShouldBindJSON(&settings); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := lb.SetTransportSettings(settings); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "transport_settings_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%+v", settings)})
+		c.JSON(200, settings)
+	})
+	
+	router.GET("/api/faults", func(c *gin.Context) {
+		c.JSON(200, lb.Faults())
+	})
+	
+	router.PUT("/api/faults", func(c *gin.Context) {
+		var faults models.FaultConfig
+		if err := c.ShouldBindJSON(&faults); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := lb.SetFaults(faults); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "faults_updated", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%+v", faults)})
+		c.JSON(200, faults)
+	})
+	
+	router.DELETE("/api/faults", func(c *gin.Context) {
+		if err := lb.SetFaults(models.FaultConfig{}); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "faults_cleared", ClientIP: c.ClientIP()})
+		c.JSON(200, gin.H{"status": "cleared"})
+	})
+	
+	router.GET("/api/tunnels", func(c *gin.Context) {
+		c.JSON(200, lb.Tunnels())
+	})
+	
+	router.DELETE("/api/tunnels/:id", func(c *gin.Context) {
+		tunnelID := c.Param("id")
+		if err := lb.CloseTunnel(tunnelID); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "tunnel_terminated", ClientIP: c.ClientIP(), Detail: tunnelID})
+		c.JSON(200, gin.H{"status": "terminated"})
+	})
+	
+	router.GET("/api/ledger", func(c *gin.Context) {
+		query, err := parseLedgerQuery(c)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		
+		entries, err := usageLedger.Query(query)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		
+		// Exports are written out as they are encoded rather than built
+		// in memory first
+		switch format := c.DefaultQuery("format", "json"); format {
+		case "json":
+			c.JSON(200, entries)
+		case "csv":
+			c.Header("Content-Type", "text/csv")
+			c.Header("Content-Disposition", `attachment; filename="ledger.csv"`)
+			if err := ledger.WriteCSV(c.Writer, entries); err != nil {
+				logger.Errorf("Failed to export ledger: %v", err)
+			}
+		case "parquet":
+			c.Header("Content-Type", "application/vnd.apache.parquet")
+			c.Header("Content-Disposition", `attachment; filename="ledger.parquet"`)
+			if err := ledger.WriteParquet(c.Writer, entries); err != nil {
+				logger.Errorf("Failed to export ledger: %v", err)
+			}
+		default:
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, fmt.Sprintf("unknown format %q (want json, csv or parquet)", format))
+		}
+	})
+	
+	router.POST("/api/abuse", func(c *gin.Context) {
+		var report models.AbuseReport
+		if err := c.ShouldBindJSON(&report); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		resolved, err := abuseDesk.Submit(report)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{
+			Event:    "abuse_report",
+			ClientIP: c.ClientIP(),
+			Detail:   fmt.Sprintf("id=%s ip=%s users=%v quarantined=%v", resolved.ID, resolved.IP, resolved.Users, resolved.Quarantine),
+		})
+		c.JSON(200, resolved)
+	})
+	
+	router.GET("/api/abuse", func(c *gin.Context) {
+		c.JSON(200, abuseDesk.Reports())
+	})
+	
+	router.POST("/api/nodes/:nodeId/drain", func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		lb.DrainNode(nodeID)
+		auditTrail.Record(audit.Entry{Event: "node_drained", ClientIP: c.ClientIP(), Detail: nodeID})
+		c.JSON(200, gin.H{"status": "draining", "in_flight": lb.NodeInFlight(nodeID)})
+	})
+	
+	router.DELETE("/api/nodes/:nodeId/drain", func(c *gin.Context) {
+		nodeID := c.Param("nodeId")
+		lb.UndrainNode(nodeID)
+		auditTrail.Record(audit.Entry{Event: "node_undrained", ClientIP: c.ClientIP(), Detail: nodeID})
+		c.JSON(200, gin.H{"status": "active"})
+	})
+	
+	// A node's report history, by default for the last day
+	router.GET("/api/nodes/:nodeId/heartbeats", func(c *gin.Context) {
+		since := time.Now().Add(-24 * time.Hour)
+		if raw := c.Query("since"); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "since must be an RFC 3339 timestamp")
+				return
+			}
+			since = parsed
+		}
+		history, err := heartbeats.ListHeartbeats(c.Param("nodeId"), since)
+		if err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		c.JSON(200, history)
+	})
+	
+	router.Any(apikey.AgentProxyRoute, agentProxy(auditTrail))
+	commandRoutes(router, commands.NewQueue(logger, lb), auditTrail)
+	eventRoutes(router)
+	billingRoutes(router, meter)
+	trafficRoutes(router, recentTraffic)
+	webhookRoutes(router, webhooks, auditTrail)
+	alertRoutes(router, alerts, auditTrail)
+	
+	router.POST("/api/drain", func(c *gin.Context) {
+		lb.DrainSelf()
+		auditTrail.Record(audit.Entry{Event: "coordinator_drained", ClientIP: c.ClientIP()})
+		c.JSON(200, lb.DrainStatus().Coordinator)
+	})
+	
+	router.DELETE("/api/drain", func(c *gin.Context) {
+		lb.UndrainSelf()
+		auditTrail.Record(audit.Entry{Event: "coordinator_undrained", ClientIP: c.ClientIP()})
+		c.JSON(200, gin.H{"status": "active"})
+	})
+	
+	// Work left on the coordinator and drained nodes, or with ?node= on
+	// one drained node
+	router.GET("/api/drain/status", func(c *gin.Context) {
+		status := lb.DrainStatus()
+		nodeID := c.Query("node")
+		if nodeID == "" {
+			c.JSON(200, status)
+			return
+		}
+		for _, node := range status.Nodes {
+			if node.NodeID == nodeID {
+				c.JSON(200, node)
+				return
+			}
+		}
+		apierror.RespondMessage(c, 404, apierror.CodeNotFound, fmt.Sprintf("node %s is not draining", nodeID))
+	})
+	
+	router.GET("/api/drains", func(c *gin.Context) {
+		c.JSON(200, lb.DrainedNodes())
+	})
+	
+	router.GET("/api/maintenance", func(c *gin.Context) {
+		c.JSON(200, windows.List())
+	})
+	
+	router.POST("/api/maintenance", func(c *gin.Context) {
+		var window models.MaintenanceWindow
+		if err := c.ShouldBindJSON(&window); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		window, err := windows.Add(window)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "maintenance_scheduled", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("%s %v", window.ID, window.Nodes)})
+		c.JSON(200, window)
+	})
+	
+	router.DELETE("/api/maintenance/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		if err := windows.Remove(id); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "maintenance_cancelled", ClientIP: c.ClientIP(), Detail: id})
+		c.JSON(200, gin.H{"status": "removed"})
+	})
+	
+	router.POST("/api/nodes/rolling-restart", func(c *gin.Context) {
+		var opts rollout.Options
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&opts); err != nil {
+				apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+				return
+			}
+		}
+		status, err := restarts.Start(opts)
+		if err != nil {
+			apierror.Respond(c, 409, apierror.CodeConflict, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "rolling_restart_started", ClientIP: c.ClientIP(), Detail: status.ID})
+		c.JSON(202, status)
+	})
+	
+	router.GET("/api/nodes/rolling-restart", func(c *gin.Context) {
+		status, ok := restarts.Status()
+		if !ok {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, "no rolling restart has been started")
+			return
+		}
+		c.JSON(200, status)
+	})
+	
+	router.POST("/api/nodes/rolling-restart/resume", func(c *gin.Context) {
+		if err := restarts.Resume(); err != nil {
+			apierror.Respond(c, 409, apierror.CodeConflict, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "rolling_restart_resumed", ClientIP: c.ClientIP()})
+		status, _ := restarts.Status()
+		c.JSON(200, status)
+	})
+	
+	router.POST("/api/nodes/rolling-restart/abort", func(c *gin.Context) {
+		if err := restarts.Abort(); err != nil {
+			apierror.Respond(c, 409, apierror.CodeConflict, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "rolling_restart_aborted", ClientIP: c.ClientIP()})
+		status, _ := restarts.Status()
+		c.JSON(200, status)
+	})
+	
+	router.GET("/api/quarantine", func(c *gin.Context) {
+		c.JSON(200, lb.QuarantinedExits())
+	})
+	
+	router.DELETE("/api/quarantine/:ip", func(c *gin.Context) {
+		ip := c.Param("ip")
+		if err := lb.ReleaseQuarantine(ip); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "quarantine_released", ClientIP: c.ClientIP(), Detail: ip})
+		c.JSON(200, gin.H{"status": "released"})
+	})
+	
+	// Reserve an egress IP for exclusive, direct use. Its exits leave the
+	// shared selection until the lease expires or is released.
+	router.POST("/api/leases", func(c *gin.Context) {
+		var req models.LeaseRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if req.Holder == "" {
+			req.Holder = c.ClientIP()
+		}
+		lease, err := lb.Lease(req, time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		saveLeases(lb)
+		auditTrail.Record(audit.Entry{Event: "lease_created", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("id=%s ip=%s holder=%s expires=%s", lease.ID, lease.IP, lease.Holder, lease.ExpiresAt.Format(time.RFC3339))})
+		c.JSON(201, lease)
+	})
+	
+	router.GET("/api/leases", func(c *gin.Context) {
+		leases := lb.Leases(time.Now())
+		if hideCredentials(c) {
+			leases = leasesWithoutCredentials(leases)
+		}
+		c.JSON(200, leases)
+	})
+	
+	router.GET("/api/leases/:id", func(c *gin.Context) {
+		lease, err := lb.LeaseByID(c.Param("id"), time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		if hideCredentials(c) {
+			lease = leaseWithoutCredentials(lease)
+		}
+		c.JSON(200, lease)
+	})
+	
+	router.POST("/api/leases/:id/renew", func(c *gin.Context) {
+		var req models.LeaseRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		lease, err := lb.RenewLease(c.Param("id"), req.TTLSeconds, time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		saveLeases(lb)
+		auditTrail.Record(audit.Entry{Event: "lease_renewed", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("id=%s ip=%s expires=%s", lease.ID, lease.IP, lease.ExpiresAt.Format(time.RFC3339))})
+		c.JSON(200, lease)
+	})
+	
+	router.DELETE("/api/leases/:id", func(c *gin.Context) {
+		lease, err := lb.ReleaseLease(c.Param("id"), time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		saveLeases(lb)
+		auditTrail.Record(audit.Entry{Event: "lease_released", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("id=%s ip=%s", lease.ID, lease.IP)})
+		c.JSON(200, gin.H{"status": "released"})
+	})
+	
+	leaseBatchRoutes(router, lb, auditTrail)
+	
+	// Addresses several nodes report, kept out of the pool until resolved
+	router.GET("/api/duplicates", func(c *gin.Context) {
+		c.JSON(200, lb.DuplicateAddresses())
+	})
+	
+	router.GET("/api/audit", func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		c.JSON(200, auditTrail.Entries(limit))
+	})
+	
+	return router
+}
+
+// parseLedgerQuery reads ip, user, node, from and to (RFC 3339) query
+// parameters.
+func parseLedgerQuery(c *gin.Context) (ledger.Query, error) {
+	query := ledger.Query{
+		IP:     c.Query("ip"),
+		User:   c.Query("user"),
+		Tenant: c.Query("tenant"),
+		NodeID: c.Query("node"),
+	}
+	// Tenant keys only get their own usage
+	if tenant := apikey.Tenant(c); tenant != "" {
+		query.Tenant = tenant
+	}
+	
+	var err error
+	if from := c.Query("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	return query, nil
+}
+
+// listen opens a TCP listener on port, accepting PROXY protocol headers
+// from trusted proxies when enabled.
+func listen(port int, clientIPs *clientip.Resolver) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProxyProtocol {
+		return clientip.NewListener(listener, logger, clientIPs), nil
+	}
+	return listener, nil
+}
+
+func startProxyServer(lb *loadbalancer.LoadBalancer, clientIPs *clientip.Resolver) {
+	logger.Infof("Starting proxy server on port %d", cfg.ProxyPort)
+	
+	listener, err := listen(cfg.ProxyPort, clientIPs)
+	if err != nil {
+		logger.Fatalf("Proxy server error: %v", err)
+	}
+	
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", cfg.ProxyPort),
+		Handler:      lb,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+	
+	if err := server.Serve(listener); err != nil {
+		logger.Fatalf("Proxy server error: %v", err)
+	}
+}
+
+func updateLoadBalancer(lb *loadbalancer.LoadBalancer) {
+	current := nodeList()
+	lb.UpdateProxies(current)
+	savePrefixWarmup(lb)
+	recordPoolHistory(current)
+}
+
+// savePrefixWarmup stores when each prefix joined the pool once that
+// changed, so a restart does not start their warm-up over.
+func savePrefixWarmup(lb *loadbalancer.LoadBalancer) {
+	seen, changed := lb.PrefixFirstSeen()
+	if !changed {
+		return
+	}
+	if err := ruleStore.PutRules(store.WarmupPrefixes, seen); err != nil {
+		logger.Errorf("Failed to save warm-up prefixes: %v", err)
+	}
+}
+
+// recordPoolHistory snapshots the pool for /api/pool/diff unless history
+// writes are being shed. History is snapshot based, so the next recorded
+// change still carries everything that happened meanwhile.
+func recordPoolHistory(current []models.NodeInfo) {
+	if shedder.Shed(loadshed.WorkHistory) {
+		return
+	}
+	poolHistory.Record(current)
+}
+
+// filterExits keeps exits using protocol and carrying tag. Empty filters
+// match every exit.
+func filterExits(exits []models.PoolExit, protocol, tag string) []models.PoolExit {
+	if protocol == "" && tag == "" {
+		return exits
+	}
+	filtered := []models.PoolExit{}
+	for _, exit := range exits {
+		if (protocol == "" || string(exit.Protocol) == protocol) && hasTag(exit.Tags, tag) {
+			filtered = append(filtered, exit)
+		}
+	}
+	return filtered
+}
+
+// hasTag reports whether tags include tag. An empty tag is no filter.
+func hasTag(tags []string, tag string) bool {
+	return tag == "" || slices.Contains(tags, tag)
+}
+
+// seedStore fills an empty store with the users and rules from the config
+// and otherwise replaces them with the stored ones, so a persistent store
+// keeps changes made through the API across restarts.
+func seedStore(st store.Store) error {
+	users, err := st.Users().ListUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		cfg.Users = users
+	} else {
+		for _, user := range cfg.Users {
+			if err := st.Users().PutUser(user); err != nil {
+				return err
+			}
+		}
+	}
+	
+	rules := map[string]interface{}{
+		store.BanRules:      &cfg.BanRules,
+		store.RewriteRules:  &cfg.RewriteRules,
+		store.ReuseRules:    &cfg.ReuseRules,
+		store.PrefixOrigins: &cfg.PrefixOrigins,
+		store.Pools:         &cfg.Pools,
+		store.Tenants:       &cfg.Tenants,
+		store.Webhooks:      &cfg.Webhooks,
+	}
+	for kind, configured := range rules {
+		found, err := st.Rules().GetRules(kind, configured)
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		if err := st.Rules().PutRules(kind, configured); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nodeList() []models.NodeInfo {
+	list, err := nodes.ListNodes()
+	if err != nil {
+		logger.Errorf("Failed to list nodes: %v", err)
+	}
+	return list
+}
+
+// recordNode stores a node report, keeping the previously known API URL
+// when the report doesn't carry one.
+func recordNode(node models.NodeInfo) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return recordNodeLocked(node)
+}
+
+func recordNodeLocked(node models.NodeInfo) error {
+	var previous *models.NodeInfo
+	existing, err := nodes.GetNode(node.NodeID)
+	if err == nil {
+		previous = &existing
+		if node.APIURL == "" {
+			node.APIURL = existing.APIURL
+		}
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	if err := nodes.PutNode(node); err != nil {
+		return err
+	}
+	publishNodeChanges(previous, node)
+	
+	running := 0
+	for _, proxy := range node.Proxies {
+		if proxy.Status == models.ProxyStatusRunning {
+			running++
+		}
+	}
+	if err := heartbeats.RecordHeartbeat(models.Heartbeat{NodeID: node.NodeID, ReceivedAt: time.Now(), Proxies: len(node.Proxies), Running: running}); err != nil {
+		logger.Warnf("Failed to record heartbeat of node %s: %v", node.NodeID, err)
+	}
+	return nil
+}
+
+// cleanupStaleNodes forgets nodes that stopped reporting. Nodes in
+// maintenance are expected to go quiet and are kept.
+func cleanupStaleNodes(ctx context.Context, windows *maintenance.Scheduler) {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mu.Lock()
+		now := time.Now()
+		removed := false
+		for _, node := range nodeList() {
+			if now.Sub(node.UpdatedAt) > 2*time.Minute && !windows.InMaintenance(node.NodeID) {
+				logger.Warnf("Removing stale node: %s", node.NodeID)
+				if err := nodes.DeleteNode(node.NodeID); err != nil && !errors.Is(err, store.ErrNotFound) {
+					logger.Errorf("Failed to remove stale node %s: %v", node.NodeID, err)
+					continue
+				}
+				forgetClockSkew(node.NodeID)
+				clusterEvents.Publish(eventstream.NodeLeft(node.NodeID, "stopped reporting"))
+				removed = true
+			}
+		}
+		mu.Unlock()
+		
+		if removed {
+			recordPoolHistory(nodeList())
+		}
+	}
+}
\ No newline at end of file
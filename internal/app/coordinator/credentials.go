@@ -0,0 +1,64 @@
+package coordinator
+
+import (
+	"proxy-v6/internal/apikey"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hideCredentials reports whether responses to c leave out the credentials
+// of exits and leases. Readonly keys only watch, so like the replication
+// state with its user passwords they are kept from them.
+func hideCredentials(c *gin.Context) bool {
+	return apikey.Role(c) == apikey.RoleReadOnly
+}
+
+// nodesWithoutCredentials returns copies of nodes without their exits'
+// credentials.
+func nodesWithoutCredentials(nodes []models.NodeInfo) []models.NodeInfo {
+	result := make([]models.NodeInfo, len(nodes))
+	for i, node := range nodes {
+		node.Proxies = append([]models.ProxyInstance(nil), node.Proxies...)
+		for j := range node.Proxies {
+			node.Proxies[j].Username = ""
+			node.Proxies[j].Password = ""
+		}
+		result[i] = node
+	}
+	return result
+}
+
+// exitsWithoutCredentials returns a copy of exits without credentials.
+func exitsWithoutCredentials(exits []models.PoolExit) []models.PoolExit {
+	if exits == nil {
+		return nil
+	}
+	result := make([]models.PoolExit, len(exits))
+	for i, exit := range exits {
+		exit.Username = ""
+		exit.Password = ""
+		result[i] = exit
+	}
+	return result
+}
+
+// leaseWithoutCredentials returns a copy of lease whose exits carry no
+// credentials, also not in their proxy URLs.
+func leaseWithoutCredentials(lease models.Lease) models.Lease {
+	lease.Exits = append([]models.LeasedExit(nil), lease.Exits...)
+	for i := range lease.Exits {
+		lease.Exits[i].Username = ""
+		lease.Exits[i].Password = ""
+		lease.Exits[i].ProxyURL = "http://" + lease.Exits[i].Address
+	}
+	return lease
+}
+
+func leasesWithoutCredentials(leases []models.Lease) []models.Lease {
+	result := make([]models.Lease, len(leases))
+	for i, lease := range leases {
+		result[i] = leaseWithoutCredentials(lease)
+	}
+	return result
+}
@@ -0,0 +1,114 @@
+package coordinator
+
+import (
+	"sync"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/eventstream"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// maxProxyEvents is how many lifecycle events the coordinator keeps,
+	// across all nodes, before dropping the oldest.
+	maxProxyEvents = 10000
+	// maxEventBatch is the most events accepted in one post.
+	maxEventBatch = 1000
+)
+
+var proxyEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_node_proxy_events_total",
+	Help: "Proxy lifecycle events reported by agents, by type.",
+}, []string{"type"})
+
+// eventLog keeps the most recent lifecycle events reported by agents,
+// oldest first.
+type eventLog struct {
+	events []models.ProxyEvent
+	mu     sync.Mutex
+}
+
+func (l *eventLog) add(events []models.ProxyEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, events...)
+	if over := len(l.events) - maxProxyEvents; over > 0 {
+		l.events = append([]models.ProxyEvent(nil), l.events[over:]...)
+	}
+}
+
+// query returns the events matching every filter that is set, oldest
+// first.
+func (l *eventLog) query(nodeID, eventType, instanceID string, since time.Time) []models.ProxyEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	matched := []models.ProxyEvent{}
+	for _, e := range l.events {
+		if nodeID != "" && e.NodeID != nodeID || eventType != "" && e.Type != eventType || instanceID != "" && e.InstanceID != instanceID {
+			continue
+		}
+		if !since.IsZero() && !e.Time.After(since) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+	return matched
+}
+
+// eventRoutes take the lifecycle events agents post and serve them to
+// automation reacting to them.
+func eventRoutes(router *gin.Engine) {
+	log := &eventLog{}
+
+	router.POST("/api/nodes/:nodeId/events", func(c *gin.Context) {
+		var events []models.ProxyEvent
+		if err := c.ShouldBindJSON(&events); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if len(events) > maxEventBatch {
+			apierror.RespondMessage(c, 413, apierror.CodeRequestTooLarge, "too many events in one post")
+			return
+		}
+		// The route says which node they are from
+		nodeID := c.Param("nodeId")
+		for i := range events {
+			events[i].NodeID = nodeID
+			proxyEvents.WithLabelValues(events[i].Type).Inc()
+		}
+		log.add(events)
+		for _, e := range events {
+			clusterEvents.Publish(eventstream.ProxyEvent(e))
+		}
+		c.JSON(200, gin.H{"status": "accepted", "events": len(events)})
+	})
+
+	// Poll with since set to the time of the last event seen for the ones
+	// after it, or open a WebSocket or ask for text/event-stream to be
+	// sent every cluster event as it happens
+	router.GET("/api/events", func(c *gin.Context) {
+		if wantsWebSocket(c) {
+			streamEventsWebSocket(c)
+			return
+		}
+		if wantsEventStream(c) {
+			streamEvents(c)
+			return
+		}
+		var since time.Time
+		if raw := c.Query("since"); raw != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "since must be an RFC 3339 timestamp")
+				return
+			}
+			since = parsed
+		}
+		c.JSON(200, log.query(c.Query("node"), c.Query("type"), c.Query("instance"), since))
+	})
+}
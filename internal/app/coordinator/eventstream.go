@@ -0,0 +1,217 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/eventstream"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// keepAliveInterval is how often an idle event stream gets a comment, or
+// a ping over WebSocket, so proxies in between do not time it out.
+const keepAliveInterval = 15 * time.Second
+
+// healthEvents publishes the health flaps of exits.
+type healthEvents struct {
+	hub *eventstream.Hub
+}
+
+func (h healthEvents) ExitHealthChanged(exit loadbalancer.ProxyEndpoint, reason string) {
+	eventType := models.ClusterEventExitUnhealthy
+	if exit.Healthy {
+		eventType = models.ClusterEventExitHealthy
+	}
+	h.hub.Publish(models.ClusterEvent{
+		Type:       eventType,
+		NodeID:     exit.NodeID,
+		InstanceID: exit.InstanceID,
+		Address:    exit.Address,
+		Reason:     reason,
+	})
+}
+
+// publishNodeChanges publishes what changed between the stored report of
+// a node, nil when there was none, and the one replacing it.
+func publishNodeChanges(previous *models.NodeInfo, current models.NodeInfo) {
+	for _, event := range eventstream.NodeChanges(previous, current) {
+		clusterEvents.Publish(event)
+	}
+}
+
+// wantsEventStream reports whether the client asked GET /api/events for a
+// stream of server-sent events rather than the stored lifecycle events.
+func wantsEventStream(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
+
+// wantsWebSocket reports whether the client asked GET /api/events to be
+// upgraded to a WebSocket stream.
+func wantsWebSocket(c *gin.Context) bool {
+	return strings.EqualFold(c.GetHeader("Upgrade"), "websocket")
+}
+
+// eventFilter is what a client streaming events asked for. type and node
+// narrow the stream, type taking a comma-separated list. A client
+// resuming passes the ID of the last event it got as Last-Event-ID, or as
+// ?last_event_id= where it cannot set headers, as browsers opening a
+// WebSocket.
+type eventFilter struct {
+	lastID uint64
+	types  map[string]bool
+	node   string
+}
+
+func parseEventFilter(c *gin.Context) (eventFilter, bool) {
+	f := eventFilter{types: make(map[string]bool), node: c.Query("node")}
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("last_event_id")
+	}
+	if raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			apierror.RespondMessage(c, 400, apierror.CodeInvalidRequest, "Last-Event-ID must be an event ID")
+			return f, false
+		}
+		f.lastID = parsed
+	}
+	for _, t := range strings.Split(c.Query("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.types[t] = true
+		}
+	}
+	return f, true
+}
+
+func (f eventFilter) matches(event models.ClusterEvent) bool {
+	return (len(f.types) == 0 || f.types[event.Type]) && (f.node == "" || event.NodeID == f.node)
+}
+
+// streamEvents sends cluster events to the client as server-sent events
+// until it disconnects. Each carries its ID, so a client reconnecting with
+// Last-Event-ID first gets the retained events it missed.
+func streamEvents(c *gin.Context) {
+	filter, ok := parseEventFilter(c)
+	if !ok {
+		return
+	}
+	matches := filter.matches
+
+	replay, sub := clusterEvents.Subscribe(filter.lastID)
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	for _, event := range replay {
+		if matches(event) {
+			writeEvent(c.Writer, event)
+		}
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	done := c.Request.Context().Done()
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			// Closed for falling behind or a shutdown; the client
+			// reconnects and resumes from the backlog
+			if !ok {
+				return
+			}
+			if !matches(event) {
+				continue
+			}
+			writeEvent(c.Writer, event)
+		case <-keepAlive.C:
+			io.WriteString(c.Writer, ": keep-alive\n\n")
+		case <-done:
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event models.ClusterEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Failed to encode event %d: %v", event.ID, err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// streamEventsWebSocket upgrades the request to a WebSocket and sends each
+// cluster event as a JSON text message, filtered and resumed as with
+// server-sent events, until either side closes it. Messages from the
+// client are read only to see it go. Any origin may connect: API keys
+// come in headers, which pages of another site cannot add, and no cookie
+// authenticates.
+func streamEventsWebSocket(c *gin.Context) {
+	filter, ok := parseEventFilter(c)
+	if !ok {
+		return
+	}
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			replay, sub := clusterEvents.Subscribe(filter.lastID)
+			defer sub.Close()
+
+			// Pings are answered and close frames end Receive
+			gone := make(chan struct{})
+			go func() {
+				defer close(gone)
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+
+			for _, event := range replay {
+				if filter.matches(event) && websocket.JSON.Send(ws, event) != nil {
+					return
+				}
+			}
+			keepAlive := time.NewTicker(keepAliveInterval)
+			defer keepAlive.Stop()
+			for {
+				select {
+				case event, ok := <-sub.Events:
+					// As with server-sent events, the client resumes
+					// from the backlog
+					if !ok {
+						return
+					}
+					if filter.matches(event) && websocket.JSON.Send(ws, event) != nil {
+						return
+					}
+				case <-keepAlive.C:
+					ws.PayloadType = websocket.PingFrame
+					_, err := ws.Write(nil)
+					ws.PayloadType = websocket.TextFrame
+					if err != nil {
+						return
+					}
+				case <-gone:
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,71 @@
+package coordinator
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Formats of GET /api/proxies/export.
+const (
+	exportPlain = "plain"
+	exportJSON  = "json"
+	exportCSV   = "csv"
+)
+
+// exportCSVHeader names the columns of the CSV export.
+var exportCSVHeader = []string{"ip", "port", "username", "password", "protocol", "node_id", "region", "name", "tags", "pools"}
+
+// exportedExits keeps the exits of nodeID and of region. Empty filters
+// keep every exit.
+func exportedExits(exits []models.PoolExit, nodeID, region string) []models.PoolExit {
+	if nodeID == "" && region == "" {
+		return exits
+	}
+	filtered := []models.PoolExit{}
+	for _, exit := range exits {
+		if (nodeID == "" || exit.NodeID == nodeID) && (region == "" || exit.Region == region) {
+			filtered = append(filtered, exit)
+		}
+	}
+	return filtered
+}
+
+// writeExport answers with exits in format. Plain lines are host:port, with
+// :user:pass appended for exits with auth; IPv6 hosts are bracketed so the
+// line splits unambiguously.
+func writeExport(c *gin.Context, format string, exits []models.PoolExit) {
+	switch format {
+	case exportJSON:
+		if exits == nil {
+			exits = []models.PoolExit{}
+		}
+		c.JSON(200, exits)
+	case exportCSV:
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		w.Write(exportCSVHeader)
+		for _, exit := range exits {
+			w.Write([]string{
+				exit.IP, strconv.Itoa(exit.Port), exit.Username, exit.Password, string(exit.Protocol),
+				exit.NodeID, exit.Region, exit.Name, strings.Join(exit.Tags, " "), strings.Join(exit.Pools, " "),
+			})
+		}
+		w.Flush()
+	default:
+		var body strings.Builder
+		for _, exit := range exits {
+			body.WriteString(exit.Address)
+			if exit.Username != "" {
+				fmt.Fprintf(&body, ":%s:%s", exit.Username, exit.Password)
+			}
+			body.WriteString("\n")
+		}
+		c.String(200, body.String())
+	}
+}
@@ -0,0 +1,41 @@
+package coordinator
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"proxy-v6/internal/loadbalancer"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// settingEnableConnectProtocol is SETTINGS_ENABLE_CONNECT_PROTOCOL (RFC
+// 9220), telling clients they may send extended CONNECT.
+const settingEnableConnectProtocol = 0x08
+
+// startHTTP3Server serves CONNECT tunnels over QUIC on --http3-port, so
+// clients on lossy networks are spared TCP's head-of-line blocking up to
+// the coordinator. The legs to the exits stay TCP.
+func startHTTP3Server(lb *loadbalancer.LoadBalancer) {
+	if cfg.HTTP3Cert == "" || cfg.HTTP3Key == "" {
+		logger.Fatal("--http3-port requires --http3-cert and --http3-key")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.HTTP3Cert, cfg.HTTP3Key)
+	if err != nil {
+		logger.Fatalf("Failed to load the HTTP/3 certificate: %v", err)
+	}
+
+	server := &http3.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.HTTP3Port),
+		Handler: lb.HTTP3Handler(),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{cert},
+		}),
+		AdditionalSettings: map[uint64]uint64{settingEnableConnectProtocol: 1},
+	}
+	logger.Infof("Starting experimental HTTP/3 proxy server on UDP port %d", cfg.HTTP3Port)
+	if err := server.ListenAndServe(); err != nil {
+		logger.Fatalf("HTTP/3 proxy server error: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package coordinator
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"proxy-v6/internal/apikey"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// openAPIKeys loads the API key store when --api-keys-file is set. Without
+// it the API is left open, as before.
+func openAPIKeys() *apikey.Store {
+	if cfg.APIKeysFile == "" {
+		logger.Warn("Coordinator API is unauthenticated; set --api-keys-file to require API keys")
+		return nil
+	}
+
+	store, err := apikey.Open(cfg.APIKeysFile)
+	if err != nil {
+		logger.Fatalf("Failed to load API keys: %v", err)
+	}
+	keys, _ := store.List()
+	if len(keys) == 0 {
+		logger.Warnf("No API keys in %s; every API call will be rejected until one is created with 'coordinator keys create'", cfg.APIKeysFile)
+	} else {
+		logger.Infof("API key authentication enabled with %d keys", len(keys))
+	}
+	for _, k := range keys {
+		if k.Role == apikey.RoleAgent && k.NodeID == "" {
+			logger.Warnf("Agent key %s (%s) is not bound to a node and is rejected; create one per node with --node", k.ID, k.Name)
+		}
+	}
+	return store
+}
+
+func keysCommand() *cobra.Command {
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage coordinator API keys (in --api-keys-file)",
+	}
+
+	var name, role, tenant, nodeID string
+	createCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create an API key and print its token",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := keyStore()
+			if err != nil {
+				return err
+			}
+			key, token, err := store.Create(name, role, tenant, nodeID)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Created %s key %s (%s). The token is only shown once:\n", key.Role, key.ID, key.Name)
+			fmt.Println(token)
+			return nil
+		},
+	}
+	createCmd.Flags().StringVar(&name, "name", "", "Description of who uses the key")
+	createCmd.Flags().StringVar(&role, "role", apikey.RoleAdmin, "Key role: admin, readonly, agent, replica or tenant")
+	createCmd.Flags().StringVar(&tenant, "tenant", "", "Tenant whose exits, users and usage a tenant key sees")
+	createCmd.Flags().StringVar(&nodeID, "node", "", "Node an agent key reports for")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List API keys",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := keyStore()
+			if err != nil {
+				return err
+			}
+			keys, err := store.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tROLE\tTENANT\tNODE\tNAME\tCREATED")
+			for _, k := range keys {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Role, k.Tenant, k.NodeID, k.Name, k.CreatedAt.Format("2006-01-02 15:04:05"))
+			}
+			return w.Flush()
+		},
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an API key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := keyStore()
+			if err != nil {
+				return err
+			}
+			if err := store.Revoke(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("Revoked %s\n", args[0])
+			return nil
+		},
+	}
+
+	keysCmd.AddCommand(createCmd, listCmd, revokeCmd)
+	return keysCmd
+}
+
+func keyStore() (*apikey.Store, error) {
+	if configFile := viper.GetString("config"); configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+	path := viper.GetString("api-keys-file")
+	if path == "" {
+		return nil, fmt.Errorf("--api-keys-file is required")
+	}
+	return apikey.Open(path)
+}
@@ -0,0 +1,147 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const leaseSweepInterval = 10 * time.Second
+
+// restoreLeases brings back the leases that were still running before a
+// restart, so their exits do not rejoin the pool under their holders.
+func restoreLeases(lb *loadbalancer.LoadBalancer) error {
+	var saved []models.Lease
+	if _, err := ruleStore.GetRules(store.Leases, &saved); err != nil {
+		return fmt.Errorf("failed to load saved leases: %w", err)
+	}
+	lb.SetLeases(saved)
+	if running := lb.Leases(time.Now()); len(running) > 0 {
+		logger.Infof("Restored %d exit leases", len(running))
+	}
+	return nil
+}
+
+func saveLeases(lb *loadbalancer.LoadBalancer) {
+	if err := ruleStore.PutRules(store.Leases, lb.Leases(time.Now())); err != nil {
+		logger.Errorf("Failed to save exit leases: %v", err)
+	}
+}
+
+// expireLeases returns the exits of expired leases to the pool until ctx
+// is done.
+func expireLeases(ctx context.Context, lb *loadbalancer.LoadBalancer, trail *audit.Trail) {
+	ticker := time.NewTicker(leaseSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expired := lb.ExpireLeases(time.Now())
+		for _, lease := range expired {
+			trail.Record(audit.Entry{Event: "lease_expired", Detail: fmt.Sprintf("id=%s ip=%s holder=%s", lease.ID, lease.IP, lease.Holder)})
+		}
+		if len(expired) > 0 {
+			saveLeases(lb)
+		}
+	}
+}
+
+// respondLeaseError answers a failed lease call with the status its error
+// calls for.
+func respondLeaseError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, loadbalancer.ErrLeaseNotFound), errors.Is(err, loadbalancer.ErrLeaseBatchNotFound), errors.Is(err, loadbalancer.ErrUnknownExit):
+		apierror.Respond(c, 404, apierror.CodeNotFound, err)
+	case errors.Is(err, loadbalancer.ErrExitLeased):
+		apierror.Respond(c, 409, apierror.CodeConflict, err)
+	case errors.Is(err, loadbalancer.ErrNoExitToLease):
+		apierror.Respond(c, 503, apierror.CodeNoExitAvailable, err)
+	default:
+		apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+	}
+}
+
+// leaseBatchRoutes lease sets of exits guaranteed to differ in address,
+// /64 or node, for clients that need a fixed number of distinct identities.
+func leaseBatchRoutes(router *gin.Engine, lb *loadbalancer.LoadBalancer, auditTrail store.EventStore) {
+	router.POST("/api/lease-batches", func(c *gin.Context) {
+		var req models.LeaseBatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if req.Holder == "" {
+			req.Holder = c.ClientIP()
+		}
+		batch, err := lb.LeaseBatch(req, time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		saveLeases(lb)
+		auditTrail.Record(audit.Entry{Event: "lease_batch_created", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("id=%s ips=%s holder=%s expires=%s", batch.ID, batchIPs(batch), batch.Holder, batch.ExpiresAt.Format(time.RFC3339))})
+		c.JSON(201, batch)
+	})
+
+	router.GET("/api/lease-batches/:id", func(c *gin.Context) {
+		batch, err := lb.LeaseBatchByID(c.Param("id"), time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		if hideCredentials(c) {
+			batch.Leases = leasesWithoutCredentials(batch.Leases)
+		}
+		c.JSON(200, batch)
+	})
+
+	router.POST("/api/lease-batches/:id/renew", func(c *gin.Context) {
+		var req models.LeaseRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		batch, err := lb.RenewLeaseBatch(c.Param("id"), req.TTLSeconds, time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		saveLeases(lb)
+		auditTrail.Record(audit.Entry{Event: "lease_batch_renewed", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("id=%s expires=%s", batch.ID, batch.ExpiresAt.Format(time.RFC3339))})
+		c.JSON(200, batch)
+	})
+
+	router.DELETE("/api/lease-batches/:id", func(c *gin.Context) {
+		batch, err := lb.ReleaseLeaseBatch(c.Param("id"), time.Now())
+		if err != nil {
+			respondLeaseError(c, err)
+			return
+		}
+		saveLeases(lb)
+		auditTrail.Record(audit.Entry{Event: "lease_batch_released", ClientIP: c.ClientIP(), Detail: fmt.Sprintf("id=%s ips=%s", batch.ID, batchIPs(batch))})
+		c.JSON(200, gin.H{"status": "released", "leases": len(batch.Leases)})
+	})
+}
+
+func batchIPs(batch models.LeaseBatch) string {
+	ips := make([]string, 0, len(batch.Leases))
+	for _, lease := range batch.Leases {
+		ips = append(ips, lease.IP)
+	}
+	return strings.Join(ips, ",")
+}
@@ -0,0 +1,369 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultNodeReportMaxBytes   = 16 << 20
+	defaultNodeReportMaxProxies = 10000
+
+	// Field length limits. They are far above anything an agent sends and
+	// only keep a report from smuggling megabytes in a single string.
+	maxIDLength         = 128
+	maxHostnameLength   = 253
+	maxLabelLength      = 64 // region, interface, backend and instance names, tags, pools
+	maxURLLength        = 2048
+	maxPathLength       = 4096
+	maxCredentialLength = 256
+	maxTags             = 32
+
+	// advertisedURLLookupTimeout bounds resolving the host of an API URL
+	// an agent advertises.
+	advertisedURLLookupTimeout = 5 * time.Second
+
+	// maxNodeWeight is well above a weight measured in Mbit/s on a 100G
+	// link, so any capacity fits and sums of weights stay exact.
+	maxNodeWeight = 1000000
+)
+
+var nodeReports = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_node_reports_total",
+	Help: "Node reports by kind: full, delta, or resync_required for deltas refused as not following the stored report",
+}, []string{"kind"})
+
+// errReportTooLarge marks reports refused for their size rather than their
+// content.
+var errReportTooLarge = errors.New("node report too large")
+
+// errResyncRequired marks deltas that do not follow the last report the
+// coordinator has, which agents answer with a full report.
+var errResyncRequired = errors.New("resync required")
+
+// decodeNodeReport reads a node report of at most maxBytes, refusing
+// fields NodeInfo does not have and anything after the report.
+func decodeNodeReport(w http.ResponseWriter, r *http.Request, maxBytes int64) (models.NodeInfo, error) {
+	var node models.NodeInfo
+	err := decodeReport(w, r, maxBytes, &node)
+	return node, err
+}
+
+// decodeNodeDelta reads a delta report like decodeNodeReport.
+func decodeNodeDelta(w http.ResponseWriter, r *http.Request, maxBytes int64) (models.NodeDelta, error) {
+	var delta models.NodeDelta
+	err := decodeReport(w, r, maxBytes, &delta)
+	return delta, err
+}
+
+func decodeReport(w http.ResponseWriter, r *http.Request, maxBytes int64, report interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(report)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("unexpected data after the report")
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return fmt.Errorf("%w: body exceeds %d bytes", errReportTooLarge, maxBytes)
+		}
+		return fmt.Errorf("malformed node report: %w", err)
+	}
+	return nil
+}
+
+// applyNodeDelta returns the node as it is after delta. The delta must
+// directly follow the report stored as existing; a gap means a report was
+// lost and the node has to send everything again.
+func applyNodeDelta(existing models.NodeInfo, delta models.NodeDelta) (models.NodeInfo, error) {
+	if existing.Sequence == 0 || delta.Sequence != existing.Sequence+1 {
+		return existing, fmt.Errorf("%w: delta %d does not follow report %d", errResyncRequired, delta.Sequence, existing.Sequence)
+	}
+
+	proxies := make([]models.ProxyInstance, len(existing.Proxies), len(existing.Proxies)+len(delta.Changed))
+	copy(proxies, existing.Proxies)
+	index := make(map[string]int, len(proxies))
+	for i, p := range proxies {
+		index[p.ID] = i
+	}
+	for _, p := range delta.Changed {
+		if i, ok := index[p.ID]; ok {
+			proxies[i] = p
+		} else {
+			index[p.ID] = len(proxies)
+			proxies = append(proxies, p)
+		}
+	}
+	if len(delta.Removed) > 0 {
+		removed := make(map[string]bool, len(delta.Removed))
+		for _, id := range delta.Removed {
+			if _, ok := index[id]; !ok {
+				return existing, fmt.Errorf("%w: removed instance %q is not known", errResyncRequired, id)
+			}
+			removed[id] = true
+		}
+		kept := proxies[:0]
+		for _, p := range proxies {
+			if !removed[p.ID] {
+				kept = append(kept, p)
+			}
+		}
+		proxies = kept
+	}
+
+	node := existing
+	node.Hostname = delta.Hostname
+	node.Region = delta.Region
+	node.Capabilities = delta.Capabilities
+	node.APIURL = delta.APIURL
+	node.APIPort = delta.APIPort
+	node.APIToken = delta.APIToken
+	node.UpdatedAt = delta.UpdatedAt
+	node.Maintenance = delta.Maintenance
+	node.Weight = delta.Weight
+	node.Provider = delta.Provider
+	node.CostPerGB = delta.CostPerGB
+	node.Proxies = proxies
+	node.Sequence = delta.Sequence
+	return node, nil
+}
+
+// rejectNodeReport answers a report that was not applied.
+func rejectNodeReport(c *gin.Context, nodeID string, err error) {
+	switch {
+	case errors.Is(err, errResyncRequired):
+		logger.Infof("Asking node %q for a full report: %v", nodeID, err)
+		nodeReports.WithLabelValues("resync_required").Inc()
+		apierror.Respond(c, 409, apierror.CodeResyncRequired, err)
+	case errors.Is(err, errReportTooLarge):
+		logger.Warnf("Rejected report from node %q: %v", nodeID, err)
+		apierror.Respond(c, 413, apierror.CodeRequestTooLarge, err)
+	default:
+		logger.Warnf("Rejected report from node %q: %v", nodeID, err)
+		apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+	}
+}
+
+// prepareNodeReport fills in what the coordinator knows about a report
+// that was accepted from nodeID at clientIP.
+func prepareNodeReport(node *models.NodeInfo, nodeID, clientIP string, receivedAt time.Time, auditTrail store.EventStore) {
+	// Agents that don't advertise a URL are reached at the address they
+	// report from
+	if node.APIURL == "" && node.APIPort > 0 {
+		node.APIURL = fmt.Sprintf("http://%s", net.JoinHostPort(clientIP, strconv.Itoa(node.APIPort)))
+	}
+	node.NodeID = nodeID
+	takeAgentToken(node, nodeID)
+	// Staleness is judged by the coordinator's clock, whatever the agent's
+	// says
+	checkClockSkew(node, receivedAt, auditTrail)
+	node.UpdatedAt = receivedAt
+}
+
+// validateNodeReport checks a decoded report for nodeID. Errors name the
+// offending field, e.g. "proxies[3].port: must be between 1 and 65535".
+func validateNodeReport(nodeID string, node *models.NodeInfo, maxProxies int) error {
+	if err := checkText(nodeID, maxIDLength, true); err != nil {
+		return fmt.Errorf("node ID: %w", err)
+	}
+	if node.NodeID != "" && node.NodeID != nodeID {
+		return fmt.Errorf("node_id: %q does not match node %q in the URL", node.NodeID, nodeID)
+	}
+	if len(node.Proxies) > maxProxies {
+		return fmt.Errorf("%w: %d proxies, at most %d are accepted", errReportTooLarge, len(node.Proxies), maxProxies)
+	}
+
+	fields := []textField{
+		{"hostname", node.Hostname, maxHostnameLength, false},
+		{"region", node.Region, maxLabelLength, false},
+		{"api_url", node.APIURL, maxURLLength, false},
+		{"api_token", node.APIToken, maxCredentialLength, false},
+		{"provider", node.Provider, maxLabelLength, false},
+	}
+	if node.Capabilities != nil {
+		fields = append(fields, textField{"capabilities.backend", node.Capabilities.Backend, maxLabelLength, false})
+		if node.Capabilities.MaxClients < 0 {
+			return errors.New("capabilities.max_clients: must not be negative")
+		}
+	}
+	if err := checkTexts(fields); err != nil {
+		return err
+	}
+	if node.APIURL != "" {
+		if err := checkHTTPURL(node.APIURL); err != nil {
+			return fmt.Errorf("api_url: %w", err)
+		}
+	}
+	if node.APIPort < 0 || node.APIPort > 65535 {
+		return errors.New("api_port: must be between 0 and 65535")
+	}
+	if node.Weight < 0 || node.Weight > maxNodeWeight {
+		return fmt.Errorf("weight: must be between 0 and %d", maxNodeWeight)
+	}
+	if node.CostPerGB != nil && *node.CostPerGB < 0 {
+		return errors.New("cost_per_gb: must not be negative")
+	}
+
+	seen := make(map[string]bool, len(node.Proxies))
+	for i := range node.Proxies {
+		if err := validateReportedProxy(&node.Proxies[i]); err != nil {
+			return fmt.Errorf("proxies[%d].%w", i, err)
+		}
+		id := node.Proxies[i].ID
+		if seen[id] {
+			return fmt.Errorf("proxies[%d].id: duplicate instance %q", i, id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// validateReportedProxy returns errors starting with the field name, for
+// validateNodeReport to prefix with the proxy's index.
+func validateReportedProxy(p *models.ProxyInstance) error {
+	texts := []textField{
+		{"id", p.ID, maxIDLength, true},
+		{"name", p.Name, maxLabelLength, false},
+		{"ipv6.interface", p.IPv6.Interface, maxLabelLength, false},
+		{"backend", p.Backend, maxLabelLength, false},
+		{"config_path", p.ConfigPath, maxPathLength, false},
+		{"status_url", p.StatusURL, maxURLLength, false},
+		{"username", p.Username, maxCredentialLength, false},
+		{"password", p.Password, maxCredentialLength, false},
+	}
+	if len(p.Tags) > maxTags {
+		return fmt.Errorf("tags: %d tags, at most %d are accepted", len(p.Tags), maxTags)
+	}
+	for i, tag := range p.Tags {
+		texts = append(texts, textField{fmt.Sprintf("tags[%d]", i), tag, maxLabelLength, true})
+	}
+	if len(p.Pools) > maxTags {
+		return fmt.Errorf("pools: %d pools, at most %d are accepted", len(p.Pools), maxTags)
+	}
+	for i, pool := range p.Pools {
+		texts = append(texts, textField{fmt.Sprintf("pools[%d]", i), pool, maxLabelLength, true})
+	}
+	if err := checkTexts(texts); err != nil {
+		return err
+	}
+
+	if p.IPv6.IP == nil {
+		return errors.New("ipv6.ip: required")
+	}
+	if p.Port < 1 || p.Port > 65535 {
+		return errors.New("port: must be between 1 and 65535")
+	}
+	switch p.Status {
+	case models.ProxyStatusStarting, models.ProxyStatusRunning, models.ProxyStatusStopped, models.ProxyStatusError, models.ProxyStatusQuotaExceeded, models.ProxyStatusPaused:
+	default:
+		return fmt.Errorf("status: unknown status %q", p.Status)
+	}
+	switch p.Protocol {
+	case "", models.ProxyProtocolHTTP, models.ProxyProtocolSOCKS5:
+	default:
+		return fmt.Errorf("protocol: unknown protocol %q", p.Protocol)
+	}
+	return nil
+}
+
+type textField struct {
+	name     string
+	value    string
+	max      int
+	required bool
+}
+
+func checkTexts(fields []textField) error {
+	for _, f := range fields {
+		if err := checkText(f.value, f.max, f.required); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// checkText enforces a length limit on s and keeps control characters out
+// of values that end up in logs and metric labels.
+func checkText(s string, max int, required bool) error {
+	if s == "" {
+		if required {
+			return errors.New("required")
+		}
+		return nil
+	}
+	if len(s) > max {
+		return fmt.Errorf("longer than %d bytes", max)
+	}
+	if strings.IndexFunc(s, unicode.IsControl) >= 0 {
+		return errors.New("contains control characters")
+	}
+	return nil
+}
+
+// checkAdvertisedURL makes sure an API URL an agent advertises points back
+// at the address it reports from, by IP or by a name resolving to it, so a
+// node key cannot aim the coordinator's calls at other hosts.
+func checkAdvertisedURL(apiURL, clientIP string) error {
+	if apiURL == "" {
+		return nil
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return fmt.Errorf("api_url: %w", err)
+	}
+	source := net.ParseIP(clientIP)
+	if source == nil {
+		return fmt.Errorf("api_url: report source %q is not an IP address", clientIP)
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.Equal(source) {
+			return fmt.Errorf("api_url: %s is not the address %s the report came from", host, clientIP)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), advertisedURLLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("api_url: %w", err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(source) {
+			return nil
+		}
+	}
+	return fmt.Errorf("api_url: %s does not resolve to the address %s the report came from", host, clientIP)
+}
+
+func checkHTTPURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an http or https URL")
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/apikey"
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/eventstream"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultReplicaInterval = 5 * time.Second
+
+var replicaSyncFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "proxy_v6_replica_sync_failures_total",
+	Help: "Failed attempts of a read replica to copy the primary coordinator's state.",
+})
+
+// replicaLocalRoutes change only state of the replica itself, so they stay
+// writable: draining it, closing its tunnels and forgetting the bans and
+// ejections it learned from its own traffic. Validating a config changes
+// nothing at all.
+var replicaLocalRoutes = map[string]bool{
+	"/api/drain":           true,
+	"/api/tunnels/:id":     true,
+	"/api/bans":            true,
+	"/api/bans/import":     true,
+	"/api/outliers":        true,
+	"/api/config/validate": true,
+}
+
+// replication is set when the coordinator runs as a read replica.
+var replication *replica
+
+// replica copies the primary coordinator's state every interval and serves
+// the proxy port and read APIs from it.
+type replica struct {
+	primary       string
+	client        *http.Client
+	lb            *loadbalancer.LoadBalancer
+	authenticator *auth.Authenticator
+	applied       *models.ReplicationState // last state copied
+	lastSync      time.Time
+	lastErr       error
+	mu            sync.Mutex
+}
+
+func newReplica(primary string, transport http.RoundTripper, lb *loadbalancer.LoadBalancer, authenticator *auth.Authenticator) *replica {
+	r := &replica{
+		primary:       strings.TrimRight(primary, "/"),
+		client:        &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		lb:            lb,
+		authenticator: authenticator,
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_v6_replica_lag_seconds",
+		Help: "Seconds since a read replica last copied the primary coordinator's state.",
+	}, func() float64 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.lastSync.IsZero() {
+			return 0
+		}
+		return time.Since(r.lastSync).Seconds()
+	})
+	return r
+}
+
+func (r *replica) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := r.sync()
+		r.mu.Lock()
+		recovered := r.lastErr != nil && err == nil
+		if err == nil {
+			r.lastSync = time.Now()
+		}
+		r.lastErr = err
+		r.mu.Unlock()
+		switch {
+		case err != nil:
+			replicaSyncFailures.Inc()
+			logger.Errorf("Failed to copy state from %s: %v", r.primary, err)
+		case recovered:
+			logger.Infof("Copying state from %s again", r.primary)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync fetches the primary's state and applies it.
+func (r *replica) sync() error {
+	req, err := http.NewRequest(http.MethodGet, r.primary+apikey.ReplicationRoute, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.ReplicaAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.ReplicaAPIKey)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("primary returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var state models.ReplicationState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return fmt.Errorf("invalid state from primary: %w", err)
+	}
+	return r.apply(&state)
+}
+
+// apply makes the replica serve state. Rules and policies are only set
+// again when they changed, since setting them is logged.
+func (r *replica) apply(state *models.ReplicationState) error {
+	prev := r.applied
+	if prev == nil {
+		prev = &models.ReplicationState{}
+	}
+	changed := func(a, b interface{}) bool { return r.applied == nil || !reflect.DeepEqual(a, b) }
+
+	if changed(prev.Users, state.Users) {
+		if err := r.authenticator.Replace(state.Users); err != nil {
+			return err
+		}
+		logger.Infof("Copied %d users from the primary", len(state.Users))
+	}
+	if changed(prev.BanRules, state.BanRules) {
+		r.lb.SetBanRules(state.BanRules)
+	}
+	if changed(prev.RewriteRules, state.RewriteRules) {
+		r.lb.SetRewriteRules(state.RewriteRules)
+	}
+	if changed(prev.ReuseRules, state.ReuseRules) {
+		if err := r.lb.SetReuseRules(state.ReuseRules); err != nil {
+			return err
+		}
+	}
+	if changed(prev.PrefixOrigins, state.PrefixOrigins) {
+		if err := r.lb.SetPrefixOrigins(state.PrefixOrigins); err != nil {
+			return err
+		}
+	}
+	if changed(prev.Pools, state.Pools) {
+		if err := r.lb.SetPools(state.Pools); err != nil {
+			return err
+		}
+	}
+	if changed(prev.Tenants, state.Tenants) {
+		if err := r.lb.SetTenants(state.Tenants); err != nil {
+			return err
+		}
+	}
+	if changed(prev.ContentPolicy, state.ContentPolicy) {
+		if err := r.lb.SetContentPolicy(state.ContentPolicy); err != nil {
+			return err
+		}
+	}
+	if changed(prev.OutlierPolicy, state.OutlierPolicy) {
+		if err := r.lb.SetOutlierPolicy(state.OutlierPolicy); err != nil {
+			return err
+		}
+	}
+	if changed(prev.Quarantined, state.Quarantined) {
+		r.lb.SetQuarantinedExits(state.Quarantined)
+	}
+	if changed(prev.Leases, state.Leases) {
+		r.lb.SetLeases(state.Leases)
+	}
+	// Check times and expiries move with every copy, and nothing is
+	// logged
+	r.lb.SetSharedHealth(state.ExitHealth)
+	r.lb.MergeStickySessions(state.StickySessions, time.Now())
+
+	if err := r.replaceNodes(state.Nodes); err != nil {
+		return err
+	}
+	if changed(prev.Nodes, state.Nodes) {
+		updateLoadBalancer(r.lb)
+	}
+
+	// After the pool update, which drains nodes reporting maintenance on
+	// its own, so the replica ends up with exactly the primary's drains
+	drain := make(map[string]bool, len(state.DrainedNodes))
+	for _, nodeID := range state.DrainedNodes {
+		drain[nodeID] = true
+		r.lb.DrainNode(nodeID)
+	}
+	for _, nodeID := range r.lb.DrainedNodes() {
+		if !drain[nodeID] {
+			r.lb.UndrainNode(nodeID)
+		}
+	}
+
+	r.applied = state
+	return nil
+}
+
+// replaceNodes makes the node store hold exactly the primary's nodes.
+func (r *replica) replaceNodes(primaryNodes []models.NodeInfo) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Diffed like reports, so clients can stream events from a replica
+	stored := make(map[string]models.NodeInfo)
+	for _, node := range nodeList() {
+		stored[node.NodeID] = node
+	}
+	current := make(map[string]bool, len(primaryNodes))
+	for _, node := range primaryNodes {
+		current[node.NodeID] = true
+		if err := nodes.PutNode(node); err != nil {
+			return fmt.Errorf("failed to store node %s: %w", node.NodeID, err)
+		}
+		var previous *models.NodeInfo
+		if existing, ok := stored[node.NodeID]; ok {
+			previous = &existing
+		}
+		publishNodeChanges(previous, node)
+	}
+	for _, node := range stored {
+		if current[node.NodeID] {
+			continue
+		}
+		if err := nodes.DeleteNode(node.NodeID); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("failed to remove node %s: %w", node.NodeID, err)
+		}
+		forgetClockSkew(node.NodeID)
+		clusterEvents.Publish(eventstream.NodeLeft(node.NodeID, "left the primary"))
+	}
+	return nil
+}
+
+// synced reports whether the replica has copied the primary's state at
+// least once.
+func (r *replica) synced() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.lastSync.IsZero()
+}
+
+func (r *replica) status() models.ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := models.ReplicationStatus{Role: "replica", Primary: r.primary}
+	if !r.lastSync.IsZero() {
+		lastSync := r.lastSync
+		status.LastSync = &lastSync
+		status.LagSeconds = time.Since(r.lastSync).Round(time.Millisecond).Seconds()
+	}
+	if r.lastErr != nil {
+		status.LastError = r.lastErr.Error()
+	}
+	if r.applied != nil {
+		status.Nodes = len(r.applied.Nodes)
+	}
+	return status
+}
+
+// readOnly refuses every call that would change replicated state.
+func readOnly(primary string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if replicaLocalRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		apierror.RespondMessage(c, http.StatusForbidden, apierror.CodeReadOnly, "this coordinator is a read replica, send changes to "+primary)
+	}
+}
+
+// replicationState gathers what read replicas copy.
+// Nodes are sorted so replicas can tell when they changed.
+func replicationState(lb *loadbalancer.LoadBalancer, authenticator *auth.Authenticator) models.ReplicationState {
+	current := nodeList()
+	sort.Slice(current, func(i, j int) bool { return current[i].NodeID < current[j].NodeID })
+	return models.ReplicationState{
+		GeneratedAt:    time.Now(),
+		Nodes:          current,
+		Users:          authenticator.Export(),
+		DrainedNodes:   lb.DrainedNodes(),
+		Quarantined:    lb.QuarantinedExits(),
+		Leases:         lb.Leases(time.Now()),
+		StickySessions: lb.StickySessions(time.Now()),
+		BanRules:       lb.BanRules(),
+		RewriteRules:   lb.RewriteRules(),
+		ReuseRules:     lb.ReuseRules(),
+		PrefixOrigins:  lb.PrefixOrigins(),
+		Pools:          lb.Pools(),
+		Tenants:        lb.Tenants(),
+		ContentPolicy:  lb.ContentPolicy(),
+		OutlierPolicy:  lb.OutlierPolicy(),
+		ExitHealth:     lb.HealthResults(),
+	}
+}
@@ -0,0 +1,54 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+)
+
+const stickySaveInterval = 30 * time.Second
+
+// restoreStickySessions brings back the sticky-client sessions saved
+// before a restart, so clients keep their exits.
+func restoreStickySessions(lb *loadbalancer.LoadBalancer) error {
+	var saved []models.StickySession
+	if _, err := ruleStore.GetRules(store.StickySessions, &saved); err != nil {
+		return fmt.Errorf("failed to load saved sticky sessions: %w", err)
+	}
+	lb.SetStickySessions(saved, time.Now())
+	if live := lb.StickySessions(time.Now()); len(live) > 0 {
+		logger.Infof("Restored %d sticky sessions", len(live))
+	}
+	return nil
+}
+
+// saveStickySessions stores the live sessions once they changed.
+func saveStickySessions(lb *loadbalancer.LoadBalancer) {
+	sessions, changed := lb.StickyState(time.Now())
+	if !changed {
+		return
+	}
+	if err := ruleStore.PutRules(store.StickySessions, sessions); err != nil {
+		logger.Errorf("Failed to save sticky sessions: %v", err)
+	}
+}
+
+// persistStickySessions saves the sticky sessions every
+// stickySaveInterval until ctx is done.
+func persistStickySessions(ctx context.Context, lb *loadbalancer.LoadBalancer) {
+	ticker := time.NewTicker(stickySaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveStickySessions(lb)
+		}
+	}
+}
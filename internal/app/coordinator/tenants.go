@@ -0,0 +1,58 @@
+package coordinator
+
+import (
+	"proxy-v6/internal/apikey"
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/ledger"
+	"proxy-v6/internal/loadbalancer"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantStatus adds to tenant its exits, its users and the requests they
+// sent.
+func tenantStatus(lb *loadbalancer.LoadBalancer, authenticator *auth.Authenticator, usage store.UsageStore, tenant models.Tenant) models.TenantStatus {
+	status := models.TenantStatus{Tenant: tenant}
+	status.Exits, status.Healthy = lb.TenantExitCounts(tenant.Name)
+	status.Users = len(tenantUsers(authenticator.Users(), tenant.Name))
+	if entries, err := usage.Query(ledger.Query{Tenant: tenant.Name}); err == nil {
+		for _, e := range entries {
+			status.Requests += e.Requests
+		}
+	}
+	return status
+}
+
+// tenantUsers keeps the users of tenant.
+func tenantUsers(users []models.User, tenant string) []models.User {
+	kept := []models.User{}
+	for _, u := range users {
+		if u.Tenant == tenant {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// userTenant returns the tenant of the named user, "" for a user shared
+// by all tenants.
+func userTenant(users []models.User, username string) (tenant string, found bool) {
+	for _, u := range users {
+		if u.Username == username {
+			return u.Tenant, true
+		}
+	}
+	return "", false
+}
+
+// scopeTenant returns the tenant whose exits a request may see: a tenant
+// key's own, or the one an admin asks for with ?tenant=. ok is false when
+// every exit may be seen.
+func scopeTenant(c *gin.Context) (tenant string, ok bool) {
+	if tenant := apikey.Tenant(c); tenant != "" {
+		return tenant, true
+	}
+	return c.GetQuery("tenant")
+}
@@ -0,0 +1,56 @@
+package coordinator
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/traffic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults of GET /api/traffic.
+const (
+	defaultTrafficMinutes = 15
+	defaultTrafficStep    = traffic.Step
+)
+
+// trafficRoutes serve the recent request rate and bandwidth through the
+// coordinator, for graphs such as the monitor's sparklines.
+func trafficRoutes(router *gin.Engine, recorder *traffic.Recorder) {
+	router.GET("/api/traffic", func(c *gin.Context) {
+		span, step, err := parseTrafficQuery(c)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		c.JSON(200, recorder.Series(span, step, c.Query("node"), time.Now()))
+	})
+}
+
+// parseTrafficQuery reads minutes, how far back the series goes, and
+// step_seconds, how much traffic each point sums up.
+func parseTrafficQuery(c *gin.Context) (span, step time.Duration, err error) {
+	minutes := defaultTrafficMinutes
+	if raw := c.Query("minutes"); raw != "" {
+		minutes, err = strconv.Atoi(raw)
+		if err != nil || minutes < 1 || time.Duration(minutes)*time.Minute > traffic.Window {
+			return 0, 0, fmt.Errorf("minutes must be between 1 and %d", int(traffic.Window/time.Minute))
+		}
+	}
+	step = defaultTrafficStep
+	if raw := c.Query("step_seconds"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		step = time.Duration(seconds) * time.Second
+		if err != nil || step < traffic.Step || step%traffic.Step != 0 {
+			return 0, 0, fmt.Errorf("step_seconds must be a multiple of %d", int(traffic.Step/time.Second))
+		}
+	}
+	span = time.Duration(minutes) * time.Minute
+	if step > span {
+		return 0, 0, fmt.Errorf("step_seconds must not exceed the %d minutes asked for", minutes)
+	}
+	return span, step, nil
+}
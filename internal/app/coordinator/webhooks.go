@@ -0,0 +1,74 @@
+package coordinator
+
+import (
+	"fmt"
+	"strconv"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/store"
+	"proxy-v6/internal/webhook"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookRoutes manage the webhooks cluster events are posted to and show
+// how their deliveries went. Secrets are never sent back.
+func webhookRoutes(router *gin.Engine, dispatcher *webhook.Dispatcher, auditTrail store.EventStore) {
+	router.GET("/api/webhooks", func(c *gin.Context) {
+		c.JSON(200, dispatcher.Statuses())
+	})
+
+	router.GET("/api/webhooks/:name", func(c *gin.Context) {
+		status, ok := dispatcher.Status(c.Param("name"))
+		if !ok {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, fmt.Sprintf("webhook %s not found", c.Param("name")))
+			return
+		}
+		c.JSON(200, status)
+	})
+
+	router.GET("/api/webhooks/:name/deliveries", func(c *gin.Context) {
+		name := c.Param("name")
+		if _, ok := dispatcher.Status(name); !ok {
+			apierror.RespondMessage(c, 404, apierror.CodeNotFound, fmt.Sprintf("webhook %s not found", name))
+			return
+		}
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		c.JSON(200, dispatcher.Deliveries(name, c.Query("status"), limit))
+	})
+
+	// Add a webhook or replace the one with its name
+	router.POST("/api/webhooks", func(c *gin.Context) {
+		var hook models.Webhook
+		if err := c.ShouldBindJSON(&hook); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := dispatcher.SetWebhook(hook); err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.Webhooks, dispatcher.Webhooks()); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "webhook_updated", ClientIP: c.ClientIP(), Detail: hook.Name})
+		c.JSON(200, gin.H{"status": "updated"})
+	})
+
+	router.DELETE("/api/webhooks/:name", func(c *gin.Context) {
+		name := c.Param("name")
+		if err := dispatcher.DeleteWebhook(name); err != nil {
+			apierror.Respond(c, 404, apierror.CodeNotFound, err)
+			return
+		}
+		if err := ruleStore.PutRules(store.Webhooks, dispatcher.Webhooks()); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		auditTrail.Record(audit.Entry{Event: "webhook_deleted", ClientIP: c.ClientIP(), Detail: name})
+		c.JSON(200, gin.H{"status": "deleted"})
+	})
+}
@@ -0,0 +1,181 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/pkg/models"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	// commandTimeout bounds the wait for an agent to carry out a command,
+	// which for restarts and rotations includes starting the proxy.
+	commandTimeout      = 2 * time.Minute
+	commandPollInterval = 500 * time.Millisecond
+)
+
+// action is a change to the cluster waiting to be confirmed.
+type action struct {
+	prompt   string // asked before running it
+	progress string // shown while it runs
+	run      tea.Cmd
+}
+
+// actionMsg reports how an action went.
+type actionMsg struct {
+	text string
+	err  error
+}
+
+// prepare asks for confirmation of the action bound to key. Drains act on
+// the selected node, or the node drilled into; the others on the selected
+// exit of the proxy table.
+func (m *model) prepare(key string) {
+	if m.running {
+		m.status, m.statusErr = "Wait for the running action to finish", true
+		return
+	}
+	if key == "d" {
+		node, ok := m.actionNode()
+		if !ok {
+			m.status, m.statusErr = "No node selected", true
+			return
+		}
+		path := "/api/nodes/" + url.PathEscape(node.NodeID) + "/drain"
+		if node.Draining {
+			m.pending = &action{
+				prompt:   fmt.Sprintf("Return node %s to rotation?", node.NodeID),
+				progress: fmt.Sprintf("Returning node %s to rotation...", node.NodeID),
+				run:      m.call(http.MethodDelete, path, fmt.Sprintf("Node %s returned to rotation", node.NodeID)),
+			}
+			return
+		}
+		m.pending = &action{
+			prompt:   fmt.Sprintf("Drain node %s? It gets no new requests or tunnels.", node.NodeID),
+			progress: fmt.Sprintf("Draining node %s...", node.NodeID),
+			run:      m.call(http.MethodPost, path, fmt.Sprintf("Node %s drained", node.NodeID)),
+		}
+		return
+	}
+
+	if m.detail == "" {
+		m.status, m.statusErr = "Press 'enter' to pick an exit of the node first", true
+		return
+	}
+	proxy, ok := m.selectedProxy()
+	if !ok {
+		m.status, m.statusErr = "No exit selected", true
+		return
+	}
+	name := proxy.Name
+	if name == "" {
+		name = proxy.ID
+	}
+	var cmdType, verb, done string
+	switch key {
+	case "x":
+		cmdType, verb, done = models.CommandStopProxy, "Stop", "stopped"
+	case "R":
+		cmdType, verb, done = models.CommandRestartProxy, "Restart", "restarted"
+	case "i":
+		cmdType, verb, done = models.CommandRotateIP, "Rotate the address of", "rotated"
+	}
+	m.pending = &action{
+		prompt:   fmt.Sprintf("%s %s on %s?", verb, name, m.detail),
+		progress: fmt.Sprintf("Sending %s for %s...", cmdType, name),
+		run:      m.nodeCommand(m.detail, models.NodeCommand{Type: cmdType, InstanceID: proxy.ID}, fmt.Sprintf("%s %s", name, done)),
+	}
+}
+
+// actionLine shows the confirmation prompt, or how the last action went.
+func (m model) actionLine() string {
+	switch {
+	case m.pending != nil:
+		return lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("214")).
+			Render(m.pending.prompt+" [y/N]") + "\n"
+	case m.status == "":
+		return ""
+	case m.statusErr:
+		return lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Render(m.status) + "\n"
+	}
+	return lipgloss.NewStyle().Foreground(lipgloss.Color("78")).Render(m.status) + "\n"
+}
+
+// actionNode is the node drains act on.
+func (m model) actionNode() (models.NodeInfo, bool) {
+	if m.detail != "" {
+		return m.detailNode()
+	}
+	return m.selectedNode()
+}
+
+// call sends a request without a body to the coordinator API.
+func (m model) call(method, path, done string) tea.Cmd {
+	return func() tea.Msg {
+		client := &http.Client{Timeout: 10 * time.Second, Transport: m.transport}
+		resp, err := m.request(client, method, path, nil)
+		if err != nil {
+			return actionMsg{err: err}
+		}
+		resp.Body.Close()
+		return actionMsg{text: done}
+	}
+}
+
+// nodeCommand queues cmd for nodeID over the command channel and waits
+// for its agent to report the result.
+func (m model) nodeCommand(nodeID string, cmd models.NodeCommand, done string) tea.Cmd {
+	return func() tea.Msg {
+		client := &http.Client{Timeout: 10 * time.Second, Transport: m.transport}
+		path := "/api/nodes/" + url.PathEscape(nodeID) + "/commands"
+		resp, err := m.request(client, http.MethodPost, path, cmd)
+		if err != nil {
+			return actionMsg{err: err}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&cmd)
+		resp.Body.Close()
+		if err != nil {
+			return actionMsg{err: err}
+		}
+
+		deadline := time.Now().Add(commandTimeout)
+		for cmd.Status == models.CommandQueued || cmd.Status == models.CommandDelivered {
+			if time.Now().After(deadline) {
+				return actionMsg{err: fmt.Errorf("%s %s is still %s after %s", cmd.Type, cmd.ID, cmd.Status, commandTimeout)}
+			}
+			time.Sleep(commandPollInterval)
+			resp, err := m.get(client, path+"/"+url.PathEscape(cmd.ID))
+			if err != nil {
+				return actionMsg{err: err}
+			}
+			err = json.NewDecoder(resp.Body).Decode(&cmd)
+			resp.Body.Close()
+			if err != nil {
+				return actionMsg{err: err}
+			}
+		}
+		if cmd.Status != models.CommandSucceeded {
+			return actionMsg{err: fmt.Errorf("%s %s: %s", cmd.Type, cmd.Status, commandError(cmd))}
+		}
+		return actionMsg{text: done}
+	}
+}
+
+// commandError describes why a command did not succeed.
+func commandError(cmd models.NodeCommand) string {
+	if cmd.Result == nil {
+		return "the agent did not fetch it"
+	}
+	var apiErr apierror.Error
+	if err := json.Unmarshal(cmd.Result.Body, &apiErr); err == nil && apiErr.Message != "" {
+		return apiErr.Message
+	}
+	return fmt.Sprintf("agent returned %d", cmd.Result.StatusCode)
+}
@@ -0,0 +1,107 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// reconnectDelay is how long the monitor waits before subscribing again
+// after the event stream broke.
+const reconnectDelay = 5 * time.Second
+
+// streamMsg reports that the event stream connected or broke.
+type streamMsg struct {
+	connected bool
+}
+
+// eventMsg is one event from the coordinator's stream.
+type eventMsg models.ClusterEvent
+
+func waitForStream(stream <-chan tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		return <-stream
+	}
+}
+
+// subscribe follows the coordinator's event stream for as long as the
+// monitor runs, reconnecting where it left off. Against a coordinator
+// without the stream it keeps trying, and the monitor keeps polling.
+func (m model) subscribe(stream chan<- tea.Msg) {
+	// No timeout, the response never ends
+	client := &http.Client{Transport: m.transport}
+	var lastID uint64
+	for {
+		m.follow(client, &lastID, func(msg tea.Msg) { stream <- msg })
+		stream <- streamMsg{connected: false}
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// follow reads the stream until it breaks, passing each event on and
+// moving lastID along.
+func (m model) follow(client *http.Client, lastID *uint64, send func(tea.Msg)) {
+	req, err := http.NewRequest(http.MethodGet, m.coordinatorURL+"/api/events", nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(*lastID, 10))
+	}
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	send(streamMsg{connected: true})
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		case line == "" && len(data) > 0:
+			var event models.ClusterEvent
+			if err := json.Unmarshal(data, &event); err == nil {
+				*lastID = event.ID
+				send(eventMsg(event))
+			}
+			data = data[:0]
+		}
+	}
+}
+
+// recentEvents lists the latest events, oldest first.
+func recentEvents(events []models.ClusterEvent) string {
+	lines := []string{"Recent events:"}
+	for _, event := range events {
+		subject := event.NodeID
+		if event.Address != "" {
+			subject += " " + event.Address
+		}
+		detail := event.Reason
+		if event.Status != "" || event.PreviousStatus != "" {
+			detail = strings.TrimSpace(fmt.Sprintf("%s -> %s %s", event.PreviousStatus, event.Status, detail))
+		}
+		lines = append(lines, fmt.Sprintf("  %s %-15s %s %s", event.Time.Local().Format("15:04:05"), event.Type, subject, detail))
+	}
+	return strings.Join(lines, "\n")
+}
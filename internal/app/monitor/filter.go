@@ -0,0 +1,289 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/charmbracelet/bubbles/table"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Filters cycled through with 'f'.
+const (
+	filterAll     = ""
+	filterStale   = "stale"   // nodes that missed reports
+	filterErrored = "errored" // exits in error or with failed requests, nodes with such exits
+)
+
+var (
+	nodeFilters  = []string{filterAll, filterStale, filterErrored}
+	proxyFilters = []string{filterAll, filterErrored}
+)
+
+// defaultStaleAfter is two missed reports at the agent's default interval.
+const defaultStaleAfter = time.Minute
+
+// sortColumn orders the rows of a table by the column titled column.
+type sortColumn[T any] struct {
+	column string
+	less   func(a, b T) bool
+}
+
+var nodeSorts = []sortColumn[models.NodeInfo]{
+	{"Node ID", func(a, b models.NodeInfo) bool { return a.NodeID < b.NodeID }},
+	{"Proxies", func(a, b models.NodeInfo) bool { return len(a.Proxies) < len(b.Proxies) }},
+	{"Running", func(a, b models.NodeInfo) bool { return runningProxies(a) < runningProxies(b) }},
+	{"State", func(a, b models.NodeInfo) bool { return nodeState(a) < nodeState(b) }},
+	{"Last Update", func(a, b models.NodeInfo) bool { return a.UpdatedAt.Before(b.UpdatedAt) }},
+}
+
+var proxySorts = []sortColumn[models.ProxyInstance]{
+	{"Name", func(a, b models.ProxyInstance) bool { return proxyName(a) < proxyName(b) }},
+	{"Status", func(a, b models.ProxyInstance) bool { return a.Status < b.Status }},
+	// Longest up last, like the other columns' largest values
+	{"Uptime", func(a, b models.ProxyInstance) bool { return a.StartedAt.After(b.StartedAt) }},
+	{"Requests", func(a, b models.ProxyInstance) bool { return a.Metrics.RequestsTotal < b.Metrics.RequestsTotal }},
+	{"Bytes", func(a, b models.ProxyInstance) bool { return a.Metrics.BytesTransmitted < b.Metrics.BytesTransmitted }},
+	{"Errors", func(a, b models.ProxyInstance) bool { return a.Metrics.ErrorCount < b.Metrics.ErrorCount }},
+}
+
+// view is how one table is searched, filtered and sorted.
+type view struct {
+	query  string
+	filter int // into nodeFilters or proxyFilters
+	sort   int // into nodeSorts or proxySorts
+	desc   bool
+}
+
+// sorted orders rows by sorts[v.sort], falling back to id.
+func sorted[T any](rows []T, v view, sorts []sortColumn[T], id func(T) string) []T {
+	less := sorts[v.sort].less
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if v.desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return id(rows[i]) < id(rows[j])
+	})
+	return rows
+}
+
+// markSorted shows the sort order in the title of the sorted column.
+func markSorted(columns []table.Column, column string, desc bool) {
+	for i := range columns {
+		if columns[i].Title == column {
+			if desc {
+				columns[i].Title += " ▼"
+			} else {
+				columns[i].Title += " ▲"
+			}
+		}
+	}
+}
+
+// visibleNodes returns the nodes the node table shows, in order.
+func (m model) visibleNodes() []models.NodeInfo {
+	var nodes []models.NodeInfo
+	now := time.Now()
+	for _, node := range m.nodes {
+		switch nodeFilters[m.nodeView.filter] {
+		case filterStale:
+			if now.Sub(node.UpdatedAt) < m.staleAfter {
+				continue
+			}
+		case filterErrored:
+			if !nodeErrored(node) {
+				continue
+			}
+		}
+		if m.nodeView.query != "" && !nodeMatches(node, m.nodeView.query) {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return sorted(nodes, m.nodeView, nodeSorts, func(n models.NodeInfo) string { return n.NodeID })
+}
+
+// detailProxies returns the exits of the detail node the proxy table
+// shows, in order.
+func (m model) detailProxies() []models.ProxyInstance {
+	node, _ := m.detailNode()
+	var proxies []models.ProxyInstance
+	for _, proxy := range node.Proxies {
+		if proxyFilters[m.proxyView.filter] == filterErrored && !proxyErrored(proxy) {
+			continue
+		}
+		if m.proxyView.query != "" && !proxyMatches(proxy, m.proxyView.query) {
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	return sorted(proxies, m.proxyView, proxySorts, func(p models.ProxyInstance) string { return p.ID })
+}
+
+// nodeMatches reports whether query is in the node's ID, hostname, region,
+// backend or tags, or the name or address of one of its exits, ignoring
+// case, so nodes can be found by the exits they carry.
+func nodeMatches(node models.NodeInfo, query string) bool {
+	fields := []string{node.NodeID, node.Hostname, node.Region, nodeBackend(node)}
+	fields = append(fields, nodeTags(node)...)
+	if contains(fields, query) {
+		return true
+	}
+	for _, proxy := range node.Proxies {
+		if contains([]string{proxy.ID, proxy.Name, proxy.IPv6.IP.String()}, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyMatches reports whether query is in the exit's ID, name, address,
+// status, tags or pools, ignoring case.
+func proxyMatches(proxy models.ProxyInstance, query string) bool {
+	fields := []string{proxy.ID, proxy.Name, proxy.IPv6.IP.String(), string(proxy.Status)}
+	fields = append(fields, proxy.Tags...)
+	fields = append(fields, proxy.Pools...)
+	return contains(fields, query)
+}
+
+func contains(fields []string, query string) bool {
+	query = strings.ToLower(query)
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+func proxyErrored(proxy models.ProxyInstance) bool {
+	return proxy.Status == models.ProxyStatusError || proxy.Metrics.ErrorCount > 0
+}
+
+func nodeErrored(node models.NodeInfo) bool {
+	for _, proxy := range node.Proxies {
+		if proxyErrored(proxy) {
+			return true
+		}
+	}
+	return false
+}
+
+func runningProxies(node models.NodeInfo) int {
+	running := 0
+	for _, proxy := range node.Proxies {
+		if proxy.Status == models.ProxyStatusRunning {
+			running++
+		}
+	}
+	return running
+}
+
+func proxyName(proxy models.ProxyInstance) string {
+	if proxy.Name != "" {
+		return proxy.Name
+	}
+	return proxy.ID
+}
+
+// describe summarises how a table is narrowed down, shown of total rows.
+func (v view) describe(shown, total int, what, filter, column string) string {
+	line := fmt.Sprintf("Showing %d of %d %s, sorted by %s", shown, total, what, strings.ToLower(column))
+	if v.desc {
+		line += " descending"
+	}
+	if filter != filterAll {
+		line += ", only " + filter
+	}
+	if v.query != "" {
+		line += fmt.Sprintf(", matching %q", v.query)
+	}
+	return line
+}
+
+// Lines around the node and proxy tables, taken from the terminal height
+// to size them.
+const (
+	nodeChrome  = 44
+	proxyChrome = 32
+)
+
+// tableHeight is the table rows fitting in a terminal of height lines,
+// fallback until the height is known.
+func tableHeight(height, chrome, fallback int) int {
+	if height == 0 {
+		return fallback
+	}
+	return max(height-chrome, 5)
+}
+
+// currentView is the view of the table on screen.
+func (m *model) currentView() *view {
+	if m.detail != "" {
+		return &m.proxyView
+	}
+	return &m.nodeView
+}
+
+func (m model) sortCount() int {
+	if m.detail != "" {
+		return len(proxySorts)
+	}
+	return len(nodeSorts)
+}
+
+func (m model) filterCount() int {
+	if m.detail != "" {
+		return len(proxyFilters)
+	}
+	return len(nodeFilters)
+}
+
+// refreshTables rebuilds the tables on screen from the last fetch.
+func (m *model) refreshTables() {
+	m.updateTable()
+	if m.detail != "" {
+		m.updateProxyTable()
+	}
+}
+
+// updateSearch edits the search of the table on screen, narrowing it down
+// as the query is typed. Enter keeps the query, esc clears it.
+func (m model) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "ctrl+c":
+		return m, tea.Quit
+	case "enter":
+		m.searching = false
+		m.search.Blur()
+		return m, nil
+	case "esc":
+		m.searching = false
+		m.search.Blur()
+		m.search.SetValue("")
+	}
+	var cmd tea.Cmd
+	m.search, cmd = m.search.Update(msg)
+	m.currentView().query = strings.TrimSpace(m.search.Value())
+	m.refreshTables()
+	return m, cmd
+}
+
+// searchLine shows the search being typed.
+func (m model) searchLine() string {
+	if !m.searching {
+		return ""
+	}
+	return m.search.View() + "\n"
+}
@@ -0,0 +1,669 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/maintenance"
+	"proxy-v6/internal/mtls"
+	"proxy-v6/pkg/models"
+	"proxy-v6/pkg/version"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type model struct {
+	coordinatorURL string
+	apiKey         string
+	transport      http.RoundTripper
+	nodes          []models.NodeInfo
+	stats          map[string]interface{}
+	maintenance    []models.MaintenanceWindow
+	traffic        *models.TrafficSeries // nil when the coordinator has none
+	trafficMinutes int
+	table          table.Model
+	shownNodes     []models.NodeInfo // rows of table
+	detail         string            // node whose exits are shown, none for the node table
+	proxyTable     table.Model       // exits of the detail node
+	shownProxies   []models.ProxyInstance
+	nodeView       view
+	proxyView      view
+	search         textinput.Model
+	searching      bool          // typing into search
+	staleAfter     time.Duration // since its last report
+	height         int           // of the terminal, 0 until known
+	pending        *action     // waiting for confirmation
+	running        bool        // an action is under way
+	status         string      // outcome of the last action
+	statusErr      bool
+	lastUpdate     time.Time
+	err            error
+	
+	stream         <-chan tea.Msg // from subscribe
+	streaming      bool
+	refreshPending bool
+	events         []models.ClusterEvent // most recent last
+}
+
+type tickMsg time.Time
+
+const (
+	// pollInterval is how often the monitor refreshes without the event
+	// stream, streamPollInterval while it is connected and refreshes on
+	// events instead.
+	pollInterval       = 2 * time.Second
+	streamPollInterval = 30 * time.Second
+	// refreshDelay gathers a burst of events into one refresh.
+	refreshDelay = 500 * time.Millisecond
+	// maxShownEvents is how many of the latest events are listed.
+	maxShownEvents = 5
+)
+
+func (m model) tickCmd() tea.Cmd {
+	interval := pollInterval
+	if m.streaming {
+		interval = streamPollInterval
+	}
+	return tea.Tick(interval, func(t time.Time) tea.Msg {
+		return tickMsg(t)
+	})
+}
+
+type refreshMsg struct{}
+
+func (m model) Init() tea.Cmd {
+	return tea.Batch(m.tickCmd(), m.fetchData(), waitForStream(m.stream))
+}
+
+func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+	
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.height = msg.Height
+		m.refreshTables()
+		
+	case tea.KeyMsg:
+		if m.searching {
+			return m.updateSearch(msg)
+		}
+		if m.pending != nil {
+			pending := m.pending
+			m.pending = nil
+			switch msg.String() {
+			case "ctrl+c":
+				return m, tea.Quit
+			case "y", "Y":
+				m.running = true
+				m.status, m.statusErr = pending.progress, false
+				return m, pending.run
+			}
+			m.status, m.statusErr = "Cancelled", false
+			return m, nil
+		}
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		case "d", "x", "R", "i":
+			m.prepare(msg.String())
+			return m, nil
+		case "r":
+			return m, m.fetchData()
+		case "enter":
+			if m.detail == "" {
+				m.openProxies()
+				return m, nil
+			}
+		case "esc", "backspace":
+			if m.detail != "" {
+				m.closeProxies()
+				return m, nil
+			}
+			if m.nodeView.query != "" {
+				m.nodeView.query = ""
+				m.refreshTables()
+				return m, nil
+			}
+		case "/":
+			m.searching = true
+			m.search.SetValue(m.currentView().query)
+			m.search.CursorEnd()
+			return m, m.search.Focus()
+		case "s":
+			v := m.currentView()
+			v.sort = (v.sort + 1) % m.sortCount()
+			m.refreshTables()
+			return m, nil
+		case "S":
+			v := m.currentView()
+			v.desc = !v.desc
+			m.refreshTables()
+			return m, nil
+		case "f":
+			v := m.currentView()
+			v.filter = (v.filter + 1) % m.filterCount()
+			m.refreshTables()
+			return m, nil
+		}
+		
+	case tickMsg:
+		return m, tea.Batch(m.tickCmd(), m.fetchData())
+		
+	case streamMsg:
+		m.streaming = msg.connected
+		return m, waitForStream(m.stream)
+		
+	case eventMsg:
+		m.events = append(m.events, models.ClusterEvent(msg))
+		if over := len(m.events) - maxShownEvents; over > 0 {
+			m.events = m.events[over:]
+		}
+		cmds := []tea.Cmd{waitForStream(m.stream)}
+		if !m.refreshPending {
+			m.refreshPending = true
+			cmds = append(cmds, tea.Tick(refreshDelay, func(time.Time) tea.Msg { return refreshMsg{} }))
+		}
+		return m, tea.Batch(cmds...)
+		
+	case refreshMsg:
+		m.refreshPending = false
+		return m, m.fetchData()
+		
+	case nodesMsg:
+		m.nodes = msg.nodes
+		m.stats = msg.stats
+		m.maintenance = msg.maintenance
+		m.traffic = msg.traffic
+		m.lastUpdate = time.Now()
+		m.refreshTables()
+		
+	case actionMsg:
+		m.running = false
+		if msg.err != nil {
+			m.status, m.statusErr = fmt.Sprintf("Failed: %v", msg.err), true
+		} else {
+			m.status, m.statusErr = msg.text, false
+		}
+		return m, m.fetchData()
+		
+	case errMsg:
+		m.err = msg.err
+	}
+	
+	if m.detail != "" {
+		m.proxyTable, cmd = m.proxyTable.Update(msg)
+		return m, cmd
+	}
+	m.table, cmd = m.table.Update(msg)
+	return m, cmd
+}
+
+func (m model) View() string {
+	var s string
+	
+	headerStyle := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(lipgloss.Color("86")).
+		MarginBottom(1)
+	
+	helpStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("241"))
+	
+	s += headerStyle.Render("IPv6 Proxy Monitor") + "\n"
+	updates := fmt.Sprintf("polling every %s", pollInterval)
+	if m.streaming {
+		updates = "streaming events"
+	}
+	s += fmt.Sprintf("Last Update: %s (%s)\n\n", m.lastUpdate.Format("15:04:05"), updates)
+	
+	if m.stats != nil {
+		statsStyle := lipgloss.NewStyle().
+			Border(lipgloss.RoundedBorder()).
+			BorderForeground(lipgloss.Color("62")).
+			Padding(0, 1)
+		
+		statsText := fmt.Sprintf(
+			"Total Nodes: %v (%d draining)\nTotal Proxies: %v\nHealthy Proxies: %v\nFeatures: %s\nMaintenance: %s",
+			m.stats["total_nodes"],
+			drainingNodes(m.nodes),
+			m.stats["total_proxies"],
+			m.stats["healthy_proxies"],
+			featureCoverage(m.nodes),
+			maintenanceSummary(m.maintenance),
+		)
+		s += statsStyle.Render(statsText) + "\n\n"
+	}
+	
+	if m.traffic != nil {
+		s += m.trafficLines("Traffic", m.traffic.Total) + "\n"
+	}
+	
+	if m.detail != "" {
+		s += m.proxiesView(helpStyle)
+		return s
+	}
+	
+	s += m.nodeView.describe(len(m.shownNodes), len(m.nodes), "nodes", nodeFilters[m.nodeView.filter], nodeSorts[m.nodeView.sort].column) + "\n"
+	s += m.table.View() + "\n\n"
+	
+	if exits := m.selectedExits(); exits != "" {
+		s += exits + "\n\n"
+	}
+	
+	if len(m.events) > 0 {
+		s += recentEvents(m.events) + "\n\n"
+	}
+	
+	if m.err != nil {
+		errStyle := lipgloss.NewStyle().
+			Foreground(lipgloss.Color("196"))
+		s += errStyle.Render(fmt.Sprintf("Error: %v", m.err)) + "\n"
+	}
+	
+	s += m.actionLine()
+	s += m.searchLine()
+	s += helpStyle.Render("Press 'q' to quit, 'r' to refresh, 'enter' to show the exits of the selected node, 'd' to drain or undrain it, " +
+		"'/' to search, 's'/'S' to sort, 'f' to filter")
+	
+	return s
+}
+
+func (m *model) updateTable() {
+	columns := []table.Column{
+		{Title: "Node ID", Width: 20},
+		{Title: "Hostname", Width: 20},
+		{Title: "Proxies", Width: 10},
+		{Title: "Running", Width: 10},
+		{Title: "State", Width: 12},
+		{Title: "Backend", Width: 12},
+		{Title: "Features", Width: 24},
+		{Title: "Tags", Width: 20},
+		{Title: "Maintenance", Width: 14},
+		{Title: "Requests/s", Width: nodeSparklineWidth},
+		{Title: "Last Update", Width: 20},
+	}
+	
+	markSorted(columns, nodeSorts[m.nodeView.sort].column, m.nodeView.desc)
+	
+	// Keep the selected node selected as rows move
+	selected, _ := m.selectedNode()
+	m.shownNodes = m.visibleNodes()
+	cursor := 0
+	var rows []table.Row
+	for i, node := range m.shownNodes {
+		if node.NodeID == selected.NodeID {
+			cursor = i
+		}
+		rows = append(rows, table.Row{
+			node.NodeID,
+			node.Hostname,
+			fmt.Sprintf("%d", len(node.Proxies)),
+			fmt.Sprintf("%d", runningProxies(node)),
+			nodeState(node),
+			nodeBackend(node),
+			strings.Join(nodeFeatures(node), ","),
+			strings.Join(nodeTags(node), ","),
+			nodeMaintenance(m.maintenance, node.NodeID),
+			m.nodeSparkline(node.NodeID),
+			node.UpdatedAt.Format("15:04:05"),
+		})
+	}
+	
+	t := table.New(
+		table.WithColumns(columns),
+		table.WithRows(rows),
+		table.WithFocused(true),
+		table.WithHeight(tableHeight(m.height, nodeChrome, 10)),
+	)
+	
+	s := table.DefaultStyles()
+	s.Header = s.Header.
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color("240")).
+		BorderBottom(true).
+		Bold(false)
+	s.Selected = s.Selected.
+		Foreground(lipgloss.Color("229")).
+		Background(lipgloss.Color("57")).
+		Bold(false)
+	t.SetStyles(s)
+	t.SetCursor(cursor)
+	
+	m.table = t
+}
+
+// selectedNode returns the node under the cursor of the node table.
+func (m model) selectedNode() (models.NodeInfo, bool) {
+	cursor := m.table.Cursor()
+	if cursor < 0 || cursor >= len(m.shownNodes) {
+		return models.NodeInfo{}, false
+	}
+	return m.shownNodes[cursor], true
+}
+
+// maxListedExits bounds the exits listed under the table.
+const maxListedExits = 8
+
+// selectedExits lists the exits of the selected node by name, falling back
+// to the instance ID for exits without one.
+func (m model) selectedExits() string {
+	node, ok := m.selectedNode()
+	if !ok || len(node.Proxies) == 0 {
+		return ""
+	}
+	
+	proxies := append([]models.ProxyInstance(nil), node.Proxies...)
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].ID < proxies[j].ID })
+	lines := []string{fmt.Sprintf("Exits of %s:", node.NodeID)}
+	for i, proxy := range proxies {
+		if i == maxListedExits {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(proxies)-maxListedExits))
+			break
+		}
+		name := proxy.Name
+		if name == "" {
+			name = proxy.ID
+		}
+		lines = append(lines, fmt.Sprintf("  %-32s [%s]:%-6d %-8s %-14s %s",
+			name, proxy.IPv6.IP, proxy.Port, proxy.Protocol, proxy.Status, strings.Join(proxy.Tags, ",")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// nodeState shows whether the node takes new traffic.
+func nodeState(node models.NodeInfo) string {
+	switch {
+	case node.Maintenance:
+		return "maintenance"
+	case node.Draining:
+		return "draining"
+	}
+	return "active"
+}
+
+func nodeBackend(node models.NodeInfo) string {
+	if node.Capabilities == nil {
+		return "unknown"
+	}
+	return node.Capabilities.Backend
+}
+
+// nodeTags lists the distinct tags of a node's exits.
+func nodeTags(node models.NodeInfo) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, proxy := range node.Proxies {
+		for _, tag := range proxy.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func nodeFeatures(node models.NodeInfo) []string {
+	caps := node.Capabilities
+	if caps == nil {
+		return nil
+	}
+	var features []string
+	for _, f := range []struct {
+		name      string
+		supported bool
+	}{
+		{"http", caps.HTTP},
+		{"connect", caps.Connect},
+		{"socks5", caps.SOCKS5},
+		{"udp", caps.UDP},
+		{"auth", caps.Auth},
+	} {
+		if f.supported {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
+
+// nodeMaintenance shows "active" while a window covers the node, or the
+// start of its next scheduled window.
+func nodeMaintenance(windows []models.MaintenanceWindow, nodeID string) string {
+	next := ""
+	for _, window := range windows {
+		if !maintenance.Matches(window, nodeID) {
+			continue
+		}
+		if window.Active {
+			return "active"
+		}
+		if next == "" {
+			// Windows are listed earliest first
+			next = window.Start.Local().Format("01-02 15:04")
+		}
+	}
+	return next
+}
+
+func maintenanceSummary(windows []models.MaintenanceWindow) string {
+	active := 0
+	for _, window := range windows {
+		if window.Active {
+			active++
+		}
+	}
+	return fmt.Sprintf("%d active, %d scheduled", active, len(windows)-active)
+}
+
+func drainingNodes(nodes []models.NodeInfo) int {
+	draining := 0
+	for _, node := range nodes {
+		if node.Draining {
+			draining++
+		}
+	}
+	return draining
+}
+
+// featureCoverage summarises how many nodes support each feature.
+func featureCoverage(nodes []models.NodeInfo) string {
+	names := []string{"http", "connect", "socks5", "udp", "auth"}
+	counts := make(map[string]int)
+	for _, node := range nodes {
+		for _, f := range nodeFeatures(node) {
+			counts[f]++
+		}
+	}
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %d/%d", name, counts[name], len(nodes)))
+	}
+	return strings.Join(parts, "  ")
+}
+
+type nodesMsg struct {
+	nodes       []models.NodeInfo
+	stats       map[string]interface{}
+	maintenance []models.MaintenanceWindow
+	traffic     *models.TrafficSeries
+}
+
+type errMsg struct {
+	err error
+}
+
+func (m model) fetchData() tea.Cmd {
+	return func() tea.Msg {
+		client := &http.Client{Timeout: 5 * time.Second, Transport: m.transport}
+		
+		resp, err := m.get(client, "/api/nodes")
+		if err != nil {
+			return errMsg{err: err}
+		}
+		defer resp.Body.Close()
+		
+		var nodes []models.NodeInfo
+		if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+			return errMsg{err: err}
+		}
+		
+		resp, err = m.get(client, "/api/stats")
+		if err != nil {
+			return errMsg{err: err}
+		}
+		defer resp.Body.Close()
+		
+		var stats map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			return errMsg{err: err}
+		}
+		
+		resp, err = m.get(client, "/api/maintenance")
+		if err != nil {
+			return errMsg{err: err}
+		}
+		defer resp.Body.Close()
+		
+		var windows []models.MaintenanceWindow
+		if err := json.NewDecoder(resp.Body).Decode(&windows); err != nil {
+			return errMsg{err: err}
+		}
+		
+		// Coordinators that predate the traffic series just get no graphs
+		var traffic *models.TrafficSeries
+		resp, err = m.get(client, fmt.Sprintf("/api/traffic?minutes=%d", m.trafficMinutes))
+		if err == nil {
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(&traffic); err != nil {
+				traffic = nil
+			}
+		}
+		
+		return nodesMsg{nodes: nodes, stats: stats, maintenance: windows, traffic: traffic}
+	}
+}
+
+// get calls the coordinator API, treating non-2xx responses as errors.
+func (m model) get(client *http.Client, path string) (*http.Response, error) {
+	return m.request(client, http.MethodGet, path, nil)
+}
+
+// request sends body, if any, as JSON to the coordinator API. Non-2xx
+// responses are returned as errors, with the message of structured API
+// errors.
+func (m model) request(client *http.Client, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, m.coordinatorURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr apierror.Error
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err == nil && apiErr.Message != "" {
+			return nil, fmt.Errorf("coordinator returned %d for %s: %s", resp.StatusCode, path, apiErr.Message)
+		}
+		return nil, fmt.Errorf("coordinator returned %d for %s", resp.StatusCode, path)
+	}
+	return resp, nil
+}
+
+// Command returns the monitor command. cmd/monitor runs it directly and the
+// root proxy-v6 binary mounts it as "proxy-v6 monitor".
+func Command() *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:   "monitor",
+		Short: "TUI monitor for IPv6 proxy system",
+		Run: func(cmd *cobra.Command, args []string) {
+			coordinatorURL, _ := cmd.Flags().GetString("coordinator")
+			apiKey, _ := cmd.Flags().GetString("api-key")
+			var files mtls.Files
+			files.Cert, _ = cmd.Flags().GetString("tls-cert")
+			files.Key, _ = cmd.Flags().GetString("tls-key")
+			files.CA, _ = cmd.Flags().GetString("tls-ca")
+			
+			transport, err := mtls.Transport(logrus.StandardLogger(), files)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			
+			stream := make(chan tea.Msg, 64)
+			staleAfter, _ := cmd.Flags().GetDuration("stale-after")
+			trafficMinutes, _ := cmd.Flags().GetInt("traffic-minutes")
+			if trafficMinutes < 1 || trafficMinutes > 60 {
+				fmt.Println("Error: --traffic-minutes must be between 1 and 60")
+				return
+			}
+			search := textinput.New()
+			search.Prompt = "/"
+			m := model{
+				coordinatorURL: coordinatorURL,
+				apiKey:         apiKey,
+				transport:      transport,
+				lastUpdate:     time.Now(),
+				stream:         stream,
+				search:         search,
+				staleAfter:     staleAfter,
+				trafficMinutes: trafficMinutes,
+			}
+			m.updateTable()
+			go m.subscribe(stream)
+			
+			p := tea.NewProgram(m, tea.WithAltScreen())
+			if _, err := p.Run(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		},
+	}
+	
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print version information",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(version.GetVersion())
+		},
+	}
+	
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.Flags().StringP("coordinator", "c", "http://localhost:8081", "Coordinator URL")
+	rootCmd.Flags().String("api-key", os.Getenv("PROXY_V6_API_KEY"), "Coordinator API key, readonly role is enough unless you act on nodes (default $PROXY_V6_API_KEY)")
+	rootCmd.Flags().String("tls-cert", "", "Client certificate for a coordinator that requires mutual TLS")
+	rootCmd.Flags().String("tls-key", "", "Private key for --tls-cert")
+	rootCmd.Flags().String("tls-ca", "", "CA bundle the coordinator's certificate must be signed by")
+	rootCmd.Flags().Duration("stale-after", defaultStaleAfter, "How long since its last report a node is shown by the stale filter")
+	rootCmd.Flags().Int("traffic-minutes", defaultTrafficMinutes, "How far back the traffic graphs go, up to 60 minutes")
+	
+	return rootCmd
+}
\ No newline at end of file
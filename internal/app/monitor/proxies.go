@@ -0,0 +1,175 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// openProxies drills into the selected node, listing its exits.
+func (m *model) openProxies() {
+	node, ok := m.selectedNode()
+	if !ok {
+		return
+	}
+	m.detail = node.NodeID
+	m.proxyTable = table.Model{}
+	m.shownProxies = nil
+	m.updateProxyTable()
+}
+
+// closeProxies goes back to the node table.
+func (m *model) closeProxies() {
+	m.detail = ""
+}
+
+// detailNode returns the node drilled into, if it is still listed.
+func (m model) detailNode() (models.NodeInfo, bool) {
+	for _, node := range m.nodes {
+		if node.NodeID == m.detail {
+			return node, true
+		}
+	}
+	return models.NodeInfo{}, false
+}
+
+// proxiesView renders the exits of the detail node in place of the node
+// table.
+func (m model) proxiesView(helpStyle lipgloss.Style) string {
+	var s string
+	node, ok := m.detailNode()
+	if !ok {
+		s += fmt.Sprintf("Node %s is no longer listed\n\n", m.detail)
+	} else {
+		running := 0
+		for _, proxy := range node.Proxies {
+			if proxy.Status == models.ProxyStatusRunning {
+				running++
+			}
+		}
+		s += fmt.Sprintf("Exits of %s (%s): %d, %d running, state %s\n\n",
+			node.NodeID, node.Hostname, len(node.Proxies), running, nodeState(node))
+		if traffic := m.trafficLines("Traffic of "+node.NodeID, m.nodePoints(node.NodeID)); traffic != "" {
+			s += traffic + "\n"
+		}
+		s += m.proxyView.describe(len(m.shownProxies), len(node.Proxies), "exits", proxyFilters[m.proxyView.filter], proxySorts[m.proxyView.sort].column) + "\n"
+		s += m.proxyTable.View() + "\n\n"
+	}
+
+	if m.err != nil {
+		errStyle := lipgloss.NewStyle().
+			Foreground(lipgloss.Color("196"))
+		s += errStyle.Render(fmt.Sprintf("Error: %v", m.err)) + "\n"
+	}
+
+	s += m.actionLine()
+	s += m.searchLine()
+	s += helpStyle.Render("Press 'esc' to go back to the nodes, 'x' to stop, 'R' to restart, 'i' to rotate the selected exit, 'd' to drain or undrain the node, " +
+		"'/' to search, 's'/'S' to sort, 'f' to filter, 'q' to quit, 'r' to refresh")
+	return s
+}
+
+// selectedProxy returns the exit under the cursor of the proxy table.
+func (m model) selectedProxy() (models.ProxyInstance, bool) {
+	cursor := m.proxyTable.Cursor()
+	if cursor < 0 || cursor >= len(m.shownProxies) {
+		return models.ProxyInstance{}, false
+	}
+	return m.shownProxies[cursor], true
+}
+
+func (m *model) updateProxyTable() {
+	columns := []table.Column{
+		{Title: "Name", Width: 36},
+		{Title: "IPv6", Width: 40},
+		{Title: "Port", Width: 6},
+		{Title: "Status", Width: 10},
+		{Title: "Uptime", Width: 12},
+		{Title: "Requests", Width: 10},
+		{Title: "Bytes", Width: 10},
+		{Title: "Errors", Width: 8},
+	}
+
+	markSorted(columns, proxySorts[m.proxyView.sort].column, m.proxyView.desc)
+
+	// Keep the selected exit selected as rows move
+	selected, _ := m.selectedProxy()
+	m.shownProxies = m.detailProxies()
+	cursor := 0
+	var rows []table.Row
+	for i, proxy := range m.shownProxies {
+		if proxy.ID == selected.ID {
+			cursor = i
+		}
+		name := proxy.Name
+		if name == "" {
+			name = proxy.ID
+		}
+		status := string(proxy.Status)
+		if proxy.Standby {
+			status = "standby"
+		}
+		rows = append(rows, table.Row{
+			name,
+			proxy.IPv6.IP.String(),
+			fmt.Sprintf("%d", proxy.Port),
+			status,
+			uptime(proxy, time.Now()),
+			fmt.Sprintf("%d", proxy.Metrics.RequestsTotal),
+			formatBytes(proxy.Metrics.BytesTransmitted),
+			fmt.Sprintf("%d", proxy.Metrics.ErrorCount),
+		})
+	}
+
+	t := table.New(
+		table.WithColumns(columns),
+		table.WithRows(rows),
+		table.WithFocused(true),
+		table.WithHeight(tableHeight(m.height, proxyChrome, 15)),
+	)
+
+	s := table.DefaultStyles()
+	s.Header = s.Header.
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color("240")).
+		BorderBottom(true).
+		Bold(false)
+	s.Selected = s.Selected.
+		Foreground(lipgloss.Color("229")).
+		Background(lipgloss.Color("57")).
+		Bold(false)
+	t.SetStyles(s)
+	t.SetCursor(cursor)
+
+	m.proxyTable = t
+}
+
+// uptime is how long a running exit has been up, as of now.
+func uptime(proxy models.ProxyInstance, now time.Time) string {
+	if proxy.Status != models.ProxyStatusRunning || proxy.StartedAt.IsZero() {
+		return "-"
+	}
+	d := now.Sub(proxy.StartedAt).Round(time.Second)
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%dd%s", d/(24*time.Hour), (d % (24 * time.Hour)).Round(time.Hour))
+	}
+	return d.String()
+}
+
+// formatBytes shows n in binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
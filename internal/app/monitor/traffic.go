@@ -0,0 +1,112 @@
+package monitor
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	// defaultTrafficMinutes is how far back the traffic graphs go.
+	defaultTrafficMinutes = 15
+	// sparklineWidth is the width of the graphs above the tables, and
+	// nodeSparklineWidth of those in the node table.
+	sparklineWidth     = 60
+	nodeSparklineWidth = 16
+)
+
+// sparkBlocks are the levels of a sparkline, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values in width cells, each the average of the values
+// it covers, scaled to the largest cell.
+func sparkline(values []float64, width int) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if width > len(values) {
+		width = len(values)
+	}
+	cells := make([]float64, width)
+	peak := 0.0
+	for i := range cells {
+		lo, hi := i*len(values)/width, (i+1)*len(values)/width
+		for _, v := range values[lo:hi] {
+			cells[i] += v
+		}
+		cells[i] /= float64(hi - lo)
+		peak = math.Max(peak, cells[i])
+	}
+	var b strings.Builder
+	for _, v := range cells {
+		level := 0
+		if peak > 0 {
+			level = int(math.Round(v / peak * float64(len(sparkBlocks)-1)))
+		}
+		b.WriteRune(sparkBlocks[level])
+	}
+	return b.String()
+}
+
+// rates turns points into requests and bytes per second.
+func rates(points []models.TrafficPoint, stepSeconds int) (requests, bytes []float64) {
+	if stepSeconds <= 0 {
+		return nil, nil
+	}
+	requests = make([]float64, len(points))
+	bytes = make([]float64, len(points))
+	for i, p := range points {
+		requests[i] = float64(p.Requests) / float64(stepSeconds)
+		bytes[i] = float64(p.Bytes) / float64(stepSeconds)
+	}
+	return requests, bytes
+}
+
+// nodePoints returns the traffic of nodeID, zeros when it had none.
+func (m model) nodePoints(nodeID string) []models.TrafficPoint {
+	if m.traffic == nil {
+		return nil
+	}
+	if points, ok := m.traffic.Nodes[nodeID]; ok {
+		return points
+	}
+	return make([]models.TrafficPoint, len(m.traffic.Total))
+}
+
+// trafficLines graphs the request rate and bandwidth of points, each with
+// its latest and peak value, under title.
+func (m model) trafficLines(title string, points []models.TrafficPoint) string {
+	if m.traffic == nil || len(points) == 0 {
+		return ""
+	}
+	requests, bytes := rates(points, m.traffic.StepSeconds)
+	graph := lipgloss.NewStyle().Foreground(lipgloss.Color("86"))
+	span := time.Duration(len(points)*m.traffic.StepSeconds) * time.Second
+	return fmt.Sprintf("%s over the last %d min\n", title, int(span.Minutes())) +
+		fmt.Sprintf("  Requests  %s  %.1f/s now, %.1f/s peak\n",
+			graph.Render(sparkline(requests, sparklineWidth)), requests[len(requests)-1], peak(requests)) +
+		fmt.Sprintf("  Bandwidth %s  %s/s now, %s/s peak\n",
+			graph.Render(sparkline(bytes, sparklineWidth)), formatBytes(int64(bytes[len(bytes)-1])), formatBytes(int64(peak(bytes))))
+}
+
+// nodeSparkline is the request rate of nodeID for the node table.
+func (m model) nodeSparkline(nodeID string) string {
+	if m.traffic == nil {
+		return ""
+	}
+	requests, _ := rates(m.nodePoints(nodeID), m.traffic.StepSeconds)
+	return sparkline(requests, nodeSparklineWidth)
+}
+
+func peak(values []float64) float64 {
+	top := 0.0
+	for _, v := range values {
+		top = math.Max(top, v)
+	}
+	return top
+}
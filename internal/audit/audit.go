@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultCapacity = 1000
+
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	User        string    `json:"user,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+}
+
+// Trail keeps the most recent audit entries in memory and optionally
+// appends every entry to a JSON lines file.
+type Trail struct {
+	logger   *logrus.Logger
+	entries  []Entry
+	capacity int
+	next     int
+	full     bool
+	file     *os.File
+	mu       sync.Mutex
+}
+
+func NewTrail(logger *logrus.Logger, path string) (*Trail, error) {
+	t := &Trail{
+		logger:   logger,
+		entries:  make([]Entry, defaultCapacity),
+		capacity: defaultCapacity,
+	}
+
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		t.file = f
+	}
+
+	return t, nil
+}
+
+func (t *Trail) Record(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries[t.next] = entry
+	t.next = (t.next + 1) % t.capacity
+	if t.next == 0 {
+		t.full = true
+	}
+
+	if t.file != nil {
+		data, err := json.Marshal(entry)
+		if err == nil {
+			data = append(data, '\n')
+			_, err = t.file.Write(data)
+		}
+		if err != nil {
+			t.logger.Warnf("Failed to write audit entry: %v", err)
+		}
+	}
+
+	t.logger.Infof("Audit: %s user=%s client=%s destination=%s %s",
+		entry.Event, entry.User, entry.ClientIP, entry.Destination, entry.Detail)
+}
+
+// Entries returns up to limit of the most recent entries, newest first.
+// A limit of zero or less returns everything retained.
+func (t *Trail) Entries(limit int) []Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := t.next
+	if t.full {
+		count = t.capacity
+	}
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+
+	result := make([]Entry, 0, limit)
+	for i := 0; i < limit; i++ {
+		idx := (t.next - 1 - i + t.capacity) % t.capacity
+		result = append(result, t.entries[idx])
+	}
+	return result
+}
+
+func (t *Trail) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
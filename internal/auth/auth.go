@@ -0,0 +1,387 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/mitm"
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrMissingCredentials = errors.New("proxy credentials required")
+	ErrInvalidCredentials = errors.New("invalid proxy credentials")
+	ErrDestinationDenied  = errors.New("destination not allowed")
+	ErrOutsideSchedule    = errors.New("credentials not valid at this time")
+)
+
+// destinationLookupTimeout bounds the lookup of a destination host checked
+// against CIDR patterns.
+const destinationLookupTimeout = 5 * time.Second
+
+type Authenticator struct {
+	logger *logrus.Logger
+	users  map[string]models.User
+	store  store.UserStore // written through on changes, if set
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	mu     sync.RWMutex
+}
+
+func NewAuthenticator(logger *logrus.Logger, users []models.User) (*Authenticator, error) {
+	a := &Authenticator{
+		logger: logger,
+		users:  make(map[string]models.User),
+		lookup: net.DefaultResolver.LookupIPAddr,
+	}
+	for _, u := range users {
+		if err := validateUser(u); err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.Username, err)
+		}
+		a.users[u.Username] = u
+	}
+	return a, nil
+}
+
+func validateUser(user models.User) error {
+	if err := ValidateSchedule(user.Schedule); err != nil {
+		return err
+	}
+	if err := ValidateContentPolicy(user.Content); err != nil {
+		return err
+	}
+	if err := ValidateConstraints(user.Constraints); err != nil {
+		return err
+	}
+	if user.Pool != "" {
+		if err := ValidatePoolName(user.Pool); err != nil {
+			return err
+		}
+	}
+	if user.Tenant != "" {
+		if err := ValidateTenantName(user.Tenant); err != nil {
+			return err
+		}
+	}
+	switch user.Priority {
+	case "", models.PriorityInteractive, models.PriorityBatch:
+	default:
+		return fmt.Errorf("priority must be %s or %s", models.PriorityInteractive, models.PriorityBatch)
+	}
+	if user.TLSProfile != "" && !mitm.ValidProfile(user.TLSProfile) {
+		return fmt.Errorf("unknown tls_profile %q (valid: %s)", user.TLSProfile, strings.Join(mitm.Profiles(), ", "))
+	}
+	return nil
+}
+
+// SetStore makes user changes also write to users.
+func (a *Authenticator) SetStore(users store.UserStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.store = users
+}
+
+// Enabled reports whether any users are configured. When none are, the
+// proxy port stays open as before.
+func (a *Authenticator) Enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.users) > 0
+}
+
+func (a *Authenticator) SetUser(user models.User) error {
+	if user.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+	if err := validateUser(user); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if existing, ok := a.users[user.Username]; ok && user.Password == "" {
+		user.Password = existing.Password
+	}
+	if user.Password == "" {
+		return fmt.Errorf("password is required")
+	}
+	if a.store != nil {
+		if err := a.store.PutUser(user); err != nil {
+			return fmt.Errorf("failed to store user: %w", err)
+		}
+	}
+	a.users[user.Username] = user
+	a.logger.Infof("User %s updated", user.Username)
+	return nil
+}
+
+func (a *Authenticator) DeleteUser(username string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.users[username]; !ok {
+		return fmt.Errorf("user not found: %s", username)
+	}
+	if a.store != nil {
+		if err := a.store.DeleteUser(username); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("failed to delete stored user: %w", err)
+		}
+	}
+	delete(a.users, username)
+	a.logger.Infof("User %s deleted", username)
+	return nil
+}
+
+// Users returns all users with passwords removed.
+func (a *Authenticator) Users() []models.User {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	users := make([]models.User, 0, len(a.users))
+	for _, u := range a.users {
+		u.Password = ""
+		users = append(users, u)
+	}
+	return users
+}
+
+// Export returns all users with their passwords, for replication.
+func (a *Authenticator) Export() []models.User {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	users := make([]models.User, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Replace swaps every user for users, as copied from a primary
+// coordinator. Nothing changes if any of them is invalid.
+func (a *Authenticator) Replace(users []models.User) error {
+	replaced := make(map[string]models.User, len(users))
+	for _, u := range users {
+		if u.Username == "" || u.Password == "" {
+			return fmt.Errorf("user %q: username and password are required", u.Username)
+		}
+		if err := validateUser(u); err != nil {
+			return fmt.Errorf("user %s: %w", u.Username, err)
+		}
+		replaced[u.Username] = u
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store != nil {
+		for username := range a.users {
+			if _, ok := replaced[username]; !ok {
+				if err := a.store.DeleteUser(username); err != nil && !errors.Is(err, store.ErrNotFound) {
+					return fmt.Errorf("failed to delete user: %w", err)
+				}
+			}
+		}
+		for _, u := range replaced {
+			if err := a.store.PutUser(u); err != nil {
+				return fmt.Errorf("failed to store user: %w", err)
+			}
+		}
+	}
+	a.users = replaced
+	return nil
+}
+
+// Authenticate validates the Proxy-Authorization header of r and the
+// user's access schedule. On ErrOutsideSchedule the user is still returned
+// so callers can attribute the rejection.
+func (a *Authenticator) Authenticate(r *http.Request) (*models.User, error) {
+	username, password, ok := ParseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return nil, ErrMissingCredentials
+	}
+
+	a.mu.RLock()
+	user, exists := a.users[username]
+	a.mu.RUnlock()
+
+	if !exists || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	if !WithinSchedule(user.Schedule, time.Now()) {
+		return &user, ErrOutsideSchedule
+	}
+	return &user, nil
+}
+
+// InSchedule reports whether username may still use its credentials at t.
+// It is false for users removed since they authenticated.
+func (a *Authenticator) InSchedule(username string, t time.Time) bool {
+	a.mu.RLock()
+	user, exists := a.users[username]
+	a.mu.RUnlock()
+	return exists && WithinSchedule(user.Schedule, t)
+}
+
+// CheckDestination returns ErrDestinationDenied when the user's policy does
+// not permit destination, which must be in host:port form. Hostnames are
+// checked against CIDR patterns by the addresses they resolve to: a deny
+// pattern matches when any of them is in the range, and an allow pattern
+// only when all of them are. A host that does not resolve is denied by
+// every deny CIDR.
+func (a *Authenticator) CheckDestination(user *models.User, destination string) error {
+	if user == nil {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+		port = ""
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	// Literal IPs match CIDR patterns directly; hostnames are looked up
+	// once, and only for CIDR patterns
+	literal := net.ParseIP(host) != nil
+	var addrs []string
+	var lookupErr error
+	looked := false
+	resolve := func() ([]string, error) {
+		if !looked {
+			addrs, lookupErr = a.resolve(host)
+			looked = true
+		}
+		return addrs, lookupErr
+	}
+
+	for _, pattern := range user.Destinations.Deny {
+		if matchDestination(pattern, host, port) {
+			return ErrDestinationDenied
+		}
+		if literal || !cidrPattern(pattern) {
+			continue
+		}
+		ips, err := resolve()
+		if err != nil {
+			return ErrDestinationDenied
+		}
+		for _, ip := range ips {
+			if matchDestination(pattern, ip, port) {
+				return ErrDestinationDenied
+			}
+		}
+	}
+
+	if len(user.Destinations.Allow) == 0 {
+		return nil
+	}
+	for _, pattern := range user.Destinations.Allow {
+		if matchDestination(pattern, host, port) {
+			return nil
+		}
+		if literal || !cidrPattern(pattern) {
+			continue
+		}
+		ips, err := resolve()
+		if err != nil || len(ips) == 0 {
+			continue
+		}
+		all := true
+		for _, ip := range ips {
+			all = all && matchDestination(pattern, ip, port)
+		}
+		if all {
+			return nil
+		}
+	}
+	return ErrDestinationDenied
+}
+
+// resolve looks up the addresses of host for CIDR patterns.
+func (a *Authenticator) resolve(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), destinationLookupTimeout)
+	defer cancel()
+	found, err := a.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(found))
+	for _, addr := range found {
+		ips = append(ips, addr.IP.String())
+	}
+	return ips, nil
+}
+
+// cidrPattern reports whether a destination pattern names an address range.
+func cidrPattern(pattern string) bool {
+	if h, _, err := net.SplitHostPort(pattern); err == nil {
+		pattern = h
+	}
+	return strings.Contains(pattern, "/")
+}
+
+func ParseProxyAuthorization(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+// MatchDestination reports whether a host:port destination (or bare host)
+// matches a policy pattern.
+func MatchDestination(pattern, destination string) bool {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+		port = ""
+	}
+	return matchDestination(pattern, strings.ToLower(strings.TrimSuffix(host, ".")), port)
+}
+
+func matchDestination(pattern, host, port string) bool {
+	patternHost, patternPort := pattern, ""
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		patternHost, patternPort = h, p
+	}
+	patternHost = strings.ToLower(patternHost)
+
+	if patternPort != "" && patternPort != "*" && patternPort != port {
+		return false
+	}
+
+	switch {
+	case patternHost == "*" || patternHost == "":
+		return true
+	case strings.HasPrefix(patternHost, "*."):
+		suffix := patternHost[1:]
+		return strings.HasSuffix(host, suffix) || host == patternHost[2:]
+	case strings.Contains(patternHost, "/"):
+		_, cidr, err := net.ParseCIDR(patternHost)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && cidr.Contains(ip)
+	default:
+		return host == patternHost
+	}
+}
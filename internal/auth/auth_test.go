@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCheckDestinationResolvesHostsForCIDRs(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	a, err := NewAuthenticator(logger, nil)
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	hosts := map[string][]string{
+		"metadata.example": {"169.254.169.254"},
+		"mixed.example":    {"203.0.113.5", "10.1.2.3"},
+		"public.example":   {"203.0.113.5"},
+		"internal.example": {"10.1.2.3", "10.4.5.6"},
+	}
+	a.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		ips, ok := hosts[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+
+	deny := &models.User{Username: "u", Destinations: models.DestinationPolicy{Deny: []string{"169.254.169.254/32", "10.0.0.0/8"}}}
+	allow := &models.User{Username: "u", Destinations: models.DestinationPolicy{Allow: []string{"10.0.0.0/8:443"}}}
+	tests := []struct {
+		user        *models.User
+		destination string
+		allowed     bool
+	}{
+		{deny, "metadata.example:80", false},
+		{deny, "mixed.example:443", false},
+		{deny, "public.example:443", true},
+		{deny, "unknown.example:443", false},
+		{deny, "10.9.9.9:443", false},
+		{allow, "internal.example:443", true},
+		{allow, "internal.example:80", false},
+		{allow, "mixed.example:443", false},
+		{allow, "unknown.example:443", false},
+	}
+	for _, tt := range tests {
+		err := a.CheckDestination(tt.user, tt.destination)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("CheckDestination(deny %v, allow %v, %s) = %v, want allowed %v", tt.user.Destinations.Deny, tt.user.Destinations.Allow, tt.destination, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"proxy-v6/pkg/models"
+)
+
+const (
+	// MaxDistinctLast bounds how many recent exits of a client a constraint
+	// may look back on, and so how many are remembered per client.
+	MaxDistinctLast = 100
+	// maxName matches the length agents allow for instance tags.
+	maxName = 64
+)
+
+// ValidateConstraints checks the ranges of pool constraints.
+func ValidateConstraints(c models.PoolConstraints) error {
+	if c.DistinctPrefix < 0 || c.DistinctPrefix > 128 {
+		return fmt.Errorf("distinct_prefix must be between 1 and 128")
+	}
+	if c.DistinctLast < 0 || c.DistinctLast > MaxDistinctLast {
+		return fmt.Errorf("distinct_last must be between 1 and %d", MaxDistinctLast)
+	}
+	if c.DistinctPrefix > 0 && c.DistinctLast == 0 {
+		return fmt.Errorf("distinct_prefix needs distinct_last")
+	}
+	for _, asn := range c.ExcludeASNs {
+		if asn <= 0 {
+			return fmt.Errorf("invalid ASN %d in exclude_asns", asn)
+		}
+	}
+	return nil
+}
+
+// ValidatePoolName checks the name of a named pool. Like instance tags,
+// names may not contain whitespace or commas.
+func ValidatePoolName(name string) error {
+	return validateName("pool", name)
+}
+
+// ValidateTenantName checks the name of a tenant, which follows the rules
+// of pool names.
+func ValidateTenantName(name string) error {
+	return validateName("tenant", name)
+}
+
+func validateName(kind, name string) error {
+	if name == "" || len(name) > maxName {
+		return fmt.Errorf("%s name %q must be 1 to %d bytes", kind, name, maxName)
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return r == ',' || unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("%s name %q contains whitespace or a comma", kind, name)
+	}
+	return nil
+}
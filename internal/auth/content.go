@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"proxy-v6/pkg/models"
+)
+
+// ValidateContentPolicy checks that every blocked type is a media type
+// ("video/mp4") or a wildcard over one top-level type ("video/*").
+func ValidateContentPolicy(policy models.ContentPolicy) error {
+	if policy.MaxResponseBytes < 0 {
+		return fmt.Errorf("max_response_bytes must not be negative")
+	}
+	for _, pattern := range policy.BlockedTypes {
+		mediaType, _, err := mime.ParseMediaType(pattern)
+		if err != nil || !strings.Contains(mediaType, "/") || strings.HasPrefix(mediaType, "*/") {
+			return fmt.Errorf("invalid blocked type %q", pattern)
+		}
+	}
+	return nil
+}
+
+// MatchContentType reports whether a Content-Type header value falls under
+// pattern. Parameters such as charset are ignored.
+func MatchContentType(pattern, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	pattern = strings.ToLower(pattern)
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return mediaType == pattern
+}
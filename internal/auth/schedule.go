@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ValidateSchedule checks that every window in schedule can be evaluated.
+func ValidateSchedule(schedule []models.AccessWindow) error {
+	for i, w := range schedule {
+		if _, err := parseClock(w.Start); err != nil {
+			return fmt.Errorf("window %d: invalid start: %w", i, err)
+		}
+		if _, err := parseClock(w.End); err != nil {
+			return fmt.Errorf("window %d: invalid end: %w", i, err)
+		}
+		if w.Timezone != "" {
+			if _, err := time.LoadLocation(w.Timezone); err != nil {
+				return fmt.Errorf("window %d: invalid timezone: %w", i, err)
+			}
+		}
+		for _, day := range w.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok && day != "*" {
+				return fmt.Errorf("window %d: invalid day %q", i, day)
+			}
+		}
+	}
+	return nil
+}
+
+// WithinSchedule reports whether t falls inside any window. An empty
+// schedule means the credentials are always valid.
+func WithinSchedule(schedule []models.AccessWindow, t time.Time) bool {
+	if len(schedule) == 0 {
+		return true
+	}
+	for _, w := range schedule {
+		if windowContains(w, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func windowContains(w models.AccessWindow, t time.Time) bool {
+	loc := time.UTC
+	if w.Timezone != "" {
+		l, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return false
+		}
+		loc = l
+	}
+	local := t.In(loc)
+
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false
+	}
+	now := local.Hour()*60 + local.Minute()
+
+	if start < end {
+		return now >= start && now < end && dayMatches(w.Days, local.Weekday())
+	}
+
+	// The window wraps past midnight, so the part after midnight belongs
+	// to the day the window started on. One that ends when it starts lasts
+	// the whole 24 hours.
+	if now >= start {
+		return dayMatches(w.Days, local.Weekday())
+	}
+	if now < end {
+		return dayMatches(w.Days, (local.Weekday()+6)%7)
+	}
+	return false
+}
+
+func dayMatches(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if d == "*" {
+			return true
+		}
+		if wd, ok := weekdays[strings.ToLower(d)]; ok && wd == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock converts "HH:MM" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	tm, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, err
+	}
+	return tm.Hour()*60 + tm.Minute(), nil
+}
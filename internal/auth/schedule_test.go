@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+func TestWithinSchedule(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		window models.AccessWindow
+		t      time.Time
+		want   bool
+	}{
+		{"inside", models.AccessWindow{Start: "09:00", End: "17:00"}, at(12, 12, 0), true},
+		{"at end", models.AccessWindow{Start: "09:00", End: "17:00"}, at(12, 17, 0), false},
+		{"wrapping, after midnight", models.AccessWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(13, 3, 0), true},
+		{"wrapping, next day's evening", models.AccessWindow{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(13, 23, 0), false},
+		{"start equals end, all day", models.AccessWindow{Start: "00:00", End: "00:00"}, at(12, 15, 30), true},
+		{"start equals end, listed day", models.AccessWindow{Days: []string{"mon"}, Start: "00:00", End: "00:00"}, at(12, 23, 59), true},
+		{"start equals end, other day", models.AccessWindow{Days: []string{"mon"}, Start: "00:00", End: "00:00"}, at(13, 0, 0), false},
+		{"start equals end, 24 hours from start", models.AccessWindow{Days: []string{"mon"}, Start: "08:00", End: "08:00"}, at(13, 7, 59), true},
+		{"start equals end, before start", models.AccessWindow{Days: []string{"mon"}, Start: "08:00", End: "08:00"}, at(12, 7, 59), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WithinSchedule([]models.AccessWindow{tt.window}, tt.t); got != tt.want {
+				t.Errorf("WithinSchedule(%s-%s %v, %s) = %v, want %v", tt.window.Start, tt.window.End, tt.window.Days, tt.t.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Package banlist reads and writes lists of exit addresses that
+// destinations are known to ban, so ban knowledge can be kept across
+// restarts and shared between deployments.
+package banlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Parse reads a ban list. JSON is a models.BanList or a bare array of
+// entries. Anything else is text with one entry per line,
+//
+//	prefix [destination [ttl]] [# reason]
+//
+// where destination defaults to "*" and ttl is a duration such as 24h,
+// leaving the entry for good when it is missing. Lines starting with # are
+// comments. Prefixes are returned in CIDR form.
+func Parse(data []byte) ([]models.BanListEntry, error) {
+	var entries []models.BanListEntry
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var list models.BanList
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, fmt.Errorf("invalid ban list: %w", err)
+		}
+		entries = list.Entries
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("invalid ban list: %w", err)
+		}
+	default:
+		var err error
+		if entries, err = parseText(trimmed); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range entries {
+		if err := normalize(&entries[i]); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+	}
+	return entries, nil
+}
+
+func parseText(data []byte) ([]models.BanListEntry, error) {
+	var entries []models.BanListEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text, reason, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: want prefix [destination [ttl]], got %d fields", line, len(fields))
+		}
+		entry := models.BanListEntry{Prefix: fields[0], Reason: strings.TrimSpace(reason)}
+		if len(fields) > 1 {
+			entry.Destination = fields[1]
+		}
+		if len(fields) > 2 {
+			ttl, err := time.ParseDuration(fields[2])
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("line %d: invalid ttl %q", line, fields[2])
+			}
+			entry.TTLSeconds = int64((ttl + time.Second - 1) / time.Second)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// normalize checks e and writes its prefix in CIDR form, so a bare
+// address becomes a /128 or /32.
+func normalize(e *models.BanListEntry) error {
+	network, err := Network(e.Prefix)
+	if err != nil {
+		return err
+	}
+	e.Prefix = network.String()
+	e.Destination = strings.ToLower(strings.TrimSpace(e.Destination))
+	if e.Destination == "" {
+		e.Destination = "*"
+	}
+	if e.TTLSeconds < 0 {
+		return fmt.Errorf("%s: ttl_seconds must not be negative", e.Prefix)
+	}
+	return nil
+}
+
+// Network parses an address or CIDR prefix.
+func Network(prefix string) (*net.IPNet, error) {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.Contains(prefix, "/") {
+		ip := net.ParseIP(prefix)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid prefix %q", prefix)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	return network, nil
+}
+
+// Expiry is when e runs out if it is imported at now, or the zero time for
+// an entry that does not.
+func Expiry(e models.BanListEntry, now time.Time) time.Time {
+	switch {
+	case e.ExpiresAt != nil:
+		return *e.ExpiresAt
+	case e.TTLSeconds > 0:
+		return now.Add(time.Duration(e.TTLSeconds) * time.Second)
+	}
+	return time.Time{}
+}
+
+// WriteText writes list in the text form Parse reads, with the time left
+// at now as each entry's ttl.
+func WriteText(w io.Writer, list models.BanList, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %d exit bans, generated %s\n", len(list.Entries), list.GeneratedAt.UTC().Format(time.RFC3339))
+	for _, e := range list.Entries {
+		line := e.Prefix + " " + e.Destination
+		if expiry := Expiry(e, now); !expiry.IsZero() {
+			line += " " + max(expiry.Sub(now).Round(time.Second), time.Second).String()
+		}
+		if e.Reason != "" {
+			line += " # " + strings.Join(strings.Fields(e.Reason), " ")
+		}
+		fmt.Fprintln(bw, line)
+	}
+	return bw.Flush()
+}
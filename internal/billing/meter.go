@@ -0,0 +1,161 @@
+// Package billing rolls the proxy traffic of every user up by hour, so the
+// coordinator can export what each tenant and user used.
+package billing
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/store"
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// flushInterval is how often counted traffic is added to the store.
+const flushInterval = time.Minute
+
+var (
+	meteredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_metered_bytes_total",
+		Help: "Bytes of proxy traffic metered for billing, by direction.",
+	}, []string{"direction"})
+	meterFlushFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_meter_flush_failures_total",
+		Help: "Failed attempts to add metered traffic to the store.",
+	})
+)
+
+type key struct {
+	hour   time.Time
+	tenant string
+	user   string
+}
+
+// Meter counts requests and bytes per user and hour in memory and adds
+// them to the store every flush, so a request never waits for the store.
+type Meter struct {
+	logger  *logrus.Logger
+	store   store.BillingStore
+	pending map[key]*models.UsageRollup
+	mu      sync.Mutex
+	flushMu sync.Mutex // one flush at a time, so none is added twice
+}
+
+func NewMeter(logger *logrus.Logger, st store.BillingStore) *Meter {
+	return &Meter{logger: logger, store: st, pending: make(map[key]*models.UsageRollup)}
+}
+
+// Add counts requests, the bytes sent and received and what they cost for
+// user of tenant in the current hour.
+func (m *Meter) Add(tenant, user string, requests, sent, received int64, cost float64) {
+	meteredBytes.WithLabelValues("sent").Add(float64(sent))
+	meteredBytes.WithLabelValues("received").Add(float64(received))
+	k := key{hour: time.Now().UTC().Truncate(time.Hour), tenant: tenant, user: user}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.pending[k]
+	if !ok {
+		r = &models.UsageRollup{Hour: k.hour, Tenant: tenant, User: user}
+		m.pending[k] = r
+	}
+	r.Requests += requests
+	r.BytesSent += sent
+	r.BytesReceived += received
+	r.Cost += cost
+}
+
+// Flush adds the traffic counted since the last flush to the store. What
+// the store refuses is kept for the next flush.
+func (m *Meter) Flush() error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[key]*models.UsageRollup)
+	m.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	rollups := make([]models.UsageRollup, 0, len(pending))
+	for _, r := range pending {
+		rollups = append(rollups, *r)
+	}
+	err := m.store.AddUsage(rollups)
+	if err == nil {
+		return nil
+	}
+
+	meterFlushFailures.Inc()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, r := range pending {
+		if current, ok := m.pending[k]; ok {
+			current.Requests += r.Requests
+			current.BytesSent += r.BytesSent
+			current.BytesReceived += r.BytesReceived
+			current.Cost += r.Cost
+		} else {
+			m.pending[k] = r
+		}
+	}
+	return err
+}
+
+// Run flushes every flushInterval until stop is closed.
+func (m *Meter) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Flush(); err != nil {
+				m.logger.Errorf("Failed to store metered usage: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Usage returns the stored rollups matching q, after adding what was
+// counted since the last flush.
+func (m *Meter) Usage(q store.BillingQuery) ([]models.UsageRollup, error) {
+	if err := m.Flush(); err != nil {
+		m.logger.Errorf("Failed to store metered usage: %v", err)
+	}
+	return m.store.ListUsage(q)
+}
+
+// WriteCSV writes rollups as CSV with a header row.
+func WriteCSV(w io.Writer, rollups []models.UsageRollup) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"hour", "tenant", "user", "requests", "bytes_sent", "bytes_received", "cost"}); err != nil {
+		return err
+	}
+	for _, r := range rollups {
+		record := []string{
+			r.Hour.UTC().Format(time.RFC3339),
+			r.Tenant,
+			r.User,
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.BytesSent, 10),
+			strconv.FormatInt(r.BytesReceived, 10),
+			strconv.FormatFloat(r.Cost, 'f', -1, 64),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
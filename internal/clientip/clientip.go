@@ -0,0 +1,103 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver determines the real client address of a request, believing
+// X-Forwarded-For only when the immediate peer is a trusted proxy.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver parses trusted proxy entries, each an IP address or CIDR.
+func NewResolver(trusted []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, entry := range trusted {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", entry)
+		}
+		r.trusted = append(r.trusted, cidr)
+	}
+	return r, nil
+}
+
+// Trusted reports whether ip belongs to a configured trusted proxy.
+func (r *Resolver) Trusted(ip net.IP) bool {
+	if r == nil || ip == nil {
+		return false
+	}
+	for _, cidr := range r.trusted {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedString reports whether a textual address is a trusted proxy.
+func (r *Resolver) TrustedString(addr string) bool {
+	return r.Trusted(net.ParseIP(hostOnly(addr)))
+}
+
+// ClientIP returns the address of the client that originated req. The
+// X-Forwarded-For chain is walked from the right, skipping trusted hops,
+// so a client cannot spoof its address by prepending entries.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	remote := hostOnly(req.RemoteAddr)
+	if !r.TrustedString(remote) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hostOnly(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Garbage in the chain, stop at the last address we trust
+			break
+		}
+		client = hop
+		if !r.TrustedString(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// hostOnly strips a port and IPv6 brackets from addr.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
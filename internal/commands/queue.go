@@ -0,0 +1,311 @@
+// Package commands queues instructions for nodes until their agents fetch
+// them over the command channel and report how they went.
+package commands
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxWait bounds how long a fetch waits for a command to arrive.
+	MaxWait = time.Minute
+	// deliveryTimeout is how long a fetched command may go without a
+	// result before it is handed out again, in case the agent died while
+	// running it. Agents run each command ID at most once.
+	deliveryTimeout = 5 * time.Minute
+	// queueTimeout is how long a command waits to be fetched before it
+	// expires, so a node that comes back days later does not replay stale
+	// instructions.
+	queueTimeout = time.Hour
+	// maxFinished bounds the finished commands remembered per node.
+	maxFinished = 100
+)
+
+// ErrNotFound is returned for a command ID the node does not have.
+var ErrNotFound = errors.New("command not found")
+
+var commandsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_node_commands_total",
+	Help: "Node commands finished, by type and status (succeeded, failed or expired)",
+}, []string{"type", "status"})
+
+// Drainer takes nodes out of rotation and returns them.
+type Drainer interface {
+	DrainNode(nodeID string)
+	UndrainNode(nodeID string)
+}
+
+// Queue holds the commands of every node. Drain and undrain are applied to
+// the pool when submitted; the rest wait for the node's agent.
+type Queue struct {
+	logger  *logrus.Logger
+	drainer Drainer
+	nodes   map[string]*nodeQueue
+	mu      sync.Mutex
+}
+
+type nodeQueue struct {
+	commands []*models.NodeCommand // oldest first
+	wake     chan struct{}         // closed when a command is queued
+}
+
+func NewQueue(logger *logrus.Logger, drainer Drainer) *Queue {
+	return &Queue{
+		logger:  logger,
+		drainer: drainer,
+		nodes:   make(map[string]*nodeQueue),
+	}
+}
+
+// Validate checks that cmd has what its type needs.
+func Validate(cmd models.NodeCommand) error {
+	switch cmd.Type {
+	case models.CommandStopProxy, models.CommandRestartProxy:
+		if cmd.InstanceID == "" {
+			return fmt.Errorf("%s needs instance_id", cmd.Type)
+		}
+	case models.CommandRotateIP:
+		if cmd.InstanceID == "" {
+			return fmt.Errorf("%s needs instance_id", cmd.Type)
+		}
+		if cmd.IPv6 != "" && cmd.IPv6 != "auto" && net.ParseIP(cmd.IPv6) == nil {
+			return fmt.Errorf("invalid ipv6 %q", cmd.IPv6)
+		}
+	case models.CommandUpdateAccessControl:
+		if cmd.Mode != "open" && cmd.Mode != "restricted" {
+			return fmt.Errorf("mode must be open or restricted")
+		}
+		for _, ip := range cmd.AllowedIPs {
+			if net.ParseIP(ip) == nil {
+				if _, _, err := net.ParseCIDR(ip); err != nil {
+					return fmt.Errorf("invalid allowed IP %q", ip)
+				}
+			}
+		}
+	case models.CommandDrain, models.CommandUndrain:
+	default:
+		return fmt.Errorf("unknown command type %q", cmd.Type)
+	}
+	return nil
+}
+
+// Submit queues cmd for nodeID and wakes the agent if it is waiting.
+func (q *Queue) Submit(nodeID string, cmd models.NodeCommand) (models.NodeCommand, error) {
+	if err := Validate(cmd); err != nil {
+		return models.NodeCommand{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return models.NodeCommand{}, err
+	}
+	now := time.Now()
+	cmd.ID = hex.EncodeToString(id)
+	cmd.NodeID = nodeID
+	cmd.Status = models.CommandQueued
+	cmd.Result = nil
+	cmd.Deliveries = 0
+	cmd.CreatedAt = now
+	cmd.DeliveredAt, cmd.FinishedAt = time.Time{}, time.Time{}
+
+	switch cmd.Type {
+	case models.CommandDrain:
+		q.drainer.DrainNode(nodeID)
+		finish(&cmd, models.CommandSucceeded, now)
+	case models.CommandUndrain:
+		q.drainer.UndrainNode(nodeID)
+		finish(&cmd, models.CommandSucceeded, now)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	nq := q.nodeLocked(nodeID)
+	stored := cmd
+	nq.commands = append(nq.commands, &stored)
+	nq.trim()
+	if cmd.Status == models.CommandQueued {
+		close(nq.wake)
+		nq.wake = make(chan struct{})
+		q.logger.Infof("Queued %s command %s for node %s", cmd.Type, cmd.ID, nodeID)
+	}
+	return cmd, nil
+}
+
+// Fetch hands nodeID's queued commands to its agent, waiting up to wait
+// for one to arrive when there are none. It returns early when ctx ends.
+// Callers check that nodeID is registered, as a queue is kept for it.
+func (q *Queue) Fetch(ctx context.Context, nodeID string, wait time.Duration) []models.NodeCommand {
+	if wait > MaxWait {
+		wait = MaxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		nq := q.nodeLocked(nodeID)
+		now := time.Now()
+		q.sweepLocked(nq, now)
+		delivered := make([]models.NodeCommand, 0)
+		for _, cmd := range nq.commands {
+			if cmd.Status != models.CommandQueued {
+				continue
+			}
+			cmd.Status = models.CommandDelivered
+			cmd.Deliveries++
+			cmd.DeliveredAt = now
+			delivered = append(delivered, *cmd)
+		}
+		wake := nq.wake
+		q.mu.Unlock()
+
+		if len(delivered) > 0 {
+			return delivered
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return delivered
+		case <-ctx.Done():
+			return delivered
+		}
+	}
+}
+
+// Report records the agent's result for a command. A result for a command
+// that already finished is ignored, so a resent report is harmless.
+func (q *Queue) Report(nodeID, id string, result models.CommandResult) (models.NodeCommand, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cmd := q.findLocked(nodeID, id)
+	if cmd == nil {
+		return models.NodeCommand{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if finished(cmd.Status) {
+		return *cmd, nil
+	}
+	cmd.Result = &result
+	status := models.CommandFailed
+	if result.StatusCode >= 200 && result.StatusCode <= 299 {
+		status = models.CommandSucceeded
+	}
+	finish(cmd, status, time.Now())
+	q.logger.Infof("Node %s reports %s command %s %s (%d)", nodeID, cmd.Type, id, status, result.StatusCode)
+	return *cmd, nil
+}
+
+// Get returns one of nodeID's commands.
+func (q *Queue) Get(nodeID, id string) (models.NodeCommand, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if nq, ok := q.nodes[nodeID]; ok {
+		q.sweepLocked(nq, time.Now())
+	}
+	cmd := q.findLocked(nodeID, id)
+	if cmd == nil {
+		return models.NodeCommand{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return *cmd, nil
+}
+
+// List returns nodeID's pending and recently finished commands, oldest
+// first.
+func (q *Queue) List(nodeID string) []models.NodeCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]models.NodeCommand, 0)
+	nq, ok := q.nodes[nodeID]
+	if !ok {
+		return list
+	}
+	q.sweepLocked(nq, time.Now())
+	for _, cmd := range nq.commands {
+		list = append(list, *cmd)
+	}
+	return list
+}
+
+func (q *Queue) nodeLocked(nodeID string) *nodeQueue {
+	nq, ok := q.nodes[nodeID]
+	if !ok {
+		nq = &nodeQueue{wake: make(chan struct{})}
+		q.nodes[nodeID] = nq
+	}
+	return nq
+}
+
+func (q *Queue) findLocked(nodeID, id string) *models.NodeCommand {
+	nq, ok := q.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	for _, cmd := range nq.commands {
+		if cmd.ID == id {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// sweepLocked expires commands nobody fetched and hands out again those
+// fetched without a result for too long.
+func (q *Queue) sweepLocked(nq *nodeQueue, now time.Time) {
+	for _, cmd := range nq.commands {
+		switch {
+		case cmd.Status == models.CommandQueued && now.Sub(cmd.CreatedAt) > queueTimeout:
+			finish(cmd, models.CommandExpired, now)
+			q.logger.Warnf("Command %s for node %s expired without being fetched", cmd.ID, cmd.NodeID)
+		case cmd.Status == models.CommandDelivered && now.Sub(cmd.DeliveredAt) > deliveryTimeout:
+			cmd.Status = models.CommandQueued
+			q.logger.Warnf("Node %s did not report on command %s, queueing it again", cmd.NodeID, cmd.ID)
+		}
+	}
+	nq.trim()
+}
+
+// trim forgets the oldest finished commands beyond maxFinished.
+func (nq *nodeQueue) trim() {
+	done := 0
+	for _, cmd := range nq.commands {
+		if finished(cmd.Status) {
+			done++
+		}
+	}
+	if done <= maxFinished {
+		return
+	}
+	kept := nq.commands[:0]
+	for _, cmd := range nq.commands {
+		if done > maxFinished && finished(cmd.Status) {
+			done--
+			continue
+		}
+		kept = append(kept, cmd)
+	}
+	nq.commands = kept
+}
+
+func finish(cmd *models.NodeCommand, status string, now time.Time) {
+	cmd.Status = status
+	cmd.FinishedAt = now
+	commandsFinished.WithLabelValues(cmd.Type, status).Inc()
+}
+
+func finished(status string) bool {
+	return status == models.CommandSucceeded || status == models.CommandFailed || status == models.CommandExpired
+}
@@ -0,0 +1,117 @@
+// Package configcheck serves POST /api/config/validate for the agent and
+// the coordinator: a candidate config file is loaded the way --config is
+// and checked without being applied, so pipelines can gate config changes
+// before they are pushed to the fleet.
+package configcheck
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/pkg/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Route is where candidate configurations are validated.
+const Route = "/api/config/validate"
+
+// MaxBytes bounds the candidate config file.
+const MaxBytes = 1 << 20
+
+// Checker returns every problem that would stop a restart with the config
+// in v, nil when there are none.
+type Checker func(v *viper.Viper) []error
+
+// Handler validates the config file in the request body. Settings it
+// leaves out come from flags, as on a restart with the file as --config,
+// so the instance's own command-line flags still apply. The format is
+// ?format=, else taken from the Content-Type, else YAML. sections are the
+// keys only the config file sets; other keys that are no flag are ignored
+// on startup and reported as warnings.
+func Handler(flags *pflag.FlagSet, sections []string, check Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format, err := format(c)
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(c.Request.Body, MaxBytes+1))
+		if err != nil {
+			apierror.Respond(c, 400, apierror.CodeInvalidRequest, err)
+			return
+		}
+		if len(data) > MaxBytes {
+			apierror.RespondMessage(c, 413, apierror.CodeRequestTooLarge, fmt.Sprintf("config is larger than %d bytes", MaxBytes))
+			return
+		}
+
+		result := models.ConfigValidation{Errors: []string{}, Warnings: []string{}}
+		v := viper.New()
+		if err := v.BindPFlags(flags); err != nil {
+			apierror.Respond(c, 500, apierror.CodeInternal, err)
+			return
+		}
+		v.SetConfigType(format)
+		if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to parse %s: %v", format, err))
+		} else {
+			for _, err := range check(v) {
+				result.Errors = append(result.Errors, err.Error())
+			}
+			result.Warnings = unknownKeys(v, flags, sections)
+		}
+		result.Valid = len(result.Errors) == 0
+
+		status := http.StatusOK
+		if !result.Valid {
+			status = http.StatusUnprocessableEntity
+		}
+		c.JSON(status, result)
+	}
+}
+
+// format is the config format of the request.
+func format(c *gin.Context) (string, error) {
+	if format := c.Query("format"); format != "" {
+		if !slices.Contains(viper.SupportedExts, format) {
+			return "", fmt.Errorf("unknown format %q (valid: %s)", format, strings.Join(viper.SupportedExts, ", "))
+		}
+		return format, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		return "json", nil
+	case "application/toml":
+		return "toml", nil
+	}
+	return "yaml", nil
+}
+
+// unknownKeys warns about the top-level keys of v that are neither a flag
+// nor one of sections.
+func unknownKeys(v *viper.Viper, flags *pflag.FlagSet, sections []string) []string {
+	seen := make(map[string]bool)
+	for _, key := range v.AllKeys() {
+		top, _, _ := strings.Cut(key, ".")
+		if flags.Lookup(top) == nil && !slices.Contains(sections, top) {
+			seen[top] = true
+		}
+	}
+	warnings := make([]string, 0, len(seen))
+	for key := range seen {
+		warnings = append(warnings, fmt.Sprintf("unknown key %q is ignored", key))
+	}
+	sort.Strings(warnings)
+	return warnings
+}
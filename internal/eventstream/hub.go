@@ -0,0 +1,144 @@
+// Package eventstream fans the changes the coordinator sees in the cluster
+// out to every client subscribed to them, so dashboards need not poll.
+package eventstream
+
+import (
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// backlogSize is how many recent events are kept for subscribers
+	// resuming after a reconnect.
+	backlogSize = 1000
+	// subscriberBuffer is how many events a subscriber may fall behind
+	// before it is dropped.
+	subscriberBuffer = 256
+)
+
+var (
+	publishedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_cluster_events_total",
+		Help: "Cluster events published to the event stream, by type.",
+	}, []string{"type"})
+	subscriberGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_v6_event_stream_subscribers",
+		Help: "Clients subscribed to the event stream.",
+	})
+	droppedSubscribers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_event_stream_dropped_subscribers_total",
+		Help: "Subscribers dropped for falling too far behind the event stream.",
+	})
+)
+
+// Hub numbers the events published to it and passes them to every
+// subscriber. Publishing never blocks: a subscriber that does not keep up
+// is dropped and can resume from the backlog.
+type Hub struct {
+	backlog     []models.ClusterEvent // oldest first
+	nextID      uint64
+	subscribers map[*Subscription]bool
+	closed      bool
+	mu          sync.Mutex
+}
+
+func NewHub() *Hub {
+	return &Hub{nextID: 1, subscribers: make(map[*Subscription]bool)}
+}
+
+// Subscription receives the events published after it was made. Events is
+// closed when the subscriber fell behind or the hub closed.
+type Subscription struct {
+	Events <-chan models.ClusterEvent
+	events chan models.ClusterEvent
+	hub    *Hub
+}
+
+// Publish stamps event with the next ID, and with the current time unless
+// it has one, and sends it to every subscriber.
+func (h *Hub) Publish(event models.ClusterEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	event.ID = h.nextID
+	h.nextID++
+	h.backlog = append(h.backlog, event)
+	if over := len(h.backlog) - backlogSize; over > 0 {
+		h.backlog = append([]models.ClusterEvent(nil), h.backlog[over:]...)
+	}
+	publishedEvents.WithLabelValues(event.Type).Inc()
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			droppedSubscribers.Inc()
+			h.removeLocked(sub)
+		}
+	}
+}
+
+// Subscribe returns the retained events after lastID, oldest first, and a
+// subscription to the ones published from now on. A lastID of 0 replays
+// nothing. The backlog may have lost events after lastID, so a client
+// resuming should compare the first ID it gets with the one it expects.
+func (h *Hub) Subscribe(lastID uint64) ([]models.ClusterEvent, *Subscription) {
+	events := make(chan models.ClusterEvent, subscriberBuffer)
+	sub := &Subscription{Events: events, events: events, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var replay []models.ClusterEvent
+	if lastID > 0 {
+		for _, event := range h.backlog {
+			if event.ID > lastID {
+				replay = append(replay, event)
+			}
+		}
+	}
+	if h.closed {
+		close(events)
+		return replay, sub
+	}
+	h.subscribers[sub] = true
+	subscriberGauge.Inc()
+	return replay, sub
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.removeLocked(s)
+}
+
+// Close ends every subscription, so streaming clients disconnect, and
+// ignores events published afterwards.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.removeLocked(sub)
+	}
+}
+
+func (h *Hub) removeLocked(sub *Subscription) {
+	if !h.subscribers[sub] {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.events)
+	subscriberGauge.Dec()
+}
@@ -0,0 +1,88 @@
+package eventstream
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"proxy-v6/pkg/models"
+)
+
+// NodeChanges are the events between the stored report of a node and its
+// next one. previous is nil for a node the coordinator did not know, which
+// yields only its node-joined event.
+func NodeChanges(previous *models.NodeInfo, current models.NodeInfo) []models.ClusterEvent {
+	if previous == nil {
+		return []models.ClusterEvent{{
+			Type:   models.ClusterEventNodeJoined,
+			NodeID: current.NodeID,
+			Reason: fmt.Sprintf("%d proxies", len(current.Proxies)),
+		}}
+	}
+
+	before := make(map[string]models.ProxyInstance, len(previous.Proxies))
+	for _, instance := range previous.Proxies {
+		before[instance.ID] = instance
+	}
+	var events []models.ClusterEvent
+	for _, instance := range current.Proxies {
+		old, known := before[instance.ID]
+		delete(before, instance.ID)
+		if known && old.Status == instance.Status {
+			continue
+		}
+		event := instanceEvent(current.NodeID, instance)
+		event.PreviousStatus = old.Status
+		switch {
+		case instance.Status == models.ProxyStatusQuotaExceeded:
+			event.Type = models.ClusterEventQuotaExceeded
+		case old.Status == models.ProxyStatusQuotaExceeded:
+			event.Type = models.ClusterEventQuotaReset
+		}
+		events = append(events, event)
+	}
+
+	// Sorted so instances that left come out in the same order each time
+	removed := make([]string, 0, len(before))
+	for id := range before {
+		removed = append(removed, id)
+	}
+	sort.Strings(removed)
+	for _, id := range removed {
+		event := instanceEvent(current.NodeID, before[id])
+		event.PreviousStatus, event.Status = event.Status, ""
+		event.Reason = "no longer reported"
+		events = append(events, event)
+	}
+	return events
+}
+
+// NodeLeft is the event of a node leaving the cluster for reason.
+func NodeLeft(nodeID, reason string) models.ClusterEvent {
+	return models.ClusterEvent{Type: models.ClusterEventNodeLeft, NodeID: nodeID, Reason: reason}
+}
+
+// ProxyEvent relays a lifecycle event an agent posted.
+func ProxyEvent(e models.ProxyEvent) models.ClusterEvent {
+	return models.ClusterEvent{
+		Type:       models.ClusterEventProxy,
+		NodeID:     e.NodeID,
+		InstanceID: e.InstanceID,
+		Address:    net.JoinHostPort(e.IP, strconv.Itoa(e.Port)),
+		Status:     e.Status,
+		Reason:     e.Type,
+		Proxy:      &e,
+		Time:       e.Time,
+	}
+}
+
+func instanceEvent(nodeID string, instance models.ProxyInstance) models.ClusterEvent {
+	return models.ClusterEvent{
+		Type:       models.ClusterEventProxyStatus,
+		NodeID:     nodeID,
+		InstanceID: instance.ID,
+		Address:    net.JoinHostPort(instance.IPv6.IP.String(), strconv.Itoa(instance.Port)),
+		Status:     instance.Status,
+	}
+}
@@ -0,0 +1,269 @@
+package ipscanner
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// ifaFlagNoDAD (IFA_F_NODAD) skips duplicate address detection so a
+	// new address can be bound immediately instead of staying tentative
+	ifaFlagNoDAD = 0x02
+
+	// maxPrefixLength leaves at least 16 bits of suffix to pick from
+	maxPrefixLength = 112
+
+	allocateAttempts = 16
+)
+
+// Allocator adds random addresses from a prefix routed to this host to a
+// network interface, so the agent can serve more exits than the host was
+// configured with. Only addresses it added are removed again.
+type Allocator struct {
+	logger *logrus.Logger
+	prefix *net.IPNet
+	link   netlink.Link
+	added  []net.IP
+	mu     sync.Mutex
+}
+
+// NewAllocator validates prefix (such as "2001:db8:1:2::/64") and resolves
+// iface. With an empty iface the interface the kernel routes the prefix
+// through is used.
+func NewAllocator(logger *logrus.Logger, prefix, iface string) (*Allocator, error) {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix %q: %w", prefix, err)
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("prefix %s is not IPv6", prefix)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > maxPrefixLength {
+		return nil, fmt.Errorf("prefix %s is too small, use a /%d or larger", prefix, maxPrefixLength)
+	}
+
+	var link netlink.Link
+	if iface != "" {
+		link, err = netlink.LinkByName(iface)
+	} else {
+		link, err = routedLink(ipNet.IP)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface for %s: %w", prefix, err)
+	}
+
+	return &Allocator{
+		logger: logger,
+		prefix: ipNet,
+		link:   link,
+	}, nil
+}
+
+func routedLink(ip net.IP) (netlink.Link, error) {
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 || routes[0].LinkIndex == 0 {
+		return nil, errors.New("no route")
+	}
+	return netlink.LinkByIndex(routes[0].LinkIndex)
+}
+
+// Allocate makes sure at least count addresses from the prefix are on the
+// interface and returns all of them. Addresses already there, for example
+// left behind by an agent that did not shut down cleanly, count towards
+// the total and are kept when the allocator is released.
+func (a *Allocator) Allocate(count int) ([]models.IPv6Address, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current, err := netlink.AddrList(a.link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses on %s: %w", a.link.Attrs().Name, err)
+	}
+
+	used := make(map[string]bool)
+	var addresses []models.IPv6Address
+	for _, addr := range current {
+		if a.prefix.Contains(addr.IP) {
+			used[addr.IP.String()] = true
+			addresses = append(addresses, a.address(addr.IP))
+		}
+	}
+
+	for len(addresses) < count {
+		ip, err := a.add(used)
+		if err != nil {
+			return addresses, err
+		}
+		used[ip.String()] = true
+		a.added = append(a.added, ip)
+		addresses = append(addresses, a.address(ip))
+		a.logger.Infof("Allocated IPv6 %s on interface %s", ip, a.link.Attrs().Name)
+	}
+	return addresses, nil
+}
+
+func (a *Allocator) address(ip net.IP) models.IPv6Address {
+	return models.IPv6Address{
+		IP:        ip.To16(),
+		Interface: a.link.Attrs().Name,
+		IsPublic:  !ip.IsPrivate(),
+		CreatedAt: time.Now(),
+	}
+}
+
+// add assigns one random unused address from the prefix to the interface.
+func (a *Allocator) add(used map[string]bool) (net.IP, error) {
+	for attempt := 0; attempt < allocateAttempts; attempt++ {
+		ip, err := randomAddress(a.prefix)
+		if err != nil {
+			return nil, err
+		}
+		if used[ip.String()] || ip.Equal(a.prefix.IP) {
+			continue
+		}
+
+		err = netlink.AddrAdd(a.link, &netlink.Addr{
+			IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)},
+			Flags: ifaFlagNoDAD,
+		})
+		if errors.Is(err, syscall.EEXIST) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s to %s: %w", ip, a.link.Attrs().Name, err)
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free address found in %s after %d attempts", a.prefix, allocateAttempts)
+}
+
+// Add assigns one more random address from the prefix to the interface.
+func (a *Allocator) Add() (models.IPv6Address, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current, err := netlink.AddrList(a.link, netlink.FAMILY_V6)
+	if err != nil {
+		return models.IPv6Address{}, fmt.Errorf("failed to list addresses on %s: %w", a.link.Attrs().Name, err)
+	}
+	used := make(map[string]bool, len(current))
+	for _, addr := range current {
+		used[addr.IP.String()] = true
+	}
+
+	ip, err := a.add(used)
+	if err != nil {
+		return models.IPv6Address{}, err
+	}
+	a.added = append(a.added, ip)
+	a.logger.Infof("Allocated IPv6 %s on interface %s", ip, a.link.Attrs().Name)
+	return a.address(ip), nil
+}
+
+// Remove takes an address the allocator added off the interface.
+func (a *Allocator) Remove(ip net.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, added := range a.added {
+		if added.Equal(ip) {
+			if err := a.del(added); err != nil {
+				return err
+			}
+			a.added = append(a.added[:i], a.added[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s was not allocated from %s", ip, a.prefix)
+}
+
+// Restore adds an address the allocator added back to the interface, as
+// after the kernel flushed it when the interface went down.
+func (a *Allocator) Restore(ip net.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, added := range a.added {
+		if !added.Equal(ip) {
+			continue
+		}
+		err := netlink.AddrAdd(a.link, &netlink.Addr{
+			IPNet: &net.IPNet{IP: added, Mask: net.CIDRMask(128, 128)},
+			Flags: ifaFlagNoDAD,
+		})
+		if err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add %s back to %s: %w", ip, a.link.Attrs().Name, err)
+		}
+		a.logger.Infof("Restored allocated IPv6 %s on interface %s", ip, a.link.Attrs().Name)
+		return nil
+	}
+	return fmt.Errorf("%s was not allocated from %s", ip, a.prefix)
+}
+
+// Owns reports whether ip is an address the allocator added.
+func (a *Allocator) Owns(ip net.IP) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, added := range a.added {
+		if added.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether ip is from the allocator's prefix.
+func (a *Allocator) Contains(ip net.IP) bool {
+	return a.prefix.Contains(ip)
+}
+
+// Release removes every address the allocator added.
+func (a *Allocator) Release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ip := range a.added {
+		if err := a.del(ip); err != nil {
+			a.logger.Errorf("Failed to remove allocated IPv6 %s: %v", ip, err)
+		}
+	}
+	a.added = nil
+}
+
+func (a *Allocator) del(ip net.IP) error {
+	err := netlink.AddrDel(a.link, &netlink.Addr{
+		IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)},
+	})
+	if err != nil {
+		return err
+	}
+	a.logger.Infof("Removed allocated IPv6 %s", ip)
+	return nil
+}
+
+// randomAddress keeps the prefix bits of prefix and randomises the rest.
+func randomAddress(prefix *net.IPNet) (net.IP, error) {
+	ip := make(net.IP, net.IPv6len)
+	if _, err := rand.Read(ip); err != nil {
+		return nil, err
+	}
+	base := prefix.IP.To16()
+	for i := range ip {
+		ip[i] = base[i]&prefix.Mask[i] | ip[i]&^prefix.Mask[i]
+	}
+	return ip, nil
+}
@@ -73,6 +73,34 @@ func (s *Scanner) ScanIPv6Addresses() ([]models.IPv6Address, error) {
 	return ipv6Addresses, nil
 }
 
+// Lookup finds the interface ip is configured on, including addresses
+// ScanIPv6Addresses leaves out as non-public.
+func (s *Scanner) Lookup(ip net.IP) (models.IPv6Address, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return models.IPv6Address{}, fmt.Errorf("failed to get network interfaces: %w", err)
+	}
+	
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return models.IPv6Address{
+					IP:        ip.To16(),
+					Interface: iface.Name,
+					IsPublic:  s.isPublicIPv6(ip),
+					CreatedAt: time.Now(),
+				}, nil
+			}
+		}
+	}
+	
+	return models.IPv6Address{}, fmt.Errorf("%s is not configured on any interface", ip)
+}
+
 func (s *Scanner) shouldSkipInterface(iface net.Interface) bool {
 	if iface.Flags&net.FlagUp == 0 {
 		return true
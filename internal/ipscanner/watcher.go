@@ -0,0 +1,182 @@
+package ipscanner
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// ifaFlagDADFailed (IFA_F_DADFAILED) and ifaFlagTentative
+	// (IFA_F_TENTATIVE) mark addresses that cannot be bound yet, or ever
+	ifaFlagDADFailed = 0x08
+	ifaFlagTentative = 0x40
+
+	// resubscribeDelay is how long a dropped address subscription waits
+	// before it is set up again
+	resubscribeDelay = 5 * time.Second
+)
+
+// AddressChange is an IPv6 address that appeared on or disappeared from an
+// interface.
+type AddressChange struct {
+	Address models.IPv6Address
+	Added   bool
+}
+
+// Watch reports address changes as the kernel announces them
+// (RTM_NEWADDR and RTM_DELADDR) until ctx is done. Only addresses
+// ScanIPv6Addresses would find are reported as added, once each and only
+// after duplicate address detection passed. Every IPv6 address removed is
+// reported. known are the addresses in use already; whatever changed since
+// they were found is picked up with a scan once the subscription is set
+// up, and again whenever it is set up after dropping, as when the kernel
+// overruns its buffer.
+func (s *Scanner) Watch(ctx context.Context, known []models.IPv6Address) <-chan AddressChange {
+	changes := make(chan AddressChange)
+	present := make(map[string]bool, len(known))
+	for _, addr := range known {
+		present[addr.IP.String()] = true
+	}
+
+	go func() {
+		defer close(changes)
+		for {
+			updates := make(chan netlink.AddrUpdate)
+			done := make(chan struct{})
+			err := netlink.AddrSubscribeWithOptions(updates, done, netlink.AddrSubscribeOptions{
+				ErrorCallback: func(err error) {
+					s.logger.Warnf("IPv6 address watch: %v", err)
+				},
+			})
+			if err != nil {
+				s.logger.Errorf("Failed to watch IPv6 addresses: %v", err)
+			} else {
+				// Anything that changed while nothing was watching
+				s.resync(ctx, present, changes)
+				s.forward(ctx, updates, present, changes)
+				close(done)
+				// The subscription sends until its socket is closed
+				for range updates {
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			s.logger.Warnf("IPv6 address watch stopped, watching again in %s", resubscribeDelay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(resubscribeDelay):
+			}
+		}
+	}()
+	return changes
+}
+
+// forward turns updates into changes until ctx is done or the
+// subscription drops.
+func (s *Scanner) forward(ctx context.Context, updates <-chan netlink.AddrUpdate, present map[string]bool, changes chan<- AddressChange) {
+	for {
+		var update netlink.AddrUpdate
+		select {
+		case <-ctx.Done():
+			return
+		case u, ok := <-updates:
+			if !ok {
+				return
+			}
+			update = u
+		}
+
+		ip := update.LinkAddress.IP
+		if ip.To4() != nil {
+			continue
+		}
+		change := AddressChange{
+			Address: models.IPv6Address{
+				IP:        ip.To16(),
+				IsPublic:  s.isPublicIPv6(ip),
+				CreatedAt: time.Now(),
+			},
+			Added: update.NewAddr,
+		}
+		// A removed address may have taken its interface with it
+		iface, err := net.InterfaceByIndex(update.LinkIndex)
+		if err == nil {
+			change.Address.Interface = iface.Name
+		}
+
+		if change.Added {
+			// Lifetime updates are announced as new addresses too
+			if present[ip.String()] || err != nil || s.shouldSkipInterface(*iface) || !change.Address.IsPublic ||
+				update.Flags&(ifaFlagTentative|ifaFlagDADFailed) != 0 {
+				continue
+			}
+			present[ip.String()] = true
+			s.logger.Infof("IPv6 %s added on interface %s", ip, iface.Name)
+		} else {
+			delete(present, ip.String())
+			s.logger.Infof("IPv6 %s removed from interface %s", ip, change.Address.Interface)
+		}
+
+		select {
+		case changes <- change:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resync reports the addresses a fresh scan finds that are not present,
+// and those present that are on no interface any more.
+func (s *Scanner) resync(ctx context.Context, present map[string]bool, changes chan<- AddressChange) {
+	addresses, err := s.ScanIPv6Addresses()
+	if err != nil {
+		s.logger.Warnf("Failed to rescan IPv6 addresses: %v", err)
+		return
+	}
+	// The scan leaves out addresses that are not public, which known may
+	// still have
+	all, err := net.InterfaceAddrs()
+	if err != nil {
+		s.logger.Warnf("Failed to rescan IPv6 addresses: %v", err)
+		return
+	}
+	configured := make(map[string]bool, len(all))
+	for _, addr := range all {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			configured[ipNet.IP.String()] = true
+		}
+	}
+
+	var missed []AddressChange
+	for _, addr := range addresses {
+		if !present[addr.IP.String()] {
+			missed = append(missed, AddressChange{Address: addr, Added: true})
+		}
+	}
+	for ip := range present {
+		if !configured[ip] {
+			missed = append(missed, AddressChange{Address: models.IPv6Address{IP: net.ParseIP(ip), CreatedAt: time.Now()}})
+		}
+	}
+
+	for _, change := range missed {
+		if change.Added {
+			present[change.Address.IP.String()] = true
+		} else {
+			delete(present, change.Address.IP.String())
+		}
+		select {
+		case changes <- change:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
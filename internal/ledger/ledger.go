@@ -0,0 +1,356 @@
+package ledger
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/loadshed"
+	"proxy-v6/pkg/models"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/sirupsen/logrus"
+)
+
+const bucketSize = time.Hour
+
+// Query filters ledger entries. Zero values match everything.
+type Query struct {
+	IP     string // exact address or CIDR prefix
+	User   string
+	Tenant string
+	NodeID string
+	From   time.Time
+	To     time.Time
+}
+
+// Ledger keeps hourly records of which exit addresses served which clients
+// and destinations. It is periodically saved to disk so records survive
+// coordinator restarts.
+type Ledger struct {
+	logger    *logrus.Logger
+	path      string
+	retention time.Duration
+	entries   map[string]*models.LedgerEntry
+	dirty     bool
+	shedder   *loadshed.Shedder
+	mu        sync.Mutex
+}
+
+func NewLedger(logger *logrus.Logger, path string, retention time.Duration) (*Ledger, error) {
+	l := &Ledger{
+		logger:    logger,
+		path:      path,
+		retention: retention,
+		entries:   make(map[string]*models.LedgerEntry),
+	}
+
+	if path != "" {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func entryKey(e *models.LedgerEntry, bucket time.Time) string {
+	return strings.Join([]string{e.ExitIP, e.Exit, e.User, e.Tenant, e.ClientIP, e.Destination, bucket.Format(time.RFC3339)}, "|")
+}
+
+// Record notes that exit served a request from clientIP to destination,
+// for user of tenant.
+func (l *Ledger) Record(exitIP, exit, nodeID, user, tenant, clientIP, destination string) {
+	now := time.Now()
+	entry := &models.LedgerEntry{
+		ExitIP:      exitIP,
+		Exit:        exit,
+		NodeID:      nodeID,
+		User:        user,
+		Tenant:      tenant,
+		ClientIP:    clientIP,
+		Destination: destination,
+	}
+	key := entryKey(entry, now.Truncate(bucketSize))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if existing, ok := l.entries[key]; ok {
+		existing.LastSeen = now
+		existing.Requests++
+	} else {
+		entry.FirstSeen = now
+		entry.LastSeen = now
+		entry.Requests = 1
+		l.entries[key] = entry
+	}
+	l.dirty = true
+}
+
+// Extend notes that a connection from clientIP to destination, recorded
+// when it was opened, is still carried by exit. Long tunnels are seen in
+// every hour they stay open, without counting further requests.
+func (l *Ledger) Extend(exitIP, exit, nodeID, user, tenant, clientIP, destination string) {
+	now := time.Now()
+	entry := &models.LedgerEntry{
+		ExitIP:      exitIP,
+		Exit:        exit,
+		NodeID:      nodeID,
+		User:        user,
+		Tenant:      tenant,
+		ClientIP:    clientIP,
+		Destination: destination,
+	}
+	key := entryKey(entry, now.Truncate(bucketSize))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if existing, ok := l.entries[key]; ok {
+		existing.LastSeen = now
+	} else {
+		entry.FirstSeen = now
+		entry.LastSeen = now
+		l.entries[key] = entry
+	}
+	l.dirty = true
+}
+
+// Query returns matching entries ordered by first use.
+func (l *Ledger) Query(q Query) ([]models.LedgerEntry, error) {
+	var prefix *net.IPNet
+	var exact net.IP
+	if q.IP != "" {
+		if strings.Contains(q.IP, "/") {
+			_, cidr, err := net.ParseCIDR(q.IP)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix: %w", err)
+			}
+			prefix = cidr
+		} else if exact = net.ParseIP(q.IP); exact == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", q.IP)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]models.LedgerEntry, 0)
+	for _, e := range l.entries {
+		if q.User != "" && e.User != q.User {
+			continue
+		}
+		if q.Tenant != "" && e.Tenant != q.Tenant {
+			continue
+		}
+		if q.NodeID != "" && e.NodeID != q.NodeID {
+			continue
+		}
+		if !q.From.IsZero() && e.LastSeen.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && e.FirstSeen.After(q.To) {
+			continue
+		}
+		if exact != nil || prefix != nil {
+			ip := net.ParseIP(e.ExitIP)
+			if ip == nil || (exact != nil && !exact.Equal(ip)) || (prefix != nil && !prefix.Contains(ip)) {
+				continue
+			}
+		}
+		result = append(result, *e)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FirstSeen.Before(result[j].FirstSeen)
+	})
+	return result, nil
+}
+
+// SetShedder defers periodic saves while the coordinator sheds history
+// writes. Unsaved usage stays dirty and is written by a later save.
+func (l *Ledger) SetShedder(s *loadshed.Shedder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shedder = s
+}
+
+// Run periodically prunes expired entries and saves the ledger until stop
+// is closed.
+func (l *Ledger) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.prune()
+			l.mu.Lock()
+			shedder := l.shedder
+			l.mu.Unlock()
+			if shedder.Shed(loadshed.WorkHistory) {
+				continue
+			}
+			if err := l.Save(); err != nil {
+				l.logger.Errorf("Failed to save usage ledger: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (l *Ledger) prune() {
+	if l.retention <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-l.retention)
+	for key, e := range l.entries {
+		if e.LastSeen.Before(cutoff) {
+			delete(l.entries, key)
+			l.dirty = true
+		}
+	}
+}
+
+// Save writes the ledger to disk if it changed since the last save.
+func (l *Ledger) Save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	entries := make([]models.LedgerEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, *e)
+	}
+	l.dirty = false
+	l.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+func (l *Ledger) load() error {
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read usage ledger: %w", err)
+	}
+
+	var entries []models.LedgerEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse usage ledger: %w", err)
+	}
+
+	for i := range entries {
+		e := entries[i]
+		l.entries[entryKey(&e, e.FirstSeen.Truncate(bucketSize))] = &e
+	}
+	l.logger.Infof("Loaded %d usage ledger entries from %s", len(entries), l.path)
+	return nil
+}
+
+// WriteCSV exports entries as CSV with a header row.
+func WriteCSV(w io.Writer, entries []models.LedgerEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"exit_ip", "exit", "node_id", "user", "tenant", "client_ip", "destination", "first_seen", "last_seen", "requests"}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		record := []string{
+			e.ExitIP,
+			e.Exit,
+			e.NodeID,
+			e.User,
+			e.Tenant,
+			e.ClientIP,
+			e.Destination,
+			e.FirstSeen.UTC().Format(time.RFC3339),
+			e.LastSeen.UTC().Format(time.RFC3339),
+			strconv.FormatInt(e.Requests, 10),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parquetRowGroupRows bounds the rows a Parquet export buffers before
+// writing them out.
+const parquetRowGroupRows = 64 * 1024
+
+// parquetRow is a ledger entry as a Parquet row. Columns are named like the
+// CSV export's.
+type parquetRow struct {
+	ExitIP      string    `parquet:"exit_ip"`
+	Exit        string    `parquet:"exit"`
+	NodeID      string    `parquet:"node_id"`
+	User        string    `parquet:"user"`
+	Tenant      string    `parquet:"tenant"`
+	ClientIP    string    `parquet:"client_ip"`
+	Destination string    `parquet:"destination"`
+	FirstSeen   time.Time `parquet:"first_seen,timestamp(millisecond)"`
+	LastSeen    time.Time `parquet:"last_seen,timestamp(millisecond)"`
+	Requests    int64     `parquet:"requests"`
+}
+
+// WriteParquet exports entries as a Snappy-compressed Parquet file. Row
+// groups are written as they fill, so large exports stream.
+func WriteParquet(w io.Writer, entries []models.LedgerEntry) error {
+	pw := parquet.NewGenericWriter[parquetRow](w,
+		parquet.Compression(&parquet.Snappy),
+		parquet.MaxRowsPerRowGroup(parquetRowGroupRows),
+	)
+	batch := make([]parquetRow, 0, 1024)
+	for i, e := range entries {
+		batch = append(batch, parquetRow{
+			ExitIP:      e.ExitIP,
+			Exit:        e.Exit,
+			NodeID:      e.NodeID,
+			User:        e.User,
+			Tenant:      e.Tenant,
+			ClientIP:    e.ClientIP,
+			Destination: e.Destination,
+			FirstSeen:   e.FirstSeen.UTC(),
+			LastSeen:    e.LastSeen.UTC(),
+			Requests:    e.Requests,
+		})
+		if len(batch) == cap(batch) || i == len(entries)-1 {
+			if _, err := pw.Write(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	return pw.Close()
+}
@@ -1,33 +1,122 @@
 package loadbalancer
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/clientip"
+	"proxy-v6/internal/ledger"
+	"proxy-v6/internal/loadshed"
+	"proxy-v6/internal/metrics"
+	"proxy-v6/internal/mitm"
 	"proxy-v6/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/sirupsen/logrus"
 )
 
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "proxy_v6_lb_request_duration_seconds",
+	Help:    "Time to serve proxied HTTP requests, including queueing and retries, by priority class.",
+	Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+}, []string{"class"})
+
 type LoadBalancer struct {
-	logger      *logrus.Logger
-	proxies     []ProxyEndpoint
-	mu          sync.RWMutex
-	roundRobin  uint64
-	httpClient  *http.Client
-	healthCheck *HealthChecker
+	logger        *logrus.Logger
+	proxies       []ProxyEndpoint
+	mu            sync.RWMutex
+	roundRobin    uint64
+	strategy      Strategy
+	reuse         *reuseLimiter
+	history       *exitHistory // recent exits per client, for distinct constraints
+	origins       *originTable
+	pools         *poolTable
+	tenants       *tenantTable
+	ring          *hashRing // exits by client hash, for sticky-client
+	sticky        *stickyTable // client IP -> its exit, for sticky-client
+	httpClient    *http.Client
+	healthCheck   *HealthChecker
+	health        *healthResults
+	authenticator *auth.Authenticator
+	auditTrail    *audit.Trail
+	tunnels       *tunnelRegistry
+	promoted      map[string]bool // standby addresses promoted into rotation
+	activeTarget  int
+	bans          *banTracker
+	rewriter      *rewriter
+	ledger        *ledger.Ledger
+	meter         UsageMeter
+	traffic       TrafficRecorder
+	healthWatcher HealthWatcher
+	quarantined   map[string]models.QuarantinedExit
+	leases        map[string]models.Lease // IP -> its lease
+	transports    *transportPool
+	resolver      *preResolver
+	faults        *faultInjector
+	inflight      *inflightTracker
+	queue         *requestQueue
+	maxPerExit    int
+	batchShare    int // percent of maxPerExit batch requests may hold
+	clientIPs     *clientip.Resolver
+	drained       map[string]time.Time // node ID -> drain start
+	drainedInFlight map[string]int64   // node ID -> work in flight at drain start
+	maintenance   map[string]bool      // nodes drained because they report maintenance
+	selfDrained   time.Time // when the coordinator began draining itself
+	selfDrainedInFlight int64
+	interceptor   *mitm.Interceptor
+	mitmProfile   string
+	mitmTargets   []string
+	egressHeaders bool
+	content       *contentFilter
+	retryAttempts int // exits a failed replayable request may try
+	retryConnectOnly bool
+	streamThreshold int64 // Content-Length from which downloads take the raw path; 0 = off
+	outliers      *outlierDetector
+	passive       *passiveChecker
+	exitMetrics   *exitMetrics
+	shedder       *loadshed.Shedder
+	rateLimit     *rateLimiter
+	warmup        *prefixWarmup
+	duplicates    map[string]models.DuplicateAddress // IP -> nodes reporting it
 }
 
 type ProxyEndpoint struct {
-	NodeID    string
-	Address   string
-	Healthy   bool
-	LastCheck time.Time
+	NodeID       string
+	InstanceID   string
+	Address      string
+	IP           string
+	Healthy      bool
+	Standby      bool
+	LastCheck    time.Time
+	Capabilities models.Capabilities
+	Username     string // credentials the exit requires, if any
+	Password     string
+	Weight       float64 // the node's capacity weight, 0 when it reports none
+	Provider     string   // who the node's bandwidth is bought from
+	CostPerGB    *float64 // the node's egress price, nil when it reports none
+	Pools        []string // named pools its agent assigned it to
+	batch        bool // holds a batch slot, set once acquired
+}
+
+// authorization is the Proxy-Authorization value the exit expects, or "".
+func (p *ProxyEndpoint) authorization() string {
+	if p.Username == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
 }
 
 type HealthChecker struct {
@@ -36,6 +125,8 @@ type HealthChecker struct {
 	logger   *logrus.Logger
 }
 
+// NewLoadBalancer returns a load balancer checking exits every
+// checkInterval once RunHealthChecks runs.
 func NewLoadBalancer(logger *logrus.Logger, checkInterval time.Duration) *LoadBalancer {
 	lb := &LoadBalancer{
 		logger:  logger,
@@ -51,63 +142,404 @@ func NewLoadBalancer(logger *logrus.Logger, checkInterval time.Duration) *LoadBa
 			timeout:  5 * time.Second,
 			logger:   logger,
 		},
+		health:      newHealthResults(),
+		tunnels:     newTunnelRegistry(),
+		promoted:    make(map[string]bool),
+		bans:        newBanTracker(),
+		rewriter:    &rewriter{},
+		quarantined: make(map[string]models.QuarantinedExit),
+		leases:      make(map[string]models.Lease),
+		duplicates:  make(map[string]models.DuplicateAddress),
+		transports:  newTransportPool(),
+		resolver:    newPreResolver(logger),
+		faults:      &faultInjector{},
+		inflight:    newInflightTracker(),
+		queue:       newRequestQueue(),
+		drained:     make(map[string]time.Time),
+		drainedInFlight: make(map[string]int64),
+		maintenance: make(map[string]bool),
+		strategy:    StrategyRoundRobin,
+		reuse:       newReuseLimiter(),
+		history:     newExitHistory(),
+		origins:     &originTable{},
+		pools:       newPoolTable(),
+		tenants:     newTenantTable(),
+		content:     newContentFilter(),
+		retryAttempts: 1,
+		batchShare:  DefaultBatchShare,
+		outliers:    newOutlierDetector(),
+		passive:     newPassiveChecker(),
+		exitMetrics: newExitMetrics(),
+		rateLimit:   newRateLimiter(),
+		warmup:      newPrefixWarmup(),
+		sticky:      newStickyTable(),
 	}
 	
-	go lb.startHealthChecks()
 	return lb
 }
 
+// SetAuthenticator enables proxy authentication and destination policies.
+func (lb *LoadBalancer) SetAuthenticator(authenticator *auth.Authenticator) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.authenticator = authenticator
+}
+
+func (lb *LoadBalancer) SetAuditTrail(trail *audit.Trail) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.auditTrail = trail
+}
+
+// SetLedger records every forwarded request in the usage ledger.
+func (lb *LoadBalancer) SetLedger(l *ledger.Ledger) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.ledger = l
+}
+
+// SetShedder makes the load balancer stop recording usage and finally
+// refuse requests when the coordinator is overloaded.
+func (lb *LoadBalancer) SetShedder(s *loadshed.Shedder) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.shedder = s
+}
+
+// SetClientIPResolver makes the load balancer believe X-Forwarded-For from
+// trusted proxies when attributing requests to clients.
+func (lb *LoadBalancer) SetClientIPResolver(resolver *clientip.Resolver) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.clientIPs = resolver
+}
+
 func (lb *LoadBalancer) UpdateProxies(nodes []models.NodeInfo) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 	
 	newProxies := make([]ProxyEndpoint, 0)
+	promoted := make(map[string]bool)
+	activeTarget := 0
+	duplicated := lb.findDuplicatesLocked(nodes, time.Now())
+	lb.applyMaintenanceLocked(nodes)
+	
+	// Reports do not say whether an exit passes its health checks; that
+	// carries over until the next check
+	previous := make(map[string]ProxyEndpoint, len(lb.proxies))
+	for _, p := range lb.proxies {
+		previous[p.Address] = p
+	}
 	
 	for _, node := range nodes {
+		caps := nodeCapabilities(node)
 		for _, proxy := range node.Proxies {
+			// SOCKS5 instances are used directly by clients; the
+			// coordinator only fronts HTTP exits
+			if proxy.Protocol == models.ProxyProtocolSOCKS5 {
+				continue
+			}
+			// Which of the nodes really has the address is anyone's guess
+			if duplicated[proxy.IPv6.IP.String()] {
+				continue
+			}
 			if proxy.Status == models.ProxyStatusRunning {
 				endpoint := ProxyEndpoint{
-					NodeID:    node.NodeID,
-					Address:   fmt.Sprintf("[%s]:%d", proxy.IPv6.IP.String(), proxy.Port),
-					Healthy:   true,
-					LastCheck: time.Now(),
+					NodeID:       node.NodeID,
+					InstanceID:   proxy.ID,
+					Address:      fmt.Sprintf("[%s]:%d", proxy.IPv6.IP.String(), proxy.Port),
+					IP:           proxy.IPv6.IP.String(),
+					Healthy:      true,
+					Standby:      proxy.Standby,
+					LastCheck:    time.Now(),
+					Capabilities: caps,
+					Username:     proxy.Username,
+					Password:     proxy.Password,
+					Weight:       node.Weight,
+					Provider:     node.Provider,
+					CostPerGB:    node.CostPerGB,
+					Pools:        proxy.Pools,
+				}
+				if old, known := previous[endpoint.Address]; known {
+					endpoint.Healthy = old.Healthy
+					endpoint.LastCheck = old.LastCheck
+				}
+				// Exits failing requests stay out until a trial succeeds
+				endpoint.Healthy = endpoint.Healthy && !lb.passive.isOpen(endpoint.Address)
+				if !proxy.Standby {
+					activeTarget++
+				} else if lb.promoted[endpoint.Address] {
+					// Keep standby exits we already promoted in rotation
+					endpoint.Standby = false
+					promoted[endpoint.Address] = true
 				}
 				newProxies = append(newProxies, endpoint)
 			}
 		}
 	}
 	
+	active := make(map[string]bool, len(newProxies))
+	for _, p := range newProxies {
+		active[p.Address] = true
+	}
+	lb.transports.prune(active)
+	lb.outliers.prune(active)
+	lb.passive.prune(active)
+	lb.exitMetrics.prune(newProxies)
+	for _, prefix := range lb.warmup.observe(newProxies, time.Now()) {
+		lb.logger.Infof("New prefix %s in the pool", prefix)
+	}
+	
+	for _, p := range newProxies {
+		if old, known := previous[p.Address]; known && old.Healthy != p.Healthy {
+			lb.healthChangedLocked(p, "failing requests")
+		}
+	}
+	
 	lb.proxies = newProxies
-	lb.logger.Infof("Updated proxy pool: %d endpoints", len(newProxies))
+	lb.rebuildRingLocked()
+	lb.promoted = promoted
+	lb.activeTarget = activeTarget
+	lb.replenishFromStandbyLocked()
+	lb.logger.Infof("Updated proxy pool: %d endpoints (%d active target, %d promoted standby)",
+		len(newProxies), activeTarget, len(lb.promoted))
+}
+
+// StandbyEndpoints returns the warm standby exits not currently in rotation.
+func (lb *LoadBalancer) StandbyEndpoints() []ProxyEndpoint {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	
+	standby := make([]ProxyEndpoint, 0)
+	for _, p := range lb.proxies {
+		if p.Standby {
+			standby = append(standby, p)
+		}
+	}
+	return standby
+}
+
+// PromoteStandby moves up to count healthy standby exits into rotation and
+// returns the promoted addresses.
+func (lb *LoadBalancer) PromoteStandby(count int) []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.promoteStandbyLocked(count)
+}
+
+func (lb *LoadBalancer) promoteStandbyLocked(count int) []string {
+	promoted := make([]string, 0, count)
+	for i := range lb.proxies {
+		if len(promoted) >= count {
+			break
+		}
+		p := &lb.proxies[i]
+		if p.Standby && p.Healthy {
+			p.Standby = false
+			lb.promoted[p.Address] = true
+			promoted = append(promoted, p.Address)
+			lb.logger.Infof("Promoted standby proxy %s (Node: %s) into rotation", p.Address, p.NodeID)
+		}
+	}
+	return promoted
+}
+
+// replenishFromStandbyLocked promotes standby exits until the number of
+// healthy active exits is back at the target reported by the agents, and
+// demotes promoted ones again as the active exits recover.
+func (lb *LoadBalancer) replenishFromStandbyLocked() {
+	healthyActive, healthyPrimary := 0, 0
+	for _, p := range lb.proxies {
+		if !p.Standby && p.Healthy {
+			healthyActive++
+			if !lb.promoted[p.Address] {
+				healthyPrimary++
+			}
+		}
+	}
+	if missing := lb.activeTarget - healthyActive; missing > 0 {
+		if promoted := lb.promoteStandbyLocked(missing); len(promoted) < missing {
+			lb.logger.Warnf("Active pool is %d exits short and standby reserve is exhausted", missing-len(promoted))
+		}
+		return
+	}
+	if len(lb.promoted) > 0 && healthyPrimary >= lb.activeTarget {
+		lb.demoteStandbyLocked()
+	}
+}
+
+// demoteStandbyLocked takes the promoted standby exits out of rotation
+// again.
+func (lb *LoadBalancer) demoteStandbyLocked() {
+	for i := range lb.proxies {
+		p := &lb.proxies[i]
+		if lb.promoted[p.Address] {
+			p.Standby = true
+			lb.logger.Infof("Demoted standby proxy %s (Node: %s) out of rotation", p.Address, p.NodeID)
+		}
+	}
+	lb.promoted = make(map[string]bool)
 }
 
 func (lb *LoadBalancer) GetNextProxy() (*ProxyEndpoint, error) {
+	return lb.selectProxy(selection{kind: trafficHTTP})
+}
+
+// selectProxy picks an eligible exit for sel with the load balancing
+// strategy, or a random one for destinations under a reuse rule. An exit
+// the client pinned is used whenever it is healthy, in rotation and
+// compatible.
+func (lb *LoadBalancer) selectProxy(sel selection) (*ProxyEndpoint, error) {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 	
+	if sel.pool != "" && !lb.pools.defined(sel.pool) {
+		return nil, errPoolNotFound
+	}
+	if sel.pinned() {
+		found := false
+		for _, p := range lb.proxies {
+			if sel.matches(p) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errExitNotFound
+		}
+	}
+	
 	if len(lb.proxies) == 0 {
 		return nil, fmt.Errorf("no proxies available")
 	}
 	
+	host := destinationHost(sel.destination)
+	reuseRule, limited := lb.reuse.rule(host)
+	if sel.instanceID != "" {
+		// The client chose the exit; only hard failures rule it out
+		host, limited = "", false
+	}
 	healthyProxies := make([]ProxyEndpoint, 0)
+	probes := make([]ProxyEndpoint, 0)  // unhealthy exits due a trial request
+	warming := make([]ProxyEndpoint, 0) // exits of new prefixes sitting this one out
+	now := time.Now()
+	filter := lb.constraintFilterLocked(sel)
+	atCapacity := 0
+	incompatible := 0
+	reused := 0
+	constrained := 0
 	for _, p := range lb.proxies {
-		if p.Healthy {
-			healthyProxies = append(healthyProxies, p)
+		if !sel.matches(p) {
+			continue
+		}
+		if sel.pool != "" && !lb.pools.contains(p, sel.pool) {
+			continue
+		}
+		// Tenants' exits serve only them, and their users only those
+		if lb.tenants.owner(p, lb.pools) != sel.tenant {
+			continue
+		}
+		probe := false
+		if !p.Healthy {
+			if !lb.passive.probeDue(p.Address) {
+				continue
+			}
+			probe = true
+		}
+		if p.Standby || sel.exclude[p.Address] || lb.isQuarantinedLocked(p.IP) || lb.isLeasedLocked(p.IP, now) || lb.outliers.isEjected(p.Address) {
+			continue
+		}
+		if _, draining := lb.drained[p.NodeID]; draining {
+			continue
+		}
+		if !sel.kind.supportedBy(p.Capabilities) {
+			incompatible++
+			continue
+		}
+		if host != "" && lb.bans.isBanned(p.Address, p.IP, host) {
+			continue
+		}
+		if filter != nil && !filter.allows(p.IP, lb.origins) {
+			constrained++
+			continue
+		}
+		if limited && lb.reuse.exhausted(p.Address, host, reuseRule) {
+			reused++
+			continue
+		}
+		if limit := exitLimit(lb.maxPerExit, p.Capabilities); limit > 0 && lb.inflight.count(p.Address) >= int64(limit) {
+			atCapacity++
+			continue
+		} else if batchMax := batchLimit(limit, lb.batchShare); sel.priority == classBatch && batchMax > 0 && lb.inflight.batchCount(p.Address) >= int64(batchMax) {
+			atCapacity++
+			continue
+		}
+		if probe {
+			probes = append(probes, p)
+			continue
+		}
+		if sel.instanceID == "" && !lb.warmup.admit(p.IP, now) {
+			warming = append(warming, p)
+			continue
+		}
+		healthyProxies = append(healthyProxies, p)
+	}
+	if len(healthyProxies) == 0 {
+		// Warming exits are still better than none
+		healthyProxies = warming
+	}
+	
+	for i := range probes {
+		if lb.passive.claimProbe(probes[i].Address) {
+			lb.logger.Infof("Sending a trial request through unhealthy proxy %s (NodeID: %s)", probes[i].Address, probes[i].NodeID)
+			return &probes[i], nil
 		}
 	}
 	
 	if len(healthyProxies) == 0 {
+		if atCapacity > 0 {
+			return nil, errNoCapacity
+		}
+		if reused > 0 {
+			return nil, errReuseExhausted
+		}
+		if constrained > 0 {
+			return nil, errConstraintsUnmet
+		}
+		if incompatible > 0 {
+			return nil, fmt.Errorf("%w: %s", errNoCompatibleExit, sel.kind)
+		}
+		if sel.pool != "" {
+			return nil, errPoolUnavailable
+		}
+		if sel.tenant != "" {
+			return nil, errTenantUnavailable
+		}
+		if sel.pinned() {
+			return nil, errExitUnavailable
+		}
 		return nil, fmt.Errorf("no healthy proxies available")
 	}
 	
-	// Get the current counter value and increment atomically
-	currentIndex := atomic.AddUint64(&lb.roundRobin, 1) - 1
-	index := currentIndex % uint64(len(healthyProxies))
+	if lb.strategy == StrategyLeastCost {
+		healthyProxies = cheapest(healthyProxies)
+	}
+	
+	var index int
+	if limited {
+		if weights := exitWeights(healthyProxies); weights != nil {
+			index = weightedIndex(weights, rand.Float64())
+		} else {
+			index = rand.Intn(len(healthyProxies))
+		}
+	} else {
+		index = lb.pickLocked(healthyProxies, sel.client)
+	}
 	selectedProxy := &healthyProxies[index]
 	
 	// Log which proxy was selected and why
-	lb.logger.Infof("Selected proxy %d of %d: %s (NodeID: %s, Round-robin counter: %d)", 
-		index+1, len(healthyProxies), selectedProxy.Address, selectedProxy.NodeID, currentIndex)
+	lb.logger.Infof("Selected proxy %d of %d: %s (NodeID: %s, Strategy: %s, In flight: %d)", 
+		index+1, len(healthyProxies), selectedProxy.Address, selectedProxy.NodeID, lb.strategy, lb.inflight.count(selectedProxy.Address))
 	
 	return selectedProxy, nil
 }
@@ -116,77 +548,332 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Log incoming request
 	lb.logger.Debugf("Incoming proxy request: %s %s from %s", r.Method, r.URL.String(), r.RemoteAddr)
 	
-	proxy, err := lb.GetNextProxy()
+	requestID := r.Header.Get(apierror.RequestIDHeader)
+	if requestID == "" {
+		requestID = apierror.NewRequestID()
+	}
+	w.Header().Set(apierror.RequestIDHeader, requestID)
+	start := time.Now()
+	r = r.WithContext(metrics.WithTraceID(r.Context(), metrics.TraceID(r)))
+	
+	// Refuse work before authenticating so an overloaded coordinator spends
+	// as little as possible on it
+	lb.mu.RLock()
+	shedder := lb.shedder
+	lb.mu.RUnlock()
+	if shedder.Shed(loadshed.WorkProxy) {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeOverloaded, "coordinator is overloaded, retry later")
+		return
+	}
+	if lb.SelfDraining() {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeDraining, "coordinator is draining, use another one")
+		return
+	}
+	
+	user, ok := lb.authorize(w, r)
+	if !ok {
+		return
+	}
+	
+	username := ""
+	if user != nil {
+		username = user.Username
+	}
+	key, by := lb.rateLimit.key(lb.clientIP(r), username)
+	if allowed, wait := lb.rateLimit.allow(key, time.Now()); !allowed {
+		rateLimited.WithLabelValues(by).Inc()
+		w.Header().Set("Retry-After", retryAfter(wait))
+		writeError(w, http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests from this client, retry later")
+		return
+	}
+	
+	if !lb.faults.before(w) {
+		return
+	}
+	
+	destination := requestDestination(r)
+	client := lb.clientIP(r)
+	instanceID, nodeID := takePin(r)
+	pool := takePool(r)
+	tenant := ""
+	if user != nil {
+		if pool == "" {
+			pool = user.Pool
+		}
+		tenant = user.Tenant
+	}
+	priority, err := takePriority(r, user)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+	constraints, err := takeConstraints(r)
 	if err != nil {
-		lb.logger.Errorf("Failed to get proxy: %v", err)
-		http.Error(w, "No proxy available", http.StatusServiceUnavailable)
+		writeError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
 		return
 	}
+	if user != nil {
+		constraints = combineConstraints(user.Constraints, constraints)
+	}
+	history := historyKey(client, user)
 	
-	// Log which proxy will handle this request
-	lb.logger.Infof("Forwarding request to proxy: %s (Node: %s) for URL: %s", 
-		proxy.Address, proxy.NodeID, r.URL.String())
+	// If it's a CONNECT request (HTTPS), handle it differently
+	if r.Method == "CONNECT" {
+		proxy, err := lb.acquireProxy(r.Context(), selection{
+			client:      client,
+			destination: destination,
+			kind:        trafficConnect,
+			instanceID:  instanceID,
+			nodeID:      nodeID,
+			pool:        pool,
+			tenant:      tenant,
+			priority:    priority,
+			constraints: constraints,
+			history:     history,
+		})
+		if err != nil {
+			lb.logger.Errorf("Failed to get proxy: %v", err)
+			writeSelectionError(w, err)
+			return
+		}
+		defer lb.releaseProxy(proxy)
+		if lb.faults.exitFails(proxy) {
+			writeError(w, http.StatusBadGateway, apierror.CodeFaultInjected, "Failed to connect to proxy", proxy.Address)
+			return
+		}
+		lb.handleConnect(w, r, proxy, user)
+		return
+	}
 	
-	proxyURL, _ := url.Parse(fmt.Sprintf("http://%s", proxy.Address))
+	defer func() {
+		metrics.Observe(r.Context(), requestDuration.WithLabelValues(priority.String()), time.Since(start).Seconds())
+	}()
 	
 	// For HTTP proxy requests, we need to use the full URL
 	targetURL := r.URL.String()
 	if !r.URL.IsAbs() {
-		// If it's a CONNECT request (HTTPS), handle it differently
-		if r.Method == "CONNECT" {
-			lb.handleConnect(w, r, proxy)
-			return
-		}
 		// For relative URLs, construct the full URL
 		targetURL = fmt.Sprintf("http://%s%s", r.Host, r.RequestURI)
 	}
 	
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		lb.logger.Errorf("Failed to create proxy request: %v", err)
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
+	// Requests without a body can be replayed through another exit when the
+	// first one fails or turns out to be banned by the destination
+	replayable := isReplayable(r) && instanceID == ""
+	banRetries, failures := 0, 0
+	var lastFailure error
+	exclude := make(map[string]bool)
+	attempted := make([]string, 0, 1)
+	pinnedURL := lb.pinURL(r.Context(), targetURL)
+	sel := selection{
+		client:      client,
+		destination: destination,
+		kind:        trafficHTTP,
+		exclude:     exclude,
+		instanceID:  instanceID,
+		nodeID:      nodeID,
+		pool:        pool,
+		tenant:      tenant,
+		priority:    priority,
+		constraints: constraints,
+		history:     history,
+	}
+	var next *ProxyEndpoint // already acquired for a ban retry
+	
+	for {
+		proxy := next
+		next = nil
+		if proxy == nil {
+			proxy, err = lb.acquireProxy(r.Context(), sel)
+			if err != nil {
+				if lastFailure != nil {
+					lb.logger.Errorf("No other exit to retry on: %v", err)
+					writeError(w, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Proxy request failed", attempted...)
+					return
+				}
+				lb.logger.Errorf("Failed to get proxy: %v", err)
+				writeSelectionError(w, err, attempted...)
+				return
+			}
+		}
+		attempted = append(attempted, proxy.Address)
+		
+		// Log which proxy will handle this request
+		lb.logger.Infof("Forwarding request to proxy: %s (Node: %s) for URL: %s", 
+			proxy.Address, proxy.NodeID, r.URL.String())
+		
+		if lb.faults.exitFails(proxy) {
+			lb.releaseProxy(proxy)
+			writeError(w, http.StatusBadGateway, apierror.CodeFaultInjected, "Proxy request failed", attempted...)
+			return
+		}
+		
+		sent := time.Now()
+		resp, err := lb.forward(r, pinnedURL, proxy)
+		lb.recordOutcome(proxy, err != nil || isGatewayError(resp.StatusCode), time.Since(sent))
+		if err != nil {
+			// A client that went away says nothing about the exit
+			if r.Context().Err() == nil {
+				lb.recordHealth(proxy, true)
+			}
+			lb.releaseProxy(proxy)
+			lb.logger.Errorf("Proxy request failed for %s: %v", proxy.Address, err)
+			failures++
+			if replayable && lb.retryFailure(err, failures) {
+				lastFailure = err
+				exclude[proxy.Address] = true
+				retriesTotal.WithLabelValues("error").Inc()
+				lb.logger.Infof("Retrying %s through a different exit after a failure (attempt %d)", targetURL, failures+1)
+				continue
+			}
+			writeError(w, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Proxy request failed", attempted...)
+			return
+		}
+		lastFailure = nil
+		lb.recordHealth(proxy, exitFailed(resp))
+		
+		lb.logger.Debugf("Proxy response: %d from %s", resp.StatusCode, proxy.Address)
+		
+		if reason, duration, banned := lb.bans.inspect(destination, resp); banned {
+			lb.recordBan(proxy, destination, reason, duration, client, user)
+			if replayable && banRetries < maxBanRetries {
+				// The ban response is only dropped once another exit is
+				// lined up; without one the client is better off with it
+				exclude[proxy.Address] = true
+				alternative, err := lb.acquireProxy(r.Context(), sel)
+				if err == nil {
+					banRetries++
+					resp.Body.Close()
+					lb.releaseProxy(proxy)
+					retriesTotal.WithLabelValues("ban").Inc()
+					lb.logger.Infof("Retrying %s through a different exit (ban retry %d/%d)", targetURL, banRetries, maxBanRetries)
+					next = alternative
+					continue
+				}
+				lb.logger.Infof("Passing on the ban response for %s, no other exit to retry on: %v", targetURL, err)
+			}
+		}
+		
+		lb.recordUsage(proxy, r, user, destination)
+		lb.rewriter.apply(destination, resp)
+		capped, err := lb.screen(user, resp)
+		if err != nil {
+			resp.Body.Close()
+			lb.releaseProxy(proxy)
+			lb.logger.Infof("Blocked response from %s: %v", targetURL, err)
+			writeContentError(w, err, attempted...)
+			return
+		}
+		lb.setEgress(resp.Header, proxy)
+		if !lb.streamResponse(w, r, resp, proxy, user) {
+			lb.meterTraffic(user, proxy, 0, 0, lb.writeResponse(w, resp))
+		}
+		lb.releaseProxy(proxy)
+		if capped != nil && capped.exceeded {
+			// The status is already sent, so closing the connection is the
+			// only way to tell the client the body is incomplete
+			lb.logger.Infof("Cut off response from %s over the size limit", targetURL)
+			panic(http.ErrAbortHandler)
+		}
 		return
 	}
+}
+
+// pinURL replaces the host of targetURL with its pinned address when
+// pre-resolution is enabled.
+func (lb *LoadBalancer) pinURL(ctx context.Context, targetURL string) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return targetURL
+	}
+	hostport := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		hostport = net.JoinHostPort(u.Hostname(), port)
+	}
+	pinned := lb.resolver.pin(ctx, hostport)
+	if pinned == hostport {
+		return targetURL
+	}
+	u.Host = pinned
+	return u.String()
+}
+
+// writeError sends a structured error to the proxy client.
+func writeError(w http.ResponseWriter, status int, code, message string, attemptedExits ...string) {
+	apierror.Write(w, status, apierror.Error{
+		Code:           code,
+		Message:        message,
+		AttemptedExits: attemptedExits,
+	})
+}
+
+// writeSelectionError maps an exit selection failure to an error response.
+func writeSelectionError(w http.ResponseWriter, err error, attemptedExits ...string) {
+	switch err {
+	case errQueueFull:
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeQueueFull, "All exits are busy and the request queue is full", attemptedExits...)
+	case errQueueWait:
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeQueueTimeout, "Timed out waiting for a free exit", attemptedExits...)
+	case errExitNotFound:
+		writeError(w, http.StatusNotFound, apierror.CodeNotFound, "Requested exit does not exist", attemptedExits...)
+	case errExitUnavailable:
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeNoExitAvailable, "Requested exit is unhealthy or out of rotation", attemptedExits...)
+	case errReuseExhausted:
+		writeError(w, http.StatusTooManyRequests, apierror.CodeReuseLimited, "Every exit reached its reuse limit for this destination", attemptedExits...)
+	case errConstraintsUnmet:
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeConstraintsUnmet, "No available exit satisfies the pool constraints", attemptedExits...)
+	case errPoolNotFound:
+		writeError(w, http.StatusNotFound, apierror.CodeNotFound, "Requested pool does not exist", attemptedExits...)
+	case errPoolUnavailable:
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeNoExitAvailable, "No exit of the requested pool is available", attemptedExits...)
+	case errTenantUnavailable:
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeNoExitAvailable, "No exit of your tenant is available", attemptedExits...)
+	default:
+		writeError(w, http.StatusServiceUnavailable, apierror.CodeNoExitAvailable, "No proxy available", attemptedExits...)
+	}
+}
+
+// forward sends r to targetURL through the given upstream proxy. The Host
+// header is always taken from the original request so a pinned targetURL
+// still reaches the right virtual host.
+func (lb *LoadBalancer) forward(r *http.Request, targetURL string, proxy *ProxyEndpoint) (*http.Response, error) {
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy request: %w", err)
+	}
+	proxyReq.Host = r.Host
+	if r.URL.IsAbs() {
+		proxyReq.Host = r.URL.Host
+	}
 	
 	// Copy headers
 	for key, values := range r.Header {
+		if key == "Proxy-Authorization" {
+			continue
+		}
 		for _, value := range values {
 			proxyReq.Header.Add(key, value)
 		}
 	}
 	
-	// Use the selected proxy
-	transport := &http.Transport{
-		Proxy: http.ProxyURL(proxyURL),
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   60 * time.Second,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse // Don't follow redirects
-		},
+	if authorization := proxy.authorization(); authorization != "" {
+		proxyReq.Header.Set("Proxy-Authorization", authorization)
 	}
 	
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		lb.logger.Errorf("Proxy request failed for %s: %v", proxy.Address, err)
-		lb.markProxyUnhealthy(proxy.Address)
-		http.Error(w, "Proxy request failed", http.StatusBadGateway)
-		return
-	}
+	// Use the pooled transport of the selected proxy
+	return lb.transports.get(proxy.Address).roundTrip(proxyReq)
+}
+
+// writeResponse sends resp to the client and returns how many body bytes
+// it wrote.
+func (lb *LoadBalancer) writeResponse(w http.ResponseWriter, resp *http.Response) int64 {
 	defer resp.Body.Close()
 	
-	lb.logger.Debugf("Proxy response: %d from %s", resp.StatusCode, proxy.Address)
-	
 	// Copy response headers
 	for key, values := range resp.Header {
 		for _, value := range values {
@@ -204,109 +891,422 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		lb.logger.Debugf("Response sent: %d bytes", written)
 	}
+	return written
+}
+
+func (lb *LoadBalancer) recordBan(proxy *ProxyEndpoint, destination, reason string, duration time.Duration, clientIP string, user *models.User) {
+	host := destinationHost(destination)
+	lb.bans.ban(proxy, host, reason, duration)
+	lb.logger.Warnf("Exit %s (Node: %s) banned by %s (%s), excluding for %s", proxy.Address, proxy.NodeID, host, reason, duration)
+	
+	lb.mu.RLock()
+	trail := lb.auditTrail
+	lb.mu.RUnlock()
+	if trail != nil {
+		entry := audit.Entry{
+			Event:       "exit_banned",
+			ClientIP:    clientIP,
+			Destination: destination,
+			Detail:      fmt.Sprintf("exit=%s node=%s reason=%s", proxy.Address, proxy.NodeID, reason),
+		}
+		if user != nil {
+			entry.User = user.Username
+		}
+		trail.Record(entry)
+	}
+}
+
+func (lb *LoadBalancer) recordUsage(proxy *ProxyEndpoint, r *http.Request, user *models.User, destination string) {
+	username, tenant := "", ""
+	if user != nil {
+		username, tenant = user.Username, user.Tenant
+	}
+	if tenant != "" {
+		tenantRequests.WithLabelValues(tenant).Inc()
+	}
+	lb.meterTraffic(user, proxy, 1, requestBytes(r), 0)
+	
+	lb.mu.RLock()
+	l := lb.ledger
+	shedder := lb.shedder
+	lb.mu.RUnlock()
+	if l == nil || shedder.Shed(loadshed.WorkAnalytics) {
+		return
+	}
+	l.Record(proxy.IP, proxy.Address, proxy.NodeID, username, tenant, lb.clientIP(r), destination)
+}
+
+// trackTunnelUsage keeps the ledger entry of a tunnel recorded by
+// recordUsage current while the tunnel is open, so it is found for every
+// hour it carried traffic. The returned function records the close.
+func (lb *LoadBalancer) trackTunnelUsage(proxy *ProxyEndpoint, r *http.Request, user *models.User, destination string) func() {
+	username, tenant := "", ""
+	if user != nil {
+		username, tenant = user.Username, user.Tenant
+	}
+	exitIP, exit, nodeID, clientIP := proxy.IP, proxy.Address, proxy.NodeID, lb.clientIP(r)
+	extend := func() {
+		lb.mu.RLock()
+		l := lb.ledger
+		shedder := lb.shedder
+		lb.mu.RUnlock()
+		if l == nil || shedder.Shed(loadshed.WorkAnalytics) {
+			return
+		}
+		l.Extend(exitIP, exit, nodeID, username, tenant, clientIP, destination)
+	}
+	
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tunnelUsageInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				extend()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		extend()
+	}
+}
+
+// isReplayable reports whether r can safely be sent a second time.
+func isReplayable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
+	}
+	return false
 }
 
-func (lb *LoadBalancer) startHealthChecks() {
+// authorize authenticates the client and enforces its destination policy.
+// It writes the error response itself and returns false when the request
+// must not be forwarded. The user is nil when authentication is disabled.
+func (lb *LoadBalancer) authorize(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	lb.mu.RLock()
+	authenticator := lb.authenticator
+	trail := lb.auditTrail
+	lb.mu.RUnlock()
+	
+	if authenticator == nil || !authenticator.Enabled() {
+		return nil, true
+	}
+	
+	clientIP := lb.clientIP(r)
+	destination := requestDestination(r)
+	
+	user, err := authenticator.Authenticate(r)
+	if err == auth.ErrOutsideSchedule {
+		if trail != nil {
+			trail.Record(audit.Entry{
+				Event:       "outside_schedule",
+				User:        user.Username,
+				ClientIP:    clientIP,
+				Destination: destination,
+			})
+		}
+		writeError(w, http.StatusForbidden, apierror.CodeOutsideSchedule, "Credentials not valid at this time")
+		return nil, false
+	}
+	if err != nil {
+		if err == auth.ErrInvalidCredentials && trail != nil {
+			username, _, _ := auth.ParseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+			trail.Record(audit.Entry{
+				Event:       "auth_failed",
+				User:        username,
+				ClientIP:    clientIP,
+				Destination: destination,
+			})
+		}
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy-v6"`)
+		writeError(w, http.StatusProxyAuthRequired, apierror.CodeProxyAuthRequired, "Proxy authentication required")
+		return nil, false
+	}
+	
+	if err := authenticator.CheckDestination(user, destination); err != nil {
+		if trail != nil {
+			trail.Record(audit.Entry{
+				Event:       "destination_denied",
+				User:        user.Username,
+				ClientIP:    clientIP,
+				Destination: destination,
+			})
+		}
+		writeError(w, http.StatusForbidden, apierror.CodeDestinationDenied, "Destination not allowed")
+		return nil, false
+	}
+	
+	return user, true
+}
+
+func (lb *LoadBalancer) clientIP(r *http.Request) string {
+	lb.mu.RLock()
+	resolver := lb.clientIPs
+	lb.mu.RUnlock()
+	return resolver.ClientIP(r)
+}
+
+// requestDestination returns the host:port the client wants to reach.
+func requestDestination(r *http.Request) string {
+	host := r.Host
+	scheme := "http"
+	if r.URL.IsAbs() {
+		host = r.URL.Host
+		scheme = r.URL.Scheme
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if r.Method == "CONNECT" || scheme == "https" {
+		return net.JoinHostPort(strings.Trim(host, "[]"), "443")
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "80")
+}
+
+// RunHealthChecks checks every exit each health check interval until ctx
+// is done. Checks still in flight then are abandoned without marking any
+// exit.
+func (lb *LoadBalancer) RunHealthChecks(ctx context.Context) {
 	ticker := time.NewTicker(lb.healthCheck.interval)
 	defer ticker.Stop()
 	
-	for range ticker.C {
-		lb.performHealthChecks()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.performHealthChecks(ctx)
+		}
 	}
 }
 
-func (lb *LoadBalancer) performHealthChecks() {
+func (lb *LoadBalancer) performHealthChecks(ctx context.Context) {
+	lb.mu.RLock()
+	addresses := make(map[string]bool, len(lb.proxies))
+	for _, p := range lb.proxies {
+		addresses[p.Address] = true
+	}
+	lb.mu.RUnlock()
+	
+	// The pool may be replaced by a report while the checks run, so the
+	// results are applied by address once all are in
+	var wg sync.WaitGroup
+	results := make(chan models.ExitHealth, len(addresses))
+	for address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			if result, ok := lb.checkProxyHealth(ctx, address); ok {
+				results <- result
+			}
+		}(address)
+	}
+	wg.Wait()
+	close(results)
+	if ctx.Err() != nil {
+		return
+	}
+	lb.health.retain(addresses)
+	
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	
-	for i := range lb.proxies {
-		go lb.checkProxyHealth(&lb.proxies[i])
+	for result := range results {
+		lb.applyHealthLocked(result)
 	}
+	lb.replenishFromStandbyLocked()
 }
 
-func (lb *LoadBalancer) checkProxyHealth(proxy *ProxyEndpoint) {
+// checkProxyHealth checks whether the exit at address accepts connections,
+// or takes the primary's recent result for it. It returns false when ctx
+// was done first.
+func (lb *LoadBalancer) checkProxyHealth(ctx context.Context, address string) (models.ExitHealth, bool) {
+	now := time.Now()
+	result, shared := lb.health.recent(address, 2*lb.healthCheck.interval, now)
+	if shared {
+		healthCheckResults.WithLabelValues("shared").Inc()
+		if !result.Reachable {
+			lb.healthCheck.logger.Debugf("Proxy %s failed the primary's health check", address)
+		}
+		return result, true
+	}
+	
 	// Simple TCP connection test - don't send HTTP requests as it causes errors in tinyproxy logs
-	conn, err := net.DialTimeout("tcp", proxy.Address, lb.healthCheck.timeout)
+	dialer := net.Dialer{Timeout: lb.healthCheck.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if ctx.Err() != nil {
+		if err == nil {
+			conn.Close()
+		}
+		return models.ExitHealth{}, false
+	}
+	result = models.ExitHealth{Address: address, Reachable: err == nil, CheckedAt: now}
 	if err != nil {
-		proxy.Healthy = false
-		lb.healthCheck.logger.Warnf("Proxy %s failed health check: %v", proxy.Address, err)
+		lb.healthCheck.logger.Warnf("Proxy %s failed health check: %v", address, err)
 	} else {
 		conn.Close()
-		proxy.Healthy = true
 	}
-	proxy.LastCheck = time.Now()
+	healthCheckResults.WithLabelValues("probe").Inc()
+	lb.health.record(result)
+	return result, true
+}
+
+// applyHealthLocked marks the exit checked in result healthy or unhealthy.
+func (lb *LoadBalancer) applyHealthLocked(result models.ExitHealth) {
+	for i := range lb.proxies {
+		proxy := &lb.proxies[i]
+		if proxy.Address != result.Address {
+			continue
+		}
+		// Accepting connections does not clear an exit that failed requests;
+		// only a successful trial request does
+		wasHealthy := proxy.Healthy
+		proxy.Healthy = result.Reachable && !lb.passive.isOpen(proxy.Address)
+		proxy.LastCheck = result.CheckedAt
+		if proxy.Healthy != wasHealthy {
+			reason := "health check passed"
+			if !result.Reachable {
+				reason = "health check failed"
+			} else if !proxy.Healthy {
+				reason = "failing requests"
+			}
+			lb.healthChangedLocked(*proxy, reason)
+		}
+		return
+	}
 }
 
-func (lb *LoadBalancer) handleConnect(w http.ResponseWriter, r *http.Request, proxy *ProxyEndpoint) {
+func (lb *LoadBalancer) handleConnect(w http.ResponseWriter, r *http.Request, proxy *ProxyEndpoint, user *models.User) {
 	lb.logger.Infof("Handling CONNECT request to %s via proxy %s", r.Host, proxy.Address)
 	
-	// Connect to the upstream proxy
-	proxyConn, err := net.DialTimeout("tcp", proxy.Address, 10*time.Second)
+	// Connect to the upstream proxy, giving up once the client does
+	sent := time.Now()
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	proxyConn, err := dialer.DialContext(r.Context(), "tcp", proxy.Address)
+	if r.Context().Err() != nil {
+		if err == nil {
+			proxyConn.Close()
+		}
+		return
+	}
 	if err != nil {
+		lb.recordOutcome(proxy, true, time.Since(sent))
+		lb.recordHealth(proxy, true)
 		lb.logger.Errorf("Failed to connect to proxy %s: %v", proxy.Address, err)
-		http.Error(w, "Failed to connect to proxy", http.StatusBadGateway)
+		writeError(w, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Failed to connect to proxy", proxy.Address)
 		return
 	}
 	defer proxyConn.Close()
 	
+	// A client leaving mid-handshake unblocks it; the exit is not blamed
+	handshakeDone := context.AfterFunc(r.Context(), func() {
+		proxyConn.SetDeadline(time.Unix(1, 0))
+	})
+	
 	// Send CONNECT request to the proxy
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", r.Host, r.Host)
+	target := lb.resolver.pin(r.Context(), r.Host)
+	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if authorization := proxy.authorization(); authorization != "" {
+		connectReq += "Proxy-Authorization: " + authorization + "\r\n"
+	}
+	connectReq += "\r\n"
 	if _, err := proxyConn.Write([]byte(connectReq)); err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		lb.recordOutcome(proxy, true, time.Since(sent))
+		lb.recordHealth(proxy, true)
 		lb.logger.Errorf("Failed to send CONNECT to proxy: %v", err)
-		http.Error(w, "Failed to send CONNECT request", http.StatusBadGateway)
+		writeError(w, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Failed to send CONNECT request", proxy.Address)
 		return
 	}
 	
 	// Read the proxy's response
 	buf := make([]byte, 1024)
 	n, err := proxyConn.Read(buf)
+	if !handshakeDone() {
+		lb.logger.Debugf("Client left before %s answered CONNECT to %s", proxy.Address, r.Host)
+		return
+	}
 	if err != nil {
+		lb.recordOutcome(proxy, true, time.Since(sent))
+		lb.recordHealth(proxy, true)
 		lb.logger.Errorf("Failed to read CONNECT response: %v", err)
-		http.Error(w, "Failed to read CONNECT response", http.StatusBadGateway)
+		writeError(w, http.StatusBadGateway, apierror.CodeUpstreamFailed, "Failed to read CONNECT response", proxy.Address)
 		return
 	}
 	
 	// Check if the proxy accepted the CONNECT
 	response := string(buf[:n])
+	lb.recordOutcome(proxy, isGatewayError(connectStatus(response)), time.Since(sent))
+	lb.recordHealth(proxy, isGatewayError(connectStatus(response)))
 	if !contains(response, "200") {
 		lb.logger.Errorf("Proxy rejected CONNECT: %s", response)
-		http.Error(w, "Proxy rejected CONNECT", http.StatusBadGateway)
+		writeError(w, http.StatusBadGateway, apierror.CodeUpstreamRejected, "Proxy rejected CONNECT", proxy.Address)
 		return
 	}
 	
-	// Hijack the client connection
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		lb.logger.Error("Cannot hijack connection")
-		http.Error(w, "Cannot hijack connection", http.StatusInternalServerError)
-		return
-	}
-	
-	clientConn, _, err := hijacker.Hijack()
+	// Take over the client connection, or stream, and answer 200
+	clientConn, err := lb.clientTunnel(w, r, proxy)
 	if err != nil {
 		lb.logger.Errorf("Failed to hijack connection: %v", err)
-		http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to hijack connection")
 		return
 	}
 	defer clientConn.Close()
 	
-	// Send 200 Connection Established to the client
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	t := &tunnel{
+		info: models.TunnelInfo{
+			ID:          newTunnelID(),
+			ClientIP:    lb.clientIP(r),
+			Destination: r.Host,
+			Exit:        proxy.Address,
+			NodeID:      proxy.NodeID,
+			StartedAt:   time.Now(),
+		},
+		clientConn: clientConn,
+		proxyConn:  proxyConn,
+	}
+	if user != nil {
+		t.info.User = user.Username
+	}
+	lb.tunnels.add(t)
+	defer lb.tunnels.remove(t.info.ID)
+	lb.recordUsage(proxy, r, user, r.Host)
+	defer lb.trackTunnelUsage(proxy, r, user, r.Host)()
+	defer func() {
+		lb.meterTraffic(user, proxy, 0, atomic.LoadInt64(&t.sent), atomic.LoadInt64(&t.received))
+	}()
+	defer t.close()
+	
+	if profile := lb.interceptProfile(user, r.Host); profile != "" {
+		t.info.Intercepted = true
+		t.info.TLSProfile = profile
+		upstream := countingConn{Conn: proxyConn, sent: &t.sent, received: &t.received}
+		if err := lb.interceptor.Serve(clientConn, r.Host, profile, upstream); err != nil {
+			lb.logger.Debugf("Intercepted tunnel %s to %s ended: %v", t.info.ID, r.Host, err)
+		}
+		return
+	}
 	
 	// Start bidirectional copy
 	errc := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(proxyConn, clientConn)
+		_, err := io.Copy(countingWriter{w: proxyConn, counter: &t.sent}, clientConn)
 		errc <- err
 	}()
 	go func() {
-		_, err := io.Copy(clientConn, proxyConn)
+		_, err := io.Copy(countingWriter{w: clientConn, counter: &t.received}, proxyConn)
 		errc <- err
 	}()
 	
 	// Wait for one side to close
 	<-errc
-	lb.logger.Debugf("CONNECT tunnel closed for %s via %s", r.Host, proxy.Address)
+	lb.logger.Debugf("CONNECT tunnel %s closed for %s via %s", t.info.ID, r.Host, proxy.Address)
 }
 
 func contains(s, substr string) bool {
@@ -319,9 +1319,14 @@ func (lb *LoadBalancer) markProxyUnhealthy(address string) {
 	
 	for i := range lb.proxies {
 		if lb.proxies[i].Address == address {
-			lb.proxies[i].Healthy = false
+			if lb.proxies[i].Healthy {
+				lb.proxies[i].Healthy = false
+				lb.healthChangedLocked(lb.proxies[i], "failing requests")
+			}
 			lb.logger.Warnf("Marked proxy %s as unhealthy", address)
 			break
 		}
 	}
+	
+	lb.replenishFromStandbyLocked()
 }
\ No newline at end of file
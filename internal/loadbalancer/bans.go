@@ -0,0 +1,408 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/banlist"
+	"proxy-v6/pkg/models"
+)
+
+const (
+	// maxBanInspectBytes bounds how much of a response body is buffered to
+	// look for ban markers, and how much of it is scanned once decoded.
+	maxBanInspectBytes = 64 * 1024
+	defaultBanDuration = 10 * time.Minute
+	// maxBanRetries is how many other exits a replayable request is tried
+	// on after hitting a ban response.
+	maxBanRetries = 2
+)
+
+// DefaultBanRules flags rate limiting and forbidden responses from any
+// destination.
+var DefaultBanRules = []models.BanRule{
+	{Destination: "*", StatusCodes: []int{403, 429}, BanSeconds: 600},
+}
+
+// banTracker remembers exit+destination pairs that recently produced ban
+// responses so selection can route around them, along with the prefixes
+// imported from ban lists.
+type banTracker struct {
+	rules    []models.BanRule
+	bans     map[string]models.ExitBan
+	listed   map[string][]listedBan // imported, by destination pattern
+	patterns []string               // keys of listed that match more than one host
+	changed  bool                   // since the state was last taken for saving
+	mu       sync.RWMutex
+}
+
+// listedBan is an imported ban list entry.
+type listedBan struct {
+	entry   models.BanListEntry
+	network *net.IPNet
+	expires time.Time // zero for good
+}
+
+func (l listedBan) active(now time.Time) bool {
+	return l.expires.IsZero() || now.Before(l.expires)
+}
+
+func newBanTracker() *banTracker {
+	return &banTracker{bans: make(map[string]models.ExitBan), listed: make(map[string][]listedBan)}
+}
+
+func banKey(exit, host string) string {
+	return exit + "|" + host
+}
+
+func destinationHost(destination string) string {
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+	return strings.ToLower(host)
+}
+
+func (b *banTracker) setRules(rules []models.BanRule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rules = rules
+}
+
+func (b *banTracker) getRules() []models.BanRule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]models.BanRule(nil), b.rules...)
+}
+
+// isBanned reports whether the exit at address on ip is banned for host,
+// learned or by an imported entry.
+func (b *banTracker) isBanned(exit, ip, host string) bool {
+	now := time.Now()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if ban, ok := b.bans[banKey(exit, host)]; ok && now.Before(ban.ExpiresAt) {
+		return true
+	}
+	if len(b.listed) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	listedFor := func(pattern string) bool {
+		for _, l := range b.listed[pattern] {
+			if l.active(now) && l.network.Contains(parsed) {
+				return true
+			}
+		}
+		return false
+	}
+	if listedFor(host) {
+		return true
+	}
+	for _, pattern := range b.patterns {
+		if auth.MatchDestination(pattern, host) && listedFor(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *banTracker) ban(endpoint *ProxyEndpoint, host, reason string, duration time.Duration) models.ExitBan {
+	now := time.Now()
+	ban := models.ExitBan{
+		Exit:      endpoint.Address,
+		NodeID:    endpoint.NodeID,
+		Host:      host,
+		Reason:    reason,
+		BannedAt:  now,
+		ExpiresAt: now.Add(duration),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans[banKey(endpoint.Address, host)] = ban
+	b.changed = true
+	return ban
+}
+
+func (b *banTracker) list() []models.ExitBan {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	result := make([]models.ExitBan, 0, len(b.bans))
+	for key, ban := range b.bans {
+		if now.After(ban.ExpiresAt) {
+			delete(b.bans, key)
+			continue
+		}
+		result = append(result, ban)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].BannedAt.After(result[j].BannedAt)
+	})
+	return result
+}
+
+func (b *banTracker) clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans = make(map[string]models.ExitBan)
+	b.listed = make(map[string][]listedBan)
+	b.patterns = nil
+	b.changed = true
+}
+
+// importEntries adds entries, replacing those already listed for the same
+// prefix and destination. Entries that already expired are skipped. It
+// returns how many were added.
+func (b *banTracker) importEntries(entries []models.BanListEntry, now time.Time) (int, error) {
+	adding := make([]listedBan, 0, len(entries))
+	for i, e := range entries {
+		network, err := banlist.Network(e.Prefix)
+		if err != nil {
+			return 0, fmt.Errorf("entry %d: %w", i, err)
+		}
+		l := listedBan{entry: e, network: network, expires: banlist.Expiry(e, now)}
+		if !l.active(now) {
+			continue
+		}
+		l.entry.Prefix = network.String()
+		l.entry.Destination = strings.ToLower(e.Destination)
+		if l.entry.Destination == "" {
+			l.entry.Destination = "*"
+		}
+		adding = append(adding, l)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, l := range adding {
+		pattern := l.entry.Destination
+		existing, known := b.listed[pattern]
+		replaced := false
+		for i := range existing {
+			if existing[i].entry.Prefix == l.entry.Prefix {
+				existing[i], replaced = l, true
+				break
+			}
+		}
+		if !replaced {
+			b.listed[pattern] = append(existing, l)
+		}
+		if !known && matchesSeveral(pattern) {
+			b.patterns = append(b.patterns, pattern)
+		}
+	}
+	b.changed = b.changed || len(adding) > 0
+	return len(adding), nil
+}
+
+// matchesSeveral reports whether a destination pattern can match more
+// than one host, so it cannot be looked up by host.
+func matchesSeveral(pattern string) bool {
+	return strings.ContainsAny(pattern, "*/:")
+}
+
+// export lists the learned bans, as the exit's address, and the imported
+// ones still active. An address learned for several exits is listed once,
+// with the latest expiry. Expired imports are dropped.
+func (b *banTracker) export(now time.Time) models.BanList {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := models.BanList{GeneratedAt: now, Entries: []models.BanListEntry{}}
+	index := make(map[string]int)
+	add := func(e models.BanListEntry) {
+		key := e.Prefix + "|" + e.Destination
+		if i, ok := index[key]; ok {
+			if e.ExpiresAt == nil || (list.Entries[i].ExpiresAt != nil && e.ExpiresAt.After(*list.Entries[i].ExpiresAt)) {
+				list.Entries[i] = e
+			}
+			return
+		}
+		index[key] = len(list.Entries)
+		list.Entries = append(list.Entries, e)
+	}
+	withExpiry := func(e models.BanListEntry, expires time.Time) models.BanListEntry {
+		if !expires.IsZero() {
+			e.ExpiresAt = &expires
+			e.TTLSeconds = int64(expires.Sub(now).Round(time.Second) / time.Second)
+		}
+		return e
+	}
+
+	for _, ban := range b.bans {
+		if !now.Before(ban.ExpiresAt) {
+			continue
+		}
+		host, _, err := net.SplitHostPort(ban.Exit)
+		if err != nil {
+			continue
+		}
+		network, err := banlist.Network(host)
+		if err != nil {
+			continue
+		}
+		add(withExpiry(models.BanListEntry{Prefix: network.String(), Destination: ban.Host, Reason: ban.Reason}, ban.ExpiresAt))
+	}
+	for pattern, listed := range b.listed {
+		kept := listed[:0]
+		for _, l := range listed {
+			if l.active(now) {
+				kept = append(kept, l)
+				add(withExpiry(models.BanListEntry{Prefix: l.entry.Prefix, Destination: pattern, Reason: l.entry.Reason}, l.expires))
+			}
+		}
+		b.listed[pattern] = kept
+	}
+
+	sort.Slice(list.Entries, func(i, j int) bool {
+		a, c := list.Entries[i], list.Entries[j]
+		if a.Destination != c.Destination {
+			return a.Destination < c.Destination
+		}
+		return a.Prefix < c.Prefix
+	})
+	return list
+}
+
+// inspect checks resp against the rules for destination. When body markers
+// need to be checked the start of the body is buffered and resp.Body is
+// replaced so the caller can still stream the full response. Gzip and
+// deflate bodies are decoded before matching; the response itself is left
+// encoded.
+func (b *banTracker) inspect(destination string, resp *http.Response) (string, time.Duration, bool) {
+	var matching []models.BanRule
+	for _, rule := range b.getRules() {
+		if auth.MatchDestination(rule.Destination, destination) {
+			matching = append(matching, rule)
+		}
+	}
+	if len(matching) == 0 {
+		return "", 0, false
+	}
+
+	var prefix, scanned []byte
+	bodyRead := false
+
+	for _, rule := range matching {
+		duration := time.Duration(rule.BanSeconds) * time.Second
+		if duration <= 0 {
+			duration = defaultBanDuration
+		}
+
+		for _, code := range rule.StatusCodes {
+			if resp.StatusCode == code {
+				return fmt.Sprintf("status %d", code), duration, true
+			}
+		}
+
+		if len(rule.BodyMarkers) == 0 {
+			continue
+		}
+		if !bodyRead {
+			prefix, _ = io.ReadAll(io.LimitReader(resp.Body, maxBanInspectBytes))
+			resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body), Closer: resp.Body}
+			scanned = decodeBodyPrefix(resp.Header.Get("Content-Encoding"), prefix)
+			bodyRead = true
+		}
+		for _, marker := range rule.BodyMarkers {
+			if marker != "" && bytes.Contains(scanned, []byte(marker)) {
+				return fmt.Sprintf("body marker %q", marker), duration, true
+			}
+		}
+	}
+
+	return "", 0, false
+}
+
+// decodeBodyPrefix undoes the content encoding of the start of a body. The
+// prefix is usually cut off mid-stream, so whatever decodes before the
+// stream ends is kept. Encodings it cannot decode yield nothing to scan.
+func decodeBodyPrefix(encoding string, prefix []byte) []byte {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return prefix
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(prefix))
+		if err != nil {
+			return nil
+		}
+		reader = zr
+	case "deflate":
+		// Servers send deflate both zlib-wrapped, as specified, and raw
+		zr, err := zlib.NewReader(bytes.NewReader(prefix))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(prefix))
+		} else {
+			reader = zr
+		}
+	default:
+		return nil
+	}
+	decoded, _ := io.ReadAll(io.LimitReader(reader, maxBanInspectBytes))
+	return decoded
+}
+
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// SetBanRules replaces the ban detection rules.
+func (lb *LoadBalancer) SetBanRules(rules []models.BanRule) {
+	lb.bans.setRules(rules)
+	lb.logger.Infof("Ban detection configured with %d rules", len(rules))
+}
+
+func (lb *LoadBalancer) BanRules() []models.BanRule {
+	return lb.bans.getRules()
+}
+
+// Bans returns the currently active exit+destination exclusions.
+func (lb *LoadBalancer) Bans() []models.ExitBan {
+	return lb.bans.list()
+}
+
+func (lb *LoadBalancer) ClearBans() {
+	lb.bans.clear()
+	lb.logger.Info("Cleared all exit bans")
+}
+
+// ImportBans adds ban list entries, keeping exits on their prefixes from
+// their destinations. It returns how many entries were still active.
+func (lb *LoadBalancer) ImportBans(entries []models.BanListEntry) (int, error) {
+	return lb.bans.importEntries(entries, time.Now())
+}
+
+// ExportBans returns the learned and imported bans as a ban list.
+func (lb *LoadBalancer) ExportBans() models.BanList {
+	return lb.bans.export(time.Now())
+}
+
+// BanState returns the bans for persisting, and whether they changed since
+// the last call.
+func (lb *LoadBalancer) BanState() (models.BanList, bool) {
+	lb.bans.mu.Lock()
+	changed := lb.bans.changed
+	lb.bans.changed = false
+	lb.bans.mu.Unlock()
+	return lb.ExportBans(), changed
+}
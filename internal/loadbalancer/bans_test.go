@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestInspectEncodedBodyMarkers(t *testing.T) {
+	page := []byte("<html><body>Please solve this captcha to continue</body></html>")
+	encode := func(w io.WriteCloser, buf *bytes.Buffer) []byte {
+		w.Write(page)
+		w.Close()
+		return buf.Bytes()
+	}
+	var gz, zl, raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	bodies := map[string][]byte{
+		"":        page,
+		"gzip":    encode(gzip.NewWriter(&gz), &gz),
+		"deflate": encode(zlib.NewWriter(&zl), &zl),
+	}
+
+	b := &banTracker{rules: []models.BanRule{{Destination: "*", BodyMarkers: []string{"captcha"}}}}
+	check := func(encoding string, body []byte) {
+		t.Helper()
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))}
+		if encoding != "" {
+			resp.Header.Set("Content-Encoding", encoding)
+		}
+		if _, _, banned := b.inspect("shop.example", resp); !banned {
+			t.Errorf("marker in %q encoded body not found", encoding)
+		}
+		if streamed, _ := io.ReadAll(resp.Body); !bytes.Equal(streamed, body) {
+			t.Errorf("%q encoded body was altered for the client", encoding)
+		}
+	}
+	for encoding, body := range bodies {
+		check(encoding, body)
+	}
+	check("deflate", encode(fw, &raw))
+}
+
+func TestBanResponseRelayedWithoutOtherExit(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	exit := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, "slow down")
+	}))
+	exit.Listener = listener
+	exit.Start()
+	defer exit.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	lb := NewLoadBalancer(logger, time.Minute)
+	lb.SetBanRules(DefaultBanRules)
+	lb.UpdateProxies([]models.NodeInfo{{
+		NodeID: "node-1",
+		Proxies: []models.ProxyInstance{{
+			ID:     "p1",
+			IPv6:   models.IPv6Address{IP: net.ParseIP("::1")},
+			Port:   listener.Addr().(*net.TCPAddr).Port,
+			Status: models.ProxyStatusRunning,
+		}},
+	}})
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://shop.example/", nil))
+	if w.Code != http.StatusTooManyRequests || w.Body.String() != "slow down" {
+		t.Fatalf("banned response through the only exit: got %d %q, want the exit's 429", w.Code, w.Body.String())
+	}
+}
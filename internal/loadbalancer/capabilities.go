@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"errors"
+
+	"proxy-v6/pkg/models"
+)
+
+// trafficKind is the kind of client traffic an exit must support.
+type trafficKind int
+
+const (
+	trafficHTTP trafficKind = iota
+	trafficConnect
+)
+
+var errNoCompatibleExit = errors.New("no exit supports this kind of traffic")
+
+func (k trafficKind) String() string {
+	switch k {
+	case trafficConnect:
+		return "CONNECT"
+	default:
+		return "HTTP"
+	}
+}
+
+// supportedBy reports whether an exit with caps can carry traffic of kind k.
+func (k trafficKind) supportedBy(caps models.Capabilities) bool {
+	switch k {
+	case trafficConnect:
+		return caps.Connect
+	default:
+		return caps.HTTP
+	}
+}
+
+// exitLimit returns the concurrency cap for an exit: the smaller of the
+// configured per-exit limit and what the exit's backend advertises, with 0
+// meaning unlimited.
+func exitLimit(maxPerExit int, caps models.Capabilities) int {
+	if caps.MaxClients > 0 && (maxPerExit == 0 || caps.MaxClients < maxPerExit) {
+		return caps.MaxClients
+	}
+	return maxPerExit
+}
+
+// nodeCapabilities returns what node advertises, assuming the original
+// tinyproxy feature set for agents that predate capability reporting.
+func nodeCapabilities(node models.NodeInfo) models.Capabilities {
+	if node.Capabilities != nil {
+		return *node.Capabilities
+	}
+	return models.Capabilities{Backend: "tinyproxy", HTTP: true, Connect: true}
+}
@@ -0,0 +1,274 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/auth"
+	"proxy-v6/pkg/models"
+)
+
+// ProxyConstraintsHeader carries pool constraints for one request, such as
+// "distinct-prefix=48; distinct-last=5; exclude-asn=64500,64501". It is
+// removed before the request is forwarded.
+const ProxyConstraintsHeader = "X-Proxy-Constraints"
+
+const (
+	// historyIdle is how long the recent exits of a client that stopped
+	// sending requests are remembered.
+	historyIdle          = time.Hour
+	historySweepInterval = time.Minute
+)
+
+var errConstraintsUnmet = errors.New("no exit satisfies the pool constraints")
+
+// takeConstraints reads the pool constraints header from r and strips it so
+// it does not reach the destination.
+func takeConstraints(r *http.Request) (models.PoolConstraints, error) {
+	header := r.Header.Get(ProxyConstraintsHeader)
+	r.Header.Del(ProxyConstraintsHeader)
+
+	var c models.PoolConstraints
+	for _, part := range strings.Split(header, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(part, "=")
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "distinct-prefix":
+			c.DistinctPrefix, err = strconv.Atoi(strings.TrimPrefix(value, "/"))
+		case "distinct-last":
+			c.DistinctLast, err = strconv.Atoi(value)
+		case "exclude-asn":
+			for _, asn := range strings.Split(value, ",") {
+				asn = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(asn)), "AS")
+				n, convErr := strconv.Atoi(asn)
+				if convErr != nil {
+					err = convErr
+					break
+				}
+				c.ExcludeASNs = append(c.ExcludeASNs, n)
+			}
+		default:
+			return c, fmt.Errorf("unknown pool constraint %q in %s", key, ProxyConstraintsHeader)
+		}
+		if err != nil {
+			return c, fmt.Errorf("invalid %s in %s: %q", key, ProxyConstraintsHeader, value)
+		}
+	}
+	if err := auth.ValidateConstraints(c); err != nil {
+		return c, fmt.Errorf("%s: %w", ProxyConstraintsHeader, err)
+	}
+	return c, nil
+}
+
+// combineConstraints applies a user's constraints and a request's together:
+// excluded ASNs add up, and the shorter prefix and longer look-back win.
+func combineConstraints(a, b models.PoolConstraints) models.PoolConstraints {
+	c := models.PoolConstraints{
+		DistinctPrefix: a.DistinctPrefix,
+		DistinctLast:   max(a.DistinctLast, b.DistinctLast),
+		ExcludeASNs:    append(append([]int(nil), a.ExcludeASNs...), b.ExcludeASNs...),
+	}
+	if c.DistinctPrefix == 0 || (b.DistinctPrefix > 0 && b.DistinctPrefix < c.DistinctPrefix) {
+		c.DistinctPrefix = b.DistinctPrefix
+	}
+	return c
+}
+
+// historyKey identifies the client whose recent exits distinct constraints
+// look at: the user when there is one, the client IP otherwise.
+func historyKey(client string, user *models.User) string {
+	if user != nil {
+		return "user " + user.Username
+	}
+	return "ip " + client
+}
+
+// constraintFilter rules out exits for one selection.
+type constraintFilter struct {
+	length   int
+	avoid    map[string]bool // networks of the client's recent exits
+	excluded map[int]bool
+}
+
+// constraintFilterLocked builds the filter for sel, or nil when it has no
+// constraints.
+func (lb *LoadBalancer) constraintFilterLocked(sel selection) *constraintFilter {
+	c := sel.constraints
+	if c.DistinctLast == 0 && len(c.ExcludeASNs) == 0 {
+		return nil
+	}
+	f := &constraintFilter{excluded: make(map[int]bool, len(c.ExcludeASNs))}
+	for _, asn := range c.ExcludeASNs {
+		f.excluded[asn] = true
+	}
+	if c.DistinctLast > 0 {
+		f.length = c.DistinctPrefix
+		if f.length == 0 {
+			f.length = 128
+		}
+		f.avoid = make(map[string]bool, c.DistinctLast)
+		for _, ip := range lb.history.recent(sel.history, c.DistinctLast) {
+			f.avoid[prefixOf(ip, f.length)] = true
+		}
+	}
+	return f
+}
+
+func (f *constraintFilter) allows(ip string, origins *originTable) bool {
+	if f.avoid != nil && f.avoid[prefixOf(ip, f.length)] {
+		return false
+	}
+	if len(f.excluded) > 0 {
+		if asn, ok := origins.asn(ip); ok && f.excluded[asn] {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixOf returns the network of ip under the given prefix length, or ""
+// for an unparsable address. IPv4 addresses use at most 32 bits.
+func prefixOf(ip string, length int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	bits := 128
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, bits = v4, 32
+	}
+	if length > bits {
+		length = bits
+	}
+	network := &net.IPNet{IP: parsed.Mask(net.CIDRMask(length, bits)), Mask: net.CIDRMask(length, bits)}
+	return network.String()
+}
+
+// exitHistory remembers the last exits each client was given, newest last.
+type exitHistory struct {
+	clients   map[string]*recentExits
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+type recentExits struct {
+	ips  []string
+	seen time.Time
+}
+
+func newExitHistory() *exitHistory {
+	return &exitHistory{clients: make(map[string]*recentExits)}
+}
+
+func (h *exitHistory) record(client, ip string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	recent, ok := h.clients[client]
+	if !ok {
+		recent = &recentExits{}
+		h.clients[client] = recent
+	}
+	recent.ips = append(recent.ips, ip)
+	if len(recent.ips) > auth.MaxDistinctLast {
+		recent.ips = recent.ips[len(recent.ips)-auth.MaxDistinctLast:]
+	}
+	recent.seen = now
+
+	if now.Sub(h.lastSweep) >= historySweepInterval {
+		h.lastSweep = now
+		for key, r := range h.clients {
+			if now.Sub(r.seen) > historyIdle {
+				delete(h.clients, key)
+			}
+		}
+	}
+}
+
+// recent returns up to n of client's last exits.
+func (h *exitHistory) recent(client string, n int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r, ok := h.clients[client]
+	if !ok {
+		return nil
+	}
+	ips := r.ips
+	if len(ips) > n {
+		ips = ips[len(ips)-n:]
+	}
+	return append([]string(nil), ips...)
+}
+
+// originTable maps exit prefixes to the ASN they are announced from.
+type originTable struct {
+	origins  []models.PrefixOrigin
+	networks []originNetwork // longest prefix first
+	mu       sync.RWMutex
+}
+
+type originNetwork struct {
+	network *net.IPNet
+	asn     int
+}
+
+func (t *originTable) asn(ip string) (int, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, n := range t.networks {
+		if n.network.Contains(parsed) {
+			return n.asn, true
+		}
+	}
+	return 0, false
+}
+
+// SetPrefixOrigins replaces the ASNs recorded for exit prefixes.
+func (lb *LoadBalancer) SetPrefixOrigins(origins []models.PrefixOrigin) error {
+	networks := make([]originNetwork, 0, len(origins))
+	for i, origin := range origins {
+		_, network, err := net.ParseCIDR(origin.Prefix)
+		if err != nil {
+			return fmt.Errorf("prefix origin %d: invalid prefix %q", i, origin.Prefix)
+		}
+		if origin.ASN <= 0 {
+			return fmt.Errorf("prefix origin %d (%s): asn must be positive", i, origin.Prefix)
+		}
+		networks = append(networks, originNetwork{network: network, asn: origin.ASN})
+	}
+	sort.SliceStable(networks, func(i, j int) bool {
+		a, _ := networks[i].network.Mask.Size()
+		b, _ := networks[j].network.Mask.Size()
+		return a > b
+	})
+
+	lb.origins.mu.Lock()
+	lb.origins.origins = append([]models.PrefixOrigin(nil), origins...)
+	lb.origins.networks = networks
+	lb.origins.mu.Unlock()
+	lb.logger.Infof("Prefix origins configured for %d prefixes", len(origins))
+	return nil
+}
+
+func (lb *LoadBalancer) PrefixOrigins() []models.PrefixOrigin {
+	lb.origins.mu.RLock()
+	defer lb.origins.mu.RUnlock()
+	return append([]models.PrefixOrigin{}, lb.origins.origins...)
+}
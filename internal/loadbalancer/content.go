@@ -0,0 +1,172 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/internal/auth"
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons a response is blocked by a content policy.
+const (
+	blockedType = "type"
+	blockedSize = "size"
+)
+
+var (
+	errContentBlocked    = errors.New("response content type is blocked")
+	errResponseTooLarge  = errors.New("response exceeds the size limit")
+	contentBlockedTotals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_content_blocked_total",
+		Help: "Proxied responses refused or cut off by content policies, by reason (type, size) and user.",
+	}, []string{"reason", "user"})
+)
+
+// contentFilter holds the pool-wide content policy and counts responses
+// blocked by it or by user policies.
+type contentFilter struct {
+	pool    models.ContentPolicy
+	blocked map[string]uint64 // reason -> responses
+	mu      sync.Mutex
+}
+
+func newContentFilter() *contentFilter {
+	return &contentFilter{blocked: make(map[string]uint64)}
+}
+
+// policy combines the pool policy with user's own.
+func (f *contentFilter) policy(user *models.User) models.ContentPolicy {
+	f.mu.Lock()
+	policy := models.ContentPolicy{
+		MaxResponseBytes: f.pool.MaxResponseBytes,
+		BlockedTypes:     append([]string(nil), f.pool.BlockedTypes...),
+	}
+	f.mu.Unlock()
+	if user == nil {
+		return policy
+	}
+	if limit := user.Content.MaxResponseBytes; limit > 0 && (policy.MaxResponseBytes == 0 || limit < policy.MaxResponseBytes) {
+		policy.MaxResponseBytes = limit
+	}
+	policy.BlockedTypes = append(policy.BlockedTypes, user.Content.BlockedTypes...)
+	return policy
+}
+
+func (f *contentFilter) record(reason string, user *models.User) {
+	username := ""
+	if user != nil {
+		username = user.Username
+	}
+	contentBlockedTotals.WithLabelValues(reason, username).Inc()
+	f.mu.Lock()
+	f.blocked[reason]++
+	f.mu.Unlock()
+}
+
+// screen applies the content policy for user to resp before it is written.
+// Responses of a blocked type or with a declared length over the limit are
+// refused. The body of a response of unknown length is capped instead, and
+// the returned cappedBody reports whether it was cut off.
+func (lb *LoadBalancer) screen(user *models.User, resp *http.Response) (*cappedBody, error) {
+	policy := lb.content.policy(user)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		for _, pattern := range policy.BlockedTypes {
+			if auth.MatchContentType(pattern, contentType) {
+				lb.content.record(blockedType, user)
+				return nil, fmt.Errorf("%w: %s", errContentBlocked, contentType)
+			}
+		}
+	}
+	if policy.MaxResponseBytes == 0 {
+		return nil, nil
+	}
+	if resp.ContentLength > policy.MaxResponseBytes {
+		lb.content.record(blockedSize, user)
+		return nil, fmt.Errorf("%w of %d bytes", errResponseTooLarge, policy.MaxResponseBytes)
+	}
+	if resp.ContentLength >= 0 {
+		return nil, nil
+	}
+	capped := &cappedBody{ReadCloser: resp.Body, remaining: policy.MaxResponseBytes, onExceed: func() {
+		lb.content.record(blockedSize, user)
+	}}
+	resp.Body = capped
+	return capped, nil
+}
+
+// cappedBody fails reads once more than remaining bytes were read, so a
+// streamed response over the limit is cut off instead of delivered whole.
+type cappedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+	onExceed  func()
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errResponseTooLarge
+	}
+	// Read one byte past the limit to tell a body that ends exactly at it
+	// from one that goes on
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.exceeded = true
+		b.onExceed()
+		return n, errResponseTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// SetContentPolicy replaces the pool-wide content policy applied to every
+// proxied HTTP response.
+func (lb *LoadBalancer) SetContentPolicy(policy models.ContentPolicy) error {
+	if err := auth.ValidateContentPolicy(policy); err != nil {
+		return err
+	}
+	lb.content.mu.Lock()
+	lb.content.pool = policy
+	lb.content.mu.Unlock()
+	lb.logger.Infof("Content policy: max response %d bytes, %d blocked types", policy.MaxResponseBytes, len(policy.BlockedTypes))
+	return nil
+}
+
+func (lb *LoadBalancer) ContentPolicy() models.ContentPolicy {
+	lb.content.mu.Lock()
+	defer lb.content.mu.Unlock()
+	return lb.content.pool
+}
+
+// ContentBlocked returns how many responses content policies refused or
+// cut off since start, by reason.
+func (lb *LoadBalancer) ContentBlocked() map[string]uint64 {
+	lb.content.mu.Lock()
+	defer lb.content.mu.Unlock()
+	counts := make(map[string]uint64, len(lb.content.blocked))
+	for reason, n := range lb.content.blocked {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// writeContentError answers a response refused by screen.
+func writeContentError(w http.ResponseWriter, err error, attempted ...string) {
+	code := apierror.CodeContentBlocked
+	if errors.Is(err, errResponseTooLarge) {
+		code = apierror.CodeResponseTooLarge
+	}
+	writeError(w, http.StatusForbidden, code, err.Error(), attempted...)
+}
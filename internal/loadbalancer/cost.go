@@ -0,0 +1,36 @@
+package loadbalancer
+
+// bytesPerGB is the unit egress is priced in, decimal as providers bill it.
+const bytesPerGB = 1e9
+
+// cheapest narrows candidates to the exits with the lowest egress price,
+// so least-cost only falls back to dearer nodes once the cheaper ones are
+// unhealthy, excluded or at capacity. Exits of unpriced nodes come after
+// every priced one.
+func cheapest(candidates []ProxyEndpoint) []ProxyEndpoint {
+	var lowest *float64
+	for _, p := range candidates {
+		if p.CostPerGB != nil && (lowest == nil || *p.CostPerGB < *lowest) {
+			lowest = p.CostPerGB
+		}
+	}
+	if lowest == nil {
+		return candidates
+	}
+	kept := make([]ProxyEndpoint, 0, len(candidates))
+	for _, p := range candidates {
+		if p.CostPerGB != nil && *p.CostPerGB == *lowest {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// egressCost is what moving bytes through the exit costs, 0 when its node
+// is unpriced.
+func egressCost(p *ProxyEndpoint, bytes int64) float64 {
+	if p == nil || p.CostPerGB == nil {
+		return 0
+	}
+	return float64(bytes) / bytesPerGB * *p.CostPerGB
+}
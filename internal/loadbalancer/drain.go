@@ -0,0 +1,211 @@
+package loadbalancer
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"proxy-v6/internal/audit"
+	"proxy-v6/pkg/models"
+)
+
+// DrainNode stops routing new requests and tunnels to every exit on nodeID.
+// Work already in flight is left to finish.
+func (lb *LoadBalancer) DrainNode(nodeID string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if _, ok := lb.drained[nodeID]; !ok {
+		lb.drained[nodeID] = time.Now()
+		lb.drainedInFlight[nodeID] = lb.nodeInFlightLocked(nodeID)
+		lb.logger.Infof("Draining node %s", nodeID)
+	}
+}
+
+func (lb *LoadBalancer) UndrainNode(nodeID string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if _, ok := lb.drained[nodeID]; ok {
+		delete(lb.drained, nodeID)
+		delete(lb.drainedInFlight, nodeID)
+		delete(lb.maintenance, nodeID)
+		lb.logger.Infof("Node %s returned to rotation", nodeID)
+	}
+}
+
+// applyMaintenanceLocked drains the nodes whose agents report maintenance
+// and returns them to rotation once they stop, or when they are gone. Nodes
+// drained by hand are left as they are.
+func (lb *LoadBalancer) applyMaintenanceLocked(nodes []models.NodeInfo) {
+	reported := make(map[string]bool)
+	for _, node := range nodes {
+		if !node.Maintenance {
+			continue
+		}
+		reported[node.NodeID] = true
+		if _, ok := lb.drained[node.NodeID]; ok {
+			continue
+		}
+		lb.drained[node.NodeID] = time.Now()
+		lb.drainedInFlight[node.NodeID] = lb.nodeInFlightLocked(node.NodeID)
+		lb.maintenance[node.NodeID] = true
+		lb.logger.Infof("Node %s reports maintenance, draining it", node.NodeID)
+		if lb.auditTrail != nil {
+			lb.auditTrail.Record(audit.Entry{Event: "node_maintenance_reported", Detail: node.NodeID})
+		}
+	}
+	for nodeID := range lb.maintenance {
+		if reported[nodeID] {
+			continue
+		}
+		delete(lb.maintenance, nodeID)
+		delete(lb.drained, nodeID)
+		delete(lb.drainedInFlight, nodeID)
+		lb.logger.Infof("Node %s no longer reports maintenance and returned to rotation", nodeID)
+	}
+}
+
+// DrainedNodes returns the IDs of nodes currently drained.
+func (lb *LoadBalancer) DrainedNodes() []string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	nodes := make([]string, 0, len(lb.drained))
+	for nodeID := range lb.drained {
+		nodes = append(nodes, nodeID)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// NodeInFlight returns the number of requests and tunnels currently using
+// exits on nodeID.
+func (lb *LoadBalancer) NodeInFlight(nodeID string) int64 {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.nodeInFlightLocked(nodeID)
+}
+
+func (lb *LoadBalancer) nodeInFlightLocked(nodeID string) int64 {
+	var total int64
+	for _, p := range lb.proxies {
+		if p.NodeID == nodeID {
+			total += lb.inflight.count(p.Address)
+		}
+	}
+	return total
+}
+
+// DrainSelf makes the coordinator refuse new proxy requests and tunnels,
+// and report itself unhealthy, so a load balancer in front moves clients
+// to other coordinators. Work already in flight is left to finish.
+func (lb *LoadBalancer) DrainSelf() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.selfDrained.IsZero() {
+		lb.selfDrained = time.Now()
+		lb.selfDrainedInFlight = lb.totalInFlight()
+		lb.logger.Infof("Draining the coordinator")
+	}
+}
+
+// UndrainSelf accepts proxy requests again.
+func (lb *LoadBalancer) UndrainSelf() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if !lb.selfDrained.IsZero() {
+		lb.selfDrained = time.Time{}
+		lb.selfDrainedInFlight = 0
+		lb.logger.Infof("Coordinator accepts proxy requests again")
+	}
+}
+
+// SelfDraining reports whether the coordinator is draining itself.
+func (lb *LoadBalancer) SelfDraining() bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return !lb.selfDrained.IsZero()
+}
+
+// DrainStatus reports how much work is left on the coordinator and on each
+// drained node, for automation that waits for them to go quiet.
+func (lb *LoadBalancer) DrainStatus() models.DrainStatus {
+	tunnels := lb.tunnels.list()
+
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	now := time.Now()
+
+	self := models.DrainProgress{
+		Draining:        !lb.selfDrained.IsZero(),
+		Since:           lb.selfDrained,
+		Tunnels:         int64(len(tunnels)),
+		Queued:          int(atomic.LoadInt64(&lb.queue.depth)),
+		InitialInFlight: lb.selfDrainedInFlight,
+	}
+	self.Requests = lb.totalInFlight() - self.Tunnels
+	if len(tunnels) > 0 {
+		self.OldestTunnel = tunnels[0].StartedAt
+	}
+	estimateDrain(&self, now)
+
+	status := models.DrainStatus{Coordinator: self, Nodes: make([]models.DrainProgress, 0, len(lb.drained))}
+	for nodeID, since := range lb.drained {
+		node := models.DrainProgress{
+			NodeID:          nodeID,
+			Draining:        true,
+			Since:           since,
+			InitialInFlight: lb.drainedInFlight[nodeID],
+		}
+		// Oldest first, so the first tunnel of the node is its oldest
+		for _, t := range tunnels {
+			if t.NodeID == nodeID {
+				if node.Tunnels == 0 {
+					node.OldestTunnel = t.StartedAt
+				}
+				node.Tunnels++
+			}
+		}
+		node.Requests = lb.nodeInFlightLocked(nodeID) - node.Tunnels
+		estimateDrain(&node, now)
+		status.Nodes = append(status.Nodes, node)
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].NodeID < status.Nodes[j].NodeID })
+	return status
+}
+
+// totalInFlight counts the requests and tunnels on every exit.
+func (lb *LoadBalancer) totalInFlight() int64 {
+	var total int64
+	for _, n := range lb.inflight.snapshot() {
+		total += n
+	}
+	return total
+}
+
+// estimateDrain marks p quiescent when nothing is left, and otherwise
+// projects when the rest finishes from the rate work finished at so far.
+func estimateDrain(p *models.DrainProgress, now time.Time) {
+	if p.Requests < 0 {
+		// Tunnels are counted on their exit a moment after they register
+		p.Requests = 0
+	}
+	remaining := p.Requests + p.Tunnels + int64(p.Queued)
+	if remaining == 0 {
+		p.Quiescent = true
+		return
+	}
+	if !p.Draining {
+		return
+	}
+	finished := p.InitialInFlight - remaining
+	elapsed := now.Sub(p.Since)
+	if finished <= 0 || elapsed <= 0 {
+		return
+	}
+	eta := now.Add(time.Duration(float64(elapsed) * float64(remaining) / float64(finished)))
+	p.EstimatedCompletion = &eta
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"proxy-v6/internal/audit"
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var duplicateAddresses = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "proxy_v6_lb_duplicate_addresses",
+	Help: "Addresses reported by more than one node, whose exits are kept out of the pool.",
+})
+
+// DuplicateAddresses lists the addresses more than one node currently
+// reports, oldest first.
+func (lb *LoadBalancer) DuplicateAddresses() []models.DuplicateAddress {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	result := make([]models.DuplicateAddress, 0, len(lb.duplicates))
+	for _, d := range lb.duplicates {
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Since.Equal(result[j].Since) {
+			return result[i].Since.Before(result[j].Since)
+		}
+		return result[i].IP < result[j].IP
+	})
+	return result
+}
+
+// findDuplicatesLocked returns the addresses that more than one node runs
+// a proxy on, as happens with overlapping prefixes or cloned VMs. Nodes
+// that start reporting the same address are logged and audited, and the
+// time they were first seen is kept until only one node is left.
+func (lb *LoadBalancer) findDuplicatesLocked(nodes []models.NodeInfo, now time.Time) map[string]bool {
+	owners := make(map[string][]string)
+	for _, node := range nodes {
+		seen := make(map[string]bool)
+		for _, proxy := range node.Proxies {
+			if proxy.IPv6.IP == nil || proxy.Status == models.ProxyStatusStopped || proxy.Status == models.ProxyStatusError {
+				continue
+			}
+			ip := proxy.IPv6.IP.String()
+			if !seen[ip] {
+				seen[ip] = true
+				owners[ip] = append(owners[ip], node.NodeID)
+			}
+		}
+	}
+
+	current := make(map[string]models.DuplicateAddress)
+	for ip, nodeIDs := range owners {
+		if len(nodeIDs) < 2 {
+			continue
+		}
+		sort.Strings(nodeIDs)
+		d := models.DuplicateAddress{IP: ip, Nodes: nodeIDs, Since: now}
+		prev, ok := lb.duplicates[ip]
+		if ok {
+			d.Since = prev.Since
+		}
+		if !ok || strings.Join(prev.Nodes, ",") != strings.Join(nodeIDs, ",") {
+			lb.logger.Errorf("Address %s is reported by nodes %s, keeping its exits out of the pool", ip, strings.Join(nodeIDs, ", "))
+			if lb.auditTrail != nil {
+				lb.auditTrail.Record(audit.Entry{
+					Event:  "duplicate_address",
+					Detail: fmt.Sprintf("ip=%s nodes=%s", ip, strings.Join(nodeIDs, ",")),
+				})
+			}
+		}
+		current[ip] = d
+	}
+	for ip, prev := range lb.duplicates {
+		if _, ok := current[ip]; !ok {
+			lb.logger.Infof("Address %s is no longer reported by several nodes (was %s)", ip, strings.Join(prev.Nodes, ", "))
+		}
+	}
+	lb.duplicates = current
+	duplicateAddresses.Set(float64(len(current)))
+
+	duplicated := make(map[string]bool, len(current))
+	for ip := range current {
+		duplicated[ip] = true
+	}
+	return duplicated
+}
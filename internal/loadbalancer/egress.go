@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Response headers naming the exit a request left through, added when
+// SetEgressHeaders is on.
+const (
+	EgressIPHeader   = "X-Egress-IP"
+	EgressNodeHeader = "X-Egress-Node"
+)
+
+// SetEgressHeaders controls whether responses tell clients which IPv6
+// address and node carried their request. It is off by default so a
+// client learns nothing about the pool it is using.
+func (lb *LoadBalancer) SetEgressHeaders(enabled bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.egressHeaders = enabled
+	if enabled {
+		lb.logger.Info("Egress headers enabled on proxied responses")
+	}
+}
+
+func (lb *LoadBalancer) egressHeadersEnabled() bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.egressHeaders
+}
+
+// setEgress adds the egress headers for proxy to h, replacing any the
+// destination sent.
+func (lb *LoadBalancer) setEgress(h http.Header, proxy *ProxyEndpoint) {
+	if !lb.egressHeadersEnabled() {
+		return
+	}
+	h.Set(EgressIPHeader, proxy.IP)
+	h.Set(EgressNodeHeader, proxy.NodeID)
+}
+
+// connectEstablished is the reply to a CONNECT once the exit accepted it.
+func (lb *LoadBalancer) connectEstablished(proxy *ProxyEndpoint) []byte {
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 200 Connection Established\r\n")
+	if lb.egressHeadersEnabled() {
+		fmt.Fprintf(&b, "%s: %s\r\n%s: %s\r\n", EgressIPHeader, proxy.IP, EgressNodeHeader, proxy.NodeID)
+	}
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
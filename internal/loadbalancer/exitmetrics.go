@@ -0,0 +1,147 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	exitSelections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_exit_selections_total",
+		Help: "Requests and tunnels routed to each exit",
+	}, []string{"node", "instance"})
+	exitErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_exit_errors_total",
+		Help: "Requests and tunnels through each exit that failed at the exit or upstream",
+	}, []string{"node", "instance"})
+	// Latency is labelled by node only: a histogram per exit would be a
+	// dozen series for every address in the pool.
+	exitLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_v6_lb_exit_latency_seconds",
+		Help:    "Time until an exit answered a request or tunnel setup, per node",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"node"})
+
+	exitStatesDesc = prometheus.NewDesc("proxy_v6_lb_exits",
+		"Exits in the pool by node and state (healthy, unhealthy, standby)",
+		[]string{"node", "state"}, nil)
+)
+
+type exitSeries struct {
+	node     string
+	instance string
+}
+
+// exitMetrics tracks which exits have published series, so exits leaving
+// the pool do not leave their series behind.
+type exitMetrics struct {
+	published map[exitSeries]bool
+	nodes     map[string]bool
+	mu        sync.Mutex
+}
+
+func newExitMetrics() *exitMetrics {
+	return &exitMetrics{
+		published: make(map[exitSeries]bool),
+		nodes:     make(map[string]bool),
+	}
+}
+
+func (em *exitMetrics) track(endpoint *ProxyEndpoint) {
+	em.mu.Lock()
+	em.published[exitSeries{node: endpoint.NodeID, instance: endpoint.InstanceID}] = true
+	em.nodes[endpoint.NodeID] = true
+	em.mu.Unlock()
+}
+
+func (em *exitMetrics) selected(endpoint *ProxyEndpoint) {
+	em.track(endpoint)
+	exitSelections.WithLabelValues(endpoint.NodeID, endpoint.InstanceID).Inc()
+}
+
+func (em *exitMetrics) outcome(endpoint *ProxyEndpoint, failed bool, latency time.Duration) {
+	em.track(endpoint)
+	if failed {
+		exitErrors.WithLabelValues(endpoint.NodeID, endpoint.InstanceID).Inc()
+	}
+	exitLatency.WithLabelValues(endpoint.NodeID).Observe(latency.Seconds())
+}
+
+// prune deletes the series of exits and nodes no longer in proxies.
+func (em *exitMetrics) prune(proxies []ProxyEndpoint) {
+	current := make(map[exitSeries]bool, len(proxies))
+	currentNodes := make(map[string]bool)
+	for _, p := range proxies {
+		current[exitSeries{node: p.NodeID, instance: p.InstanceID}] = true
+		currentNodes[p.NodeID] = true
+	}
+
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	for series := range em.published {
+		if !current[series] {
+			exitSelections.DeleteLabelValues(series.node, series.instance)
+			exitErrors.DeleteLabelValues(series.node, series.instance)
+			delete(em.published, series)
+		}
+	}
+	for node := range em.nodes {
+		if !currentNodes[node] {
+			exitLatency.DeleteLabelValues(node)
+			delete(em.nodes, node)
+		}
+	}
+}
+
+// exitCollector reports the pool's exit states when scraped, so the gauges
+// never lag behind health checks.
+type exitCollector struct {
+	lb *LoadBalancer
+}
+
+// Collector returns a collector for the exit state gauges. Register it once
+// per load balancer.
+func (lb *LoadBalancer) Collector() prometheus.Collector {
+	return exitCollector{lb: lb}
+}
+
+func (c exitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- exitStatesDesc
+}
+
+func (c exitCollector) Collect(ch chan<- prometheus.Metric) {
+	for node, n := range c.lb.ExitCounts() {
+		ch <- prometheus.MustNewConstMetric(exitStatesDesc, prometheus.GaugeValue, float64(n.Healthy), node, "healthy")
+		ch <- prometheus.MustNewConstMetric(exitStatesDesc, prometheus.GaugeValue, float64(n.Unhealthy), node, "unhealthy")
+		ch <- prometheus.MustNewConstMetric(exitStatesDesc, prometheus.GaugeValue, float64(n.Standby), node, "standby")
+	}
+}
+
+// ExitCounts is how many exits of a node are in each state.
+type ExitCounts struct {
+	Healthy, Unhealthy, Standby int
+}
+
+// ExitCounts counts the exits of each node by state. Nodes without exits
+// are left out.
+func (lb *LoadBalancer) ExitCounts() map[string]ExitCounts {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	byNode := make(map[string]ExitCounts)
+	for _, p := range lb.proxies {
+		n := byNode[p.NodeID]
+		switch {
+		case p.Standby:
+			n.Standby++
+		case p.Healthy:
+			n.Healthy++
+		default:
+			n.Unhealthy++
+		}
+		byNode[p.NodeID] = n
+	}
+	return byNode
+}
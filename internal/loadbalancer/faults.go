@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/pkg/models"
+)
+
+// faultInjector applies the configured FaultConfig to proxied requests. It
+// is inert until the coordinator enables it explicitly.
+type faultInjector struct {
+	enabled bool
+	config  models.FaultConfig
+	mu      sync.RWMutex
+}
+
+func (f *faultInjector) get() (models.FaultConfig, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.config, f.enabled
+}
+
+// before runs ahead of proxy selection. It returns false when the request
+// was dropped or failed and must not be forwarded.
+func (f *faultInjector) before(w http.ResponseWriter) bool {
+	cfg, enabled := f.get()
+	if !enabled {
+		return true
+	}
+
+	if cfg.LatencyMs > 0 || cfg.LatencyJitterMs > 0 {
+		delay := time.Duration(cfg.LatencyMs) * time.Millisecond
+		if cfg.LatencyJitterMs > 0 {
+			delay += time.Duration(rand.Intn(cfg.LatencyJitterMs)) * time.Millisecond
+		}
+		time.Sleep(delay)
+	}
+
+	if cfg.DropPercent > 0 && rand.Float64()*100 < cfg.DropPercent {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return false
+			}
+		}
+		// Fall back to an error when the connection can't be taken over
+		writeError(w, http.StatusBadGateway, apierror.CodeFaultInjected, "Injected fault: dropped")
+		return false
+	}
+
+	if cfg.ErrorPercent > 0 && rand.Float64()*100 < cfg.ErrorPercent {
+		status := cfg.ErrorStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		writeError(w, status, apierror.CodeFaultInjected, "Injected fault")
+		return false
+	}
+
+	return true
+}
+
+// exitFails reports whether requests through proxy should fail.
+func (f *faultInjector) exitFails(proxy *ProxyEndpoint) bool {
+	cfg, enabled := f.get()
+	if !enabled {
+		return false
+	}
+	for _, target := range cfg.FailExits {
+		if target == proxy.Address || target == proxy.IP || target == proxy.NodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableFaultInjection allows faults to be configured at runtime. Until it
+// is called SetFaults is rejected.
+func (lb *LoadBalancer) EnableFaultInjection() {
+	lb.faults.mu.Lock()
+	defer lb.faults.mu.Unlock()
+	lb.faults.enabled = true
+	lb.logger.Warn("Fault injection enabled - do not use in production")
+}
+
+func (lb *LoadBalancer) SetFaults(cfg models.FaultConfig) error {
+	lb.faults.mu.Lock()
+	defer lb.faults.mu.Unlock()
+
+	if !lb.faults.enabled {
+		return fmt.Errorf("fault injection is disabled")
+	}
+	if cfg.DropPercent < 0 || cfg.DropPercent > 100 || cfg.ErrorPercent < 0 || cfg.ErrorPercent > 100 {
+		return fmt.Errorf("percentages must be between 0 and 100")
+	}
+	if cfg.LatencyMs < 0 || cfg.LatencyJitterMs < 0 {
+		return fmt.Errorf("latency must not be negative")
+	}
+	lb.faults.config = cfg
+	lb.logger.Warnf("Fault injection configured: %+v", cfg)
+	return nil
+}
+
+func (lb *LoadBalancer) Faults() models.FaultConfig {
+	cfg, _ := lb.faults.get()
+	return cfg
+}
@@ -0,0 +1,21 @@
+package loadbalancer
+
+// HealthWatcher is told whenever an exit turns healthy or unhealthy, by a
+// health check or by the requests through it. It is called with the
+// balancer locked and must not block.
+type HealthWatcher interface {
+	ExitHealthChanged(exit ProxyEndpoint, reason string)
+}
+
+// SetHealthWatcher reports every health flap of an exit to w.
+func (lb *LoadBalancer) SetHealthWatcher(w HealthWatcher) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.healthWatcher = w
+}
+
+func (lb *LoadBalancer) healthChangedLocked(exit ProxyEndpoint, reason string) {
+	if lb.healthWatcher != nil {
+		lb.healthWatcher.ExitHealthChanged(exit, reason)
+	}
+}
@@ -0,0 +1,157 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/apierror"
+)
+
+const (
+	// ProtocolConnectTCP is the :protocol of an extended CONNECT that asks
+	// for a TCP tunnel, the target named in its path.
+	ProtocolConnectTCP = "connect-tcp"
+	// connectTCPPath is the path template of connect-tcp requests,
+	// followed by {host}/{port}/.
+	connectTCPPath = "/.well-known/masque/tcp/"
+)
+
+// HTTP3Handler serves tunnels to HTTP/3 clients. A plain CONNECT names the
+// target as its authority, an extended CONNECT with protocol connect-tcp
+// in its path, e.g. /.well-known/masque/tcp/example.com/443/. Either way
+// the tunnel is carried on the request stream, and the leg to the exit is
+// TCP as for every other client. Other requests are refused, as HTTP/3
+// gives them no way to name an absolute-form target.
+func (lb *LoadBalancer) HTTP3Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			writeError(w, http.StatusMethodNotAllowed, apierror.CodeNotSupported, "Only CONNECT is served over HTTP/3")
+			return
+		}
+		// quic-go reports the :protocol of extended CONNECT as Proto
+		switch r.Proto {
+		case "":
+		case ProtocolConnectTCP:
+			target, err := connectTCPTarget(r.URL.Path)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+				return
+			}
+			r.Host, r.RequestURI = target, target
+			r.URL = &url.URL{Host: target}
+		default:
+			writeError(w, http.StatusNotImplemented, apierror.CodeNotSupported, fmt.Sprintf("Extended CONNECT protocol %q is not supported", r.Proto))
+			return
+		}
+		lb.ServeHTTP(w, r)
+	})
+}
+
+// connectTCPTarget returns the host:port named by a connect-tcp path.
+func connectTCPTarget(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, connectTCPPath)
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if !ok || len(parts) != 2 || parts[0] == "" {
+		return "", fmt.Errorf("connect-tcp path must be %s{host}/{port}/", connectTCPPath)
+	}
+	if port, err := strconv.Atoi(parts[1]); err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid connect-tcp port %q", parts[1])
+	}
+	return net.JoinHostPort(parts[0], parts[1]), nil
+}
+
+// clientTunnel answers a CONNECT the exit accepted and returns the client
+// side of the tunnel. HTTP/1 connections are hijacked; HTTP/2 and HTTP/3
+// carry the tunnel on the request stream, after a 200 response holding the
+// egress headers.
+func (lb *LoadBalancer) clientTunnel(w http.ResponseWriter, r *http.Request, proxy *ProxyEndpoint) (net.Conn, error) {
+	if r.ProtoMajor >= 2 {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return nil, fmt.Errorf("HTTP/%d response cannot be flushed", r.ProtoMajor)
+		}
+		if lb.egressHeadersEnabled() {
+			w.Header().Set(EgressIPHeader, proxy.IP)
+			w.Header().Set(EgressNodeHeader, proxy.NodeID)
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		return &streamConn{body: r.Body, w: w, flusher: flusher, remote: r.RemoteAddr, rc: http.NewResponseController(w)}, nil
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	clientConn.Write(lb.connectEstablished(proxy))
+	return clientConn, nil
+}
+
+// streamConn is a tunnel carried on an HTTP/2 or HTTP/3 request stream:
+// the request body from the client, the response body back.
+type streamConn struct {
+	body    io.ReadCloser
+	w       io.Writer
+	flusher http.Flusher
+	remote  string
+	rc      *http.ResponseController
+	mu      sync.Mutex // one write and flush at a time
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.w.Write(p)
+	if err == nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+// Close stops reading from the client, which ends the handler serving the
+// stream and with it the stream.
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return streamAddr("")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return streamAddr(c.remote)
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.rc.SetReadDeadline(t)
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// streamAddr is the client address of a stream tunnel.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "stream" }
+func (a streamAddr) String() string  { return string(a) }
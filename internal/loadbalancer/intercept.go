@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"proxy-v6/internal/auth"
+	"proxy-v6/internal/mitm"
+	"proxy-v6/pkg/models"
+)
+
+// SetInterception enables TLS interception of CONNECT tunnels. Tunnels are
+// re-originated with defaultProfile unless the user has a profile of their
+// own; when destinations is non-empty only matching targets are intercepted.
+func (lb *LoadBalancer) SetInterception(interceptor *mitm.Interceptor, defaultProfile string, destinations []string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.interceptor = interceptor
+	lb.mitmProfile = defaultProfile
+	lb.mitmTargets = destinations
+}
+
+// interceptProfile returns the ClientHello profile a tunnel to destination
+// should be re-originated with, or "" to pass it through untouched.
+func (lb *LoadBalancer) interceptProfile(user *models.User, destination string) string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	if lb.interceptor == nil {
+		return ""
+	}
+	profile := lb.mitmProfile
+	if user != nil && user.TLSProfile != "" {
+		profile = user.TLSProfile
+	}
+	if profile == "" {
+		return ""
+	}
+	if len(lb.mitmTargets) == 0 {
+		return profile
+	}
+	for _, pattern := range lb.mitmTargets {
+		if auth.MatchDestination(pattern, destination) {
+			return profile
+		}
+	}
+	return ""
+}
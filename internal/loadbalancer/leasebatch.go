@@ -0,0 +1,165 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// MaxLeaseBatch is the most exits one batch may lease.
+const MaxLeaseBatch = 1000
+
+var ErrLeaseBatchNotFound = errors.New("lease batch not found")
+
+// distinctKey returns what the exits of a batch must differ in.
+func distinctKey(distinct string) (func(freeExit) string, error) {
+	switch distinct {
+	case "", models.LeaseDistinctAddress:
+		return func(e freeExit) string { return e.ip }, nil
+	case models.LeaseDistinctPrefix:
+		return func(e freeExit) string { return prefixOf(e.ip, 64) }, nil
+	case models.LeaseDistinctNode:
+		return func(e freeExit) string { return e.nodeID }, nil
+	}
+	return nil, fmt.Errorf("distinct must be %q, %q or %q", models.LeaseDistinctAddress, models.LeaseDistinctPrefix, models.LeaseDistinctNode)
+}
+
+// LeaseBatch leases req.Count free exits that differ in req.Distinct, all
+// expiring together. It leases all of them or none: a pool without
+// enough distinct free exits fails with ErrNoExitToLease. Among the
+// candidates for each address, /64 or node, the exit with the least work
+// in flight is taken.
+func (lb *LoadBalancer) LeaseBatch(req models.LeaseBatchRequest, now time.Time) (models.LeaseBatch, error) {
+	ttl, err := leaseTTL(req.TTLSeconds)
+	if err != nil {
+		return models.LeaseBatch{}, err
+	}
+	if req.Count < 1 || req.Count > MaxLeaseBatch {
+		return models.LeaseBatch{}, fmt.Errorf("count must be between 1 and %d", MaxLeaseBatch)
+	}
+	key, err := distinctKey(req.Distinct)
+	if err != nil {
+		return models.LeaseBatch{}, err
+	}
+	if req.Pool != "" && !lb.pools.defined(req.Pool) {
+		return models.LeaseBatch{}, fmt.Errorf("%w: %s", errPoolNotFound, req.Pool)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	taken := make(map[string]bool)
+	var chosen []string
+	for _, exit := range lb.freeExitsLocked(req.Pool, now) {
+		k := key(exit)
+		if taken[k] {
+			continue
+		}
+		taken[k] = true
+		chosen = append(chosen, exit.ip)
+		if len(chosen) == req.Count {
+			break
+		}
+	}
+	if len(chosen) < req.Count {
+		distinct := req.Distinct
+		if distinct == "" {
+			distinct = models.LeaseDistinctAddress
+		}
+		return models.LeaseBatch{}, fmt.Errorf("%w: only %d of %d free with a distinct %s", ErrNoExitToLease, len(chosen), req.Count, distinct)
+	}
+
+	batch := models.LeaseBatch{
+		ID:        newTunnelID(),
+		Holder:    req.Holder,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	for _, ip := range chosen {
+		lease, err := lb.newLeaseLocked(ip, req.Holder, now, ttl)
+		if err != nil {
+			return models.LeaseBatch{}, err
+		}
+		lease.Batch = batch.ID
+		batch.Leases = append(batch.Leases, lease)
+	}
+	for _, lease := range batch.Leases {
+		lb.leases[lease.IP] = lease
+	}
+	leasedIPs.Set(float64(len(lb.leases)))
+	lb.logger.Infof("Leased a batch of %d exits to %q until %s", len(batch.Leases), batch.Holder, batch.ExpiresAt.Format(time.RFC3339))
+	return batch, nil
+}
+
+// batchLocked collects the running leases of batch id.
+func (lb *LoadBalancer) batchLocked(id string, now time.Time) (models.LeaseBatch, bool) {
+	batch := models.LeaseBatch{ID: id}
+	for _, lease := range lb.leases {
+		if lease.Batch != id || !lease.ExpiresAt.After(now) {
+			continue
+		}
+		if len(batch.Leases) == 0 || lease.CreatedAt.Before(batch.CreatedAt) {
+			batch.CreatedAt = lease.CreatedAt
+		}
+		if len(batch.Leases) == 0 || lease.ExpiresAt.Before(batch.ExpiresAt) {
+			batch.ExpiresAt = lease.ExpiresAt
+		}
+		batch.Holder = lease.Holder
+		batch.Leases = append(batch.Leases, lease)
+	}
+	sort.Slice(batch.Leases, func(i, j int) bool { return batch.Leases[i].IP < batch.Leases[j].IP })
+	return batch, len(batch.Leases) > 0
+}
+
+// LeaseBatchByID returns the leases of a batch that have not expired.
+func (lb *LoadBalancer) LeaseBatchByID(id string, now time.Time) (models.LeaseBatch, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	batch, ok := lb.batchLocked(id, now)
+	if !ok {
+		return models.LeaseBatch{}, fmt.Errorf("%w: %s", ErrLeaseBatchNotFound, id)
+	}
+	return batch, nil
+}
+
+// RenewLeaseBatch moves the expiry of every running lease of a batch to
+// ttl seconds from now.
+func (lb *LoadBalancer) RenewLeaseBatch(id string, ttlSeconds int64, now time.Time) (models.LeaseBatch, error) {
+	ttl, err := leaseTTL(ttlSeconds)
+	if err != nil {
+		return models.LeaseBatch{}, err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	batch, ok := lb.batchLocked(id, now)
+	if !ok {
+		return models.LeaseBatch{}, fmt.Errorf("%w: %s", ErrLeaseBatchNotFound, id)
+	}
+	batch.ExpiresAt = now.Add(ttl)
+	for i := range batch.Leases {
+		batch.Leases[i].ExpiresAt = batch.ExpiresAt
+		lb.leases[batch.Leases[i].IP] = batch.Leases[i]
+	}
+	return batch, nil
+}
+
+// ReleaseLeaseBatch ends every lease of a batch early and returns their
+// exits to the pool.
+func (lb *LoadBalancer) ReleaseLeaseBatch(id string, now time.Time) (models.LeaseBatch, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	batch, ok := lb.batchLocked(id, now)
+	if !ok {
+		return models.LeaseBatch{}, fmt.Errorf("%w: %s", ErrLeaseBatchNotFound, id)
+	}
+	for _, lease := range batch.Leases {
+		delete(lb.leases, lease.IP)
+	}
+	leasedIPs.Set(float64(len(lb.leases)))
+	lb.logger.Infof("Released a batch of %d leased exits", len(batch.Leases))
+	return batch, nil
+}
@@ -0,0 +1,282 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// How long a lease lasts when no TTL is asked for, and at most.
+const (
+	DefaultLeaseTTL = time.Hour
+	MaxLeaseTTL     = 7 * 24 * time.Hour
+)
+
+var (
+	ErrLeaseNotFound = errors.New("lease not found")
+	ErrExitLeased    = errors.New("exit is already leased")
+	ErrUnknownExit   = errors.New("no exit has this IP")
+	ErrNoExitToLease = errors.New("no free exit to lease")
+)
+
+var leasedIPs = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "proxy_v6_lb_leased_ips",
+	Help: "Egress IPs leased for exclusive use and out of shared selection.",
+})
+
+// leaseTTL checks a requested lease duration in seconds, 0 meaning the
+// default.
+func leaseTTL(seconds int64) (time.Duration, error) {
+	if seconds == 0 {
+		return DefaultLeaseTTL, nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if seconds < 0 || ttl > MaxLeaseTTL {
+		return 0, fmt.Errorf("ttl_seconds must be between 1 and %d", int64(MaxLeaseTTL/time.Second))
+	}
+	return ttl, nil
+}
+
+// Lease reserves an egress IP for req's holder: the one asked for, else the
+// free exit with the least work in flight. Until the lease expires or is
+// released no request through the proxy port uses its exits.
+func (lb *LoadBalancer) Lease(req models.LeaseRequest, now time.Time) (models.Lease, error) {
+	ttl, err := leaseTTL(req.TTLSeconds)
+	if err != nil {
+		return models.Lease{}, err
+	}
+	ip := ""
+	if req.IP != "" {
+		parsed := net.ParseIP(req.IP)
+		if parsed == nil {
+			return models.Lease{}, fmt.Errorf("invalid IP address: %s", req.IP)
+		}
+		ip = parsed.String()
+	}
+	if req.Pool != "" && !lb.pools.defined(req.Pool) {
+		return models.Lease{}, fmt.Errorf("%w: %s", errPoolNotFound, req.Pool)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if ip == "" {
+		if ip, err = lb.freeExitLocked(req.Pool, now); err != nil {
+			return models.Lease{}, err
+		}
+	} else if lb.isLeasedLocked(ip, now) {
+		return models.Lease{}, fmt.Errorf("%w: %s", ErrExitLeased, ip)
+	}
+
+	lease, err := lb.newLeaseLocked(ip, req.Holder, now, ttl)
+	if err != nil {
+		return models.Lease{}, err
+	}
+	lb.leases[ip] = lease
+	leasedIPs.Set(float64(len(lb.leases)))
+	lb.logger.Infof("Leased exit %s to %q until %s", ip, lease.Holder, lease.ExpiresAt.Format(time.RFC3339))
+	return lease, nil
+}
+
+// newLeaseLocked builds a lease of every exit on ip, without taking it.
+func (lb *LoadBalancer) newLeaseLocked(ip, holder string, now time.Time, ttl time.Duration) (models.Lease, error) {
+	lease := models.Lease{
+		ID:        newTunnelID(),
+		IP:        ip,
+		Holder:    holder,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	for _, p := range lb.proxies {
+		if p.IP != ip {
+			continue
+		}
+		lease.NodeID = p.NodeID
+		lease.Exits = append(lease.Exits, leasedExit(p))
+	}
+	if len(lease.Exits) == 0 {
+		return models.Lease{}, fmt.Errorf("%w: %s", ErrUnknownExit, ip)
+	}
+	return lease, nil
+}
+
+// freeExit is an IP that can be leased, with the least work in flight on
+// any of its exits.
+type freeExit struct {
+	ip     string
+	nodeID string
+	load   int64
+}
+
+// freeExitsLocked returns the IPs of the exits in rotation, of pool when
+// one is named, that no lease holds, least work in flight first. Tenants'
+// exits are only leased when asked for by IP.
+func (lb *LoadBalancer) freeExitsLocked(pool string, now time.Time) []freeExit {
+	var free []freeExit
+	index := make(map[string]int)
+	for _, p := range lb.proxies {
+		if !p.Healthy || p.Standby || lb.isQuarantinedLocked(p.IP) || lb.isLeasedLocked(p.IP, now) || lb.outliers.isEjected(p.Address) {
+			continue
+		}
+		if _, draining := lb.drained[p.NodeID]; draining {
+			continue
+		}
+		if pool != "" && !lb.pools.contains(p, pool) {
+			continue
+		}
+		if lb.tenants.owner(p, lb.pools) != "" {
+			continue
+		}
+		load := lb.inflight.count(p.Address)
+		if i, seen := index[p.IP]; seen {
+			if load < free[i].load {
+				free[i].load = load
+			}
+			continue
+		}
+		index[p.IP] = len(free)
+		free = append(free, freeExit{ip: p.IP, nodeID: p.NodeID, load: load})
+	}
+	sort.SliceStable(free, func(i, j int) bool { return free[i].load < free[j].load })
+	return free
+}
+
+// freeExitLocked returns the IP of the free exit with the least work in
+// flight.
+func (lb *LoadBalancer) freeExitLocked(pool string, now time.Time) (string, error) {
+	free := lb.freeExitsLocked(pool, now)
+	if len(free) == 0 {
+		return "", ErrNoExitToLease
+	}
+	return free[0].ip, nil
+}
+
+func leasedExit(p ProxyEndpoint) models.LeasedExit {
+	proxyURL := url.URL{Scheme: "http", Host: p.Address}
+	if p.Username != "" {
+		proxyURL.User = url.UserPassword(p.Username, p.Password)
+	}
+	return models.LeasedExit{
+		InstanceID: p.InstanceID,
+		Address:    p.Address,
+		Username:   p.Username,
+		Password:   p.Password,
+		ProxyURL:   proxyURL.String(),
+	}
+}
+
+// RenewLease moves the expiry of a lease that has not expired yet to ttl
+// seconds from now.
+func (lb *LoadBalancer) RenewLease(id string, ttlSeconds int64, now time.Time) (models.Lease, error) {
+	ttl, err := leaseTTL(ttlSeconds)
+	if err != nil {
+		return models.Lease{}, err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lease, ok := lb.leaseLocked(id, now)
+	if !ok {
+		return models.Lease{}, fmt.Errorf("%w: %s", ErrLeaseNotFound, id)
+	}
+	lease.ExpiresAt = now.Add(ttl)
+	lb.leases[lease.IP] = lease
+	return lease, nil
+}
+
+// ReleaseLease ends a lease early and returns its exits to the pool.
+func (lb *LoadBalancer) ReleaseLease(id string, now time.Time) (models.Lease, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lease, ok := lb.leaseLocked(id, now)
+	if !ok {
+		return models.Lease{}, fmt.Errorf("%w: %s", ErrLeaseNotFound, id)
+	}
+	delete(lb.leases, lease.IP)
+	leasedIPs.Set(float64(len(lb.leases)))
+	lb.logger.Infof("Released lease of exit %s", lease.IP)
+	return lease, nil
+}
+
+func (lb *LoadBalancer) leaseLocked(id string, now time.Time) (models.Lease, bool) {
+	for _, lease := range lb.leases {
+		if lease.ID == id && lease.ExpiresAt.After(now) {
+			return lease, true
+		}
+	}
+	return models.Lease{}, false
+}
+
+// LeaseByID returns a lease that has not expired.
+func (lb *LoadBalancer) LeaseByID(id string, now time.Time) (models.Lease, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	lease, ok := lb.leaseLocked(id, now)
+	if !ok {
+		return models.Lease{}, fmt.Errorf("%w: %s", ErrLeaseNotFound, id)
+	}
+	return lease, nil
+}
+
+// Leases returns the leases that have not expired, soonest to expire first.
+func (lb *LoadBalancer) Leases(now time.Time) []models.Lease {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	result := make([]models.Lease, 0, len(lb.leases))
+	for _, lease := range lb.leases {
+		if lease.ExpiresAt.After(now) {
+			result = append(result, lease)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ExpiresAt.Before(result[j].ExpiresAt) })
+	return result
+}
+
+// ExpireLeases forgets the leases that expired by now and returns them.
+// Their exits are back in selection from the moment they expire either way.
+func (lb *LoadBalancer) ExpireLeases(now time.Time) []models.Lease {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	var expired []models.Lease
+	for ip, lease := range lb.leases {
+		if !lease.ExpiresAt.After(now) {
+			expired = append(expired, lease)
+			delete(lb.leases, ip)
+		}
+	}
+	if len(expired) > 0 {
+		leasedIPs.Set(float64(len(lb.leases)))
+		for _, lease := range expired {
+			lb.logger.Infof("Lease of exit %s expired, returning it to the pool", lease.IP)
+		}
+	}
+	return expired
+}
+
+// SetLeases replaces every lease with leases, as restored after a restart
+// or copied from a primary coordinator.
+func (lb *LoadBalancer) SetLeases(leases []models.Lease) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.leases = make(map[string]models.Lease, len(leases))
+	for _, lease := range leases {
+		lb.leases[lease.IP] = lease
+	}
+	leasedIPs.Set(float64(len(lb.leases)))
+}
+
+func (lb *LoadBalancer) isLeasedLocked(ip string, now time.Time) bool {
+	lease, ok := lb.leases[ip]
+	return ok && lease.ExpiresAt.After(now)
+}
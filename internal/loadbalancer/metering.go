@@ -0,0 +1,63 @@
+package loadbalancer
+
+import (
+	"net/http"
+
+	"proxy-v6/pkg/models"
+)
+
+// UsageMeter counts the traffic of each proxy user for billing, with what
+// it cost at the egress price of the exit that carried it.
+type UsageMeter interface {
+	Add(tenant, user string, requests, sent, received int64, cost float64)
+}
+
+// TrafficRecorder counts the traffic through the exits of each node, for
+// graphs of recent traffic.
+type TrafficRecorder interface {
+	Add(nodeID string, requests, bytes int64)
+}
+
+// SetTrafficRecorder counts every forwarded request and the bytes it moved
+// in r, by the node of its exit.
+func (lb *LoadBalancer) SetTrafficRecorder(r TrafficRecorder) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.traffic = r
+}
+
+// SetUsageMeter counts every forwarded request and the bytes it moved
+// between client and destination in m.
+func (lb *LoadBalancer) SetUsageMeter(m UsageMeter) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.meter = m
+}
+
+// meterTraffic counts traffic of user, or of unauthenticated clients when
+// user is nil, through proxy.
+func (lb *LoadBalancer) meterTraffic(user *models.User, proxy *ProxyEndpoint, requests, sent, received int64) {
+	lb.mu.RLock()
+	m := lb.meter
+	t := lb.traffic
+	lb.mu.RUnlock()
+	if t != nil {
+		t.Add(proxy.NodeID, requests, sent+received)
+	}
+	if m == nil {
+		return
+	}
+	username, tenant := "", ""
+	if user != nil {
+		username, tenant = user.Username, user.Tenant
+	}
+	m.Add(tenant, username, requests, sent, received, egressCost(proxy, sent+received))
+}
+
+// requestBytes is the size of r's body as announced, 0 when it is not.
+func requestBytes(r *http.Request) int64 {
+	if r.ContentLength > 0 {
+		return r.ContentLength
+	}
+	return 0
+}
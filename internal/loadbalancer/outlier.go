@@ -0,0 +1,270 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultOutlierPolicy ejects exits that fail half their requests over 30
+// seconds for a minute, never more than half the pool at once.
+var DefaultOutlierPolicy = models.OutlierPolicy{
+	ErrorRatePercent:  50,
+	MinRequests:       10,
+	WindowSeconds:     30,
+	EjectSeconds:      60,
+	MaxEjectedPercent: 50,
+}
+
+var (
+	outlierEjections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_outlier_ejections_total",
+		Help: "Exits ejected from rotation for failing requests.",
+	})
+	outlierEjectionsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_outlier_ejections_skipped_total",
+		Help: "Ejections not made because too much of the pool was already ejected.",
+	})
+)
+
+// outcomeBucket counts the requests an exit finished in one second.
+type outcomeBucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+// outlierDetector tracks recent request outcomes per exit and ejects exits
+// whose error rate crosses the policy threshold.
+type outlierDetector struct {
+	policy  models.OutlierPolicy
+	windows map[string][]outcomeBucket // exit -> outcomes, oldest first
+	ejected map[string]models.OutlierEjection
+	mu      sync.Mutex
+}
+
+func newOutlierDetector() *outlierDetector {
+	return &outlierDetector{
+		windows: make(map[string][]outcomeBucket),
+		ejected: make(map[string]models.OutlierEjection),
+	}
+}
+
+func validateOutlierPolicy(policy models.OutlierPolicy) error {
+	if policy.ErrorRatePercent == 0 {
+		return nil
+	}
+	if policy.ErrorRatePercent < 0 || policy.ErrorRatePercent > 100 {
+		return fmt.Errorf("error_rate_percent must be between 1 and 100")
+	}
+	if policy.MinRequests <= 0 || policy.WindowSeconds <= 0 || policy.EjectSeconds <= 0 {
+		return fmt.Errorf("min_requests, window_seconds and eject_seconds must be positive")
+	}
+	if policy.MaxEjectedPercent <= 0 || policy.MaxEjectedPercent > 100 {
+		return fmt.Errorf("max_ejected_percent must be between 1 and 100")
+	}
+	if policy.SlowMs < 0 {
+		return fmt.Errorf("slow_ms must not be negative")
+	}
+	return nil
+}
+
+// isEjected reports whether exit is ejected, forgetting ejections that
+// ran out.
+func (d *outlierDetector) isEjected(exit string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ejection, ok := d.ejected[exit]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(ejection.ExpiresAt) {
+		return true
+	}
+	delete(d.ejected, exit)
+	return false
+}
+
+// record adds one outcome for endpoint and ejects it when its window
+// crosses the threshold. poolSize is the number of exits in rotation, which
+// bounds how many may be ejected together.
+func (d *outlierDetector) record(endpoint *ProxyEndpoint, failed bool, latency time.Duration, poolSize int) (models.OutlierEjection, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	policy := d.policy
+	if policy.ErrorRatePercent == 0 {
+		return models.OutlierEjection{}, false
+	}
+	if policy.SlowMs > 0 && latency > time.Duration(policy.SlowMs)*time.Millisecond {
+		failed = true
+	}
+
+	now := time.Now()
+	second := now.Unix()
+	window := d.windows[endpoint.Address]
+	cutoff := second - int64(policy.WindowSeconds)
+	i := 0
+	for i < len(window) && window[i].second <= cutoff {
+		i++
+	}
+	window = window[i:]
+	if len(window) == 0 || window[len(window)-1].second != second {
+		window = append(window, outcomeBucket{second: second})
+	}
+	last := &window[len(window)-1]
+	last.requests++
+	if failed {
+		last.failures++
+	}
+	d.windows[endpoint.Address] = window
+
+	requests, failures := 0, 0
+	for _, b := range window {
+		requests += b.requests
+		failures += b.failures
+	}
+	if requests < policy.MinRequests || failures*100 < policy.ErrorRatePercent*requests {
+		return models.OutlierEjection{}, false
+	}
+	if _, ok := d.ejected[endpoint.Address]; ok {
+		return models.OutlierEjection{}, false
+	}
+
+	active := 0
+	for exit, ejection := range d.ejected {
+		if now.Before(ejection.ExpiresAt) {
+			active++
+		} else {
+			delete(d.ejected, exit)
+		}
+	}
+	if (active+1)*100 > policy.MaxEjectedPercent*poolSize {
+		outlierEjectionsSkipped.Inc()
+		return models.OutlierEjection{}, false
+	}
+
+	ejection := models.OutlierEjection{
+		Exit:      endpoint.Address,
+		NodeID:    endpoint.NodeID,
+		Requests:  requests,
+		Failures:  failures,
+		EjectedAt: now,
+		ExpiresAt: now.Add(time.Duration(policy.EjectSeconds) * time.Second),
+	}
+	d.ejected[endpoint.Address] = ejection
+	// The exit starts with a clean window when it returns
+	delete(d.windows, endpoint.Address)
+	outlierEjections.Inc()
+	return ejection, true
+}
+
+// prune drops the outcomes of exits that left the pool.
+func (d *outlierDetector) prune(active map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for exit := range d.windows {
+		if !active[exit] {
+			delete(d.windows, exit)
+		}
+	}
+}
+
+// recordOutcome feeds the result of a request or tunnel setup through
+// endpoint to outlier detection and the exit metrics.
+func (lb *LoadBalancer) recordOutcome(endpoint *ProxyEndpoint, failed bool, latency time.Duration) {
+	lb.exitMetrics.outcome(endpoint, failed, latency)
+
+	lb.mu.RLock()
+	poolSize := 0
+	for _, p := range lb.proxies {
+		if !p.Standby {
+			poolSize++
+		}
+	}
+	lb.mu.RUnlock()
+
+	if ejection, ok := lb.outliers.record(endpoint, failed, latency, poolSize); ok {
+		lb.logger.Warnf("Ejected exit %s for %s: %d of %d recent requests failed",
+			ejection.Exit, ejection.ExpiresAt.Sub(ejection.EjectedAt), ejection.Failures, ejection.Requests)
+	}
+}
+
+// SetOutlierPolicy replaces the outlier detection thresholds. Current
+// ejections run out as they were set.
+func (lb *LoadBalancer) SetOutlierPolicy(policy models.OutlierPolicy) error {
+	if err := validateOutlierPolicy(policy); err != nil {
+		return err
+	}
+	lb.outliers.mu.Lock()
+	lb.outliers.policy = policy
+	lb.outliers.mu.Unlock()
+	if policy.ErrorRatePercent > 0 {
+		lb.logger.Infof("Outlier detection: eject exits failing %d%% of %d+ requests over %ds for %ds",
+			policy.ErrorRatePercent, policy.MinRequests, policy.WindowSeconds, policy.EjectSeconds)
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) OutlierPolicy() models.OutlierPolicy {
+	lb.outliers.mu.Lock()
+	defer lb.outliers.mu.Unlock()
+	return lb.outliers.policy
+}
+
+// Outliers returns the exits currently ejected, oldest first.
+func (lb *LoadBalancer) Outliers() []models.OutlierEjection {
+	lb.outliers.mu.Lock()
+	defer lb.outliers.mu.Unlock()
+	now := time.Now()
+	result := make([]models.OutlierEjection, 0, len(lb.outliers.ejected))
+	for _, ejection := range lb.outliers.ejected {
+		if now.Before(ejection.ExpiresAt) {
+			result = append(result, ejection)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].EjectedAt.Before(result[j].EjectedAt)
+	})
+	return result
+}
+
+// ReturnOutlier puts an ejected exit back into rotation early.
+func (lb *LoadBalancer) ReturnOutlier(exit string) error {
+	lb.outliers.mu.Lock()
+	defer lb.outliers.mu.Unlock()
+	if _, ok := lb.outliers.ejected[exit]; !ok {
+		return fmt.Errorf("exit not ejected: %s", exit)
+	}
+	delete(lb.outliers.ejected, exit)
+	lb.logger.Infof("Returned ejected exit %s to rotation", exit)
+	return nil
+}
+
+// isGatewayError reports whether an HTTP status is one exits answer with
+// when they cannot carry a request.
+func isGatewayError(status int) bool {
+	switch status {
+	case 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// connectStatus returns the status code of a raw CONNECT response, or 0
+// when it cannot be parsed.
+func connectStatus(response string) int {
+	fields := strings.Fields(response)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return 0
+	}
+	status, _ := strconv.Atoi(fields[1])
+	return status
+}
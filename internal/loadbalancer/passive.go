@@ -0,0 +1,197 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults for passive health checking: three failed requests in a row take
+// an exit out of rotation, and a trial request is let through 30 seconds
+// later.
+const (
+	DefaultPassiveFailures = 3
+	DefaultPassiveRecovery = 30 * time.Second
+)
+
+var passiveTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_lb_passive_health_transitions_total",
+	Help: "Exits marked unhealthy by failing requests or recovered by a trial request, by state (unhealthy, recovered).",
+}, []string{"state"})
+
+// passiveState is the request history of one exit.
+type passiveState struct {
+	failures int       // consecutive failed requests
+	open     bool      // marked unhealthy by failed requests
+	retryAt  time.Time // when the next trial request may go through
+	probeAt  time.Time // when the current trial was handed out, zero if none
+}
+
+// passiveChecker marks exits unhealthy after consecutive failed requests and
+// lets single trial requests through once the recovery delay passed, like a
+// circuit breaker going half-open. A successful trial puts the exit back.
+type passiveChecker struct {
+	threshold int // 0 = passive checking off
+	recovery  time.Duration
+	states    map[string]*passiveState
+	mu        sync.Mutex
+}
+
+func newPassiveChecker() *passiveChecker {
+	return &passiveChecker{
+		threshold: DefaultPassiveFailures,
+		recovery:  DefaultPassiveRecovery,
+		states:    make(map[string]*passiveState),
+	}
+}
+
+// fail records a failed request through exit and reports whether it made
+// the exit unhealthy.
+func (c *passiveChecker) fail(exit string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.threshold == 0 {
+		return false
+	}
+	st := c.states[exit]
+	if st == nil {
+		st = &passiveState{}
+		c.states[exit] = st
+	}
+	st.failures++
+	if st.open {
+		// A failed trial keeps the exit out for another recovery delay
+		st.probeAt = time.Time{}
+		st.retryAt = time.Now().Add(c.recovery)
+		return false
+	}
+	if st.failures < c.threshold {
+		return false
+	}
+	st.open = true
+	st.retryAt = time.Now().Add(c.recovery)
+	return true
+}
+
+// succeed records a successful request through exit and reports whether it
+// brought the exit back.
+func (c *passiveChecker) succeed(exit string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.states[exit]
+	if st == nil {
+		return false
+	}
+	delete(c.states, exit)
+	return st.open
+}
+
+func (c *passiveChecker) isOpen(exit string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.states[exit]
+	return st != nil && st.open
+}
+
+// probeDue reports whether exit is waiting for a trial request.
+func (c *passiveChecker) probeDue(exit string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.probeDueLocked(c.states[exit], time.Now())
+}
+
+func (c *passiveChecker) probeDueLocked(st *passiveState, now time.Time) bool {
+	if st == nil || !st.open || now.Before(st.retryAt) {
+		return false
+	}
+	// A trial that never reported back, because the request was cancelled
+	// or refused before reaching the exit, is given up on after a delay
+	return st.probeAt.IsZero() || now.Sub(st.probeAt) >= c.recovery
+}
+
+// claimProbe hands out the trial request for exit, so only one is in
+// flight at a time.
+func (c *passiveChecker) claimProbe(exit string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.states[exit]
+	now := time.Now()
+	if !c.probeDueLocked(st, now) {
+		return false
+	}
+	st.probeAt = now
+	return true
+}
+
+// prune drops the state of exits that left the pool.
+func (c *passiveChecker) prune(active map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for exit := range c.states {
+		if !active[exit] {
+			delete(c.states, exit)
+		}
+	}
+}
+
+// SetPassiveHealth configures passive health checking: after failures
+// consecutive failed requests (0 = off) an exit is marked unhealthy, and a
+// trial request is sent through it every recovery until one succeeds.
+func (lb *LoadBalancer) SetPassiveHealth(failures int, recovery time.Duration) {
+	if recovery <= 0 {
+		recovery = DefaultPassiveRecovery
+	}
+	lb.passive.mu.Lock()
+	lb.passive.threshold = failures
+	lb.passive.recovery = recovery
+	lb.passive.mu.Unlock()
+	if failures > 0 {
+		lb.logger.Infof("Passive health checks: unhealthy after %d failed requests, trial every %s", failures, recovery)
+	}
+}
+
+// recordHealth updates the passive health of endpoint with the result of a
+// request or tunnel setup through it.
+func (lb *LoadBalancer) recordHealth(endpoint *ProxyEndpoint, failed bool) {
+	if failed {
+		if lb.passive.fail(endpoint.Address) {
+			passiveTransitions.WithLabelValues("unhealthy").Inc()
+			lb.logger.Warnf("Proxy %s failed %d requests in a row", endpoint.Address, lb.passiveThreshold())
+			lb.markProxyUnhealthy(endpoint.Address)
+		}
+		return
+	}
+	if !lb.passive.succeed(endpoint.Address) {
+		return
+	}
+	passiveTransitions.WithLabelValues("recovered").Inc()
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for i := range lb.proxies {
+		if lb.proxies[i].Address == endpoint.Address {
+			if !lb.proxies[i].Healthy {
+				lb.proxies[i].Healthy = true
+				lb.healthChangedLocked(lb.proxies[i], "trial request succeeded")
+			}
+			lb.proxies[i].LastCheck = time.Now()
+			lb.logger.Infof("Proxy %s recovered after a successful trial request", endpoint.Address)
+			break
+		}
+	}
+}
+
+func (lb *LoadBalancer) passiveThreshold() int {
+	lb.passive.mu.Lock()
+	defer lb.passive.mu.Unlock()
+	return lb.passive.threshold
+}
+
+// exitFailed reports whether resp is an error the exit produced itself
+// rather than one it relayed. Relayed responses carry the exit's Via
+// header; an exit's own gateway errors do not.
+func exitFailed(resp *http.Response) bool {
+	return isGatewayError(resp.StatusCode) && resp.Header.Get("Via") == ""
+}
@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+
+	"proxy-v6/pkg/models"
+)
+
+// Headers clients send to the proxy port to choose their exit. They are
+// removed before the request is forwarded.
+const (
+	ProxyIDHeader   = "X-Proxy-ID"   // agent instance ID, e.g. "2001:db8::10-10000"
+	ProxyNodeHeader = "X-Proxy-Node" // node ID; any of its exits
+)
+
+var (
+	errExitNotFound    = errors.New("requested exit does not exist")
+	errExitUnavailable = errors.New("requested exit is not available")
+)
+
+// selection is what a request needs from an exit.
+type selection struct {
+	client      string
+	destination string
+	kind        trafficKind
+	exclude     map[string]bool
+	instanceID  string // only this exit
+	nodeID      string // only this node's exits
+	pool        string // only exits of this named pool
+	tenant      string // only exits of this tenant, or only shared ones when ""
+	priority    priorityClass
+	constraints models.PoolConstraints
+	history     string // whose recent exits distinct constraints look at
+}
+
+// pinned reports whether the client chose its exit or node.
+func (s selection) pinned() bool {
+	return s.instanceID != "" || s.nodeID != ""
+}
+
+func (s selection) matches(p ProxyEndpoint) bool {
+	if s.instanceID != "" && p.InstanceID != s.instanceID {
+		return false
+	}
+	return s.nodeID == "" || p.NodeID == s.nodeID
+}
+
+// takePin reads the exit selection headers from r and strips them so they
+// do not reach the destination.
+func takePin(r *http.Request) (instanceID, nodeID string) {
+	instanceID = r.Header.Get(ProxyIDHeader)
+	nodeID = r.Header.Get(ProxyNodeHeader)
+	r.Header.Del(ProxyIDHeader)
+	r.Header.Del(ProxyNodeHeader)
+	return instanceID, nodeID
+}
@@ -0,0 +1,201 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"proxy-v6/internal/auth"
+	"proxy-v6/pkg/models"
+)
+
+// ProxyPoolHeader names the pool a request's exit must come from, e.g.
+// "residential". It is removed before the request is forwarded.
+const ProxyPoolHeader = "X-Proxy-Pool"
+
+var (
+	errPoolNotFound    = errors.New("requested pool does not exist")
+	errPoolUnavailable = errors.New("no exit of the requested pool is available")
+)
+
+// takePool reads the pool header from r and strips it so it does not reach
+// the destination.
+func takePool(r *http.Request) string {
+	pool := strings.TrimSpace(r.Header.Get(ProxyPoolHeader))
+	r.Header.Del(ProxyPoolHeader)
+	return pool
+}
+
+// poolTable holds the named pools clients can select.
+type poolTable struct {
+	pools    map[string]models.ProxyPool
+	networks map[string][]*net.IPNet // pool -> its prefixes
+	mu       sync.RWMutex
+}
+
+func newPoolTable() *poolTable {
+	return &poolTable{pools: make(map[string]models.ProxyPool), networks: make(map[string][]*net.IPNet)}
+}
+
+func (t *poolTable) defined(name string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.pools[name]
+	return ok
+}
+
+// contains reports whether p belongs to the pool name: its agent assigned
+// it, or its address lies in one of the pool's prefixes.
+func (t *poolTable) contains(p ProxyEndpoint, name string) bool {
+	if slices.Contains(p.Pools, name) {
+		return true
+	}
+	t.mu.RLock()
+	networks := t.networks[name]
+	t.mu.RUnlock()
+	if len(networks) == 0 {
+		return false
+	}
+	ip := net.ParseIP(p.IP)
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePool checks a pool definition and parses its prefixes.
+func validatePool(pool models.ProxyPool) ([]*net.IPNet, error) {
+	if err := auth.ValidatePoolName(pool.Name); err != nil {
+		return nil, err
+	}
+	networks := make([]*net.IPNet, 0, len(pool.Prefixes))
+	for _, prefix := range pool.Prefixes {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: invalid prefix %q", pool.Name, prefix)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// SetPools replaces the named pools.
+func (lb *LoadBalancer) SetPools(pools []models.ProxyPool) error {
+	defined := make(map[string]models.ProxyPool, len(pools))
+	networks := make(map[string][]*net.IPNet, len(pools))
+	for i, pool := range pools {
+		parsed, err := validatePool(pool)
+		if err != nil {
+			return fmt.Errorf("pool %d: %w", i, err)
+		}
+		if _, ok := defined[pool.Name]; ok {
+			return fmt.Errorf("pool %d: %s is defined twice", i, pool.Name)
+		}
+		defined[pool.Name] = pool
+		networks[pool.Name] = parsed
+	}
+
+	lb.pools.mu.Lock()
+	lb.pools.pools = defined
+	lb.pools.networks = networks
+	lb.pools.mu.Unlock()
+	if len(pools) > 0 {
+		lb.logger.Infof("Named pools configured: %d", len(pools))
+	}
+	return nil
+}
+
+// SetPool adds the named pool or replaces the one with its name.
+func (lb *LoadBalancer) SetPool(pool models.ProxyPool) error {
+	networks, err := validatePool(pool)
+	if err != nil {
+		return err
+	}
+	lb.pools.mu.Lock()
+	lb.pools.pools[pool.Name] = pool
+	lb.pools.networks[pool.Name] = networks
+	lb.pools.mu.Unlock()
+	lb.logger.Infof("Pool %s updated", pool.Name)
+	return nil
+}
+
+// DeletePool removes the named pool. Requests still asking for it are
+// refused.
+func (lb *LoadBalancer) DeletePool(name string) error {
+	lb.pools.mu.Lock()
+	defer lb.pools.mu.Unlock()
+	if _, ok := lb.pools.pools[name]; !ok {
+		return fmt.Errorf("%w: %s", errPoolNotFound, name)
+	}
+	delete(lb.pools.pools, name)
+	delete(lb.pools.networks, name)
+	lb.logger.Infof("Pool %s deleted", name)
+	return nil
+}
+
+// Pools returns the named pools sorted by name.
+func (lb *LoadBalancer) Pools() []models.ProxyPool {
+	lb.pools.mu.RLock()
+	defer lb.pools.mu.RUnlock()
+	pools := make([]models.ProxyPool, 0, len(lb.pools.pools))
+	for _, pool := range lb.pools.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools
+}
+
+// PoolExits keeps the exits that belong to the named pool.
+func (lb *LoadBalancer) PoolExits(exits []models.PoolExit, name string) ([]models.PoolExit, error) {
+	if !lb.pools.defined(name) {
+		return nil, fmt.Errorf("%w: %s", errPoolNotFound, name)
+	}
+	members := []models.PoolExit{}
+	for _, exit := range exits {
+		if lb.pools.contains(ProxyEndpoint{IP: exit.IP, Pools: exit.Pools}, name) {
+			members = append(members, exit)
+		}
+	}
+	return members, nil
+}
+
+// PoolStatuses returns the named pools with how many exits each has and
+// how many of them are healthy and in rotation.
+func (lb *LoadBalancer) PoolStatuses() []models.PoolStatus {
+	pools := lb.Pools()
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	statuses := make([]models.PoolStatus, 0, len(pools))
+	for _, pool := range pools {
+		status := models.PoolStatus{ProxyPool: pool}
+		for _, p := range lb.proxies {
+			if !lb.pools.contains(p, pool.Name) {
+				continue
+			}
+			status.Exits++
+			if _, draining := lb.drained[p.NodeID]; p.Healthy && !p.Standby && !draining {
+				status.Healthy++
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// PoolStatus returns one named pool with its exit counts.
+func (lb *LoadBalancer) PoolStatus(name string) (models.PoolStatus, error) {
+	for _, status := range lb.PoolStatuses() {
+		if status.Name == name {
+			return status, nil
+		}
+	}
+	return models.PoolStatus{}, fmt.Errorf("%w: %s", errPoolNotFound, name)
+}
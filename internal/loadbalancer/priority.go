@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"proxy-v6/pkg/models"
+)
+
+// ProxyPriorityHeader sets the priority class of a request, "interactive"
+// or "batch". It is removed before the request is forwarded.
+const ProxyPriorityHeader = "X-Proxy-Priority"
+
+// DefaultBatchShare is the percentage of each exit's concurrency limit
+// batch requests may hold, leaving the rest to interactive ones.
+const DefaultBatchShare = 50
+
+// priorityClass orders requests competing for exit capacity.
+type priorityClass int
+
+const (
+	classInteractive priorityClass = iota
+	classBatch
+	numClasses
+)
+
+func (c priorityClass) String() string {
+	if c == classBatch {
+		return models.PriorityBatch
+	}
+	return models.PriorityInteractive
+}
+
+// takePriority reads the priority header from r and strips it so it does
+// not reach the destination. A user's priority is the class of their
+// requests; the header can only lower it, so batch users cannot jump the
+// queue.
+func takePriority(r *http.Request, user *models.User) (priorityClass, error) {
+	header := strings.ToLower(strings.TrimSpace(r.Header.Get(ProxyPriorityHeader)))
+	r.Header.Del(ProxyPriorityHeader)
+
+	class := classInteractive
+	if user != nil && user.Priority == models.PriorityBatch {
+		class = classBatch
+	}
+	switch header {
+	case "":
+	case models.PriorityInteractive:
+	case models.PriorityBatch:
+		class = classBatch
+	default:
+		return class, fmt.Errorf("%s must be %s or %s", ProxyPriorityHeader, models.PriorityInteractive, models.PriorityBatch)
+	}
+	return class, nil
+}
+
+// batchLimit is how many requests of the batch class may use an exit whose
+// limit is limit. 0 means no limit.
+func batchLimit(limit, share int) int {
+	if limit == 0 || share >= 100 {
+		return 0
+	}
+	return max(1, limit*share/100)
+}
+
+// SetBatchShare sets the percentage of each exit's concurrency limit batch
+// requests may hold, from 1 to 100. It only applies to exits with a limit.
+func (lb *LoadBalancer) SetBatchShare(percent int) error {
+	if percent < 1 || percent > 100 {
+		return fmt.Errorf("batch share must be between 1 and 100 percent, got %d", percent)
+	}
+	lb.mu.Lock()
+	lb.batchShare = percent
+	lb.mu.Unlock()
+	return nil
+}
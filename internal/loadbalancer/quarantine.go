@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Quarantine removes every exit bound to ip from selection until it is
+// released. Unlike bans this applies to all destinations.
+func (lb *LoadBalancer) Quarantine(ip, reason string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.quarantined[parsed.String()] = models.QuarantinedExit{
+		IP:     parsed.String(),
+		Reason: reason,
+		Since:  time.Now(),
+	}
+	lb.logger.Warnf("Quarantined exit %s: %s", parsed.String(), reason)
+	return nil
+}
+
+func (lb *LoadBalancer) ReleaseQuarantine(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if _, ok := lb.quarantined[parsed.String()]; !ok {
+		return fmt.Errorf("exit not quarantined: %s", ip)
+	}
+	delete(lb.quarantined, parsed.String())
+	lb.logger.Infof("Released exit %s from quarantine", parsed.String())
+	return nil
+}
+
+func (lb *LoadBalancer) QuarantinedExits() []models.QuarantinedExit {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	result := make([]models.QuarantinedExit, 0, len(lb.quarantined))
+	for _, q := range lb.quarantined {
+		result = append(result, q)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Since.Before(result[j].Since)
+	})
+	return result
+}
+
+// SetQuarantinedExits replaces every quarantine with exits, as copied from
+// a primary coordinator.
+func (lb *LoadBalancer) SetQuarantinedExits(exits []models.QuarantinedExit) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.quarantined = make(map[string]models.QuarantinedExit, len(exits))
+	for _, q := range exits {
+		lb.quarantined[q.IP] = q
+	}
+}
+
+func (lb *LoadBalancer) isQuarantinedLocked(ip string) bool {
+	_, ok := lb.quarantined[ip]
+	return ok
+}
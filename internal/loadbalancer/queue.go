@@ -0,0 +1,298 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-v6/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	errNoCapacity = errors.New("all exits are at capacity")
+	errQueueFull  = errors.New("request queue is full")
+	errQueueWait  = errors.New("timed out waiting for exit capacity")
+)
+
+var (
+	queueDepthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_lb_queue_depth",
+		Help: "Requests currently waiting for exit capacity, by priority class.",
+	}, []string{"class"})
+	queueResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_queue_requests_total",
+		Help: "Queued requests by outcome (served, timeout, rejected) and priority class.",
+	}, []string{"result", "class"})
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_v6_lb_queue_wait_seconds",
+		Help:    "Time requests spent waiting for exit capacity, by priority class.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+	}, []string{"class"})
+)
+
+// QueueStats is a point-in-time view of the request queue.
+type QueueStats struct {
+	Enabled           bool             `json:"enabled"`
+	Depth             int64            `json:"depth"`
+	DepthByClass      map[string]int64 `json:"depth_by_class"`
+	MaxDepth          int              `json:"max_depth"`
+	TimeoutSeconds    float64          `json:"timeout_seconds"`
+	MaxPerExit        int              `json:"max_per_exit"`
+	BatchSharePercent int              `json:"batch_share_percent"`
+}
+
+// inflightTracker counts requests and tunnels currently using each exit,
+// and how many of them are of the batch class.
+type inflightTracker struct {
+	counts map[string]int64
+	batch  map[string]int64
+	mu     sync.Mutex
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{counts: make(map[string]int64), batch: make(map[string]int64)}
+}
+
+func (t *inflightTracker) count(address string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts[address]
+}
+
+func (t *inflightTracker) batchCount(address string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.batch[address]
+}
+
+// tryAcquire takes a slot on address unless max (when positive) is reached,
+// or for a batch request batchMax (when positive) batch slots are.
+func (t *inflightTracker) tryAcquire(address string, max int, batch bool, batchMax int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if max > 0 && t.counts[address] >= int64(max) {
+		return false
+	}
+	if batch && batchMax > 0 && t.batch[address] >= int64(batchMax) {
+		return false
+	}
+	t.counts[address]++
+	if batch {
+		t.batch[address]++
+	}
+	return true
+}
+
+func (t *inflightTracker) snapshot() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int64, len(t.counts))
+	for address, n := range t.counts {
+		counts[address] = n
+	}
+	return counts
+}
+
+func (t *inflightTracker) release(address string, batch bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	decrement(t.counts, address)
+	if batch {
+		decrement(t.batch, address)
+	}
+}
+
+func decrement(counts map[string]int64, address string) {
+	if counts[address] <= 1 {
+		delete(counts, address)
+		return
+	}
+	counts[address]--
+}
+
+// requestQueue holds requests briefly when no exit can take them, smoothing
+// short bursts past pool capacity instead of failing them immediately.
+// Queued batch requests wait for every queued interactive one to be served.
+type requestQueue struct {
+	size    int
+	timeout time.Duration
+	depth   int64
+	waiting [numClasses]int64 // depth by priority class
+	ready   chan struct{}
+	mu      sync.Mutex
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{ready: make(chan struct{})}
+}
+
+func (q *requestQueue) enabled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size > 0
+}
+
+func (q *requestQueue) waitChan() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.ready
+}
+
+// yields reports whether a request of class must leave free capacity to
+// the queued requests of a higher class.
+func (q *requestQueue) yields(class priorityClass) bool {
+	return class == classBatch && atomic.LoadInt64(&q.waiting[classInteractive]) > 0
+}
+
+// signal wakes every waiter so they retry selection.
+func (q *requestQueue) signal() {
+	if atomic.LoadInt64(&q.depth) == 0 {
+		return
+	}
+	q.mu.Lock()
+	close(q.ready)
+	q.ready = make(chan struct{})
+	q.mu.Unlock()
+}
+
+// SetCapacity limits concurrent requests per exit (0 means unlimited) and
+// configures the queue used once every exit is busy. A queueSize of 0
+// disables queueing.
+func (lb *LoadBalancer) SetCapacity(maxPerExit, queueSize int, queueTimeout time.Duration) {
+	lb.mu.Lock()
+	lb.maxPerExit = maxPerExit
+	lb.mu.Unlock()
+
+	lb.queue.mu.Lock()
+	lb.queue.size = queueSize
+	lb.queue.timeout = queueTimeout
+	lb.queue.mu.Unlock()
+
+	if maxPerExit > 0 || queueSize > 0 {
+		lb.logger.Infof("Exit capacity: %d concurrent per exit, queue size %d, queue timeout %s", maxPerExit, queueSize, queueTimeout)
+	}
+}
+
+func (lb *LoadBalancer) QueueStats() QueueStats {
+	lb.mu.RLock()
+	maxPerExit, batchShare := lb.maxPerExit, lb.batchShare
+	lb.mu.RUnlock()
+
+	byClass := make(map[string]int64, numClasses)
+	for class := priorityClass(0); class < numClasses; class++ {
+		byClass[class.String()] = atomic.LoadInt64(&lb.queue.waiting[class])
+	}
+	lb.queue.mu.Lock()
+	defer lb.queue.mu.Unlock()
+	return QueueStats{
+		Enabled:           lb.queue.size > 0,
+		Depth:             atomic.LoadInt64(&lb.queue.depth),
+		DepthByClass:      byClass,
+		MaxDepth:          lb.queue.size,
+		TimeoutSeconds:    lb.queue.timeout.Seconds(),
+		MaxPerExit:        maxPerExit,
+		BatchSharePercent: batchShare,
+	}
+}
+
+// acquireProxy selects an exit for sel and takes an in-flight slot on it,
+// queueing when every eligible exit is busy or the pool is momentarily
+// empty. Batch requests also queue while interactive ones are. The caller
+// must call releaseProxy when done.
+func (lb *LoadBalancer) acquireProxy(ctx context.Context, sel selection) (*ProxyEndpoint, error) {
+	var timer *time.Timer
+	var queuedAt time.Time
+	batch := sel.priority == classBatch
+
+	for {
+		var proxy *ProxyEndpoint
+		err := errNoCapacity
+		if !lb.queue.yields(sel.priority) {
+			proxy, err = lb.selectProxy(sel)
+		}
+		if err == nil {
+			lb.mu.RLock()
+			limit := exitLimit(lb.maxPerExit, proxy.Capabilities)
+			batchMax := batchLimit(limit, lb.batchShare)
+			lb.mu.RUnlock()
+			if lb.inflight.tryAcquire(proxy.Address, limit, batch, batchMax) {
+				proxy.batch = batch
+				// Pinned exits are counted but never refused
+				if !lb.reuse.take(proxy.Address, destinationHost(sel.destination), sel.instanceID != "") {
+					// Another request used up the exit for this
+					// destination, select again
+					lb.inflight.release(proxy.Address, batch)
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+					lb.leaveQueue(ctx, queuedAt, sel.priority, "served")
+				}
+				lb.exitMetrics.selected(proxy)
+				if sel.history != "" {
+					lb.history.record(sel.history, proxy.IP, time.Now())
+				}
+				return proxy, nil
+			}
+			// Lost the race for the last slot, treat it as no capacity
+			err = errNoCapacity
+		}
+
+		// Waiting only helps when capacity may free up; an exhausted
+		// retry set or a pool that does not exist will not change while
+		// queued
+		if !lb.queue.enabled() || errors.Is(err, errNoCompatibleExit) || errors.Is(err, errPoolNotFound) || err == errReuseExhausted || err == errConstraintsUnmet || err == errExitNotFound || err == errExitUnavailable || (err != errNoCapacity && len(sel.exclude) > 0) {
+			return nil, err
+		}
+
+		if timer == nil {
+			lb.queue.mu.Lock()
+			size, timeout := lb.queue.size, lb.queue.timeout
+			lb.queue.mu.Unlock()
+
+			if atomic.AddInt64(&lb.queue.depth, 1) > int64(size) {
+				atomic.AddInt64(&lb.queue.depth, -1)
+				queueResults.WithLabelValues("rejected", sel.priority.String()).Inc()
+				return nil, errQueueFull
+			}
+			atomic.AddInt64(&lb.queue.waiting[sel.priority], 1)
+			queueDepthGauge.WithLabelValues(sel.priority.String()).Inc()
+			queuedAt = time.Now()
+			timer = time.NewTimer(timeout)
+			lb.logger.Debugf("Queued request for %s: %v", sel.destination, err)
+		}
+
+		select {
+		case <-lb.queue.waitChan():
+		case <-timer.C:
+			lb.leaveQueue(ctx, queuedAt, sel.priority, "timeout")
+			return nil, errQueueWait
+		case <-ctx.Done():
+			timer.Stop()
+			lb.leaveQueue(ctx, queuedAt, sel.priority, "cancelled")
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (lb *LoadBalancer) leaveQueue(ctx context.Context, queuedAt time.Time, class priorityClass, result string) {
+	atomic.AddInt64(&lb.queue.depth, -1)
+	remaining := atomic.AddInt64(&lb.queue.waiting[class], -1)
+	queueDepthGauge.WithLabelValues(class.String()).Dec()
+	queueResults.WithLabelValues(result, class.String()).Inc()
+	metrics.Observe(ctx, queueWait.WithLabelValues(class.String()), time.Since(queuedAt).Seconds())
+	if class == classInteractive && remaining == 0 {
+		// Batch requests held back for this one may go now
+		lb.queue.signal()
+	}
+}
+
+func (lb *LoadBalancer) releaseProxy(proxy *ProxyEndpoint) {
+	lb.inflight.release(proxy.Address, proxy.batch)
+	lb.queue.signal()
+}
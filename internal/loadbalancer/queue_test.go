@@ -0,0 +1,27 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAcquireUnknownPoolSkipsQueue(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	lb := NewLoadBalancer(logger, time.Minute)
+	lb.SetCapacity(0, 10, 5*time.Second)
+
+	start := time.Now()
+	_, err := lb.acquireProxy(context.Background(), selection{kind: trafficHTTP, pool: "missing"})
+	if !errors.Is(err, errPoolNotFound) {
+		t.Fatalf("acquireProxy with an unknown pool: got %v, want %v", err, errPoolNotFound)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("request for an unknown pool waited %s in the queue", waited)
+	}
+}
@@ -0,0 +1,137 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Rate limit keys: every client IP gets a bucket, or every authenticated
+// user does, with unauthenticated clients falling back to their IP.
+const (
+	RateLimitByIP   = "ip"
+	RateLimitByUser = "user"
+)
+
+// rateLimitSweepInterval bounds how often buckets of clients that went
+// quiet are dropped.
+const rateLimitSweepInterval = time.Minute
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_rate_limited_total",
+	Help: "Proxy requests and tunnels refused by the per-client rate limit, by key kind (ip or user)",
+}, []string{"by"})
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token bucket per client: each holds up to burst tokens
+// and refills at rate per second, and every request takes one.
+type rateLimiter struct {
+	rate      float64 // tokens per second; 0 = no limit
+	burst     float64
+	by        string
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{by: RateLimitByIP, buckets: make(map[string]*tokenBucket)}
+}
+
+// SetRateLimit allows each client rate requests per second with bursts of
+// up to burst (at least 1). by is RateLimitByIP or RateLimitByUser. A rate
+// of 0 turns the limit off.
+func (lb *LoadBalancer) SetRateLimit(rate float64, burst int, by string) error {
+	if rate < 0 || burst < 0 {
+		return fmt.Errorf("rate limit and burst must not be negative")
+	}
+	if by == "" {
+		by = RateLimitByIP
+	}
+	if by != RateLimitByIP && by != RateLimitByUser {
+		return fmt.Errorf("unknown rate limit key %q (want %s or %s)", by, RateLimitByIP, RateLimitByUser)
+	}
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	l := lb.rateLimit
+	l.mu.Lock()
+	l.rate = rate
+	l.burst = float64(burst)
+	l.by = by
+	l.buckets = make(map[string]*tokenBucket)
+	l.mu.Unlock()
+
+	if rate > 0 {
+		lb.logger.Infof("Rate limit: %g requests/s per %s, burst %d", rate, by, burst)
+	}
+	return nil
+}
+
+// key returns the bucket a request from client, authenticated as user
+// (empty when not), is counted against, and the kind of key.
+func (l *rateLimiter) key(client, user string) (string, string) {
+	l.mu.Lock()
+	by := l.by
+	l.mu.Unlock()
+	if by == RateLimitByUser && user != "" {
+		return "user " + user, RateLimitByUser
+	}
+	return "ip " + client, RateLimitByIP
+}
+
+// allow takes a token from key's bucket. When it is empty it returns false
+// and how long until the next token.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.lastSweep = now
+		l.sweepLocked(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+		b.updated = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweepLocked drops buckets that have refilled completely, which are the
+// same as no bucket at all.
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// retryAfter formats wait for a Retry-After header, in whole seconds and
+// never less than one.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds()))))
+}
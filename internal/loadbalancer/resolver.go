@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	preResolveTTL     = 60 * time.Second
+	preResolveTimeout = 5 * time.Second
+)
+
+type resolvedHost struct {
+	ip      string
+	expires time.Time
+}
+
+// preResolver resolves destinations to a single AAAA record at the
+// coordinator so every exit connects to the same literal address, avoiding
+// per-node DNS differences for geo-balanced targets.
+type preResolver struct {
+	logger  *logrus.Logger
+	enabled bool
+	cache   map[string]resolvedHost
+	mu      sync.Mutex
+}
+
+func newPreResolver(logger *logrus.Logger) *preResolver {
+	return &preResolver{
+		logger: logger,
+		cache:  make(map[string]resolvedHost),
+	}
+}
+
+func (p *preResolver) setEnabled(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enabled = enabled
+	p.cache = make(map[string]resolvedHost)
+}
+
+// pin returns hostport with its host replaced by a pinned IPv6 literal. It
+// returns hostport unchanged when pre-resolution is disabled, the host is
+// already an IP, or no AAAA record exists.
+func (p *preResolver) pin(ctx context.Context, hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || net.ParseIP(host) != nil {
+		return hostport
+	}
+
+	p.mu.Lock()
+	if !p.enabled {
+		p.mu.Unlock()
+		return hostport
+	}
+	entry, ok := p.cache[host]
+	p.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return net.JoinHostPort(entry.ip, port)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, preResolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip6", host)
+	if err != nil || len(ips) == 0 {
+		p.logger.Debugf("No AAAA record to pin for %s, letting the exit resolve it: %v", host, err)
+		return hostport
+	}
+
+	ip := ips[0].String()
+	p.mu.Lock()
+	p.cache[host] = resolvedHost{ip: ip, expires: time.Now().Add(preResolveTTL)}
+	p.mu.Unlock()
+
+	p.logger.Debugf("Pinned %s to %s", host, ip)
+	return net.JoinHostPort(ip, port)
+}
+
+// SetPreResolve enables resolving destinations at the coordinator and
+// passing the literal IPv6 address on to the exits.
+func (lb *LoadBalancer) SetPreResolve(enabled bool) {
+	lb.resolver.setEnabled(enabled)
+	if enabled {
+		lb.logger.Info("Destination pre-resolution (AAAA pinning) enabled")
+	}
+}
@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_lb_retries_total",
+	Help: "HTTP requests resent through another exit, by reason (ban, error).",
+}, []string{"reason"})
+
+// SetRetryPolicy lets replayable HTTP requests whose exit failed be resent
+// through up to maxAttempts exits in total (1 disables retries). With
+// connectOnly, only failures to connect to the exit are retried, since the
+// request cannot have reached the destination; otherwise any transport
+// error is.
+func (lb *LoadBalancer) SetRetryPolicy(maxAttempts int, connectOnly bool) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.retryAttempts = maxAttempts
+	lb.retryConnectOnly = connectOnly
+	if maxAttempts > 1 {
+		lb.logger.Infof("Failed requests are retried on up to %d exits (connect errors only: %t)", maxAttempts, connectOnly)
+	}
+}
+
+// retryFailure reports whether a request that already failed on failures
+// exits, the last time with err, may be tried on another one.
+func (lb *LoadBalancer) retryFailure(err error, failures int) bool {
+	lb.mu.RLock()
+	maxAttempts, connectOnly := lb.retryAttempts, lb.retryConnectOnly
+	lb.mu.RUnlock()
+	if failures >= maxAttempts {
+		return false
+	}
+	return !connectOnly || isConnectError(err)
+}
+
+// isConnectError reports whether err is a failure to reach the exit itself.
+// The transport wraps dial errors in a "proxyconnect" one.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	for errors.As(err, &opErr) {
+		if opErr.Op == "dial" {
+			return true
+		}
+		err = opErr.Err
+	}
+	return false
+}
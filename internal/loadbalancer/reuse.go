@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/auth"
+	"proxy-v6/pkg/models"
+)
+
+// reuseSweepInterval bounds how often uses of exit+host pairs that are no
+// longer requested are dropped.
+const reuseSweepInterval = time.Minute
+
+var errReuseExhausted = errors.New("every exit reached its reuse limit for this destination")
+
+// reuseLimiter counts recent uses of each exit against each destination
+// host covered by a reuse rule.
+type reuseLimiter struct {
+	rules     []models.ReuseRule
+	uses      map[string][]time.Time // banKey(exit, host) -> uses, oldest first
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func newReuseLimiter() *reuseLimiter {
+	return &reuseLimiter{uses: make(map[string][]time.Time)}
+}
+
+func validateReuseRules(rules []models.ReuseRule) error {
+	for i, rule := range rules {
+		if rule.Destination == "" {
+			return fmt.Errorf("reuse rule %d: destination is required", i)
+		}
+		if rule.MaxUses <= 0 || rule.WindowSeconds <= 0 {
+			return fmt.Errorf("reuse rule %d (%s): max_uses and window_seconds must be positive", i, rule.Destination)
+		}
+	}
+	return nil
+}
+
+// rule returns the first rule covering host.
+func (l *reuseLimiter) rule(host string) (models.ReuseRule, bool) {
+	if host == "" {
+		return models.ReuseRule{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rule := range l.rules {
+		if auth.MatchDestination(rule.Destination, host) {
+			return rule, true
+		}
+	}
+	return models.ReuseRule{}, false
+}
+
+// exhausted reports whether exit already carried rule.MaxUses requests to
+// host within the rule's window.
+func (l *reuseLimiter) exhausted(exit, host string, rule models.ReuseRule) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := banKey(exit, host)
+	uses := l.recentLocked(key, time.Now().Add(-time.Duration(rule.WindowSeconds)*time.Second))
+	return len(uses) >= rule.MaxUses
+}
+
+// take counts one use of exit against host if a rule covers the host. It
+// fails when a concurrent request used up the exit since it was selected,
+// unless force is set: the use is then counted past the limit.
+func (l *reuseLimiter) take(exit, host string, force bool) bool {
+	rule, ok := l.rule(host)
+	if !ok {
+		return true
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := banKey(exit, host)
+	uses := l.recentLocked(key, now.Add(-time.Duration(rule.WindowSeconds)*time.Second))
+	if len(uses) >= rule.MaxUses && !force {
+		return false
+	}
+	l.uses[key] = append(uses, now)
+
+	if now.Sub(l.lastSweep) >= reuseSweepInterval {
+		l.lastSweep = now
+		l.sweepLocked(now)
+	}
+	return true
+}
+
+// recentLocked drops uses of key older than since and returns the rest.
+func (l *reuseLimiter) recentLocked(key string, since time.Time) []time.Time {
+	uses := l.uses[key]
+	i := 0
+	for i < len(uses) && uses[i].Before(since) {
+		i++
+	}
+	if i == len(uses) {
+		delete(l.uses, key)
+		return nil
+	}
+	uses = uses[i:]
+	l.uses[key] = uses
+	return uses
+}
+
+// sweepLocked removes pairs whose last use is older than the longest
+// window, so destinations that stopped being requested do not pile up.
+func (l *reuseLimiter) sweepLocked(now time.Time) {
+	longest := 0
+	for _, rule := range l.rules {
+		if rule.WindowSeconds > longest {
+			longest = rule.WindowSeconds
+		}
+	}
+	since := now.Add(-time.Duration(longest) * time.Second)
+	for key, uses := range l.uses {
+		if uses[len(uses)-1].Before(since) {
+			delete(l.uses, key)
+		}
+	}
+}
+
+// SetReuseRules replaces the exit reuse limits. Uses already counted are
+// kept and measured against the new windows.
+func (lb *LoadBalancer) SetReuseRules(rules []models.ReuseRule) error {
+	if err := validateReuseRules(rules); err != nil {
+		return err
+	}
+	lb.reuse.mu.Lock()
+	lb.reuse.rules = rules
+	lb.reuse.mu.Unlock()
+	lb.logger.Infof("Exit reuse limits configured with %d rules", len(rules))
+	return nil
+}
+
+func (lb *LoadBalancer) ReuseRules() []models.ReuseRule {
+	lb.reuse.mu.Lock()
+	defer lb.reuse.mu.Unlock()
+	return append([]models.ReuseRule(nil), lb.reuse.rules...)
+}
@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPinnedUsesCountPastReuseLimit(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	lb := NewLoadBalancer(logger, time.Minute)
+	if err := lb.SetReuseRules([]models.ReuseRule{{Destination: "shop.example", MaxUses: 1, WindowSeconds: 60}}); err != nil {
+		t.Fatalf("SetReuseRules: %v", err)
+	}
+	lb.UpdateProxies([]models.NodeInfo{{
+		NodeID: "node-1",
+		Proxies: []models.ProxyInstance{{
+			ID:     "p1",
+			IPv6:   models.IPv6Address{IP: net.ParseIP("2001:db8::1")},
+			Port:   3128,
+			Status: models.ProxyStatusRunning,
+		}},
+	}})
+
+	pinned := selection{kind: trafficHTTP, destination: "shop.example:80", instanceID: "p1"}
+	for i := 0; i < 3; i++ {
+		proxy, err := lb.acquireProxy(context.Background(), pinned)
+		if err != nil {
+			t.Fatalf("pinned request %d: %v", i+1, err)
+		}
+		lb.releaseProxy(proxy)
+	}
+	if uses := len(lb.reuse.uses[banKey("[2001:db8::1]:3128", "shop.example")]); uses != 3 {
+		t.Fatalf("three pinned requests counted %d uses, want 3", uses)
+	}
+
+	if _, err := lb.acquireProxy(context.Background(), selection{kind: trafficHTTP, destination: "shop.example:80"}); err != errReuseExhausted {
+		t.Fatalf("unpinned request after the pinned ones: got %v, want %v", err, errReuseExhausted)
+	}
+}
@@ -0,0 +1,92 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"proxy-v6/internal/auth"
+	"proxy-v6/pkg/models"
+)
+
+type rewriter struct {
+	rules []models.RewriteRule
+	mu    sync.RWMutex
+}
+
+func (rw *rewriter) setRules(rules []models.RewriteRule) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.rules = rules
+}
+
+func (rw *rewriter) getRules() []models.RewriteRule {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return append([]models.RewriteRule(nil), rw.rules...)
+}
+
+// apply mutates resp headers according to every rule matching destination.
+func (rw *rewriter) apply(destination string, resp *http.Response) {
+	for _, rule := range rw.getRules() {
+		if !auth.MatchDestination(rule.Destination, destination) {
+			continue
+		}
+
+		if rule.StripCookies {
+			resp.Header.Del("Set-Cookie")
+		}
+		for _, header := range rule.StripHeaders {
+			resp.Header.Del(header)
+		}
+		if rule.LocationTarget != "" {
+			if location := resp.Header.Get("Location"); location != "" {
+				if rewritten, ok := rewriteLocation(location, rule); ok {
+					resp.Header.Set("Location", rewritten)
+				}
+			}
+		}
+	}
+}
+
+func rewriteLocation(location string, rule models.RewriteRule) (string, bool) {
+	loc, err := url.Parse(location)
+	if err != nil || !loc.IsAbs() || !isInternalHost(loc.Hostname(), rule.InternalHosts) {
+		return "", false
+	}
+	target, err := url.Parse(rule.LocationTarget)
+	if err != nil || target.Host == "" {
+		return "", false
+	}
+	loc.Scheme = target.Scheme
+	loc.Host = target.Host
+	return loc.String(), true
+}
+
+func isInternalHost(host string, internalHosts []string) bool {
+	for _, h := range internalHosts {
+		if auth.MatchDestination(h, host) {
+			return true
+		}
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// SetRewriteRules replaces the response rewriting rules.
+func (lb *LoadBalancer) SetRewriteRules(rules []models.RewriteRule) {
+	lb.rewriter.setRules(rules)
+	lb.logger.Infof("Response rewriting configured with %d rules", len(rules))
+}
+
+func (lb *LoadBalancer) RewriteRules() []models.RewriteRule {
+	return lb.rewriter.getRules()
+}
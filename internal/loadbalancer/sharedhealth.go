@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var healthCheckResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_lb_health_checks_total",
+	Help: "Exit health check results by source: probe (dialed by this coordinator) or shared (copied from the primary).",
+}, []string{"source"})
+
+// healthResults keeps the outcome of the last connect check of every exit,
+// and on a read replica the primary's outcomes, so that every coordinator
+// does not probe every exit.
+type healthResults struct {
+	probed map[string]models.ExitHealth // address -> this coordinator's last check
+	shared map[string]models.ExitHealth // address -> the primary's last check
+	mu     sync.Mutex
+}
+
+func newHealthResults() *healthResults {
+	return &healthResults{probed: make(map[string]models.ExitHealth), shared: make(map[string]models.ExitHealth)}
+}
+
+func (h *healthResults) record(result models.ExitHealth) {
+	h.mu.Lock()
+	h.probed[result.Address] = result
+	h.mu.Unlock()
+}
+
+// recent returns the primary's result for address when it is younger than
+// maxAge.
+func (h *healthResults) recent(address string, maxAge time.Duration, now time.Time) (models.ExitHealth, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result, ok := h.shared[address]
+	if !ok || now.Sub(result.CheckedAt) >= maxAge {
+		return models.ExitHealth{}, false
+	}
+	return result, true
+}
+
+// retain forgets the results of exits no longer in the pool.
+func (h *healthResults) retain(addresses map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for address := range h.probed {
+		if !addresses[address] {
+			delete(h.probed, address)
+		}
+	}
+}
+
+// HealthResults returns the outcome of this coordinator's last connect
+// check of each exit, sorted by address.
+func (lb *LoadBalancer) HealthResults() []models.ExitHealth {
+	lb.health.mu.Lock()
+	defer lb.health.mu.Unlock()
+	results := make([]models.ExitHealth, 0, len(lb.health.probed))
+	for _, result := range lb.health.probed {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Address < results[j].Address })
+	return results
+}
+
+// SetSharedHealth replaces the check results copied from the primary
+// coordinator. An exit with a result younger than twice the check interval
+// is not probed again; once the primary stops sharing, results age and the
+// exits are probed here instead.
+func (lb *LoadBalancer) SetSharedHealth(results []models.ExitHealth) {
+	shared := make(map[string]models.ExitHealth, len(results))
+	for _, result := range results {
+		shared[result.Address] = result
+	}
+	lb.health.mu.Lock()
+	lb.health.shared = shared
+	lb.health.mu.Unlock()
+}
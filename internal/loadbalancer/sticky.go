@@ -0,0 +1,144 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// DefaultStickyTTL is how long a sticky-client session outlives the last
+// request of its client.
+const DefaultStickyTTL = 30 * time.Minute
+
+// stickyTable remembers the exit of every client picked with the
+// sticky-client strategy. The hash ring places new clients; once placed, a
+// client keeps its exit until the session expires, also while exits join
+// the pool, and only moves while its exit is not eligible.
+type stickyTable struct {
+	ttl      time.Duration
+	sessions map[string]models.StickySession // client IP -> its session
+	changed  bool                            // since the sessions were last saved
+	mu       sync.Mutex
+}
+
+func newStickyTable() *stickyTable {
+	return &stickyTable{
+		ttl:      DefaultStickyTTL,
+		sessions: make(map[string]models.StickySession),
+	}
+}
+
+// lookup returns the index in candidates of the client's exit and extends
+// its session, or false when the client has no live session on one of
+// them.
+func (t *stickyTable) lookup(client string, candidates []ProxyEndpoint, now time.Time) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.sessions[client]
+	if !ok || !session.ExpiresAt.After(now) {
+		return 0, false
+	}
+	for i, p := range candidates {
+		if p.Address == session.Exit {
+			session.ExpiresAt = now.Add(t.ttl)
+			t.sessions[client] = session
+			t.changed = true
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// record starts or moves the client's session to exit.
+func (t *stickyTable) record(client, exit string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sessions[client] = models.StickySession{Client: client, Exit: exit, ExpiresAt: now.Add(t.ttl)}
+	t.changed = true
+}
+
+// live returns the sessions not expired by now, oldest expiry first, and
+// forgets the others.
+func (t *stickyTable) live(now time.Time) []models.StickySession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]models.StickySession, 0, len(t.sessions))
+	for client, session := range t.sessions {
+		if !session.ExpiresAt.After(now) {
+			delete(t.sessions, client)
+			continue
+		}
+		result = append(result, session)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].ExpiresAt.Equal(result[j].ExpiresAt) {
+			return result[i].ExpiresAt.Before(result[j].ExpiresAt)
+		}
+		return result[i].Client < result[j].Client
+	})
+	return result
+}
+
+// SetStickyTTL sets how long a sticky-client session lasts after the last
+// request of its client.
+func (lb *LoadBalancer) SetStickyTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("sticky session TTL must be positive")
+	}
+	lb.sticky.mu.Lock()
+	defer lb.sticky.mu.Unlock()
+	lb.sticky.ttl = ttl
+	return nil
+}
+
+// StickySessions returns the sticky-client sessions not expired by now.
+func (lb *LoadBalancer) StickySessions(now time.Time) []models.StickySession {
+	return lb.sticky.live(now)
+}
+
+// StickyState returns the live sessions and whether any changed since the
+// last call, so they are only saved when needed.
+func (lb *LoadBalancer) StickyState(now time.Time) ([]models.StickySession, bool) {
+	sessions := lb.sticky.live(now)
+	lb.sticky.mu.Lock()
+	changed := lb.sticky.changed
+	lb.sticky.changed = false
+	lb.sticky.mu.Unlock()
+	return sessions, changed
+}
+
+// SetStickySessions replaces the sticky-client sessions, as when restoring
+// them after a restart. Expired ones are dropped.
+func (lb *LoadBalancer) SetStickySessions(sessions []models.StickySession, now time.Time) {
+	lb.sticky.mu.Lock()
+	defer lb.sticky.mu.Unlock()
+
+	lb.sticky.sessions = make(map[string]models.StickySession, len(sessions))
+	for _, session := range sessions {
+		if session.ExpiresAt.After(now) {
+			lb.sticky.sessions[session.Client] = session
+		}
+	}
+}
+
+// MergeStickySessions takes over the sessions of another coordinator, as a
+// read replica does from its primary. Of two sessions of the same client
+// the one expiring last wins, so a replica keeps the clients it placed
+// itself.
+func (lb *LoadBalancer) MergeStickySessions(sessions []models.StickySession, now time.Time) {
+	lb.sticky.mu.Lock()
+	defer lb.sticky.mu.Unlock()
+
+	for _, session := range sessions {
+		current, ok := lb.sticky.sessions[session.Client]
+		if session.ExpiresAt.After(now) && (!ok || session.ExpiresAt.After(current.ExpiresAt)) {
+			lb.sticky.sessions[session.Client] = session
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy decides which eligible exit a request goes to.
+type Strategy string
+
+const (
+	// StrategyRoundRobin cycles through exits in pool order.
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyLeastConnections prefers the exits with the fewest requests
+	// and tunnels in flight, taking turns among equally busy ones.
+	StrategyLeastConnections Strategy = "least-connections"
+	// StrategyStickyClient sends every request from a client IP through
+	// the same exit for as long as that exit is eligible. New clients are
+	// placed with a consistent hash ring; the exit each one got is kept as
+	// a session until the client has been idle for the sticky TTL, so
+	// exits joining the pool do not move it.
+	StrategyStickyClient Strategy = "sticky-client"
+	// StrategyLeastCost sends requests to the exits of the nodes with the
+	// cheapest egress, taking turns among them as round-robin does, and
+	// only uses dearer or unpriced nodes when no cheaper exit is eligible.
+	StrategyLeastCost Strategy = "least-cost"
+)
+
+// ringReplicas is how many points each exit gets on the hash ring, enough
+// to spread clients evenly over a handful of exits.
+const ringReplicas = 100
+
+// ParseStrategy validates a --lb-strategy value. Empty means round-robin.
+func ParseStrategy(name string) (Strategy, error) {
+	switch Strategy(name) {
+	case "", StrategyRoundRobin:
+		return StrategyRoundRobin, nil
+	case StrategyLeastConnections, StrategyStickyClient, StrategyLeastCost:
+		return Strategy(name), nil
+	}
+	return "", fmt.Errorf("unknown load balancing strategy %q (want %s, %s, %s or %s)", name, StrategyRoundRobin, StrategyLeastConnections, StrategyStickyClient, StrategyLeastCost)
+}
+
+// SetStrategy changes how exits are picked for new requests.
+func (lb *LoadBalancer) SetStrategy(strategy Strategy) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.strategy = strategy
+	lb.rebuildRingLocked()
+	lb.logger.Infof("Load balancing strategy: %s", strategy)
+}
+
+// Strategy returns the current load balancing strategy.
+func (lb *LoadBalancer) Strategy() Strategy {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.strategy
+}
+
+// InFlight returns the number of requests and tunnels currently using each
+// exit. Idle exits are left out.
+func (lb *LoadBalancer) InFlight() map[string]int64 {
+	return lb.inflight.snapshot()
+}
+
+// pickLocked chooses among candidates according to the strategy. The
+// round-robin counter also breaks ties between equally busy exits so idle
+// exits share new traffic instead of the first one taking all of it.
+// Sticky selection keeps a client on the exit of its session, and falls
+// back to round-robin without a client. When nodes
+// report weights, turns are spread in proportion to them and
+// least-connections compares requests in flight per unit of weight.
+func (lb *LoadBalancer) pickLocked(candidates []ProxyEndpoint, client string) int {
+	if lb.strategy == StrategyStickyClient && client != "" && lb.ring != nil {
+		now := time.Now()
+		if i, ok := lb.sticky.lookup(client, candidates, now); ok {
+			return i
+		}
+		if i, ok := lb.ring.pick(client, candidates); ok {
+			lb.sticky.record(client, candidates[i].Address, now)
+			return i
+		}
+	}
+
+	weights := exitWeights(candidates)
+	turn := atomic.AddUint64(&lb.roundRobin, 1) - 1
+	if lb.strategy != StrategyLeastConnections {
+		if weights != nil {
+			return weightedIndex(weights, spread(turn))
+		}
+		return int(turn % uint64(len(candidates)))
+	}
+
+	counts := lb.inflight.snapshot()
+	load := func(i int) float64 {
+		if weights == nil {
+			return float64(counts[candidates[i].Address])
+		}
+		return float64(counts[candidates[i].Address]) / weights[i]
+	}
+	var least []int
+	for i := range candidates {
+		switch {
+		case len(least) == 0 || load(i) < load(least[0]):
+			least = append(least[:0], i)
+		case load(i) == load(least[0]):
+			least = append(least, i)
+		}
+	}
+	if weights == nil {
+		return least[turn%uint64(len(least))]
+	}
+	tied := make([]float64, len(least))
+	for j, i := range least {
+		tied[j] = weights[i]
+	}
+	return least[weightedIndex(tied, spread(turn))]
+}
+
+// rebuildRingLocked places the pool's exits on the hash ring, each with
+// points in proportion to its weight. It only keeps a ring while the
+// sticky strategy is in use.
+func (lb *LoadBalancer) rebuildRingLocked() {
+	if lb.strategy != StrategyStickyClient {
+		lb.ring = nil
+		return
+	}
+	addresses := make([]string, 0, len(lb.proxies))
+	for _, p := range lb.proxies {
+		addresses = append(addresses, p.Address)
+	}
+	var shares []int
+	if weights := exitWeights(lb.proxies); weights != nil {
+		shares = ringShares(weights)
+	}
+	lb.ring = newHashRing(addresses, shares)
+}
+
+// hashRing maps clients to exits by consistent hashing. Each exit owns
+// ringReplicas points, or its share of them when weighted; a client
+// belongs to the first point at or after its own hash.
+type hashRing struct {
+	points []uint64
+	owners []string // exit address at each point
+}
+
+// newHashRing gives the exit at addresses[i] shares[i] points, or
+// ringReplicas each when shares is nil.
+func newHashRing(addresses []string, shares []int) *hashRing {
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(addresses)*ringReplicas)
+	for n, address := range addresses {
+		replicas := uint64(ringReplicas)
+		if shares != nil {
+			replicas = uint64(shares[n])
+		}
+		base := ringHash(address)
+		for i := uint64(0); i < replicas; i++ {
+			points = append(points, point{mix64(base + i*0x9e3779b97f4a7c15), address})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	h := &hashRing{
+		points: make([]uint64, len(points)),
+		owners: make([]string, len(points)),
+	}
+	for i, p := range points {
+		h.points[i], h.owners[i] = p.hash, p.owner
+	}
+	return h
+}
+
+// pick returns the index in candidates of the client's exit: the first
+// exit clockwise from the client's hash that is a candidate, so a client
+// whose exit is unhealthy, excluded or full moves to the next one.
+func (h *hashRing) pick(client string, candidates []ProxyEndpoint) (int, bool) {
+	if len(h.points) == 0 {
+		return 0, false
+	}
+	index := make(map[string]int, len(candidates))
+	for i, p := range candidates {
+		index[p.Address] = i
+	}
+
+	key := ringHash(client)
+	start := sort.Search(len(h.points), func(i int) bool {
+		return h.points[i] >= key
+	})
+	for n := 0; n < len(h.points); n++ {
+		if i, ok := index[h.owners[(start+n)%len(h.points)]]; ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ringHash is FNV-1a finished with mix64, which spreads similar keys such
+// as neighbouring client IPs evenly around the ring.
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,166 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultStreamThreshold is the response size from which downloads
+	// take the raw path.
+	DefaultStreamThreshold = 16 << 20
+	// streamChunk is how much is copied between byte accounting updates.
+	streamChunk = 1 << 20
+	// streamIdleTimeout ends a raw stream whose chunk makes no progress.
+	streamIdleTimeout = 2 * time.Minute
+)
+
+var (
+	streamsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_streams_total",
+		Help: "Large HTTP downloads copied on the raw connection path.",
+	})
+	streamedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_lb_streamed_bytes_total",
+		Help: "Response body bytes copied on the raw connection path.",
+	})
+)
+
+// errHandedOff ends the transport's reads on a connection taken over by a
+// raw stream.
+var errHandedOff = errors.New("connection handed off to a raw stream")
+
+// SetStreamThreshold sets the Content-Length from which responses skip the
+// HTTP stack and are copied straight between the exit's connection and the
+// client's. 0 turns the raw path off.
+func (lb *LoadBalancer) SetStreamThreshold(bytes int64) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.streamThreshold = bytes
+	if bytes > 0 {
+		lb.logger.Infof("Downloads of %d MB or more take the raw connection path", bytes>>20)
+	}
+}
+
+// exitConn finds the exit connection under a response body, through the
+// wrappers ban inspection puts around it.
+func exitConn(body io.Closer) *trackedConn {
+	for {
+		switch b := body.(type) {
+		case *inFlightBody:
+			return b.conn
+		case *prefixedBody:
+			body = b.Closer
+		default:
+			return nil
+		}
+	}
+}
+
+// streamResponse sends a large download with a known length by copying the
+// exit's connection to the client's, which Linux can splice without the
+// body passing through the process. Both connections are closed after it.
+// The transfer is listed with the tunnels, its bytes accounted every
+// chunk. It reports false, with nothing written, when resp does not
+// qualify.
+func (lb *LoadBalancer) streamResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, proxy *ProxyEndpoint, user *models.User) bool {
+	lb.mu.RLock()
+	threshold := lb.streamThreshold
+	lb.mu.RUnlock()
+	if threshold <= 0 || resp.ContentLength < threshold || r.Method == http.MethodHead || resp.ProtoMajor != 1 {
+		return false
+	}
+	conn := exitConn(resp.Body)
+	hijacker, ok := w.(http.Hijacker)
+	if conn == nil || !ok {
+		return false
+	}
+	header := w.Header().Clone()
+	clientConn, client, err := hijacker.Hijack()
+	if err != nil {
+		lb.logger.Debugf("Streaming %s the regular way: %v", r.URL, err)
+		return false
+	}
+	defer clientConn.Close()
+
+	// What the transport already read past the headers comes out of the
+	// body; after that its reads fail and the connection is ours
+	conn.handOff()
+	defer conn.close()
+	defer resp.Body.Close()
+	var buffered bytes.Buffer
+	if _, err := io.Copy(&buffered, resp.Body); err != nil && !errors.Is(err, errHandedOff) {
+		lb.logger.Warnf("Error reading response body from %s: %v", proxy.Address, err)
+		return true
+	}
+	remaining := resp.ContentLength - int64(buffered.Len())
+
+	for key, values := range resp.Header {
+		header[key] = append(header[key], values...)
+	}
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	header.Set("Connection", "close")
+	clientConn.SetDeadline(time.Time{})
+	fmt.Fprintf(client, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	header.Write(client)
+	client.WriteString("\r\n")
+	client.Write(buffered.Bytes())
+	if err := client.Flush(); err != nil {
+		lb.logger.Debugf("Client of %s went away: %v", r.URL, err)
+		return true
+	}
+
+	t := &tunnel{
+		info: models.TunnelInfo{
+			ID:          newTunnelID(),
+			ClientIP:    lb.clientIP(r),
+			Destination: requestDestination(r),
+			Exit:        proxy.Address,
+			NodeID:      proxy.NodeID,
+			StartedAt:   time.Now(),
+			Streamed:    true,
+		},
+		clientConn: clientConn,
+		proxyConn:  conn.Conn,
+		received:   int64(buffered.Len()),
+	}
+	if user != nil {
+		t.info.User = user.Username
+	}
+	lb.tunnels.add(t)
+	defer lb.tunnels.remove(t.info.ID)
+	defer func() { lb.meterTraffic(user, proxy, 0, 0, atomic.LoadInt64(&t.received)) }()
+	streamsTotal.Inc()
+	streamedBytes.Add(float64(buffered.Len()))
+
+	for remaining > 0 {
+		deadline := time.Now().Add(streamIdleTimeout)
+		conn.Conn.SetReadDeadline(deadline)
+		clientConn.SetWriteDeadline(deadline)
+		n, err := io.Copy(clientConn, io.LimitReader(conn.Conn, min(remaining, streamChunk)))
+		remaining -= n
+		atomic.AddInt64(&t.received, n)
+		streamedBytes.Add(float64(n))
+		if err != nil || n == 0 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			lb.logger.Warnf("Stream of %s via %s ended %d bytes short: %v", r.URL, proxy.Address, remaining, err)
+			break
+		}
+	}
+	lb.logger.Debugf("Streamed %d bytes of %s via %s", atomic.LoadInt64(&t.received), r.URL, proxy.Address)
+	return true
+}
@@ -0,0 +1,227 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/auth"
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+	// errTenantUnavailable is a tenant's user finding none of the tenant's
+	// exits in rotation.
+	errTenantUnavailable = errors.New("no exit of the tenant is available")
+)
+
+var tenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_tenant_requests_total",
+	Help: "Requests forwarded for the proxy users of each tenant.",
+}, []string{"tenant"})
+
+// tenantTable holds the tenants and which of them each node and pool is
+// assigned to.
+type tenantTable struct {
+	tenants map[string]models.Tenant
+	nodes   map[string]string // node ID -> tenant
+	pools   map[string]string // pool -> tenant
+	mu      sync.RWMutex
+}
+
+func newTenantTable() *tenantTable {
+	return &tenantTable{tenants: make(map[string]models.Tenant), nodes: make(map[string]string), pools: make(map[string]string)}
+}
+
+// owner returns the tenant p is assigned to through its node or one of its
+// pools, or "" for an exit shared by everyone else.
+func (t *tenantTable) owner(p ProxyEndpoint, pools *poolTable) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if tenant, ok := t.nodes[p.NodeID]; ok {
+		return tenant
+	}
+	for pool, tenant := range t.pools {
+		if pools.contains(p, pool) {
+			return tenant
+		}
+	}
+	return ""
+}
+
+func (t *tenantTable) defined(name string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.tenants[name]
+	return ok
+}
+
+// assign indexes tenants by node and pool, refusing a node or pool
+// assigned twice.
+func assign(tenants map[string]models.Tenant) (nodes, pools map[string]string, err error) {
+	nodes, pools = make(map[string]string), make(map[string]string)
+	for _, tenant := range tenants {
+		for _, nodeID := range tenant.Nodes {
+			if other, ok := nodes[nodeID]; ok && other != tenant.Name {
+				return nil, nil, fmt.Errorf("node %s is assigned to both %s and %s", nodeID, other, tenant.Name)
+			}
+			nodes[nodeID] = tenant.Name
+		}
+		for _, pool := range tenant.Pools {
+			if other, ok := pools[pool]; ok && other != tenant.Name {
+				return nil, nil, fmt.Errorf("pool %s is assigned to both %s and %s", pool, other, tenant.Name)
+			}
+			pools[pool] = tenant.Name
+		}
+	}
+	return nodes, pools, nil
+}
+
+func validateTenant(tenant models.Tenant) error {
+	if err := auth.ValidateTenantName(tenant.Name); err != nil {
+		return err
+	}
+	for _, pool := range tenant.Pools {
+		if err := auth.ValidatePoolName(pool); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.Name, err)
+		}
+	}
+	return nil
+}
+
+// replace swaps in tenants once they are checked.
+func (t *tenantTable) replace(tenants map[string]models.Tenant) error {
+	nodes, pools, err := assign(tenants)
+	if err != nil {
+		return err
+	}
+	t.tenants, t.nodes, t.pools = tenants, nodes, pools
+	return nil
+}
+
+// SetTenants replaces the tenants.
+func (lb *LoadBalancer) SetTenants(tenants []models.Tenant) error {
+	defined := make(map[string]models.Tenant, len(tenants))
+	for i, tenant := range tenants {
+		if err := validateTenant(tenant); err != nil {
+			return fmt.Errorf("tenant %d: %w", i, err)
+		}
+		if _, ok := defined[tenant.Name]; ok {
+			return fmt.Errorf("tenant %d: %s is defined twice", i, tenant.Name)
+		}
+		defined[tenant.Name] = tenant
+	}
+
+	lb.tenants.mu.Lock()
+	defer lb.tenants.mu.Unlock()
+	if err := lb.tenants.replace(defined); err != nil {
+		return err
+	}
+	if len(tenants) > 0 {
+		lb.logger.Infof("Tenants configured: %d", len(tenants))
+	}
+	return nil
+}
+
+// SetTenant adds the tenant or replaces the one with its name. A new
+// tenant's CreatedAt is set to now, and a replaced one keeps its own.
+func (lb *LoadBalancer) SetTenant(tenant models.Tenant, now time.Time) (models.Tenant, error) {
+	if err := validateTenant(tenant); err != nil {
+		return models.Tenant{}, err
+	}
+
+	lb.tenants.mu.Lock()
+	defer lb.tenants.mu.Unlock()
+	if existing, ok := lb.tenants.tenants[tenant.Name]; ok {
+		tenant.CreatedAt = existing.CreatedAt
+	} else {
+		tenant.CreatedAt = now
+	}
+	tenants := make(map[string]models.Tenant, len(lb.tenants.tenants)+1)
+	for name, t := range lb.tenants.tenants {
+		tenants[name] = t
+	}
+	tenants[tenant.Name] = tenant
+	if err := lb.tenants.replace(tenants); err != nil {
+		return models.Tenant{}, err
+	}
+	lb.logger.Infof("Tenant %s updated", tenant.Name)
+	return tenant, nil
+}
+
+// DeleteTenant removes the tenant. Its nodes and pools serve everyone
+// without a tenant again.
+func (lb *LoadBalancer) DeleteTenant(name string) error {
+	lb.tenants.mu.Lock()
+	defer lb.tenants.mu.Unlock()
+	if _, ok := lb.tenants.tenants[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrTenantNotFound, name)
+	}
+	tenants := make(map[string]models.Tenant, len(lb.tenants.tenants))
+	for n, t := range lb.tenants.tenants {
+		if n != name {
+			tenants[n] = t
+		}
+	}
+	lb.tenants.replace(tenants)
+	lb.logger.Infof("Tenant %s deleted", name)
+	return nil
+}
+
+// Tenants returns the tenants sorted by name.
+func (lb *LoadBalancer) Tenants() []models.Tenant {
+	lb.tenants.mu.RLock()
+	defer lb.tenants.mu.RUnlock()
+	tenants := make([]models.Tenant, 0, len(lb.tenants.tenants))
+	for _, tenant := range lb.tenants.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants
+}
+
+// Tenant returns the named tenant.
+func (lb *LoadBalancer) Tenant(name string) (models.Tenant, error) {
+	lb.tenants.mu.RLock()
+	defer lb.tenants.mu.RUnlock()
+	tenant, ok := lb.tenants.tenants[name]
+	if !ok {
+		return models.Tenant{}, fmt.Errorf("%w: %s", ErrTenantNotFound, name)
+	}
+	return tenant, nil
+}
+
+// TenantExitCounts returns how many exits the tenant has and how many of
+// them are healthy and in rotation.
+func (lb *LoadBalancer) TenantExitCounts(name string) (exits, healthy int) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, p := range lb.proxies {
+		if lb.tenants.owner(p, lb.pools) != name {
+			continue
+		}
+		exits++
+		if _, draining := lb.drained[p.NodeID]; p.Healthy && !p.Standby && !draining {
+			healthy++
+		}
+	}
+	return exits, healthy
+}
+
+// TenantExits keeps the exits of the tenant, or the shared ones when
+// tenant is "".
+func (lb *LoadBalancer) TenantExits(exits []models.PoolExit, tenant string) []models.PoolExit {
+	kept := []models.PoolExit{}
+	for _, exit := range exits {
+		if lb.tenants.owner(ProxyEndpoint{NodeID: exit.NodeID, IP: exit.IP, Pools: exit.Pools}, lb.pools) == tenant {
+			kept = append(kept, exit)
+		}
+	}
+	return kept
+}
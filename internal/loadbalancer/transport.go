@@ -0,0 +1,263 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+var defaultTransportSettings = models.TransportSettings{
+	MaxIdleConns:           100,
+	MaxIdleConnsPerHost:    10,
+	IdleConnTimeoutSeconds: 90,
+}
+
+// exitTransport is the pooled HTTP transport used for one upstream exit,
+// together with counters describing how well its connections are reused.
+type exitTransport struct {
+	transport  atomic.Pointer[http.Transport] // swapped when the settings change
+	dials      int64
+	dialErrors int64
+	requests   int64
+	reused     int64
+	openConns  int64
+	inFlight   int64
+}
+
+// transportPool keeps one transport per exit so keep-alive connections are
+// reused across client requests instead of being dialed every time.
+type transportPool struct {
+	settings   models.TransportSettings
+	transports map[string]*exitTransport
+	mu         sync.Mutex
+}
+
+func newTransportPool() *transportPool {
+	return &transportPool{
+		settings:   defaultTransportSettings,
+		transports: make(map[string]*exitTransport),
+	}
+}
+
+func (p *transportPool) get(address string) *exitTransport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if et, ok := p.transports[address]; ok {
+		return et
+	}
+	et := p.newExitTransport(address)
+	p.transports[address] = et
+	return et
+}
+
+func (p *transportPool) newExitTransport(address string) *exitTransport {
+	et := &exitTransport{}
+	et.transport.Store(p.buildTransport(et, address))
+	return et
+}
+
+// buildTransport makes a transport to address with the current settings
+// that counts its connections on et.
+func (p *transportPool) buildTransport(et *exitTransport, address string) *http.Transport {
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://%s", address))
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt64(&et.dials, 1)
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				atomic.AddInt64(&et.dialErrors, 1)
+				return nil, err
+			}
+			atomic.AddInt64(&et.openConns, 1)
+			return &trackedConn{Conn: conn, open: &et.openConns}, nil
+		},
+		MaxIdleConns:          p.settings.MaxIdleConns,
+		MaxIdleConnsPerHost:   p.settings.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(p.settings.IdleConnTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// roundTrip sends req through the exit transport and records reuse stats.
+func (et *exitTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&et.requests, 1)
+	var conn *trackedConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&et.reused, 1)
+			}
+			// Only plain HTTP requests; https ones run over TLS inside it
+			conn, _ = info.Conn.(*trackedConn)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	client := &http.Client{
+		Transport: et.transport.Load(),
+		Timeout:   60 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // Don't follow redirects
+		},
+	}
+
+	atomic.AddInt64(&et.inFlight, 1)
+	resp, err := client.Do(req)
+	if err != nil {
+		atomic.AddInt64(&et.inFlight, -1)
+		return nil, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, inFlight: &et.inFlight, conn: conn}
+	return resp, nil
+}
+
+func (et *exitTransport) stats(address string) models.TransportStats {
+	stats := models.TransportStats{
+		Exit:       address,
+		Dials:      atomic.LoadInt64(&et.dials),
+		DialErrors: atomic.LoadInt64(&et.dialErrors),
+		Requests:   atomic.LoadInt64(&et.requests),
+		Reused:     atomic.LoadInt64(&et.reused),
+		OpenConns:  atomic.LoadInt64(&et.openConns),
+		InFlight:   atomic.LoadInt64(&et.inFlight),
+	}
+	if stats.Requests > 0 {
+		stats.ReuseRatio = float64(stats.Reused) / float64(stats.Requests)
+	}
+	if idle := stats.OpenConns - stats.InFlight; idle > 0 {
+		stats.IdleConns = idle
+	}
+	return stats
+}
+
+// prune drops transports for exits that left the pool.
+func (p *transportPool) prune(active map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for address, et := range p.transports {
+		if !active[address] {
+			et.transport.Load().CloseIdleConnections()
+			delete(p.transports, address)
+		}
+	}
+}
+
+func (p *transportPool) getSettings() models.TransportSettings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.settings
+}
+
+// setSettings rebuilds every transport with the new limits. Counters are
+// kept and in-flight requests finish on the old transport.
+func (p *transportPool) setSettings(settings models.TransportSettings) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.settings = settings
+	for address, et := range p.transports {
+		old := et.transport.Swap(p.buildTransport(et, address))
+		old.CloseIdleConnections()
+	}
+}
+
+func (p *transportPool) allStats() []models.TransportStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := make([]models.TransportStats, 0, len(p.transports))
+	for address, et := range p.transports {
+		result = append(result, et.stats(address))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Exit < result[j].Exit
+	})
+	return result
+}
+
+type trackedConn struct {
+	net.Conn
+	open      *int64
+	handedOff atomic.Bool // taken over by a raw stream, which closes it
+	closeOnce sync.Once
+}
+
+// handOff lets a raw stream take over the connection: the transport's
+// reads fail from now on and closing it is left to the stream.
+func (c *trackedConn) handOff() {
+	c.handedOff.Store(true)
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	if c.handedOff.Load() {
+		return 0, errHandedOff
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *trackedConn) Close() error {
+	if c.handedOff.Load() {
+		return nil
+	}
+	return c.close()
+}
+
+func (c *trackedConn) close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(c.open, -1)
+	})
+	return c.Conn.Close()
+}
+
+type inFlightBody struct {
+	io.ReadCloser
+	inFlight  *int64
+	conn      *trackedConn // the exit connection, nil for https requests
+	closeOnce sync.Once
+}
+
+func (b *inFlightBody) Close() error {
+	b.closeOnce.Do(func() {
+		atomic.AddInt64(b.inFlight, -1)
+	})
+	return b.ReadCloser.Close()
+}
+
+// TransportStats returns connection reuse statistics per exit.
+func (lb *LoadBalancer) TransportStats() []models.TransportStats {
+	return lb.transports.allStats()
+}
+
+func (lb *LoadBalancer) TransportSettings() models.TransportSettings {
+	return lb.transports.getSettings()
+}
+
+// SetTransportSettings applies new connection pool limits at runtime.
+func (lb *LoadBalancer) SetTransportSettings(settings models.TransportSettings) error {
+	if settings.MaxIdleConns < 0 || settings.MaxIdleConnsPerHost < 0 || settings.IdleConnTimeoutSeconds < 0 {
+		return fmt.Errorf("transport settings must not be negative")
+	}
+	lb.transports.setSettings(settings)
+	lb.logger.Infof("Transport settings updated: max_idle=%d max_idle_per_host=%d idle_timeout=%ds",
+		settings.MaxIdleConns, settings.MaxIdleConnsPerHost, settings.IdleConnTimeoutSeconds)
+	return nil
+}
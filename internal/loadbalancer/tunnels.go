@@ -0,0 +1,199 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-v6/internal/audit"
+	"proxy-v6/pkg/models"
+)
+
+const (
+	// tunnelUsageInterval is how often an open tunnel renews its ledger
+	// entry.
+	tunnelUsageInterval = 5 * time.Minute
+	// scheduleCheckInterval is how often open tunnels are checked against
+	// the access schedules of their users.
+	scheduleCheckInterval = 15 * time.Second
+)
+
+type tunnel struct {
+	info       models.TunnelInfo
+	clientConn net.Conn
+	proxyConn  net.Conn
+	sent       int64
+	received   int64
+	closeOnce  sync.Once
+}
+
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		t.clientConn.Close()
+		t.proxyConn.Close()
+	})
+}
+
+// tunnelRegistry tracks active CONNECT tunnels so they can be listed and
+// terminated through the API.
+type tunnelRegistry struct {
+	tunnels map[string]*tunnel
+	mu      sync.RWMutex
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{tunnels: make(map[string]*tunnel)}
+}
+
+func (r *tunnelRegistry) add(t *tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tunnels[t.info.ID] = t
+}
+
+func (r *tunnelRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tunnels, id)
+}
+
+func (r *tunnelRegistry) list() []models.TunnelInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]models.TunnelInfo, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		info := t.info
+		info.AgeSeconds = now.Sub(info.StartedAt).Seconds()
+		info.BytesSent = atomic.LoadInt64(&t.sent)
+		info.BytesRecv = atomic.LoadInt64(&t.received)
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result
+}
+
+func (r *tunnelRegistry) get(id string) (*tunnel, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tunnels[id]
+	return t, ok
+}
+
+// Tunnels returns all active CONNECT tunnels, oldest first.
+func (lb *LoadBalancer) Tunnels() []models.TunnelInfo {
+	return lb.tunnels.list()
+}
+
+// CloseTunnel terminates an active tunnel by closing both of its legs.
+func (lb *LoadBalancer) CloseTunnel(id string) error {
+	t, ok := lb.tunnels.get(id)
+	if !ok {
+		return fmt.Errorf("tunnel not found: %s", id)
+	}
+	t.close()
+	lb.logger.Warnf("Terminated tunnel %s (%s -> %s via %s)", id, t.info.ClientIP, t.info.Destination, t.info.Exit)
+	return nil
+}
+
+// RunScheduleChecks closes the tunnels of users whose access schedule no
+// longer covers them every scheduleCheckInterval until ctx is done. A
+// schedule is checked when a tunnel is set up; this ends those opened
+// before their window closed.
+func (lb *LoadBalancer) RunScheduleChecks(ctx context.Context) {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			lb.closeTunnelsOutsideSchedule(now)
+		}
+	}
+}
+
+// closeTunnelsOutsideSchedule closes the tunnels of users whose access
+// schedule does not cover now and returns how many it closed.
+func (lb *LoadBalancer) closeTunnelsOutsideSchedule(now time.Time) int {
+	lb.mu.RLock()
+	authenticator := lb.authenticator
+	trail := lb.auditTrail
+	lb.mu.RUnlock()
+	if authenticator == nil || !authenticator.Enabled() {
+		return 0
+	}
+
+	lb.tunnels.mu.RLock()
+	expired := make([]*tunnel, 0)
+	for _, t := range lb.tunnels.tunnels {
+		if t.info.User != "" && !authenticator.InSchedule(t.info.User, now) {
+			expired = append(expired, t)
+		}
+	}
+	lb.tunnels.mu.RUnlock()
+
+	for _, t := range expired {
+		t.close()
+		lb.logger.Infof("Closed tunnel %s of %s to %s: outside its access schedule", t.info.ID, t.info.User, t.info.Destination)
+		if trail != nil {
+			trail.Record(audit.Entry{
+				Event:       "outside_schedule",
+				User:        t.info.User,
+				ClientIP:    t.info.ClientIP,
+				Destination: t.info.Destination,
+				Detail:      "tunnel " + t.info.ID + " closed",
+			})
+		}
+	}
+	return len(expired)
+}
+
+type countingWriter struct {
+	w       net.Conn
+	counter *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.counter, int64(n))
+	return n, err
+}
+
+// countingConn counts bytes on an upstream leg whose reads and writes are
+// driven by someone else, such as the TLS interceptor.
+type countingConn struct {
+	net.Conn
+	sent     *int64
+	received *int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.sent, int64(n))
+	return n, err
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.received, int64(n))
+	return n, err
+}
+
+func newTunnelID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
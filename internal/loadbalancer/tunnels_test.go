@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"proxy-v6/internal/auth"
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCloseTunnelsOutsideSchedule(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	authenticator, err := auth.NewAuthenticator(logger, []models.User{
+		{Username: "office", Password: "secret", Schedule: []models.AccessWindow{{Start: "09:00", End: "17:00"}}},
+		{Username: "always", Password: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	lb := NewLoadBalancer(logger, time.Minute)
+	lb.SetAuthenticator(authenticator)
+
+	open := func(id, user string) net.Conn {
+		clientConn, client := net.Pipe()
+		proxyConn, _ := net.Pipe()
+		lb.tunnels.add(&tunnel{
+			info:       models.TunnelInfo{ID: id, User: user, Destination: "example.com:443"},
+			clientConn: clientConn,
+			proxyConn:  proxyConn,
+		})
+		return client
+	}
+	office := open("t1", "office")
+	always := open("t2", "always")
+
+	if closed := lb.closeTunnelsOutsideSchedule(time.Date(2026, 10, 12, 16, 59, 0, 0, time.UTC)); closed != 0 {
+		t.Fatalf("closed %d tunnels inside the window, want none", closed)
+	}
+	if closed := lb.closeTunnelsOutsideSchedule(time.Date(2026, 10, 12, 17, 0, 0, 0, time.UTC)); closed != 1 {
+		t.Fatalf("closed %d tunnels once the window ended, want 1", closed)
+	}
+	if _, err := office.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("tunnel of the user outside its schedule is still open (read: %v)", err)
+	}
+
+	always.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := always.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatal("tunnel of a user without a schedule was closed")
+	}
+}
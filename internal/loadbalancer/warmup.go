@@ -0,0 +1,260 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Warm-up curves of models.PrefixWarmup.
+const (
+	WarmupCurveLinear      = "linear"
+	WarmupCurveExponential = "exponential"
+	WarmupCurveSteps       = "steps"
+)
+
+const (
+	defaultWarmupPrefixLength = 64
+	defaultWarmupStartPercent = 10
+)
+
+// prefixWarmup remembers when each prefix was first seen in the pool and
+// admits the exits of young prefixes to selection only part of the time.
+// Prefixes recorded with a zero time count as established.
+type prefixWarmup struct {
+	policy    models.PrefixWarmup
+	firstSeen map[string]time.Time // prefix -> first seen
+	changed   bool                 // firstSeen changed since it was last taken
+	mu        sync.Mutex
+}
+
+func newPrefixWarmup() *prefixWarmup {
+	return &prefixWarmup{
+		policy:    models.PrefixWarmup{PrefixLength: defaultWarmupPrefixLength},
+		firstSeen: make(map[string]time.Time),
+	}
+}
+
+func validatePrefixWarmup(policy *models.PrefixWarmup) error {
+	if policy.PrefixLength == 0 {
+		policy.PrefixLength = defaultWarmupPrefixLength
+	}
+	if policy.PrefixLength < 1 || policy.PrefixLength > 128 {
+		return fmt.Errorf("prefix_length must be between 1 and 128")
+	}
+	if policy.Hours < 0 {
+		return fmt.Errorf("hours must not be negative")
+	}
+	if policy.Hours == 0 {
+		return nil
+	}
+	if policy.StartPercent == 0 {
+		policy.StartPercent = defaultWarmupStartPercent
+	}
+	if policy.StartPercent < 0 || policy.StartPercent > 100 {
+		return fmt.Errorf("start_percent must be between 0 and 100")
+	}
+	switch policy.Curve {
+	case "":
+		policy.Curve = WarmupCurveLinear
+	case WarmupCurveLinear:
+	case WarmupCurveExponential:
+		if policy.StartPercent < 1 {
+			return fmt.Errorf("an exponential curve needs a start_percent of at least 1")
+		}
+	case WarmupCurveSteps:
+		if len(policy.Steps) == 0 {
+			return fmt.Errorf("a steps curve needs steps")
+		}
+		for i, step := range policy.Steps {
+			if step.AfterHours < 0 || step.AfterHours >= policy.Hours {
+				return fmt.Errorf("steps[%d].after_hours must be between 0 and hours", i)
+			}
+			if step.Percent < 0 || step.Percent > 100 {
+				return fmt.Errorf("steps[%d].percent must be between 0 and 100", i)
+			}
+			if i > 0 && step.AfterHours <= policy.Steps[i-1].AfterHours {
+				return fmt.Errorf("steps must be in increasing after_hours order")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown curve %q (want %s, %s or %s)", policy.Curve, WarmupCurveLinear, WarmupCurveExponential, WarmupCurveSteps)
+	}
+	return nil
+}
+
+// SetPrefixWarmup configures how exits of new prefixes are ramped into
+// rotation. firstSeen are the prefixes known from earlier runs. With none,
+// the prefixes of the first pool update are taken as established, so
+// enabling warm-up does not throttle the whole existing pool.
+func (lb *LoadBalancer) SetPrefixWarmup(policy models.PrefixWarmup, firstSeen map[string]time.Time) error {
+	if err := validatePrefixWarmup(&policy); err != nil {
+		return err
+	}
+
+	w := lb.warmup
+	w.mu.Lock()
+	w.policy = policy
+	w.firstSeen = make(map[string]time.Time, len(firstSeen))
+	for prefix, seen := range firstSeen {
+		w.firstSeen[prefix] = seen
+	}
+	w.mu.Unlock()
+
+	if policy.Hours > 0 {
+		lb.logger.Infof("Prefix warm-up: exits of new /%d prefixes ramp from %g%% over %gh (%s)", policy.PrefixLength, policy.StartPercent, policy.Hours, policy.Curve)
+	}
+	return nil
+}
+
+// PrefixFirstSeen returns when each prefix was first seen, for persisting,
+// and whether that changed since the last call.
+func (lb *LoadBalancer) PrefixFirstSeen() (map[string]time.Time, bool) {
+	w := lb.warmup
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changed := w.changed
+	w.changed = false
+	seen := make(map[string]time.Time, len(w.firstSeen))
+	for prefix, at := range w.firstSeen {
+		seen[prefix] = at
+	}
+	return seen, changed
+}
+
+// WarmingPrefixes lists the prefixes in the pool whose exits are still
+// being ramped in.
+func (lb *LoadBalancer) WarmingPrefixes() []models.WarmingPrefix {
+	lb.mu.RLock()
+	ips := make([]string, 0, len(lb.proxies))
+	for _, p := range lb.proxies {
+		ips = append(ips, p.IP)
+	}
+	lb.mu.RUnlock()
+
+	w := lb.warmup
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	exits := make(map[string]int)
+	for _, ip := range ips {
+		exits[w.prefixLocked(ip)]++
+	}
+
+	now := time.Now()
+	warming := make([]models.WarmingPrefix, 0)
+	for prefix, count := range exits {
+		share, ok := w.shareLocked(prefix, now)
+		if !ok {
+			continue
+		}
+		first := w.firstSeen[prefix]
+		warming = append(warming, models.WarmingPrefix{
+			Prefix:    prefix,
+			FirstSeen: first,
+			Percent:   math.Round(share*1000) / 10,
+			Exits:     count,
+			WarmUntil: first.Add(time.Duration(w.policy.Hours * float64(time.Hour))),
+		})
+	}
+	sort.Slice(warming, func(i, j int) bool { return warming[i].FirstSeen.Before(warming[j].FirstSeen) })
+	return warming
+}
+
+// FinishWarmup puts the exits of prefix into full rotation now.
+func (lb *LoadBalancer) FinishWarmup(prefix string) error {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix: %s", prefix)
+	}
+
+	w := lb.warmup
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	first, ok := w.firstSeen[network.String()]
+	if !ok || first.IsZero() {
+		return fmt.Errorf("prefix not warming up: %s", network)
+	}
+	w.firstSeen[network.String()] = time.Time{}
+	w.changed = true
+	lb.logger.Infof("Finished warm-up of prefix %s early", network)
+	return nil
+}
+
+// observe records the prefixes of exits first seen now. On the first call
+// without a record every prefix counts as established.
+func (w *prefixWarmup) observe(proxies []ProxyEndpoint, now time.Time) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seed := len(w.firstSeen) == 0
+	added := make([]string, 0)
+	for _, p := range proxies {
+		prefix := w.prefixLocked(p.IP)
+		if prefix == "" {
+			continue
+		}
+		if _, ok := w.firstSeen[prefix]; ok {
+			continue
+		}
+		if seed {
+			w.firstSeen[prefix] = time.Time{}
+		} else {
+			w.firstSeen[prefix] = now
+			added = append(added, prefix)
+		}
+		w.changed = true
+	}
+	return added
+}
+
+// admit reports whether an exit on ip takes part in one selection. Exits
+// of warming prefixes are admitted with their share as the probability.
+func (w *prefixWarmup) admit(ip string, now time.Time) bool {
+	w.mu.Lock()
+	share, warming := w.shareLocked(w.prefixLocked(ip), now)
+	w.mu.Unlock()
+	return !warming || rand.Float64() < share
+}
+
+// shareLocked returns the fraction of an established exit's traffic the
+// exits of prefix get now, and false once the prefix is warm.
+func (w *prefixWarmup) shareLocked(prefix string, now time.Time) (float64, bool) {
+	policy := w.policy
+	first, ok := w.firstSeen[prefix]
+	if policy.Hours <= 0 || !ok || first.IsZero() {
+		return 1, false
+	}
+	hours := now.Sub(first).Hours()
+	if hours >= policy.Hours {
+		return 1, false
+	}
+	start := policy.StartPercent / 100
+	progress := math.Max(0, hours/policy.Hours)
+
+	switch policy.Curve {
+	case WarmupCurveExponential:
+		return start * math.Pow(1/start, progress), true
+	case WarmupCurveSteps:
+		share := start
+		for _, step := range policy.Steps {
+			if hours >= step.AfterHours {
+				share = step.Percent / 100
+			}
+		}
+		return share, true
+	}
+	return start + (1-start)*progress, true
+}
+
+// prefixLocked returns the prefix of ip under the configured length, or ""
+// for an unparsable address.
+func (w *prefixWarmup) prefixLocked(ip string) string {
+	return prefixOf(ip, w.policy.PrefixLength)
+}
@@ -0,0 +1,74 @@
+package loadbalancer
+
+import "math"
+
+// exitWeights gives each candidate its share of new traffic. A node that
+// reports a weight has it split evenly over its candidates, so the node
+// gets the same share however many of its exits are eligible; exits of
+// nodes without a weight count one each. It returns nil when every
+// candidate has the same share, which plain turns already give.
+func exitWeights(candidates []ProxyEndpoint) []float64 {
+	perNode := make(map[string]int)
+	for _, p := range candidates {
+		if p.Weight > 0 {
+			perNode[p.NodeID]++
+		}
+	}
+	if len(perNode) == 0 {
+		return nil
+	}
+
+	weights := make([]float64, len(candidates))
+	equal := true
+	for i, p := range candidates {
+		weights[i] = 1
+		if p.Weight > 0 {
+			weights[i] = p.Weight / float64(perNode[p.NodeID])
+		}
+		equal = equal && weights[i] == weights[0]
+	}
+	if equal {
+		return nil
+	}
+	return weights
+}
+
+// weightedIndex returns the index whose part of the summed weights holds
+// position, a fraction in [0, 1).
+func weightedIndex(weights []float64, position float64) int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	target := position * total
+	for i, w := range weights {
+		if target < w {
+			return i
+		}
+		target -= w
+	}
+	return len(weights) - 1
+}
+
+// spread places turn n at the fractional part of n times the golden ratio.
+// Consecutive turns land far apart and every stretch of turns covers
+// [0, 1) evenly, so exits get their share even over a few requests.
+func spread(turn uint64) float64 {
+	return float64((turn*0x9e3779b97f4a7c15)>>11) / (1 << 53)
+}
+
+// ringShares is how many points each exit gets on the hash ring when
+// weights differs, ringReplicas for an exit of average weight and at
+// least one.
+func ringShares(weights []float64) []int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	mean := total / float64(len(weights))
+	shares := make([]int, len(weights))
+	for i, w := range weights {
+		shares[i] = max(1, int(math.Round(ringReplicas*w/mean)))
+	}
+	return shares
+}
@@ -0,0 +1,241 @@
+package loadshed
+
+import (
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Level is how much work is being shed. Each level also sheds the work of
+// the levels below it.
+type Level int
+
+const (
+	LevelNone      Level = iota
+	LevelHistory         // defer pool history and ledger writes
+	LevelAnalytics       // also stop recording per-request usage
+	LevelProxy           // also refuse new proxy requests
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelHistory:
+		return "history"
+	case LevelAnalytics:
+		return "analytics"
+	case LevelProxy:
+		return "proxy"
+	}
+	return "none"
+}
+
+// Work is a kind of task that can be shed, named after the lowest level
+// that sheds it.
+type Work = Level
+
+const (
+	WorkHistory   = LevelHistory
+	WorkAnalytics = LevelAnalytics
+	WorkProxy     = LevelProxy
+)
+
+const (
+	lagInterval = 100 * time.Millisecond
+	// lagWindow is how many lag samples the pressure is taken over.
+	lagWindow = 10
+	// cooldown is how long pressure must stay lower before the level steps
+	// down, so shedding does not flap around a threshold.
+	cooldown = 5 * time.Second
+)
+
+var (
+	shedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_shed_total",
+		Help: "Work skipped or refused under load, by kind (history, analytics, proxy).",
+	}, []string{"work"})
+	shedLevel = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_v6_shed_level",
+		Help: "Current load shedding level: 0 none, 1 history, 2 analytics, 3 proxy.",
+	})
+	schedulerLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_v6_scheduler_lag_seconds",
+		Help: "Largest recent delay in waking a timer goroutine, a sign of CPU saturation.",
+	})
+)
+
+// Stats is the shedder's state as reported by the API.
+type Stats struct {
+	Level      string           `json:"level"`
+	LagMs      float64          `json:"lag_ms"`
+	HeapBytes  uint64           `json:"heap_bytes"`
+	Pressure   float64          `json:"pressure"` // 1 = proxy requests are refused
+	Shed       map[string]int64 `json:"shed"`
+	LevelSince time.Time        `json:"level_since"`
+}
+
+// Shedder watches scheduler lag and heap size and decides which work to
+// skip. Pressure is the larger of lag/maxLag and heap/maxHeap: history
+// writes are deferred from 0.5, usage recording stops from 0.75 and proxy
+// requests are refused from 1. A nil Shedder never sheds.
+type Shedder struct {
+	logger  *logrus.Logger
+	maxLag  time.Duration
+	maxHeap uint64
+
+	mu       sync.Mutex
+	level    Level
+	since    time.Time
+	lower    time.Time // when pressure first fell below the current level
+	lags     []time.Duration
+	lag      time.Duration
+	heap     uint64
+	pressure float64
+	shed     map[string]int64
+}
+
+// New returns a shedder for the given limits, or nil when both are zero.
+func New(logger *logrus.Logger, maxLag time.Duration, maxHeapBytes uint64) *Shedder {
+	if maxLag <= 0 && maxHeapBytes == 0 {
+		return nil
+	}
+	return &Shedder{
+		logger:  logger,
+		maxLag:  maxLag,
+		maxHeap: maxHeapBytes,
+		since:   time.Now(),
+		shed:    make(map[string]int64),
+	}
+}
+
+// Run samples load until stop is closed.
+func (s *Shedder) Run(stop <-chan struct{}) {
+	if s == nil {
+		return
+	}
+	s.logger.Infof("Load shedding enabled (max lag %s, max heap %d bytes)", s.maxLag, s.maxHeap)
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			lag := now.Sub(last) - lagInterval
+			if lag < 0 {
+				lag = 0
+			}
+			last = now
+			metrics.Read(sample)
+			var heap uint64
+			if sample[0].Value.Kind() == metrics.KindUint64 {
+				heap = sample[0].Value.Uint64()
+			}
+			s.update(now, lag, heap)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Shedder) update(now time.Time, lag time.Duration, heap uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lags = append(s.lags, lag)
+	if len(s.lags) > lagWindow {
+		s.lags = s.lags[1:]
+	}
+	s.lag = 0
+	for _, l := range s.lags {
+		if l > s.lag {
+			s.lag = l
+		}
+	}
+	s.heap = heap
+
+	s.pressure = 0
+	if s.maxLag > 0 {
+		s.pressure = float64(s.lag) / float64(s.maxLag)
+	}
+	if s.maxHeap > 0 {
+		if p := float64(heap) / float64(s.maxHeap); p > s.pressure {
+			s.pressure = p
+		}
+	}
+	schedulerLag.Set(s.lag.Seconds())
+
+	target := LevelNone
+	switch {
+	case s.pressure >= 1:
+		target = LevelProxy
+	case s.pressure >= 0.75:
+		target = LevelAnalytics
+	case s.pressure >= 0.5:
+		target = LevelHistory
+	}
+
+	switch {
+	case target > s.level:
+		s.setLevelLocked(now, target)
+	case target < s.level:
+		if s.lower.IsZero() {
+			s.lower = now
+		} else if now.Sub(s.lower) >= cooldown {
+			s.setLevelLocked(now, s.level-1)
+		}
+	default:
+		s.lower = time.Time{}
+	}
+}
+
+func (s *Shedder) setLevelLocked(now time.Time, level Level) {
+	if level > s.level {
+		s.logger.Warnf("Load shedding raised to %s (pressure %.2f, lag %s, heap %d bytes)", level, s.pressure, s.lag, s.heap)
+	} else {
+		s.logger.Infof("Load shedding lowered to %s (pressure %.2f)", level, s.pressure)
+	}
+	s.level = level
+	s.since = now
+	s.lower = time.Time{}
+	shedLevel.Set(float64(level))
+}
+
+// Shed reports whether work should be skipped now, counting it if so.
+func (s *Shedder) Shed(work Work) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.level < work {
+		return false
+	}
+	s.shed[work.String()]++
+	shedTotal.WithLabelValues(work.String()).Inc()
+	return true
+}
+
+func (s *Shedder) Stats() Stats {
+	if s == nil {
+		return Stats{Level: LevelNone.String()}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shed := make(map[string]int64, len(s.shed))
+	for work, n := range s.shed {
+		shed[work] = n
+	}
+	return Stats{
+		Level:      s.level.String(),
+		LagMs:      float64(s.lag) / float64(time.Millisecond),
+		HeapBytes:  s.heap,
+		Pressure:   s.pressure,
+		Shed:       shed,
+		LevelSince: s.since,
+	}
+}
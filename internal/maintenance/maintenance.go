@@ -0,0 +1,275 @@
+// Package maintenance schedules windows during which nodes are drained,
+// skipped by rolling restarts and flagged so alerts can be silenced.
+package maintenance
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// checkInterval is how often window starts and ends are acted on.
+const checkInterval = 5 * time.Second
+
+// ErrNotFound is returned when removing an unknown window.
+var ErrNotFound = errors.New("maintenance window not found")
+
+var nodeMaintenance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "proxy_v6_node_maintenance",
+	Help: "1 while the node is in a maintenance window, for silencing alerts",
+}, []string{"node"})
+
+// Drainer takes nodes out of rotation and returns them.
+type Drainer interface {
+	DrainNode(nodeID string)
+	UndrainNode(nodeID string)
+	DrainedNodes() []string
+}
+
+// Scheduler applies maintenance windows: a matching node is drained when
+// a window starts and returned to rotation when the last one ends. Nodes
+// that were already drained by hand are left drained.
+type Scheduler struct {
+	logger  *logrus.Logger
+	drainer Drainer
+	nodes   func() []models.NodeInfo
+	path    string
+	windows []models.MaintenanceWindow
+	owned   map[string]bool // nodes drained by a window
+	mu      sync.Mutex
+}
+
+// NewScheduler creates a scheduler. Windows are saved to path, if set, so
+// scheduled maintenance survives coordinator restarts.
+func NewScheduler(logger *logrus.Logger, drainer Drainer, nodes func() []models.NodeInfo, path string) (*Scheduler, error) {
+	s := &Scheduler{
+		logger:  logger,
+		drainer: drainer,
+		nodes:   nodes,
+		path:    path,
+		owned:   make(map[string]bool),
+	}
+	if path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Scheduler) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read maintenance windows: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.windows); err != nil {
+		return fmt.Errorf("failed to parse maintenance windows: %w", err)
+	}
+	return nil
+}
+
+// save writes the windows to disk. Called with s.mu held.
+func (s *Scheduler) save() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.windows, "", "  ")
+	if err != nil {
+		s.logger.Errorf("Failed to encode maintenance windows: %v", err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		s.logger.Errorf("Failed to save maintenance windows: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		s.logger.Errorf("Failed to save maintenance windows: %v", err)
+	}
+}
+
+// Add schedules a window and applies it right away if it has started.
+func (s *Scheduler) Add(window models.MaintenanceWindow) (models.MaintenanceWindow, error) {
+	if len(window.Nodes) == 0 {
+		return models.MaintenanceWindow{}, errors.New("nodes is required")
+	}
+	for _, pattern := range window.Nodes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return models.MaintenanceWindow{}, fmt.Errorf("invalid node pattern %q", pattern)
+		}
+	}
+	if !window.End.After(window.Start) {
+		return models.MaintenanceWindow{}, errors.New("end must be after start")
+	}
+	if !window.End.After(time.Now()) {
+		return models.MaintenanceWindow{}, errors.New("end is in the past")
+	}
+
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return models.MaintenanceWindow{}, err
+	}
+	window.ID = hex.EncodeToString(id)
+	window.CreatedAt = time.Now()
+
+	nodes := s.nodes()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.windows = append(s.windows, window)
+	s.save()
+	s.logger.Infof("Scheduled maintenance window %s for %v from %s to %s",
+		window.ID, window.Nodes, window.Start.Format(time.RFC3339), window.End.Format(time.RFC3339))
+	s.apply(time.Now(), nodes)
+	window.Active = active(window, time.Now())
+	return window, nil
+}
+
+// Remove cancels a window, ending it early if it is active.
+func (s *Scheduler) Remove(id string) error {
+	nodes := s.nodes()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, window := range s.windows {
+		if window.ID == id {
+			s.windows = append(s.windows[:i], s.windows[i+1:]...)
+			s.save()
+			s.logger.Infof("Removed maintenance window %s", id)
+			s.apply(time.Now(), nodes)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// List returns the active and upcoming windows, earliest first.
+func (s *Scheduler) List() []models.MaintenanceWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	windows := make([]models.MaintenanceWindow, 0, len(s.windows))
+	for _, window := range s.windows {
+		window.Active = active(window, now)
+		windows = append(windows, window)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	return windows
+}
+
+// InMaintenance reports whether an active window covers nodeID.
+func (s *Scheduler) InMaintenance(nodeID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.covered(nodeID, time.Now())
+}
+
+// Run acts on window starts and ends until stop is closed.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		nodes := s.nodes()
+		s.mu.Lock()
+		s.apply(time.Now(), nodes)
+		s.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func active(window models.MaintenanceWindow, now time.Time) bool {
+	return !now.Before(window.Start) && now.Before(window.End)
+}
+
+// Matches reports whether window applies to nodeID, active or not.
+func Matches(window models.MaintenanceWindow, nodeID string) bool {
+	for _, pattern := range window.Nodes {
+		if ok, _ := path.Match(pattern, nodeID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// covered reports whether an active window matches nodeID. Called with
+// s.mu held.
+func (s *Scheduler) covered(nodeID string, now time.Time) bool {
+	for _, window := range s.windows {
+		if active(window, now) && Matches(window, nodeID) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply drains nodes entering maintenance, returns nodes leaving it and
+// drops windows that have ended. Called with s.mu held; nodes is fetched
+// beforehand so the coordinator's node lock is never taken under s.mu.
+func (s *Scheduler) apply(now time.Time, nodes []models.NodeInfo) {
+	drained := make(map[string]bool)
+	for _, nodeID := range s.drainer.DrainedNodes() {
+		drained[nodeID] = true
+	}
+
+	candidates := make(map[string]bool)
+	for _, node := range nodes {
+		candidates[node.NodeID] = true
+	}
+	for nodeID := range s.owned {
+		candidates[nodeID] = true
+	}
+
+	for nodeID := range candidates {
+		if s.covered(nodeID, now) {
+			nodeMaintenance.WithLabelValues(nodeID).Set(1)
+			// Also re-drains a node something else returned to rotation
+			// during the window
+			if !drained[nodeID] {
+				s.drainer.DrainNode(nodeID)
+				s.owned[nodeID] = true
+				s.logger.Infof("Node %s entered maintenance", nodeID)
+			}
+			continue
+		}
+		nodeMaintenance.DeleteLabelValues(nodeID)
+		if s.owned[nodeID] {
+			s.drainer.UndrainNode(nodeID)
+			delete(s.owned, nodeID)
+			s.logger.Infof("Node %s left maintenance", nodeID)
+		}
+	}
+
+	kept := s.windows[:0]
+	for _, window := range s.windows {
+		if now.Before(window.End) {
+			kept = append(kept, window)
+		}
+	}
+	if len(kept) != len(s.windows) {
+		s.windows = kept
+		s.save()
+	}
+}
@@ -0,0 +1,69 @@
+// Package metrics serves the Prometheus registry in OpenMetrics format and
+// attaches trace exemplars to latency observations, so a slow bucket in
+// Grafana links to the trace of a request that landed in it.
+package metrics
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// TraceParentHeader is the W3C Trace Context header clients and
+// instrumented upstreams use to propagate a trace.
+const TraceParentHeader = "traceparent"
+
+type traceIDKey struct{}
+
+// Handler serves the default registry. Scrapers that accept OpenMetrics,
+// such as Prometheus with exemplar storage enabled, get exemplars; others
+// get the classic text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+}
+
+// TraceID returns the trace ID of the request's traceparent header, or ""
+// when it has none or it is malformed.
+func TraceID(r *http.Request) string {
+	// version-traceid-parentid-flags, e.g.
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(strings.TrimSpace(r.Header.Get(TraceParentHeader)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 {
+		return ""
+	}
+	id, err := hex.DecodeString(parts[1])
+	if err != nil || strings.ToLower(parts[1]) != parts[1] {
+		return ""
+	}
+	for _, b := range id {
+		if b != 0 {
+			return parts[1]
+		}
+	}
+	// All zeroes is an invalid trace ID
+	return ""
+}
+
+// WithTraceID returns a copy of ctx carrying traceID for Observe.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	if traceID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// Observe records v on o, with a trace_id exemplar when ctx carries one.
+func Observe(ctx context.Context, o prometheus.Observer, v float64) {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && traceID != "" {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	o.Observe(v)
+}
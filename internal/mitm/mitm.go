@@ -0,0 +1,242 @@
+// Package mitm terminates client TLS inside CONNECT tunnels and re-originates
+// it towards the destination with a fixed, browser-like ClientHello so every
+// request leaving the pool presents the same TLS fingerprint.
+//
+// This is deliberate man-in-the-middle interception: clients only accept the
+// coordinator's certificates once they trust its CA.
+package mitm
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"github.com/sirupsen/logrus"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+var profiles = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"ios":     utls.HelloIOS_Auto,
+	"edge":    utls.HelloEdge_Auto,
+	"go":      utls.HelloGolang,
+}
+
+// ValidProfile reports whether name is a known ClientHello profile.
+func ValidProfile(name string) bool {
+	_, ok := profiles[name]
+	return ok
+}
+
+// Profiles returns the names of all ClientHello profiles, sorted.
+func Profiles() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Interceptor plays TLS server towards the client with certificates issued
+// by its CA, and TLS client towards the destination with a chosen profile.
+type Interceptor struct {
+	logger  *logrus.Logger
+	caCert  *x509.Certificate
+	caKey   crypto.Signer
+	leafKey crypto.Signer
+	leaves  map[string]*tls.Certificate
+	mu      sync.Mutex
+}
+
+// NewInterceptor loads the CA at certPath/keyPath, creating it when both
+// files are missing.
+func NewInterceptor(logger *logrus.Logger, certPath, keyPath string) (*Interceptor, error) {
+	caCert, caKey, created, err := loadOrCreateCA(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		logger.Warnf("Generated new TLS interception CA at %s; clients must trust it", certPath)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Interceptor{
+		logger:  logger,
+		caCert:  caCert,
+		caKey:   caKey,
+		leafKey: leafKey,
+		leaves:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// CACertPEM returns the CA certificate clients need to trust.
+func (i *Interceptor) CACertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.caCert.Raw})
+}
+
+func (i *Interceptor) certificate(host string) (*tls.Certificate, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if cert, ok := i.leaves[host]; ok && time.Now().Before(cert.Leaf.NotAfter.Add(-time.Hour)) {
+		return cert, nil
+	}
+	cert, err := i.issueLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+	i.leaves[host] = cert
+	return cert, nil
+}
+
+// Serve terminates TLS on client, opens TLS to destination over upstream
+// using profile, and relays HTTP/1.1 requests between the two until either
+// side closes. Both connections are left for the caller to close.
+func (i *Interceptor) Serve(client net.Conn, destination, profile string, upstream net.Conn) error {
+	helloID, ok := profiles[profile]
+	if !ok {
+		return fmt.Errorf("unknown TLS profile %q", profile)
+	}
+
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+
+	serverConn := tls.Server(client, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return i.certificate(name)
+		},
+	})
+	serverConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := serverConn.Handshake(); err != nil {
+		return fmt.Errorf("client handshake failed: %w", err)
+	}
+	serverConn.SetDeadline(time.Time{})
+
+	serverName := serverConn.ConnectionState().ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	uconn, err := dialProfile(upstream, serverName, helloID)
+	if err != nil {
+		return fmt.Errorf("upstream handshake with %s failed: %w", destination, err)
+	}
+
+	return relay(serverConn, uconn)
+}
+
+// dialProfile performs the upstream handshake with the ClientHello of
+// helloID. ALPN is pinned to http/1.1 because requests are relayed one at a
+// time; the rest of the hello is left exactly as the profile defines it.
+func dialProfile(upstream net.Conn, serverName string, helloID utls.ClientHelloID) (*utls.UConn, error) {
+	config := &utls.Config{ServerName: serverName, NextProtos: []string{"http/1.1"}}
+
+	var uconn *utls.UConn
+	if helloID == utls.HelloGolang {
+		uconn = utls.UClient(upstream, config, helloID)
+	} else {
+		spec, err := utls.UTLSIdToSpec(helloID)
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+		uconn = utls.UClient(upstream, config, utls.HelloCustom)
+		if err := uconn.ApplyPreset(&spec); err != nil {
+			return nil, err
+		}
+	}
+
+	uconn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := uconn.Handshake(); err != nil {
+		return nil, err
+	}
+	uconn.SetDeadline(time.Time{})
+	return uconn, nil
+}
+
+// relay forwards HTTP/1.1 exchanges from client to upstream. A protocol
+// upgrade (e.g. WebSocket) switches to copying raw bytes in both directions.
+func relay(client, upstream net.Conn) error {
+	clientReader := bufio.NewReader(client)
+	upstreamReader := bufio.NewReader(upstream)
+
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := req.Write(upstream); err != nil {
+			return err
+		}
+
+		resp, err := http.ReadResponse(upstreamReader, req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if err := resp.Write(client); err != nil {
+				return err
+			}
+			return pipe(client, clientReader, upstream, upstreamReader)
+		}
+
+		err = resp.Write(client)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+func pipe(client net.Conn, clientReader io.Reader, upstream net.Conn, upstreamReader io.Reader) error {
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, clientReader)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, upstreamReader)
+		errc <- err
+	}()
+	return <-errc
+}
@@ -0,0 +1,201 @@
+// Package mtls builds mutual TLS configurations for the agent-coordinator
+// API. Certificates, keys and CA bundles are re-read when their files
+// change, so they can be rotated without restarting either side.
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadCheckInterval bounds how often the files are stat'ed.
+const reloadCheckInterval = time.Second
+
+// Files names the PEM files for one side of a connection. CA verifies the
+// peer: client certificates on the coordinator, the coordinator's
+// certificate on clients.
+type Files struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// Enabled reports whether any file is set.
+func (f Files) Enabled() bool {
+	return f.Cert != "" || f.Key != "" || f.CA != ""
+}
+
+func (f Files) validate() error {
+	if f.Cert == "" || f.Key == "" || f.CA == "" {
+		return errors.New("certificate, key and CA files are all required for mutual TLS")
+	}
+	return nil
+}
+
+// reloader holds the current certificate and CA pool, loading them again
+// when any of the files' modification times change. A failed reload keeps
+// serving the previous material.
+type reloader struct {
+	logger   *logrus.Logger
+	files    Files
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes [3]time.Time
+	checked  time.Time
+	mu       sync.Mutex
+}
+
+func newReloader(logger *logrus.Logger, files Files) (*reloader, error) {
+	if err := files.validate(); err != nil {
+		return nil, err
+	}
+	r := &reloader{logger: logger, files: files}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *reloader) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, path := range []string{r.files.Cert, r.files.Key, r.files.CA} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *reloader) load(modTimes [3]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.files.Cert, r.files.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	data, err := os.ReadFile(r.files.CA)
+	if err != nil {
+		return fmt.Errorf("failed to read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", r.files.CA)
+	}
+	r.cert, r.pool, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// current returns the certificate and CA pool, reloading them first if
+// the files changed since the last check.
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= reloadCheckInterval {
+		r.checked = time.Now()
+		modTimes, err := r.stat()
+		if err != nil {
+			r.logger.Warnf("Failed to check TLS files, keeping current certificates: %v", err)
+		} else if modTimes != r.modTimes {
+			if err := r.load(modTimes); err != nil {
+				r.logger.Warnf("Failed to reload TLS files, keeping current certificates: %v", err)
+			} else {
+				r.logger.Infof("Reloaded TLS certificate %s and CA %s", r.files.Cert, r.files.CA)
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+// ServerConfig returns a TLS configuration that presents files.Cert and
+// requires every client to present a certificate signed by files.CA.
+func ServerConfig(logger *logrus.Logger, files Files) (*tls.Config, error) {
+	r, err := newReloader(logger, files)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}, nil
+		},
+	}, nil
+}
+
+// clientConfig returns a TLS configuration that presents the reloader's
+// certificate and only accepts a server certificate signed by its CA for
+// host. The host is checked here rather than through ServerName because
+// the handshake does not record IP addresses as server names.
+func clientConfig(r *reloader, host string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		// RootCAs cannot change once the config is in use, so the chain is
+		// verified against the current pool in VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			_, pool := r.current()
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				DNSName:       host,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+// Transport returns an HTTP transport for calling the coordinator API that
+// presents files.Cert and verifies the coordinator against files.CA. It is
+// plain http.DefaultTransport when no files are set.
+func Transport(logger *logrus.Logger, files Files) (http.RoundTripper, error) {
+	if !files.Enabled() {
+		return http.DefaultTransport, nil
+	}
+	r, err := newReloader(logger, files)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &tls.Dialer{Config: clientConfig(r, host)}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return transport, nil
+}
@@ -0,0 +1,379 @@
+// Package plan compares a desired state of the pool, kept in a file, with
+// what the coordinator reports, and lists the actions that would bring the
+// pool there: exits to create, rotate or destroy on each node, and rule
+// changes. Planning changes nothing.
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// Action types. Exits are created, rotated or destroyed; rules are
+// created, updated or deleted.
+const (
+	Create  = "create"
+	Rotate  = "rotate"
+	Destroy = "destroy"
+	Update  = "update"
+	Delete  = "delete"
+)
+
+// Rule sets a desired state can manage, as named in its file.
+const (
+	BanRules     = "ban_rules"
+	RewriteRules = "rewrite_rules"
+	ReuseRules   = "reuse_rules"
+)
+
+// State is a desired-state file. Rule sets left out, as opposed to empty,
+// are not managed.
+type State struct {
+	Nodes        []NodeState           `json:"nodes"`
+	BanRules     *[]models.BanRule     `json:"ban_rules"`
+	RewriteRules *[]models.RewriteRule `json:"rewrite_rules"`
+	ReuseRules   *[]models.ReuseRule   `json:"reuse_rules"`
+}
+
+// NodeState is the desired state of the nodes Node matches, a node ID or
+// a pattern such as "edge-*". A node follows the first entry matching it.
+// Proxies is the number of running exits, standby ones included; left out,
+// the count is not managed. Exits outside Prefixes, or up longer than
+// RotateAfterSeconds, are rotated.
+type NodeState struct {
+	Node               string   `json:"node"`
+	Proxies            *int     `json:"proxies"`
+	Prefixes           []string `json:"prefixes"`
+	RotateAfterSeconds int      `json:"rotate_after_seconds"`
+}
+
+// Current is what the coordinator reports.
+type Current struct {
+	Nodes        []models.NodeInfo
+	BanRules     []models.BanRule
+	RewriteRules []models.RewriteRule
+	ReuseRules   []models.ReuseRule
+}
+
+// Action is one step of a plan. Exit actions name the node, and but for
+// creates the instance and its address; Prefix is where a created or
+// rotated exit should be. Rule actions name the rule set and the
+// destination the rule is for.
+type Action struct {
+	Type        string `json:"type"`
+	Node        string `json:"node,omitempty"`
+	Instance    string `json:"instance,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+	Rules       string `json:"rules,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Plan is the actions bringing the pool to a desired state, exit actions
+// by node, then rule changes.
+type Plan struct {
+	Actions  []Action `json:"actions"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Load reads a desired-state file, YAML or JSON by its extension, and
+// validates it.
+func Load(file string) (State, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return State{}, err
+	}
+	var state State
+	if err := v.Unmarshal(&state, func(dc *mapstructure.DecoderConfig) { dc.TagName = "json" }); err != nil {
+		return State{}, fmt.Errorf("%s: %w", file, err)
+	}
+	if err := Validate(state); err != nil {
+		return State{}, fmt.Errorf("%s: %w", file, err)
+	}
+	return state, nil
+}
+
+// Validate checks a desired state before it is planned.
+func Validate(state State) error {
+	for i, node := range state.Nodes {
+		if node.Node == "" {
+			return fmt.Errorf("nodes[%d]: node is required", i)
+		}
+		if _, err := path.Match(node.Node, ""); err != nil {
+			return fmt.Errorf("nodes[%d]: invalid pattern %q", i, node.Node)
+		}
+		if node.Proxies != nil && *node.Proxies < 0 {
+			return fmt.Errorf("node %s: proxies must not be negative", node.Node)
+		}
+		if node.RotateAfterSeconds < 0 {
+			return fmt.Errorf("node %s: rotate_after_seconds must not be negative", node.Node)
+		}
+		for _, prefix := range node.Prefixes {
+			_, ipnet, err := net.ParseCIDR(prefix)
+			if err != nil || ipnet.IP.To4() != nil {
+				return fmt.Errorf("node %s: %q is not an IPv6 prefix", node.Node, prefix)
+			}
+		}
+	}
+	if state.BanRules != nil {
+		if err := uniqueDestinations(BanRules, *state.BanRules, func(r models.BanRule) string { return r.Destination }); err != nil {
+			return err
+		}
+	}
+	if state.RewriteRules != nil {
+		if err := uniqueDestinations(RewriteRules, *state.RewriteRules, func(r models.RewriteRule) string { return r.Destination }); err != nil {
+			return err
+		}
+	}
+	if state.ReuseRules != nil {
+		if err := uniqueDestinations(ReuseRules, *state.ReuseRules, func(r models.ReuseRule) string { return r.Destination }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uniqueDestinations[T any](kind string, rules []T, destination func(T) string) error {
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		dest := destination(rule)
+		if seen[dest] {
+			return fmt.Errorf("%s: more than one rule for destination %q", kind, dest)
+		}
+		seen[dest] = true
+	}
+	return nil
+}
+
+// Compute plans the way from current to state, with exit ages as of now.
+func Compute(state State, current Current, now time.Time) Plan {
+	plan := Plan{Actions: []Action{}}
+
+	nodes := append([]models.NodeInfo(nil), current.Nodes...)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+	matched := make([]bool, len(state.Nodes))
+	for _, node := range nodes {
+		for i, desired := range state.Nodes {
+			if ok, _ := path.Match(desired.Node, node.NodeID); ok {
+				matched[i] = true
+				plan.Actions = append(plan.Actions, planNode(desired, node, now)...)
+				break
+			}
+		}
+	}
+	for i, desired := range state.Nodes {
+		if !matched[i] {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("no registered node matches %s", desired.Node))
+		}
+	}
+
+	if state.BanRules != nil {
+		plan.Actions = append(plan.Actions, planRules(BanRules, current.BanRules, *state.BanRules,
+			func(r models.BanRule) string { return r.Destination })...)
+	}
+	if state.RewriteRules != nil {
+		plan.Actions = append(plan.Actions, planRules(RewriteRules, current.RewriteRules, *state.RewriteRules,
+			func(r models.RewriteRule) string { return r.Destination })...)
+	}
+	if state.ReuseRules != nil {
+		plan.Actions = append(plan.Actions, planRules(ReuseRules, current.ReuseRules, *state.ReuseRules,
+			func(r models.ReuseRule) string { return r.Destination })...)
+	}
+	return plan
+}
+
+// exit is a running exit of a node with the reason it should be rotated,
+// if any.
+type exit struct {
+	proxy  models.ProxyInstance
+	rotate string
+}
+
+func planNode(desired NodeState, node models.NodeInfo, now time.Time) []Action {
+	var prefixes []*net.IPNet
+	for _, prefix := range desired.Prefixes {
+		// Checked by Validate
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		prefixes = append(prefixes, ipnet)
+	}
+	rotateAfter := time.Duration(desired.RotateAfterSeconds) * time.Second
+
+	var exits []exit
+	for _, proxy := range node.Proxies {
+		if proxy.Status != models.ProxyStatusRunning {
+			continue
+		}
+		e := exit{proxy: proxy}
+		switch {
+		case len(prefixes) > 0 && !inPrefixes(prefixes, proxy.IPv6.IP):
+			e.rotate = "outside " + strings.Join(desired.Prefixes, ", ")
+		case rotateAfter > 0 && !proxy.StartedAt.IsZero() && now.Sub(proxy.StartedAt) >= rotateAfter:
+			e.rotate = fmt.Sprintf("up %s, rotate after %s", now.Sub(proxy.StartedAt).Round(time.Second), rotateAfter)
+		}
+		exits = append(exits, e)
+	}
+	// Exits due for rotation go first, the youngest of the others next, so
+	// surplus exits are those needing work or carrying the least history
+	sort.SliceStable(exits, func(i, j int) bool {
+		a, b := exits[i], exits[j]
+		if (a.rotate != "") != (b.rotate != "") {
+			return a.rotate != ""
+		}
+		if !a.proxy.StartedAt.Equal(b.proxy.StartedAt) {
+			return a.proxy.StartedAt.After(b.proxy.StartedAt)
+		}
+		return a.proxy.ID < b.proxy.ID
+	})
+
+	var actions []Action
+	keep := exits
+	if desired.Proxies != nil && len(exits) > *desired.Proxies {
+		surplus := exits[:len(exits)-*desired.Proxies]
+		keep = exits[len(surplus):]
+		for _, e := range surplus {
+			actions = append(actions, Action{
+				Type:     Destroy,
+				Node:     node.NodeID,
+				Instance: e.proxy.ID,
+				Address:  address(e.proxy),
+				Reason:   fmt.Sprintf("%d running, %d wanted", len(exits), *desired.Proxies),
+			})
+		}
+	}
+
+	// Rotated and created exits spread over the prefixes, the emptiest first
+	counts := make([]int, len(prefixes))
+	for _, e := range keep {
+		if e.rotate == "" {
+			for i, ipnet := range prefixes {
+				if ipnet.Contains(e.proxy.IPv6.IP) {
+					counts[i]++
+				}
+			}
+		}
+	}
+	next := func() string {
+		if len(prefixes) == 0 {
+			return ""
+		}
+		best := 0
+		for i := range counts {
+			if counts[i] < counts[best] {
+				best = i
+			}
+		}
+		counts[best]++
+		return desired.Prefixes[best]
+	}
+
+	for _, e := range keep {
+		if e.rotate == "" {
+			continue
+		}
+		actions = append(actions, Action{
+			Type:     Rotate,
+			Node:     node.NodeID,
+			Instance: e.proxy.ID,
+			Address:  address(e.proxy),
+			Prefix:   next(),
+			Reason:   e.rotate,
+		})
+	}
+	if desired.Proxies != nil {
+		for i := len(exits); i < *desired.Proxies; i++ {
+			actions = append(actions, Action{
+				Type:   Create,
+				Node:   node.NodeID,
+				Prefix: next(),
+				Reason: fmt.Sprintf("%d running, %d wanted", len(exits), *desired.Proxies),
+			})
+		}
+	}
+	return actions
+}
+
+func inPrefixes(prefixes []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range prefixes {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func address(proxy models.ProxyInstance) string {
+	return fmt.Sprintf("[%s]:%d", proxy.IPv6.IP, proxy.Port)
+}
+
+// planRules compares rule sets by destination, which the rules of a set
+// are unique by.
+func planRules[T any](kind string, current, desired []T, destination func(T) string) []Action {
+	have := make(map[string]T, len(current))
+	for _, rule := range current {
+		have[destination(rule)] = rule
+	}
+	want := make(map[string]T, len(desired))
+	for _, rule := range desired {
+		want[destination(rule)] = rule
+	}
+
+	var actions []Action
+	for _, rule := range desired {
+		dest := destination(rule)
+		old, ok := have[dest]
+		switch {
+		case !ok:
+			actions = append(actions, Action{Type: Create, Rules: kind, Destination: dest})
+		case !sameJSON(old, rule):
+			actions = append(actions, Action{Type: Update, Rules: kind, Destination: dest})
+		}
+	}
+	for _, rule := range current {
+		if _, ok := want[destination(rule)]; !ok {
+			actions = append(actions, Action{Type: Delete, Rules: kind, Destination: destination(rule)})
+		}
+	}
+	// The first matching rule applies, so the order is part of the set
+	if len(actions) == 0 && len(desired) > 0 && !sameJSON(current, desired) {
+		actions = append(actions, Action{Type: Update, Rules: kind, Reason: "rules reordered"})
+	}
+	return actions
+}
+
+// sameJSON compares rules as the API serves them, so an empty list and a
+// missing one are equal.
+func sameJSON(a, b interface{}) bool {
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(x) == string(y)
+}
+
+// Summary counts the actions of p by type.
+func (p Plan) Summary() string {
+	counts := make(map[string]int)
+	rules := 0
+	for _, action := range p.Actions {
+		if action.Rules != "" {
+			rules++
+			continue
+		}
+		counts[action.Type]++
+	}
+	if len(p.Actions) == 0 {
+		return "No changes. The pool matches the desired state."
+	}
+	return fmt.Sprintf("Plan: %d to create, %d to rotate, %d to destroy, %d rule changes.",
+		counts[Create], counts[Rotate], counts[Destroy], rules)
+}
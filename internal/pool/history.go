@@ -0,0 +1,172 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// ErrHistoryExpired is returned by Diff when changes before since are no
+// longer retained. The caller should take a new snapshot.
+var ErrHistoryExpired = errors.New("pool history does not go back that far")
+
+type event struct {
+	at    time.Time
+	added bool
+	exit  models.PoolExit
+}
+
+// History tracks when exits join and leave the pool, so clients syncing
+// the proxy list can ask for what changed since their last snapshot
+// instead of downloading and diffing the full list.
+type History struct {
+	retention time.Duration
+	current   map[string]models.PoolExit
+	events    []event
+	start     time.Time // diffs can be answered for any since >= start
+	mu        sync.Mutex
+}
+
+// NewHistory creates an empty history that keeps changes for retention.
+func NewHistory(retention time.Duration) *History {
+	return &History{
+		retention: retention,
+		current:   make(map[string]models.PoolExit),
+		start:     time.Now(),
+	}
+}
+
+func key(exit models.PoolExit) string {
+	return string(exit.Protocol) + " " + exit.Address
+}
+
+// Exits lists the running exits of nodes.
+func Exits(nodes []models.NodeInfo) []models.PoolExit {
+	var exits []models.PoolExit
+	for _, node := range nodes {
+		for _, proxy := range node.Proxies {
+			if proxy.Status != models.ProxyStatusRunning {
+				continue
+			}
+			exits = append(exits, models.PoolExit{
+				Address:  fmt.Sprintf("[%s]:%d", proxy.IPv6.IP.String(), proxy.Port),
+				IP:       proxy.IPv6.IP.String(),
+				Port:     proxy.Port,
+				Protocol: proxy.Protocol,
+				NodeID:   node.NodeID,
+				Region:   node.Region,
+				Name:     proxy.Name,
+				Tags:     proxy.Tags,
+				Pools:    proxy.Pools,
+				Username: proxy.Username,
+				Password: proxy.Password,
+			})
+		}
+	}
+	return exits
+}
+
+// Record replaces the pool with the running exits of nodes, noting which
+// exits were added and removed.
+func (h *History) Record(nodes []models.NodeInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	next := make(map[string]models.PoolExit)
+	for _, exit := range Exits(nodes) {
+		k := key(exit)
+		next[k] = exit
+		if _, ok := h.current[k]; !ok {
+			h.events = append(h.events, event{at: now, added: true, exit: exit})
+		}
+	}
+	for k, exit := range h.current {
+		if _, ok := next[k]; !ok {
+			h.events = append(h.events, event{at: now, exit: exit})
+		}
+	}
+	h.current = next
+	h.prune(now)
+}
+
+func (h *History) prune(now time.Time) {
+	cutoff := now.Add(-h.retention)
+	drop := 0
+	for drop < len(h.events) && h.events[drop].at.Before(cutoff) {
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	h.start = h.events[drop-1].at
+	h.events = append([]event(nil), h.events[drop:]...)
+}
+
+// Snapshot returns the current pool. Its timestamp can be passed to Diff.
+func (h *History) Snapshot() models.PoolSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	exits := make([]models.PoolExit, 0, len(h.current))
+	for _, exit := range h.current {
+		exits = append(exits, exit)
+	}
+	sortExits(exits)
+	return models.PoolSnapshot{Timestamp: time.Now(), Exits: exits}
+}
+
+// Diff returns the exits added and removed after since. An exit that was
+// removed and came back (or the reverse) in between is not listed.
+func (h *History) Diff(since time.Time) (models.PoolDiff, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if since.Before(h.start) {
+		return models.PoolDiff{}, ErrHistoryExpired
+	}
+
+	// An exit was in the pool at since if its first later change removed
+	// it, and is in it now if its last change added it
+	first := make(map[string]event)
+	last := make(map[string]event)
+	for _, e := range h.events {
+		if !e.at.After(since) {
+			continue
+		}
+		k := key(e.exit)
+		if _, ok := first[k]; !ok {
+			first[k] = e
+		}
+		last[k] = e
+	}
+
+	diff := models.PoolDiff{
+		Since:     since,
+		Timestamp: time.Now(),
+		Added:     []models.PoolExit{},
+		Removed:   []models.PoolExit{},
+	}
+	for k, e := range last {
+		wasPresent := !first[k].added
+		switch {
+		case e.added && !wasPresent:
+			diff.Added = append(diff.Added, e.exit)
+		case !e.added && wasPresent:
+			diff.Removed = append(diff.Removed, e.exit)
+		}
+	}
+	sortExits(diff.Added)
+	sortExits(diff.Removed)
+	return diff, nil
+}
+
+func sortExits(exits []models.PoolExit) {
+	sort.Slice(exits, func(i, j int) bool {
+		return key(exits[i]) < key(exits[j])
+	})
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultArchiveFile is where the agent keeps archived instances unless
+// told otherwise.
+const DefaultArchiveFile = "/tmp/proxy-v6-agent-archive.json"
+
+const (
+	// DefaultArchiveAfter is how long an instance is down before it is
+	// archived.
+	DefaultArchiveAfter = time.Hour
+	// DefaultArchiveKeep is how many archived instances the archive holds.
+	DefaultArchiveKeep = 10000
+)
+
+var archivedInstances = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "proxy_v6_agent_instances_archived_total",
+	Help: "Stopped and failed instances moved out of the live instances into the archive.",
+})
+
+// archive is where instances down for longer than after are moved, so
+// the live instances and node reports do not grow with every instance an
+// agent ever ran.
+type archive struct {
+	path  string        // "" = archived instances are dropped
+	after time.Duration // 0 = never archive
+	keep  int           // newest archived instances kept; 0 = all
+}
+
+// SetArchive moves instances that have been stopped or failed for after
+// out of the live instances into the file at path, which keeps the newest
+// keep of them (0 = all). after 0 keeps every instance live, and an empty
+// path drops archived instances.
+func (m *Manager) SetArchive(path string, after time.Duration, keep int) error {
+	if after < 0 {
+		return fmt.Errorf("archive retention must not be negative")
+	}
+	if keep < 0 {
+		return fmt.Errorf("archived instances kept must not be negative")
+	}
+	m.mu.Lock()
+	m.archive = archive{path: path, after: after, keep: keep}
+	m.mu.Unlock()
+	return nil
+}
+
+// archiveInstances archives the instances whose process has been gone for
+// the retention and returns how many it moved. Their credentials and API
+// labels go with them; their passwords are not archived.
+func (m *Manager) archiveInstances(now time.Time) int {
+	m.mu.Lock()
+	a := m.archive
+	if a.after <= 0 {
+		m.mu.Unlock()
+		return 0
+	}
+	var moved []models.ArchivedInstance
+	for id, instance := range m.instances {
+		if _, running := m.running[id]; running {
+			continue
+		}
+		if instance.Status != models.ProxyStatusStopped && instance.Status != models.ProxyStatusError {
+			continue
+		}
+		if instance.StoppedAt == nil || now.Sub(*instance.StoppedAt) < a.after {
+			continue
+		}
+		archived := models.ArchivedInstance{ProxyInstance: *instance, ArchivedAt: now}
+		archived.Password = ""
+		moved = append(moved, archived)
+		delete(m.instances, id)
+		delete(m.credentials, id)
+		delete(m.labels, id)
+	}
+	m.mu.Unlock()
+	if len(moved) == 0 {
+		return 0
+	}
+
+	sort.Slice(moved, func(i, j int) bool { return moved[i].StoppedAt.Before(*moved[j].StoppedAt) })
+	archivedInstances.Add(float64(len(moved)))
+	if a.path != "" {
+		if err := appendArchive(a.path, moved, a.keep); err != nil {
+			m.logger.Warnf("Failed to write archive %s: %v", a.path, err)
+		}
+	}
+	m.logger.Infof("Archived %d instances down for over %s", len(moved), a.after)
+	return len(moved)
+}
+
+// Archived returns the archived instances, oldest first.
+func (m *Manager) Archived() ([]models.ArchivedInstance, error) {
+	m.mu.RLock()
+	path := m.archive.path
+	m.mu.RUnlock()
+	if path == "" {
+		return []models.ArchivedInstance{}, nil
+	}
+	return readArchive(path)
+}
+
+func readArchive(path string) ([]models.ArchivedInstance, error) {
+	archived := []models.ArchivedInstance{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return archived, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &archived); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return archived, nil
+}
+
+// appendArchive adds instances to the archive at path, dropping the oldest
+// beyond keep.
+func appendArchive(path string, instances []models.ArchivedInstance, keep int) error {
+	archived, err := readArchive(path)
+	if err != nil {
+		return err
+	}
+	archived = append(archived, instances...)
+	if keep > 0 && len(archived) > keep {
+		archived = archived[len(archived)-keep:]
+	}
+	data, err := json.Marshal(archived)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BackendTinyproxy = "tinyproxy"
+	Backend3proxy    = "3proxy"
+	BackendEmbedded  = "embedded"
+)
+
+// errProcessExited is returned by HealthCheck once a backend's process or
+// server has stopped, so startup does not keep retrying a dead instance.
+var errProcessExited = errors.New("proxy process exited")
+
+// InstanceConfig is what a backend needs to run one proxy instance.
+type InstanceConfig struct {
+	ID         string
+	BindIP     net.IP
+	Port       int
+	AllowedIPs []string
+	Mode       string // "open" or "restricted"
+	Username   string // basic auth credentials; empty disables auth
+	Password   string
+}
+
+func (c InstanceConfig) open() bool {
+	return c.Mode == "open"
+}
+
+func (c InstanceConfig) authenticated() bool {
+	return c.Username != ""
+}
+
+// ProxyBackend runs a single proxy instance, either as an external process
+// or inside the agent.
+type ProxyBackend interface {
+	// Start launches the instance. It returns once the process or listener
+	// is up; readiness is reported by HealthCheck.
+	Start(ctx context.Context) error
+	Stop() error
+	// Reload applies a changed access configuration without a restart.
+	Reload(cfg InstanceConfig) error
+	HealthCheck() error
+	// ConfigPath is the generated config file, or "" if there is none.
+	ConfigPath() string
+	// Wait delivers the exit error, or nil, when the instance stops.
+	Wait() <-chan error
+}
+
+type backendDescriptor struct {
+	newBackend   func(logger *logrus.Logger, cfg InstanceConfig) ProxyBackend
+	capabilities models.Capabilities
+	// check, when set, verifies the backend can run on this host before it
+	// is selected.
+	check func(logger *logrus.Logger) error
+}
+
+// backends are the HTTP backends selectable with --proxy-backend.
+var backends = map[string]backendDescriptor{
+	BackendTinyproxy: {
+		newBackend: newTinyproxyBackend,
+		capabilities: models.Capabilities{
+			Backend: BackendTinyproxy, HTTP: true, Connect: true, MaxClients: tinyproxyMaxClients,
+		},
+		check: checkTinyproxy,
+	},
+	Backend3proxy: {
+		newBackend: new3proxyBackend,
+		capabilities: models.Capabilities{
+			Backend: Backend3proxy, HTTP: true, Connect: true, MaxClients: threeproxyMaxClients,
+		},
+	},
+	BackendEmbedded: {
+		newBackend: newEmbeddedBackend,
+		capabilities: models.Capabilities{
+			Backend: BackendEmbedded, HTTP: true, Connect: true, MaxClients: embeddedMaxClients,
+		},
+	},
+}
+
+// BackendNames lists the selectable HTTP backends.
+func BackendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// inProcessBackend adapts a server run by the agent itself (the embedded
+// HTTP engine or SOCKS5) to ProxyBackend. Each one also serves a loopback
+// status endpoint, which is what HealthCheck and Status query.
+type inProcessBackend struct {
+	server inProcessServer
+	status *statusServer
+	access *accessList
+	cfg    InstanceConfig
+	exited chan struct{}
+	done   chan error
+}
+
+func newInProcessBackend(cfg InstanceConfig, protocol models.ProxyProtocol, access *accessList, server inProcessServer) *inProcessBackend {
+	b := &inProcessBackend{
+		server: server,
+		access: access,
+		cfg:    cfg,
+		exited: make(chan struct{}),
+		done:   make(chan error, 1),
+	}
+	b.status = newStatusServer(cfg.ID, protocol, server.stats(), b.serving)
+	return b
+}
+
+func newEmbeddedBackend(logger *logrus.Logger, cfg InstanceConfig) ProxyBackend {
+	access := newAccessList(cfg)
+	return newInProcessBackend(cfg, models.ProxyProtocolHTTP, access, newEngine(logger, cfg.ID, cfg.BindIP, cfg.Port, access))
+}
+
+func newSOCKS5Backend(logger *logrus.Logger, cfg InstanceConfig) ProxyBackend {
+	access := newAccessList(cfg)
+	return newInProcessBackend(cfg, models.ProxyProtocolSOCKS5, access, newSOCKSServer(logger, cfg.ID, cfg.BindIP, cfg.Port, access))
+}
+
+func (b *inProcessBackend) Start(ctx context.Context) error {
+	if err := b.server.start(); err != nil {
+		return err
+	}
+	if err := b.status.start(); err != nil {
+		// Releases the port the listener holds
+		b.server.stop()
+		return fmt.Errorf("failed to start status endpoint: %w", err)
+	}
+	go func() {
+		err := <-b.server.wait()
+		close(b.exited)
+		b.status.stop()
+		b.done <- err
+	}()
+	return nil
+}
+
+func (b *inProcessBackend) Stop() error {
+	b.server.stop()
+	return nil
+}
+
+// StopAccepting refuses new connections and keeps the open ones.
+func (b *inProcessBackend) StopAccepting() {
+	b.server.stopAccepting()
+}
+
+// ActiveConnections counts the requests and tunnels in progress.
+func (b *inProcessBackend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&b.server.stats().active)
+}
+
+func (b *inProcessBackend) serving() bool {
+	select {
+	case <-b.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// StatusURL is the loopback endpoint serving /health and /status.
+func (b *inProcessBackend) StatusURL() string {
+	return b.status.url()
+}
+
+// Status reads the instance's counters from its status endpoint.
+func (b *inProcessBackend) Status() (models.InstanceStatus, error) {
+	return fetchStatus(b.status.url())
+}
+
+func (b *inProcessBackend) Reload(cfg InstanceConfig) error {
+	b.access.update(cfg)
+	b.cfg = cfg
+	return nil
+}
+
+func (b *inProcessBackend) HealthCheck() error {
+	if !b.serving() {
+		return errProcessExited
+	}
+	resp, err := statusClient.Get(b.status.url() + "/health")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (b *inProcessBackend) ConfigPath() string {
+	return ""
+}
+
+func (b *inProcessBackend) Wait() <-chan error {
+	return b.done
+}
+
+// statusReporter is implemented by backends with a status endpoint.
+type statusReporter interface {
+	StatusURL() string
+	Status() (models.InstanceStatus, error)
+}
+
+// drainingBackend is implemented by backends that can refuse new
+// connections while the open ones finish, and count those.
+type drainingBackend interface {
+	StopAccepting()
+	ActiveConnections() int64
+}
+
+// usageReporter is implemented by backends that count their traffic from
+// the instance's log.
+type usageReporter interface {
+	Usage() (models.ProxyMetrics, bool)
+}
+
+// dialCheck is a plain TCP connect, which avoids generating errors in the
+// backends' own logs. It is the fallback for process backends, which have
+// no status endpoint of their own.
+func dialCheck(ip net.IP, port int) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("[%s]:%d", ip, port), 3*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
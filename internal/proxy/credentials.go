@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+type credentials struct {
+	username string
+	password string
+}
+
+// SetProxyAuth requires basic auth on every instance started afterwards.
+// An empty username or password is generated randomly per instance; an
+// instance keeps its credentials across restarts.
+func (m *Manager) SetProxyAuth(enabled bool, username, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.proxyAuth = enabled
+	m.authUsername = username
+	m.authPassword = password
+	if enabled {
+		m.logger.Info("Proxy authentication enabled for new instances")
+	}
+}
+
+// instanceCredentials returns the credentials for instanceID, generating
+// them the first time. Called with m.mu held.
+func (m *Manager) instanceCredentials(instanceID string) credentials {
+	if !m.proxyAuth {
+		return credentials{}
+	}
+	if c, ok := m.credentials[instanceID]; ok {
+		return c
+	}
+	c := credentials{username: m.authUsername, password: m.authPassword}
+	if c.username == "" {
+		c.username = "u" + randomToken(6)
+	}
+	if c.password == "" {
+		c.password = randomToken(16)
+	}
+	m.credentials[instanceID] = c
+	return c
+}
+
+// randomToken returns n random bytes as hex.
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
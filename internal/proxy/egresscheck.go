@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultEgressCheckTimeout = 10 * time.Second
+	// egressCheckConcurrency bounds the verification requests in flight, so
+	// an agent with many instances neither takes a whole interval per round
+	// nor floods the IP echo service.
+	egressCheckConcurrency = 16
+	// maxEgressResponse is as much of the echo response as is read.
+	maxEgressResponse = 4096
+)
+
+var errEgressMismatch = errors.New("egress IP does not match the bound address")
+
+var egressCheckFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxy_v6_egress_check_failures_total",
+	Help: "Egress verification checks that failed, by reason (mismatch, request)",
+}, []string{"reason"})
+
+// SetEgressCheck makes every health check also request checkURL through
+// each instance and compare the IP it echoes with the instance's bound
+// IPv6. checkURL must answer with the caller's IP, as plain text or as JSON
+// with an "ip" field. An empty URL turns the check off.
+func (m *Manager) SetEgressCheck(checkURL string, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if timeout <= 0 {
+		timeout = defaultEgressCheckTimeout
+	}
+	m.egressCheckURL = checkURL
+	m.egressCheckTimeout = timeout
+	if checkURL != "" {
+		m.logger.Infof("Egress verification enabled against %s", checkURL)
+	}
+}
+
+// verifyEgress checks every instance passed concurrently and returns the
+// failures by instance ID.
+func (m *Manager) verifyEgress(ctx context.Context, instances map[string]models.ProxyInstance) map[string]error {
+	m.mu.RLock()
+	checkURL, timeout := m.egressCheckURL, m.egressCheckTimeout
+	m.mu.RUnlock()
+
+	failures := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, egressCheckConcurrency)
+	for id, instance := range instances {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string, instance models.ProxyInstance) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := checkEgress(ctx, &instance, checkURL, timeout); err != nil {
+				reason := "request"
+				if errors.Is(err, errEgressMismatch) {
+					reason = "mismatch"
+				}
+				egressCheckFailures.WithLabelValues(reason).Inc()
+				mu.Lock()
+				failures[id] = err
+				mu.Unlock()
+			}
+		}(id, instance)
+	}
+	wg.Wait()
+	return failures
+}
+
+// checkEgress requests checkURL through instance and verifies the echoed
+// IP is the one the instance is bound to.
+func checkEgress(ctx context.Context, instance *models.ProxyInstance, checkURL string, timeout time.Duration) error {
+	client := instanceClient(instance, timeout)
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("egress check request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("egress check returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxEgressResponse))
+	if err != nil {
+		return fmt.Errorf("egress check response: %w", err)
+	}
+
+	observed := parseEchoedIP(body)
+	if observed == nil {
+		return fmt.Errorf("egress check response has no IP: %q", strings.TrimSpace(string(body)))
+	}
+	if !observed.Equal(instance.IPv6.IP) {
+		return fmt.Errorf("%w: egress %s, bound %s", errEgressMismatch, observed, instance.IPv6.IP)
+	}
+	return nil
+}
+
+// parseEchoedIP reads the IP from an echo service response: either the
+// bare address or a JSON object with an "ip" field.
+func parseEchoedIP(body []byte) net.IP {
+	text := strings.TrimSpace(string(body))
+	if strings.HasPrefix(text, "{") {
+		var echoed struct {
+			IP string `json:"ip"`
+		}
+		if err := json.Unmarshal([]byte(text), &echoed); err != nil {
+			return nil
+		}
+		text = echoed.IP
+	}
+	return net.ParseIP(text)
+}
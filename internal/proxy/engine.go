@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// embeddedMaxClients matches the MaxClients limit used for tinyproxy.
+const embeddedMaxClients = tinyproxyMaxClients
+
+// connectPortList are the destination ports CONNECT is allowed to on every
+// backend.
+var connectPortList = []string{"443", "563", "993", "995", "80", "8080", "8443"}
+
+var connectPorts = func() map[string]bool {
+	ports := make(map[string]bool, len(connectPortList))
+	for _, port := range connectPortList {
+		ports[port] = true
+	}
+	return ports
+}()
+
+// hopHeaders are stripped before forwarding, per RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// inProcessServer is a proxy instance served by the agent itself rather
+// than an external process.
+type inProcessServer interface {
+	start() error
+	// stopAccepting closes the listener and keeps serving the connections
+	// already open until stop.
+	stopAccepting()
+	stop()
+	wait() <-chan error
+	stats() *instanceCounters
+}
+
+// engine is an in-process HTTP/CONNECT proxy bound to one IPv6 address.
+// Outbound connections use the same address as their source, so the agent
+// can serve every egress IP without running a process per address.
+type engine struct {
+	logger     *logrus.Logger
+	id         string
+	bindIP     net.IP
+	port       int
+	access     *accessList
+	server     *http.Server
+	listener   net.Listener
+	transport  *http.Transport
+	dialer     *net.Dialer
+	slots      chan struct{}
+	counters   *instanceCounters
+	done       chan error
+	refusing   chan struct{} // closed by stopAccepting
+	stopped    chan struct{} // closed by stop
+	refuseOnce sync.Once
+	stopOnce   sync.Once
+}
+
+func newEngine(logger *logrus.Logger, id string, bindIP net.IP, port int, access *accessList) *engine {
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: bindIP},
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	e := &engine{
+		logger: logger,
+		id:     id,
+		bindIP: bindIP,
+		port:   port,
+		access: access,
+		dialer: dialer,
+		slots:    make(chan struct{}, embeddedMaxClients),
+		counters: newInstanceCounters(),
+		done:     make(chan error, 1),
+		refusing: make(chan struct{}),
+		stopped:  make(chan struct{}),
+		transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+		},
+	}
+	e.server = &http.Server{
+		Handler:     e,
+		IdleTimeout: 600 * time.Second,
+	}
+	return e
+}
+
+// start binds the listener and serves in the background. The returned
+// error only covers binding; later failures are delivered on e.done.
+func (e *engine) start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("[%s]:%d", e.bindIP, e.port))
+	if err != nil {
+		return err
+	}
+	e.listener = listener
+	go func() {
+		err := e.server.Serve(listener)
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		select {
+		case <-e.refusing:
+			// Requests and tunnels still open are served until stop
+			<-e.stopped
+			err = nil
+		default:
+		}
+		e.done <- err
+	}()
+	return nil
+}
+
+func (e *engine) stopAccepting() {
+	e.refuseOnce.Do(func() {
+		close(e.refusing)
+		// Also closes idle keep-alive connections
+		e.server.SetKeepAlivesEnabled(false)
+		e.listener.Close()
+	})
+}
+
+func (e *engine) stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopped)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := e.server.Shutdown(ctx); err != nil {
+			e.server.Close()
+		}
+		// Serve may not have taken the listener over yet, as when the
+		// status endpoint failed right after start; the port is free
+		// once stop returns either way
+		e.listener.Close()
+		e.transport.CloseIdleConnections()
+	})
+}
+
+func (e *engine) wait() <-chan error {
+	return e.done
+}
+
+func (e *engine) stats() *instanceCounters {
+	return e.counters
+}
+
+func (e *engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.access.permitted(r.RemoteAddr) {
+		atomic.AddInt64(&e.counters.denied, 1)
+		e.logger.Warnf("Embedded[%s] denied connection from %s", e.id, r.RemoteAddr)
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if e.access.requiresAuth() {
+		username, password, ok := parseBasicAuth(r.Header.Get("Proxy-Authorization"))
+		if !ok || !e.access.authorized(username, password) {
+			atomic.AddInt64(&e.counters.denied, 1)
+			w.Header().Set("Proxy-Authenticate", `Basic realm="proxy-v6"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+
+	select {
+	case e.slots <- struct{}{}:
+		defer func() { <-e.slots }()
+	default:
+		atomic.AddInt64(&e.counters.rejected, 1)
+		http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+		return
+	}
+
+	defer e.counters.begin(r.Method == http.MethodConnect)()
+
+	if r.Method == http.MethodConnect {
+		e.serveConnect(w, r)
+		return
+	}
+	e.serveHTTP(w, r)
+}
+
+func (e *engine) serveConnect(w http.ResponseWriter, r *http.Request) {
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil || !connectPorts[port] {
+		http.Error(w, "CONNECT to this port is not allowed", http.StatusForbidden)
+		return
+	}
+
+	upstream, err := e.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		atomic.AddInt64(&e.counters.errors, 1)
+		e.logger.Debugf("Embedded[%s] CONNECT %s failed: %v", e.id, r.Host, err)
+		http.Error(w, "Unable to connect to destination", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		e.logger.Errorf("Embedded[%s] hijack failed: %v", e.id, err)
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// Anything the client pipelined after the CONNECT line is already in
+	// the hijacked reader
+	if n := buffered.Reader.Buffered(); n > 0 {
+		pending, _ := buffered.Reader.Peek(n)
+		if _, err := upstream.Write(pending); err != nil {
+			return
+		}
+		atomic.AddInt64(&e.counters.bytesRecv, int64(n))
+	}
+
+	e.counters.relay(client, upstream)
+}
+
+func (e *engine) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy, send absolute URLs", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	out.Header.Add("Via", fmt.Sprintf("%d.%d proxy-v6", r.ProtoMajor, r.ProtoMinor))
+
+	resp, err := e.transport.RoundTrip(out)
+	if err != nil {
+		atomic.AddInt64(&e.counters.errors, 1)
+		e.logger.Debugf("Embedded[%s] request to %s failed: %v", e.id, r.URL.Host, err)
+		http.Error(w, "Unable to reach destination", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Add("Via", fmt.Sprintf("%d.%d proxy-v6", resp.ProtoMajor, resp.ProtoMinor))
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, resp.Body)
+	atomic.AddInt64(&e.counters.bytesSent, n)
+	if r.ContentLength > 0 {
+		atomic.AddInt64(&e.counters.bytesRecv, r.ContentLength)
+	}
+}
+
+// parseBasicAuth decodes a "Basic" Proxy-Authorization header value.
+func parseBasicAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+func removeHopHeaders(h http.Header) {
+	// Headers named in Connection are hop-by-hop too
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// accessList mirrors the tinyproxy Allow and BasicAuth directives: loopback
+// and the bind address are always allowed, plus the configured IPs unless
+// open. When credentials are set every client must present them.
+type accessList struct {
+	bindIP   net.IP
+	allowed  []*net.IPNet
+	open     bool
+	username string
+	password string
+	mu       sync.RWMutex
+}
+
+func newAccessList(cfg InstanceConfig) *accessList {
+	a := &accessList{bindIP: cfg.BindIP}
+	a.update(cfg)
+	return a
+}
+
+// update replaces the rules in place so running servers pick them up.
+func (a *accessList) update(cfg InstanceConfig) {
+	allowed := parseAllowList(cfg.AllowedIPs)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allowed = allowed
+	a.open = cfg.open()
+	a.username = cfg.Username
+	a.password = cfg.Password
+}
+
+// requiresAuth reports whether clients must present credentials.
+func (a *accessList) requiresAuth() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.username != ""
+}
+
+// authorized checks client credentials in constant time. It always
+// succeeds when no credentials are configured.
+func (a *accessList) authorized(username, password string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.username == "" {
+		return true
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.password))
+	return userOK&passOK == 1
+}
+
+func (a *accessList) permitted(remoteAddr string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.open {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.Equal(a.bindIP) {
+		return true
+	}
+	for _, cidr := range a.allowed {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAllowList converts allowed IP or CIDR entries into networks,
+// skipping entries that are neither.
+func parseAllowList(entries []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, cidr)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return nets
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventQueueSize is how many lifecycle events wait for the sinks before
+	// new ones are dropped.
+	eventQueueSize = 4096
+	// eventBatchSize caps the events handed to a sink at once.
+	eventBatchSize = 100
+)
+
+var (
+	lifecycleEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_agent_lifecycle_events_total",
+		Help: "Proxy lifecycle events emitted, by type.",
+	}, []string{"type"})
+	lifecycleEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_agent_lifecycle_events_dropped_total",
+		Help: "Lifecycle events dropped because the event sinks fell behind.",
+	})
+	eventSinkFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_agent_event_sink_failures_total",
+		Help: "Batches of lifecycle events a sink failed to take, by sink.",
+	}, []string{"sink"})
+)
+
+// EventSink receives proxy lifecycle events. Send is called from a single
+// goroutine with events in the order they happened. A failed batch is
+// counted and logged, not retried.
+type EventSink interface {
+	Name() string
+	Send(events []models.ProxyEvent) error
+}
+
+// eventBus queues lifecycle events for the sinks, so an instance
+// transition never waits for one.
+type eventBus struct {
+	node  string
+	sinks []EventSink
+	queue chan models.ProxyEvent
+	done  chan struct{}
+}
+
+// rotation is an instance being moved to another address, whose stop and
+// start are reported as a single rotated event.
+type rotation struct {
+	id   string
+	from net.IP
+}
+
+// SetEventSinks sends the lifecycle events of every instance, stamped with
+// node, to sinks. Call it once, before instances are started.
+func (m *Manager) SetEventSinks(node string, sinks []EventSink) {
+	bus := &eventBus{
+		node:  node,
+		sinks: sinks,
+		queue: make(chan models.ProxyEvent, eventQueueSize),
+		done:  make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.events = bus
+	m.mu.Unlock()
+	go bus.run(m.logger)
+}
+
+// CloseEvents waits up to timeout for the queued events to reach the
+// sinks. Later transitions are only counted.
+func (m *Manager) CloseEvents(timeout time.Duration) {
+	m.mu.Lock()
+	bus := m.events
+	m.events = nil
+	m.mu.Unlock()
+	if bus == nil {
+		return
+	}
+	close(bus.queue)
+	select {
+	case <-bus.done:
+	case <-time.After(timeout):
+		m.logger.Warnf("Gave up delivering lifecycle events after %s", timeout)
+	}
+}
+
+// emit queues a lifecycle event of instance. Called with m.mu held.
+func (m *Manager) emit(eventType string, instance *models.ProxyInstance, reason string) {
+	var previous string
+	if r := m.rotating; r != nil && r.id == instance.ID {
+		switch eventType {
+		case models.ProxyEventStopped:
+			return
+		case models.ProxyEventCreated:
+			eventType, previous = models.ProxyEventRotated, r.from.String()
+		}
+	}
+	lifecycleEvents.WithLabelValues(eventType).Inc()
+	if m.events == nil {
+		return
+	}
+
+	event := models.ProxyEvent{
+		Type:       eventType,
+		NodeID:     m.events.node,
+		InstanceID: instance.ID,
+		IP:         instance.IPv6.IP.String(),
+		PreviousIP: previous,
+		Port:       instance.Port,
+		Protocol:   instance.Protocol,
+		Backend:    instance.Backend,
+		Status:     instance.Status,
+		Reason:     reason,
+		Time:       time.Now(),
+	}
+	select {
+	case m.events.queue <- event:
+	default:
+		lifecycleEventsDropped.Inc()
+	}
+}
+
+func (b *eventBus) run(logger *logrus.Logger) {
+	defer close(b.done)
+	for event := range b.queue {
+		batch := []models.ProxyEvent{event}
+	collect:
+		for len(batch) < eventBatchSize {
+			select {
+			case next, ok := <-b.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		for _, sink := range b.sinks {
+			if err := sink.Send(batch); err != nil {
+				eventSinkFailures.WithLabelValues(sink.Name()).Inc()
+				logger.Warnf("Failed to send %d lifecycle events to the %s sink: %v", len(batch), sink.Name(), err)
+			}
+		}
+	}
+}
+
+// eventMessages are what the log sink writes for each event type.
+var eventMessages = map[string]string{
+	models.ProxyEventCreated:      "Proxy created",
+	models.ProxyEventHealthPassed: "Proxy passed its health check",
+	models.ProxyEventDegraded:     "Proxy degraded",
+	models.ProxyEventRotated:      "Proxy rotated",
+	models.ProxyEventStopped:      "Proxy stopped",
+	models.ProxyEventDied:         "Proxy died",
+}
+
+type logSink struct {
+	logger *logrus.Logger
+}
+
+// NewLogSink writes lifecycle events to logger with the event's fields.
+func NewLogSink(logger *logrus.Logger) EventSink {
+	return logSink{logger: logger}
+}
+
+func (s logSink) Name() string { return "log" }
+
+func (s logSink) Send(events []models.ProxyEvent) error {
+	for _, e := range events {
+		entry := s.logger.WithFields(logrus.Fields{
+			"event":    e.Type,
+			"instance": e.InstanceID,
+			"ip":       e.IP,
+			"port":     e.Port,
+			"protocol": e.Protocol,
+		})
+		if e.PreviousIP != "" {
+			entry = entry.WithField("previous_ip", e.PreviousIP)
+		}
+		if e.Reason != "" {
+			entry = entry.WithField("reason", e.Reason)
+		}
+		switch e.Type {
+		case models.ProxyEventDegraded:
+			entry.Warn(eventMessages[e.Type])
+		case models.ProxyEventDied:
+			entry.Error(eventMessages[e.Type])
+		default:
+			entry.Info(eventMessages[e.Type])
+		}
+	}
+	return nil
+}
+
+type webhookSink struct {
+	url     string
+	timeout time.Duration
+}
+
+// NewWebhookSink posts each batch of lifecycle events to url as a JSON
+// array.
+func NewWebhookSink(url string, timeout time.Duration) (EventSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("webhook sink needs a url")
+	}
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	return webhookSink{url: url, timeout: timeout}, nil
+}
+
+func (s webhookSink) Name() string { return "webhook" }
+
+func (s webhookSink) Send(events []models.ProxyEvent) error {
+	return runWebhook(s.url, events, s.timeout)
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+const (
+	HookPreStart  = "pre-start"
+	HookPostStart = "post-start"
+	HookPreStop   = "pre-stop"
+	HookOnError   = "on-error"
+
+	defaultHookTimeout = 30 * time.Second
+)
+
+// hookPayload is posted to webhook hooks and mirrored into PROXY_*
+// environment variables for command hooks.
+type hookPayload struct {
+	Event      string             `json:"event"`
+	InstanceID string             `json:"instance_id"`
+	IP         string             `json:"ip"`
+	Port       int                `json:"port"`
+	Protocol   string             `json:"protocol"`
+	Status     models.ProxyStatus `json:"status"`
+	Error      string             `json:"error,omitempty"`
+	Time       time.Time          `json:"time"`
+}
+
+// SetHooks configures the lifecycle hooks run for every instance.
+func (m *Manager) SetHooks(hooks []models.LifecycleHook) error {
+	for _, h := range hooks {
+		switch h.Event {
+		case HookPreStart, HookPostStart, HookPreStop, HookOnError:
+		default:
+			return fmt.Errorf("unknown hook event: %s", h.Event)
+		}
+		if (h.Command == "") == (h.URL == "") {
+			return fmt.Errorf("hook for %s needs exactly one of command or url", h.Event)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = hooks
+	if len(hooks) > 0 {
+		m.logger.Infof("Configured %d lifecycle hooks", len(hooks))
+	}
+	return nil
+}
+
+// runHooks runs every hook registered for event and returns the first
+// error. Callers decide whether an error is fatal.
+func (m *Manager) runHooks(event string, instance *models.ProxyInstance, cause error) error {
+	payload := hookPayload{
+		Event:      event,
+		InstanceID: instance.ID,
+		IP:         instance.IPv6.IP.String(),
+		Port:       instance.Port,
+		Protocol:   string(instance.Protocol),
+		Status:     instance.Status,
+		Time:       time.Now(),
+	}
+	if cause != nil {
+		payload.Error = cause.Error()
+	}
+
+	var firstErr error
+	for _, h := range m.hooks {
+		if h.Event != event {
+			continue
+		}
+		timeout := defaultHookTimeout
+		if h.TimeoutSeconds > 0 {
+			timeout = time.Duration(h.TimeoutSeconds) * time.Second
+		}
+
+		var err error
+		if h.Command != "" {
+			err = runCommandHook(h.Command, payload, timeout)
+		} else {
+			err = runWebhook(h.URL, payload, timeout)
+		}
+		if err != nil {
+			m.logger.Warnf("%s hook failed for %s: %v", event, instance.ID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// runHooksAsync is used for notification-style events that must not delay
+// the caller.
+func (m *Manager) runHooksAsync(event string, instance *models.ProxyInstance, cause error) {
+	if len(m.hooks) == 0 {
+		return
+	}
+	snapshot := *instance
+	go m.runHooks(event, &snapshot, cause)
+}
+
+func runCommandHook(command string, payload hookPayload, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"PROXY_EVENT="+payload.Event,
+		"PROXY_ID="+payload.InstanceID,
+		"PROXY_IP="+payload.IP,
+		"PROXY_PORT="+strconv.Itoa(payload.Port),
+		"PROXY_PROTOCOL="+payload.Protocol,
+		"PROXY_STATUS="+string(payload.Status),
+		"PROXY_ERROR="+payload.Error,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func runWebhook(url string, payload interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
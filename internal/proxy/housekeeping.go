@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RuntimeDir holds the configs, logs and pid files of process backends.
+const RuntimeDir = "/tmp"
+
+// staleFileAge is how long a backend file no running instance uses is left
+// alone before it is removed, so the files of an instance being started are
+// never taken away.
+const staleFileAge = time.Hour
+
+// runtimeFilePatterns match the files process backends write to RuntimeDir.
+var runtimeFilePatterns = []string{
+	"tinyproxy-*.conf", "tinyproxy-*.log", "tinyproxy-*.log.*", "tinyproxy-*.pid",
+	"3proxy-*.cfg", "3proxy-*.log", "3proxy-*.log.*",
+}
+
+var (
+	logRotations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_agent_log_rotations_total",
+		Help: "Instance logs rotated or truncated for size or low disk space.",
+	})
+	staleFilesRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_v6_agent_stale_files_removed_total",
+		Help: "Configs, logs and pid files of instances no longer running that were removed.",
+	})
+	instanceLogBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_v6_agent_log_bytes",
+		Help: "Size of the running instances' logs and their rotated copies.",
+	})
+)
+
+// logFileBackend is implemented by backends whose process writes a log of
+// its own.
+type logFileBackend interface {
+	LogPath() string
+}
+
+// Housekeeping is what one pass of Housekeep did.
+type Housekeeping struct {
+	Rotated  int   // logs rotated or truncated
+	Removed  int   // stale files removed
+	LogBytes int64 // size of the instance logs and rotated copies left
+	Archived int   // instances moved to the archive
+}
+
+// SetLogRotation rotates instance logs once they grow past maxBytes (0 =
+// never), keeping keep copies of each (0 = truncate only).
+func (m *Manager) SetLogRotation(maxBytes int64, keep int) error {
+	if maxBytes < 0 {
+		return fmt.Errorf("log size limit must not be negative")
+	}
+	if keep < 0 {
+		return fmt.Errorf("rotated log copies must not be negative")
+	}
+	m.mu.Lock()
+	m.maxLogBytes = maxBytes
+	m.logKeep = keep
+	m.mu.Unlock()
+	return nil
+}
+
+// Housekeep archives the instances down for the archive retention, rotates
+// the instance logs over the size limit and removes the backend files of
+// instances no longer running. With lowDisk set every log is truncated and
+// no rotated copy is kept, to give the space back.
+func (m *Manager) Housekeep(lowDisk bool) Housekeeping {
+	var result Housekeeping
+	result.Archived = m.archiveInstances(time.Now())
+
+	m.mu.RLock()
+	maxBytes, keep := m.maxLogBytes, m.logKeep
+	var logs []string
+	inUse := make(map[string]bool)
+	for _, b := range m.running {
+		if path := b.ConfigPath(); path != "" {
+			inUse[path] = true
+		}
+		if l, ok := b.(logFileBackend); ok {
+			path := l.LogPath()
+			logs = append(logs, path)
+			inUse[path] = true
+			inUse[strings.TrimSuffix(path, ".log")+".pid"] = true
+		}
+	}
+	m.mu.RUnlock()
+	if lowDisk {
+		keep = 0
+	}
+
+	for _, path := range logs {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.Size() > 0 && (lowDisk || maxBytes > 0 && info.Size() > maxBytes) {
+			if err := rotateLog(path, keep); err != nil {
+				m.logger.Warnf("Failed to rotate %s: %v", path, err)
+			} else {
+				result.Rotated++
+				logRotations.Inc()
+				m.logger.Infof("Rotated %s at %d bytes", path, info.Size())
+			}
+		}
+		for i := 1; i <= keep; i++ {
+			inUse[fmt.Sprintf("%s.%d", path, i)] = true
+		}
+	}
+
+	now := time.Now()
+	for _, pattern := range runtimeFilePatterns {
+		matches, _ := filepath.Glob(filepath.Join(RuntimeDir, pattern))
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if inUse[path] {
+				result.LogBytes += logSize(path, info)
+				continue
+			}
+			// Rotated copies over keep go at once, the rest once they aged
+			if !rotatedCopy(path) && now.Sub(info.ModTime()) < staleFileAge {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				m.logger.Warnf("Failed to remove %s: %v", path, err)
+				continue
+			}
+			result.Removed++
+			staleFilesRemoved.Inc()
+		}
+	}
+	if result.Removed > 0 {
+		m.logger.Infof("Removed %d files of proxy instances no longer running", result.Removed)
+	}
+	instanceLogBytes.Set(float64(result.LogBytes))
+	return result
+}
+
+// rotateLog copies path to path.1, moving older copies up to keep, and
+// truncates it in place. The processes append to their logs, so they carry
+// on at the start of the emptied file, where the log tailer reads it again.
+func rotateLog(path string, keep int) error {
+	if keep > 0 {
+		for i := keep; i > 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i-1), fmt.Sprintf("%s.%d", path, i))
+		}
+		if err := copyFile(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	return os.Truncate(path, 0)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// rotatedCopy reports whether path is a rotated log, e.g. "x.log.1".
+func rotatedCopy(path string) bool {
+	return strings.Contains(filepath.Base(path), ".log.")
+}
+
+// logSize counts path towards the log bytes when it is a log or a rotated
+// copy of one.
+func logSize(path string, info os.FileInfo) int64 {
+	if strings.HasSuffix(path, ".log") || rotatedCopy(path) {
+		return info.Size()
+	}
+	return 0
+}
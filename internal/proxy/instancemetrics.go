@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Metric granularities: how finely the per-instance gauges are labelled.
+const (
+	GranularityExit   = "exit"   // one series per instance
+	GranularityNode   = "node"   // instances summed per node
+	GranularityRegion = "region" // instances summed per region
+)
+
+// DefaultMaxExitSeries is how many instances a node may publish separate
+// series for before they are summed per node.
+const DefaultMaxExitSeries = 1000
+
+// instanceSample is the last health check result of an instance.
+type instanceSample struct {
+	protocol string
+	healthy  bool
+	status   *models.InstanceStatus
+}
+
+// seriesKey identifies one published series of each gauge.
+type seriesKey struct {
+	instance string
+	protocol string
+}
+
+// instanceMetrics publishes the instance gauges at the configured
+// granularity. Summing happens here rather than in queries so a node with
+// thousands of addresses does not hand Prometheus a series per address.
+type instanceMetrics struct {
+	logger      *logrus.Logger
+	granularity string
+	node        string
+	region      string
+	maxExits    int // 0 = never aggregate exit series
+	aggregated  bool
+	samples     map[string]instanceSample // instance ID -> last result
+	published   map[seriesKey]bool
+	mu          sync.Mutex
+}
+
+func newInstanceMetrics(logger *logrus.Logger) *instanceMetrics {
+	return &instanceMetrics{
+		logger:      logger,
+		granularity: GranularityExit,
+		maxExits:    DefaultMaxExitSeries,
+		samples:     make(map[string]instanceSample),
+		published:   make(map[seriesKey]bool),
+	}
+}
+
+// SetMetricsGranularity chooses how instance metrics are labelled. node and
+// region name this agent for the aggregated granularities. With exit
+// granularity, maxExits (0 = unlimited) caps the instances published one by
+// one; above it they are summed per node.
+func (m *Manager) SetMetricsGranularity(granularity, node, region string, maxExits int) error {
+	switch granularity {
+	case GranularityExit, GranularityNode:
+	case GranularityRegion:
+		if region == "" {
+			return fmt.Errorf("region granularity needs a region")
+		}
+	default:
+		return fmt.Errorf("unknown metrics granularity %q (want %s, %s or %s)", granularity, GranularityExit, GranularityNode, GranularityRegion)
+	}
+	if maxExits < 0 {
+		return fmt.Errorf("exit series limit must not be negative")
+	}
+
+	m.metrics.mu.Lock()
+	m.metrics.granularity = granularity
+	m.metrics.node = node
+	m.metrics.region = region
+	m.metrics.maxExits = maxExits
+	m.metrics.mu.Unlock()
+	m.logger.Infof("Instance metrics granularity: %s", granularity)
+	return nil
+}
+
+// Lifecycle events counted by instanceMetrics.event.
+const (
+	eventStarted       = "started"
+	eventAdopted       = "adopted" // taken over from an earlier agent
+	eventStartFailed   = "start_failed"
+	eventStopped       = "stopped"
+	eventFailed        = "failed"    // failed a health check
+	eventRecovered     = "recovered" // passed one again
+	eventDied          = "died"      // the backend exited on its own
+	eventQuotaExceeded = "quota_exceeded"
+	eventQuotaReset    = "quota_reset"
+	eventPaused        = "paused"  // its interface lost its link
+	eventResumed       = "resumed" // the link came back and it still answered
+)
+
+func (im *instanceMetrics) event(instance *models.ProxyInstance, event string) {
+	im.mu.Lock()
+	node := im.node
+	im.mu.Unlock()
+	instanceEvents.WithLabelValues(node, string(instance.Protocol), event).Inc()
+}
+
+func (im *instanceMetrics) record(instance *models.ProxyInstance, healthy bool, status *models.InstanceStatus) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.samples[instance.ID] = instanceSample{protocol: string(instance.Protocol), healthy: healthy, status: status}
+}
+
+func (im *instanceMetrics) forget(instanceID string) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	delete(im.samples, instanceID)
+	im.publishLocked()
+}
+
+// publish sets every gauge from the latest samples and removes series no
+// instance contributes to any more.
+func (im *instanceMetrics) publish() {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.publishLocked()
+}
+
+func (im *instanceMetrics) publishLocked() {
+	type totals struct {
+		healthy, active, requests, sent, received, errors float64
+		reported                                          bool // any sample with counters
+	}
+
+	granularity := im.granularity
+	aggregated := granularity == GranularityExit && im.maxExits > 0 && len(im.samples) > im.maxExits
+	if aggregated {
+		granularity = GranularityNode
+	}
+	if aggregated != im.aggregated {
+		im.aggregated = aggregated
+		if aggregated {
+			im.logger.Warnf("%d instances exceed the %d exit series limit, summing instance metrics per node", len(im.samples), im.maxExits)
+		} else {
+			im.logger.Infof("Instance metrics are published per exit again")
+		}
+	}
+	label := func(id string) string {
+		switch granularity {
+		case GranularityNode:
+			return im.node
+		case GranularityRegion:
+			return im.region
+		}
+		return id
+	}
+
+	sums := make(map[seriesKey]*totals)
+	for id, sample := range im.samples {
+		key := seriesKey{instance: label(id), protocol: sample.protocol}
+		t := sums[key]
+		if t == nil {
+			t = &totals{}
+			sums[key] = t
+		}
+		if sample.healthy {
+			t.healthy++
+		}
+		if sample.status != nil {
+			t.reported = true
+			t.active += float64(sample.status.ActiveConnections)
+			t.requests += float64(sample.status.RequestsTotal)
+			t.sent += float64(sample.status.BytesSent)
+			t.received += float64(sample.status.BytesReceived)
+			t.errors += float64(sample.status.ErrorsTotal)
+		}
+	}
+
+	for key, t := range sums {
+		instanceHealthy.WithLabelValues(key.instance, key.protocol).Set(t.healthy)
+		if !t.reported {
+			continue
+		}
+		instanceActive.WithLabelValues(key.instance, key.protocol).Set(t.active)
+		instanceRequests.WithLabelValues(key.instance, key.protocol).Set(t.requests)
+		instanceBytes.WithLabelValues(key.instance, key.protocol, "sent").Set(t.sent)
+		instanceBytes.WithLabelValues(key.instance, key.protocol, "received").Set(t.received)
+		instanceErrors.WithLabelValues(key.instance, key.protocol).Set(t.errors)
+	}
+	for key := range im.published {
+		if sums[key] != nil {
+			continue
+		}
+		instanceHealthy.DeleteLabelValues(key.instance, key.protocol)
+		instanceActive.DeleteLabelValues(key.instance, key.protocol)
+		instanceRequests.DeleteLabelValues(key.instance, key.protocol)
+		instanceBytes.DeleteLabelValues(key.instance, key.protocol, "sent")
+		instanceBytes.DeleteLabelValues(key.instance, key.protocol, "received")
+		instanceErrors.DeleteLabelValues(key.instance, key.protocol)
+	}
+	im.published = make(map[seriesKey]bool, len(sums))
+	for key := range sums {
+		im.published[key] = true
+	}
+}
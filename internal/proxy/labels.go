@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"proxy-v6/pkg/models"
+)
+
+const (
+	maxInstanceName = 64
+	maxInstanceTags = 32
+	maxInstanceTag  = 64
+)
+
+// labels are a name, tags and pools set on one instance through the API.
+// They take precedence over the configured rules.
+type labels struct {
+	name  string
+	tags  []string
+	pools []string
+}
+
+func (l labels) apply(instance *models.ProxyInstance) {
+	instance.Name, instance.Tags, instance.Pools = l.name, l.tags, l.pools
+}
+
+// labelRule is a parsed models.InstanceLabel.
+type labelRule struct {
+	network *net.IPNet // nil matches every address
+	name    string
+	tags    []string
+	pools   []string
+}
+
+// SetLabelRules configures the names, tags and pools given to instances as
+// they start. Instances already running keep theirs until restarted.
+func (m *Manager) SetLabelRules(rules []models.InstanceLabel) error {
+	parsed := make([]labelRule, 0, len(rules))
+	for i, rule := range rules {
+		r := labelRule{name: rule.Name}
+		switch {
+		case rule.Match == "*":
+		case strings.Contains(rule.Match, "/"):
+			_, network, err := net.ParseCIDR(rule.Match)
+			if err != nil {
+				return fmt.Errorf("instance label %d: invalid match %q", i, rule.Match)
+			}
+			r.network = network
+		default:
+			ip := net.ParseIP(rule.Match)
+			if ip == nil {
+				return fmt.Errorf("instance label %d: match must be an address, a CIDR prefix or \"*\", got %q", i, rule.Match)
+			}
+			r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		l, err := validateLabels(rule.Name, rule.Tags, rule.Pools)
+		if err != nil {
+			return fmt.Errorf("instance label %d: %w", i, err)
+		}
+		r.tags, r.pools = l.tags, l.pools
+		parsed = append(parsed, r)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.labelRules = parsed
+	if len(parsed) > 0 {
+		m.logger.Infof("Configured %d instance label rules", len(parsed))
+	}
+	return nil
+}
+
+// SetLabels names, tags and assigns pools to an instance, replacing what
+// the rules gave it. The labels stay with the instance ID across restarts
+// and rotation. An empty name, no tags and no pools hand the instance back
+// to the rules.
+func (m *Manager) SetLabels(instanceID, name string, tags, pools []string) (*models.ProxyInstance, error) {
+	l, err := validateLabels(name, tags, pools)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	instance, exists := m.instances[instanceID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errInstanceNotFound, instanceID)
+	}
+	if name == "" && len(l.tags) == 0 && len(l.pools) == 0 {
+		delete(m.labels, instanceID)
+	} else {
+		m.labels[instanceID] = l
+	}
+	m.instanceLabelsLocked(instanceID, instance.IPv6, instance.Port, instance.Protocol).apply(instance)
+	labelled := *instance
+	return &labelled, nil
+}
+
+// instanceLabelsLocked returns the labels for an instance: its API labels,
+// else those of the first rule matching its address.
+func (m *Manager) instanceLabelsLocked(instanceID string, ipv6 models.IPv6Address, port int, protocol models.ProxyProtocol) labels {
+	if l, ok := m.labels[instanceID]; ok {
+		return l
+	}
+	for _, rule := range m.labelRules {
+		if rule.network != nil && !rule.network.Contains(ipv6.IP) {
+			continue
+		}
+		name := strings.NewReplacer(
+			"{ip}", ipv6.IP.String(),
+			"{port}", strconv.Itoa(port),
+			"{protocol}", string(protocol),
+		).Replace(rule.name)
+		return labels{name: name, tags: rule.tags, pools: rule.pools}
+	}
+	return labels{}
+}
+
+// validateLabels checks an instance name, tags and pools and returns them
+// with the duplicates removed. Tags and pools may not contain whitespace or
+// commas, so they can be listed in query strings, headers and exports.
+func validateLabels(name string, tags, pools []string) (labels, error) {
+	if len(name) > maxInstanceName {
+		return labels{}, fmt.Errorf("name is longer than %d bytes", maxInstanceName)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return labels{}, fmt.Errorf("name contains control characters")
+	}
+	l := labels{name: name}
+	var err error
+	if l.tags, err = uniqueWords("tag", tags); err != nil {
+		return labels{}, err
+	}
+	if l.pools, err = uniqueWords("pool", pools); err != nil {
+		return labels{}, err
+	}
+	return l, nil
+}
+
+func uniqueWords(kind string, words []string) ([]string, error) {
+	if len(words) > maxInstanceTags {
+		return nil, fmt.Errorf("%d %ss, at most %d are allowed", len(words), kind, maxInstanceTags)
+	}
+	var unique []string
+	seen := make(map[string]bool, len(words))
+	for _, word := range words {
+		if word == "" || len(word) > maxInstanceTag {
+			return nil, fmt.Errorf("%s %q must be 1 to %d bytes", kind, word, maxInstanceTag)
+		}
+		if strings.IndexFunc(word, func(r rune) bool { return r == ',' || unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+			return nil, fmt.Errorf("%s %q contains whitespace or a comma", kind, word)
+		}
+		if !seen[word] {
+			seen[word] = true
+			unique = append(unique, word)
+		}
+	}
+	return unique, nil
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+const (
+	logPollInterval = time.Second
+	// maxLogLine bounds the partial line kept between reads, in case a log
+	// is written without newlines.
+	maxLogLine = 64 * 1024
+)
+
+// logEvent is what a log line says about an instance's traffic.
+type logEvent struct {
+	request bool
+	failed  bool
+	at      time.Time
+}
+
+// logParser reads one log line; ok is false for lines that carry nothing.
+type logParser func(line string, now time.Time) (event logEvent, ok bool)
+
+// logUsage accumulates the events parsed from an instance's log since it
+// started.
+type logUsage struct {
+	requests    int64
+	errors      int64
+	lastRequest time.Time
+	mu          sync.Mutex
+}
+
+func (u *logUsage) add(e logEvent) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e.request {
+		u.requests++
+		if e.at.After(u.lastRequest) {
+			u.lastRequest = e.at
+		}
+	}
+	if e.failed {
+		u.errors++
+	}
+}
+
+func (u *logUsage) metrics() models.ProxyMetrics {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return models.ProxyMetrics{
+		RequestsTotal: u.requests,
+		ErrorCount:    u.errors,
+		LastRequest:   u.lastRequest,
+	}
+}
+
+// logTailer follows a log file from an offset, handing complete lines to
+// parse. A file that shrinks was truncated by rotation and is read again
+// from the start.
+type logTailer struct {
+	path    string
+	offset  int64
+	partial []byte
+	parse   logParser
+	usage   *logUsage
+}
+
+// newLogTailer starts after the current end of path, so lines an earlier
+// run appended to the same file are not counted again.
+func newLogTailer(path string, parse logParser, usage *logUsage) *logTailer {
+	t := &logTailer{path: path, parse: parse, usage: usage}
+	if info, err := os.Stat(path); err == nil {
+		t.offset = info.Size()
+	}
+	return t
+}
+
+// run polls the log until stop is closed, then reads it one last time.
+func (t *logTailer) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			t.poll()
+			return
+		case <-ticker.C:
+			t.poll()
+		}
+	}
+}
+
+func (t *logTailer) poll() {
+	file, err := os.Open(t.path)
+	if err != nil {
+		// Not created yet
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if info.Size() < t.offset {
+		t.offset = 0
+		t.partial = nil
+	}
+	if info.Size() == t.offset {
+		return
+	}
+	if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, info.Size()-t.offset))
+	if err != nil {
+		return
+	}
+	t.offset += int64(len(data))
+
+	data = append(t.partial, data...)
+	now := time.Now()
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if event, ok := t.parse(strings.TrimRight(string(data[:i]), "\r"), now); ok {
+			t.usage.add(event)
+		}
+		data = data[i+1:]
+	}
+	if len(data) > maxLogLine {
+		data = nil
+	}
+	t.partial = append([]byte(nil), data...)
+}
+
+// tinyproxyLogLine matches tinyproxy's log format, e.g.
+// "CONNECT   Jun 04 11:04:43.393 [29731]: Request (file descriptor 7): GET ...".
+// 1.10 logs without the milliseconds.
+var tinyproxyLogLine = regexp.MustCompile(`^([A-Z]+)\s+([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})(?:\.\d+)? \[\d+\]: (.*)$`)
+
+// parseTinyproxyLog counts request lines and errors. A client closing
+// without sending a request is logged as an error, but that is what the TCP
+// health check does, so it is not counted. Tinyproxy logs no byte counts.
+func parseTinyproxyLog(line string, now time.Time) (logEvent, bool) {
+	match := tinyproxyLogLine.FindStringSubmatch(line)
+	if match == nil {
+		return logEvent{}, false
+	}
+	level, message := match[1], match[3]
+
+	switch {
+	case strings.HasPrefix(message, "Request (file descriptor"):
+		return logEvent{request: true, at: tinyproxyLogTime(match[2], now)}, true
+	case level == "ERROR" || level == "CRITICAL":
+		if strings.Contains(message, "closed socket before read") {
+			return logEvent{}, false
+		}
+		return logEvent{failed: true}, true
+	}
+	return logEvent{}, false
+}
+
+// tinyproxyLogTime reads a log timestamp, which has no year. A time ahead
+// of now was logged last year.
+func tinyproxyLogTime(stamp string, now time.Time) time.Time {
+	t, err := time.ParseInLocation("Jan _2 15:04:05", stamp, now.Location())
+	if err != nil {
+		return now
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
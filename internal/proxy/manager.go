@@ -2,28 +2,65 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
-	"os"
-	"os/exec"
+	"sort"
 	"sync"
-	"syscall"
 	"time"
 
 	"proxy-v6/pkg/models"
 	"github.com/sirupsen/logrus"
 )
 
+// Instances are health checked this many times, this far apart, before
+// startup is considered failed.
+const (
+	startupRetries       = 5
+	startupRetryInterval = 2 * time.Second
+)
+
+// errNoStatusEndpoint is returned for instances run by external processes,
+// which only get TCP health checks.
+var errNoStatusEndpoint = errors.New("backend has no status endpoint")
+
+// errPortInUse is returned when an instance already serves an address and
+// port.
+var errPortInUse = errors.New("port already in use on this address")
+
+var errInstanceNotFound = errors.New("proxy instance not found")
+
 type Manager struct {
-	logger      *logrus.Logger
-	instances   map[string]*models.ProxyInstance
-	mu          sync.RWMutex
-	startPort   int
-	endPort     int
-	currentPort int
-	processes   map[string]*exec.Cmd
-	allowedIPs  []string
-	proxyMode   string
+	logger        *logrus.Logger
+	instances     map[string]*models.ProxyInstance
+	mu            sync.RWMutex
+	startPort     int
+	endPort       int
+	currentPort   int
+	running       map[string]ProxyBackend
+	allowedIPs    []string
+	proxyMode     string
+	warmupURLs    []string
+	warmupTimeout time.Duration
+	egressCheckURL     string
+	egressCheckTimeout time.Duration
+	hooks         []models.LifecycleHook
+	events        *eventBus // nil until SetEventSinks
+	rotating      *rotation // set while RotateProxy relaunches an instance
+	backend       string
+	socks5        bool
+	proxyAuth     bool
+	authUsername  string
+	authPassword  string
+	credentials   map[string]credentials // instance ID -> credentials
+	labels        map[string]labels      // instance ID -> labels set through the API
+	labelRules    []labelRule
+	metrics       *instanceMetrics
+	quota         *quotaTracker
+	stateFile     string
+	maxLogBytes   int64 // instance log size that triggers rotation; 0 = never
+	logKeep       int   // rotated copies kept of each log
+	archive       archive
+	shuttingDown  bool // set by StopAccepting
 }
 
 func NewManager(logger *logrus.Logger, startPort, endPort int) *Manager {
@@ -33,21 +70,96 @@ func NewManager(logger *logrus.Logger, startPort, endPort int) *Manager {
 		startPort:   startPort,
 		endPort:     endPort,
 		currentPort: startPort,
-		processes:   make(map[string]*exec.Cmd),
+		running:     make(map[string]ProxyBackend),
+		credentials: make(map[string]credentials),
+		labels:      make(map[string]labels),
+		metrics:     newInstanceMetrics(logger),
+		quota:       newQuotaTracker(),
 		allowedIPs:  []string{},
 		proxyMode:   "open",
+		backend:     BackendTinyproxy,
 	}
 }
 
+// SetBackend selects how new HTTP instances are run: one of BackendNames.
+func (m *Manager) SetBackend(backend string) error {
+	descriptor, ok := backends[backend]
+	if !ok {
+		return fmt.Errorf("unknown proxy backend: %s (valid: %v)", backend, BackendNames())
+	}
+	if descriptor.check != nil {
+		if err := descriptor.check(m.logger); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backend = backend
+	m.logger.Infof("Proxy backend: %s", backend)
+	return nil
+}
+
 func (m *Manager) SetAccessControl(allowedIPs []string, mode string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.allowedIPs = allowedIPs
 	m.proxyMode = mode
 	m.logger.Infof("Proxy access control set to mode: %s with %d allowed IPs", mode, len(allowedIPs))
+	
+	// Apply the new rules to instances that are already running
+	for id, b := range m.running {
+		instance := m.instances[id]
+		if err := b.Reload(m.instanceConfig(id, instance.IPv6, instance.Port)); err != nil {
+			m.logger.Warnf("Failed to reload access control for %s: %v", id, err)
+		}
+	}
+}
+
+// AccessControl returns the current access mode and allowed IPs.
+func (m *Manager) AccessControl() (string, []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.proxyMode, append([]string(nil), m.allowedIPs...)
+}
+
+// Permitted reports whether a client at remoteAddr may use this node's
+// proxies under the current access control. Loopback is always allowed.
+func (m *Manager) Permitted(remoteAddr string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return newAccessList(InstanceConfig{AllowedIPs: m.allowedIPs, Mode: m.proxyMode}).permitted(remoteAddr)
+}
+
+// ReloadProxy re-applies the current configuration to a running instance
+// without restarting it.
+func (m *Manager) ReloadProxy(instanceID string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	b, ok := m.running[instanceID]
+	if !ok {
+		return fmt.Errorf("proxy instance not running: %s", instanceID)
+	}
+	instance := m.instances[instanceID]
+	return b.Reload(m.instanceConfig(instanceID, instance.IPv6, instance.Port))
 }
 
-func (m *Manager) StartProxy(ctx context.Context, ipv6 models.IPv6Address) (*models.ProxyInstance, error) {
+func (m *Manager) instanceConfig(instanceID string, ipv6 models.IPv6Address, port int) InstanceConfig {
+	creds := m.instanceCredentials(instanceID)
+	return InstanceConfig{
+		ID:         instanceID,
+		BindIP:     ipv6.IP,
+		Port:       port,
+		AllowedIPs: m.allowedIPs,
+		Mode:       m.proxyMode,
+		Username:   creds.username,
+		Password:   creds.password,
+	}
+}
+
+func (m *Manager) StartProxy(ctx context.Context, ipv6 models.IPv6Address) (instance *models.ProxyInstance, err error) {
+	// Runs after the unlock below: warm-up requests take a while
+	defer func() { instance, err = m.finishStart(ctx, instance, err) }()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
@@ -56,112 +168,290 @@ func (m *Manager) StartProxy(ctx context.Context, ipv6 models.IPv6Address) (*mod
 		return nil, fmt.Errorf("no available ports")
 	}
 	
-	instanceID := fmt.Sprintf("%s-%d", ipv6.IP.String(), port)
-	m.logger.Debugf("Starting proxy instance: %s", instanceID)
+	return m.startProxyLocked(ctx, ipv6, port, models.ProxyProtocolHTTP)
+}
+
+// StartSOCKS5 starts an in-process SOCKS5 proxy on ipv6, alongside any HTTP
+// proxy on the same address. SOCKS5 does not depend on the HTTP backend.
+func (m *Manager) StartSOCKS5(ctx context.Context, ipv6 models.IPv6Address) (instance *models.ProxyInstance, err error) {
+	// Runs after the unlock below: warm-up requests take a while
+	defer func() { instance, err = m.finishStart(ctx, instance, err) }()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	
-	configPath := fmt.Sprintf("/tmp/tinyproxy-%s.conf", instanceID)
-	if err := m.createTinyproxyConfig(configPath, ipv6.IP.String(), port); err != nil {
-		return nil, fmt.Errorf("failed to create config: %w", err)
+	port := m.getNextPort()
+	if port == 0 {
+		return nil, fmt.Errorf("no available ports")
 	}
-	m.logger.Debugf("Created config file: %s", configPath)
 	
-	// Add debug mode and foreground mode for better error visibility
-	cmd := exec.CommandContext(ctx, "tinyproxy", "-d", "-c", configPath)
+	m.socks5 = true
+	return m.startProxyLocked(ctx, ipv6, port, models.ProxyProtocolSOCKS5)
+}
+
+// StartProxyOn starts a protocol instance on ipv6 and port, or on the next
+// free port when port is 0.
+func (m *Manager) StartProxyOn(ctx context.Context, ipv6 models.IPv6Address, port int, protocol models.ProxyProtocol) (instance *models.ProxyInstance, err error) {
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
 	
-	// Capture stdout and stderr for debugging
-	stdoutPipe, _ := cmd.StdoutPipe()
-	stderrPipe, _ := cmd.StderrPipe()
+	// Runs after the unlock below: warm-up requests take a while
+	defer func() { instance, err = m.finishStart(ctx, instance, err) }()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	
-	if err := cmd.Start(); err != nil {
-		m.logger.Errorf("Failed to start tinyproxy for %s: %v", instanceID, err)
-		// Try to read any output that might have been produced
-		if output, _ := os.ReadFile(configPath); len(output) > 0 {
-			m.logger.Debugf("Config file contents:\n%s", string(output))
+	if port == 0 {
+		port = m.getNextPort()
+		if port == 0 {
+			return nil, fmt.Errorf("no available ports")
 		}
-		return nil, fmt.Errorf("failed to start tinyproxy: %w", err)
+	} else if existing := m.serving(ipv6, port); existing != nil {
+		return nil, fmt.Errorf("%w: %s", errPortInUse, existing.ID)
+	}
+	// A rotated instance keeps the ID of its first address
+	if existing, ok := m.instances[fmt.Sprintf("%s-%d", ipv6.IP.String(), port)]; ok && existing.Status != models.ProxyStatusStopped {
+		return nil, fmt.Errorf("%w: %s", errPortInUse, existing.ID)
 	}
 	
-	// Start goroutines to capture output
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stdoutPipe.Read(buf)
-			if err != nil {
-				break
-			}
-			if n > 0 {
-				m.logger.Infof("Tinyproxy[%s] stdout: %s", instanceID, string(buf[:n]))
-			}
+	if protocol == models.ProxyProtocolSOCKS5 {
+		m.socks5 = true
+	}
+	return m.startProxyLocked(ctx, ipv6, port, protocol)
+}
+
+// RestartProxy stops an instance and starts it again on the same address
+// and port, keeping its standby flag.
+func (m *Manager) RestartProxy(ctx context.Context, instanceID string) (instance *models.ProxyInstance, err error) {
+	// Runs after the unlock below: warm-up requests take a while
+	defer func() { instance, err = m.finishStart(ctx, instance, err) }()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	old, err := m.stopProxyLocked(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return m.relaunchLocked(ctx, old, old.IPv6)
+}
+
+// RotateProxy moves an instance to another address on this host. Its ID,
+// port, protocol and standby flag stay the same.
+func (m *Manager) RotateProxy(ctx context.Context, instanceID string, ipv6 models.IPv6Address) (instance *models.ProxyInstance, err error) {
+	// Runs after the unlock below: warm-up requests take a while
+	defer func() { instance, err = m.finishStart(ctx, instance, err) }()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	old, exists := m.instances[instanceID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errInstanceNotFound, instanceID)
+	}
+	if old.IPv6.IP.Equal(ipv6.IP) {
+		return nil, fmt.Errorf("%s is already on %s", instanceID, ipv6.IP)
+	}
+	if existing := m.serving(ipv6, old.Port); existing != nil {
+		return nil, fmt.Errorf("%w: %s", errPortInUse, existing.ID)
+	}
+	
+	m.rotating = &rotation{id: instanceID, from: old.IPv6.IP}
+	defer func() { m.rotating = nil }()
+	if _, err := m.stopProxyLocked(instanceID); err != nil {
+		return nil, err
+	}
+	m.logger.Debugf("Rotating proxy %s from %s to %s", instanceID, old.IPv6.IP, ipv6.IP)
+	instance, err = m.relaunchLocked(ctx, old, ipv6)
+	if instance == nil {
+		// It never came up on the new address
+		m.rotating = nil
+		m.emit(models.ProxyEventStopped, old, err.Error())
+	}
+	return instance, err
+}
+
+// relaunchLocked starts a stopped instance again on ipv6 under its old ID.
+func (m *Manager) relaunchLocked(ctx context.Context, old *models.ProxyInstance, ipv6 models.IPv6Address) (*models.ProxyInstance, error) {
+	delete(m.instances, old.ID)
+	
+	instance, err := m.startInstanceLocked(ctx, old.ID, ipv6, old.Port, old.Protocol)
+	if instance != nil {
+		instance.Standby = old.Standby
+	}
+	return instance, err
+}
+
+// serving returns the instance that is not stopped on ipv6 and port, if any.
+func (m *Manager) serving(ipv6 models.IPv6Address, port int) *models.ProxyInstance {
+	for _, instance := range m.instances {
+		if instance.Port == port && instance.IPv6.IP.Equal(ipv6.IP) && instance.Status != models.ProxyStatusStopped {
+			return instance
 		}
-	}()
+	}
+	return nil
+}
+
+// RestartAll restarts every instance that has not been stopped, one at a
+// time, and returns the restarted instances.
+func (m *Manager) RestartAll(ctx context.Context) ([]models.ProxyInstance, error) {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.instances))
+	for id, instance := range m.instances {
+		if instance.Status != models.ProxyStatusStopped {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(ids)
 	
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stderrPipe.Read(buf)
-			if err != nil {
-				break
-			}
-			if n > 0 {
-				m.logger.Warnf("Tinyproxy[%s] stderr: %s", instanceID, string(buf[:n]))
-			}
+	restarted := make([]models.ProxyInstance, 0, len(ids))
+	failed := make([]string, 0)
+	for _, id := range ids {
+		instance, err := m.RestartProxy(ctx, id)
+		if err != nil {
+			m.logger.Errorf("Failed to restart proxy %s: %v", id, err)
+			failed = append(failed, id)
+		}
+		if instance != nil {
+			restarted = append(restarted, *instance)
+		}
+	}
+	
+	if len(failed) > 0 {
+		return restarted, fmt.Errorf("failed to restart %d of %d proxies: %v", len(failed), len(ids), failed)
+	}
+	m.logger.Infof("Restarted %d proxies", len(ids))
+	return restarted, nil
+}
+
+func (m *Manager) startProxyLocked(ctx context.Context, ipv6 models.IPv6Address, port int, protocol models.ProxyProtocol) (*models.ProxyInstance, error) {
+	return m.startInstanceLocked(ctx, fmt.Sprintf("%s-%d", ipv6.IP.String(), port), ipv6, port, protocol)
+}
+
+func (m *Manager) startInstanceLocked(ctx context.Context, instanceID string, ipv6 models.IPv6Address, port int, protocol models.ProxyProtocol) (*models.ProxyInstance, error) {
+	if protocol == "" {
+		protocol = models.ProxyProtocolHTTP
+	}
+	m.logger.Debugf("Starting %s proxy instance: %s", protocol, instanceID)
+	
+	pending := &models.ProxyInstance{ID: instanceID, IPv6: ipv6, Port: port, Status: models.ProxyStatusStarting, Protocol: protocol}
+	recorded := false
+	defer func() {
+		// The port of an instance that never came up goes back to the pool
+		if !recorded {
+			m.releasePortLocked(port)
 		}
 	}()
+	if err := m.runHooks(HookPreStart, pending, nil); err != nil {
+		return nil, fmt.Errorf("pre-start hook failed: %w", err)
+	}
+	
+	cfg := m.instanceConfig(instanceID, ipv6, port)
+	backendName := m.backend
+	b := backends[backendName].newBackend(m.logger, cfg)
+	if protocol == models.ProxyProtocolSOCKS5 {
+		backendName = "socks5"
+		b = newSOCKS5Backend(m.logger, cfg)
+	}
+	
+	if err := b.Start(ctx); err != nil {
+		m.logger.Errorf("Failed to start %s proxy for %s: %v", backendName, instanceID, err)
+		m.metrics.event(pending, eventStartFailed)
+		return nil, fmt.Errorf("failed to start %s proxy: %w", backendName, err)
+	}
 	
 	instance := &models.ProxyInstance{
-		ID:        instanceID,
-		IPv6:      ipv6,
-		Port:      port,
-		Status:    models.ProxyStatusStarting,
-		StartedAt: time.Now(),
+		ID:          instanceID,
+		IPv6:        ipv6,
+		Port:        port,
+		Status:      models.ProxyStatusStarting,
+		StartedAt:   time.Now(),
 		LastChecked: time.Now(),
-		Metrics:   models.ProxyMetrics{},
+		Metrics:     models.ProxyMetrics{},
+		Protocol:    protocol,
+		Backend:     backendName,
+		ConfigPath:  b.ConfigPath(),
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	}
+	m.instanceLabelsLocked(instanceID, ipv6, port, protocol).apply(instance)
+	if reporter, ok := b.(statusReporter); ok {
+		instance.StatusURL = reporter.StatusURL()
 	}
 	
 	m.instances[instanceID] = instance
-	m.processes[instanceID] = cmd
+	m.running[instanceID] = b
+	recorded = true
+	m.saveStateLocked()
+	m.emit(models.ProxyEventCreated, instance, "")
 	
-	go m.monitorProcess(instanceID, cmd)
+	go m.monitorBackend(instanceID, b)
 	
-	// Give tinyproxy more time to start up and check multiple times
-	retries := 5
-	for i := 0; i < retries; i++ {
-		time.Sleep(2 * time.Second)
-		
-		// Check if process is still running
-		if cmd.Process != nil {
-			// Use kill -0 to check if process exists
-			if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
-				m.logger.Errorf("Tinyproxy process died during startup (attempt %d/%d): %v", i+1, retries, err)
-				// Try to get exit status
-				if cmd.ProcessState != nil {
-					m.logger.Errorf("Process exit code: %d", cmd.ProcessState.ExitCode())
-				}
-				// Read log file for errors
-				if logContent, err := os.ReadFile(fmt.Sprintf("/tmp/tinyproxy-%s-%d.log", ipv6.IP.String(), port)); err == nil && len(logContent) > 0 {
-					m.logger.Errorf("Tinyproxy log contents:\n%s", string(logContent))
-				}
-				instance.Status = models.ProxyStatusError
-				return instance, fmt.Errorf("tinyproxy process died during startup")
-			}
+	// External processes need a moment before they accept connections
+	var err error
+	for i := 0; i < startupRetries; i++ {
+		if i > 0 {
+			m.logger.Debugf("Proxy not ready yet, retrying... (attempt %d/%d)", i+1, startupRetries)
+			time.Sleep(startupRetryInterval)
 		}
-		
-		if m.checkProxyHealth(ipv6.IP.String(), port) {
-			instance.Status = models.ProxyStatusRunning
-			m.logger.Infof("Proxy started successfully: %s on port %d (attempt %d/%d)", ipv6.IP.String(), port, i+1, retries)
+		if err = b.HealthCheck(); err == nil || errors.Is(err, errProcessExited) {
 			break
-		} else if i == retries-1 {
-			instance.Status = models.ProxyStatusError
-			m.logger.Errorf("Proxy failed health check after %d attempts: %s on port %d", retries, ipv6.IP.String(), port)
-			// Read log file for debugging
-			if logContent, err := os.ReadFile(fmt.Sprintf("/tmp/tinyproxy-%s-%d.log", ipv6.IP.String(), port)); err == nil && len(logContent) > 0 {
-				m.logger.Errorf("Tinyproxy log contents:\n%s", string(logContent))
+		}
+	}
+	
+	if err != nil {
+		instance.Status = models.ProxyStatusError
+		if errors.Is(err, errProcessExited) {
+			m.logger.Errorf("%s process for %s died during startup", backendName, instanceID)
+		} else {
+			m.logger.Errorf("Proxy failed health check after %d attempts: %s on port %d", startupRetries, ipv6.IP.String(), port)
+			err = fmt.Errorf("failed health check after %d attempts", startupRetries)
+		}
+		if logs, ok := b.(interface{ logContents() string }); ok {
+			if content := logs.logContents(); content != "" {
+				m.logger.Errorf("%s log contents:\n%s", backendName, content)
 			}
+		}
+		m.metrics.event(instance, eventStartFailed)
+		if errors.Is(err, errProcessExited) {
+			m.emit(models.ProxyEventDied, instance, err.Error())
 		} else {
-			m.logger.Debugf("Proxy not ready yet, retrying... (attempt %d/%d)", i+1, retries)
+			m.emit(models.ProxyEventDegraded, instance, err.Error())
 		}
+		m.runHooksAsync(HookOnError, instance, err)
+		return instance, err
 	}
 	
+	// Left starting for finishStart, which warms it up without m.mu
+	return instance, nil
+}
+
+// finishStart warms up an instance just started by startInstanceLocked and
+// reports it running. It is called without m.mu, so the warm-up requests
+// do not hold up the rest of the manager; an instance stopped or replaced
+// meanwhile is left as it is. Failed and resumed instances pass through.
+func (m *Manager) finishStart(ctx context.Context, instance *models.ProxyInstance, err error) (*models.ProxyInstance, error) {
+	if err != nil || instance == nil {
+		return instance, err
+	}
+	m.mu.RLock()
+	if instance.Status != models.ProxyStatusStarting {
+		m.mu.RUnlock()
+		return instance, nil
+	}
+	target := *instance
+	urls, timeout := m.warmupURLs, m.warmupTimeout
+	m.mu.RUnlock()
+	
+	m.warmUp(ctx, target, urls, timeout)
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.instances[instance.ID] != instance || instance.Status != models.ProxyStatusStarting {
+		return instance, nil
+	}
+	instance.Status = models.ProxyStatusRunning
+	m.metrics.event(instance, eventStarted)
+	m.emit(models.ProxyEventHealthPassed, instance, "")
+	m.runHooksAsync(HookPostStart, instance, nil)
 	return instance, nil
 }
 
@@ -169,22 +459,79 @@ func (m *Manager) StopProxy(instanceID string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
+	_, err := m.stopProxyLocked(instanceID)
+	return err
+}
+
+func (m *Manager) stopProxyLocked(instanceID string) (*models.ProxyInstance, error) {
 	instance, exists := m.instances[instanceID]
 	if !exists {
-		return fmt.Errorf("proxy instance not found: %s", instanceID)
+		return nil, fmt.Errorf("%w: %s", errInstanceNotFound, instanceID)
 	}
 	
-	if cmd, ok := m.processes[instanceID]; ok {
-		if err := cmd.Process.Kill(); err != nil {
-			m.logger.Warnf("Failed to kill process for %s: %v", instanceID, err)
+	m.runHooks(HookPreStop, instance, nil)
+	wasStopped := instance.Status == models.ProxyStatusStopped
+	
+	if b, ok := m.running[instanceID]; ok {
+		if err := b.Stop(); err != nil {
+			m.logger.Warnf("Failed to stop proxy %s: %v", instanceID, err)
 		}
-		delete(m.processes, instanceID)
+		delete(m.running, instanceID)
+		m.saveStateLocked()
 	}
 	
 	instance.Status = models.ProxyStatusStopped
-	m.logger.Infof("Proxy stopped: %s", instanceID)
+	if !wasStopped {
+		stoppedAt := time.Now()
+		instance.StoppedAt = &stoppedAt
+	}
+	m.metrics.forget(instance.ID)
+	m.quota.forget(instance.ID)
+	m.metrics.event(instance, eventStopped)
+	if !wasStopped {
+		m.emit(models.ProxyEventStopped, instance, "")
+	}
 	
-	return nil
+	return instance, nil
+}
+
+// SetStandbyCount marks count running instances as warm standby and clears
+// the flag on the rest. Standby proxies are fully started and health
+// checked but the coordinator only routes to them once it promotes them.
+func (m *Manager) SetStandbyCount(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	ids := make([]string, 0, len(m.instances))
+	// Only HTTP exits are pooled by the coordinator
+	for id, instance := range m.instances {
+		if instance.Status == models.ProxyStatusRunning && instance.Protocol != models.ProxyProtocolSOCKS5 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	
+	if count > len(ids) {
+		m.logger.Warnf("Requested %d standby proxies but only %d are running", count, len(ids))
+		count = len(ids)
+	}
+	
+	for i, id := range ids {
+		m.instances[id].Standby = i >= len(ids)-count
+	}
+	m.logger.Infof("Holding %d of %d running proxies as warm standby", count, len(ids))
+}
+
+// Capabilities reports what the configured backend supports so the
+// coordinator only routes compatible traffic here.
+func (m *Manager) Capabilities() models.Capabilities {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	caps := backends[m.backend].capabilities
+	caps.SOCKS5 = m.socks5
+	caps.Auth = m.proxyAuth
+	return caps
 }
 
 func (m *Manager) GetInstances() []models.ProxyInstance {
@@ -208,11 +555,178 @@ func (m *Manager) UpdateMetrics(instanceID string, metrics models.ProxyMetrics)
 	}
 }
 
+// InstanceStatus fetches live counters from a native instance's status
+// endpoint.
+func (m *Manager) InstanceStatus(instanceID string) (models.InstanceStatus, error) {
+	m.mu.RLock()
+	b, ok := m.running[instanceID]
+	m.mu.RUnlock()
+	if !ok {
+		return models.InstanceStatus{}, fmt.Errorf("proxy instance not running: %s", instanceID)
+	}
+	
+	reporter, ok := b.(statusReporter)
+	if !ok {
+		return models.InstanceStatus{}, errNoStatusEndpoint
+	}
+	return reporter.Status()
+}
+
+// RunHealthChecks checks every running instance each interval until ctx is
+// done.
+func (m *Manager) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.CheckInstances(ctx)
+		}
+	}
+}
+
+// CheckInstances health checks every started instance, flipping it between
+// running and error, and refreshes the metrics of native instances from
+// their status endpoints. A round cut short by ctx changes nothing.
+func (m *Manager) CheckInstances(ctx context.Context) {
+	m.mu.RLock()
+	if m.shuttingDown {
+		m.mu.RUnlock()
+		return
+	}
+	checks := make(map[string]ProxyBackend, len(m.running))
+	instances := make(map[string]models.ProxyInstance, len(m.running))
+	for id, b := range m.running {
+		if status := m.instances[id].Status; status == models.ProxyStatusRunning || status == models.ProxyStatusError || status == models.ProxyStatusQuotaExceeded {
+			checks[id] = b
+			instances[id] = *m.instances[id]
+		}
+	}
+	verifyEgress := m.egressCheckURL != ""
+	m.mu.RUnlock()
+	
+	type result struct {
+		err    error
+		status *models.InstanceStatus
+		usage  *models.ProxyMetrics
+	}
+	results := make(map[string]result, len(checks))
+	for id, b := range checks {
+		if ctx.Err() != nil {
+			return
+		}
+		r := result{err: b.HealthCheck()}
+		if reporter, ok := b.(statusReporter); ok && r.err == nil {
+			if status, err := reporter.Status(); err == nil {
+				r.status = &status
+			} else {
+				m.logger.Debugf("Failed to read status of %s: %v", id, err)
+			}
+		}
+		if reporter, ok := b.(usageReporter); ok {
+			if usage, ok := reporter.Usage(); ok {
+				r.usage = &usage
+			}
+		}
+		results[id] = r
+	}
+	
+	// Instances that accept connections may still route out of the wrong
+	// address, e.g. when the IPv6 is not actually routed to this host
+	if verifyEgress {
+		reachable := make(map[string]models.ProxyInstance, len(results))
+		for id, r := range results {
+			if r.err == nil {
+				reachable[id] = instances[id]
+			}
+		}
+		for id, err := range m.verifyEgress(ctx, reachable) {
+			r := results[id]
+			r.err = err
+			results[id] = r
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	for id, r := range results {
+		// Skip instances stopped or restarted while we were checking
+		if m.running[id] != checks[id] {
+			continue
+		}
+		instance := m.instances[id]
+		instance.LastChecked = time.Now()
+		
+		used, overQuota := m.quota.account(instance, r.status, instance.LastChecked)
+		instance.QuotaUsedBytes = used
+		
+		switch {
+		case r.err != nil && (instance.Status == models.ProxyStatusRunning || instance.Status == models.ProxyStatusQuotaExceeded):
+			instance.Status = models.ProxyStatusError
+			m.metrics.event(instance, eventFailed)
+			m.emit(models.ProxyEventDegraded, instance, "health check failed: "+r.err.Error())
+			m.runHooksAsync(HookOnError, instance, fmt.Errorf("health check failed: %w", r.err))
+		case r.err == nil && instance.Status == models.ProxyStatusError:
+			instance.Status = models.ProxyStatusRunning
+			m.metrics.event(instance, eventRecovered)
+			m.emit(models.ProxyEventHealthPassed, instance, "")
+		}
+		
+		// Exits over quota keep running but are not routed to until the
+		// period resets
+		switch {
+		case overQuota && instance.Status == models.ProxyStatusRunning:
+			instance.Status = models.ProxyStatusQuotaExceeded
+			m.metrics.event(instance, eventQuotaExceeded)
+			m.emit(models.ProxyEventDegraded, instance, fmt.Sprintf("over its bandwidth quota (%d bytes used)", used))
+		case !overQuota && instance.Status == models.ProxyStatusQuotaExceeded:
+			instance.Status = models.ProxyStatusRunning
+			m.metrics.event(instance, eventQuotaReset)
+			m.emit(models.ProxyEventHealthPassed, instance, "bandwidth quota was reset")
+		}
+		
+		if r.status != nil {
+			instance.Metrics = models.ProxyMetrics{
+				RequestsTotal:    r.status.RequestsTotal,
+				BytesTransmitted: r.status.BytesSent + r.status.BytesReceived,
+				ErrorCount:       r.status.ErrorsTotal,
+				LastRequest:      r.status.LastRequest,
+			}
+		}
+		if r.usage != nil {
+			instance.Metrics = *r.usage
+		}
+		m.metrics.record(instance, r.err == nil, r.status)
+	}
+	m.metrics.publish()
+}
+
+// portHeld reports whether an instance in status keeps its port. Starting
+// instances are warming up.
+func portHeld(status models.ProxyStatus) bool {
+	return status == models.ProxyStatusRunning || status == models.ProxyStatusQuotaExceeded || status == models.ProxyStatusPaused || status == models.ProxyStatusStarting
+}
+
+// releasePortLocked makes getNextPort hand out port again first, once the
+// instance it was taken for failed to start.
+func (m *Manager) releasePortLocked(port int) {
+	if port >= m.startPort && port < m.currentPort {
+		m.currentPort = port
+	}
+}
+
 func (m *Manager) getNextPort() int {
 	for i := m.currentPort; i <= m.endPort; i++ {
 		portInUse := false
 		for _, instance := range m.instances {
-			if instance.Port == i && instance.Status == models.ProxyStatusRunning {
+			if instance.Port == i && portHeld(instance.Status) {
 				portInUse = true
 				break
 			}
@@ -226,7 +740,7 @@ func (m *Manager) getNextPort() int {
 	for i := m.startPort; i < m.currentPort; i++ {
 		portInUse := false
 		for _, instance := range m.instances {
-			if instance.Port == i && instance.Status == models.ProxyStatusRunning {
+			if instance.Port == i && portHeld(instance.Status) {
 				portInUse = true
 				break
 			}
@@ -240,89 +754,47 @@ func (m *Manager) getNextPort() int {
 	return 0
 }
 
-func (m *Manager) createTinyproxyConfig(path, bindIP string, port int) error {
-	// Build Allow directives based on access control mode
-	allowDirectives := ""
-	
-	// Always allow localhost connections for health checks
-	allowDirectives += "Allow 127.0.0.1\n"
-	allowDirectives += "Allow ::1\n"
-	
-	// Also allow connections from the same IPv6 address (for health checks)
-	allowDirectives += fmt.Sprintf("Allow %s\n", bindIP)
-	
-	if m.proxyMode == "restricted" && len(m.allowedIPs) > 0 {
-		// In restricted mode, only allow specified IPs
-		for _, ip := range m.allowedIPs {
-			allowDirectives += fmt.Sprintf("Allow %s\n", ip)
-		}
-	} else if m.proxyMode == "open" {
-		// In open mode, allow all (use with caution!)
-		allowDirectives += "Allow 0.0.0.0/0\nAllow ::/0"
-	}
-	// If restricted mode but no IPs, only localhost and bindIP are allowed
-	
-	config := fmt.Sprintf(`# Basic Configuration
-Port %d
-Listen %s
-
-# Server Configuration  
-MaxClients 100
-MinSpareServers 5
-MaxSpareServers 20
-StartServers 10
-MaxRequestsPerChild 10000
-
-# Access Control
-%s
-
-# Logging
-LogLevel Info
-LogFile "/tmp/tinyproxy-%s-%d.log"
-PidFile "/tmp/tinyproxy-%s-%d.pid"
-
-# Proxy Configuration
-ViaProxyName "proxy-v6"
-DisableViaHeader No
-Timeout 600
-
-# Performance
-ConnectPort 443
-ConnectPort 563
-ConnectPort 993
-ConnectPort 995
-ConnectPort 80
-ConnectPort 8080
-ConnectPort 8443
-`, port, bindIP, allowDirectives, bindIP, port, bindIP, port)
-	
-	return os.WriteFile(path, []byte(config), 0644)
-}
-
-func (m *Manager) checkProxyHealth(ip string, port int) bool {
-	// Simple TCP connection test to avoid generating errors in tinyproxy logs
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("[%s]:%d", ip, port), 3*time.Second)
-	if err != nil {
-		return false
-	}
-	defer conn.Close()
-	return true
-}
-
-func (m *Manager) monitorProcess(instanceID string, cmd *exec.Cmd) {
-	if err := cmd.Wait(); err != nil {
+func (m *Manager) monitorBackend(instanceID string, b ProxyBackend) {
+	if err := <-b.Wait(); err != nil {
 		m.logger.Warnf("Process exited with error for %s: %v", instanceID, err)
 	}
 	
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
+	// The instance was stopped or restarted with a new backend
+	if m.running[instanceID] != b {
+		return
+	}
+	
 	if instance, exists := m.instances[instanceID]; exists {
-		if instance.Status == models.ProxyStatusRunning {
+		if !m.shuttingDown && (instance.Status == models.ProxyStatusRunning || instance.Status == models.ProxyStatusQuotaExceeded) {
 			instance.Status = models.ProxyStatusError
-			m.logger.Errorf("Proxy process died unexpectedly: %s", instanceID)
+			m.metrics.event(instance, eventDied)
+			m.emit(models.ProxyEventDied, instance, "process died unexpectedly")
+			m.runHooksAsync(HookOnError, instance, fmt.Errorf("process died unexpectedly"))
 		}
+		stoppedAt := time.Now()
+		instance.StoppedAt = &stoppedAt
 	}
 	
-	delete(m.processes, instanceID)
-}
\ No newline at end of file
+	delete(m.running, instanceID)
+	m.saveStateLocked()
+}
+
+// IsNoStatusEndpoint reports whether err means the instance's backend does
+// not serve a status endpoint.
+func IsNoStatusEndpoint(err error) bool {
+	return errors.Is(err, errNoStatusEndpoint)
+}
+
+// IsNotFound reports whether err is from an unknown instance ID.
+func IsNotFound(err error) bool {
+	return errors.Is(err, errInstanceNotFound)
+}
+
+// IsPortInUse reports whether err is from starting an instance on a port
+// another instance already serves.
+func IsPortInUse(err error) bool {
+	return errors.Is(err, errPortInUse)
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// PauseInterface takes every started instance on iface out of health
+// checking while the interface has no link, so a flap does not turn them
+// into errors. Paused instances keep their backend and port. It returns the
+// IDs of the instances it paused.
+func (m *Manager) PauseInterface(iface string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var paused []string
+	for id, instance := range m.instances {
+		if instance.IPv6.Interface != iface || instance.Status == models.ProxyStatusStopped || instance.Status == models.ProxyStatusPaused {
+			continue
+		}
+		instance.Status = models.ProxyStatusPaused
+		m.metrics.event(instance, eventPaused)
+		m.emit(models.ProxyEventDegraded, instance, "interface "+iface+" lost its link")
+		paused = append(paused, id)
+	}
+	sort.Strings(paused)
+	return paused
+}
+
+// PausedOn returns the instances paused on iface.
+func (m *Manager) PausedOn(iface string) []models.ProxyInstance {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var paused []models.ProxyInstance
+	for _, instance := range m.instances {
+		if instance.IPv6.Interface == iface && instance.Status == models.ProxyStatusPaused {
+			paused = append(paused, *instance)
+		}
+	}
+	sort.Slice(paused, func(i, j int) bool { return paused[i].ID < paused[j].ID })
+	return paused
+}
+
+// ResumeProxy returns a paused instance to service once its address is back
+// on the interface. One that still answers its health check carries on as
+// it was; one whose backend died or no longer answers is rebuilt on the
+// same address and port.
+func (m *Manager) ResumeProxy(ctx context.Context, instanceID string) (instance *models.ProxyInstance, err error) {
+	// Runs after the unlock below: a rebuilt instance is warmed up
+	defer func() { instance, err = m.finishStart(ctx, instance, err) }()
+	m.mu.RLock()
+	instance, exists := m.instances[instanceID]
+	if !exists {
+		m.mu.RUnlock()
+		return nil, fmt.Errorf("%w: %s", errInstanceNotFound, instanceID)
+	}
+	b, running := m.running[instanceID]
+	m.mu.RUnlock()
+
+	var checkErr error
+	if running {
+		checkErr = b.HealthCheck()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if instance.Status != models.ProxyStatusPaused {
+		return instance, nil
+	}
+	if running && checkErr == nil && m.running[instanceID] == b {
+		instance.Status = models.ProxyStatusRunning
+		instance.LastChecked = time.Now()
+		m.metrics.event(instance, eventResumed)
+		m.emit(models.ProxyEventHealthPassed, instance, "")
+		return instance, nil
+	}
+
+	if checkErr != nil {
+		m.logger.Infof("Rebuilding proxy %s, it does not answer since its interface came back: %v", instanceID, checkErr)
+	} else {
+		m.logger.Infof("Rebuilding proxy %s, its backend exited while it was paused", instanceID)
+	}
+	old, err := m.stopProxyLocked(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return m.relaunchLocked(ctx, old, old.IPv6)
+}
+
+// FailPaused gives up on a paused instance whose address did not come
+// back, marking it failed like a failed health check would.
+func (m *Manager) FailPaused(instanceID string, reason error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	instance, exists := m.instances[instanceID]
+	if !exists || instance.Status != models.ProxyStatusPaused {
+		return
+	}
+	instance.Status = models.ProxyStatusError
+	m.metrics.event(instance, eventFailed)
+	m.emit(models.ProxyEventDegraded, instance, reason.Error())
+	m.runHooksAsync(HookOnError, instance, reason)
+}
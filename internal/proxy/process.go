@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adoptedPollInterval is how often a process taken over from an earlier
+// agent is checked for having exited.
+const adoptedPollInterval = time.Second
+
+// processBackend runs an instance as an external proxy process with a
+// generated config file. Tinyproxy and 3proxy differ only in their config
+// format and command line.
+type processBackend struct {
+	logger     *logrus.Logger
+	label      string
+	binary     string
+	args       func(configPath string) []string
+	render     func(cfg InstanceConfig) string
+	cfg        InstanceConfig
+	configPath string
+	logPath    string
+	parseLog   logParser // reads usage from the log at logPath, when set
+	usage      logUsage
+	cmd        *exec.Cmd
+	adopted    *os.Process // set instead of cmd for a process taken over
+	exited     chan struct{}
+	done       chan error
+	mu         sync.Mutex
+}
+
+func (b *processBackend) Start(ctx context.Context) error {
+	if err := b.writeConfig(b.cfg); err != nil {
+		return fmt.Errorf("failed to create config: %w", err)
+	}
+	b.logger.Debugf("Created config file: %s", b.configPath)
+
+	var tailer *logTailer
+	if b.parseLog != nil {
+		tailer = newLogTailer(b.logPath, b.parseLog, &b.usage)
+	}
+
+	cmd := exec.CommandContext(ctx, b.binary, b.args(b.configPath)...)
+
+	// Capture stdout and stderr for debugging
+	stdoutPipe, _ := cmd.StdoutPipe()
+	stderrPipe, _ := cmd.StderrPipe()
+
+	if err := cmd.Start(); err != nil {
+		if output, _ := os.ReadFile(b.configPath); len(output) > 0 {
+			b.logger.Debugf("Config file contents:\n%s", string(output))
+		}
+		return err
+	}
+	b.cmd = cmd
+
+	go b.pipeOutput(stdoutPipe, "stdout", b.logger.Infof)
+	go b.pipeOutput(stderrPipe, "stderr", b.logger.Warnf)
+	if tailer != nil {
+		go tailer.run(b.exited)
+	}
+
+	go func() {
+		err := cmd.Wait()
+		close(b.exited)
+		b.done <- err
+	}()
+	return nil
+}
+
+// adopt takes over the process pid, which an earlier agent started for
+// this instance. It is not a child of this agent, so its exit is noticed by
+// polling rather than waiting.
+func (b *processBackend) adopt(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Signal(syscall.Signal(0)); err != nil {
+		return fmt.Errorf("process %d: %w", pid, err)
+	}
+	b.adopted = process
+
+	if b.parseLog != nil {
+		go newLogTailer(b.logPath, b.parseLog, &b.usage).run(b.exited)
+	}
+	go func() {
+		for process.Signal(syscall.Signal(0)) == nil {
+			time.Sleep(adoptedPollInterval)
+		}
+		close(b.exited)
+		b.done <- nil
+	}()
+	return nil
+}
+
+// process returns the running process, started or adopted, or nil.
+func (b *processBackend) process() *os.Process {
+	if b.cmd != nil {
+		return b.cmd.Process
+	}
+	return b.adopted
+}
+
+// pid returns the process ID, or 0 before the process started.
+func (b *processBackend) pid() int {
+	if p := b.process(); p != nil {
+		return p.Pid
+	}
+	return 0
+}
+
+func (b *processBackend) pipeOutput(pipe interface{ Read([]byte) (int, error) }, stream string, logf func(string, ...interface{})) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := pipe.Read(buf)
+		if err != nil {
+			break
+		}
+		if n > 0 {
+			logf("%s[%s] %s: %s", b.label, b.config().ID, stream, string(buf[:n]))
+		}
+	}
+}
+
+func (b *processBackend) Stop() error {
+	p := b.process()
+	if p == nil {
+		return nil
+	}
+	return p.Kill()
+}
+
+// Reload rewrites the config and asks the process to re-read it; both
+// tinyproxy and 3proxy reload on SIGUSR1.
+func (b *processBackend) Reload(cfg InstanceConfig) error {
+	if err := b.writeConfig(cfg); err != nil {
+		return fmt.Errorf("failed to rewrite config: %w", err)
+	}
+	p := b.process()
+	if p == nil {
+		return nil
+	}
+	return p.Signal(syscall.SIGUSR1)
+}
+
+func (b *processBackend) HealthCheck() error {
+	select {
+	case <-b.exited:
+		return errProcessExited
+	default:
+	}
+	cfg := b.config()
+	return dialCheck(cfg.BindIP, cfg.Port)
+}
+
+func (b *processBackend) ConfigPath() string {
+	return b.configPath
+}
+
+func (b *processBackend) Wait() <-chan error {
+	return b.done
+}
+
+// LogPath is the log file the process writes.
+func (b *processBackend) LogPath() string {
+	return b.logPath
+}
+
+// Usage returns the traffic counted from the instance's log since it
+// started, or false when the backend's log is not parsed.
+func (b *processBackend) Usage() (models.ProxyMetrics, bool) {
+	if b.parseLog == nil {
+		return models.ProxyMetrics{}, false
+	}
+	return b.usage.metrics(), true
+}
+
+// logContents returns the instance's log file for startup diagnostics.
+func (b *processBackend) logContents() string {
+	content, err := os.ReadFile(b.logPath)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+func (b *processBackend) writeConfig(cfg InstanceConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg = cfg
+	return os.WriteFile(b.configPath, []byte(b.render(cfg)), 0644)
+}
+
+func (b *processBackend) config() InstanceConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Quota reset schedules. Periods start on UTC boundaries: the hour, midnight,
+// Monday midnight or the first of the month.
+const (
+	QuotaResetHourly  = "hourly"
+	QuotaResetDaily   = "daily"
+	QuotaResetWeekly  = "weekly"
+	QuotaResetMonthly = "monthly"
+)
+
+// quotaTracker adds up the bytes each egress IP carried in the current
+// period. Usage is kept per IP rather than per instance, so restarting an
+// instance or serving SOCKS5 next to HTTP on the same address does not get
+// a fresh allowance.
+type quotaTracker struct {
+	limit       int64 // bytes per egress IP and period; 0 = no quota
+	reset       string
+	periodStart time.Time
+	used        map[string]int64 // egress IP -> bytes this period
+	counted     map[string]int64 // instance ID -> cumulative bytes already added
+	mu          sync.Mutex
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		reset:   QuotaResetDaily,
+		used:    make(map[string]int64),
+		counted: make(map[string]int64),
+	}
+}
+
+// SetQuota caps the bytes each egress IP may carry per period (0 turns the
+// quota off). reset is one of the QuotaReset schedules. Only instances that
+// report byte counts, the embedded engine and SOCKS5, are accounted.
+func (m *Manager) SetQuota(limitBytes int64, reset string) error {
+	if limitBytes < 0 {
+		return fmt.Errorf("quota must not be negative")
+	}
+	if reset == "" {
+		reset = QuotaResetDaily
+	}
+	switch reset {
+	case QuotaResetHourly, QuotaResetDaily, QuotaResetWeekly, QuotaResetMonthly:
+	default:
+		return fmt.Errorf("unknown quota reset %q (want %s, %s, %s or %s)", reset, QuotaResetHourly, QuotaResetDaily, QuotaResetWeekly, QuotaResetMonthly)
+	}
+
+	m.quota.mu.Lock()
+	m.quota.limit = limitBytes
+	m.quota.reset = reset
+	m.quota.periodStart = quotaPeriodStart(reset, time.Now())
+	m.quota.mu.Unlock()
+
+	if limitBytes > 0 {
+		m.logger.Infof("Bandwidth quota: %d bytes per egress IP, reset %s", limitBytes, reset)
+		m.mu.RLock()
+		backend := m.backend
+		m.mu.RUnlock()
+		if backend != BackendEmbedded {
+			m.logger.Warnf("%s instances do not report byte counts; the quota only applies to embedded and SOCKS5 instances", backend)
+		}
+	}
+	return nil
+}
+
+// Quota returns the quota and the usage of every egress IP this period.
+func (m *Manager) Quota() models.QuotaStatus {
+	q := m.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollLocked(time.Now())
+
+	status := models.QuotaStatus{
+		LimitBytes:  q.limit,
+		Reset:       q.reset,
+		PeriodStart: q.periodStart,
+		NextReset:   quotaNextPeriod(q.reset, q.periodStart),
+		Usage:       make([]models.QuotaUsage, 0, len(q.used)),
+	}
+	for ip, used := range q.used {
+		status.Usage = append(status.Usage, models.QuotaUsage{
+			IP:        ip,
+			UsedBytes: used,
+			Exceeded:  q.limit > 0 && used >= q.limit,
+		})
+	}
+	sort.Slice(status.Usage, func(i, j int) bool { return status.Usage[i].IP < status.Usage[j].IP })
+	return status
+}
+
+// account adds the bytes instance carried since it was last accounted and
+// returns its egress IP's usage this period and whether that is over quota.
+// status is nil for instances that do not report counters.
+func (q *quotaTracker) account(instance *models.ProxyInstance, status *models.InstanceStatus, now time.Time) (int64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollLocked(now)
+
+	ip := instance.IPv6.IP.String()
+	if status != nil {
+		total := status.BytesSent + status.BytesReceived
+		// Counters start from zero when the instance is started again
+		previous := q.counted[instance.ID]
+		if total < previous {
+			previous = 0
+		}
+		if delta := total - previous; delta > 0 {
+			q.used[ip] += delta
+		}
+		q.counted[instance.ID] = total
+	}
+	used := q.used[ip]
+	return used, q.limit > 0 && used >= q.limit
+}
+
+// forget drops the counter baseline of a stopped instance. Its bytes stay
+// in the IP's usage for the period.
+func (q *quotaTracker) forget(instanceID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.counted, instanceID)
+}
+
+// rollLocked starts a new period once the current one is over. Baselines are
+// kept so traffic from before the reset is not counted again.
+func (q *quotaTracker) rollLocked(now time.Time) {
+	if q.periodStart.IsZero() {
+		q.periodStart = quotaPeriodStart(q.reset, now)
+		return
+	}
+	if now.Before(quotaNextPeriod(q.reset, q.periodStart)) {
+		return
+	}
+	q.periodStart = quotaPeriodStart(q.reset, now)
+	q.used = make(map[string]int64)
+}
+
+func quotaPeriodStart(reset string, now time.Time) time.Time {
+	now = now.UTC()
+	switch reset {
+	case QuotaResetHourly:
+		return now.Truncate(time.Hour)
+	case QuotaResetWeekly:
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return midnight.AddDate(0, 0, -((int(now.Weekday()) + 6) % 7))
+	case QuotaResetMonthly:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func quotaNextPeriod(reset string, start time.Time) time.Time {
+	switch reset {
+	case QuotaResetHourly:
+		return start.Add(time.Hour)
+	case QuotaResetWeekly:
+		return start.AddDate(0, 0, 7)
+	case QuotaResetMonthly:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tcp6Established is the state column of established sockets in
+// /proc/net/tcp6.
+const tcp6Established = "01"
+
+// StopAccepting prepares the instances for shutdown. Those run by the agent
+// stop accepting connections and keep serving the open ones. Process
+// backends cannot do that without exiting and go on accepting. Health
+// checks stop, so instances on their way out are not reported as failed.
+func (m *Manager) StopAccepting() {
+	m.mu.Lock()
+	m.shuttingDown = true
+	backends := make([]ProxyBackend, 0, len(m.running))
+	for _, b := range m.running {
+		backends = append(backends, b)
+	}
+	m.mu.Unlock()
+
+	for _, b := range backends {
+		if d, ok := b.(drainingBackend); ok {
+			d.StopAccepting()
+		}
+	}
+}
+
+// ActiveConnections counts the client connections still open on all
+// running instances. Process backends are counted from the established
+// sockets on their address and port.
+func (m *Manager) ActiveConnections() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var total int64
+	var established map[string]int64
+	for id, b := range m.running {
+		if d, ok := b.(drainingBackend); ok {
+			total += d.ActiveConnections()
+			continue
+		}
+		if established == nil {
+			var err error
+			if established, err = establishedConnections(); err != nil {
+				m.logger.Debugf("Failed to count connections of process backends: %v", err)
+				established = map[string]int64{}
+			}
+		}
+		instance := m.instances[id]
+		total += established[fmt.Sprintf("[%s]:%d", instance.IPv6.IP, instance.Port)]
+	}
+	return total
+}
+
+// establishedConnections counts the established TCP connections on each
+// local IPv6 address and port.
+func establishedConnections() (map[string]int64, error) {
+	data, err := os.ReadFile("/proc/net/tcp6")
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[1:] {
+		// sl local_address rem_address st ...
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != tcp6Established {
+			continue
+		}
+		hexIP, hexPort, ok := strings.Cut(fields[1], ":")
+		raw, err := hex.DecodeString(hexIP)
+		if !ok || err != nil || len(raw) != net.IPv6len {
+			continue
+		}
+		port, err := strconv.ParseUint(hexPort, 16, 16)
+		if err != nil {
+			continue
+		}
+		// Four 32-bit words, each in host (little-endian) byte order
+		ip := make(net.IP, net.IPv6len)
+		for word := 0; word < 4; word++ {
+			for i := 0; i < 4; i++ {
+				ip[word*4+i] = raw[word*4+3-i]
+			}
+		}
+		counts[fmt.Sprintf("[%s]:%d", ip, port)]++
+	}
+	return counts, nil
+}
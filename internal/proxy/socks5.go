@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksUserPassVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyCommandUnsupported = 0x07
+	socksReplyAddressUnsupported = 0x08
+	socksHandshakeTimeout        = 10 * time.Second
+)
+
+// socksServer is an in-process SOCKS5 proxy (RFC 1928, CONNECT only)
+// bound to one IPv6 address, dialing out from the same address.
+type socksServer struct {
+	logger   *logrus.Logger
+	id       string
+	bindIP   net.IP
+	port     int
+	access   *accessList
+	dialer   *net.Dialer
+	listener net.Listener
+	slots    chan struct{}
+	counters *instanceCounters
+	conns    map[net.Conn]struct{}
+	done     chan error
+	stopped  chan struct{} // closed by stop
+	stopOnce sync.Once
+	closed   bool
+	refusing bool // the listener was closed by stopAccepting
+	mu       sync.Mutex
+}
+
+func newSOCKSServer(logger *logrus.Logger, id string, bindIP net.IP, port int, access *accessList) *socksServer {
+	return &socksServer{
+		logger: logger,
+		id:     id,
+		bindIP: bindIP,
+		port:   port,
+		access: access,
+		dialer: &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: bindIP},
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		slots:    make(chan struct{}, embeddedMaxClients),
+		counters: newInstanceCounters(),
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan error, 1),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (s *socksServer) start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("[%s]:%d", s.bindIP, s.port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	go s.serve()
+	return nil
+}
+
+func (s *socksServer) wait() <-chan error {
+	return s.done
+}
+
+func (s *socksServer) stats() *instanceCounters {
+	return s.counters
+}
+
+func (s *socksServer) stopAccepting() {
+	s.mu.Lock()
+	s.refusing = true
+	s.mu.Unlock()
+	s.listener.Close()
+}
+
+func (s *socksServer) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+		s.mu.Lock()
+		s.closed = true
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		s.listener.Close()
+	})
+}
+
+func (s *socksServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed, refusing := s.closed, s.refusing
+			s.mu.Unlock()
+			if refusing && !closed {
+				// Tunnels still open are served until stop
+				<-s.stopped
+				closed = true
+			}
+			if closed {
+				err = nil
+			}
+			s.done <- err
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socksServer) track(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+	return true
+}
+
+func (s *socksServer) handle(client net.Conn) {
+	defer client.Close()
+	if !s.track(client, true) {
+		return
+	}
+	defer s.track(client, false)
+
+	if !s.access.permitted(client.RemoteAddr().String()) {
+		atomic.AddInt64(&s.counters.denied, 1)
+		s.logger.Warnf("SOCKS5[%s] denied connection from %s", s.id, client.RemoteAddr())
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		atomic.AddInt64(&s.counters.rejected, 1)
+		return
+	}
+
+	client.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := s.handshake(client)
+	if err != nil {
+		s.logger.Debugf("SOCKS5[%s] handshake with %s failed: %v", s.id, client.RemoteAddr(), err)
+		return
+	}
+
+	defer s.counters.begin(true)()
+
+	upstream, err := s.dialer.Dial("tcp", target)
+	if err != nil {
+		atomic.AddInt64(&s.counters.errors, 1)
+		s.logger.Debugf("SOCKS5[%s] connect to %s failed: %v", s.id, target, err)
+		writeSOCKSReply(client, dialErrorReply(err), nil)
+		return
+	}
+	defer upstream.Close()
+
+	if err := writeSOCKSReply(client, socksReplySucceeded, upstream.LocalAddr()); err != nil {
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	s.counters.relay(client, upstream)
+}
+
+// handshake negotiates the auth method and reads the request, returning
+// the host:port to connect to.
+func (s *socksServer) handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	// Username/password (RFC 1929) is the only method offered when the
+	// instance has credentials
+	want := byte(socksMethodNoAuth)
+	if s.access.requiresAuth() {
+		want = socksMethodUserPass
+	}
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodNoAcceptable {
+		return "", errors.New("no acceptable auth method")
+	}
+	if method == socksMethodUserPass {
+		if err := s.authenticate(conn); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksReplyCommandUnsupported, nil)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4:
+		addr := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case socksAddrIPv6:
+		addr := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSOCKSReply(conn, socksReplyAddressUnsupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// authenticate runs the RFC 1929 username/password sub-negotiation.
+func (s *socksServer) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksUserPassVersion {
+		return fmt.Errorf("unsupported auth version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if !s.access.authorized(string(username), string(password)) {
+		atomic.AddInt64(&s.counters.denied, 1)
+		conn.Write([]byte{socksUserPassVersion, 0x01})
+		return errors.New("invalid credentials")
+	}
+	_, err := conn.Write([]byte{socksUserPassVersion, 0x00})
+	return err
+}
+
+// writeSOCKSReply sends a reply with bound as BND.ADDR (zeros when nil).
+func writeSOCKSReply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0x00}
+	ip := net.IPv4zero
+	port := 0
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcp.IP, tcp.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socksAddrIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socksAddrIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+func dialErrorReply(err error) byte {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return socksReplyConnectionRefused
+		}
+		return socksReplyHostUnreachable
+	}
+	return socksReplyGeneralFailure
+}
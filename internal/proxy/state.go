@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// DefaultStateFile is where the agent records its running instances unless
+// told otherwise.
+const DefaultStateFile = "/tmp/proxy-v6-agent-state.json"
+
+// leftoverExitTimeout bounds the wait for a stopped leftover process to exit.
+const leftoverExitTimeout = 5 * time.Second
+
+// instanceState is what the state file records about a running instance:
+// enough to find its process again and serve it under the same ID and
+// credentials.
+type instanceState struct {
+	ID         string               `json:"id"`
+	IPv6       models.IPv6Address   `json:"ipv6"`
+	Port       int                  `json:"port"`
+	Protocol   models.ProxyProtocol `json:"protocol"`
+	Backend    string               `json:"backend"`
+	PID        int                  `json:"pid,omitempty"` // external processes only
+	ConfigPath string               `json:"config_path,omitempty"`
+	Username   string               `json:"username,omitempty"`
+	Password   string               `json:"password,omitempty"`
+	StartedAt  time.Time            `json:"started_at"`
+}
+
+type agentState struct {
+	Instances []instanceState `json:"instances"`
+}
+
+// SetStateFile records the running instances in path from now on, so an
+// agent restarted after a crash can find the processes this one started.
+// An empty path turns the state file off.
+func (m *Manager) SetStateFile(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stateFile = path
+}
+
+// RestoreState reads the state file left by an earlier agent and deals
+// with the proxy processes it lists that are still running. With adopt,
+// those on one of addresses and run by the configured backend are taken
+// over as they are and returned; every other one is stopped. In-process
+// instances died with the earlier agent and are left to be started again.
+func (m *Manager) RestoreState(addresses []models.IPv6Address, adopt bool) ([]models.ProxyInstance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stateFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(m.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state agentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", m.stateFile, err)
+	}
+
+	adopted := make([]models.ProxyInstance, 0)
+	for _, st := range state.Instances {
+		if st.PID <= 0 || !processRunning(st.PID, st.ConfigPath) {
+			continue
+		}
+		if !adopt || st.Backend != m.backend || !hasAddress(addresses, st.IPv6) || st.Port < m.startPort || st.Port > m.endPort {
+			m.killLeftover(st)
+			continue
+		}
+		instance, err := m.adoptLocked(st)
+		if err != nil {
+			m.logger.Warnf("Could not adopt proxy %s: %v", st.ID, err)
+			m.killLeftover(st)
+			continue
+		}
+		adopted = append(adopted, *instance)
+	}
+	m.saveStateLocked()
+
+	if len(adopted) > 0 {
+		m.logger.Infof("Adopted %d proxy processes left running by an earlier agent", len(adopted))
+	}
+	return adopted, nil
+}
+
+// adoptLocked serves st's process as a running instance again. Its config
+// is rewritten and reloaded, in case access control changed meanwhile.
+func (m *Manager) adoptLocked(st instanceState) (*models.ProxyInstance, error) {
+	if m.proxyAuth && st.Username != "" {
+		c := credentials{username: st.Username, password: st.Password}
+		if m.authUsername != "" {
+			c.username = m.authUsername
+		}
+		if m.authPassword != "" {
+			c.password = m.authPassword
+		}
+		m.credentials[st.ID] = c
+	}
+	cfg := m.instanceConfig(st.ID, st.IPv6, st.Port)
+	b, ok := backends[m.backend].newBackend(m.logger, cfg).(*processBackend)
+	if !ok {
+		return nil, fmt.Errorf("the %s backend does not run processes", m.backend)
+	}
+	if err := b.adopt(st.PID); err != nil {
+		return nil, err
+	}
+	if err := b.Reload(cfg); err != nil {
+		return nil, fmt.Errorf("failed to reload: %w", err)
+	}
+	if err := b.HealthCheck(); err != nil {
+		return nil, fmt.Errorf("failed health check: %w", err)
+	}
+
+	instance := &models.ProxyInstance{
+		ID:          st.ID,
+		IPv6:        st.IPv6,
+		Port:        st.Port,
+		Status:      models.ProxyStatusRunning,
+		StartedAt:   st.StartedAt,
+		LastChecked: time.Now(),
+		Protocol:    st.Protocol,
+		Backend:     m.backend,
+		ConfigPath:  b.ConfigPath(),
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	}
+	m.instanceLabelsLocked(st.ID, st.IPv6, st.Port, st.Protocol).apply(instance)
+	m.instances[st.ID] = instance
+	m.running[st.ID] = b
+	go m.monitorBackend(st.ID, b)
+
+	m.logger.Infof("Adopted %s process %d for proxy %s", m.backend, st.PID, st.ID)
+	m.metrics.event(instance, eventAdopted)
+	m.emit(models.ProxyEventCreated, instance, "adopted from an earlier agent")
+	m.emit(models.ProxyEventHealthPassed, instance, "")
+	return instance, nil
+}
+
+// killLeftover stops a process an earlier agent left running and removes
+// its config file. It waits a moment for the process to go, so its port is
+// free for the instance started in its place.
+func (m *Manager) killLeftover(st instanceState) {
+	if p, err := os.FindProcess(st.PID); err == nil {
+		if err := p.Kill(); err != nil {
+			m.logger.Warnf("Failed to stop leftover process %d of proxy %s: %v", st.PID, st.ID, err)
+			return
+		}
+		deadline := time.Now().Add(leftoverExitTimeout)
+		for p.Signal(syscall.Signal(0)) == nil && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if st.ConfigPath != "" {
+		os.Remove(st.ConfigPath)
+	}
+	m.logger.Infof("Stopped leftover %s process %d of proxy %s", st.Backend, st.PID, st.ID)
+}
+
+// saveStateLocked writes the running instances to the state file. It is
+// written to a temporary file and renamed, so a crash mid-write leaves the
+// previous state.
+func (m *Manager) saveStateLocked() {
+	if m.stateFile == "" {
+		return
+	}
+
+	state := agentState{Instances: make([]instanceState, 0, len(m.running))}
+	for id, b := range m.running {
+		instance, ok := m.instances[id]
+		if !ok {
+			continue
+		}
+		st := instanceState{
+			ID:         id,
+			IPv6:       instance.IPv6,
+			Port:       instance.Port,
+			Protocol:   instance.Protocol,
+			Backend:    instance.Backend,
+			ConfigPath: instance.ConfigPath,
+			Username:   instance.Username,
+			Password:   instance.Password,
+			StartedAt:  instance.StartedAt,
+		}
+		if p, ok := b.(*processBackend); ok {
+			st.PID = p.pid()
+		}
+		state.Instances = append(state.Instances, st)
+	}
+	sort.Slice(state.Instances, func(i, j int) bool { return state.Instances[i].ID < state.Instances[j].ID })
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		// Credentials are in the file, keep it to ourselves
+		tmp := filepath.Join(filepath.Dir(m.stateFile), "."+filepath.Base(m.stateFile)+".tmp")
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, m.stateFile)
+		}
+	}
+	if err != nil {
+		m.logger.Warnf("Failed to write state file %s: %v", m.stateFile, err)
+	}
+}
+
+// processRunning reports whether pid is alive and still the process
+// started with configPath, not an unrelated one that reused the PID.
+func processRunning(pid int, configPath string) bool {
+	cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return false
+	}
+	return configPath != "" && strings.Contains(string(cmdline), configPath)
+}
+
+func hasAddress(addresses []models.IPv6Address, ipv6 models.IPv6Address) bool {
+	for _, addr := range addresses {
+		if addr.IP.Equal(ipv6.IP) {
+			return true
+		}
+	}
+	return false
+}
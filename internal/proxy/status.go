@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	instanceHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_instance_healthy",
+		Help: "Whether the proxy instance passed its last health check",
+	}, []string{"instance", "protocol"})
+	instanceActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_instance_active_connections",
+		Help: "Client connections currently open on a native proxy instance",
+	}, []string{"instance", "protocol"})
+	instanceRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_instance_requests",
+		Help: "Requests and tunnels handled by a native proxy instance since it started",
+	}, []string{"instance", "protocol"})
+	instanceBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_instance_bytes",
+		Help: "Bytes relayed by a native proxy instance since it started",
+	}, []string{"instance", "protocol", "direction"})
+	instanceErrors = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_v6_instance_errors",
+		Help: "Failed upstream requests and dials on a native proxy instance since it started",
+	}, []string{"instance", "protocol"})
+	// Events are counted per node rather than per instance: rotation keeps
+	// replacing instances, and a counter per departed instance would stay.
+	instanceEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_instance_events_total",
+		Help: "Instance lifecycle events (started, start_failed, stopped, failed, recovered, died, quota_exceeded, quota_reset)",
+	}, []string{"node", "protocol", "event"})
+)
+
+// instanceCounters are updated by in-process servers as they handle
+// traffic and served on the instance's status endpoint.
+type instanceCounters struct {
+	started     time.Time
+	active      int64
+	requests    int64
+	connects    int64
+	bytesSent   int64 // to clients
+	bytesRecv   int64 // from clients
+	errors      int64
+	denied      int64
+	rejected    int64 // over the client limit
+	lastRequest int64 // unix nanoseconds
+}
+
+func newInstanceCounters() *instanceCounters {
+	return &instanceCounters{started: time.Now()}
+}
+
+// begin records a new client request or tunnel and returns a function to
+// call when it is done.
+func (c *instanceCounters) begin(connect bool) func() {
+	atomic.AddInt64(&c.requests, 1)
+	if connect {
+		atomic.AddInt64(&c.connects, 1)
+	}
+	atomic.StoreInt64(&c.lastRequest, time.Now().UnixNano())
+	atomic.AddInt64(&c.active, 1)
+	return func() { atomic.AddInt64(&c.active, -1) }
+}
+
+// relay copies between client and upstream until both directions are done,
+// counting the bytes each way.
+func (c *instanceCounters) relay(client, upstream net.Conn) {
+	errc := make(chan error, 2)
+	go func() {
+		n, err := io.Copy(upstream, client)
+		atomic.AddInt64(&c.bytesRecv, n)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		errc <- err
+	}()
+	go func() {
+		n, err := io.Copy(client, upstream)
+		atomic.AddInt64(&c.bytesSent, n)
+		errc <- err
+	}()
+	<-errc
+	<-errc
+}
+
+func (c *instanceCounters) snapshot(id string, protocol models.ProxyProtocol) models.InstanceStatus {
+	status := models.InstanceStatus{
+		ID:                id,
+		Protocol:          protocol,
+		UptimeSeconds:     time.Since(c.started).Seconds(),
+		ActiveConnections: atomic.LoadInt64(&c.active),
+		RequestsTotal:     atomic.LoadInt64(&c.requests),
+		ConnectsTotal:     atomic.LoadInt64(&c.connects),
+		BytesSent:         atomic.LoadInt64(&c.bytesSent),
+		BytesReceived:     atomic.LoadInt64(&c.bytesRecv),
+		ErrorsTotal:       atomic.LoadInt64(&c.errors),
+		DeniedTotal:       atomic.LoadInt64(&c.denied),
+		RejectedTotal:     atomic.LoadInt64(&c.rejected),
+	}
+	if last := atomic.LoadInt64(&c.lastRequest); last > 0 {
+		status.LastRequest = time.Unix(0, last)
+	}
+	return status
+}
+
+// statusServer is a native instance's loopback-only HTTP endpoint: GET
+// /health answers 200 while the proxy is serving and GET /status returns
+// its counters.
+type statusServer struct {
+	id       string
+	protocol models.ProxyProtocol
+	counters *instanceCounters
+	serving  func() bool
+	server   *http.Server
+	listener net.Listener
+}
+
+func newStatusServer(id string, protocol models.ProxyProtocol, counters *instanceCounters, serving func() bool) *statusServer {
+	s := &statusServer{id: id, protocol: protocol, counters: counters, serving: serving}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/status", s.handleStatus)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	return s
+}
+
+// start listens on an ephemeral loopback port.
+func (s *statusServer) start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	go s.server.Serve(listener)
+	return nil
+}
+
+func (s *statusServer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+func (s *statusServer) url() string {
+	return fmt.Sprintf("http://%s", s.listener.Addr())
+}
+
+func (s *statusServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !s.serving() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *statusServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.counters.snapshot(s.id, s.protocol)
+	status.Healthy = s.serving()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+var statusClient = &http.Client{Timeout: 3 * time.Second}
+
+// fetchStatus reads a native instance's counters from its status endpoint.
+func fetchStatus(statusURL string) (models.InstanceStatus, error) {
+	var status models.InstanceStatus
+	resp, err := statusClient.Get(statusURL + "/status")
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("status endpoint returned %d", resp.StatusCode)
+	}
+	return status, nil
+}
+
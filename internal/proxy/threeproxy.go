@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// threeproxyMaxClients is the maxconn setting written to every instance.
+const threeproxyMaxClients = 100
+
+func new3proxyBackend(logger *logrus.Logger, cfg InstanceConfig) ProxyBackend {
+	return &processBackend{
+		logger:     logger,
+		label:      "3proxy",
+		binary:     "3proxy",
+		args:       func(configPath string) []string { return []string{configPath} },
+		render:     threeproxyConfig,
+		cfg:        cfg,
+		configPath: fmt.Sprintf("/tmp/3proxy-%s.cfg", cfg.ID),
+		logPath:    fmt.Sprintf("/tmp/3proxy-%s-%d.log", cfg.BindIP, cfg.Port),
+		exited:     make(chan struct{}),
+		done:       make(chan error, 1),
+	}
+}
+
+// threeproxyConfig runs a single HTTP proxy service that listens on and
+// connects out from the bind address, with the same access rules and
+// CONNECT ports as the tinyproxy backend.
+func threeproxyConfig(cfg InstanceConfig) string {
+	bindIP := cfg.BindIP.String()
+
+	sources := "*"
+	if !cfg.open() {
+		// Loopback and the bind address are always allowed for health checks
+		list := []string{"127.0.0.1", "::1", bindIP}
+		if cfg.Mode == "restricted" {
+			list = append(list, cfg.AllowedIPs...)
+		}
+		sources = strings.Join(list, ",")
+	}
+	users, auth := "*", "auth iponly"
+	if cfg.authenticated() {
+		users, auth = cfg.Username, fmt.Sprintf("users %s:CL:%s\nauth strong", cfg.Username, cfg.Password)
+	}
+	acl := strings.Join([]string{
+		auth,
+		fmt.Sprintf("allow %s %s * %s HTTPS", users, sources, strings.Join(connectPortList, ",")),
+		fmt.Sprintf("allow %s %s * * HTTP", users, sources),
+		"deny *",
+	}, "\n")
+
+	return fmt.Sprintf(`# Generated by proxy-v6
+log /tmp/3proxy-%s-%d.log
+logformat "L%%t %%N.%%p %%E %%U %%C:%%c %%R:%%r %%O %%I %%h %%T"
+maxconn %d
+timeouts 1 5 30 60 180 1800 15 60
+
+%s
+
+proxy -6 -n -p%d -i%s -e%s
+`, bindIP, cfg.Port, threeproxyMaxClients, acl, cfg.Port, bindIP, bindIP)
+}
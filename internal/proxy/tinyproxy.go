@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tinyproxyMaxClients is the MaxClients setting written to every instance.
+const tinyproxyMaxClients = 100
+
+// tinyproxyVersion is a tinyproxy release. The zero value stands for "not
+// detected" and renders the 1.10 config.
+type tinyproxyVersion struct {
+	major, minor, patch int
+}
+
+func (v tinyproxyVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+func (v tinyproxyVersion) atLeast(major, minor int) bool {
+	return v.major > major || v.major == major && v.minor >= minor
+}
+
+// threaded reports whether the release serves clients from threads. 1.11
+// dropped the pre-forking model along with its MinSpareServers,
+// MaxSpareServers, StartServers and MaxRequestsPerChild directives.
+func (v tinyproxyVersion) threaded() bool {
+	return v.atLeast(1, 11)
+}
+
+var (
+	tinyproxyVersionPattern = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+	tinyproxyMu       sync.RWMutex
+	tinyproxyDetected tinyproxyVersion
+)
+
+// checkTinyproxy finds the installed tinyproxy and remembers its version so
+// generated configs use the directives it understands. Releases before
+// 1.10, which lack BasicAuth, and unknown major versions are refused up
+// front instead of dying on their config at every start.
+func checkTinyproxy(logger *logrus.Logger) error {
+	output, err := exec.Command("tinyproxy", "-v").CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("tinyproxy is not installed; install it or use --proxy-backend embedded")
+	}
+	version, ok := parseTinyproxyVersion(string(output))
+	if !ok {
+		if err != nil {
+			return fmt.Errorf("failed to run tinyproxy -v: %w", err)
+		}
+		return fmt.Errorf("cannot tell the tinyproxy version from %q", strings.TrimSpace(string(output)))
+	}
+	if version.major != 1 || !version.atLeast(1, 10) {
+		return fmt.Errorf("tinyproxy %s is not supported; install 1.10 or 1.11, or use --proxy-backend embedded", version)
+	}
+	if version.atLeast(1, 12) {
+		logger.Warnf("tinyproxy %s is newer than the 1.11 this agent was built for, using the 1.11 config", version)
+	} else {
+		logger.Infof("Using tinyproxy %s", version)
+	}
+
+	tinyproxyMu.Lock()
+	tinyproxyDetected = version
+	tinyproxyMu.Unlock()
+	return nil
+}
+
+// parseTinyproxyVersion reads the version from tinyproxy -v output, e.g.
+// "tinyproxy 1.11.1".
+func parseTinyproxyVersion(output string) (tinyproxyVersion, bool) {
+	match := tinyproxyVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return tinyproxyVersion{}, false
+	}
+	var v tinyproxyVersion
+	v.major, _ = strconv.Atoi(match[1])
+	v.minor, _ = strconv.Atoi(match[2])
+	if match[3] != "" {
+		v.patch, _ = strconv.Atoi(match[3])
+	}
+	return v, true
+}
+
+func installedTinyproxy() tinyproxyVersion {
+	tinyproxyMu.RLock()
+	defer tinyproxyMu.RUnlock()
+	return tinyproxyDetected
+}
+
+func newTinyproxyBackend(logger *logrus.Logger, cfg InstanceConfig) ProxyBackend {
+	return &processBackend{
+		logger:     logger,
+		label:      "Tinyproxy",
+		binary:     "tinyproxy",
+		args:       func(configPath string) []string { return []string{"-d", "-c", configPath} },
+		render:     tinyproxyConfig,
+		cfg:        cfg,
+		configPath: fmt.Sprintf("/tmp/tinyproxy-%s.conf", cfg.ID),
+		logPath:    fmt.Sprintf("/tmp/tinyproxy-%s-%d.log", cfg.BindIP, cfg.Port),
+		parseLog:   parseTinyproxyLog,
+		exited:     make(chan struct{}),
+		done:       make(chan error, 1),
+	}
+}
+
+func tinyproxyConfig(cfg InstanceConfig) string {
+	return renderTinyproxyConfig(cfg, installedTinyproxy())
+}
+
+func renderTinyproxyConfig(cfg InstanceConfig, version tinyproxyVersion) string {
+	bindIP := cfg.BindIP.String()
+
+	servers := fmt.Sprintf("MaxClients %d", tinyproxyMaxClients)
+	if !version.threaded() {
+		servers += `
+MinSpareServers 5
+MaxSpareServers 20
+StartServers 10
+MaxRequestsPerChild 10000`
+	}
+
+	// Always allow localhost and the bind address for health checks
+	allow := []string{"Allow 127.0.0.1", "Allow ::1", "Allow " + bindIP}
+	if cfg.Mode == "restricted" {
+		// Only the specified IPs; with none, only the above are allowed
+		for _, ip := range cfg.AllowedIPs {
+			allow = append(allow, "Allow "+ip)
+		}
+	} else if cfg.open() {
+		// In open mode, allow all (use with caution!)
+		allow = append(allow, "Allow 0.0.0.0/0", "Allow ::/0")
+	}
+
+	if cfg.authenticated() {
+		allow = append(allow, fmt.Sprintf("BasicAuth %s %s", cfg.Username, cfg.Password))
+	}
+
+	return fmt.Sprintf(`# Basic Configuration
+Port %d
+Listen %s
+
+# Server Configuration  
+%s
+
+# Access Control
+%s
+
+# Logging
+LogLevel Info
+LogFile "/tmp/tinyproxy-%s-%d.log"
+PidFile "/tmp/tinyproxy-%s-%d.pid"
+
+# Proxy Configuration
+ViaProxyName "proxy-v6"
+DisableViaHeader No
+Timeout 600
+
+# Performance
+%s
+`, cfg.Port, bindIP, servers, strings.Join(allow, "\n"), bindIP, cfg.Port, bindIP, cfg.Port, connectPortDirectives("ConnectPort %s"))
+}
+
+// connectPortDirectives renders one directive per allowed CONNECT port in
+// a stable order.
+func connectPortDirectives(format string) string {
+	lines := make([]string, 0, len(connectPortList))
+	for _, port := range connectPortList {
+		lines = append(lines, fmt.Sprintf(format, port))
+	}
+	return strings.Join(lines, "\n")
+}
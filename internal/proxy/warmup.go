@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+const defaultWarmupTimeout = 10 * time.Second
+
+// SetWarmup configures URLs requested through every new proxy after it
+// passes its health check and before it is reported as running, so TLS
+// session caches and path MTU discovery are primed for the first client.
+func (m *Manager) SetWarmup(urls []string, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if timeout <= 0 {
+		timeout = defaultWarmupTimeout
+	}
+	m.warmupURLs = urls
+	m.warmupTimeout = timeout
+	if len(urls) > 0 {
+		m.logger.Infof("Proxy warm-up enabled with %d URLs", len(urls))
+	}
+}
+
+// warmUp requests urls through instance, a copy taken under m.mu. Failures
+// are logged but never fail the instance. Warming up stops once ctx is
+// done.
+func (m *Manager) warmUp(ctx context.Context, instance models.ProxyInstance, urls []string, timeout time.Duration) {
+	if len(urls) == 0 {
+		return
+	}
+	instanceID := instance.ID
+	client := instanceClient(&instance, timeout)
+	defer client.CloseIdleConnections()
+
+	for _, target := range urls {
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			m.logger.Warnf("Invalid warm-up URL %s: %v", target, err)
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			m.logger.Warnf("Warm-up request to %s via %s failed: %v", target, instanceID, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		m.logger.Debugf("Warm-up request to %s via %s returned %d in %s", target, instanceID, resp.StatusCode, time.Since(start))
+	}
+}
+
+// instanceClient returns an HTTP client that sends every request through
+// instance.
+func instanceClient(instance *models.ProxyInstance, timeout time.Duration) *http.Client {
+	// net/http speaks SOCKS5 itself when the proxy URL uses that scheme
+	scheme := "http"
+	if instance.Protocol == models.ProxyProtocolSOCKS5 {
+		scheme = "socks5"
+	}
+	proxyURL, _ := url.Parse(fmt.Sprintf("%s://[%s]:%d", scheme, instance.IPv6.IP.String(), instance.Port))
+	if instance.Username != "" {
+		proxyURL.User = url.UserPassword(instance.Username, instance.Password)
+	}
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   timeout,
+	}
+}
@@ -0,0 +1,533 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/apierror"
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDrainTimeout   = 2 * time.Minute
+	defaultRestartTimeout = 10 * time.Minute
+	defaultVerifyTimeout  = 2 * time.Minute
+	verifyInterval        = 2 * time.Second
+	// restartAttempts is how often a restart request that got no response
+	// is sent before the node is marked failed.
+	restartAttempts   = 3
+	restartRetryDelay = 2 * time.Second
+)
+
+// Job states.
+const (
+	StateRunning   = "running"
+	StatePaused    = "paused"
+	StateCompleted = "completed"
+	StateAborted   = "aborted"
+)
+
+// Node states within a job.
+const (
+	NodePending    = "pending"
+	NodeDraining   = "draining"
+	NodeRestarting = "restarting"
+	NodeVerifying  = "verifying"
+	NodeDone       = "done"
+	NodeFailed     = "failed"
+	NodeSkipped    = "skipped"
+)
+
+// Drainer takes nodes out of rotation while they restart.
+type Drainer interface {
+	DrainNode(nodeID string)
+	UndrainNode(nodeID string)
+	NodeInFlight(nodeID string) int64
+}
+
+type Options struct {
+	MaxUnavailable       int `json:"max_unavailable"`
+	DrainTimeoutSeconds  int `json:"drain_timeout_seconds"`
+	VerifyTimeoutSeconds int `json:"verify_timeout_seconds"`
+}
+
+type NodeStatus struct {
+	NodeID     string    `json:"node_id"`
+	State      string    `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+type Status struct {
+	ID         string       `json:"id"`
+	State      string       `json:"state"`
+	Options    Options      `json:"options"`
+	Nodes      []NodeStatus `json:"nodes"`
+	Error      string       `json:"error,omitempty"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at,omitempty"`
+}
+
+type job struct {
+	status Status
+	resume chan struct{}
+	abort  chan struct{}
+}
+
+// Orchestrator restarts agents a few at a time: each node is drained,
+// told to restart its proxies, and verified healthy before it returns to
+// rotation. A failure pauses the rollout until it is resumed or aborted.
+type Orchestrator struct {
+	logger  *logrus.Logger
+	drainer Drainer
+	nodes   func() []models.NodeInfo
+	report  func(models.NodeInfo)
+	client  *http.Client
+	skip    func(nodeID string) bool
+	token   func(nodeID string) string
+	current *job
+	seq     int
+	mu      sync.Mutex
+}
+
+// NewOrchestrator creates an orchestrator. nodes lists the registered
+// agents and report records fresh node info fetched during verification.
+func NewOrchestrator(logger *logrus.Logger, drainer Drainer, nodes func() []models.NodeInfo, report func(models.NodeInfo)) *Orchestrator {
+	return &Orchestrator{
+		logger:  logger,
+		drainer: drainer,
+		nodes:   nodes,
+		report:  report,
+		client:  &http.Client{},
+	}
+}
+
+// SetSkip makes rollouts pass over nodes for which skip returns true when
+// their turn comes, such as nodes in a maintenance window.
+func (o *Orchestrator) SetSkip(skip func(nodeID string) bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.skip = skip
+}
+
+// SetAgentToken makes calls to a node's agent API present the token
+// returns for it, when not empty.
+func (o *Orchestrator) SetAgentToken(token func(nodeID string) string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = token
+}
+
+// Start begins a rolling restart of every registered node. Only one
+// rollout may be active (running or paused) at a time.
+func (o *Orchestrator) Start(opts Options) (Status, error) {
+	if opts.MaxUnavailable <= 0 {
+		opts.MaxUnavailable = 1
+	}
+	if opts.DrainTimeoutSeconds <= 0 {
+		opts.DrainTimeoutSeconds = int(defaultDrainTimeout.Seconds())
+	}
+	if opts.VerifyTimeoutSeconds <= 0 {
+		opts.VerifyTimeoutSeconds = int(defaultVerifyTimeout.Seconds())
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.current != nil && (o.current.status.State == StateRunning || o.current.status.State == StatePaused) {
+		return Status{}, fmt.Errorf("rolling restart %s is already %s", o.current.status.ID, o.current.status.State)
+	}
+
+	nodes := o.nodes()
+	if len(nodes) == 0 {
+		return Status{}, fmt.Errorf("no nodes registered")
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+
+	o.seq++
+	j := &job{
+		status: Status{
+			ID:        fmt.Sprintf("restart-%d", o.seq),
+			State:     StateRunning,
+			Options:   opts,
+			StartedAt: time.Now(),
+		},
+		resume: make(chan struct{}, 1),
+		abort:  make(chan struct{}),
+	}
+	for _, node := range nodes {
+		j.status.Nodes = append(j.status.Nodes, NodeStatus{NodeID: node.NodeID, State: NodePending})
+	}
+	o.current = j
+
+	o.logger.Infof("Starting rolling restart %s of %d nodes (max unavailable %d)", j.status.ID, len(nodes), opts.MaxUnavailable)
+	go o.run(j)
+	return o.snapshot(j), nil
+}
+
+// Status returns the most recent rollout, if any.
+func (o *Orchestrator) Status() (Status, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.current == nil {
+		return Status{}, false
+	}
+	return o.snapshot(o.current), true
+}
+
+// Resume retries the failed nodes of a paused rollout and continues.
+func (o *Orchestrator) Resume() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.current == nil || o.current.status.State != StatePaused {
+		return fmt.Errorf("no paused rolling restart")
+	}
+	o.current.status.State = StateRunning
+	o.current.status.Error = ""
+	o.current.resume <- struct{}{}
+	return nil
+}
+
+// Abort stops an active rollout after the current batch and returns any
+// nodes it drained to rotation.
+func (o *Orchestrator) Abort() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.current == nil || (o.current.status.State != StateRunning && o.current.status.State != StatePaused) {
+		return fmt.Errorf("no active rolling restart")
+	}
+	close(o.current.abort)
+	o.current.status.State = StateAborted
+	o.current.status.FinishedAt = time.Now()
+	return nil
+}
+
+func (o *Orchestrator) snapshot(j *job) Status {
+	status := j.status
+	status.Nodes = append([]NodeStatus(nil), j.status.Nodes...)
+	return status
+}
+
+func (o *Orchestrator) setNode(j *job, index int, update func(*NodeStatus)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	update(&j.status.Nodes[index])
+}
+
+func (o *Orchestrator) aborted(j *job) bool {
+	select {
+	case <-j.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *Orchestrator) run(j *job) {
+	opts := j.status.Options
+
+	for {
+		pending := make([]int, 0)
+		o.mu.Lock()
+		for i, node := range j.status.Nodes {
+			if node.State == NodePending || node.State == NodeFailed {
+				pending = append(pending, i)
+			}
+		}
+		o.mu.Unlock()
+
+		if len(pending) == 0 {
+			break
+		}
+
+		batch := pending
+		if len(batch) > opts.MaxUnavailable {
+			batch = batch[:opts.MaxUnavailable]
+		}
+
+		var wg sync.WaitGroup
+		for _, index := range batch {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+				o.restartNode(j, index)
+			}(index)
+		}
+		wg.Wait()
+
+		failures := make([]string, 0)
+		o.mu.Lock()
+		for _, index := range batch {
+			if node := j.status.Nodes[index]; node.State == NodeFailed {
+				failures = append(failures, fmt.Sprintf("%s: %s", node.NodeID, node.Error))
+			}
+		}
+		if len(failures) > 0 && j.status.State == StateRunning {
+			j.status.State = StatePaused
+			j.status.Error = strings.Join(failures, "; ")
+			o.logger.Errorf("Rolling restart %s paused: %s", j.status.ID, j.status.Error)
+		}
+		o.mu.Unlock()
+
+		if o.aborted(j) {
+			o.finishAborted(j)
+			return
+		}
+
+		if len(failures) > 0 {
+			select {
+			case <-j.resume:
+				o.logger.Infof("Resuming rolling restart %s", j.status.ID)
+			case <-j.abort:
+				o.finishAborted(j)
+				return
+			}
+		}
+	}
+
+	// An abort after the last batch came back still wins. Abort closes
+	// j.abort with o.mu held, so it cannot slip in between
+	o.mu.Lock()
+	if o.aborted(j) {
+		o.mu.Unlock()
+		o.finishAborted(j)
+		return
+	}
+	j.status.State = StateCompleted
+	j.status.FinishedAt = time.Now()
+	o.mu.Unlock()
+	o.logger.Infof("Rolling restart %s completed", j.status.ID)
+}
+
+func (o *Orchestrator) finishAborted(j *job) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, node := range j.status.Nodes {
+		if node.State == NodeFailed {
+			o.drainer.UndrainNode(node.NodeID)
+		}
+		if node.State == NodePending {
+			j.status.Nodes[i].State = NodeSkipped
+		}
+	}
+	o.logger.Warnf("Rolling restart %s aborted", j.status.ID)
+}
+
+func (o *Orchestrator) restartNode(j *job, index int) {
+	opts := j.status.Options
+	nodeID := j.status.Nodes[index].NodeID
+
+	fail := func(err error) {
+		o.logger.Errorf("Rolling restart of node %s failed: %v", nodeID, err)
+		o.setNode(j, index, func(n *NodeStatus) {
+			n.State = NodeFailed
+			n.Error = err.Error()
+			n.FinishedAt = time.Now()
+		})
+	}
+
+	o.mu.Lock()
+	skip := o.skip
+	o.mu.Unlock()
+	if skip != nil && skip(nodeID) {
+		o.logger.Infof("Rolling restart skipping node %s: in maintenance", nodeID)
+		o.setNode(j, index, func(n *NodeStatus) {
+			n.State = NodeSkipped
+			n.Error = "in maintenance"
+			n.FinishedAt = time.Now()
+		})
+		return
+	}
+
+	node, ok := o.findNode(nodeID)
+	if !ok {
+		fail(fmt.Errorf("node is no longer registered"))
+		return
+	}
+	if node.APIURL == "" {
+		fail(fmt.Errorf("node does not report an API URL"))
+		return
+	}
+	expected := 0
+	for _, p := range node.Proxies {
+		if p.Status != models.ProxyStatusStopped {
+			expected++
+		}
+	}
+
+	o.setNode(j, index, func(n *NodeStatus) {
+		n.State = NodeDraining
+		n.Error = ""
+		n.StartedAt = time.Now()
+		n.FinishedAt = time.Time{}
+	})
+	o.drainer.DrainNode(nodeID)
+	o.waitDrained(nodeID, time.Duration(opts.DrainTimeoutSeconds)*time.Second)
+
+	o.setNode(j, index, func(n *NodeStatus) { n.State = NodeRestarting })
+	if err := o.requestRestart(node); err != nil {
+		fail(err)
+		return
+	}
+
+	o.setNode(j, index, func(n *NodeStatus) { n.State = NodeVerifying })
+	if err := o.verify(node, expected, time.Duration(opts.VerifyTimeoutSeconds)*time.Second); err != nil {
+		fail(err)
+		return
+	}
+
+	o.drainer.UndrainNode(nodeID)
+	o.setNode(j, index, func(n *NodeStatus) {
+		n.State = NodeDone
+		n.FinishedAt = time.Now()
+	})
+	o.logger.Infof("Node %s restarted and verified", nodeID)
+}
+
+func (o *Orchestrator) findNode(nodeID string) (models.NodeInfo, bool) {
+	for _, node := range o.nodes() {
+		if node.NodeID == nodeID {
+			return node, true
+		}
+	}
+	return models.NodeInfo{}, false
+}
+
+// waitDrained waits for in-flight work on nodeID to finish. Long-lived
+// tunnels are not waited on past timeout.
+func (o *Orchestrator) waitDrained(nodeID string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight := o.drainer.NodeInFlight(nodeID)
+		if inFlight == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			o.logger.Warnf("Node %s still has %d in-flight requests after %s, restarting anyway", nodeID, inFlight, timeout)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// requestRestart tells the agent of node to restart its proxies. Requests
+// that got no response are resent with the same idempotency key, so an
+// agent that already restarted answers from its journal instead of
+// restarting again.
+func (o *Orchestrator) requestRestart(node models.NodeInfo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRestartTimeout)
+	defer cancel()
+
+	key := apierror.NewRequestID()
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		req, err := o.agentRequest(ctx, http.MethodPost, node, "/restart")
+		if err != nil {
+			return err
+		}
+		req.Header.Set(apierror.IdempotencyKeyHeader, key)
+		resp, err = o.client.Do(req)
+		if err == nil {
+			break
+		}
+		if attempt == restartAttempts || ctx.Err() != nil {
+			return fmt.Errorf("restart request failed: %w", err)
+		}
+		o.logger.Warnf("Restart request to %s failed, resending (attempt %d/%d): %v", node.APIURL, attempt+1, restartAttempts, err)
+		time.Sleep(restartRetryDelay)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("agent returned %d: %s", resp.StatusCode, apiErr.Message)
+	}
+	return nil
+}
+
+// verify polls the agent until at least expected proxies are running.
+func (o *Orchestrator) verify(node models.NodeInfo, expected int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var last string
+	for time.Now().Before(deadline) {
+		info, err := o.fetchStatus(node)
+		if err != nil {
+			last = err.Error()
+		} else {
+			running := 0
+			for _, p := range info.Proxies {
+				if p.Status == models.ProxyStatusRunning {
+					running++
+				}
+			}
+			if running >= expected {
+				// The status carries the agent's own view of its URL,
+				// which the coordinator has not checked
+				info.NodeID = node.NodeID
+				info.APIURL = node.APIURL
+				o.report(info)
+				return nil
+			}
+			last = fmt.Sprintf("%d of %d proxies running", running, expected)
+		}
+		time.Sleep(verifyInterval)
+	}
+	return fmt.Errorf("not healthy after %s: %s", timeout, last)
+}
+
+func (o *Orchestrator) fetchStatus(node models.NodeInfo) (models.NodeInfo, error) {
+	var info models.NodeInfo
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := o.agentRequest(ctx, http.MethodGet, node, "/status")
+	if err != nil {
+		return info, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("status returned %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// agentRequest builds a call to path on node's agent API, with the agent's
+// token when one is known.
+func (o *Orchestrator) agentRequest(ctx context.Context, method string, node models.NodeInfo, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(node.APIURL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	token := o.token
+	o.mu.Unlock()
+	if token != nil {
+		if t := token(node.NodeID); t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,81 @@
+package rollout
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+type idleDrainer struct{}
+
+func (idleDrainer) DrainNode(nodeID string)          {}
+func (idleDrainer) UndrainNode(nodeID string)        {}
+func (idleDrainer) NodeInFlight(nodeID string) int64 { return 0 }
+
+func TestAbortDuringLastBatch(t *testing.T) {
+	restarting := make(chan struct{})
+	release := make(chan struct{})
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/restart":
+			close(restarting)
+			<-release
+			w.WriteHeader(http.StatusOK)
+		case "/status":
+			json.NewEncoder(w).Encode(models.NodeInfo{
+				Proxies: []models.ProxyInstance{{ID: "p1", Status: models.ProxyStatusRunning}},
+			})
+		}
+	}))
+	defer agent.Close()
+
+	node := models.NodeInfo{
+		NodeID:  "node-1",
+		APIURL:  agent.URL,
+		Proxies: []models.ProxyInstance{{ID: "p1", Status: models.ProxyStatusRunning}},
+	}
+	logger, hook := test.NewNullLogger()
+	o := NewOrchestrator(logger, idleDrainer{}, func() []models.NodeInfo { return []models.NodeInfo{node} }, func(models.NodeInfo) {})
+
+	if _, err := o.Start(Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	<-restarting
+	if err := o.Abort(); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	close(release)
+
+	// The job logs once it is finished, either way
+	deadline := time.Now().Add(5 * time.Second)
+	for !finished(hook) {
+		if time.Now().After(deadline) {
+			t.Fatal("rolling restart did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status, _ := o.Status()
+	if status.State != StateAborted {
+		t.Fatalf("rollout aborted during its last batch ended %s, want %s", status.State, StateAborted)
+	}
+	if status.FinishedAt.IsZero() {
+		t.Fatal("aborted rollout has no finish time")
+	}
+}
+
+func finished(hook *test.Hook) bool {
+	for _, entry := range hook.AllEntries() {
+		if strings.HasSuffix(entry.Message, " aborted") || strings.HasSuffix(entry.Message, " completed") {
+			return true
+		}
+	}
+	return false
+}
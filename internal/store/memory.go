@@ -0,0 +1,208 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Memory is a Store whose nodes, users, rules, heartbeats and usage
+// rollups live in maps and are gone on restart; the usage ledger and events
+// are delegated.
+type Memory struct {
+	nodes      map[string]models.NodeInfo
+	users      map[string]models.User
+	rules      map[string][]byte             // kind -> JSON, so callers never share slices
+	heartbeats map[string][]models.Heartbeat // node ID -> heartbeats, oldest first
+	billing    map[billingKey]models.UsageRollup
+	retention  time.Duration
+	usage      UsageStore
+	events     EventStore
+	mu         sync.RWMutex
+}
+
+func NewMemory(heartbeatRetention time.Duration, usage UsageStore, events EventStore) *Memory {
+	return &Memory{
+		nodes:      make(map[string]models.NodeInfo),
+		users:      make(map[string]models.User),
+		rules:      make(map[string][]byte),
+		heartbeats: make(map[string][]models.Heartbeat),
+		billing:    make(map[billingKey]models.UsageRollup),
+		retention:  heartbeatRetention,
+		usage:      usage,
+		events:     events,
+	}
+}
+
+func (m *Memory) Nodes() NodeStore           { return m }
+func (m *Memory) Users() UserStore           { return m }
+func (m *Memory) Rules() RuleStore           { return m }
+func (m *Memory) Usage() UsageStore          { return m.usage }
+func (m *Memory) Billing() BillingStore      { return m }
+func (m *Memory) Events() EventStore         { return m.events }
+func (m *Memory) Heartbeats() HeartbeatStore { return m }
+func (m *Memory) Close() error               { return nil }
+
+func (m *Memory) GetNode(nodeID string) (models.NodeInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, ok := m.nodes[nodeID]
+	if !ok {
+		return models.NodeInfo{}, fmt.Errorf("node %s: %w", nodeID, ErrNotFound)
+	}
+	return node, nil
+}
+
+func (m *Memory) PutNode(node models.NodeInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes[node.NodeID] = node
+	return nil
+}
+
+func (m *Memory) DeleteNode(nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[nodeID]; !ok {
+		return fmt.Errorf("node %s: %w", nodeID, ErrNotFound)
+	}
+	delete(m.nodes, nodeID)
+	return nil
+}
+
+// ListNodes returns the nodes ordered by ID.
+func (m *Memory) ListNodes() ([]models.NodeInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]models.NodeInfo, 0, len(m.nodes))
+	for _, node := range m.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeID < nodes[j].NodeID })
+	return nodes, nil
+}
+
+func (m *Memory) PutUser(user models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.Username] = user
+	return nil
+}
+
+func (m *Memory) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[username]; !ok {
+		return fmt.Errorf("user %s: %w", username, ErrNotFound)
+	}
+	delete(m.users, username)
+	return nil
+}
+
+// ListUsers returns the users ordered by name.
+func (m *Memory) ListUsers() ([]models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := make([]models.User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (m *Memory) GetRules(kind string, out interface{}) (bool, error) {
+	m.mu.RLock()
+	data, ok := m.rules[kind]
+	m.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", kind, err)
+	}
+	return true, nil
+}
+
+func (m *Memory) PutRules(kind string, rules interface{}) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", kind, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules[kind] = data
+	return nil
+}
+
+func (m *Memory) RecordHeartbeat(hb models.Heartbeat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history := append(m.heartbeats[hb.NodeID], hb)
+	if m.retention > 0 {
+		cutoff := hb.ReceivedAt.Add(-m.retention)
+		i := sort.Search(len(history), func(i int) bool { return !history[i].ReceivedAt.Before(cutoff) })
+		history = history[i:]
+	}
+	m.heartbeats[hb.NodeID] = history
+	return nil
+}
+
+func (m *Memory) ListHeartbeats(nodeID string, since time.Time) ([]models.Heartbeat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history := m.heartbeats[nodeID]
+	i := sort.Search(len(history), func(i int) bool { return !history[i].ReceivedAt.Before(since) })
+	return append([]models.Heartbeat{}, history[i:]...), nil
+}
+
+// billingKey identifies the rollup of one user in one hour.
+type billingKey struct {
+	hour   int64 // Unix seconds
+	tenant string
+	user   string
+}
+
+func (m *Memory) AddUsage(rollups []models.UsageRollup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range rollups {
+		key := billingKey{hour: r.Hour.Unix(), tenant: r.Tenant, user: r.User}
+		sum, ok := m.billing[key]
+		if !ok {
+			sum = models.UsageRollup{Hour: r.Hour.UTC(), Tenant: r.Tenant, User: r.User}
+		}
+		sum.Requests += r.Requests
+		sum.BytesSent += r.BytesSent
+		sum.BytesReceived += r.BytesReceived
+		sum.Cost += r.Cost
+		m.billing[key] = sum
+	}
+	return nil
+}
+
+func (m *Memory) ListUsage(q BillingQuery) ([]models.UsageRollup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rollups := make([]models.UsageRollup, 0)
+	for _, r := range m.billing {
+		if q.matches(r) {
+			rollups = append(rollups, r)
+		}
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		a, b := rollups[i], rollups[j]
+		if !a.Hour.Equal(b.Hour) {
+			return a.Hour.Before(b.Hour)
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		return a.User < b.User
+	})
+	return rollups, nil
+}
@@ -0,0 +1,371 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+
+	_ "modernc.org/sqlite"
+)
+
+// DefaultSQLitePath is where BackendSQLite keeps its database unless told
+// otherwise, relative to the coordinator's working directory.
+const DefaultSQLitePath = "coordinator.db"
+
+// heartbeatPruneInterval bounds how often heartbeats past the retention
+// are deleted.
+const heartbeatPruneInterval = time.Minute
+
+// sqliteSchema creates the tables of schema version 1. Nodes, users and
+// rules are stored as the JSON the API serves, so models can grow fields
+// without migrations.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS nodes (
+	node_id    TEXT PRIMARY KEY,
+	updated_at INTEGER NOT NULL,
+	report     TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS users (
+	username TEXT PRIMARY KEY,
+	user     TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS rules (
+	kind  TEXT PRIMARY KEY,
+	rules TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS heartbeats (
+	node_id     TEXT NOT NULL,
+	received_at INTEGER NOT NULL,
+	proxies     INTEGER NOT NULL,
+	running     INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS heartbeats_by_node ON heartbeats (node_id, received_at);
+CREATE INDEX IF NOT EXISTS heartbeats_by_time ON heartbeats (received_at);
+CREATE TABLE IF NOT EXISTS usage_hourly (
+	hour           INTEGER NOT NULL,
+	tenant         TEXT NOT NULL,
+	user           TEXT NOT NULL,
+	requests       INTEGER NOT NULL,
+	bytes_sent     INTEGER NOT NULL,
+	bytes_received INTEGER NOT NULL,
+	PRIMARY KEY (hour, tenant, user)
+);
+`
+
+// sqliteMigrations bring a database from the version before each one to
+// the version after it, version 1 being sqliteSchema.
+var sqliteMigrations = []string{
+	2: `
+ALTER TABLE usage_hourly ADD COLUMN cost REAL NOT NULL DEFAULT 0;
+`,
+}
+
+// sqliteVersion is the schema version this coordinator writes.
+var sqliteVersion = len(sqliteMigrations) - 1
+
+// SQLite is a Store that keeps nodes, users, rules, heartbeats and usage
+// rollups in a SQLite database, so a restarted coordinator starts from the
+// pool it had. The usage ledger and events are delegated, as with Memory.
+type SQLite struct {
+	db        *sql.DB
+	retention time.Duration
+	lastPrune time.Time
+	usage     UsageStore
+	events    EventStore
+	mu        sync.Mutex // guards lastPrune
+}
+
+// OpenSQLite opens or creates the database at path.
+func OpenSQLite(path string, heartbeatRetention time.Duration, usage UsageStore, events EventStore) (*SQLite, error) {
+	if path == "" {
+		path = DefaultSQLitePath
+	}
+	// WAL lets API reads run while a node report is written
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {
+		"busy_timeout(5000)",
+		"journal_mode(WAL)",
+		"synchronous(NORMAL)",
+	}}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	// One connection serialises writes instead of failing them as busy
+	db.SetMaxOpenConns(1)
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if version > sqliteVersion {
+		db.Close()
+		return nil, fmt.Errorf("%s has schema version %d, this coordinator only knows up to version %d", path, version, sqliteVersion)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the schema in %s: %w", path, err)
+	}
+	for v := max(version, 1) + 1; v <= sqliteVersion; v++ {
+		if _, err := db.Exec(sqliteMigrations[v] + fmt.Sprintf("PRAGMA user_version = %d;", v)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate %s to schema version %d: %w", path, v, err)
+		}
+	}
+
+	return &SQLite{
+		db:        db,
+		retention: heartbeatRetention,
+		usage:     usage,
+		events:    events,
+	}, nil
+}
+
+func (s *SQLite) Nodes() NodeStore           { return s }
+func (s *SQLite) Users() UserStore           { return s }
+func (s *SQLite) Rules() RuleStore           { return s }
+func (s *SQLite) Usage() UsageStore          { return s.usage }
+func (s *SQLite) Billing() BillingStore      { return s }
+func (s *SQLite) Events() EventStore         { return s.events }
+func (s *SQLite) Heartbeats() HeartbeatStore { return s }
+func (s *SQLite) Close() error               { return s.db.Close() }
+
+func (s *SQLite) GetNode(nodeID string) (models.NodeInfo, error) {
+	var node models.NodeInfo
+	var report string
+	err := s.db.QueryRow("SELECT report FROM nodes WHERE node_id = ?", nodeID).Scan(&report)
+	if errors.Is(err, sql.ErrNoRows) {
+		return node, fmt.Errorf("node %s: %w", nodeID, ErrNotFound)
+	}
+	if err != nil {
+		return node, err
+	}
+	if err := json.Unmarshal([]byte(report), &node); err != nil {
+		return node, fmt.Errorf("failed to decode node %s: %w", nodeID, err)
+	}
+	return node, nil
+}
+
+func (s *SQLite) PutNode(node models.NodeInfo) error {
+	report, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("failed to encode node %s: %w", node.NodeID, err)
+	}
+	_, err = s.db.Exec(`INSERT INTO nodes (node_id, updated_at, report) VALUES (?, ?, ?)
+		ON CONFLICT (node_id) DO UPDATE SET updated_at = excluded.updated_at, report = excluded.report`,
+		node.NodeID, node.UpdatedAt.UnixMilli(), string(report))
+	return err
+}
+
+func (s *SQLite) DeleteNode(nodeID string) error {
+	return s.deleteRow("DELETE FROM nodes WHERE node_id = ?", "node", nodeID)
+}
+
+// ListNodes returns the nodes ordered by ID.
+func (s *SQLite) ListNodes() ([]models.NodeInfo, error) {
+	rows, err := s.db.Query("SELECT node_id, report FROM nodes ORDER BY node_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make([]models.NodeInfo, 0)
+	for rows.Next() {
+		var nodeID, report string
+		if err := rows.Scan(&nodeID, &report); err != nil {
+			return nil, err
+		}
+		var node models.NodeInfo
+		if err := json.Unmarshal([]byte(report), &node); err != nil {
+			return nil, fmt.Errorf("failed to decode node %s: %w", nodeID, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
+
+func (s *SQLite) PutUser(user models.User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to encode user %s: %w", user.Username, err)
+	}
+	_, err = s.db.Exec(`INSERT INTO users (username, user) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET user = excluded.user`, user.Username, string(data))
+	return err
+}
+
+func (s *SQLite) DeleteUser(username string) error {
+	return s.deleteRow("DELETE FROM users WHERE username = ?", "user", username)
+}
+
+// ListUsers returns the users ordered by name.
+func (s *SQLite) ListUsers() ([]models.User, error) {
+	rows, err := s.db.Query("SELECT username, user FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]models.User, 0)
+	for rows.Next() {
+		var username, data string
+		if err := rows.Scan(&username, &data); err != nil {
+			return nil, err
+		}
+		var user models.User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return nil, fmt.Errorf("failed to decode user %s: %w", username, err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLite) GetRules(kind string, out interface{}) (bool, error) {
+	var data string
+	err := s.db.QueryRow("SELECT rules FROM rules WHERE kind = ?", kind).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(data), out); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", kind, err)
+	}
+	return true, nil
+}
+
+func (s *SQLite) PutRules(kind string, rules interface{}) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", kind, err)
+	}
+	_, err = s.db.Exec(`INSERT INTO rules (kind, rules) VALUES (?, ?)
+		ON CONFLICT (kind) DO UPDATE SET rules = excluded.rules`, kind, string(data))
+	return err
+}
+
+func (s *SQLite) RecordHeartbeat(hb models.Heartbeat) error {
+	if _, err := s.db.Exec("INSERT INTO heartbeats (node_id, received_at, proxies, running) VALUES (?, ?, ?, ?)",
+		hb.NodeID, hb.ReceivedAt.UnixMilli(), hb.Proxies, hb.Running); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	prune := s.retention > 0 && hb.ReceivedAt.Sub(s.lastPrune) >= heartbeatPruneInterval
+	if prune {
+		s.lastPrune = hb.ReceivedAt
+	}
+	s.mu.Unlock()
+	if prune {
+		_, err := s.db.Exec("DELETE FROM heartbeats WHERE received_at < ?", hb.ReceivedAt.Add(-s.retention).UnixMilli())
+		return err
+	}
+	return nil
+}
+
+func (s *SQLite) ListHeartbeats(nodeID string, since time.Time) ([]models.Heartbeat, error) {
+	rows, err := s.db.Query(`SELECT received_at, proxies, running FROM heartbeats
+		WHERE node_id = ? AND received_at >= ? ORDER BY received_at`, nodeID, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	heartbeats := make([]models.Heartbeat, 0)
+	for rows.Next() {
+		hb := models.Heartbeat{NodeID: nodeID}
+		var receivedAt int64
+		if err := rows.Scan(&receivedAt, &hb.Proxies, &hb.Running); err != nil {
+			return nil, err
+		}
+		hb.ReceivedAt = time.UnixMilli(receivedAt)
+		heartbeats = append(heartbeats, hb)
+	}
+	return heartbeats, rows.Err()
+}
+
+// AddUsage adds rollups in one transaction, so a failed flush adds none
+// of them.
+func (s *SQLite) AddUsage(rollups []models.UsageRollup) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range rollups {
+		if _, err := tx.Exec(`INSERT INTO usage_hourly (hour, tenant, user, requests, bytes_sent, bytes_received, cost)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (hour, tenant, user) DO UPDATE SET
+				requests = requests + excluded.requests,
+				bytes_sent = bytes_sent + excluded.bytes_sent,
+				bytes_received = bytes_received + excluded.bytes_received,
+				cost = cost + excluded.cost`,
+			r.Hour.Unix(), r.Tenant, r.User, r.Requests, r.BytesSent, r.BytesReceived, r.Cost); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) ListUsage(q BillingQuery) ([]models.UsageRollup, error) {
+	query := "SELECT hour, tenant, user, requests, bytes_sent, bytes_received, cost FROM usage_hourly WHERE 1 = 1"
+	var args []interface{}
+	if q.Tenant != "" {
+		query += " AND tenant = ?"
+		args = append(args, q.Tenant)
+	}
+	if q.User != "" {
+		query += " AND user = ?"
+		args = append(args, q.User)
+	}
+	if !q.From.IsZero() {
+		query += " AND hour >= ?"
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		query += " AND hour < ?"
+		args = append(args, q.To.Unix())
+	}
+	rows, err := s.db.Query(query+" ORDER BY hour, tenant, user", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollups := make([]models.UsageRollup, 0)
+	for rows.Next() {
+		var r models.UsageRollup
+		var hour int64
+		if err := rows.Scan(&hour, &r.Tenant, &r.User, &r.Requests, &r.BytesSent, &r.BytesReceived, &r.Cost); err != nil {
+			return nil, err
+		}
+		r.Hour = time.Unix(hour, 0).UTC()
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
+
+// deleteRow runs a single-row delete, returning ErrNotFound when it
+// matched nothing.
+func (s *SQLite) deleteRow(query, what, key string) error {
+	result, err := s.db.Exec(query, key)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%s %s: %w", what, key, ErrNotFound)
+	}
+	return nil
+}
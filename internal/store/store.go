@@ -0,0 +1,149 @@
+// Package store is the coordinator's state storage: the nodes reporting in,
+// proxy users, rules changed through the API, the usage ledger, the usage
+// rollups billed and the audit trail. Handlers only see the interfaces
+// here, so a persistent backend can replace the in-memory default without
+// changing them.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"proxy-v6/internal/audit"
+	"proxy-v6/internal/ledger"
+	"proxy-v6/pkg/models"
+)
+
+// Backends. BackendMemory keeps everything in process memory and
+// BackendSQLite in a database file. Either way the ledger and audit trail
+// write their own files when configured.
+const (
+	BackendMemory = "memory"
+	BackendSQLite = "sqlite"
+)
+
+// ErrNotFound is returned for a node or user the store does not hold.
+var ErrNotFound = errors.New("not found")
+
+// Rule kinds stored through RuleStore. WarmupPrefixes holds when each
+// prefix joined the pool rather than rules, so its warm-up survives
+// restarts, ExitBans the bans learned and imported, as a ban list, Leases
+// the exit leases still running and StickySessions the exit every
+// sticky-client session is on, with its expiry. Tenants holds the tenants
+// and Webhooks the coordinator's webhooks.
+const (
+	BanRules       = "ban_rules"
+	RewriteRules   = "rewrite_rules"
+	ReuseRules     = "reuse_rules"
+	PrefixOrigins  = "prefix_origins"
+	Pools          = "pools"
+	Tenants        = "tenants"
+	WarmupPrefixes = "warmup_prefixes"
+	ExitBans       = "exit_bans"
+	Leases         = "leases"
+	StickySessions = "sticky_sessions"
+	Webhooks       = "webhooks"
+)
+
+// Store groups the state the coordinator keeps.
+type Store interface {
+	Nodes() NodeStore
+	Users() UserStore
+	Rules() RuleStore
+	Usage() UsageStore
+	Billing() BillingStore
+	Events() EventStore
+	Heartbeats() HeartbeatStore
+	Close() error
+}
+
+// NodeStore holds the last report of every node.
+type NodeStore interface {
+	GetNode(nodeID string) (models.NodeInfo, error)
+	PutNode(node models.NodeInfo) error
+	DeleteNode(nodeID string) error
+	ListNodes() ([]models.NodeInfo, error)
+}
+
+// UserStore holds proxy users, passwords included.
+type UserStore interface {
+	PutUser(user models.User) error
+	DeleteUser(username string) error
+	ListUsers() ([]models.User, error)
+}
+
+// RuleStore holds rule sets by kind. rules is any JSON-encodable value;
+// GetRules decodes into out and reports whether the kind was stored.
+type RuleStore interface {
+	GetRules(kind string, out interface{}) (bool, error)
+	PutRules(kind string, rules interface{}) error
+}
+
+// UsageStore records which exits served whom, as the usage ledger does.
+type UsageStore interface {
+	Record(exitIP, exit, nodeID, user, tenant, clientIP, destination string)
+	Query(q ledger.Query) ([]models.LedgerEntry, error)
+}
+
+// BillingQuery filters usage rollups. Zero values match everything; From
+// and To bound the hour a rollup starts, To exclusive.
+type BillingQuery struct {
+	Tenant string
+	User   string
+	From   time.Time
+	To     time.Time
+}
+
+// BillingStore keeps the hourly usage rollups of every proxy user.
+type BillingStore interface {
+	// AddUsage adds rollups to those stored for the same hour and user
+	AddUsage(rollups []models.UsageRollup) error
+	// ListUsage returns the matching rollups ordered by hour, tenant and
+	// user
+	ListUsage(q BillingQuery) ([]models.UsageRollup, error)
+}
+
+func (q BillingQuery) matches(r models.UsageRollup) bool {
+	return (q.Tenant == "" || r.Tenant == q.Tenant) &&
+		(q.User == "" || r.User == q.User) &&
+		(q.From.IsZero() || !r.Hour.Before(q.From)) &&
+		(q.To.IsZero() || r.Hour.Before(q.To))
+}
+
+// HeartbeatStore keeps a summary of every node report for the retention
+// the store was opened with.
+type HeartbeatStore interface {
+	RecordHeartbeat(hb models.Heartbeat) error
+	// ListHeartbeats returns nodeID's heartbeats since since, oldest first
+	ListHeartbeats(nodeID string, since time.Time) ([]models.Heartbeat, error)
+}
+
+// EventStore is the audit trail of administrative and security events.
+type EventStore interface {
+	Record(entry audit.Entry)
+	Entries(limit int) []audit.Entry
+}
+
+// Backends lists the selectable store backends.
+func Backends() []string {
+	return []string{BackendSQLite, BackendMemory}
+}
+
+// Options configure Open.
+type Options struct {
+	Path               string        // database file of BackendSQLite
+	HeartbeatRetention time.Duration // 0 keeps heartbeats forever
+}
+
+// Open returns the store for backend. usage and events serve the usage and
+// event parts for backends that do not store those themselves.
+func Open(backend string, opts Options, usage UsageStore, events EventStore) (Store, error) {
+	switch backend {
+	case BackendMemory:
+		return NewMemory(opts.HeartbeatRetention, usage, events), nil
+	case BackendSQLite, "":
+		return OpenSQLite(opts.Path, opts.HeartbeatRetention, usage, events)
+	}
+	return nil, fmt.Errorf("unknown store backend: %s (valid: %v)", backend, Backends())
+}
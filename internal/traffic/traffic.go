@@ -0,0 +1,132 @@
+// Package traffic keeps the proxy traffic of the last hour in short steps,
+// in total and per node, so operators can graph recent request rates and
+// bandwidth without a metrics stack.
+package traffic
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+const (
+	// Step is how finely traffic is kept.
+	Step = 10 * time.Second
+	// Window is how long traffic is kept.
+	Window = time.Hour
+)
+
+const steps = int64(Window / Step)
+
+type bucket struct {
+	start    int64 // step number, Unix time divided by Step
+	requests int64
+	bytes    int64
+}
+
+// ring holds the buckets of the last Window, each reused once its step is
+// a Window old.
+type ring [steps]bucket
+
+func (r *ring) add(step, requests, bytes int64) {
+	b := &r[step%steps]
+	if b.start != step {
+		*b = bucket{start: step}
+	}
+	b.requests += requests
+	b.bytes += bytes
+}
+
+// get returns the traffic of step, none if its bucket was reused since.
+func (r *ring) get(step int64) (requests, bytes int64) {
+	b := r[step%steps]
+	if b.start != step {
+		return 0, 0
+	}
+	return b.requests, b.bytes
+}
+
+// Recorder counts requests and bytes per node in steps of Step.
+type Recorder struct {
+	total ring
+	nodes map[string]*ring
+	last  map[string]int64 // step each node last had traffic in
+	mu    sync.Mutex
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{nodes: make(map[string]*ring), last: make(map[string]int64)}
+}
+
+// Add counts requests and bytes, sent and received, through an exit of
+// nodeID in the current step.
+func (r *Recorder) Add(nodeID string, requests, bytes int64) {
+	step := time.Now().Unix() / int64(Step/time.Second)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total.add(step, requests, bytes)
+	nodeRing, ok := r.nodes[nodeID]
+	if !ok {
+		nodeRing = new(ring)
+		r.nodes[nodeID] = nodeRing
+	}
+	nodeRing.add(step, requests, bytes)
+	r.last[nodeID] = step
+}
+
+// Series returns the traffic of the complete steps in the last span, in
+// points of step each, oldest first. The step in progress is left out so
+// the latest point is not low for being partial. Nodes without traffic
+// in the span are left out; nodeID, if set, keeps only that node.
+func (r *Recorder) Series(span, step time.Duration, nodeID string, now time.Time) models.TrafficSeries {
+	per := int64(step / Step)
+	points := int(span / step)
+	current := now.Unix() / int64(Step/time.Second)
+	// The first step of the oldest point, so points end with the last
+	// complete step
+	first := current - int64(points)*per
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	series := models.TrafficSeries{
+		StepSeconds: int(step / time.Second),
+		Total:       collect(&r.total, first, per, points),
+		Nodes:       make(map[string][]models.TrafficPoint),
+	}
+	ids := make([]string, 0, len(r.nodes))
+	for id := range r.nodes {
+		if r.last[id] < current-int64(steps) {
+			// Nothing left in the window
+			delete(r.nodes, id)
+			delete(r.last, id)
+			continue
+		}
+		if r.last[id] >= first && (nodeID == "" || id == nodeID) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		series.Nodes[id] = collect(r.nodes[id], first, per, points)
+	}
+	return series
+}
+
+// collect sums the ring into points of per steps starting at step first.
+func collect(r *ring, first, per int64, points int) []models.TrafficPoint {
+	stepSeconds := int64(Step / time.Second)
+	out := make([]models.TrafficPoint, points)
+	for i := range out {
+		start := first + int64(i)*per
+		out[i].Time = time.Unix(start*stepSeconds, 0).UTC()
+		for s := start; s < start+per; s++ {
+			requests, bytes := r.get(s)
+			out[i].Requests += requests
+			out[i].Bytes += bytes
+		}
+	}
+	return out
+}
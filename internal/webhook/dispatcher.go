@@ -0,0 +1,420 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"proxy-v6/internal/eventstream"
+	"proxy-v6/pkg/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// queueSize is how many deliveries wait for each webhook before new
+	// ones are dropped.
+	queueSize = 1000
+	// keptDeliveries is how many deliveries, across webhooks, are kept
+	// for the API.
+	keptDeliveries = 1000
+	// Retries wait firstBackoff, doubling up to maxBackoff.
+	firstBackoff = time.Second
+	maxBackoff   = 5 * time.Minute
+	// resubscribeDelay is how long the dispatcher waits before following
+	// the event stream again after it was dropped.
+	resubscribeDelay = time.Second
+)
+
+var (
+	deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_webhook_deliveries_total",
+		Help: "Finished webhook deliveries, by webhook and status (delivered, failed or dropped).",
+	}, []string{"webhook", "status"})
+	deliveryAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_v6_webhook_attempts_total",
+		Help: "Webhook delivery attempts, retries included, by webhook.",
+	}, []string{"webhook"})
+)
+
+// target is a webhook and the deliveries waiting for it. Each target has
+// a worker sending them one at a time, in the order of the events.
+type target struct {
+	hook  models.Webhook
+	queue chan *models.WebhookDelivery
+	quit  chan struct{}
+
+	delivered, failed, dropped int64
+	lastDelivered              *time.Time
+	lastError                  string
+}
+
+// Dispatcher sends the events of the cluster to every webhook matching
+// them. Deliveries live in memory: the ones still pending at shutdown are
+// lost.
+type Dispatcher struct {
+	logger  *logrus.Logger
+	client  *http.Client
+	targets map[string]*target
+	kept    []*models.WebhookDelivery // oldest first
+	mu      sync.Mutex
+}
+
+func NewDispatcher(logger *logrus.Logger) *Dispatcher {
+	return &Dispatcher{
+		logger:  logger,
+		client:  &http.Client{},
+		targets: make(map[string]*target),
+	}
+}
+
+// SetWebhooks replaces the webhooks. Deliveries queued for a webhook that
+// is kept go out with its new settings; those of a removed one are
+// dropped.
+func (d *Dispatcher) SetWebhooks(hooks []models.Webhook) error {
+	seen := make(map[string]bool, len(hooks))
+	for _, hook := range hooks {
+		if err := Validate(hook); err != nil {
+			return err
+		}
+		if seen[hook.Name] {
+			return fmt.Errorf("duplicate webhook %s", hook.Name)
+		}
+		seen[hook.Name] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, t := range d.targets {
+		if !seen[name] {
+			close(t.quit)
+			delete(d.targets, name)
+		}
+	}
+	for _, hook := range hooks {
+		if t, ok := d.targets[hook.Name]; ok {
+			t.hook = hook
+			continue
+		}
+		t := &target{hook: hook, queue: make(chan *models.WebhookDelivery, queueSize), quit: make(chan struct{})}
+		d.targets[hook.Name] = t
+		go d.work(t)
+	}
+	return nil
+}
+
+// SetWebhook adds hook, or replaces the webhook with its name.
+func (d *Dispatcher) SetWebhook(hook models.Webhook) error {
+	hooks := d.Webhooks()
+	replaced := false
+	for i := range hooks {
+		if hooks[i].Name == hook.Name {
+			hooks[i], replaced = hook, true
+		}
+	}
+	if !replaced {
+		hooks = append(hooks, hook)
+	}
+	return d.SetWebhooks(hooks)
+}
+
+// DeleteWebhook removes the named webhook.
+func (d *Dispatcher) DeleteWebhook(name string) error {
+	hooks := d.Webhooks()
+	for i := range hooks {
+		if hooks[i].Name == name {
+			return d.SetWebhooks(append(hooks[:i], hooks[i+1:]...))
+		}
+	}
+	return fmt.Errorf("webhook %s not found", name)
+}
+
+// Webhooks returns the webhooks, secrets included, by name.
+func (d *Dispatcher) Webhooks() []models.Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hooks := make([]models.Webhook, 0, len(d.targets))
+	for _, t := range d.targets {
+		hooks = append(hooks, t.hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Name < hooks[j].Name })
+	return hooks
+}
+
+// Statuses returns every webhook with how its deliveries went, by name.
+func (d *Dispatcher) Statuses() []models.WebhookStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := make([]models.WebhookStatus, 0, len(d.targets))
+	for _, t := range d.targets {
+		statuses = append(statuses, t.statusLocked())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Status returns the named webhook with how its deliveries went.
+func (d *Dispatcher) Status(name string) (models.WebhookStatus, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.targets[name]
+	if !ok {
+		return models.WebhookStatus{}, false
+	}
+	return t.statusLocked(), true
+}
+
+func (t *target) statusLocked() models.WebhookStatus {
+	status := models.WebhookStatus{
+		Webhook:       t.hook,
+		Signed:        t.hook.Secret != "",
+		Pending:       len(t.queue),
+		Delivered:     t.delivered,
+		Failed:        t.failed,
+		Dropped:       t.dropped,
+		LastDelivered: t.lastDelivered,
+		LastError:     t.lastError,
+	}
+	status.Secret = ""
+	return status
+}
+
+// Deliveries returns up to limit of the kept deliveries of the named
+// webhook, newest first, only those with status when it is set.
+func (d *Dispatcher) Deliveries(name, status string, limit int) []models.WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := []models.WebhookDelivery{}
+	for i := len(d.kept) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		delivery := d.kept[i]
+		if delivery.Webhook == name && (status == "" || delivery.Status == status) {
+			result = append(result, *delivery)
+		}
+	}
+	return result
+}
+
+// Run follows the event stream of hub until stop is closed, queueing a
+// delivery of every event for each webhook that wants it. When the hub
+// drops it for falling behind it resumes with the events it missed.
+func (d *Dispatcher) Run(hub *eventstream.Hub, stop <-chan struct{}) {
+	var lastID uint64
+	for {
+		replay, sub := hub.Subscribe(lastID)
+		for _, event := range replay {
+			d.dispatch(event)
+			lastID = event.ID
+		}
+		d.follow(sub, &lastID, stop)
+		sub.Close()
+		select {
+		case <-stop:
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+func (d *Dispatcher) follow(sub *eventstream.Subscription, lastID *uint64, stop <-chan struct{}) {
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			d.dispatch(event)
+			*lastID = event.ID
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops every worker. Deliveries still queued are dropped.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, t := range d.targets {
+		close(t.quit)
+		delete(d.targets, name)
+	}
+}
+
+func (d *Dispatcher) dispatch(event models.ClusterEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for name, t := range d.targets {
+		if !Matches(t.hook, event) {
+			continue
+		}
+		delivery := &models.WebhookDelivery{
+			ID:        newDeliveryID(),
+			Webhook:   name,
+			Event:     event,
+			Status:    models.DeliveryPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		d.keepLocked(delivery)
+		select {
+		case t.queue <- delivery:
+		default:
+			d.finishLocked(t, delivery, models.DeliveryDropped, fmt.Errorf("queue of %d deliveries is full", queueSize))
+		}
+	}
+}
+
+func (d *Dispatcher) keepLocked(delivery *models.WebhookDelivery) {
+	d.kept = append(d.kept, delivery)
+	if over := len(d.kept) - keptDeliveries; over > 0 {
+		d.kept = append([]*models.WebhookDelivery(nil), d.kept[over:]...)
+	}
+}
+
+// work sends the deliveries of t until it is removed, retrying each one
+// with backoff before going on to the next.
+func (d *Dispatcher) work(t *target) {
+	for {
+		select {
+		case delivery := <-t.queue:
+			d.deliver(t, delivery)
+		case <-t.quit:
+			d.drop(t)
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) drop(t *target) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		select {
+		case delivery := <-t.queue:
+			d.finishLocked(t, delivery, models.DeliveryDropped, fmt.Errorf("webhook was removed"))
+		default:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(t *target, delivery *models.WebhookDelivery) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		d.mu.Lock()
+		d.finishLocked(t, delivery, models.DeliveryFailed, err)
+		d.mu.Unlock()
+		return
+	}
+
+	backoff := firstBackoff
+	for {
+		d.mu.Lock()
+		hook := t.hook
+		d.mu.Unlock()
+
+		code, err := d.send(hook, delivery, body)
+		deliveryAttempts.WithLabelValues(hook.Name).Inc()
+
+		d.mu.Lock()
+		delivery.Attempts++
+		delivery.ResponseCode = code
+		delivery.UpdatedAt = time.Now()
+		delivery.NextAttempt = nil
+		if err == nil {
+			d.finishLocked(t, delivery, models.DeliveryDelivered, nil)
+			d.mu.Unlock()
+			return
+		}
+		// Other client errors will not go away by sending again
+		permanent := code >= 400 && code < 500 && code != http.StatusTooManyRequests && code != http.StatusRequestTimeout
+		if permanent || delivery.Attempts >= attempts(hook) {
+			d.finishLocked(t, delivery, models.DeliveryFailed, err)
+			d.mu.Unlock()
+			d.logger.Warnf("Webhook %s: giving up on delivery %s after %d attempts: %v", hook.Name, delivery.ID, delivery.Attempts, err)
+			return
+		}
+		delivery.LastError = err.Error()
+		next := time.Now().Add(backoff)
+		delivery.NextAttempt = &next
+		d.mu.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-t.quit:
+			d.mu.Lock()
+			d.finishLocked(t, delivery, models.DeliveryDropped, fmt.Errorf("webhook was removed"))
+			d.mu.Unlock()
+			return
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// send posts body once and returns the response status, 0 when there was
+// none.
+func (d *Dispatcher) send(hook models.Webhook, delivery *models.WebhookDelivery, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	if hook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(hook.Secret, now, body))
+	}
+
+	client := *d.client
+	client.Timeout = timeout(hook)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// finishLocked records the outcome of a delivery on it and its target.
+func (d *Dispatcher) finishLocked(t *target, delivery *models.WebhookDelivery, status string, err error) {
+	now := time.Now()
+	delivery.Status = status
+	delivery.UpdatedAt = now
+	delivery.NextAttempt = nil
+	switch status {
+	case models.DeliveryDelivered:
+		delivery.LastError = ""
+		t.delivered++
+		t.lastDelivered = &now
+	case models.DeliveryFailed:
+		t.failed++
+	case models.DeliveryDropped:
+		t.dropped++
+	}
+	if err != nil {
+		delivery.LastError = err.Error()
+		t.lastError = err.Error()
+	}
+	deliveries.WithLabelValues(t.hook.Name, status).Inc()
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,133 @@
+// Package webhook delivers the coordinator's cluster events to HTTP
+// endpoints, signed, retried with backoff, and with the outcome of every
+// delivery kept for the API.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"proxy-v6/pkg/models"
+)
+
+// Events webhooks can filter on besides the cluster event types.
+const (
+	EventNodeDown      = "node_down"      // a node left
+	EventProxyError    = "proxy_error"    // an instance went into error
+	EventQuotaExceeded = "quota_exceeded" // an instance went over its quota
+)
+
+// Headers of every delivery. SignatureHeader is only set for webhooks
+// with a secret.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultMaxAttempts = 5
+	maxAttempts        = 20
+)
+
+var clusterEventTypes = []string{
+	models.ClusterEventNodeJoined,
+	models.ClusterEventNodeLeft,
+	models.ClusterEventProxyStatus,
+	models.ClusterEventExitHealthy,
+	models.ClusterEventExitUnhealthy,
+	models.ClusterEventQuotaExceeded,
+	models.ClusterEventQuotaReset,
+	models.ClusterEventProxy,
+}
+
+// Validate checks a webhook before it is added.
+func Validate(hook models.Webhook) error {
+	if hook.Name == "" {
+		return fmt.Errorf("webhook needs a name")
+	}
+	parsed, err := url.Parse(hook.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook %s: url must be an http or https URL", hook.Name)
+	}
+	for _, event := range hook.Events {
+		switch event {
+		case EventNodeDown, EventProxyError, EventQuotaExceeded:
+			continue
+		}
+		if !slices.Contains(clusterEventTypes, event) {
+			return fmt.Errorf("webhook %s: unknown event %q", hook.Name, event)
+		}
+	}
+	if hook.TimeoutSeconds < 0 || hook.TimeoutSeconds > 300 {
+		return fmt.Errorf("webhook %s: timeout_seconds must be between 0 and 300", hook.Name)
+	}
+	if hook.MaxAttempts < 0 || hook.MaxAttempts > maxAttempts {
+		return fmt.Errorf("webhook %s: max_attempts must be between 0 and %d", hook.Name, maxAttempts)
+	}
+	return nil
+}
+
+// Matches reports whether hook wants event.
+func Matches(hook models.Webhook, event models.ClusterEvent) bool {
+	if len(hook.Nodes) > 0 && !slices.Contains(hook.Nodes, event.NodeID) {
+		return false
+	}
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, want := range hook.Events {
+		switch want {
+		case EventNodeDown:
+			if event.Type == models.ClusterEventNodeLeft {
+				return true
+			}
+		case EventProxyError:
+			if event.Type == models.ClusterEventProxyStatus && event.Status == models.ProxyStatusError {
+				return true
+			}
+		case EventQuotaExceeded:
+			if event.Type == models.ClusterEventQuotaExceeded {
+				return true
+			}
+		default:
+			if event.Type == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sign returns the signature header value of body sent at timestamp:
+// HMAC-SHA256 with secret over the Unix timestamp, a dot and the body.
+// Receivers recompute it and should reject old timestamps.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func timeout(hook models.Webhook) time.Duration {
+	if hook.TimeoutSeconds == 0 {
+		return defaultTimeout
+	}
+	return time.Duration(hook.TimeoutSeconds) * time.Second
+}
+
+func attempts(hook models.Webhook) int {
+	if hook.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return hook.MaxAttempts
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"net"
 	"time"
 )
@@ -14,14 +15,75 @@ type IPv6Address struct {
 
 type ProxyInstance struct {
 	ID          string      `json:"id"`
+	Name        string      `json:"name,omitempty"` // operator-chosen label, from the agent's instance_labels or API
+	Tags        []string    `json:"tags,omitempty"`
+	Pools       []string    `json:"pools,omitempty"` // named pools clients can select it through
 	IPv6        IPv6Address `json:"ipv6"`
 	Port        int         `json:"port"`
 	Status      ProxyStatus `json:"status"`
 	StartedAt   time.Time   `json:"started_at"`
 	LastChecked time.Time   `json:"last_checked"`
 	Metrics     ProxyMetrics `json:"metrics"`
+	Standby     bool        `json:"standby,omitempty"` // running but held in reserve
+	Protocol    ProxyProtocol `json:"protocol"`
+	Backend     string      `json:"backend,omitempty"`
+	ConfigPath  string      `json:"config_path,omitempty"`
+	StatusURL   string      `json:"status_url,omitempty"` // loopback status endpoint of native instances
+	Username    string      `json:"username,omitempty"`   // basic auth credentials, when required
+	Password    string      `json:"password,omitempty"`
+	QuotaUsedBytes int64    `json:"quota_used_bytes,omitempty"` // bytes its egress IP carried this quota period
+	StoppedAt   *time.Time  `json:"stopped_at,omitempty"` // when it was stopped or its process exited
 }
 
+// ArchivedInstance is a stopped or failed instance the agent moved out of
+// its live instances once it had been down for the archive retention.
+type ArchivedInstance struct {
+	ProxyInstance
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// QuotaStatus is the agent's bandwidth quota and the usage of each egress
+// IP in the current period.
+type QuotaStatus struct {
+	LimitBytes  int64        `json:"limit_bytes"` // 0 = no quota
+	Reset       string       `json:"reset"`
+	PeriodStart time.Time    `json:"period_start"`
+	NextReset   time.Time    `json:"next_reset"`
+	Usage       []QuotaUsage `json:"usage"`
+}
+
+type QuotaUsage struct {
+	IP        string `json:"ip"`
+	UsedBytes int64  `json:"used_bytes"`
+	Exceeded  bool   `json:"exceeded"`
+}
+
+// InstanceStatus is served by a native proxy instance on its loopback
+// status endpoint. Counters are cumulative since the instance started.
+type InstanceStatus struct {
+	ID                string        `json:"id"`
+	Protocol          ProxyProtocol `json:"protocol"`
+	Healthy           bool          `json:"healthy"`
+	UptimeSeconds     float64       `json:"uptime_seconds"`
+	ActiveConnections int64         `json:"active_connections"`
+	RequestsTotal     int64         `json:"requests_total"`
+	ConnectsTotal     int64         `json:"connects_total"`
+	BytesSent         int64         `json:"bytes_sent"`     // to clients
+	BytesReceived     int64         `json:"bytes_received"` // from clients
+	ErrorsTotal       int64         `json:"errors_total"`
+	DeniedTotal       int64         `json:"denied_total"`
+	RejectedTotal     int64         `json:"rejected_total"` // over the client limit
+	LastRequest       time.Time     `json:"last_request,omitempty"`
+}
+
+// ProxyProtocol is the protocol a proxy instance speaks to its clients.
+type ProxyProtocol string
+
+const (
+	ProxyProtocolHTTP   ProxyProtocol = "http" // HTTP forward proxy with CONNECT
+	ProxyProtocolSOCKS5 ProxyProtocol = "socks5"
+)
+
 type ProxyStatus string
 
 const (
@@ -29,6 +91,8 @@ const (
 	ProxyStatusRunning  ProxyStatus = "running"
 	ProxyStatusStopped  ProxyStatus = "stopped"
 	ProxyStatusError    ProxyStatus = "error"
+	ProxyStatusQuotaExceeded ProxyStatus = "quota_exceeded" // running, but out of bandwidth until the quota resets
+	ProxyStatusPaused   ProxyStatus = "paused" // its interface lost its link, waiting for it to come back
 )
 
 type ProxyMetrics struct {
@@ -40,11 +104,376 @@ type ProxyMetrics struct {
 }
 
 type NodeInfo struct {
-	NodeID    string          `json:"node_id"`
-	Hostname  string          `json:"hostname"`
-	Region    string          `json:"region"`
-	Proxies   []ProxyInstance `json:"proxies"`
-	UpdatedAt time.Time       `json:"updated_at"`
+	NodeID       string          `json:"node_id"`
+	Hostname     string          `json:"hostname"`
+	Region       string          `json:"region"`
+	Proxies      []ProxyInstance `json:"proxies"`
+	Capabilities *Capabilities   `json:"capabilities,omitempty"`
+	APIURL       string          `json:"api_url,omitempty"`  // where the coordinator reaches the agent API
+	APIPort      int             `json:"api_port,omitempty"` // used with the report's source IP when APIURL is empty
+	APIToken     string          `json:"api_token,omitempty"` // required by the agent API; the coordinator keeps it out of its store
+	UpdatedAt    time.Time       `json:"updated_at"`
+	ClockSkewMs  int64           `json:"clock_skew_ms,omitempty"` // how far the agent's clock is ahead of the coordinator's, set by the coordinator
+	Sequence     uint64          `json:"sequence,omitempty"` // of the last report applied, full or delta
+	Maintenance  bool            `json:"maintenance,omitempty"` // the agent runs with --maintenance and asks to be drained
+	Weight       float64         `json:"weight,omitempty"`      // capacity relative to other nodes; 0 = one share per exit
+	Provider     string          `json:"provider,omitempty"`    // who the node's bandwidth is bought from
+	CostPerGB    *float64        `json:"cost_per_gb,omitempty"` // egress price per GB (10^9 bytes); nil = unpriced
+	Draining     bool            `json:"draining,omitempty"`    // drained by the coordinator, set when listing nodes
+}
+
+// NodeDelta is a node report that only carries the instances that changed
+// since the report before it, which had Sequence-1. Node fields are always
+// sent in full. Instances are not compared on LastChecked, so that only
+// refreshes with full reports.
+type NodeDelta struct {
+	Sequence     uint64          `json:"sequence"`
+	Hostname     string          `json:"hostname"`
+	Region       string          `json:"region"`
+	Capabilities *Capabilities   `json:"capabilities,omitempty"`
+	APIURL       string          `json:"api_url,omitempty"`
+	APIPort      int             `json:"api_port,omitempty"`
+	APIToken     string          `json:"api_token,omitempty"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	Maintenance  bool            `json:"maintenance,omitempty"`
+	Weight       float64         `json:"weight,omitempty"`
+	Provider     string          `json:"provider,omitempty"`
+	CostPerGB    *float64        `json:"cost_per_gb,omitempty"`
+	Changed      []ProxyInstance `json:"changed,omitempty"` // new or updated instances
+	Removed      []string        `json:"removed,omitempty"` // IDs of instances gone since
+}
+
+// Heartbeat summarises one node report, kept as the node's history.
+type Heartbeat struct {
+	NodeID     string    `json:"node_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Proxies    int       `json:"proxies"`
+	Running    int       `json:"running"`
+}
+
+// Capabilities describes what an agent's proxy backend can carry. Agents
+// that predate capability reporting send none.
+type Capabilities struct {
+	Backend    string `json:"backend"`
+	HTTP       bool   `json:"http"`
+	Connect    bool   `json:"connect"`
+	SOCKS5     bool   `json:"socks5"`
+	UDP        bool   `json:"udp"`
+	Auth       bool   `json:"auth"`
+	MaxClients int    `json:"max_clients"`
+}
+
+// TunnelInfo describes an active CONNECT tunnel through the coordinator.
+type TunnelInfo struct {
+	ID          string    `json:"id"`
+	ClientIP    string    `json:"client_ip"`
+	User        string    `json:"user,omitempty"`
+	Destination string    `json:"destination"`
+	Exit        string    `json:"exit"`
+	NodeID      string    `json:"node_id"`
+	StartedAt   time.Time `json:"started_at"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	BytesSent   int64     `json:"bytes_sent"`
+	BytesRecv   int64     `json:"bytes_received"`
+	Intercepted bool      `json:"intercepted,omitempty"`
+	TLSProfile  string    `json:"tls_profile,omitempty"`
+	Streamed    bool      `json:"streamed,omitempty"` // a large HTTP download on the raw connection path
+}
+
+// LedgerEntry records use of an exit address by a client within one hour
+// bucket, so abuse reports for an IPv6+timestamp can be traced back.
+type LedgerEntry struct {
+	ExitIP      string    `json:"exit_ip"`
+	Exit        string    `json:"exit"`
+	NodeID      string    `json:"node_id"`
+	User        string    `json:"user,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	ClientIP    string    `json:"client_ip"`
+	Destination string    `json:"destination"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Requests    int64     `json:"requests"`
+}
+
+// UsageRollup is the traffic a proxy user sent through the coordinator in
+// one hour, for billing. BytesSent went from the client to destinations
+// and BytesReceived back. Cost is what both cost at the egress prices
+// of the nodes that carried them.
+type UsageRollup struct {
+	Hour          time.Time `json:"hour"`
+	Tenant        string    `json:"tenant,omitempty"`
+	User          string    `json:"user,omitempty"`
+	Requests      int64     `json:"requests"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Cost          float64   `json:"cost"`
+}
+
+// TrafficPoint is the proxy traffic of one step of a TrafficSeries,
+// starting at Time. Bytes counts both directions.
+type TrafficPoint struct {
+	Time     time.Time `json:"time"`
+	Requests int64     `json:"requests"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// TrafficSeries is the recent proxy traffic through the coordinator in
+// steps of StepSeconds, oldest first, in total and per node. Every series
+// covers the same steps.
+type TrafficSeries struct {
+	StepSeconds int                       `json:"step_seconds"`
+	Total       []TrafficPoint            `json:"total"`
+	Nodes       map[string][]TrafficPoint `json:"nodes"`
+}
+
+// MaintenanceWindow takes the matching nodes out of rotation between Start
+// and End. Nodes holds node IDs or patterns such as "edge-*", with "*"
+// covering the whole pool.
+type MaintenanceWindow struct {
+	ID        string    `json:"id"`
+	Nodes     []string  `json:"nodes"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Active    bool      `json:"active"`
+}
+
+// Node command types. Drain and undrain act on the coordinator's pool; the
+// others are carried out by the node's agent.
+const (
+	CommandStopProxy           = "stop_proxy"
+	CommandRestartProxy        = "restart_proxy"
+	CommandRotateIP            = "rotate_ip"
+	CommandUpdateAccessControl = "update_access_control"
+	CommandDrain               = "drain"
+	CommandUndrain             = "undrain"
+)
+
+// Node command states.
+const (
+	CommandQueued    = "queued"    // waiting for the agent to fetch it
+	CommandDelivered = "delivered" // fetched, result not reported yet
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+	CommandExpired   = "expired" // the agent did not fetch it in time
+)
+
+// NodeCommand is an instruction for one node, delivered to its agent over
+// the command channel. InstanceID is the target of stop_proxy,
+// restart_proxy and rotate_ip, IPv6 the address rotate_ip moves it to (a
+// fresh one when empty), and Mode and AllowedIPs the new access control of
+// update_access_control.
+type NodeCommand struct {
+	ID          string         `json:"id"`
+	NodeID      string         `json:"node_id"`
+	Type        string         `json:"type"`
+	InstanceID  string         `json:"instance_id,omitempty"`
+	IPv6        string         `json:"ipv6,omitempty"`
+	Mode        string         `json:"mode,omitempty"`
+	AllowedIPs  []string       `json:"allowed_ips,omitempty"`
+	Status      string         `json:"status"`
+	Result      *CommandResult `json:"result,omitempty"`
+	Deliveries  int            `json:"deliveries"`
+	CreatedAt   time.Time      `json:"created_at"`
+	DeliveredAt time.Time      `json:"delivered_at,omitempty"`
+	FinishedAt  time.Time      `json:"finished_at,omitempty"`
+}
+
+// CommandResult is the agent's answer to a command: the status and body
+// its API responded with.
+type CommandResult struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+// PoolExit is one running exit in pool snapshots and diffs.
+type PoolExit struct {
+	Address  string        `json:"address"` // [ip]:port
+	IP       string        `json:"ip"`
+	Port     int           `json:"port"`
+	Protocol ProxyProtocol `json:"protocol"`
+	NodeID   string        `json:"node_id"`
+	Region   string        `json:"region,omitempty"` // of the node
+	Name     string        `json:"name,omitempty"`
+	Tags     []string      `json:"tags,omitempty"`
+	Pools    []string      `json:"pools,omitempty"`
+	Username string        `json:"username,omitempty"`
+	Password string        `json:"password,omitempty"`
+}
+
+// PoolSnapshot is the full set of running exits. Timestamp can be passed
+// as since to the pool diff endpoint.
+type PoolSnapshot struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Exits     []PoolExit `json:"exits"`
+}
+
+// PoolDiff lists the exits that joined and left the pool between Since
+// and Timestamp.
+type PoolDiff struct {
+	Since     time.Time  `json:"since"`
+	Timestamp time.Time  `json:"timestamp"`
+	Added     []PoolExit `json:"added"`
+	Removed   []PoolExit `json:"removed"`
+}
+
+// AbuseReport is an operator-submitted complaint about an exit address at
+// a point in time, resolved against the usage ledger.
+type AbuseReport struct {
+	ID            string        `json:"id"`
+	IP            string        `json:"ip"`
+	Timestamp     time.Time     `json:"timestamp"`
+	WindowMinutes int           `json:"window_minutes,omitempty"`
+	Note          string        `json:"note,omitempty"`
+	Quarantine    bool          `json:"quarantine,omitempty"`
+	ReceivedAt    time.Time     `json:"received_at"`
+	Users         []string      `json:"users"`
+	ClientIPs     []string      `json:"client_ips"`
+	Destinations  []string      `json:"destinations"`
+	Nodes         []string      `json:"nodes"`
+	Matches       []LedgerEntry `json:"matches"`
+	Quarantined   []string      `json:"quarantined,omitempty"`
+}
+
+// QuarantinedExit is an exit address excluded from selection entirely.
+type QuarantinedExit struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// Lease reserves an egress IP for one client's exclusive use until
+// ExpiresAt. Its exits leave the coordinator's shared selection, and the
+// client connects to them directly.
+type Lease struct {
+	ID        string       `json:"id"`
+	IP        string       `json:"ip"`
+	NodeID    string       `json:"node_id"`
+	Holder    string       `json:"holder,omitempty"` // who took it, for reference
+	Batch     string       `json:"batch,omitempty"` // the lease batch it was taken in
+	Exits     []LeasedExit `json:"exits"`
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt time.Time    `json:"expires_at"`
+}
+
+// StickySession is the exit a client IP is kept on by the sticky-client
+// strategy, until ExpiresAt unless the client sends more requests.
+type StickySession struct {
+	Client    string    `json:"client"`
+	Exit      string    `json:"exit"` // [ip]:port
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LeasedExit is how a lease holder reaches one exit of the leased IP.
+type LeasedExit struct {
+	InstanceID string `json:"instance_id"`
+	Address    string `json:"address"` // [ip]:port
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	ProxyURL   string `json:"proxy_url"` // for HTTP_PROXY, credentials included
+}
+
+// LeaseRequest is the body of POST /api/leases. Without an IP the
+// coordinator leases a free exit, of Pool when one is named.
+type LeaseRequest struct {
+	IP         string `json:"ip,omitempty"`
+	Pool       string `json:"pool,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"` // 1 hour when 0
+	Holder     string `json:"holder,omitempty"`
+}
+
+// What the exits of a lease batch are guaranteed to differ in. Every batch
+// has distinct addresses; prefix also keeps them in different /64s, node
+// on different nodes.
+const (
+	LeaseDistinctAddress = "address"
+	LeaseDistinctPrefix  = "prefix"
+	LeaseDistinctNode    = "node"
+)
+
+// LeaseBatchRequest is the body of POST /api/lease-batches: Count free
+// exits leased together, or none at all.
+type LeaseBatchRequest struct {
+	Count      int    `json:"count"`
+	Distinct   string `json:"distinct,omitempty"` // address when empty
+	Pool       string `json:"pool,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"` // 1 hour when 0
+	Holder     string `json:"holder,omitempty"`
+}
+
+// LeaseBatch is a set of leases taken together, with a shared expiry.
+// Leases released on their own leave the batch; ExpiresAt is the soonest
+// expiry of the rest.
+type LeaseBatch struct {
+	ID        string    `json:"id"`
+	Holder    string    `json:"holder,omitempty"`
+	Leases    []Lease   `json:"leases"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DrainProgress is how far the drain of a node, or of the coordinator
+// itself when NodeID is empty, has come. EstimatedCompletion extrapolates
+// the rate work finished at since the drain began, and is absent until
+// some has.
+type DrainProgress struct {
+	NodeID              string     `json:"node_id,omitempty"`
+	Draining            bool       `json:"draining"`
+	Since               time.Time  `json:"since,omitempty"`
+	Requests            int64      `json:"requests"` // plain HTTP requests in flight
+	Tunnels             int64      `json:"tunnels"`
+	Queued              int        `json:"queued,omitempty"` // coordinator only: requests waiting for an exit
+	InitialInFlight     int64      `json:"initial_in_flight"`
+	OldestTunnel        time.Time  `json:"oldest_tunnel,omitempty"`
+	Quiescent           bool       `json:"quiescent"`
+	EstimatedCompletion *time.Time `json:"estimated_completion,omitempty"`
+}
+
+// DrainStatus is the drain progress of the coordinator and its drained
+// nodes.
+type DrainStatus struct {
+	Coordinator DrainProgress   `json:"coordinator"`
+	Nodes       []DrainProgress `json:"nodes"`
+}
+
+// DuplicateAddress is an address more than one node reports a proxy on.
+// Its exits stay out of the pool until only one node reports it.
+type DuplicateAddress struct {
+	IP    string    `json:"ip"`
+	Nodes []string  `json:"nodes"`
+	Since time.Time `json:"since"`
+}
+
+// TransportSettings tunes the coordinator's pooled upstream connections.
+type TransportSettings struct {
+	MaxIdleConns           int `json:"max_idle_conns"`
+	MaxIdleConnsPerHost    int `json:"max_idle_conns_per_host"`
+	IdleConnTimeoutSeconds int `json:"idle_conn_timeout_seconds"`
+}
+
+// TransportStats describes connection reuse towards a single exit.
+type TransportStats struct {
+	Exit       string  `json:"exit"`
+	Dials      int64   `json:"dials"`
+	DialErrors int64   `json:"dial_errors"`
+	Requests   int64   `json:"requests"`
+	Reused     int64   `json:"reused"`
+	ReuseRatio float64 `json:"reuse_ratio"`
+	OpenConns  int64   `json:"open_conns"`
+	InFlight   int64   `json:"in_flight"`
+	IdleConns  int64   `json:"idle_conns"` // open connections not serving a request
+}
+
+// FaultConfig injects failures on the coordinator proxy port so client
+// retry behaviour can be tested against a staging coordinator.
+type FaultConfig struct {
+	DropPercent     float64  `json:"drop_percent"`      // requests whose connection is closed without a response
+	ErrorPercent    float64  `json:"error_percent"`     // requests answered with ErrorStatus
+	ErrorStatus     int      `json:"error_status"`      // defaults to 503
+	LatencyMs       int      `json:"latency_ms"`        // added before forwarding
+	LatencyJitterMs int      `json:"latency_jitter_ms"` // random extra latency up to this value
+	FailExits       []string `json:"fail_exits"`        // exit addresses, IPs or node IDs that always fail
 }
 
 type Config struct {
@@ -58,16 +487,583 @@ type AgentConfig struct {
 	ProxyStartPort  int      `json:"proxy_start_port"`
 	ProxyEndPort    int      `json:"proxy_end_port"`
 	CoordinatorURL  string   `json:"coordinator_url"`
+	NodeID          string   `json:"node_id"`          // reported to the coordinator; default: the hostname
+	ReportInterval  time.Duration `json:"report_interval"` // between reports to the coordinator
 	MetricsPort     int      `json:"metrics_port"`
 	ExcludeInterfaces []string `json:"exclude_interfaces"`
 	AllowedIPs      []string `json:"allowed_ips"`      // IPs allowed to connect to proxies
 	ProxyMode       string   `json:"proxy_mode"`       // "open" or "restricted"
+	StandbyProxies  int      `json:"standby_proxies"`  // running proxies kept in reserve
+	WarmupURLs      []string `json:"warmup_urls"`      // requested through new proxies before use
+	WarmupTimeout   time.Duration `json:"warmup_timeout"`
+	EgressCheckURL  string   `json:"egress_check_url"` // IP echo service to verify egress through
+	EgressCheckTimeout time.Duration `json:"egress_check_timeout"`
+	Hooks           []LifecycleHook `json:"hooks"`
+	EventSinks      []string `json:"event_sinks"`      // where lifecycle events go: "log", "coordinator", "webhook"
+	EventWebhook    string   `json:"event_webhook"`    // URL the webhook sink posts events to
+	ProxyBackend    string   `json:"proxy_backend"`    // "tinyproxy", "3proxy" or "embedded"
+	HealthInterval  time.Duration `json:"health_interval"` // how often running instances are checked
+	ProxyAuth       bool     `json:"proxy_auth"`       // require basic auth on every instance
+	ProxyUsername   string   `json:"proxy_username"`   // shared credentials; generated per instance when empty
+	ProxyPassword   string   `json:"proxy_password"`
+	APIKey          string   `json:"api_key"`          // presented to the coordinator when reporting
+	AdvertiseURL    string   `json:"advertise_url"`    // agent API URL reported to the coordinator
+	APIToken        string   `json:"api_token"`        // required on agent API calls except /health when set
+	TLSCert         string   `json:"tls_cert"`         // client certificate presented to the coordinator
+	TLSKey          string   `json:"tls_key"`
+	TLSCA           string   `json:"tls_ca"`           // CA that must have signed the coordinator's certificate
+	IPv6Prefix      string   `json:"ipv6_prefix"`      // routed prefix to allocate addresses from
+	IPv6Interface   string   `json:"ipv6_interface"`   // interface to add them to (default: the prefix's route)
+	IPv6Count       int      `json:"ipv6_count"`       // addresses to keep allocated from the prefix
+	SOCKS5          bool     `json:"socks5"`           // also serve SOCKS5 on every address
+	AggregatePort   int      `json:"aggregate_port"`   // node-local port rotating across this node's exits
+	Region          string   `json:"region"`
+	MetricsGranularity string `json:"metrics_granularity"` // "exit", "node" or "region"
+	MetricsMaxExits int      `json:"metrics_max_exits"` // exit series before summing per node
+	QuotaMB         int64    `json:"quota_mb"`          // bandwidth per egress IP and period; 0 = no quota
+	QuotaReset      string   `json:"quota_reset"`       // "hourly", "daily", "weekly" or "monthly"
+	InstanceLabels  []InstanceLabel `json:"instance_labels"`
+	StateFile       string   `json:"state_file"`        // running proxy processes, for recovery after a crash
+	AdoptProxies    bool     `json:"adopt_proxies"`     // take over processes left running instead of stopping them
+	ArchiveFile     string   `json:"archive_file"`      // stopped and failed instances moved out of the live ones
+	ArchiveAfter    time.Duration `json:"archive_after"` // how long an instance is down before it is archived; 0 = never
+	ArchiveKeep     int      `json:"archive_keep"`      // archived instances kept; 0 = all
+	MaxLogSizeMB    int64    `json:"max_log_size_mb"`   // instance log size that triggers rotation; 0 = never
+	LogKeep         int      `json:"log_keep"`          // rotated copies kept of each instance log
+	DiskWarnPercent float64  `json:"disk_warn_percent"` // disk usage that is warned about and truncates logs; 0 = off
+	HousekeepingInterval time.Duration `json:"housekeeping_interval"` // between log rotation and disk checks; 0 = never
+	MaxClockSkew    time.Duration `json:"max_clock_skew"` // warn when the coordinator's clock is further off
+	FullReportInterval time.Duration `json:"full_report_interval"` // between full reports, with deltas in between; 0 = full only
+	LinkCheckInterval time.Duration `json:"link_check_interval"` // how often instance interfaces are checked for a link; 0 = never
+	WatchAddresses  bool     `json:"watch_addresses"`   // start and stop proxies as public IPv6 addresses come and go
+	Maintenance     bool     `json:"maintenance"`       // report the node as in maintenance, so the coordinator drains it
+	DrainTimeout    time.Duration `json:"drain_timeout"` // how long shutdown waits for open connections
+	Weight          float64  `json:"weight"`            // capacity weight reported to the coordinator; 0 = measured or none
+	WeightFrom      string   `json:"weight_from"`       // what the weight is measured from: "cpu" or "bandwidth"
+	Provider        string   `json:"provider"`          // who the node's bandwidth is bought from
+	CostPerGB       *float64 `json:"cost_per_gb"`       // egress price per GB reported to the coordinator; nil = unpriced
+}
+
+// InstanceLabel names, tags and assigns to pools the instances on
+// addresses matching Match: an IPv6 address, a CIDR prefix or "*". Name may
+// use the placeholders {ip}, {port} and {protocol}. The first matching rule
+// applies.
+type InstanceLabel struct {
+	Match string   `json:"match"`
+	Name  string   `json:"name,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Pools []string `json:"pools,omitempty"`
+}
+
+// LifecycleHook runs a shell command or posts to a webhook when a proxy
+// instance reaches Event ("pre-start", "post-start", "pre-stop" or
+// "on-error"). A failing pre-start hook aborts the start.
+type LifecycleHook struct {
+	Event          string `json:"event"`
+	Command        string `json:"command,omitempty"`
+	URL            string `json:"url,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+// Proxy lifecycle event types, emitted by agents on every transition of an
+// instance. health-passed follows a start, a recovery and a resume;
+// degraded a failed health check, a paused link or an exhausted quota.
+const (
+	ProxyEventCreated      = "created"
+	ProxyEventHealthPassed = "health-passed"
+	ProxyEventDegraded     = "degraded"
+	ProxyEventRotated      = "rotated" // moved to another address, PreviousIP is the old one
+	ProxyEventStopped      = "stopped"
+	ProxyEventDied         = "died" // its backend exited on its own
+)
+
+// ProxyEvent is one lifecycle transition of a proxy instance.
+type ProxyEvent struct {
+	Type       string        `json:"type"`
+	NodeID     string        `json:"node_id"`
+	InstanceID string        `json:"instance_id"`
+	IP         string        `json:"ip"`
+	PreviousIP string        `json:"previous_ip,omitempty"`
+	Port       int           `json:"port"`
+	Protocol   ProxyProtocol `json:"protocol"`
+	Backend    string        `json:"backend,omitempty"`
+	Status     ProxyStatus   `json:"status"`
+	Reason     string        `json:"reason,omitempty"`
+	Time       time.Time     `json:"time"`
+}
+
+// Cluster event types, streamed by the coordinator from GET /api/events.
+// proxy-status is any other status change of an instance between two
+// reports of its node; a proxy event relays a lifecycle event an agent
+// posted.
+const (
+	ClusterEventNodeJoined    = "node-joined"
+	ClusterEventNodeLeft      = "node-left"
+	ClusterEventProxyStatus   = "proxy-status"
+	ClusterEventExitHealthy   = "exit-healthy"
+	ClusterEventExitUnhealthy = "exit-unhealthy"
+	ClusterEventQuotaExceeded = "quota-exceeded"
+	ClusterEventQuotaReset    = "quota-reset"
+	ClusterEventProxy         = "proxy"
+)
+
+// ClusterEvent is one change the coordinator saw in the cluster. IDs
+// increase by one with every event since the coordinator started.
+type ClusterEvent struct {
+	ID             uint64      `json:"id"`
+	Type           string      `json:"type"`
+	NodeID         string      `json:"node_id,omitempty"`
+	InstanceID     string      `json:"instance_id,omitempty"`
+	Address        string      `json:"address,omitempty"`
+	Status         ProxyStatus `json:"status,omitempty"`
+	PreviousStatus ProxyStatus `json:"previous_status,omitempty"`
+	Reason         string      `json:"reason,omitempty"`
+	Proxy          *ProxyEvent `json:"proxy,omitempty"` // set on proxy events
+	Time           time.Time   `json:"time"`
 }
 
 type CoordinatorConfig struct {
 	ListenPort     int      `json:"listen_port"`
 	ProxyPort      int      `json:"proxy_port"`
+	HTTP3Port      int      `json:"http3_port"` // UDP port of the experimental HTTP/3 proxy listener; 0 = off
+	HTTP3Cert      string   `json:"http3_cert"` // certificate the HTTP/3 listener presents
+	HTTP3Key       string   `json:"http3_key"`
 	MetricsPort    int      `json:"metrics_port"`
 	AgentEndpoints []string `json:"agent_endpoints"`
 	HealthCheckInterval time.Duration `json:"health_check_interval"`
+	Users          []User   `json:"users"`
+	AuditLogPath   string   `json:"audit_log_path"`
+	BanRules       []BanRule `json:"ban_rules"`
+	BanLists       []string `json:"ban_lists"` // ban list files imported at startup
+	RewriteRules   []RewriteRule `json:"rewrite_rules"`
+	ReuseRules     []ReuseRule `json:"reuse_rules"`
+	PrefixOrigins  []PrefixOrigin `json:"prefix_origins"`
+	Pools          []ProxyPool `json:"pools"`
+	Tenants        []Tenant `json:"tenants"`
+	Webhooks       []Webhook `json:"webhooks"`
+	AlertRules     []AlertRule `json:"alert_rules"`
+	Notifiers      []Notifier `json:"notifiers"`
+	AlertInterval  time.Duration `json:"alert_interval"` // between evaluations of the alert rules
+	ContentPolicy  ContentPolicy `json:"content_policy"`
+	OutlierPolicy  OutlierPolicy `json:"outlier_detection"`
+	PrefixWarmup   PrefixWarmup `json:"prefix_warmup"`
+	LedgerPath     string   `json:"ledger_path"`
+	LedgerRetention time.Duration `json:"ledger_retention"`
+	PoolHistoryRetention time.Duration `json:"pool_history_retention"`
+	MaintenancePath string  `json:"maintenance_path"`
+	NodeReportMaxBytes int64 `json:"node_report_max_bytes"`
+	NodeReportMaxProxies int `json:"node_report_max_proxies"`
+	Store          string   `json:"store"` // state backend, "sqlite" by default
+	StorePath      string   `json:"store_path"` // SQLite database file
+	HeartbeatRetention time.Duration `json:"heartbeat_retention"` // how long node report history is kept
+	MaxClockSkew time.Duration `json:"max_clock_skew"` // warn about nodes whose clock is further off (0 = off)
+	PreResolve     bool     `json:"pre_resolve"` // pin destinations to one AAAA record
+	LBStrategy     string   `json:"lb_strategy"` // round-robin, least-connections, sticky-client or least-cost
+	StickyTTL      time.Duration `json:"sticky_ttl"` // how long an idle sticky-client session keeps its exit
+	EgressHeaders  bool     `json:"egress_headers"` // X-Egress-IP/X-Egress-Node on responses
+	RetryAttempts  int      `json:"retry_attempts"` // exits tried per failed request
+	RetryConnectOnly bool   `json:"retry_connect_only"`
+	StreamThresholdMB int64 `json:"stream_threshold_mb"` // downloads this large take the raw path; 0 = never
+	PassiveHealthFailures int `json:"passive_health_failures"` // failed requests in a row that mark an exit unhealthy
+	PassiveHealthRecovery time.Duration `json:"passive_health_recovery"` // delay between trial requests
+	ShedMaxLag     time.Duration `json:"shed_max_lag"` // 0 = no lag-based shedding
+	ShedMaxMemoryMB int     `json:"shed_max_memory_mb"` // 0 = no memory-based shedding
+	MaxConnsPerExit int     `json:"max_conns_per_exit"`
+	BatchSharePercent int   `json:"batch_share_percent"` // of each exit's limit batch requests may hold
+	QueueSize      int      `json:"queue_size"`
+	QueueTimeout   time.Duration `json:"queue_timeout"`
+	RateLimit      float64  `json:"rate_limit"`       // proxy requests per second per client; 0 = unlimited
+	RateLimitBurst int      `json:"rate_limit_burst"`
+	RateLimitBy    string   `json:"rate_limit_by"`    // "ip" or "user"
+	TrustedProxies []string `json:"trusted_proxies"`
+	ProxyProtocol  bool     `json:"proxy_protocol"`
+	MITMCACert     string   `json:"mitm_ca_cert"`
+	MITMCAKey      string   `json:"mitm_ca_key"`
+	TLSProfile     string   `json:"tls_profile"`
+	MITMDestinations []string `json:"mitm_destinations"`
+	APIKeysFile    string   `json:"api_keys_file"`
+	TLSCert        string   `json:"tls_cert"`      // serve the API over HTTPS with this certificate
+	TLSKey         string   `json:"tls_key"`
+	TLSClientCA    string   `json:"tls_client_ca"` // agents and clients must present a certificate from this CA
+	ReplicaOf      string   `json:"replica_of"` // primary coordinator API URL; set for a read replica
+	ReplicaInterval time.Duration `json:"replica_interval"`
+	ReplicaAPIKey  string   `json:"replica_api_key"`
+	ReplicaTLSCert string   `json:"replica_tls_cert"` // client certificate for the primary's mutual TLS
+	ReplicaTLSKey  string   `json:"replica_tls_key"`
+	ReplicaTLSCA   string   `json:"replica_tls_ca"`
+}
+
+// ConfigValidation is the outcome of checking a candidate config file
+// without applying it. Errors would stop a restart with it; warnings name
+// keys it would ignore.
+type ConfigValidation struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// ReplicationState is what a read replica copies from the primary
+// coordinator. Users carry their passwords, since the replica checks proxy
+// credentials itself.
+type ReplicationState struct {
+	GeneratedAt    time.Time         `json:"generated_at"`
+	Nodes          []NodeInfo        `json:"nodes"`
+	Users          []User            `json:"users"`
+	DrainedNodes   []string          `json:"drained_nodes"`
+	Quarantined    []QuarantinedExit `json:"quarantined"`
+	Leases         []Lease           `json:"leases"`
+	StickySessions []StickySession   `json:"sticky_sessions"`
+	BanRules       []BanRule         `json:"ban_rules"`
+	RewriteRules   []RewriteRule     `json:"rewrite_rules"`
+	ReuseRules     []ReuseRule       `json:"reuse_rules"`
+	PrefixOrigins  []PrefixOrigin    `json:"prefix_origins"`
+	Pools          []ProxyPool       `json:"pools"`
+	Tenants        []Tenant          `json:"tenants"`
+	ContentPolicy  ContentPolicy     `json:"content_policy"`
+	OutlierPolicy  OutlierPolicy     `json:"outlier_policy"`
+	ExitHealth     []ExitHealth      `json:"exit_health"`
+}
+
+// ExitHealth is the outcome of a coordinator's connect check of an exit.
+type ExitHealth struct {
+	Address   string    `json:"address"`
+	Reachable bool      `json:"reachable"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ReplicationStatus is a coordinator's place in replication. Replicas
+// report when they last copied the primary's state and why the last
+// attempt failed.
+type ReplicationStatus struct {
+	Role       string     `json:"role"` // "primary" or "replica"
+	Primary    string     `json:"primary,omitempty"`
+	LastSync   *time.Time `json:"last_sync,omitempty"`
+	LagSeconds float64    `json:"lag_seconds,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	Nodes      int        `json:"nodes"`
+}
+
+// RewriteRule mutates proxied HTTP responses from matching destinations.
+// LocationTarget replaces the scheme and host of Location headers that
+// point at loopback, private or link-local addresses (or InternalHosts).
+type RewriteRule struct {
+	Destination    string   `json:"destination"` // host pattern, "*" for all
+	StripCookies   bool     `json:"strip_cookies,omitempty"`
+	StripHeaders   []string `json:"strip_headers,omitempty"`
+	LocationTarget string   `json:"location_target,omitempty"`
+	InternalHosts  []string `json:"internal_hosts,omitempty"`
+}
+
+// BanRule describes target responses that indicate an exit has been banned
+// by a destination. A response matches when its status is listed in
+// StatusCodes or its body contains one of BodyMarkers.
+type BanRule struct {
+	Destination string   `json:"destination"` // host pattern, "*" for all
+	StatusCodes []int    `json:"status_codes,omitempty"`
+	BodyMarkers []string `json:"body_markers,omitempty"`
+	BanSeconds  int      `json:"ban_seconds"`
+}
+
+// ReuseRule caps how often one exit is used against matching destination
+// hosts: an exit that carried MaxUses requests or tunnels to a host within
+// the last WindowSeconds is skipped for that host until older uses age out.
+// Matching destinations get a random exit among those still under the cap.
+type ReuseRule struct {
+	Destination   string `json:"destination"` // host pattern, "*" for all
+	MaxUses       int    `json:"max_uses"`
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+// ExitBan is an exit temporarily excluded for a single destination host.
+type ExitBan struct {
+	Exit      string    `json:"exit"`
+	NodeID    string    `json:"node_id"`
+	Host      string    `json:"host"`
+	Reason    string    `json:"reason"`
+	BannedAt  time.Time `json:"banned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BanList is a portable set of exit bans, exported by one coordinator and
+// imported by another or loaded from files.
+type BanList struct {
+	GeneratedAt time.Time      `json:"generated_at"`
+	Entries     []BanListEntry `json:"entries"`
+}
+
+// BanListEntry keeps the exits on Prefix, an address or CIDR prefix, away
+// from destinations matching Destination until ExpiresAt. Without
+// ExpiresAt the entry lasts TTLSeconds from its import, or for good when
+// that is 0 too. Exports set both.
+type BanListEntry struct {
+	Prefix      string     `json:"prefix"`
+	Destination string     `json:"destination"` // host pattern, "*" for all
+	Reason      string     `json:"reason,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds  int64      `json:"ttl_seconds,omitempty"`
+}
+
+// OutlierPolicy ejects exits that accept connections but fail requests. An
+// exit whose failures reach ErrorRatePercent of at least MinRequests
+// requests within WindowSeconds is left out of selection for EjectSeconds.
+// Requests slower than SlowMs (0 = off) count as failures. At most
+// MaxEjectedPercent of the pool is ejected at once. A zero ErrorRatePercent
+// disables ejection.
+type OutlierPolicy struct {
+	ErrorRatePercent  int `json:"error_rate_percent"`
+	MinRequests       int `json:"min_requests"`
+	WindowSeconds     int `json:"window_seconds"`
+	SlowMs            int `json:"slow_ms,omitempty"`
+	EjectSeconds      int `json:"eject_seconds"`
+	MaxEjectedPercent int `json:"max_ejected_percent"`
+}
+
+// PrefixWarmup ramps the exits of a prefix the coordinator has not seen
+// before into rotation over Hours instead of all at once. An exit on a new
+// prefix takes StartPercent of the share of traffic an established exit
+// gets, growing along Curve until Hours have passed:
+//
+//   - "linear" grows the share by the same amount every hour
+//   - "exponential" multiplies it by the same factor every hour
+//   - "steps" holds Percent from each step's AfterHours on
+//
+// Prefixes are the first PrefixLength bits of the exit address (64 when
+// unset). A zero Hours disables warm-up.
+type PrefixWarmup struct {
+	Hours        float64      `json:"hours"`
+	Curve        string       `json:"curve,omitempty"`
+	StartPercent float64      `json:"start_percent,omitempty"`
+	Steps        []WarmupStep `json:"steps,omitempty"`
+	PrefixLength int          `json:"prefix_length,omitempty"`
+}
+
+// WarmupStep is a point of a "steps" warm-up curve.
+type WarmupStep struct {
+	AfterHours float64 `json:"after_hours"`
+	Percent    float64 `json:"percent"`
+}
+
+// WarmingPrefix is a prefix whose exits are still being ramped in.
+type WarmingPrefix struct {
+	Prefix    string    `json:"prefix"`
+	FirstSeen time.Time `json:"first_seen"`
+	Percent   float64   `json:"percent"` // of an established exit's share
+	Exits     int       `json:"exits"`
+	WarmUntil time.Time `json:"warm_until"`
+}
+
+// OutlierEjection is an exit taken out of rotation for failing requests.
+type OutlierEjection struct {
+	Exit      string    `json:"exit"`
+	NodeID    string    `json:"node_id"`
+	Requests  int       `json:"requests"` // in the window that triggered it
+	Failures  int       `json:"failures"`
+	EjectedAt time.Time `json:"ejected_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// User is a credential accepted on the coordinator proxy port.
+type User struct {
+	Username     string            `json:"username"`
+	Password     string            `json:"password,omitempty"`
+	Destinations DestinationPolicy `json:"destinations"`
+	Schedule     []AccessWindow    `json:"schedule,omitempty"`
+	TLSProfile   string            `json:"tls_profile,omitempty"` // re-originate intercepted TLS with this ClientHello
+	Content      ContentPolicy     `json:"content,omitempty"`
+	Constraints  PoolConstraints   `json:"constraints,omitempty"`
+	Pool         string            `json:"pool,omitempty"` // named pool used when requests choose none
+	Priority     string            `json:"priority,omitempty"` // PriorityInteractive (default) or PriorityBatch
+	Tenant       string            `json:"tenant,omitempty"` // only uses the tenant's exits
+}
+
+// Priority classes of proxy requests. Under contention interactive requests
+// are served first and batch requests get a limited share of each exit.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// ProxyPool is a named group of exits clients can select, such as
+// "residential" or "datacenter". Its exits are those the agents assign to
+// it and, for agents that assign none, those in Prefixes.
+type ProxyPool struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Prefixes    []string `json:"prefixes,omitempty"` // CIDR
+}
+
+// PoolStatus is a named pool with how many of its exits are in rotation.
+type PoolStatus struct {
+	ProxyPool
+	Exits   int `json:"exits"`
+	Healthy int `json:"healthy"`
+}
+
+// Webhook posts every cluster event matching Events to URL, one event per
+// request. With a Secret each request is signed with HMAC-SHA256.
+type Webhook struct {
+	Name           string   `json:"name"`
+	URL            string   `json:"url"`
+	Secret         string   `json:"secret,omitempty"`
+	Events         []string `json:"events,omitempty"` // cluster event types or node_down, proxy_error, quota_exceeded; all when empty
+	Nodes          []string `json:"nodes,omitempty"`  // only events of these nodes
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"` // 10 when 0
+	MaxAttempts    int      `json:"max_attempts,omitempty"`    // 5 when 0
+}
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"  // gave up after the last attempt
+	DeliveryDropped   = "dropped" // the webhook's queue was full, or it was removed
+)
+
+// WebhookDelivery is one event sent, or being sent, to a webhook.
+type WebhookDelivery struct {
+	ID           string       `json:"id"`
+	Webhook      string       `json:"webhook"`
+	Event        ClusterEvent `json:"event"`
+	Status       string       `json:"status"`
+	Attempts     int          `json:"attempts"`
+	ResponseCode int          `json:"response_code,omitempty"` // of the last attempt
+	LastError    string       `json:"last_error,omitempty"`
+	NextAttempt  *time.Time   `json:"next_attempt,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+// WebhookStatus is a webhook, its secret left out, with the outcome of
+// its deliveries since the coordinator started.
+type WebhookStatus struct {
+	Webhook
+	Signed         bool       `json:"signed"`
+	Pending        int        `json:"pending"`
+	Delivered      int64      `json:"delivered"`
+	Failed         int64      `json:"failed"`
+	Dropped        int64      `json:"dropped"`
+	LastDelivered  *time.Time `json:"last_delivered,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// AlertRule raises an alert once Metric compared by Op with Threshold has
+// held for ForSeconds. Metrics starting with "node_" are watched on every
+// node, or only on Nodes, and each node is alerted about on its own.
+type AlertRule struct {
+	Name       string   `json:"name"`
+	Metric     string   `json:"metric"`
+	Op         string   `json:"op"` // <, <=, >, >=, == or !=
+	Threshold  float64  `json:"threshold"`
+	ForSeconds int      `json:"for_seconds,omitempty"`
+	Nodes      []string `json:"nodes,omitempty"`
+	Severity   string   `json:"severity,omitempty"`  // "warning" when empty
+	Notifiers  []string `json:"notifiers,omitempty"` // every notifier when empty
+}
+
+// Notifier is where alerts are sent. "slack" posts to the incoming webhook
+// URL, "telegram" has bot Token message ChatID, and "http" posts the alert
+// as JSON to URL.
+type Notifier struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	URL            string `json:"url,omitempty"` // the Bot API for telegram, https://api.telegram.org when empty
+	Token          string `json:"token,omitempty"`
+	ChatID         string `json:"chat_id,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"` // 10 when 0
+}
+
+// Alert states.
+const (
+	AlertPending  = "pending" // the condition holds, not yet for long enough
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is a rule whose condition holds, for one node when its metric is
+// per node.
+type Alert struct {
+	Rule       string     `json:"rule"`
+	Node       string     `json:"node,omitempty"`
+	Severity   string     `json:"severity"`
+	State      string     `json:"state"`
+	Metric     string     `json:"metric"`
+	Op         string     `json:"op"`
+	Threshold  float64    `json:"threshold"`
+	Value      float64    `json:"value"` // at the last evaluation
+	Since      time.Time  `json:"since"` // when the condition started to hold
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Reason     string     `json:"reason,omitempty"` // why it resolved without its metric recovering
+}
+
+// Tenant is a customer kept apart from the others. The exits of its nodes
+// and of its pools serve only its proxy users, and its API keys only see
+// those exits and its own users and usage.
+type Tenant struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Nodes       []string  `json:"nodes,omitempty"` // node IDs
+	Pools       []string  `json:"pools,omitempty"` // named pools
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TenantStatus is a tenant with its exits, users and the requests its
+// users sent within the ledger's retention.
+type TenantStatus struct {
+	Tenant
+	Exits    int   `json:"exits"`
+	Healthy  int   `json:"healthy"`
+	Users    int   `json:"users"`
+	Requests int64 `json:"requests"`
+}
+
+// PoolConstraints narrow the exits a request may use. With DistinctLast
+// the exit must lie outside the /DistinctPrefix networks of the client's
+// last DistinctLast exits; DistinctPrefix defaults to 128, a different
+// address. ExcludeASNs skips exits whose prefix origin is one of them.
+// Exits without a known origin are never excluded by ASN.
+type PoolConstraints struct {
+	DistinctPrefix int   `json:"distinct_prefix,omitempty"`
+	DistinctLast   int   `json:"distinct_last,omitempty"`
+	ExcludeASNs    []int `json:"exclude_asns,omitempty"`
+}
+
+// PrefixOrigin records the autonomous system an exit prefix is announced
+// from. The longest prefix containing an exit's address applies.
+type PrefixOrigin struct {
+	Prefix string `json:"prefix"` // CIDR, e.g. "2001:db8::/32"
+	ASN    int    `json:"asn"`
+	Name   string `json:"name,omitempty"` // operator, for reference
+}
+
+// ContentPolicy limits what proxied HTTP responses may carry. A user's
+// policy applies on top of the pool's: the smaller size limit wins and
+// blocked types add up. BlockedTypes are media types ("video/mp4") or
+// wildcards over a top-level type ("video/*"). Zero MaxResponseBytes means
+// no limit.
+type ContentPolicy struct {
+	MaxResponseBytes int64    `json:"max_response_bytes,omitempty"`
+	BlockedTypes     []string `json:"blocked_types,omitempty"`
+}
+
+// AccessWindow is a recurring period during which a user's credentials are
+// accepted. Days are three-letter weekday names ("mon", "tue", ...) or "*";
+// Start and End are "HH:MM" and End may be earlier than Start to wrap past
+// midnight; an End equal to Start makes the window last 24 hours. Timezone
+// is an IANA name and defaults to UTC.
+type AccessWindow struct {
+	Days     []string `json:"days,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// DestinationPolicy restricts which targets a user may reach. Entries are
+// host patterns ("example.com", "*.example.com") or CIDRs ("10.0.0.0/8"),
+// optionally followed by a port ("example.com:443", "*:22"). Deny entries
+// win over allow entries and an empty allow list permits everything not
+// denied.
+type DestinationPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
 }
\ No newline at end of file